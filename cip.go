@@ -17,16 +17,27 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	// nolint[lll]
 	guuid "github.com/google/uuid"
 	"k8s.io/klog"
 	"sigs.k8s.io/k8s-container-image-promoter/lib/audit"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
 	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/jobspec"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/metrics"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/remotemanifest"
 	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/webhook"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
 )
 
@@ -39,17 +50,29 @@ var GitCommit string
 // TimestampUtcRfc3339 is stamped by bazel.
 var TimestampUtcRfc3339 string
 
-// nolint[gocyclo]
 func main() {
+	err := run()
+	if err != nil {
+		klog.Error(err)
+	}
+	klog.Flush()
+	os.Exit(reg.ExitCodeOf(err))
+}
+
+// run runs the promoter as configured by the flags. The exit code of the
+// process is derived from the returned error (see reg.ExitCodeOf()).
+//
+// nolint[gocyclo]
+func run() error {
 	// klog uses the "v" flag in order to set the verbosity level
 	klog.InitFlags(nil)
 
 	manifestPtr := flag.String(
-		"manifest", "", "the manifest file to load")
+		"manifest", "", "the manifest file to load (or a directory, in which case all *.yaml manifests within it are merged into one); it can also be downloaded from an 'https://...' URL, or from a Git repository as 'git::<repo URL>[//<path>][?ref=<branch>]'")
 	thinManifestDirPtr := flag.String(
 		"thin-manifest-dir",
 		"",
-		"recursively read in all manifests within a folder, but all manifests MUST be 'thin' manifests named 'promoter-manifest.yaml', which are like regular manifests but instead of defining the 'images: ...' field directly, the 'imagesPath' field must be defined that points to another YAML file containing the 'images: ...' contents")
+		"recursively read in all manifests within a folder, but all manifests MUST be 'thin' manifests named 'promoter-manifest.yaml', which are like regular manifests but instead of defining the 'images: ...' field directly, the 'imagesPath' field must be defined that points to another YAML file containing the 'images: ...' contents; the folder can also be in a Git repository, as 'git::<repo URL>[//<path>][?ref=<branch>]'")
 	threadsPtr := flag.Int(
 		"threads",
 		10, "number of concurrent goroutines to use when talking to GCR")
@@ -67,6 +90,22 @@ func main() {
 		true,
 		"print what would have happened by running this tool;"+
 			" do not actually modify any registry")
+	dryRunDiffPtr := flag.Bool(
+		"dry-run-diff",
+		false,
+		"print the promotions that would be executed (grouped by destination registry, with the number of bytes to transfer if known), and exit without modifying any registry")
+	prunePtr := flag.Bool(
+		"prune",
+		false,
+		"also delete the tags of the destination images that are not in the manifests, so that the destination registries mirror them; only the tags of images listed in the 'allowedRemovals' of their manifest can be deleted (see -dry-run to preview the deletions)")
+	garbageCollectPtr := flag.Bool(
+		"garbage-collect",
+		false,
+		"after promoting, delete the untagged images of the destination repositories that are neither in the manifests nor referenced by a manifest list (see -dry-run to list them, with their sizes)")
+	verifyPtr := flag.Bool(
+		"verify",
+		false,
+		"read-only: compare the destination registries with the manifests, print the digests and tags that are missing from them or not declared in the manifests, and exit with a non-zero status if there are any; nothing is promoted or deleted")
 	keyFilesPtr := flag.String(
 		"key-files",
 		"",
@@ -129,27 +168,293 @@ func main() {
 		"GCP project ID (name); used for labeling error reporting logs to GCP")
 	maxImageSizePtr := flag.Int(
 		"max-image-size",
-		2048,
+		reg.DefaultMaxImageSize,
 		"The maximum image size (MiB) allowed for promotion and must be a positive value (othwerise set to the default value of 2048 MiB)")
 	if *maxImageSizePtr <= 0 {
-		*maxImageSizePtr = 2048
+		*maxImageSizePtr = reg.DefaultMaxImageSize
 	}
+	listingCacheDirPtr := flag.String(
+		"listing-cache-dir",
+		"",
+		"cache the tag/digest listings of registries in this directory, to avoid reading them over the network on every run (default: no caching)")
+	listingCacheTTLPtr := flag.Duration(
+		"listing-cache-ttl",
+		time.Hour,
+		"(only works with -listing-cache-dir) how long cached listings remain valid; 0 means forever")
+	refreshListingCachePtr := flag.Bool(
+		"refresh-listing-cache",
+		false,
+		"(only works with -listing-cache-dir) ignore cached listings and read all registries over the network, updating the cache")
+	maxRetriesPtr := flag.Int(
+		"max-retries",
+		reg.DefaultMaxRetries,
+		"number of times to retry registry reads that fail with a transient error")
+	retryBaseDelayPtr := flag.Duration(
+		"retry-base-delay",
+		reg.DefaultRetryBaseDelay,
+		"how long to wait before the first retry of a failed registry read; the delay doubles with every retry")
+	registryQPSPtr := flag.Float64(
+		"registry-qps",
+		0,
+		"maximum average number of registry requests per second, shared by all threads (0 means no limit)")
+	registryBurstPtr := flag.Int(
+		"registry-burst",
+		1,
+		"(only works with -registry-qps) number of registry requests that may be sent at once, above the -registry-qps rate")
+	maxParallelImagesPtr := flag.Int(
+		"max-parallel-images",
+		reg.DefaultMaxParallelImages,
+		"number of images to copy at the same time during promotion (also limited by -threads)")
+	concurrencyPtr := flag.Int(
+		"concurrency",
+		0,
+		"maximum number of registry reads, image size lookups and image copies in flight at the same time, all together (0 means no shared limit)")
+	timeoutPtr := flag.Duration(
+		"timeout",
+		0,
+		"give up on the whole run after this long; the images that are not promoted by then are reported as failed (default: no limit)")
+	copyTimeoutPtr := flag.Duration(
+		"copy-timeout",
+		reg.DefaultCopyTimeout,
+		"give up on the copy of a single image after this long, reporting it as failed and carrying on with the other images; 0 means no limit")
+	filterImagePtr := flag.String(
+		"filter-image",
+		"",
+		"only promote the images whose name matches this shell pattern (e.g. 'foo-*'; '*' does not match the '/' of nested image names), leaving the rest of the manifests untouched; cannot be used with -prune or -garbage-collect (default: all images)")
+	filterTagPtr := flag.String(
+		"filter-tag",
+		"",
+		"only promote the tags that match this shell pattern (e.g. 'v1.2.*'); like -filter-image, it cannot be used with -prune or -garbage-collect (default: all tags)")
+	destPrefixPtr := flag.String(
+		"dest-prefix",
+		"",
+		"promote all images below this path of the destination registries (e.g. 'mirror' promotes the image 'foo' to 'gcr.io/bar/mirror/foo'); the source images are unchanged; cannot be used with -prune or -garbage-collect (default: promote images under their own names)")
+	destRegistryPtr := flag.String(
+		"dest-registry",
+		"",
+		"only promote to this destination registry of the manifests (e.g. 'us.gcr.io/bar'); the images to the other destination registries are skipped, and logged; cannot be used with -prune, -garbage-collect or -verify (default: all destination registries)")
+	logFormatPtr := flag.String(
+		"log-format",
+		logging.FormatText,
+		"format of the structured logs about promotions: 'text' (through klog) or 'json' (one JSON object per line on stderr)")
+	outputPtr := flag.String(
+		"output",
+		"text",
+		"format of the promotion results: 'text' (the regular logs) or 'json' (also print a JSON object listing the promoted, skipped and failed images to stdout)")
+	copyReferrersPtr := flag.Bool(
+		"copy-referrers",
+		false,
+		"also promote the referrers (signatures, SBOMs and attestations) of the promoted images, which are found by their tags next to the source digest ('sha256-<hex>', 'sha256-<hex>.sbom', 'sha256-<hex>.att' and 'sha256-<hex>.sig')")
+	referrersAPIPtr := flag.Bool(
+		"referrers-api",
+		true,
+		"with -copy-referrers, also find the referrers that are not tagged (signatures, attestations, provenance) with the OCI referrers API, and promote them by digest; registries that do not support the API only have their tagged referrers promoted. With -garbage-collect, keep the untagged referrers of the kept images")
+	platformsPtr := flag.String(
+		"platforms",
+		"",
+		"comma-separated platforms (e.g. 'linux/amd64,linux/arm64') to keep in the promoted manifest lists; the other images are dropped from them, so the promoted manifest lists get new digests (default: promote manifest lists as they are)")
+	skipMissingPlatformsPtr := flag.Bool(
+		"skip-missing-platforms",
+		false,
+		"drop the images which are missing from the source registry (e.g. garbage collected) from the promoted manifest lists, instead of failing; the promoted manifest lists then get new digests")
+	additiveOnlyPtr := flag.Bool(
+		"additive-only",
+		false,
+		"only promote tags that are not in the destination yet; fail (before promoting anything) if a tag of the manifests already points to another digest in the destination, instead of moving it (cannot be used with -prune or -garbage-collect)")
+	sincePtr := flag.String(
+		"since",
+		"",
+		"only promote the images that were uploaded to the source registry since this time, as a timestamp (e.g. '2020-06-01T00:00:00Z'), a date (e.g. '2020-06-01') or an age (e.g. '30d' or '36h'); older images, and images whose upload time the registry does not report, are skipped (default: promote images of any age)")
+	verifyDigestsPtr := flag.Bool(
+		"verify-digests",
+		false,
+		"read back every image after copying it, and fail its promotion unless it has the same digest in the destination as in the source (e.g., because a registry or proxy re-encoded the manifest); cannot be used with -platforms (default: false)")
+	keepGoingPtr := flag.Bool(
+		"keep-going",
+		false,
+		"once every promotion has been attempted, fail the run with an error listing all the failed ones, if any (default: fail the run with a generic error; the failures are only logged)")
+	quietPtr := flag.Bool(
+		"quiet",
+		false,
+		"do not report the progress of the promotion (default: report it on stderr every -progress-interval, as text if stderr is a terminal, or as JSON events with -output=json)")
+	progressIntervalPtr := flag.Duration(
+		"progress-interval",
+		reg.DefaultProgressInterval,
+		"how often to report the progress of the promotion (see -quiet)")
+	annotateSourcesPtr := flag.Bool(
+		"annotate-sources",
+		false,
+		"point every promoted image back to the manifest file and line that declares its digest, in the JSON output (see -output) and in the -dry-run-diff table")
+	signKeyPtr := flag.String(
+		"sign-key",
+		"",
+		"after promoting, sign the destination digest of every promoted image with cosign, using this key reference (e.g. 'gcpkms://projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>'); the 'cosign' binary must be in PATH (default: no signing)")
+	signFailOnErrorPtr := flag.Bool(
+		"sign-fail-on-error",
+		false,
+		"(only works with -sign-key) fail the run if any promoted image could not be signed (default: only report the failures)")
+	webhookURLPtr := flag.String(
+		"webhook-url",
+		"",
+		"after promoting, POST a JSON summary of the promotion to this URL; the request is signed with the secret in the CIP_WEBHOOK_SECRET environment variable, if set (default: no notification)")
+	auditLogPtr := flag.String(
+		"audit-log",
+		"",
+		"append a JSON line to this file for every image copied or deleted (by promotion, -prune or -garbage-collect), as soon as it is done (default: no audit log; nothing is recorded in dry runs)")
+	metricsAddrPtr := flag.String(
+		"metrics-addr",
+		"",
+		"serve Prometheus metrics about the promotion on this address (e.g. ':9090'), at /metrics (default: no metrics)")
+	emitJobPtr := flag.Bool(
+		"emit-job",
+		false,
+		"print the Kubernetes Job (or CronJob, with -job-schedule) which runs cip with the other flags given, and exit without doing anything else (default: false)")
+	jobNamePtr := flag.String(
+		"job-name",
+		jobspec.DefaultName,
+		"the name of the Job for -emit-job")
+	jobNamespacePtr := flag.String(
+		"job-namespace",
+		"",
+		"the namespace of the Job for -emit-job (default: none, i.e. the namespace it is applied to)")
+	jobImagePtr := flag.String(
+		"job-image",
+		jobspec.DefaultImage,
+		"the cip image run by the Job for -emit-job")
+	jobServiceAccountPtr := flag.String(
+		"job-service-account",
+		"",
+		"the Kubernetes service account the Job for -emit-job runs as (default: the default service account of the namespace)")
+	jobSchedulePtr := flag.String(
+		"job-schedule",
+		"",
+		"emit a CronJob with this cron schedule (e.g. '0 3 * * *') instead of a Job, for -emit-job")
 	flag.Parse()
+	start := time.Now()
+
+	// Cancel all registry reads, checks and copies on CTRL-C (or SIGTERM), or
+	// once the run takes longer than -timeout.
+	ctx := context.Background()
+	if *timeoutPtr > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		klog.Warningf("received %v; cancelling", sig)
+		cancel()
+	}()
+
+	logger, logErr := logging.NewLogger(*logFormatPtr, os.Stderr)
+	if logErr != nil {
+		return logErr
+	}
+	logging.SetLogger(logger)
+
+	if *outputPtr != "text" && *outputPtr != "json" {
+		return fmt.Errorf(
+			"invalid value %q for -output (allowed values: 'text' or 'json')",
+			*outputPtr)
+	}
+
+	// Pruning and garbage collection must see all the edges of the
+	// manifests, or they would delete what was merely filtered out.
+	filtering := len(*filterImagePtr) > 0 || len(*filterTagPtr) > 0
+	if filtering && (*prunePtr || *garbageCollectPtr) {
+		return errors.New(
+			"-filter-image and -filter-tag cannot be used with -prune or -garbage-collect")
+	}
+	// Likewise, verification must see all the edges of the manifests, or it
+	// would report what was merely filtered out as extra.
+	if filtering && *verifyPtr {
+		return errors.New(
+			"-filter-image and -filter-tag cannot be used with -verify")
+	}
+	// Pruning and garbage collection go by the image names of the manifests,
+	// which the prefix does not apply to.
+	if len(*destPrefixPtr) > 0 && (*prunePtr || *garbageCollectPtr) {
+		return errors.New(
+			"-dest-prefix cannot be used with -prune or -garbage-collect")
+	}
+	// Likewise, pruning, garbage collection and verification must see all the
+	// destination registries of the manifests.
+	if len(*destRegistryPtr) > 0 &&
+		(*prunePtr || *garbageCollectPtr || *verifyPtr) {
+		return errors.New(
+			"-dest-registry cannot be used with -prune, -garbage-collect or -verify")
+	}
+	// Additive-only runs must never remove anything from the destinations.
+	if *additiveOnlyPtr && (*prunePtr || *garbageCollectPtr) {
+		return errors.New(
+			"-additive-only cannot be used with -prune or -garbage-collect")
+	}
+
+	// Filtered manifest lists get new digests on purpose.
+	if *verifyDigestsPtr && len(*platformsPtr) > 0 {
+		return errors.New("-verify-digests cannot be used with -platforms")
+	}
+	if *verifyDigestsPtr && *skipMissingPlatformsPtr {
+		return errors.New(
+			"-verify-digests cannot be used with -skip-missing-platforms")
+	}
+
+	if *registryQPSPtr < 0 || *registryBurstPtr < 1 {
+		return errors.New(
+			"-registry-qps cannot be negative, and -registry-burst must be at least 1")
+	}
+	if *concurrencyPtr < 0 {
+		return errors.New("-concurrency cannot be negative")
+	}
+
+	jobFlagSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "emit-job" && jobspec.IsJobFlag(f.Name) {
+			jobFlagSet = true
+		}
+	})
+	if jobFlagSet && !*emitJobPtr {
+		return errors.New("the -job-* flags can only be used with -emit-job")
+	}
+	if *emitJobPtr && *manifestPtr == "" && *thinManifestDirPtr == "" {
+		return errors.New("-emit-job requires -manifest or -thin-manifest-dir")
+	}
 
 	if len(os.Args) == 1 {
 		printVersion()
 		printUsage()
-		os.Exit(0)
+		return nil
 	}
 
 	if *helpPtr {
 		printUsage()
-		os.Exit(0)
+		return nil
 	}
 
 	if *versionPtr {
 		printVersion()
-		os.Exit(0)
+		return nil
+	}
+
+	if *emitJobPtr {
+		args := jobspec.FlagArgs(flag.CommandLine, jobspec.IsJobFlag)
+		spec, err := jobspec.Generate(jobspec.Options{
+			Name:           *jobNamePtr,
+			Namespace:      *jobNamespacePtr,
+			Image:          *jobImagePtr,
+			ServiceAccount: *jobServiceAccountPtr,
+			Schedule:       *jobSchedulePtr,
+			Args:           args,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(spec))
+		return nil
 	}
 
 	if *auditorPtr {
@@ -168,7 +473,7 @@ func main() {
 			*auditManifestPathPtr,
 			uuid)
 		if err != nil {
-			klog.Exitln(err)
+			return err
 		}
 		auditServerContext.RunAuditor()
 	}
@@ -176,7 +481,7 @@ func main() {
 	// Activate service accounts.
 	if useServiceAccount && len(*keyFilesPtr) > 0 {
 		if err := gcloud.ActivateServiceAccounts(*keyFilesPtr); err != nil {
-			klog.Exitln(err)
+			return err
 		}
 	}
 
@@ -212,15 +517,22 @@ func main() {
 		}
 	} else {
 		if *manifestPtr == "" && *thinManifestDirPtr == "" {
-			klog.Fatal(fmt.Errorf("one of -manifest or -thin-manifest-dir is required"))
+			return errors.New(
+				"one of -manifest or -thin-manifest-dir is required")
 		}
 	}
 
 	doingPromotion := false
 	if *manifestPtr != "" {
-		mfest, err = reg.ParseManifestFromFile(*manifestPtr)
+		manifestPath, cleanup, err := remotemanifest.Download(*manifestPtr)
 		if err != nil {
-			klog.Fatal(err)
+			return err
+		}
+		defer cleanup()
+
+		mfest, err = reg.ParseManifestFromFile(manifestPath)
+		if err != nil {
+			return err
 		}
 		mfests = append(mfests, mfest)
 		for _, registry := range mfest.Registries {
@@ -232,13 +544,20 @@ func main() {
 			*dryRunPtr,
 			useServiceAccount)
 		if err != nil {
-			klog.Fatal(err)
+			return err
 		}
 		doingPromotion = true
 	} else if *thinManifestDirPtr != "" {
-		mfests, err = reg.ParseThinManifestsFromDir(*thinManifestDirPtr)
+		thinManifestDir, cleanup, err := remotemanifest.Download(
+			*thinManifestDirPtr)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		mfests, err = reg.ParseThinManifestsFromDir(thinManifestDir)
 		if err != nil {
-			klog.Exitln(err)
+			return err
 		}
 
 		sc, err = reg.MakeSyncContext(
@@ -247,22 +566,122 @@ func main() {
 			*dryRunPtr,
 			useServiceAccount)
 		if err != nil {
-			klog.Fatal(err)
+			return err
 		}
 		doingPromotion = true
 	}
 
 	if *parseOnlyPtr {
-		os.Exit(0)
+		return nil
+	}
+
+	if doingPromotion {
+		sc.MaxRetries = *maxRetriesPtr
+		sc.RetryBaseDelay = *retryBaseDelayPtr
+		sc.RateLimiter = reg.NewRateLimiter(*registryQPSPtr, *registryBurstPtr)
+		sc.MaxParallelImages = *maxParallelImagesPtr
+		sc.Budget = reg.NewBudget(*concurrencyPtr)
+		sc.CopyTimeout = *copyTimeoutPtr
+		sc.CopyReferrers = *copyReferrersPtr
+		sc.ReferrersAPI = *referrersAPIPtr
+		sc.AdditiveOnly = *additiveOnlyPtr
+		sc.VerifyDigests = *verifyDigestsPtr
+		sc.Since, err = reg.ParseSince(*sincePtr, time.Now())
+		if err != nil {
+			return err
+		}
+		sc.KeepGoing = *keepGoingPtr
+		sc.ProgressInterval = *progressIntervalPtr
+		switch {
+		case *quietPtr:
+		case *outputPtr == "json":
+			sc.Progress = &reg.JSONProgressReporter{Out: os.Stderr}
+		case isTerminal(os.Stderr):
+			sc.Progress = &reg.TextProgressReporter{Out: os.Stderr}
+		}
+		sc.Platforms, err = reg.ParsePlatforms(*platformsPtr)
+		if err != nil {
+			return err
+		}
+		sc.SkipMissingPlatforms = *skipMissingPlatformsPtr
+	}
+
+	if doingPromotion && *annotateSourcesPtr {
+		sc.Positions, err = reg.ManifestPositions(mfests)
+		if err != nil {
+			return err
+		}
+	}
+
+	if doingPromotion && len(*auditLogPtr) > 0 {
+		sc.AuditLog, err = auditlog.Open(*auditLogPtr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if doingPromotion && len(*metricsAddrPtr) > 0 {
+		sc.Metrics = metrics.New()
+		if err := sc.Metrics.Serve(*metricsAddrPtr); err != nil {
+			return err
+		}
+	}
+
+	if doingPromotion && len(*listingCacheDirPtr) > 0 {
+		sc.ListingCache = reg.MakeDiskListingCache(
+			*listingCacheDirPtr,
+			*listingCacheTTLPtr)
+		sc.RefreshListingCache = *refreshListingCachePtr
 	}
 
 	// If there are no images in the manifest, it may be a stub manifest file
 	// (such as for brand new registries that would be watched by the promoter
 	// for the very first time).
 	if doingPromotion && len(*manifestBasedSnapshotOf) == 0 {
+		// Catch manifests which would promote in the wrong direction before
+		// reading anything from the registries.
+		err = reg.MKRealSourceRegistryFlagCheck(mfests).Run()
+		if err != nil {
+			return err
+		}
+		// Resolve the tag patterns of the manifests, so that the checks and
+		// the promotion see concrete tags.
+		err = sc.ExpandTagPatterns(ctx, mfests, reg.MkReadRepositoryCmdReal)
+		if err != nil {
+			return err
+		}
+		err = reg.MKRealDuplicateImageCheck(mfests).Run()
+		if err != nil {
+			return err
+		}
 		promotionEdges, err = reg.ToPromotionEdges(mfests)
 		if err != nil {
-			klog.Exitln(err)
+			return err
+		}
+		promotionEdges, err = reg.PrefixPromotionEdges(
+			promotionEdges,
+			*destPrefixPtr)
+		if err != nil {
+			return err
+		}
+		promotionEdges, err = reg.SelectDestinationEdges(
+			promotionEdges,
+			reg.RegistryName(*destRegistryPtr))
+		if err != nil {
+			return err
+		}
+
+		if filtering {
+			promotionEdges, err = reg.SelectPromotionEdges(
+				promotionEdges,
+				*filterImagePtr,
+				*filterTagPtr)
+			if err != nil {
+				return err
+			}
+			if len(promotionEdges) == 0 {
+				klog.Info("No images match -filter-image and -filter-tag --- nothing to promote.")
+			}
 		}
 
 		imagesInManifests := false
@@ -274,7 +693,7 @@ func main() {
 		}
 		if !imagesInManifests {
 			klog.Info("No images in manifest(s) --- nothing to do.")
-			os.Exit(0)
+			return nil
 		}
 
 		// Print version to make Prow logs more self-explanatory.
@@ -292,16 +711,20 @@ func main() {
 		if len(*manifestBasedSnapshotOf) > 0 {
 			promotionEdges, err = reg.ToPromotionEdges(mfests)
 			if err != nil {
-				klog.Exitln(err)
+				return err
 			}
 			rii = reg.EdgesToRegInvImage(promotionEdges,
 				*manifestBasedSnapshotOf)
 
 			if *minimalSnapshotPtr {
-				sc.ReadRegistries(
+				err = sc.ReadRegistries(
+					ctx,
 					[]reg.RegistryContext{*srcRegistry},
 					true,
 					reg.MkReadRepositoryCmdReal)
+				if err != nil {
+					return err
+				}
 				sc.ReadGCRManifestLists(reg.MkReadManifestListCmdReal)
 				rii = sc.RemoveChildDigestEntries(rii)
 			}
@@ -312,14 +735,18 @@ func main() {
 				*dryRunPtr,
 				useServiceAccount)
 			if err != nil {
-				klog.Fatal(err)
+				return err
 			}
-			sc.ReadRegistries(
+			err = sc.ReadRegistries(
+				ctx,
 				[]reg.RegistryContext{*srcRegistry},
 				// Read all registries recursively, because we want to produce a
 				// complete snapshot.
 				true,
 				reg.MkReadRepositoryCmdReal)
+			if err != nil {
+				return err
+			}
 
 			rii = sc.Inv[mfests[0].Registries[0].Name]
 			if snapshotTag != "" {
@@ -343,7 +770,23 @@ func main() {
 			snapshot = rii.ToYAML(reg.YamlMarshalingOpts{})
 		}
 		fmt.Print(snapshot)
-		os.Exit(0)
+		return nil
+	}
+
+	if *verifyPtr {
+		verifyResult, err := sc.VerifyDestinations(
+			ctx,
+			promotionEdges,
+			reg.MkReadRepositoryCmdReal)
+		if err != nil {
+			return err
+		}
+		fmt.Print(verifyResult)
+		if verifyResult.HasDrift() {
+			return errors.New(
+				"the destination registries do not match the manifests")
+		}
+		return nil
 	}
 
 	if *jsonLogSummaryPtr {
@@ -352,9 +795,9 @@ func main() {
 
 	// Check the pull request
 	if *dryRunPtr {
-		err = sc.RunChecks([]reg.PreCheck{})
+		err = sc.RunChecks(ctx, []reg.PreCheck{})
 		if err != nil {
-			klog.Exitln(err)
+			return err
 		}
 	}
 
@@ -377,15 +820,110 @@ func main() {
 			tp)
 		return &sp
 	}
-	promotionEdges, ok := sc.FilterPromotionEdges(promotionEdges, true)
+	allEdges := promotionEdges
+	promotionEdges, ok := sc.FilterPromotionEdges(ctx, promotionEdges, true)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	// If any funny business was detected during a comparison of the manifests
 	// with the state of the registries, then exit immediately.
 	if !ok {
-		klog.Exitln("encountered errors during edge filtering")
+		return errors.New("encountered errors during edge filtering")
+	}
+	// The destination registries were read by FilterPromotionEdges(), so the
+	// tags to prune can be computed now. Check them before promoting anything,
+	// so that an accidental prune does not leave a half-done promotion behind.
+	var pruneEdges map[reg.PromotionEdge]interface{}
+	if *prunePtr {
+		pruneEdges = sc.GetPruneEdges(allEdges)
+		err = reg.CheckPruneEdges(mfests, allEdges, pruneEdges)
+		if err != nil {
+			return err
+		}
+	}
+	if *dryRunDiffPtr {
+		fmt.Print(sc.PromotionDiff(promotionEdges))
+		return nil
+	}
+	result, err := sc.Promote(ctx, promotionEdges, mkProducer, nil)
+	counts := result.Counts()
+	var signErr error
+	if len(*signKeyPtr) > 0 {
+		mkSignProducer := func(fqin string) stream.Producer {
+			var sp stream.Subprocess
+			sp.CmdInvocation = reg.GetSignCmd(*signKeyPtr, fqin)
+			return &sp
+		}
+		signErr = sc.SignPromotedImages(&result, mkSignProducer)
+	}
+	if len(*webhookURLPtr) > 0 {
+		manifest := *manifestPtr
+		if len(manifest) == 0 {
+			manifest = *thinManifestDirPtr
+		}
+		summary := webhook.Summary{
+			Manifest:        manifest,
+			DryRun:          result.DryRun,
+			Promoted:        counts.Promoted,
+			Skipped:         counts.Skipped,
+			Failed:          counts.Failed,
+			DurationSeconds: time.Since(start).Seconds(),
+		}
+		notifier := webhook.New(
+			*webhookURLPtr,
+			os.Getenv("CIP_WEBHOOK_SECRET"))
+		// A failed notification does not fail the promotion.
+		if notifyErr := notifier.Notify(summary); notifyErr != nil {
+			klog.Error(notifyErr)
+		}
+	}
+	if *outputPtr == "json" {
+		out, jsonErr := result.ToJSON()
+		if jsonErr != nil {
+			return jsonErr
+		}
+		fmt.Println(out)
 	}
-	err = sc.Promote(promotionEdges, mkProducer, nil)
 	if err != nil {
-		klog.Exitln(err)
+		return err
+	}
+	if signErr != nil && *signFailOnErrorPtr {
+		return signErr
+	}
+	if *prunePtr {
+		err = sc.Prune(ctx, pruneEdges, mkProducer, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if *garbageCollectPtr {
+		err = sc.ReadGarbageCollectionInventory(ctx, allEdges)
+		if err != nil {
+			return err
+		}
+		mkDeleteProducer := func(
+			rc reg.RegistryContext,
+			imageName reg.ImageName,
+			digest reg.Digest) stream.Producer {
+			var sp stream.Subprocess
+			sp.CmdInvocation = reg.GetDeleteCmd(
+				rc,
+				sc.UseServiceAccount,
+				imageName,
+				digest,
+				false)
+			return &sp
+		}
+		for _, mfest := range mfests {
+			sc.GarbageCollect(ctx, mfest, mkDeleteProducer, nil)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := sc.AuditLog.Close(); err != nil {
+		return err
 	}
 
 	if *dryRunPtr {
@@ -393,6 +931,14 @@ func main() {
 	} else {
 		klog.Info("********** FINISHED **********")
 	}
+
+	return nil
+}
+
+// isTerminal returns true if f is a terminal, rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 func printVersion() {
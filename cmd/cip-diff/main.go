@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"k8s.io/klog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		// nolint[gomnd]
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	klog.InitFlags(nil)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] OLD NEW\n", os.Args[0])
+		fmt.Fprintln(os.Stderr,
+			"OLD and NEW are manifest files or thin manifest directories.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// nolint[gomnd]
+	if flag.NArg() != 2 {
+		flag.Usage()
+		return fmt.Errorf("expected 2 manifest paths, got %d", flag.NArg())
+	}
+
+	oldEdges, err := readEdges(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	newEdges, err := readEdges(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	d := reg.DiffPromotionEdges(oldEdges, newEdges)
+	fmt.Print(d.String())
+	return nil
+}
+
+// readEdges computes the promotion edges of the manifest file, or of the
+// thin manifests in the directory, at the given path.
+func readEdges(path string) (map[reg.PromotionEdge]interface{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mfests []reg.Manifest
+	if info.IsDir() {
+		mfests, err = reg.ParseThinManifestsFromDir(path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		mfest, err := reg.ParseManifestFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		mfests = []reg.Manifest{mfest}
+	}
+
+	edges, err := reg.ToPromotionEdges(mfests)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not compute the promotion edges of %s: %v", path, err)
+	}
+	return edges, nil
+}
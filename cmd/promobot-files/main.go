@@ -36,12 +36,12 @@ func main() {
 		&options.FilestoresPath,
 		"filestores",
 		options.FilestoresPath,
-		"the manifest of filestores (REQUIRED)")
+		"the manifest of filestores (REQUIRED).  It can also be an 'https://...' URL or a 'git::<repo URL>[//<path>][?ref=<branch>]' location.")
 	flag.StringVar(
 		&options.FilesPath,
 		"files",
 		options.FilesPath,
-		"path to the files manifest (REQUIRED).  A directory can be specified.")
+		"path to the files manifest (REQUIRED).  A directory can be specified, also within a Git repository as 'git::<repo URL>[//<path>][?ref=<branch>]'.")
 	flag.BoolVar(
 		&options.DryRun,
 		"dry-run",
@@ -56,8 +56,108 @@ func main() {
 		"allow service account usage with gcloud calls"+
 			" (default: false)")
 
+	flag.IntVar(
+		&options.Workers,
+		"workers",
+		options.Workers,
+		"the number of files to upload concurrently")
+
+	flag.BoolVar(
+		&options.Force,
+		"force",
+		options.Force,
+		"copy all files, even those that already exist in the destination"+
+			" with the expected sha256 (default: false)")
+
+	flag.BoolVar(
+		&options.Prune,
+		"prune",
+		options.Prune,
+		"delete the files of the destinations that are not in the manifest,"+
+			" so that they mirror it exactly; review them with -dry-run"+
+			" first (default: false)")
+
+	var contentTypes string
+	flag.StringVar(
+		&contentTypes,
+		"content-types",
+		"",
+		"comma-separated '<extension>=<content type>' overrides for the content type of uploaded files (e.g. '.html=text/html,.sig=text/plain'); by default it is detected from the extension")
+
+	var gzipExtensions string
+	flag.StringVar(
+		&gzipExtensions,
+		"gzip-extensions",
+		"",
+		"comma-separated extensions of the files to store gzip-compressed, with a 'gzip' content encoding (e.g. '.txt,.html'); only supported for gs:// destinations")
+
+	flag.BoolVar(
+		&options.SniffContentType,
+		"sniff-content-type",
+		options.SniffContentType,
+		"detect the content type of files with unknown extensions"+
+			" from their contents (default: false)")
+
+	flag.Int64Var(
+		&options.MaxTotalFileSize,
+		"max-total-file-size",
+		options.MaxTotalFileSize,
+		"the max total size of the files to upload, in MiB; the promotion"+
+			" fails if they are larger (default: 0, no limit)")
+
+	flag.IntVar(
+		&options.UploadRetries,
+		"upload-retries",
+		options.UploadRetries,
+		"the number of times an upload that fails with a transient error"+
+			" is retried")
+
+	flag.DurationVar(
+		&options.UploadRetryBaseDelay,
+		"upload-retry-delay",
+		options.UploadRetryBaseDelay,
+		"how long to wait before the first retry of a failed upload;"+
+			" the delay doubles with every retry")
+
+	flag.BoolVar(
+		&options.VerifyReadBack,
+		"verify-read-back",
+		options.VerifyReadBack,
+		"download every uploaded file again, and fail its promotion if its"+
+			" sha256 does not match the manifest; this doubles the"+
+			" egress (default: false)")
+
+	flag.StringVar(
+		&options.ManifestVerifyKey,
+		"manifest-verify-key",
+		options.ManifestVerifyKey,
+		"verify the signature of the files manifest with this public key (a PEM file, or a cosign key reference such as 'gcpkms://...') before promoting anything; the files manifest must then be a single file")
+
+	flag.StringVar(
+		&options.ManifestSignaturePath,
+		"manifest-signature",
+		options.ManifestSignaturePath,
+		"the detached signature of the files manifest, for -manifest-verify-key (default: the -files path with a '.sig' suffix).  It can also be a remote location, like -files")
+
+	flag.StringVar(
+		&options.AuditLogPath,
+		"audit-log",
+		options.AuditLogPath,
+		"append a JSON line to this file for every file uploaded or deleted"+
+			" (or failed), as soon as it is done; nothing is recorded"+
+			" in dry runs")
+
 	flag.Parse()
 
+	var err error
+	options.ContentTypes, err = cmd.ParseContentTypes(contentTypes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		// nolint[gomnd]
+		os.Exit(1)
+	}
+	options.GzipExtensions = cmd.ParseExtensions(gzipExtensions)
+
 	ctx := context.Background()
 	if err := cmd.RunPromoteFiles(ctx, options); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
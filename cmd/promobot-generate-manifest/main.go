@@ -20,8 +20,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/xerrors"
 	"k8s.io/klog"
@@ -43,6 +45,9 @@ func main() {
 func run(ctx context.Context) error {
 	klog.InitFlags(nil)
 
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+
 	src := ""
 	flag.StringVar(
 		&src,
@@ -50,20 +55,75 @@ func run(ctx context.Context) error {
 		src,
 		"the base directory to copy from")
 
+	flag.BoolVar(
+		&opt.SHA512,
+		"sha512",
+		opt.SHA512,
+		"also record the sha512 hash of each file")
+
+	flag.IntVar(
+		&opt.Threads,
+		"threads",
+		opt.Threads,
+		"number of files to hash concurrently")
+
+	exclude := ""
+	flag.StringVar(
+		&exclude,
+		"exclude",
+		exclude,
+		"comma-separated glob patterns of files and directories to skip (e.g. .git,*.tmp)")
+
+	include := ""
+	flag.StringVar(
+		&include,
+		"include",
+		include,
+		"comma-separated glob patterns of the files to hash (default all); --exclude takes precedence")
+
+	flag.BoolVar(
+		&opt.FollowSymlinks,
+		"follow-symlinks",
+		opt.FollowSymlinks,
+		"hash the targets of symlinks to files, instead of skipping symlinks")
+
+	flag.BoolVar(
+		&opt.ExcludeHidden,
+		"exclude-hidden",
+		opt.ExcludeHidden,
+		"skip the files and directories whose name starts with a '.', instead of hashing them")
+
+	signKey := ""
+	flag.StringVar(
+		&signKey,
+		"sign-key",
+		signKey,
+		"sign the manifest with this cosign key (a private key file, or a KMS key such as 'gcpkms://...'); requires --signature-output")
+
+	signatureOutput := ""
+	flag.StringVar(
+		&signatureOutput,
+		"signature-output",
+		signatureOutput,
+		"the file to which the detached signature of the manifest is written (e.g. files.yaml.sig)")
+
 	flag.Parse()
 
 	if src == "" {
 		return xerrors.New("must specify --src")
 	}
-
-	var opt cmd.GenerateManifestOptions
-	opt.PopulateDefaults()
+	if (signKey == "") != (signatureOutput == "") {
+		return xerrors.New(
+			"--sign-key and --signature-output must be specified together")
+	}
 
 	s, err := filepath.Abs(src)
 	if err != nil {
 		return xerrors.Errorf("cannot resolve %q to absolute path: %w", src, err)
 	}
 	opt.BaseDir = s
+	opt.Exclude = splitPatterns(exclude)
+	opt.Include = splitPatterns(include)
 
 	manifest, err := cmd.GenerateManifest(ctx, opt)
 	if err != nil {
@@ -75,9 +135,32 @@ func run(ctx context.Context) error {
 		return xerrors.Errorf("error serializing manifest: %w", err)
 	}
 
+	if signKey != "" {
+		sig, err := cmd.CosignSignBlob(ctx, manifestYAML, signKey)
+		if err != nil {
+			return xerrors.Errorf("error signing manifest: %w", err)
+		}
+		if err := ioutil.WriteFile(signatureOutput, sig, 0644); err != nil {
+			return xerrors.Errorf(
+				"error writing signature to %q: %w", signatureOutput, err)
+		}
+	}
+
 	if _, err := os.Stdout.Write(manifestYAML); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// splitPatterns splits a comma-separated list of patterns, ignoring empty
+// entries.
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
@@ -6,6 +6,7 @@ require (
 	cloud.google.com/go v0.50.0
 	cloud.google.com/go/logging v1.0.0
 	cloud.google.com/go/storage v1.5.0
+	github.com/go-logr/logr v0.4.0
 	github.com/google/go-containerregistry v0.0.0-20200219182403-4336215636f7
 	github.com/google/uuid v1.1.1
 	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
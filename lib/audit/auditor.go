@@ -284,10 +284,16 @@ func (s *ServerContext) Audit(w http.ResponseWriter, r *http.Request) {
 	}
 	logInfo.Printf("(%s): reading srcRegistries %q for %q", s.ID, srcRegistries, gcrPayload)
 
-	sc.ReadRegistries(
+	err = sc.ReadRegistries(
+		r.Context(),
 		srcRegistries,
 		true,
 		s.GcrReadingFacility.ReadRepo)
+	if err != nil {
+		msg := fmt.Sprintf("(%s) TRANSACTION REJECTED: %v", s.ID, err)
+		_, _ = w.Write([]byte(msg))
+		panic(msg)
+	}
 	sc.ReadGCRManifestLists(s.GcrReadingFacility.ReadManifestList)
 	if gcrPayload.Digest == "" {
 		msg := fmt.Sprintf("(%s) TRANSACTION REJECTED: digest missing from payload --- cannot check parent digest: %v", s.ID, gcrPayload.Digest)
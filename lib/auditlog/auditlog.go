@@ -0,0 +1,155 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package auditlog keeps an append-only record of the operations that change
+// registries or filestores (copies and deletions), as JSON lines. Every entry
+// is flushed to disk as soon as it is recorded, so that a run that crashes
+// still leaves a record of what it did until then.
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The kinds of things that are operated on.
+const (
+	KindImage = "image"
+	KindFile  = "file"
+)
+
+// The operations that are recorded.
+const (
+	OperationCopy   = "copy"
+	OperationDelete = "delete"
+)
+
+// The results of an operation.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Entry is a single operation, written as a line of JSON. Source is empty for
+// deletions. Digest is the digest of the image, or the "sha256:<hex>" hash of
+// the file. Manifest is the manifest file that declared the operation, if it
+// is known.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Operation   string    `json:"operation"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Digest      string    `json:"digest,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	Manifest    string    `json:"manifest,omitempty"`
+}
+
+// syncer is implemented by writers that can flush their contents to stable
+// storage, such as *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// Log writes Entries to Out, one per line; it is safe for concurrent use. A
+// nil *Log records nothing.
+//
+// Recording an entry never fails the operation it records: write errors are
+// logged, and the first one is returned by Close().
+type Log struct {
+	Out io.Writer
+	// Now returns the time of the entries (time.Now if nil).
+	Now func() time.Time
+
+	mutex sync.Mutex
+	err   error
+}
+
+// Open opens the audit log at path for appending, creating it if needed.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &Log{Out: f}, nil
+}
+
+// Record writes the entry (setting its Time if it is not set), and flushes it
+// if Out supports it.
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if e.Time.IsZero() {
+		now := time.Now
+		if l.Now != nil {
+			now = l.Now
+		}
+		e.Time = now().UTC()
+	}
+
+	if err := l.write(e); err != nil {
+		klog.Errorf("error writing to the audit log: %v", err)
+		if l.err == nil {
+			l.err = err
+		}
+	}
+}
+
+func (l *Log) write(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.Out.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if s, ok := l.Out.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close closes Out (if it is an io.Closer), and returns the first error met
+// while recording entries, if any.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.err
+	if c, ok := l.Out.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
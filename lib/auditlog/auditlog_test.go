@@ -0,0 +1,110 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auditlog
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{
+			Kind:        KindImage,
+			Operation:   OperationCopy,
+			Source:      "gcr.io/foo/a",
+			Destination: "gcr.io/bar/a",
+			Digest:      "sha256:000",
+			Tags:        []string{"1.0"},
+			Result:      ResultSuccess,
+			Manifest:    "manifests/a.yaml",
+		},
+		{
+			Kind:        KindFile,
+			Operation:   OperationDelete,
+			Destination: "gs://bar/a.txt",
+			Result:      ResultFailure,
+			Error:       "access denied",
+		},
+	}
+
+	// Every run appends to the log.
+	for _, e := range entries {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatalf("error opening audit log: %v", err)
+		}
+		l.Now = func() time.Time { return now }
+		l.Record(e)
+		if err := l.Close(); err != nil {
+			t.Fatalf("error closing audit log: %v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	expected := `{"time":"2020-05-01T12:00:00Z","kind":"image",` +
+		`"operation":"copy","source":"gcr.io/foo/a",` +
+		`"destination":"gcr.io/bar/a","digest":"sha256:000",` +
+		`"tags":["1.0"],"result":"success",` +
+		`"manifest":"manifests/a.yaml"}` + "\n" +
+		`{"time":"2020-05-01T12:00:00Z","kind":"file",` +
+		`"operation":"delete","destination":"gs://bar/a.txt",` +
+		`"result":"failure","error":"access denied"}` + "\n"
+	if string(b) != expected {
+		t.Errorf("expected audit log:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// A nil *Log records nothing (and does not panic)
+	var noop *Log
+	noop.Record(entries[0])
+	if err := noop.Close(); err != nil {
+		t.Errorf("unexpected error closing a nil log: %v", err)
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestLogWriteError(t *testing.T) {
+	l := &Log{Out: failingWriter{}}
+	l.Record(Entry{Kind: KindImage, Operation: OperationCopy})
+	l.Record(Entry{Kind: KindImage, Operation: OperationCopy})
+
+	err := l.Close()
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
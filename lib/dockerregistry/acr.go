@@ -0,0 +1,249 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/azure"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// ACRRefreshTokenUsername is the username that must be paired with an ACR
+// refresh token (see ExchangeACRRefreshToken) when authenticating against an
+// ACR registry.
+const ACRRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrCatalogPageSize is the number of repositories requested per page from
+// ACR's catalog API.
+const acrCatalogPageSize = 100
+
+// IsACRDomain returns true if the given hostname belongs to Azure Container
+// Registry, e.g. "myregistry.azurecr.io".
+func IsACRDomain(domain string) bool {
+	for _, suffix := range []string{
+		".azurecr.io",
+		".azurecr.cn",
+		".azurecr.us",
+	} {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acrClient is the RegistryClient for Azure Container Registry. ACR
+// implements the standard Docker Registry HTTP API V2. It authenticates either
+// with the admin credentials of the registry (see RegistryContext's Username
+// and TokenEnv), or, if none are configured, with a refresh token obtained by
+// exchanging the Azure Active Directory token of the az CLI.
+type acrClient struct{}
+
+// GetToken reads the admin password from the environment, if credentials are
+// configured for the registry. Otherwise, the AAD token of the az CLI is
+// exchanged for an ACR refresh token. A token is always required, regardless
+// of useServiceAccount (which only applies to GCP service accounts).
+func (c *acrClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	if len(rc.Username) > 0 || len(rc.TokenEnv) > 0 {
+		return getBasicAuthToken(rc)
+	}
+
+	aadToken, err := azure.GetAADAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	domain := strings.Split(string(rc.Name), "/")[0]
+	return ExchangeACRRefreshToken(
+		fmt.Sprintf("https://%s/oauth2/exchange", domain),
+		domain,
+		aadToken)
+}
+
+// ExchangeACRRefreshToken exchanges the AAD access token for a refresh token
+// of the ACR registry (the "service", i.e. the hostname of the registry), by
+// posting it to the registry's exchangeURL
+// ("https://<registry>/oauth2/exchange").
+func ExchangeACRRefreshToken(
+	exchangeURL string,
+	service string,
+	aadToken string) (gcloud.Token, error) {
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {service},
+		"access_token": {aadToken},
+	}
+	httpReq, err := http.NewRequest(
+		"POST",
+		exchangeURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doJSONRequest(
+		defaultRetryClient, httpReq, &exchange); err != nil {
+		// Do not wrap the error with the request body, as it contains the
+		// AAD token.
+		return "", fmt.Errorf("could not get an ACR refresh token for %s: %v",
+			service,
+			err)
+	}
+	if len(exchange.RefreshToken) == 0 {
+		return "", fmt.Errorf("no ACR refresh token returned for %s", service)
+	}
+
+	return gcloud.Token(exchange.RefreshToken), nil
+}
+
+// ListTags creates a stream.Producer which reads the repository
+// with the standard registry API. The repositories of the registry are listed
+// with ACR's catalog API.
+func (c *acrClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	r := registryV2Reader{
+		RegistryName: rc.Name,
+		Options:      c.RemoteOptions(sc, rc),
+	}
+
+	if sc.isToplevelRegistry(rc.Name) {
+		_, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
+		username, password := c.credentials(sc, rc)
+		r.ListChildren = func() ([]string, error) {
+			repos, err := listACRRepositories(
+				&http.Client{Transport: sc.transport()},
+				domain,
+				username,
+				password)
+			if err != nil {
+				return nil, err
+			}
+			return childRepos(repos, repoPath), nil
+		}
+	}
+
+	return &r
+}
+
+// listACRRepositories lists the names of all repositories in the given ACR
+// registry.
+func listACRRepositories(
+	client *http.Client,
+	domain string,
+	username string,
+	password gcloud.Token) ([]string, error) {
+
+	names := []string{}
+	last := ""
+	for {
+		endpoint := fmt.Sprintf(
+			"https://%s/acr/v1/_catalog?n=%d&last=%s",
+			domain,
+			acrCatalogPageSize,
+			url.QueryEscape(last))
+		httpReq, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.SetBasicAuth(username, string(password))
+
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := doJSONRequest(client, httpReq, &page); err != nil {
+			return nil, err
+		}
+
+		names = append(names, page.Repositories...)
+		if len(page.Repositories) < acrCatalogPageSize {
+			return names, nil
+		}
+		last = page.Repositories[len(page.Repositories)-1]
+	}
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest list (or
+// OCI image index) by digest with the standard registry API.
+func (c *acrClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage copies the image into the registry. Like for all registries,
+// layers are streamed from the source to ACR (see copyImage()), and never
+// held in memory as a whole.
+func (c *acrClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions authenticates with the admin credentials or the refresh
+// token as a basic auth password. Failed reads are retried (see
+// sc.transport()).
+func (c *acrClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	username, password := c.credentials(sc, rc)
+	return []ggcrV1Remote.Option{
+		ggcrV1Remote.WithAuth(&authn.Basic{
+			Username: username,
+			Password: string(password),
+		}),
+		sc.transportOption(),
+	}
+}
+
+// credentials returns the basic auth username and password of the registry
+// that rc belongs to (see GetToken()).
+func (c *acrClient) credentials(
+	sc *SyncContext,
+	rc RegistryContext) (string, gcloud.Token) {
+
+	rc = sc.toplevelRegistryContext(rc)
+	username := rc.Username
+	if len(username) == 0 {
+		username = ACRRefreshTokenUsername
+	}
+	return username, sc.getToken(rc)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+func TestIsACRDomain(t *testing.T) {
+	var tests = []struct {
+		name     string
+		input    string
+		expected bool
+	}{
+		{
+			"ACR",
+			"myregistry.azurecr.io",
+			true,
+		},
+		{
+			"ACR in Azure China",
+			"myregistry.azurecr.cn",
+			true,
+		},
+		{
+			"Not a subdomain",
+			"azurecr.io",
+			false,
+		},
+		{
+			"GCR",
+			"gcr.io",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		got := reg.IsACRDomain(test.input)
+		err := checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+// TestExchangeACRRefreshToken exchanges an AAD token against a mocked
+// "/oauth2/exchange" endpoint of ACR.
+func TestExchangeACRRefreshToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/oauth2/exchange" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.FormValue("grant_type") != "access_token" ||
+				r.FormValue("service") != "myregistry.azurecr.io" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.FormValue("access_token") != "good-aad-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"refresh_token": "acr-refresh-token"}`)
+		}))
+	defer server.Close()
+
+	var tests = []struct {
+		name          string
+		aadToken      string
+		expected      gcloud.Token
+		expectedError bool
+	}{
+		{
+			"Valid AAD token",
+			"good-aad-token",
+			"acr-refresh-token",
+			false,
+		},
+		{
+			"Invalid AAD token",
+			"bad-aad-token",
+			"",
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := reg.ExchangeACRRefreshToken(
+			server.URL+"/oauth2/exchange",
+			"myregistry.azurecr.io",
+			test.aadToken)
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		err = checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"strings"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+)
+
+// manifestFiles maps the destination images (see ToLQIN()) of the manifests
+// to the files that declare them. If an image is declared by more than one
+// manifest, the first one wins.
+func manifestFiles(mfests []Manifest) map[string]string {
+	files := make(map[string]string)
+	for _, mfest := range mfests {
+		if mfest.Filepath == "" {
+			continue
+		}
+		for _, rc := range mfest.Registries {
+			if rc.Src {
+				continue
+			}
+			for _, image := range mfest.Images {
+				lqin := ToLQIN(rc.Name, image.ImageName)
+				if _, ok := files[lqin]; !ok {
+					files[lqin] = mfest.Filepath
+				}
+			}
+		}
+	}
+	return files
+}
+
+// auditRequests returns a ProcessRequest that records the results of the
+// given one in sc.AuditLog, as they come. Nothing is recorded in dry runs, as
+// nothing is changed.
+func (sc *SyncContext) auditRequests(
+	processRequest ProcessRequest) ProcessRequest {
+
+	if sc.AuditLog == nil || sc.DryRun {
+		return processRequest
+	}
+	return observeResults(processRequest, sc.audit)
+}
+
+// audit records the result of a PromotionRequest in sc.AuditLog.
+func (sc *SyncContext) audit(reqRes RequestResult) {
+	pr, ok := reqRes.Context.RequestParams.(PromotionRequest)
+	if !ok {
+		return
+	}
+
+	dest := ToLQIN(pr.RegistryDest, pr.ImageNameDest)
+	e := auditlog.Entry{
+		Kind:        auditlog.KindImage,
+		Destination: dest,
+		Digest:      string(pr.Digest),
+		Result:      auditlog.ResultSuccess,
+		Manifest:    sc.ManifestFiles[dest],
+	}
+	switch pr.TagOp {
+	case Add:
+		e.Operation = auditlog.OperationCopy
+		e.Source = ToLQIN(pr.RegistrySrc, pr.ImageNameSrc)
+	case Delete:
+		e.Operation = auditlog.OperationDelete
+	default:
+		// Tag moves are not supported, so they change nothing.
+		return
+	}
+	if len(pr.Tag) > 0 {
+		e.Tags = []string{string(pr.Tag)}
+	}
+	if len(reqRes.Errors) > 0 {
+		e.Result = auditlog.ResultFailure
+		errs := make([]string, 0, len(reqRes.Errors))
+		for _, err := range reqRes.Errors {
+			errs = append(errs, err.Error.Error())
+		}
+		e.Error = strings.Join(errs, "; ")
+	}
+
+	sc.AuditLog.Record(e)
+}
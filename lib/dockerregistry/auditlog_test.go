@@ -0,0 +1,182 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestAuditLog(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0"},
+					"sha256:111": {"2.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+		Filepath:    "manifests/a/promoter-manifest.yaml",
+	}
+
+	sc, err := reg.MakeSyncContext([]reg.Manifest{mfest}, 1, false, false)
+	checkError(t, err, "unexpected error making the SyncContext\n")
+	var out bytes.Buffer
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	sc.AuditLog = &auditlog.Log{
+		Out: &out,
+		Now: func() time.Time { return now },
+	}
+
+	// Fail the promotion of the "2.0" tag.
+	var processRequestFake reg.ProcessRequest = func(
+		sc *reg.SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- reg.RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			reqRes := reg.RequestResult{Context: req}
+			pr := req.RequestParams.(reg.PromotionRequest)
+			if pr.Tag == "2.0" {
+				reqRes.Errors = reg.Errors{
+					{
+						Context: "running writeImage()",
+						Error:   fmt.Errorf("copy failed"),
+					},
+				}
+			}
+			requestResults <- reqRes
+		}
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "unexpected error getting promotion edges\n")
+
+	_, err = sc.Promote(
+		context.Background(),
+		edges,
+		nopStream,
+		&processRequestFake)
+	eqErr := checkEqual(err != nil, true)
+	checkError(t, eqErr, "expected a promotion error\n")
+
+	pruneEdge := reg.PromotionEdge{
+		SrcRegistry: srcRC,
+		SrcImageTag: reg.ImageTag{ImageName: "a", Tag: "old"},
+		Digest:      "sha256:222",
+		DstRegistry: destRC,
+		DstImageTag: reg.ImageTag{ImageName: "a", Tag: "old"},
+	}
+	err = sc.Prune(
+		context.Background(),
+		map[reg.PromotionEdge]interface{}{pruneEdge: nil},
+		nopStream,
+		&processRequestFake)
+	checkError(t, err, "unexpected error pruning\n")
+
+	// Nothing is recorded in dry runs.
+	sc.DryRun = true
+	_, err = sc.Promote(context.Background(), edges, nopStream, nil)
+	checkError(t, err, "unexpected error in dry run\n")
+
+	// The entries are recorded as the requests complete, so sort them.
+	var got []auditlog.Entry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e auditlog.Entry
+		err := json.Unmarshal([]byte(line), &e)
+		checkError(t, err, fmt.Sprintf("invalid audit log line %q\n", line))
+		got = append(got, e)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].Digest < got[j].Digest
+	})
+
+	manifest := "manifests/a/promoter-manifest.yaml"
+	eqErr = checkEqual(got, []auditlog.Entry{
+		{
+			Time:        now,
+			Kind:        "image",
+			Operation:   "copy",
+			Source:      "gcr.io/foo/a",
+			Destination: "gcr.io/bar/a",
+			Digest:      "sha256:000",
+			Tags:        []string{"1.0"},
+			Result:      "success",
+			Manifest:    manifest,
+		},
+		{
+			Time:        now,
+			Kind:        "image",
+			Operation:   "copy",
+			Source:      "gcr.io/foo/a",
+			Destination: "gcr.io/bar/a",
+			Digest:      "sha256:111",
+			Tags:        []string{"2.0"},
+			Result:      "failure",
+			Error:       "copy failed",
+			Manifest:    manifest,
+		},
+		{
+			Time:        now,
+			Kind:        "image",
+			Operation:   "delete",
+			Destination: "gcr.io/bar/a",
+			Digest:      "sha256:222",
+			Tags:        []string{"old"},
+			Result:      "success",
+			Manifest:    manifest,
+		},
+	})
+	checkError(t, eqErr, "unexpected audit log entries\n")
+}
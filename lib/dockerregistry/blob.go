@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// BlobCopyBufferSize is the size of the buffer through which every blob is
+// streamed from the source to the destination registry. It caps the memory
+// used for copying a blob, no matter how large the blob is.
+const BlobCopyBufferSize = 1024 * 1024
+
+// StreamBlob copies the blob from src to dst through a buffer of
+// BlobCopyBufferSize bytes, and returns the number of bytes copied. The blob is
+// verified against its (sha256) digest while it is streamed; as the data has
+// already been written to dst by the time a mismatch is detected, dst must
+// discard the blob if an error is returned.
+func StreamBlob(
+	dst io.Writer,
+	src io.Reader,
+	digest ggcrV1.Hash) (int64, error) {
+
+	if digest.Algorithm != "sha256" {
+		return 0, fmt.Errorf(
+			"unsupported digest algorithm %q",
+			digest.Algorithm)
+	}
+
+	hasher := sha256.New()
+	buf := make([]byte, BlobCopyBufferSize)
+	var copied int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return copied, err
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != digest.Hex {
+		return copied, fmt.Errorf(
+			"digest mismatch for blob %v: got sha256:%s",
+			digest,
+			actual)
+	}
+
+	return copied, nil
+}
+
+// streamingLayer is a layer whose (compressed) contents are streamed from the
+// source registry through StreamBlob(), and so verified against the digest of
+// the layer while they are uploaded to the destination registry.
+type streamingLayer struct {
+	ggcrV1.Layer
+}
+
+// Compressed returns the verified stream of the layer's contents. A digest
+// mismatch surfaces as a read error, which aborts the upload.
+func (l *streamingLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	src, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := StreamBlob(pw, src, digest)
+		// nolint[errcheck]
+		src.Close()
+		// A nil error makes the reader see io.EOF.
+		// nolint[errcheck]
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// canMount returns true if the source and destination repositories are in the
+// same registry. The registry then mounts blobs from one repository into the
+// other, without any data going through the promoter.
+func canMount(srcRef, dstRef name.Reference) bool {
+	return srcRef.Context().RegistryStr() == dstRef.Context().RegistryStr()
+}
+
+// streamLayers uploads the layers of img (from srcRef) to the repository of
+// dstRef, one streamingLayer at a time. Afterwards, writing img only uploads
+// its config and manifest, as its layers are already in place.
+//
+// Nothing is done if the layers can be mounted (see canMount()).
+// Non-distributable layers (e.g., the foreign base layers of Windows images)
+// are skipped, like ggcrV1Remote.Write() does: registries do not hold them.
+func streamLayers(
+	srcRef, dstRef name.Reference,
+	img ggcrV1.Image,
+	dstOpts []ggcrV1Remote.Option) error {
+
+	if canMount(srcRef, dstRef) {
+		return nil
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		mt, err := layer.MediaType()
+		if err != nil {
+			return err
+		}
+		if !mt.IsDistributable() {
+			continue
+		}
+
+		if err := ggcrV1Remote.WriteLayer(
+			dstRef.Context(),
+			&streamingLayer{layer},
+			dstOpts...); err != nil {
+			digest, _ := layer.Digest()
+			return fmt.Errorf("copying layer %v: %v", digest, err)
+		}
+	}
+
+	return nil
+}
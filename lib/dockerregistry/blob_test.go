@@ -0,0 +1,214 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+var zeroDigest = ggcrV1.Hash{
+	Algorithm: "sha256",
+	Hex:       strings.Repeat("0", 64),
+}
+
+// patternReader produces an endless stream of a repeating byte pattern, to
+// make up large layers without holding them in memory.
+type patternReader struct {
+	offset int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r.offset % 251)
+		r.offset++
+	}
+	return len(p), nil
+}
+
+// recordingWriter discards everything written to it, recording the total
+// number of bytes and the size of the largest single write.
+type recordingWriter struct {
+	total    int64
+	maxWrite int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.total += int64(len(p))
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return len(p), nil
+}
+
+func TestStreamBlob(t *testing.T) {
+	// Much larger than the buffer, and not a multiple of its size.
+	const layerSize = 64*reg.BlobCopyBufferSize + 12345
+	mkLayer := func() io.Reader {
+		return io.LimitReader(&patternReader{}, layerSize)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, mkLayer()); err != nil {
+		t.Fatal(err)
+	}
+	digest := ggcrV1.Hash{
+		Algorithm: "sha256",
+		Hex:       hex.EncodeToString(hasher.Sum(nil)),
+	}
+
+	var tests = []struct {
+		name          string
+		digest        ggcrV1.Hash
+		expectedError error
+	}{
+		{
+			"Matching digest",
+			digest,
+			nil,
+		},
+		{
+			"Digest mismatch",
+			zeroDigest,
+			fmt.Errorf(
+				"digest mismatch for blob %v: got %v",
+				zeroDigest,
+				digest),
+		},
+		{
+			"Unsupported digest algorithm",
+			ggcrV1.Hash{
+				Algorithm: "sha512",
+				Hex:       digest.Hex,
+			},
+			fmt.Errorf("unsupported digest algorithm \"sha512\""),
+		},
+	}
+
+	for _, test := range tests {
+		w := &recordingWriter{}
+		copied, err := reg.StreamBlob(w, mkLayer(), test.digest)
+
+		err = checkEqual(err, test.expectedError)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		if test.expectedError != nil {
+			continue
+		}
+
+		err = checkEqual(copied, int64(layerSize))
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		err = checkEqual(w.total, int64(layerSize))
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		if w.maxWrite > reg.BlobCopyBufferSize {
+			t.Errorf("%s: wrote %d bytes at once, more than the buffer size %d",
+				test.name, w.maxWrite, reg.BlobCopyBufferSize)
+		}
+	}
+}
+
+// TestStreamBlobReadError checks that read errors of the source are passed on.
+func TestStreamBlobReadError(t *testing.T) {
+	src := io.MultiReader(
+		io.LimitReader(&patternReader{}, 10),
+		&errReader{fmt.Errorf("connection reset")})
+
+	_, err := reg.StreamBlob(ioutil.Discard, src, zeroDigest)
+	err = checkEqual(err, fmt.Errorf("connection reset"))
+	checkError(t, err, "checkError: test: TestStreamBlobReadError\n")
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestCopyImageForeignLayers(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("creating random image: %v", err)
+	}
+	foreign, err := random.Layer(1024, ggcrV1Types.DockerForeignLayer)
+	if err != nil {
+		t.Fatalf("creating random layer: %v", err)
+	}
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: foreign,
+		URLs:  []string{"https://example.com/foreign-layer"},
+	})
+	if err != nil {
+		t.Fatalf("appending foreign layer: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("reading image digest: %v", err)
+	}
+
+	// Different registries, so that the layers are streamed rather than
+	// mounted.
+	srcServer := httptest.NewServer(registry.New())
+	defer srcServer.Close()
+	srcHost := strings.TrimPrefix(srcServer.URL, "http://")
+	dstServer := httptest.NewServer(registry.New())
+	defer dstServer.Close()
+	dstHost := strings.TrimPrefix(dstServer.URL, "http://")
+
+	// The source registry does not hold the foreign layer.
+	srcRef, err := name.ParseReference(srcHost + "/src/foo:1.0")
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	if err := ggcrV1Remote.Write(srcRef, img); err != nil {
+		t.Fatalf("writing image: %v", err)
+	}
+
+	srcRC := reg.RegistryContext{Name: reg.RegistryName(srcHost + "/src")}
+	dstRC := reg.RegistryContext{Name: reg.RegistryName(dstHost + "/dst")}
+	sc := reg.SyncContext{
+		RegistryContexts: []reg.RegistryContext{srcRC, dstRC},
+	}
+	err = sc.CopyImage(srcRC, srcRef.String(), dstRC, dstHost+"/dst/foo:1.0")
+	checkError(t, err, "unexpected error copying image with a foreign layer\n")
+
+	dstRef, err := name.ParseReference(dstHost + "/dst/foo:1.0")
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	desc, err := ggcrV1Remote.Get(dstRef)
+	if err != nil {
+		t.Fatalf("reading copy: %v", err)
+	}
+	eqErr := checkEqual(desc.Digest, digest)
+	checkError(t, eqErr, "unexpected digest of copy\n")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"io"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// Budget limits the number of registry operations (repository reads, image
+// size lookups and image copies) that run at the same time. It is safe for
+// concurrent use, so that a single Budget can be shared by all the workers of
+// a SyncContext. A nil Budget does not limit anything.
+type Budget struct {
+	slots chan struct{}
+}
+
+// NewBudget returns a Budget that allows up to n operations at once. A
+// budget of zero (or less) means no limit, for which nil is returned.
+func NewBudget(n int) *Budget {
+	if n <= 0 {
+		return nil
+	}
+	return &Budget{slots: make(chan struct{}, n)}
+}
+
+// Acquire blocks until an operation may start. Every Acquire() must be
+// followed by a Release(), once the operation is done.
+func (b *Budget) Acquire() {
+	if b == nil {
+		return
+	}
+	b.slots <- struct{}{}
+}
+
+// Release gives back the slot taken by Acquire().
+func (b *Budget) Release() {
+	if b == nil {
+		return
+	}
+	<-b.slots
+}
+
+// Producer wraps producer, so that it holds a slot of the Budget from the
+// time its stream is produced until it is closed. A nil Budget returns
+// producer as is.
+func (b *Budget) Producer(producer stream.Producer) stream.Producer {
+	if b == nil {
+		return producer
+	}
+	return &budgetProducer{budget: b, producer: producer}
+}
+
+// budgetProducer is a stream.Producer which holds a slot of a Budget while
+// its stream is open.
+type budgetProducer struct {
+	budget   *Budget
+	producer stream.Producer
+	held     bool
+}
+
+// Produce takes a slot of the Budget, and produces the stream of the wrapped
+// producer. The slot is given back right away if that fails, as the stream
+// is not closed then.
+func (p *budgetProducer) Produce() (io.Reader, io.Reader, error) {
+	if !p.held {
+		p.budget.Acquire()
+		p.held = true
+	}
+	stdout, stderr, err := p.producer.Produce()
+	if err != nil {
+		p.release()
+	}
+	return stdout, stderr, err
+}
+
+// Close closes the wrapped producer, and gives back its slot of the Budget.
+func (p *budgetProducer) Close() error {
+	defer p.release()
+	return p.producer.Close()
+}
+
+func (p *budgetProducer) release() {
+	if p.held {
+		p.budget.Release()
+		p.held = false
+	}
+}
+
+// withBudget wraps mkProducer so that every read holds a slot of sc.Budget.
+func withBudget(
+	mkProducer func(*SyncContext, RegistryContext) stream.Producer,
+) func(*SyncContext, RegistryContext) stream.Producer {
+
+	return func(sc *SyncContext, rc RegistryContext) stream.Producer {
+		return sc.Budget.Producer(mkProducer(sc, rc))
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// inFlightTracker counts the operations in flight, and remembers the highest
+// count. It is safe for concurrent use.
+type inFlightTracker struct {
+	mutex   sync.Mutex
+	current int
+	max     int
+}
+
+func (tr *inFlightTracker) start() {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.current++
+	if tr.current > tr.max {
+		tr.max = tr.current
+	}
+}
+
+func (tr *inFlightTracker) done() {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.current--
+}
+
+// trackedProducer is a stream.Producer whose stream is in flight (as far as
+// its tracker is concerned) from Produce() until Close().
+type trackedProducer struct {
+	tracker *inFlightTracker
+	fake    stream.Fake
+}
+
+func (p *trackedProducer) Produce() (io.Reader, io.Reader, error) {
+	p.tracker.start()
+	// Give the other operations a chance to pile up.
+	time.Sleep(5 * time.Millisecond)
+	return p.fake.Produce()
+}
+
+func (p *trackedProducer) Close() error {
+	p.tracker.done()
+	return p.fake.Close()
+}
+
+func TestNewBudget(t *testing.T) {
+	eqErr := checkEqual(reg.NewBudget(0) == nil, true)
+	checkError(t, eqErr, "checkError: test: zero budget\n")
+	eqErr = checkEqual(reg.NewBudget(-1) == nil, true)
+	checkError(t, eqErr, "checkError: test: negative budget\n")
+
+	// A nil Budget does not limit (or wrap) anything.
+	var budget *reg.Budget
+	budget.Acquire()
+	budget.Release()
+	producer := &stream.Fake{}
+	eqErr = checkEqual(budget.Producer(producer) == producer, true)
+	checkError(t, eqErr, "checkError: test: nil budget\n")
+}
+
+func TestBudget(t *testing.T) {
+	const budgetSize = 3
+	const operations = 20
+
+	listing := `{"child": [], "manifest": {}, "name": "foo", "tags": []}`
+	manifest := `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {"size": 1024},
+  "layers": [{"size": 1024}]
+}`
+
+	tracker := &inFlightTracker{}
+	budget := reg.NewBudget(budgetSize)
+
+	// Repository reads, with more threads than the budget.
+	rcs := make([]reg.RegistryContext, 0, operations)
+	for i := 0; i < operations; i++ {
+		rcs = append(rcs, reg.RegistryContext{
+			Name: reg.RegistryName(fmt.Sprintf("gcr.io/foo-%d", i)),
+		})
+	}
+	sc := reg.SyncContext{
+		Threads: operations,
+		Inv:     make(reg.MasterInventory),
+		Budget:  budget,
+	}
+	mkListing := func(
+		sc *reg.SyncContext,
+		rc reg.RegistryContext) stream.Producer {
+
+		return &trackedProducer{
+			tracker: tracker,
+			fake:    stream.Fake{Bytes: []byte(listing)},
+		}
+	}
+
+	// Image size lookups, with more threads than the budget.
+	edges := make(map[reg.PromotionEdge]interface{})
+	for i := 0; i < operations; i++ {
+		edges[reg.PromotionEdge{
+			Digest: reg.Digest(fmt.Sprintf("sha256:%03d", i)),
+		}] = nil
+	}
+	check := reg.ImageSizeCheck{
+		MaxImageSize:    1,
+		DigestImageSize: reg.DigestImageSize{},
+		PullEdges:       edges,
+		Threads:         operations,
+		MkReadManifestCmd: func(edge reg.PromotionEdge) stream.Producer {
+			return &trackedProducer{
+				tracker: tracker,
+				fake:    stream.Fake{Bytes: []byte(manifest)},
+			}
+		},
+		Budget: budget,
+	}
+
+	// Reads, size lookups and copies (which take their slot directly) all
+	// run at the same time.
+	var wg sync.WaitGroup
+	var readErr, checkErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		readErr = sc.ReadRegistries(context.Background(), rcs, true, mkListing)
+	}()
+	go func() {
+		defer wg.Done()
+		checkErr = check.Run()
+	}()
+	for i := 0; i < operations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			budget.Acquire()
+			defer budget.Release()
+			tracker.start()
+			defer tracker.done()
+			time.Sleep(5 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	checkError(t, readErr, "checkError: test: budget (reads)\n")
+	checkError(t, checkErr, "checkError: test: budget (size lookups)\n")
+	eqErr := checkEqual(len(check.DigestImageSize), operations)
+	checkError(t, eqErr, "checkError: test: budget (sizes)\n")
+	if tracker.max > budgetSize {
+		t.Errorf("%d operations were in flight at the same time, "+
+			"over the budget of %d", tracker.max, budgetSize)
+	}
+	eqErr = checkEqual(tracker.current, 0)
+	checkError(t, eqErr, "checkError: test: budget (in flight)\n")
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ggcrV1Google "github.com/google/go-containerregistry/pkg/v1/google"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// ListingCache stores the listings of repositories (in the format used by
+// GCR's "tags/list" endpoint), so that ReadRegistries() does not have to read
+// the same repositories over the network on every run.
+type ListingCache interface {
+	// Get returns the cached listing of the repository rName. It returns false
+	// if there is no such listing, or if it has expired.
+	Get(rName RegistryName) ([]byte, bool)
+
+	// Put caches the listing of the repository rName.
+	Put(rName RegistryName, listing []byte) error
+}
+
+// listingCacheEntry is a single cached listing.
+type listingCacheEntry struct {
+	Name    RegistryName    `json:"name"`
+	Fetched time.Time       `json:"fetched"`
+	Listing json.RawMessage `json:"listing"`
+}
+
+// expired returns true if the entry is older than ttl. A ttl of 0 means that
+// entries never expire.
+func (entry *listingCacheEntry) expired(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(entry.Fetched) > ttl
+}
+
+// DiskListingCache is a ListingCache which stores each listing as a JSON file
+// in Dir. Listings older than TTL are ignored.
+type DiskListingCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// MakeDiskListingCache creates a DiskListingCache. The directory dir is
+// created when the first listing is cached.
+func MakeDiskListingCache(dir string, ttl time.Duration) *DiskListingCache {
+	return &DiskListingCache{
+		Dir: dir,
+		TTL: ttl,
+	}
+}
+
+// path returns the file that holds the listing of rName. Repository names are
+// hashed, because they contain slashes.
+func (cache *DiskListingCache) path(rName RegistryName) string {
+	sum := sha256.Sum256([]byte(rName))
+	return filepath.Join(cache.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get returns the cached listing of the repository rName. Unreadable cache
+// files are treated as missing.
+func (cache *DiskListingCache) Get(rName RegistryName) ([]byte, bool) {
+	data, err := ioutil.ReadFile(cache.path(rName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("could not read cached listing of %s: %v", rName, err)
+		}
+		return nil, false
+	}
+
+	var entry listingCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		klog.Warningf("could not parse cached listing of %s: %v", rName, err)
+		return nil, false
+	}
+
+	// Guard against (very unlikely) hash collisions.
+	if entry.Name != rName || entry.expired(cache.TTL) {
+		return nil, false
+	}
+
+	return entry.Listing, true
+}
+
+// Put caches the listing of the repository rName. The file is written
+// atomically, so that concurrent readers never see a partial listing.
+func (cache *DiskListingCache) Put(rName RegistryName, listing []byte) error {
+	data, err := json.Marshal(listingCacheEntry{
+		Name:    rName,
+		Fetched: time.Now(),
+		Listing: listing,
+	})
+	if err != nil {
+		return err
+	}
+
+	// nolint[gomnd]
+	if err := os.MkdirAll(cache.Dir, 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(cache.Dir, "listing-")
+	if err != nil {
+		return err
+	}
+
+	// nolint[errcheck]
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		// nolint[errcheck]
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), cache.path(rName))
+}
+
+// MemoryListingCache is a ListingCache which keeps listings in memory. It is
+// mostly useful for tests.
+type MemoryListingCache struct {
+	TTL     time.Duration
+	mutex   sync.Mutex
+	entries map[RegistryName]listingCacheEntry
+}
+
+// MakeMemoryListingCache creates an empty MemoryListingCache.
+func MakeMemoryListingCache(ttl time.Duration) *MemoryListingCache {
+	return &MemoryListingCache{
+		TTL:     ttl,
+		entries: make(map[RegistryName]listingCacheEntry),
+	}
+}
+
+// Get returns the cached listing of the repository rName.
+func (cache *MemoryListingCache) Get(rName RegistryName) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[rName]
+	if !ok || entry.expired(cache.TTL) {
+		return nil, false
+	}
+	return entry.Listing, true
+}
+
+// Put caches the listing of the repository rName.
+func (cache *MemoryListingCache) Put(rName RegistryName, listing []byte) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries[rName] = listingCacheEntry{
+		Name:    rName,
+		Fetched: time.Now(),
+		Listing: listing,
+	}
+	return nil
+}
+
+// cachedListing is a stream.Producer of a listing that was read from a
+// ListingCache (instead of the network).
+type cachedListing struct {
+	stream.Fake
+}
+
+// withListingCache wraps mkProducer so that repositories are read from
+// sc.ListingCache, if possible. If sc.RefreshListingCache is set, the cache is
+// not consulted (but it is still updated by cacheListing()).
+func withListingCache(
+	mkProducer func(*SyncContext, RegistryContext) stream.Producer,
+) func(*SyncContext, RegistryContext) stream.Producer {
+
+	return func(sc *SyncContext, rc RegistryContext) stream.Producer {
+		if !sc.RefreshListingCache {
+			if listing, ok := sc.ListingCache.Get(rc.Name); ok {
+				klog.V(2).Infof("using cached listing of %s", rc.Name)
+				return &cachedListing{stream.Fake{Bytes: listing}}
+			}
+		}
+		return mkProducer(sc, rc)
+	}
+}
+
+// cacheListing stores a listing that was read over the network in
+// sc.ListingCache. Failing to do so is not fatal, as the cache is only an
+// optimization.
+func (sc *SyncContext) cacheListing(
+	req stream.ExternalRequest,
+	tags *ggcrV1Google.Tags) {
+
+	if sc.ListingCache == nil {
+		return
+	}
+	if _, ok := req.StreamProducer.(*cachedListing); ok {
+		return
+	}
+
+	rName := req.RequestParams.(RegistryContext).Name
+	listing, err := json.Marshal(tags)
+	if err == nil {
+		err = sc.ListingCache.Put(rName, listing)
+	}
+	if err != nil {
+		klog.Warningf("could not cache listing of %s: %v", rName, err)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestListingCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "listing-cache")
+	checkError(t, err, "checkError: test: TempDir\n")
+	// nolint[errcheck]
+	defer os.RemoveAll(tmpDir)
+
+	var tests = []struct {
+		name          string
+		mkCache       func(ttl time.Duration) reg.ListingCache
+		ttl           time.Duration
+		expectedFound bool
+	}{
+		{
+			"Memory cache, unexpired",
+			func(ttl time.Duration) reg.ListingCache {
+				return reg.MakeMemoryListingCache(ttl)
+			},
+			time.Hour,
+			true,
+		},
+		{
+			"Memory cache, expired",
+			func(ttl time.Duration) reg.ListingCache {
+				return reg.MakeMemoryListingCache(ttl)
+			},
+			time.Nanosecond,
+			false,
+		},
+		{
+			"Disk cache, unexpired",
+			func(ttl time.Duration) reg.ListingCache {
+				return reg.MakeDiskListingCache(tmpDir+"/unexpired", ttl)
+			},
+			time.Hour,
+			true,
+		},
+		{
+			"Disk cache, never expires",
+			func(ttl time.Duration) reg.ListingCache {
+				return reg.MakeDiskListingCache(tmpDir+"/forever", ttl)
+			},
+			0,
+			true,
+		},
+		{
+			"Disk cache, expired",
+			func(ttl time.Duration) reg.ListingCache {
+				return reg.MakeDiskListingCache(tmpDir+"/expired", ttl)
+			},
+			time.Nanosecond,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		cache := test.mkCache(test.ttl)
+
+		_, found := cache.Get("gcr.io/foo/bar")
+		err := checkEqual(found, false)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (empty cache)\n", test.name))
+
+		err = cache.Put("gcr.io/foo/bar", []byte(`{"name":"foo/bar"}`))
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (Put)\n", test.name))
+		time.Sleep(time.Millisecond)
+
+		listing, found := cache.Get("gcr.io/foo/bar")
+		err = checkEqual(found, test.expectedFound)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (found)\n", test.name))
+		if test.expectedFound {
+			err = checkEqual(string(listing), `{"name":"foo/bar"}`)
+			checkError(t, err,
+				fmt.Sprintf("checkError: test: %v (listing)\n", test.name))
+		}
+
+		// Other repositories are unaffected.
+		_, found = cache.Get("gcr.io/foo/baz")
+		err = checkEqual(found, false)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (other repo)\n", test.name))
+	}
+}
+
+func TestReadRegistriesListingCache(t *testing.T) {
+	const fakeRegName reg.RegistryName = "gcr.io/foo"
+	rcs := []reg.RegistryContext{
+		{
+			Name:           fakeRegName,
+			ServiceAccount: "robot",
+		},
+	}
+	input := map[string]string{
+		"gcr.io/foo": `{
+  "child": [
+    "bar"
+  ],
+  "manifest": {},
+  "name": "foo",
+  "tags": []
+}`,
+		"gcr.io/foo/bar": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "imageSizeBytes": "1",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": [
+        "1.0"
+      ],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/bar",
+  "tags": [
+    "1.0"
+  ]
+}`,
+	}
+	expectedInv := reg.RegInvImage{
+		"bar": {"sha256:000": {"1.0"}}}
+
+	cache := reg.MakeMemoryListingCache(time.Hour)
+
+	var tests = []struct {
+		name          string
+		refresh       bool
+		expectedReads int
+	}{
+		{
+			"Empty cache",
+			false,
+			2,
+		},
+		{
+			"Populated cache",
+			false,
+			0,
+		},
+		{
+			"Forced refresh",
+			true,
+			2,
+		},
+	}
+
+	for _, test := range tests {
+		reads := 0
+		mkFakeStream := func(
+			sc *reg.SyncContext,
+			rc reg.RegistryContext) stream.Producer {
+
+			reads++
+			_, domain, repoPath := reg.GetTokenKeyDomainRepoPath(rc.Name)
+			return &stream.Fake{Bytes: []byte(input[domain+"/"+repoPath])}
+		}
+
+		sc := reg.SyncContext{
+			// Read one repository at a time, so that counting reads is safe.
+			Threads:             1,
+			RegistryContexts:    rcs,
+			Inv:                 map[reg.RegistryName]reg.RegInvImage{fakeRegName: nil},
+			DigestMediaType:     make(reg.DigestMediaType),
+			DigestImageSize:     make(reg.DigestImageSize),
+			ListingCache:        cache,
+			RefreshListingCache: test.refresh,
+		}
+
+		err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeStream)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (ReadRegistries)\n", test.name))
+
+		err = checkEqual(reads, test.expectedReads)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (reads)\n", test.name))
+
+		err = checkEqual(sc.Inv[fakeRegName], expectedInv)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (inventory)\n", test.name))
+	}
+}
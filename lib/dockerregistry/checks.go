@@ -17,14 +17,27 @@ limitations under the License.
 package inventory
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
 	gogit "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
 )
 
 // MBToBytes converts a value from MiB to Bytes.
@@ -39,6 +52,27 @@ func BytesToMB(value int) int {
 	return value >> bytesToMBShift
 }
 
+// BytesToHuman formats a number of bytes in human-readable binary units, e.g.
+// "512 B", "1.5 MiB" or "2.0 GiB".
+func BytesToHuman(value int64) string {
+	const unit = 1024
+	if value < unit {
+		return fmt.Sprintf("%d B", value)
+	}
+	div, exp := int64(unit), 0
+	for m := value / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB",
+		float64(value)/float64(div), "KMGTPE"[exp])
+}
+
+// bytesToMBRoundedUp converts bytes to MiB, rounding up to a whole MiB.
+func bytesToMBRoundedUp(value int) int {
+	return BytesToMB(value + MBToBytes(1) - 1)
+}
+
 func getGitShaFromEnv(envVar string) (plumbing.Hash, error) {
 	potenitalSHA := os.Getenv(envVar)
 	const gitShaLength = 40
@@ -54,81 +88,136 @@ func getGitShaFromEnv(envVar string) (plumbing.Hash, error) {
 	return plumbing.NewHash(potenitalSHA), nil
 }
 
-// MKRealImageRemovalCheck returns an instance of ImageRemovalCheck.
-func MKRealImageRemovalCheck(
-	gitRepoPath string,
-	edges map[PromotionEdge]interface{},
-) (*ImageRemovalCheck, error) {
+// getPullRequestShas returns the Git SHAs of the master branch and the pull
+// request branch.
+func getPullRequestShas() (plumbing.Hash, plumbing.Hash, error) {
 	// The "PULL_BASE_SHA" and "PULL_PULL_SHA" environment variables are given
 	// by the PROW job running the promoter container and represent the Git SHAs
 	// for the master branch and the pull request branch respectively.
 	masterSHA, err := getGitShaFromEnv("PULL_BASE_SHA")
 	if err != nil {
-		return nil, fmt.Errorf("The PULL_BASE_SHA environment variable "+
-			"is invalid: %v", err)
+		return plumbing.Hash{}, plumbing.Hash{},
+			fmt.Errorf("The PULL_BASE_SHA environment variable "+
+				"is invalid: %v", err)
 	}
 	pullRequestSHA, err := getGitShaFromEnv("PULL_PULL_SHA")
 	if err != nil {
-		return nil, fmt.Errorf("The PULL_PULL_SHA environment variable "+
-			"is invalid: %v", err)
+		return plumbing.Hash{}, plumbing.Hash{},
+			fmt.Errorf("The PULL_PULL_SHA environment variable "+
+				"is invalid: %v", err)
+	}
+	return masterSHA, pullRequestSHA, nil
+}
+
+// MKRealImageRemovalCheck returns an instance of ImageRemovalCheck. The
+// removals allowed by the pull request's manifests (mfests) are permitted.
+func MKRealImageRemovalCheck(
+	gitRepoPath string,
+	mfests []Manifest,
+	edges map[PromotionEdge]interface{},
+) (*ImageRemovalCheck, error) {
+	masterSHA, pullRequestSHA, err := getPullRequestShas()
+	if err != nil {
+		return nil, err
 	}
 	return &ImageRemovalCheck{
 		gitRepoPath,
 		masterSHA,
 		pullRequestSHA,
 		edges,
+		GetAllowedRemovals(mfests),
 	}, nil
 }
 
+// GetAllowedRemovals collects the AllowedRemovals of the given manifests. As
+// an allowed removal only applies to the manifest that declares it, each
+// image is qualified with the destination registries of its manifest.
+func GetAllowedRemovals(
+	mfests []Manifest) map[RegistryImagePath]interface{} {
+
+	allowed := make(map[RegistryImagePath]interface{})
+	for _, mfest := range mfests {
+		for _, imageName := range mfest.AllowedRemovals {
+			for _, rc := range mfest.Registries {
+				if rc.Src {
+					continue
+				}
+				allowed[RegistryImagePath(
+					string(rc.Name)+"/"+string(imageName))] = nil
+			}
+		}
+	}
+	return allowed
+}
+
 // Run executes ImageRemovalCheck on a set of promotion edges.
 // Returns an error if the pull request removes images from the
 // promoter manifests.
 func (check *ImageRemovalCheck) Run() error {
-	r, err := gogit.PlainOpen(check.GitRepoPath)
+	masterEdges, err := readMasterEdges(
+		check.GitRepoPath,
+		check.MasterSHA,
+		check.PullRequestSHA)
+	if err != nil {
+		return err
+	}
+
+	return check.Compare(masterEdges, check.PullEdges)
+}
+
+// readMasterEdges generates the promotion edges of the promoter manifests in
+// the master branch of the Git repo. The pull request branch is checked out
+// again afterwards.
+func readMasterEdges(
+	gitRepoPath string,
+	masterSHA plumbing.Hash,
+	pullRequestSHA plumbing.Hash,
+) (map[PromotionEdge]interface{}, error) {
+	r, err := gogit.PlainOpen(gitRepoPath)
 	if err != nil {
-		return fmt.Errorf("Could not open the Git repo: %v", err)
+		return nil, fmt.Errorf("Could not open the Git repo: %v", err)
 	}
 	w, err := r.Worktree()
 	if err != nil {
-		return fmt.Errorf("Could not create Git worktree: %v", err)
+		return nil, fmt.Errorf("Could not create Git worktree: %v", err)
 	}
 
 	// The Prow job that this check is running in has already cloned the
 	// git repo for us so we can just checkout the master branch to get the
 	// master branch's version of the promoter manifests.
 	err = w.Checkout(&gogit.CheckoutOptions{
-		Hash:  check.MasterSHA,
+		Hash:  masterSHA,
 		Force: true,
 	})
 	if err != nil {
-		return fmt.Errorf("Could not checkout the master branch of the Git"+
-			" repo: %v", err)
+		return nil, fmt.Errorf("Could not checkout the master branch of "+
+			"the Git repo: %v", err)
 	}
 
-	mfests, err := ParseThinManifestsFromDir(check.GitRepoPath)
+	mfests, err := ParseThinManifestsFromDir(gitRepoPath)
 	if err != nil {
-		return fmt.Errorf("Could not parse manifests from the directory: %v",
-			err)
+		return nil, fmt.Errorf("Could not parse manifests from the "+
+			"directory: %v", err)
 	}
 	masterEdges, err := ToPromotionEdges(mfests)
 	if err != nil {
-		return fmt.Errorf("Could not generate promotion edges from promoter"+
-			" manifests: %v", err)
+		return nil, fmt.Errorf("Could not generate promotion edges from "+
+			"promoter manifests: %v", err)
 	}
 
 	// Reset the current directory back to the pull request branch so that this
 	// check doesn't leave lasting effects that could affect subsequent checks.
 	err = w.Checkout(&gogit.CheckoutOptions{
-		Hash:  check.PullRequestSHA,
+		Hash:  pullRequestSHA,
 		Force: true,
 	})
 	if err != nil {
-		return fmt.Errorf("Could not checkout the pull request branch of the"+
-			" Git repo %v: %v",
-			check.GitRepoPath, err)
+		return nil, fmt.Errorf("Could not checkout the pull request branch "+
+			"of the Git repo %v: %v",
+			gitRepoPath, err)
 	}
 
-	return check.Compare(masterEdges, check.PullEdges)
+	return masterEdges, nil
 }
 
 // Compare is a function of the ImageRemovalCheck that handles
@@ -150,98 +239,1795 @@ func (check *ImageRemovalCheck) Compare(
 
 	// Check that every destination image in the master branch's set of
 	// promotion edges exists in the pull request's set of promotion edges.
-	removedImages := make([]string, 0)
+	removedImages := make([]ImageName, 0)
 	for edge := range edgesMaster {
 		_, found := destinationImages[PromotionEdge{
 			DstImageTag: edge.DstImageTag,
 			Digest:      edge.Digest,
 		}]
-		if !found {
-			removedImages = append(removedImages,
-				string(edge.DstImageTag.ImageName))
+		_, allowed := check.AllowedRemovals[RegistryImagePath(
+			string(edge.DstRegistry.Name)+"/"+
+				string(edge.DstImageTag.ImageName))]
+		if !found && !allowed {
+			removedImages = append(removedImages, edge.DstImageTag.ImageName)
 		}
 	}
 
 	if len(removedImages) > 0 {
-		return fmt.Errorf("The following images were removed in this pull "+
-			"request: %v", strings.Join(removedImages, ", "))
+		return ImageRemovalError{removedImages}
 	}
 	return nil
 }
 
-// Error is a function of ImageSizeError and implements the error interface.
-func (err ImageSizeError) Error() string {
-	errStr := ""
-	if len(err.OversizedImages) > 0 {
-		errStr += fmt.Sprintf("The following images were over the max file "+
-			"size of %dMiB:\n%v\n", err.MaxImageSize,
-			err.joinImageSizesToString(err.OversizedImages))
+// Error is a function of ImageRemovalError and implements the error
+// interface.
+func (err ImageRemovalError) Error() string {
+	images := make([]string, 0, len(err.RemovedImages))
+	for _, image := range err.RemovedImages {
+		images = append(images, string(image))
 	}
-	if len(err.InvalidImages) > 0 {
-		errStr += fmt.Sprintf("The following images had an invalid file size "+
-			"of 0 bytes or less:\n%v\n",
-			err.joinImageSizesToString(err.InvalidImages))
+	return fmt.Sprintf("The following images were removed in this pull "+
+		"request: %v", strings.Join(images, ", "))
+}
+
+// MKRealTagImmutabilityCheck returns an instance of TagImmutabilityCheck,
+// which allows the given tags to move.
+func MKRealTagImmutabilityCheck(
+	gitRepoPath string,
+	edges map[PromotionEdge]interface{},
+	mutableTags []Tag,
+) (*TagImmutabilityCheck, error) {
+	masterSHA, pullRequestSHA, err := getPullRequestShas()
+	if err != nil {
+		return nil, err
 	}
-	return errStr
+	return &TagImmutabilityCheck{
+		gitRepoPath,
+		masterSHA,
+		pullRequestSHA,
+		edges,
+		mutableTags,
+	}, nil
 }
 
-func (err ImageSizeError) joinImageSizesToString(
-	imageSizes map[string]int,
-) string {
-	imageSizesStr := ""
-	imageNames := make([]string, 0)
-	for k := range imageSizes {
-		imageNames = append(imageNames, k)
+// Run executes TagImmutabilityCheck on a set of promotion edges.
+// Returns an error if the pull request points an existing tag to a different
+// digest.
+func (check *TagImmutabilityCheck) Run() error {
+	masterEdges, err := readMasterEdges(
+		check.GitRepoPath,
+		check.MasterSHA,
+		check.PullRequestSHA)
+	if err != nil {
+		return err
 	}
-	sort.Strings(imageNames)
-	for i, imageName := range imageNames {
-		imageSizesStr += imageName + " (" +
-			fmt.Sprint(BytesToMB(imageSizes[imageName])) + " MiB)"
-		if i < len(imageNames)-1 {
-			imageSizesStr += "\n"
+
+	return check.Compare(masterEdges, check.PullEdges)
+}
+
+// Compare is a function of the TagImmutabilityCheck that handles the
+// comparison of the pull request's set of promotion edges and the master
+// branch's set of promotion edges.
+func (check *TagImmutabilityCheck) Compare(
+	edgesMaster map[PromotionEdge]interface{},
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	mutableTags := make(map[Tag]interface{})
+	for _, tag := range check.MutableTags {
+		mutableTags[tag] = nil
+	}
+
+	// Record the digest of every tag in the destination registries, as of the
+	// master branch.
+	type registryImageTag struct {
+		RegistryName RegistryName
+		ImageTag     ImageTag
+	}
+	masterDigests := make(map[registryImageTag]Digest)
+	for edge := range edgesMaster {
+		if len(edge.DstImageTag.Tag) == 0 {
+			continue
 		}
+		masterDigests[registryImageTag{
+			edge.DstRegistry.Name,
+			edge.DstImageTag,
+		}] = edge.Digest
 	}
-	return imageSizesStr
+
+	movedTags := make([]string, 0)
+	for edge := range edgesPullRequest {
+		if _, ok := mutableTags[edge.DstImageTag.Tag]; ok {
+			continue
+		}
+		digest, found := masterDigests[registryImageTag{
+			edge.DstRegistry.Name,
+			edge.DstImageTag,
+		}]
+		if found && digest != edge.Digest {
+			movedTags = append(movedTags, fmt.Sprintf("%s (%s -> %s)",
+				ToPQIN(
+					edge.DstRegistry.Name,
+					edge.DstImageTag.ImageName,
+					edge.DstImageTag.Tag),
+				digest,
+				edge.Digest))
+		}
+	}
+
+	if len(movedTags) > 0 {
+		sort.Strings(movedTags)
+		return TagImmutabilityError{movedTags}
+	}
+	return nil
 }
 
-// MKRealImageSizeCheck returns an instance of ImageSizeCheck which
-// checks that all images to be promoted are under a max size.
-func MKRealImageSizeCheck(
-	maxImageSize int,
+// Error is a function of TagImmutabilityError and implements the error
+// interface.
+func (err TagImmutabilityError) Error() string {
+	return fmt.Sprintf("The following tags were moved to a different "+
+		"digest in this pull request: %v", strings.Join(err.MovedTags, ", "))
+}
+
+// MKRealMaxTagsPerImageCheck returns an instance of MaxTagsPerImageCheck,
+// which allows up to maxTags tags per destination image, except for the images
+// in allowlist.
+func MKRealMaxTagsPerImageCheck(
+	maxTags int,
 	edges map[PromotionEdge]interface{},
-	digestImageSize DigestImageSize,
-) *ImageSizeCheck {
-	return &ImageSizeCheck{
-		maxImageSize,
-		digestImageSize,
+	allowlist []RegistryImagePath,
+) *MaxTagsPerImageCheck {
+	allowed := make(map[RegistryImagePath]interface{})
+	for _, image := range allowlist {
+		allowed[image] = nil
+	}
+	return &MaxTagsPerImageCheck{
+		maxTags,
 		edges,
+		allowed,
 	}
 }
 
-// Run is a function of ImageSizeCheck and checks that all
-// images to be promoted are under the max file size.
-func (check *ImageSizeCheck) Run() error {
-	maxImageSizeByte := MBToBytes(check.MaxImageSize)
-	oversizedImages := make(map[string]int)
-	invalidImages := make(map[string]int)
-	for edge := range check.PullEdges {
-		imageSize := check.DigestImageSize[edge.Digest]
-		imageName := string(edge.DstImageTag.ImageName)
-		if imageSize > maxImageSizeByte {
-			oversizedImages[imageName] = imageSize
+// Run executes MaxTagsPerImageCheck on a set of promotion edges.
+// Returns an error if any destination image would have more than MaxTags tags.
+func (check *MaxTagsPerImageCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the MaxTagsPerImageCheck that counts the tags of
+// every destination image in the given set of promotion edges (the state of
+// the destination registries once the pull request is merged), and compares
+// them against MaxTags.
+func (check *MaxTagsPerImageCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	tags := make(map[RegistryImagePath]map[Tag]interface{})
+	for edge := range edgesPullRequest {
+		if len(edge.DstImageTag.Tag) == 0 {
+			continue
 		}
-		if imageSize <= 0 {
-			invalidImages[imageName] = imageSize
+		image := RegistryImagePath(string(edge.DstRegistry.Name) + "/" +
+			string(edge.DstImageTag.ImageName))
+		if _, ok := check.Allowlist[image]; ok {
+			continue
 		}
+		if tags[image] == nil {
+			tags[image] = make(map[Tag]interface{})
+		}
+		tags[image][edge.DstImageTag.Tag] = nil
 	}
 
-	if len(oversizedImages) > 0 || len(invalidImages) > 0 {
-		return ImageSizeError{
-			check.MaxImageSize,
-			oversizedImages,
-			invalidImages,
+	tagCounts := make(map[RegistryImagePath]int)
+	for image, imageTags := range tags {
+		if len(imageTags) > check.MaxTags {
+			tagCounts[image] = len(imageTags)
+		}
+	}
+
+	if len(tagCounts) > 0 {
+		return MaxTagsPerImageError{
+			check.MaxTags,
+			tagCounts,
+		}
+	}
+	return nil
+}
+
+// Error is a function of MaxTagsPerImageError and implements the error
+// interface.
+func (err MaxTagsPerImageError) Error() string {
+	images := make([]string, 0)
+	for image := range err.TagCounts {
+		images = append(images, string(image))
+	}
+	sort.Strings(images)
+
+	lines := make([]string, 0)
+	for _, image := range images {
+		lines = append(lines, fmt.Sprintf("%s (%d tags)",
+			image, err.TagCounts[RegistryImagePath(image)]))
+	}
+
+	return fmt.Sprintf("The following images would have more than the max "+
+		"of %d tags:\n%v\n", err.MaxTags, strings.Join(lines, "\n"))
+}
+
+// MKRealSourceRegistryAllowlistCheck returns an instance of
+// SourceRegistryAllowlistCheck, which only allows promoting images from the
+// given source registries.
+func MKRealSourceRegistryAllowlistCheck(
+	allowedSources []RegistryName,
+	edges map[PromotionEdge]interface{},
+) *SourceRegistryAllowlistCheck {
+	return &SourceRegistryAllowlistCheck{
+		allowedSources,
+		edges,
+	}
+}
+
+// Run executes SourceRegistryAllowlistCheck on a set of promotion edges.
+// Returns an error if any edge is promoted from a source registry that is not
+// allowed.
+func (check *SourceRegistryAllowlistCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the SourceRegistryAllowlistCheck that compares the
+// source registry of every promotion edge of the pull request against the
+// allowlist.
+func (check *SourceRegistryAllowlistCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	allowed := make(map[RegistryName]interface{})
+	for _, registry := range check.AllowedSources {
+		allowed[registry] = nil
+	}
+
+	disallowed := make(map[RegistryName]interface{})
+	for edge := range edgesPullRequest {
+		if _, ok := allowed[edge.SrcRegistry.Name]; !ok {
+			disallowed[edge.SrcRegistry.Name] = nil
+		}
+	}
+
+	if len(disallowed) > 0 {
+		sources := make([]RegistryName, 0)
+		for registry := range disallowed {
+			sources = append(sources, registry)
+		}
+		sort.Slice(sources, func(i, j int) bool {
+			return sources[i] < sources[j]
+		})
+		return SourceRegistryError{sources}
+	}
+	return nil
+}
+
+// Error is a function of SourceRegistryError and implements the error
+// interface.
+func (err SourceRegistryError) Error() string {
+	sources := make([]string, 0)
+	for _, registry := range err.DisallowedSources {
+		sources = append(sources, string(registry))
+	}
+	return fmt.Sprintf("The following source registries are not in the "+
+		"allowlist: %v", strings.Join(sources, ", "))
+}
+
+// MKRealBlockedSourceCheck returns an instance of BlockedSourceCheck, which
+// rejects the promotion of images from the source registries that match one
+// of blockedSources. A blocked source is a shell pattern (see path.Match())
+// matched against the whole name of a source registry if it contains any of
+// "*?[", and a substring of the name otherwise (e.g. "docker.io" blocks
+// "docker.io/library" and "registry-1.docker.io").
+func MKRealBlockedSourceCheck(
+	blockedSources []string,
+	edges map[PromotionEdge]interface{},
+) *BlockedSourceCheck {
+	return &BlockedSourceCheck{
+		blockedSources,
+		edges,
+	}
+}
+
+// Run executes BlockedSourceCheck on a set of promotion edges. Returns an
+// error if any edge is promoted from a blocked source registry.
+func (check *BlockedSourceCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the BlockedSourceCheck that compares the source
+// registry of every promotion edge of the pull request against the blocked
+// sources.
+func (check *BlockedSourceCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	for _, pattern := range check.BlockedSources {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid blocked source pattern: %v", pattern)
+		}
+	}
+
+	blocked := make(map[RegistryName]map[ImageName]interface{})
+	for edge := range edgesPullRequest {
+		source := edge.SrcRegistry.Name
+		if !check.isBlocked(source) {
+			continue
+		}
+		if blocked[source] == nil {
+			blocked[source] = make(map[ImageName]interface{})
+		}
+		blocked[source][edge.SrcImageTag.ImageName] = nil
+	}
+
+	if len(blocked) > 0 {
+		blockedImages := make(map[RegistryName][]ImageName)
+		for source, images := range blocked {
+			names := make([]ImageName, 0, len(images))
+			for image := range images {
+				names = append(names, image)
+			}
+			sort.Slice(names, func(i, j int) bool {
+				return names[i] < names[j]
+			})
+			blockedImages[source] = names
+		}
+		return BlockedSourceError{blockedImages}
+	}
+	return nil
+}
+
+// isBlocked returns true if the source registry matches any of the blocked
+// sources of the check.
+func (check *BlockedSourceCheck) isBlocked(source RegistryName) bool {
+	for _, pattern := range check.BlockedSources {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, _ := path.Match(pattern, string(source)); ok {
+				return true
+			}
+		} else if strings.Contains(string(source), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Error is a function of BlockedSourceError and implements the error
+// interface.
+func (err BlockedSourceError) Error() string {
+	sources := make([]string, 0)
+	for source := range err.BlockedImages {
+		sources = append(sources, string(source))
+	}
+	sort.Strings(sources)
+
+	lines := make([]string, 0)
+	for _, source := range sources {
+		images := make([]string, 0)
+		for _, image := range err.BlockedImages[RegistryName(source)] {
+			images = append(images, string(image))
+		}
+		lines = append(lines, fmt.Sprintf("%s (images: %s)",
+			source, strings.Join(images, ", ")))
+	}
+
+	return fmt.Sprintf("The following source registries are blocked:\n%v\n",
+		strings.Join(lines, "\n"))
+}
+
+// MKRealFloatingTagCheck returns an instance of FloatingTagCheck, which
+// rejects the promotion of the given forbidden tags (DefaultFloatingTags if
+// none are given).
+func MKRealFloatingTagCheck(
+	forbiddenTags []Tag,
+	edges map[PromotionEdge]interface{},
+) *FloatingTagCheck {
+	if len(forbiddenTags) == 0 {
+		forbiddenTags = DefaultFloatingTags
+	}
+	return &FloatingTagCheck{
+		forbiddenTags,
+		edges,
+	}
+}
+
+// Run executes FloatingTagCheck on a set of promotion edges. Returns an error
+// if any image is promoted with a forbidden tag.
+func (check *FloatingTagCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the FloatingTagCheck that checks the tags of every
+// promotion edge of the pull request against the forbidden tags.
+func (check *FloatingTagCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	forbidden := make(map[Tag]interface{})
+	for _, tag := range check.ForbiddenTags {
+		forbidden[tag] = nil
+	}
+
+	// The same image may be promoted into several destinations, but it only
+	// needs to be reported once.
+	floating := make(map[ImageTag]interface{})
+	for edge := range edgesPullRequest {
+		if _, ok := forbidden[edge.DstImageTag.Tag]; ok {
+			floating[edge.DstImageTag] = nil
+		}
+	}
+
+	if len(floating) > 0 {
+		imageTags := make([]ImageTag, 0)
+		for imageTag := range floating {
+			imageTags = append(imageTags, imageTag)
+		}
+		sort.Slice(imageTags, func(i, j int) bool {
+			if imageTags[i].ImageName != imageTags[j].ImageName {
+				return imageTags[i].ImageName < imageTags[j].ImageName
+			}
+			return imageTags[i].Tag < imageTags[j].Tag
+		})
+		return FloatingTagError{imageTags}
+	}
+	return nil
+}
+
+// Error is a function of FloatingTagError and implements the error
+// interface.
+func (err FloatingTagError) Error() string {
+	errStr := "The following images would be promoted with a forbidden " +
+		"floating tag:\n"
+	for _, imageTag := range err.FloatingTags {
+		errStr += fmt.Sprintf("%s:%s\n", imageTag.ImageName, imageTag.Tag)
+	}
+	return errStr
+}
+
+// MKRealTagPatternCheck returns an instance of TagPatternCheck, which requires
+// the promoted tags (other than exemptTags) to match the regular expression
+// pattern as a whole (DefaultTagPattern if empty).
+func MKRealTagPatternCheck(
+	pattern string,
+	exemptTags []Tag,
+	edges map[PromotionEdge]interface{},
+) (*TagPatternCheck, error) {
+	if pattern == "" {
+		pattern = DefaultTagPattern
+	}
+	if _, err := compileTagPattern(pattern); err != nil {
+		return nil, err
+	}
+	return &TagPatternCheck{
+		pattern,
+		exemptTags,
+		edges,
+	}, nil
+}
+
+// compileTagPattern compiles the pattern of a TagPatternCheck, so that it
+// only matches whole tags.
+func compileTagPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// Run executes TagPatternCheck on a set of promotion edges. Returns an error
+// if any image is promoted with a tag which does not match the pattern.
+func (check *TagPatternCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the TagPatternCheck that checks the tags of every
+// promotion edge of the pull request against the pattern.
+func (check *TagPatternCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	re, err := compileTagPattern(check.Pattern)
+	if err != nil {
+		return err
+	}
+	exempt := make(map[Tag]interface{})
+	for _, tag := range check.ExemptTags {
+		exempt[tag] = nil
+	}
+
+	// The same image may be promoted into several destinations, but it only
+	// needs to be reported once.
+	nonConforming := make(map[ImageTag]interface{})
+	for edge := range edgesPullRequest {
+		tag := edge.DstImageTag.Tag
+		if tag == "" {
+			continue
 		}
+		if _, ok := exempt[tag]; ok {
+			continue
+		}
+		if !re.MatchString(string(tag)) {
+			nonConforming[edge.DstImageTag] = nil
+		}
+	}
+
+	if len(nonConforming) > 0 {
+		imageTags := make([]ImageTag, 0)
+		for imageTag := range nonConforming {
+			imageTags = append(imageTags, imageTag)
+		}
+		sort.Slice(imageTags, func(i, j int) bool {
+			if imageTags[i].ImageName != imageTags[j].ImageName {
+				return imageTags[i].ImageName < imageTags[j].ImageName
+			}
+			return imageTags[i].Tag < imageTags[j].Tag
+		})
+		return TagPatternError{check.Pattern, imageTags}
+	}
+	return nil
+}
+
+// Error is a function of TagPatternError and implements the error interface.
+func (err TagPatternError) Error() string {
+	errStr := fmt.Sprintf("The following images would be promoted with a tag "+
+		"which does not match %s:\n", err.Pattern)
+	for _, imageTag := range err.NonConforming {
+		errStr += fmt.Sprintf("%s:%s\n", imageTag.ImageName, imageTag.Tag)
+	}
+	return errStr
+}
+
+// MKRealDigestAllowlistCheck returns an instance of DigestAllowlistCheck,
+// which only allows promoting the given images at the given digests.
+func MKRealDigestAllowlistCheck(
+	allowedDigests map[ImageName][]Digest,
+	edges map[PromotionEdge]interface{},
+) *DigestAllowlistCheck {
+	return &DigestAllowlistCheck{
+		allowedDigests,
+		edges,
 	}
+}
 
+// Run executes DigestAllowlistCheck on a set of promotion edges. Returns an
+// error if any pinned image is promoted at a digest that is not allowed.
+func (check *DigestAllowlistCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the DigestAllowlistCheck that checks the digest of
+// every promotion edge of a pinned image against its allowed digests.
+func (check *DigestAllowlistCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	// The same digest may be promoted into several destinations, or with
+	// several tags, but it only needs to be reported once.
+	disallowed := make(map[ImageName]map[Digest]interface{})
+	for edge := range edgesPullRequest {
+		imageName := edge.SrcImageTag.ImageName
+		allowedDigests, pinned := check.AllowedDigests[imageName]
+		if !pinned {
+			continue
+		}
+
+		allowed := false
+		for _, digest := range allowedDigests {
+			if digest == edge.Digest {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			continue
+		}
+
+		if disallowed[imageName] == nil {
+			disallowed[imageName] = make(map[Digest]interface{})
+		}
+		disallowed[imageName][edge.Digest] = nil
+	}
+
+	if len(disallowed) == 0 {
+		return nil
+	}
+
+	err := DigestAllowlistError{
+		DisallowedDigests: make(map[ImageName][]Digest),
+		AllowedDigests:    make(map[ImageName][]Digest),
+	}
+	for imageName, digests := range disallowed {
+		for digest := range digests {
+			err.DisallowedDigests[imageName] = append(
+				err.DisallowedDigests[imageName], digest)
+		}
+		sortDigests(err.DisallowedDigests[imageName])
+
+		allowed := append([]Digest{}, check.AllowedDigests[imageName]...)
+		sortDigests(allowed)
+		err.AllowedDigests[imageName] = allowed
+	}
+	return err
+}
+
+// Error is a function of DigestAllowlistError and implements the error
+// interface.
+func (err DigestAllowlistError) Error() string {
+	imageNames := make([]string, 0)
+	for imageName := range err.DisallowedDigests {
+		imageNames = append(imageNames, string(imageName))
+	}
+	sort.Strings(imageNames)
+
+	errStr := "The following images would be promoted at a digest that is " +
+		"not in the allowlist:\n"
+	for _, imageName := range imageNames {
+		allowed := make([]string, 0)
+		for _, digest := range err.AllowedDigests[ImageName(imageName)] {
+			allowed = append(allowed, string(digest))
+		}
+		if len(allowed) == 0 {
+			allowed = append(allowed, "none")
+		}
+		for _, digest := range err.DisallowedDigests[ImageName(imageName)] {
+			errStr += fmt.Sprintf("%s@%s (allowed: %s)\n",
+				imageName, digest, strings.Join(allowed, ", "))
+		}
+	}
+	return errStr
+}
+
+// sortDigests sorts the digests, for deterministic error messages.
+func sortDigests(digests []Digest) {
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i] < digests[j]
+	})
+}
+
+// MKRealDigestFormatCheck returns an instance of DigestFormatCheck, which
+// checks that all digests to be promoted are well-formed.
+func MKRealDigestFormatCheck(
+	allowSHA512 bool,
+	edges map[PromotionEdge]interface{},
+) *DigestFormatCheck {
+	return &DigestFormatCheck{
+		allowSHA512,
+		edges,
+	}
+}
+
+var validSHA512Digest = regexp.MustCompile(`^sha512:[0-9a-f]{128}$`)
+
+// Run executes DigestFormatCheck on a set of promotion edges.
+// Returns an error if any digest is malformed.
+func (check *DigestFormatCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the DigestFormatCheck that validates the digest of
+// every promotion edge of the pull request.
+func (check *DigestFormatCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	type imageDigest struct {
+		Image  RegistryImagePath
+		Digest Digest
+	}
+	invalid := make(map[imageDigest]interface{})
+	for edge := range edgesPullRequest {
+		if ValidateDigest(edge.Digest) == nil {
+			continue
+		}
+		if check.AllowSHA512 &&
+			validSHA512Digest.MatchString(string(edge.Digest)) {
+			continue
+		}
+		image := RegistryImagePath(string(edge.SrcRegistry.Name) + "/" +
+			string(edge.SrcImageTag.ImageName))
+		invalid[imageDigest{image, edge.Digest}] = nil
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	invalidDigests := make(map[RegistryImagePath][]Digest)
+	for key := range invalid {
+		invalidDigests[key.Image] = append(invalidDigests[key.Image],
+			key.Digest)
+	}
+	for _, digests := range invalidDigests {
+		sort.Slice(digests, func(i, j int) bool {
+			return digests[i] < digests[j]
+		})
+	}
+	return DigestFormatError{invalidDigests}
+}
+
+// Error is a function of DigestFormatError and implements the error
+// interface.
+func (err DigestFormatError) Error() string {
+	images := make([]string, 0)
+	for image := range err.InvalidDigests {
+		images = append(images, string(image))
+	}
+	sort.Strings(images)
+
+	lines := make([]string, 0)
+	for _, image := range images {
+		for _, digest := range err.InvalidDigests[RegistryImagePath(image)] {
+			lines = append(lines, fmt.Sprintf("%s@%s", image, digest))
+		}
+	}
+
+	return fmt.Sprintf("The following images have malformed digests:\n%v\n",
+		strings.Join(lines, "\n"))
+}
+
+// MKRealSourceDigestExistsCheck returns an instance of
+// SourceDigestExistsCheck, which checks that the digests to be promoted exist
+// in their source registries. The source repositories of the edges are read
+// first (see ReadSourceRepositories()).
+func MKRealSourceDigestExistsCheck(
+	ctx context.Context,
+	sc *SyncContext,
+	edges map[PromotionEdge]interface{},
+) (*SourceDigestExistsCheck, error) {
+	err := sc.ReadSourceRepositories(ctx, edges, MkReadRepositoryCmdReal)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read source repositories: %v", err)
+	}
+
+	return &SourceDigestExistsCheck{
+		sc.Inv,
+		edges,
+	}, nil
+}
+
+// ReadSourceRepositories reads the source repositories of the given promotion
+// edges into sc.Inv. Only those repositories are read (not recursively), so
+// this is fast even for large source registries. Unlike
+// FilterPromotionEdges(), an error reading one of them is returned.
+func (sc *SyncContext) ReadSourceRepositories(
+	ctx context.Context,
+	edges map[PromotionEdge]interface{},
+	mkReadRepositoryCmd func(*SyncContext, RegistryContext) stream.Producer,
+) error {
+	srcRepos := make(map[RegistryName]RegistryContext)
+	for edge := range edges {
+		rc := edge.SrcRegistry
+		rc.Name = rc.Name + "/" + RegistryName(edge.SrcImageTag.ImageName)
+		srcRepos[rc.Name] = rc
+	}
+
+	toRead := make([]RegistryContext, 0, len(srcRepos))
+	for _, rc := range srcRepos {
+		toRead = append(toRead, rc)
+	}
+	sort.Slice(toRead, func(i, j int) bool {
+		return toRead[i].Name < toRead[j].Name
+	})
+	for _, rc := range toRead {
+		logging.Log().Info("reading registry", "registry", rc.Name)
+	}
+	return sc.ReadRegistries(ctx, toRead, false, mkReadRepositoryCmd)
+}
+
+// Run executes SourceDigestExistsCheck on a set of promotion edges. Returns
+// an error if any digest is missing from its source registry.
+func (check *SourceDigestExistsCheck) Run() error {
+	return check.Compare(check.PullEdges)
+}
+
+// Compare is a function of the SourceDigestExistsCheck that looks up the
+// digest of every promotion edge of the pull request in the source inventory.
+func (check *SourceDigestExistsCheck) Compare(
+	edgesPullRequest map[PromotionEdge]interface{},
+) error {
+	type imageDigest struct {
+		Image  RegistryImagePath
+		Digest Digest
+	}
+	missing := make(map[imageDigest]interface{})
+	for edge := range edgesPullRequest {
+		rii := check.SrcInv[edge.SrcRegistry.Name]
+		if _, ok := rii[edge.SrcImageTag.ImageName][edge.Digest]; ok {
+			continue
+		}
+		image := RegistryImagePath(string(edge.SrcRegistry.Name) + "/" +
+			string(edge.SrcImageTag.ImageName))
+		missing[imageDigest{image, edge.Digest}] = nil
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	missingDigests := make(map[RegistryImagePath][]Digest)
+	for key := range missing {
+		missingDigests[key.Image] = append(missingDigests[key.Image],
+			key.Digest)
+	}
+	for _, digests := range missingDigests {
+		sortDigests(digests)
+	}
+	return SourceDigestError{missingDigests}
+}
+
+// Error is a function of SourceDigestError and implements the error
+// interface.
+func (err SourceDigestError) Error() string {
+	images := make([]string, 0)
+	for image := range err.MissingDigests {
+		images = append(images, string(image))
+	}
+	sort.Strings(images)
+
+	lines := make([]string, 0)
+	for _, image := range images {
+		for _, digest := range err.MissingDigests[RegistryImagePath(image)] {
+			lines = append(lines, fmt.Sprintf("%s@%s", image, digest))
+		}
+	}
+
+	return fmt.Sprintf("The following digests do not exist in their "+
+		"source registries:\n%v\n",
+		strings.Join(lines, "\n"))
+}
+
+// MKRealSourceRegistryFlagCheck returns an instance of
+// SourceRegistryFlagCheck, which checks that the source registry of every
+// manifest is set correctly.
+func MKRealSourceRegistryFlagCheck(
+	mfests []Manifest) *SourceRegistryFlagCheck {
+	return &SourceRegistryFlagCheck{mfests}
+}
+
+// Run executes SourceRegistryFlagCheck on a set of manifests. Returns an
+// error if a manifest does not have exactly one registry marked as the
+// source, or if it is not the source registry of the manifest.
+func (check *SourceRegistryFlagCheck) Run() error {
+	misconfigured := make([]MisconfiguredManifest, 0)
+	for _, mfest := range check.Manifests {
+		m := MisconfiguredManifest{Filepath: mfest.Filepath}
+		for _, rc := range mfest.Registries {
+			if rc.Src {
+				m.SrcRegistries = append(m.SrcRegistries, rc.Name)
+			}
+		}
+		if mfest.SrcRegistry != nil {
+			m.SrcRegistry = mfest.SrcRegistry.Name
+		}
+
+		if len(m.SrcRegistries) == 1 && m.SrcRegistries[0] == m.SrcRegistry {
+			continue
+		}
+		misconfigured = append(misconfigured, m)
+	}
+
+	if len(misconfigured) > 0 {
+		return SourceRegistryFlagError{misconfigured}
+	}
+	return nil
+}
+
+// Error is a function of SourceRegistryFlagError and implements the error
+// interface.
+func (err SourceRegistryFlagError) Error() string {
+	lines := make([]string, 0, len(err.Misconfigured))
+	for _, m := range err.Misconfigured {
+		lines = append(lines, m.String())
+	}
+
+	return fmt.Sprintf("The following manifests have a misconfigured source "+
+		"registry:\n%v\n", strings.Join(lines, "\n"))
+}
+
+// String describes what is wrong with the source registry of the manifest.
+func (m MisconfiguredManifest) String() string {
+	name := m.Filepath
+	if name == "" {
+		name = "(manifest)"
+	}
+
+	switch {
+	case len(m.SrcRegistries) == 0:
+		return fmt.Sprintf("%s: no registry is marked with 'src: true'", name)
+	case len(m.SrcRegistries) > 1:
+		srcs := make([]string, 0, len(m.SrcRegistries))
+		for _, src := range m.SrcRegistries {
+			srcs = append(srcs, string(src))
+		}
+		return fmt.Sprintf(
+			"%s: %d registries are marked with 'src: true' (%s); "+
+				"only the source registry may be",
+			name, len(m.SrcRegistries), strings.Join(srcs, ", "))
+	case m.SrcRegistry == "":
+		return fmt.Sprintf("%s: the source registry is not set "+
+			"(%s is marked with 'src: true')", name, m.SrcRegistries[0])
+	default:
+		return fmt.Sprintf("%s: the source registry is %s, "+
+			"but %s is marked with 'src: true'",
+			name, m.SrcRegistry, m.SrcRegistries[0])
+	}
+}
+
+// MKRealDuplicateImageCheck returns an instance of DuplicateImageCheck, which
+// checks that images defined more than once in the manifests agree.
+func MKRealDuplicateImageCheck(mfests []Manifest) *DuplicateImageCheck {
+	return &DuplicateImageCheck{mfests}
+}
+
+// Run executes DuplicateImageCheck on a set of manifests. Returns an error if
+// a tag of an image points to different digests for the same destination
+// registry.
+func (check *DuplicateImageCheck) Run() error {
+	definitions := make(map[RegistryImagePath]int)
+	tagDigests := make(map[RegistryImagePath]map[Tag]map[Digest]interface{})
+	for _, mfest := range check.Manifests {
+		for _, image := range mfest.Images {
+			for _, rc := range mfest.Registries {
+				if rc.Src {
+					continue
+				}
+				path := RegistryImagePath(
+					string(rc.Name) + "/" + string(image.ImageName))
+				definitions[path]++
+				if tagDigests[path] == nil {
+					tagDigests[path] = make(map[Tag]map[Digest]interface{})
+				}
+				for digest, tags := range image.Dmap {
+					for _, tag := range tags {
+						if tagDigests[path][tag] == nil {
+							tagDigests[path][tag] =
+								make(map[Digest]interface{})
+						}
+						tagDigests[path][tag][digest] = nil
+					}
+				}
+			}
+		}
+	}
+
+	conflicts := make(map[RegistryImagePath]map[Tag][]Digest)
+	for path, tags := range tagDigests {
+		for tag, digests := range tags {
+			if len(digests) < 2 {
+				continue
+			}
+			if conflicts[path] == nil {
+				conflicts[path] = make(map[Tag][]Digest)
+			}
+			for digest := range digests {
+				conflicts[path][tag] = append(conflicts[path][tag], digest)
+			}
+			sortDigests(conflicts[path][tag])
+		}
+		if conflicts[path] == nil && definitions[path] > 1 {
+			logging.Log().Info("image is defined more than once, identically",
+				"image", path,
+				"definitions", definitions[path])
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return DuplicateImageError{conflicts}
+	}
+	return nil
+}
+
+// Error is a function of DuplicateImageError and implements the error
+// interface.
+func (err DuplicateImageError) Error() string {
+	lines := make([]string, 0)
+	for image, tags := range err.Conflicts {
+		for tag, digests := range tags {
+			digestStrs := make([]string, 0, len(digests))
+			for _, digest := range digests {
+				digestStrs = append(digestStrs, string(digest))
+			}
+			lines = append(lines, fmt.Sprintf("%s:%s (%s)",
+				image, tag, strings.Join(digestStrs, ", ")))
+		}
+	}
+	sort.Strings(lines)
+
+	return fmt.Sprintf("The following tags of duplicate image definitions "+
+		"point to different digests:\n%v\n", strings.Join(lines, "\n"))
+}
+
+// Error is a function of ImageSizeError and implements the error interface.
+func (err ImageSizeError) Error() string {
+	errStr := ""
+	if len(err.OversizedImages) > 0 {
+		errStr += fmt.Sprintf("The following images were over the max file "+
+			"size of %dMiB:\n%v\n", err.MaxImageSize,
+			err.joinImageSizesToString(err.OversizedImages, err.Overrides))
+		if err.SuggestedMaxImageSize > 0 {
+			errStr += fmt.Sprintf("To allow them, raise the max image size "+
+				"to at least %dMiB.\n", err.SuggestedMaxImageSize)
+		}
+	}
+	if len(err.InvalidImages) > 0 {
+		errStr += fmt.Sprintf("The following images had an invalid file size "+
+			"of 0 bytes or less:\n%v\n",
+			err.joinImageSizesToString(err.InvalidImages, nil))
+	}
+	return errStr
+}
+
+func (err ImageSizeError) joinImageSizesToString(
+	imageSizes map[string]int,
+	overrides map[string]int,
+) string {
+	imageSizesStr := ""
+	imageNames := make([]string, 0)
+	for k := range imageSizes {
+		imageNames = append(imageNames, k)
+	}
+	sort.Strings(imageNames)
+	for i, imageName := range imageNames {
+		imageSizesStr += imageName + " (" +
+			BytesToHuman(int64(imageSizes[imageName]))
+		if override, ok := overrides[imageName]; ok {
+			imageSizesStr += ", over the override of " +
+				fmt.Sprint(override) + "MiB"
+		}
+		imageSizesStr += ")"
+		if i < len(imageNames)-1 {
+			imageSizesStr += "\n"
+		}
+	}
+	return imageSizesStr
+}
+
+// MKRealImageSizeCheck returns an instance of ImageSizeCheck which
+// checks that all images to be promoted are under a max size (or under their
+// own max size, if they have an override). Image sizes that were not already
+// read into sc.DigestImageSize are read from the source registries, with
+// sc.Threads concurrent requests. If maxImageSize is 0, the max size is
+// derived from the destination images in sc.Inv, with the given headroom (in
+// percent).
+func MKRealImageSizeCheck(
+	sc *SyncContext,
+	maxImageSize int,
+	headroom int,
+	edges map[PromotionEdge]interface{},
+	overrides map[string]int,
+) *ImageSizeCheck {
+	return &ImageSizeCheck{
+		maxImageSize,
+		sc.DigestImageSize,
+		edges,
+		overrides,
+		sc.Threads,
+		func(edge PromotionEdge) stream.Producer {
+			return MkReadManifestListCmdReal(
+				sc,
+				GCRManifestListContext{
+					RegistryContext: edge.SrcRegistry,
+					ImageName:       edge.SrcImageTag.ImageName,
+					Tag:             edge.SrcImageTag.Tag,
+					Digest:          edge.Digest,
+				})
+		},
+		sc.Inv,
+		headroom,
+		sc.Budget,
+		newImageSizeCache(),
+	}
+}
+
+// Run is a function of ImageSizeCheck and checks that all
+// images to be promoted are under the max file size.
+func (check *ImageSizeCheck) Run() error {
+	if err := check.readMissingImageSizes(); err != nil {
+		return err
+	}
+
+	defaultMaxImageSize := check.MaxImageSize
+	if defaultMaxImageSize <= 0 {
+		defaultMaxImageSize = check.deriveMaxImageSize()
+	}
+
+	oversizedImages := make(map[string]int)
+	invalidImages := make(map[string]int)
+	appliedOverrides := make(map[string]int)
+	largestOversized := 0
+	for edge := range check.PullEdges {
+		imageSize := check.DigestImageSize[edge.Digest]
+		imageName := string(edge.DstImageTag.ImageName)
+		maxImageSize, overridden := check.Overrides[imageName]
+		if !overridden {
+			maxImageSize = defaultMaxImageSize
+		}
+		if imageSize > MBToBytes(maxImageSize) {
+			oversizedImages[imageName] = imageSize
+			if overridden {
+				appliedOverrides[imageName] = maxImageSize
+			} else if imageSize > largestOversized {
+				largestOversized = imageSize
+			}
+		}
+		if imageSize <= 0 {
+			invalidImages[imageName] = imageSize
+		}
+	}
+
+	if len(oversizedImages) > 0 || len(invalidImages) > 0 {
+		return ImageSizeError{
+			defaultMaxImageSize,
+			oversizedImages,
+			invalidImages,
+			appliedOverrides,
+			bytesToMBRoundedUp(largestOversized),
+		}
+	}
+
+	return nil
+}
+
+// deriveMaxImageSize computes the max image size (in MiB) as the size of the
+// largest image already in the destination repositories of the edges, plus
+// the headroom, rounded up. DefaultMaxImageSize is used if there is no such
+// image of a known size.
+func (check *ImageSizeCheck) deriveMaxImageSize() int {
+	largest := 0
+	for edge := range check.PullEdges {
+		rii := check.DestInv[edge.DstRegistry.Name]
+		for digest := range rii[edge.DstImageTag.ImageName] {
+			if size := check.DigestImageSize[digest]; size > largest {
+				largest = size
+			}
+		}
+	}
+
+	if largest <= 0 {
+		logging.Log().Info(
+			"no destination images to derive the max image size from",
+			"maxImageSizeMiB", DefaultMaxImageSize)
+		return DefaultMaxImageSize
+	}
+
+	limit := largest + largest*check.Headroom/100
+	maxImageSize := bytesToMBRoundedUp(limit)
+	logging.Log().Info(
+		"derived the max image size from the destination images",
+		"largestImageBytes", largest,
+		"largestImageSize", BytesToHuman(int64(largest)),
+		"headroomPercent", check.Headroom,
+		"maxImageSizeMiB", maxImageSize)
+	return maxImageSize
+}
+
+// readMissingImageSizes computes the sizes of the images to be promoted that
+// are not in DigestImageSize, using a bounded pool of Threads goroutines.
+// Images whose size cannot be computed are reported together, by digest.
+func (check *ImageSizeCheck) readMissingImageSizes() error {
+	if check.MkReadManifestCmd == nil {
+		return nil
+	}
+	if check.DigestImageSize == nil {
+		check.DigestImageSize = make(DigestImageSize)
+	}
+	if check.sizeCache == nil {
+		check.sizeCache = newImageSizeCache()
+	}
+
+	// Multiple edges can have the same digest; only schedule it once (the
+	// sizeCache makes sure it is only read once).
+	missing := make(map[Digest]PromotionEdge)
+	for edge := range check.PullEdges {
+		if _, ok := check.DigestImageSize[edge.Digest]; !ok {
+			missing[edge.Digest] = edge
+		}
+	}
+
+	threads := 10
+	if check.Threads > 0 {
+		threads = check.Threads
+	}
+	semaphore := make(chan struct{}, threads)
+	mutex := &sync.Mutex{}
+	wg := new(sync.WaitGroup)
+	sizeErrors := make([]string, 0)
+
+	for digest, edge := range missing {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(digest Digest, edge PromotionEdge) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			size, err := check.sizeCache.get(digest, func() (int, error) {
+				return getImageSizeFrom(
+					check.Budget.Producer(check.MkReadManifestCmd(edge)))
+			})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				sizeErrors = append(sizeErrors,
+					fmt.Sprintf("%s: %v", digest, err))
+				return
+			}
+			check.DigestImageSize[digest] = size
+		}(digest, edge)
+	}
+	wg.Wait()
+
+	if len(sizeErrors) > 0 {
+		sort.Strings(sizeErrors)
+		return fmt.Errorf("could not read the size of %d images:\n%s",
+			len(sizeErrors),
+			strings.Join(sizeErrors, "\n"))
+	}
+	return nil
+}
+
+// imageSizeCache remembers the sizes (or the errors) read for each digest, so
+// that concurrent lookups of the same digest only read it once; the others
+// wait for the result.
+type imageSizeCache struct {
+	mutex   sync.Mutex
+	entries map[Digest]*imageSizeEntry
+}
+
+// imageSizeEntry is the result of reading the size of a digest.
+type imageSizeEntry struct {
+	once sync.Once
+	size int
+	err  error
+}
+
+func newImageSizeCache() *imageSizeCache {
+	return &imageSizeCache{entries: make(map[Digest]*imageSizeEntry)}
+}
+
+// get returns the size of the digest, calling read only if it was never
+// called for that digest.
+func (c *imageSizeCache) get(
+	digest Digest,
+	read func() (int, error)) (int, error) {
+
+	c.mutex.Lock()
+	entry, ok := c.entries[digest]
+	if !ok {
+		entry = &imageSizeEntry{}
+		c.entries[digest] = entry
+	}
+	c.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.size, entry.err = read()
+	})
+	return entry.size, entry.err
+}
+
+// getImageSizeFrom computes the size of an image as the sum of the sizes of
+// its config and layers, as listed in its manifest.
+func getImageSizeFrom(producer stream.Producer) (int, error) {
+	reader, _, err := producer.Produce()
+	if err != nil {
+		return 0, err
+	}
+
+	// nolint[errcheck]
+	defer producer.Close()
+
+	var mfest ggcrV1.Manifest
+	if err := json.NewDecoder(reader).Decode(&mfest); err != nil {
+		return 0, err
+	}
+
+	if isManifestList(mfest.MediaType) {
+		return 0, fmt.Errorf("cannot compute the size of a manifest list")
+	}
+
+	size := mfest.Config.Size
+	for _, layer := range mfest.Layers {
+		size += layer.Size
+	}
+	return int(size), nil
+}
+
+// Error is a function of TotalSizeError and implements the error interface.
+func (err TotalSizeError) Error() string {
+	return fmt.Sprintf("The images to be promoted have a total size of "+
+		"%s, which is over the max total size of %dMiB",
+		BytesToHuman(int64(err.TotalSize)), err.MaxTotalSize)
+}
+
+// MKRealTotalSizeCheck returns an instance of TotalSizeCheck which checks
+// that the combined size of all images to be promoted is under a max size.
+// The image sizes are the same ones used by ImageSizeCheck.
+func MKRealTotalSizeCheck(
+	maxTotalSize int,
+	edges map[PromotionEdge]interface{},
+	digestImageSize DigestImageSize,
+) *TotalSizeCheck {
+	return &TotalSizeCheck{
+		maxTotalSize,
+		digestImageSize,
+		edges,
+	}
+}
+
+// Run is a function of TotalSizeCheck and checks that the combined size of
+// all images to be promoted is under the max total size. An image is counted
+// once for every destination registry it is promoted to (regardless of how
+// many tags it gets there), because each registry stores its own copy.
+func (check *TotalSizeCheck) Run() error {
+	type registryDigest struct {
+		RegistryName RegistryName
+		Digest       Digest
+	}
+	counted := make(map[registryDigest]interface{})
+
+	totalSize := 0
+	for edge := range check.PullEdges {
+		key := registryDigest{edge.DstRegistry.Name, edge.Digest}
+		if _, ok := counted[key]; ok {
+			continue
+		}
+		counted[key] = nil
+		totalSize += check.DigestImageSize[edge.Digest]
+	}
+
+	if totalSize > MBToBytes(check.MaxTotalSize) {
+		return TotalSizeError{
+			check.MaxTotalSize,
+			totalSize,
+		}
+	}
+
+	return nil
+}
+
+// severityNames maps each Severity to its name in GCP Container Analysis.
+var severityNames = map[Severity]string{
+	SeverityUnspecified: "SEVERITY_UNSPECIFIED",
+	SeverityMinimal:     "MINIMAL",
+	SeverityLow:         "LOW",
+	SeverityMedium:      "MEDIUM",
+	SeverityHigh:        "HIGH",
+	SeverityCritical:    "CRITICAL",
+}
+
+// String returns the name of the Severity.
+func (severity Severity) String() string {
+	if name, ok := severityNames[severity]; ok {
+		return name
+	}
+	return fmt.Sprintf("Severity(%d)", int(severity))
+}
+
+// ParseSeverity parses the name of a Severity (e.g., "critical"). The name is
+// case insensitive.
+func ParseSeverity(name string) (Severity, error) {
+	for severity, severityName := range severityNames {
+		if strings.EqualFold(name, severityName) {
+			return severity, nil
+		}
+	}
+	return SeverityUnspecified, fmt.Errorf("unknown severity %q", name)
+}
+
+// Error is a function of VulnerabilityError and implements the error
+// interface.
+func (err VulnerabilityError) Error() string {
+	images := make([]string, 0)
+	for image := range err.VulnerableImages {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	lines := make([]string, 0)
+	for _, image := range images {
+		vulns := make([]string, 0)
+		for _, vuln := range err.VulnerableImages[image] {
+			vulns = append(vulns,
+				fmt.Sprintf("%s (%s)", vuln.ID, vuln.Severity))
+		}
+		sort.Strings(vulns)
+		lines = append(lines,
+			fmt.Sprintf("%s: %s", image, strings.Join(vulns, ", ")))
+	}
+
+	return fmt.Sprintf("The following images have vulnerabilities with a "+
+		"severity of %s or higher:\n%v\n", err.MaxSeverity,
+		strings.Join(lines, "\n"))
+}
+
+// MKRealVulnerabilityCheck returns an instance of VulnerabilityCheck which
+// checks that none of the images to be promoted have vulnerabilities with a
+// severity of maxSeverity or higher. The vulnerabilities are read from GCP
+// Container Analysis, so only images whose source registry is in GCR can be
+// scanned. The other images are an error, unless skipUnscannable is set, in
+// which case they are skipped (and logged).
+func MKRealVulnerabilityCheck(
+	sc *SyncContext,
+	maxSeverity Severity,
+	skipUnscannable bool,
+	edges map[PromotionEdge]interface{},
+) (*VulnerabilityCheck, error) {
+	gcrEdges := make(map[PromotionEdge]interface{})
+	unscannable := make([]string, 0)
+	for edge := range edges {
+		if _, ok := GetRegistryClient(edge.SrcRegistry).(*gcrClient); !ok {
+			if !skipUnscannable {
+				unscannable = append(unscannable, ToFQIN(
+					edge.SrcRegistry.Name,
+					edge.SrcImageTag.ImageName,
+					edge.Digest))
+				continue
+			}
+			logging.Log().Info(
+				"cannot scan image for vulnerabilities (not in GCR)",
+				edge.logFields()...)
+			continue
+		}
+		gcrEdges[edge] = nil
+	}
+
+	if len(unscannable) > 0 {
+		sort.Strings(unscannable)
+		return nil, fmt.Errorf("Cannot scan the following images for "+
+			"vulnerabilities (not in GCR):\n%v",
+			strings.Join(unscannable, "\n"))
+	}
+
+	digestVulnerabilities, err := sc.ReadVulnerabilities(
+		gcrEdges,
+		MkReadVulnerabilitiesCmdReal)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read vulnerabilities: %v", err)
+	}
+
+	return &VulnerabilityCheck{
+		maxSeverity,
+		digestVulnerabilities,
+		edges,
+	}, nil
+}
+
+// Run is a function of VulnerabilityCheck and checks that none of the images
+// to be promoted have vulnerabilities with a severity of MaxSeverity or
+// higher.
+func (check *VulnerabilityCheck) Run() error {
+	vulnerableImages := make(map[string][]Vulnerability)
+	for edge := range check.PullEdges {
+		found := make([]Vulnerability, 0)
+		for _, vuln := range check.DigestVulnerabilities[edge.Digest] {
+			if vuln.Severity >= check.MaxSeverity {
+				found = append(found, vuln)
+			}
+		}
+		if len(found) > 0 {
+			image := string(edge.DstImageTag.ImageName) + "@" +
+				string(edge.Digest)
+			vulnerableImages[image] = found
+		}
+	}
+
+	if len(vulnerableImages) > 0 {
+		return VulnerabilityError{
+			check.MaxSeverity,
+			vulnerableImages,
+		}
+	}
+
+	return nil
+}
+
+// ReadVulnerabilities reads the vulnerabilities of the source images of the
+// given promotion edges.
+func (sc *SyncContext) ReadVulnerabilities(
+	edges map[PromotionEdge]interface{},
+	mkProducer func(
+		*SyncContext, VulnerabilityContext, string) stream.Producer,
+) (DigestVulnerabilities, error) {
+
+	digestVulnerabilities := make(DigestVulnerabilities)
+
+	var populateRequests PopulateRequests = func(
+		sc *SyncContext,
+		reqs chan<- stream.ExternalRequest,
+		wg *sync.WaitGroup) {
+
+		// Multiple edges can have the same source image; only read it once.
+		seen := make(map[VulnerabilityContext]interface{})
+		for edge := range edges {
+			vc := VulnerabilityContext{
+				RegistryContext: edge.SrcRegistry,
+				ImageName:       edge.SrcImageTag.ImageName,
+				Digest:          edge.Digest,
+			}
+			if _, ok := seen[vc]; ok {
+				continue
+			}
+			seen[vc] = nil
+
+			var req stream.ExternalRequest
+			req.RequestParams = vc
+			req.StreamProducer = mkProducer(sc, vc, "")
+			wg.Add(1)
+			reqs <- req
+		}
+	}
+
+	var processRequest ProcessRequest = func(
+		sc *SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			reqRes := RequestResult{Context: req}
+			vc := req.RequestParams.(VulnerabilityContext)
+
+			// Follow the page tokens until the last page has been read.
+			vulns := make([]Vulnerability, 0)
+			producer := req.StreamProducer
+			var err error
+			for {
+				var page []Vulnerability
+				var nextPageToken string
+				page, nextPageToken, err = getVulnerabilitiesFrom(producer)
+				if err != nil {
+					break
+				}
+				vulns = append(vulns, page...)
+				if len(nextPageToken) == 0 {
+					break
+				}
+				producer = mkProducer(sc, vc, nextPageToken)
+			}
+			if err != nil {
+				reqRes.Errors = Errors{
+					Error{
+						Context: "getVulnerabilitiesFrom",
+						Error:   err}}
+				requestResults <- reqRes
+				continue
+			}
+
+			mutex.Lock()
+			digestVulnerabilities[vc.Digest] = vulns
+			mutex.Unlock()
+
+			reqRes.Errors = Errors{}
+			requestResults <- reqRes
+		}
+	}
+
+	err := sc.ExecRequests(populateRequests, processRequest)
+	return digestVulnerabilities, err
+}
+
+// MkReadVulnerabilitiesCmdReal creates a stream.Producer which lists the
+// vulnerability occurrences of an image in GCP Container Analysis. The GCP
+// project is the one that hosts the GCR registry of the image. If pageToken is
+// not empty, the page it refers to is listed instead of the first one.
+func MkReadVulnerabilitiesCmdReal(
+	sc *SyncContext,
+	vc VulnerabilityContext,
+	pageToken string) stream.Producer {
+
+	var sh stream.HTTP
+
+	tokenKey, _, repoPath := GetTokenKeyDomainRepoPath(
+		vc.RegistryContext.Name)
+	project := strings.Split(repoPath, "/")[0]
+
+	filter := fmt.Sprintf(`kind="VULNERABILITY" AND resourceUrl="https://%s"`,
+		ToFQIN(vc.RegistryContext.Name, vc.ImageName, vc.Digest))
+	endpoint := fmt.Sprintf(
+		"https://containeranalysis.googleapis.com/v1/projects/%s/occurrences"+
+			"?pageSize=1000&filter=%s",
+		project,
+		url.QueryEscape(filter))
+	if len(pageToken) > 0 {
+		endpoint += "&pageToken=" + url.QueryEscape(pageToken)
+	}
+
+	httpReq, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		klog.Fatalf(
+			"could not create HTTP request for vulnerabilities of '%s'",
+			ToFQIN(vc.RegistryContext.Name, vc.ImageName, vc.Digest))
+	}
+
+	if sc.UseServiceAccount {
+		token, ok := sc.Tokens[RootRepo(tokenKey)]
+		if !ok {
+			klog.Exitf("access token for key '%s' not found\n", tokenKey)
+		}
+
+		var bearer = "Bearer " + string(token)
+		httpReq.Header.Add("Authorization", bearer)
+	}
+
+	sh.Req = httpReq
+	sh.Transport = sc.transport()
+	return &sh
+}
+
+// containerAnalysisOccurrences is the response of Container Analysis' list of
+// occurrences (only the fields we care about).
+type containerAnalysisOccurrences struct {
+	Occurrences []struct {
+		NoteName      string `json:"noteName"`
+		Vulnerability struct {
+			Severity          string `json:"severity"`
+			EffectiveSeverity string `json:"effectiveSeverity"`
+		} `json:"vulnerability"`
+	} `json:"occurrences"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// getVulnerabilitiesFrom reads one page of vulnerability occurrences, and
+// returns them along with the token of the next page (empty if it was the
+// last page).
+func getVulnerabilitiesFrom(
+	producer stream.Producer) ([]Vulnerability, string, error) {
+
+	reader, _, err := producer.Produce()
+	if err != nil {
+		klog.Warning("error reading from stream:", err)
+		return nil, "", err
+	}
+
+	// nolint[errcheck]
+	defer producer.Close()
+
+	return extractVulnerabilities(reader)
+}
+
+func extractVulnerabilities(
+	reader io.Reader) ([]Vulnerability, string, error) {
+
+	var occurrences containerAnalysisOccurrences
+	if err := json.NewDecoder(reader).Decode(&occurrences); err != nil {
+		return nil, "", err
+	}
+
+	vulns := make([]Vulnerability, 0)
+	for _, occurrence := range occurrences.Occurrences {
+		// The effective severity takes the distribution (e.g., Debian) into
+		// account, so prefer it over the generic severity.
+		severityName := occurrence.Vulnerability.EffectiveSeverity
+		if len(severityName) == 0 {
+			severityName = occurrence.Vulnerability.Severity
+		}
+		severity, err := ParseSeverity(severityName)
+		if err != nil {
+			severity = SeverityUnspecified
+		}
+
+		// The note name looks like
+		// "projects/goog-vulnz/notes/CVE-2020-1234".
+		vulns = append(vulns, Vulnerability{
+			ID:       path.Base(occurrence.NoteName),
+			Severity: severity,
+		})
+	}
+
+	return vulns, occurrences.NextPageToken, nil
+}
+
+// Error is a function of SignatureError and implements the error interface.
+func (err SignatureError) Error() string {
+	return fmt.Sprintf("The following images do not have a valid "+
+		"signature:\n%v\n", strings.Join(err.UnsignedImages, "\n"))
+}
+
+// MKRealSignatureVerificationCheck returns an instance of
+// SignatureVerificationCheck which verifies signatures with the cosign CLI.
+// Either publicKey, or both certIdentity and certOIDCIssuer, must be given.
+func MKRealSignatureVerificationCheck(
+	publicKey string,
+	certIdentity string,
+	certOIDCIssuer string,
+	edges map[PromotionEdge]interface{},
+) (*SignatureVerificationCheck, error) {
+	keyless := len(certIdentity) > 0 || len(certOIDCIssuer) > 0
+	if len(publicKey) > 0 && keyless {
+		return nil, fmt.Errorf("Either a public key or a certificate " +
+			"identity must be given for signature verification, not both")
+	}
+	if len(publicKey) == 0 &&
+		(len(certIdentity) == 0 || len(certOIDCIssuer) == 0) {
+		return nil, fmt.Errorf("A public key, or a certificate identity " +
+			"and OIDC issuer, must be given for signature verification")
+	}
+
+	return &SignatureVerificationCheck{
+		publicKey,
+		certIdentity,
+		certOIDCIssuer,
+		edges,
+		MkVerifyCmdReal,
+	}, nil
+}
+
+// GetVerifyCmd generates the cosign command used to verify the signature of
+// the given image.
+func (check *SignatureVerificationCheck) GetVerifyCmd(
+	imageRef string) []string {
+
+	cmd := []string{"cosign", "verify"}
+	if len(check.PublicKey) > 0 {
+		cmd = append(cmd, "--key", check.PublicKey)
+	} else {
+		cmd = append(cmd,
+			"--certificate-identity", check.CertificateIdentity,
+			"--certificate-oidc-issuer", check.CertificateOIDCIssuer)
+	}
+	return append(cmd, imageRef)
+}
+
+// MkVerifyCmdReal creates a stream.Producer which runs cosign to verify the
+// signature of the given image.
+func MkVerifyCmdReal(
+	check *SignatureVerificationCheck,
+	imageRef string) stream.Producer {
+
+	var sp stream.Subprocess
+	sp.CmdInvocation = check.GetVerifyCmd(imageRef)
+	return &sp
+}
+
+// Run is a function of SignatureVerificationCheck and checks that the source
+// images of all promotion edges are signed. Images are always verified by
+// digest; for manifest lists, this means that the signature of the index
+// digest is verified (and not those of the child images).
+func (check *SignatureVerificationCheck) Run() error {
+	// Multiple edges can have the same source image; only verify it once.
+	imageRefs := make(map[string]interface{})
+	for edge := range check.PullEdges {
+		imageRefs[ToFQIN(
+			edge.SrcRegistry.Name,
+			edge.SrcImageTag.ImageName,
+			edge.Digest)] = nil
+	}
+
+	unsignedImages := make([]string, 0)
+	for imageRef := range imageRefs {
+		if err := check.verify(imageRef); err != nil {
+			logging.Log().Error(err, "could not verify signature",
+				"image", imageRef)
+			unsignedImages = append(unsignedImages, imageRef)
+		}
+	}
+
+	if len(unsignedImages) > 0 {
+		sort.Strings(unsignedImages)
+		return SignatureError{unsignedImages}
+	}
+
+	return nil
+}
+
+// verify runs the verification command for a single image. The verification
+// fails if the command exits with a nonzero status.
+func (check *SignatureVerificationCheck) verify(imageRef string) error {
+	producer := check.MkVerifyCmd(check, imageRef)
+	stdout, stderr, err := producer.Produce()
+	if err != nil {
+		return err
+	}
+
+	// The output must be fully consumed before the command can be waited on
+	// (in Close()).
+	if _, err := io.Copy(ioutil.Discard, stdout); err != nil {
+		return err
+	}
+	errOutput, err := ioutil.ReadAll(stderr)
+	if err != nil {
+		return err
+	}
+
+	if err := producer.Close(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(errOutput)))
+	}
 	return nil
 }
@@ -17,10 +17,14 @@ limitations under the License.
 package inventory_test
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
 )
 
 func TestImageRemovalCheck(t *testing.T) {
@@ -111,8 +115,7 @@ func TestImageRemovalCheck(t *testing.T) {
 					},
 					SrcRegistry: &srcRC},
 			},
-			fmt.Errorf("The following images were removed in this pull " +
-				"request: a"),
+			reg.ImageRemovalError{[]reg.ImageName{"a"}},
 		},
 		{
 			"Promoting same image from different registry",
@@ -154,14 +157,58 @@ func TestImageRemovalCheck(t *testing.T) {
 					},
 					SrcRegistry: &srcRC},
 			},
-			fmt.Errorf("The following images were removed in this pull " +
-				"request: a"),
+			reg.ImageRemovalError{[]reg.ImageName{"a"}},
+		},
+		{
+			"Allowed removal",
+			reg.ImageRemovalCheck{},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageA,
+						imageB,
+					},
+					SrcRegistry: &srcRC},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageB,
+					},
+					AllowedRemovals: []reg.ImageName{"a"},
+					SrcRegistry:     &srcRC},
+			},
+			nil,
+		},
+		{
+			"Disallowed removal (another image is allowed)",
+			reg.ImageRemovalCheck{},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageA,
+						imageB,
+					},
+					SrcRegistry: &srcRC},
+			},
+			[]reg.Manifest{
+				{
+					Registries:      registries,
+					Images:          []reg.Image{},
+					AllowedRemovals: []reg.ImageName{"b"},
+					SrcRegistry:     &srcRC},
+			},
+			reg.ImageRemovalError{[]reg.ImageName{"a"}},
 		},
 	}
 
 	for _, test := range tests {
 		masterEdges, _ := reg.ToPromotionEdges(test.masterManifests)
 		pullEdges, _ := reg.ToPromotionEdges(test.pullManifests)
+		test.check.AllowedRemovals = reg.GetAllowedRemovals(test.pullManifests)
 		got := test.check.Compare(masterEdges, pullEdges)
 		err := checkEqual(got, test.expected)
 		checkError(t, err,
@@ -192,6 +239,16 @@ func TestImageSizeCheck(t *testing.T) {
 		Dmap: reg.DigestTags{
 			"sha256:111": {"0.9"}}}
 
+	// The destination already has a 10 MiB version of "foo" (see the
+	// DigestImageSize of the tests that derive the max image size).
+	destInv := reg.MasterInventory{
+		destRegName: {
+			"foo": {
+				"sha256:aaa": {"0.8"},
+			},
+		},
+	}
+
 	var tests = []struct {
 		name       string
 		check      reg.ImageSizeCheck
@@ -241,6 +298,8 @@ func TestImageSizeCheck(t *testing.T) {
 					"foo": reg.MBToBytes(5),
 				},
 				map[string]int{},
+				map[string]int{},
+				5,
 			},
 		},
 		{
@@ -269,6 +328,8 @@ func TestImageSizeCheck(t *testing.T) {
 					"bar": reg.MBToBytes(10),
 				},
 				map[string]int{},
+				map[string]int{},
+				10,
 			},
 		},
 		{
@@ -297,6 +358,176 @@ func TestImageSizeCheck(t *testing.T) {
 					"foo": 0,
 					"bar": reg.MBToBytes(-5),
 				},
+				map[string]int{},
+				0,
+			},
+		},
+		{
+			"Image size under its override",
+			reg.ImageSizeCheck{
+				MaxImageSize:    1,
+				DigestImageSize: make(reg.DigestImageSize),
+				Overrides: map[string]int{
+					"foo": 10,
+				},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:000": reg.MBToBytes(5),
+			},
+			nil,
+		},
+		{
+			"Image sizes over the override and the max size",
+			reg.ImageSizeCheck{
+				MaxImageSize:    1,
+				DigestImageSize: make(reg.DigestImageSize),
+				Overrides: map[string]int{
+					"foo": 10,
+				},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:000": reg.MBToBytes(12),
+				"sha256:111": reg.MBToBytes(5),
+			},
+			reg.ImageSizeError{
+				1,
+				map[string]int{
+					"foo": reg.MBToBytes(12),
+					"bar": reg.MBToBytes(5),
+				},
+				map[string]int{},
+				map[string]int{
+					"foo": 10,
+				},
+				5,
+			},
+		},
+		{
+			"Image size under the derived max size",
+			reg.ImageSizeCheck{
+				DigestImageSize: reg.DigestImageSize{
+					"sha256:aaa": reg.MBToBytes(10),
+				},
+				DestInv:  destInv,
+				Headroom: 20,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:000": reg.MBToBytes(12),
+			},
+			nil,
+		},
+		{
+			"Image size over the derived max size",
+			reg.ImageSizeCheck{
+				DigestImageSize: reg.DigestImageSize{
+					"sha256:aaa": reg.MBToBytes(10),
+				},
+				DestInv:  destInv,
+				Headroom: 20,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:000": reg.MBToBytes(12) + 1,
+			},
+			reg.ImageSizeError{
+				12,
+				map[string]int{
+					"foo": reg.MBToBytes(12) + 1,
+				},
+				map[string]int{},
+				map[string]int{},
+				13,
+			},
+		},
+		{
+			"Explicit max size over the derived max size",
+			reg.ImageSizeCheck{
+				MaxImageSize: 1,
+				DigestImageSize: reg.DigestImageSize{
+					"sha256:aaa": reg.MBToBytes(10),
+				},
+				DestInv:  destInv,
+				Headroom: 20,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:000": reg.MBToBytes(5),
+			},
+			reg.ImageSizeError{
+				1,
+				map[string]int{
+					"foo": reg.MBToBytes(5),
+				},
+				map[string]int{},
+				map[string]int{},
+				5,
+			},
+		},
+		{
+			"No destination images to derive the max size from",
+			reg.ImageSizeCheck{
+				DigestImageSize: make(reg.DigestImageSize),
+				DestInv:         destInv,
+				Headroom:        20,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.Digest]int{
+				"sha256:111": reg.MBToBytes(reg.DefaultMaxImageSize) + 1,
+			},
+			reg.ImageSizeError{
+				reg.DefaultMaxImageSize,
+				map[string]int{
+					"bar": reg.MBToBytes(reg.DefaultMaxImageSize) + 1,
+				},
+				map[string]int{},
+				map[string]int{},
+				reg.DefaultMaxImageSize + 1,
 			},
 		},
 	}
@@ -317,3 +548,2092 @@ func TestImageSizeCheck(t *testing.T) {
 			fmt.Sprintf("checkError: test: %v (ImageSizeCheck)\n", test.name))
 	}
 }
+
+func TestImageSizeErrorString(t *testing.T) {
+	sizeErr := reg.ImageSizeError{
+		1,
+		map[string]int{
+			"foo": reg.MBToBytes(12),
+			"bar": reg.MBToBytes(5),
+		},
+		map[string]int{
+			"baz": 0,
+		},
+		map[string]int{
+			"foo": 10,
+		},
+		5,
+	}
+	expected := "The following images were over the max file size of 1MiB:\n" +
+		"bar (5.0 MiB)\n" +
+		"foo (12.0 MiB, over the override of 10MiB)\n" +
+		"To allow them, raise the max image size to at least 5MiB.\n" +
+		"The following images had an invalid file size of 0 bytes or less:\n" +
+		"baz (0 B)\n"
+	err := checkEqual(sizeErr.Error(), expected)
+	checkError(t, err, "checkError: test: ImageSizeError string\n")
+}
+
+func TestBytesToHuman(t *testing.T) {
+	var tests = []struct {
+		bytes    int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{int64(reg.MBToBytes(5)), "5.0 MiB"},
+		{int64(reg.MBToBytes(1536)), "1.5 GiB"},
+		{int64(reg.MBToBytes(3 * 1024 * 1024)), "3.0 TiB"},
+	}
+
+	for _, test := range tests {
+		err := checkEqual(reg.BytesToHuman(test.bytes), test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: BytesToHuman(%d)\n", test.bytes))
+	}
+}
+
+func TestTotalSizeErrorString(t *testing.T) {
+	sizeErr := reg.TotalSizeError{
+		MaxTotalSize: 1024,
+		TotalSize:    reg.MBToBytes(2048) + reg.MBToBytes(512),
+	}
+	expected := "The images to be promoted have a total size of 2.5 GiB, " +
+		"which is over the max total size of 1024MiB"
+	err := checkEqual(sizeErr.Error(), expected)
+	checkError(t, err, "checkError: test: TotalSizeError string\n")
+	// The numeric fields are left as is.
+	err = checkEqual(sizeErr.TotalSize, 2684354560)
+	checkError(t, err, "checkError: test: TotalSizeError size\n")
+}
+
+func TestImageSizeCheckReadSizes(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "foo",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"}}},
+				{
+					ImageName: "bar",
+					Dmap: reg.DigestTags{
+						"sha256:111": {"0.9"}}},
+				{
+					ImageName: "baz",
+					Dmap: reg.DigestTags{
+						"sha256:222": {"0.9"}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "checkError: test: ToPromotionEdges\n")
+
+	manifests := map[reg.Digest]string{
+		"sha256:000": `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {"size": 1048576},
+  "layers": [{"size": 1048576}, {"size": 2097152}]
+}`,
+		"sha256:222": `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": []
+}`,
+	}
+
+	var tests = []struct {
+		name              string
+		digestImageSize   reg.DigestImageSize
+		expected          error
+		expectedImageSize reg.DigestImageSize
+	}{
+		{
+			"Missing sizes are read from the manifests",
+			reg.DigestImageSize{
+				"sha256:111": reg.MBToBytes(1),
+				"sha256:222": reg.MBToBytes(1),
+			},
+			reg.ImageSizeError{
+				1,
+				map[string]int{
+					"foo": reg.MBToBytes(4),
+				},
+				map[string]int{},
+				map[string]int{},
+				4,
+			},
+			reg.DigestImageSize{
+				"sha256:000": reg.MBToBytes(4),
+				"sha256:111": reg.MBToBytes(1),
+				"sha256:222": reg.MBToBytes(1),
+			},
+		},
+		{
+			"Errors are reported by digest",
+			reg.DigestImageSize{},
+			fmt.Errorf("could not read the size of 2 images:\n" +
+				"sha256:111: EOF\n" +
+				"sha256:222: cannot compute the size of a manifest list"),
+			reg.DigestImageSize{
+				"sha256:000": reg.MBToBytes(4),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		check := reg.ImageSizeCheck{
+			MaxImageSize:    1,
+			DigestImageSize: test.digestImageSize,
+			PullEdges:       edges,
+			// Read one manifest at a time, for determinism.
+			Threads: 1,
+			MkReadManifestCmd: func(edge reg.PromotionEdge) stream.Producer {
+				// Unknown digests get an empty response.
+				return &stream.Fake{Bytes: []byte(manifests[edge.Digest])}
+			},
+		}
+		got := check.Run()
+		err := checkEqual(fmt.Sprint(got), fmt.Sprint(test.expected))
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (ImageSizeCheck)\n", test.name))
+		err = checkEqual(check.DigestImageSize, test.expectedImageSize)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (DigestImageSize)\n", test.name))
+	}
+}
+
+func TestImageSizeCheckReadSizesOnce(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           "gcr.io/cat",
+		ServiceAccount: "robot",
+	}
+	// The digests are shared by several images, tags and manifests.
+	images := []reg.Image{
+		{
+			ImageName: "foo",
+			Dmap: reg.DigestTags{
+				"sha256:000": {"0.9", "1.0"},
+				"sha256:111": {"1.1"}}},
+		{
+			ImageName: "bar",
+			Dmap: reg.DigestTags{
+				"sha256:000": {"0.9"},
+				"sha256:222": {"2.0"}}},
+	}
+	mfests := []reg.Manifest{
+		{
+			Registries:  []reg.RegistryContext{destRC, srcRC},
+			Images:      images,
+			SrcRegistry: &srcRC},
+		{
+			Registries:  []reg.RegistryContext{destRC2, srcRC},
+			Images:      images,
+			SrcRegistry: &srcRC},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "checkError: test: ToPromotionEdges\n")
+
+	manifest := `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {"size": 1024},
+  "layers": [{"size": 1024}]
+}`
+
+	var mutex sync.Mutex
+	reads := make(map[reg.Digest]int)
+	check := reg.ImageSizeCheck{
+		MaxImageSize:    1,
+		DigestImageSize: reg.DigestImageSize{},
+		PullEdges:       edges,
+		Threads:         4,
+		MkReadManifestCmd: func(edge reg.PromotionEdge) stream.Producer {
+			mutex.Lock()
+			defer mutex.Unlock()
+			reads[edge.Digest]++
+			// The size of "sha256:222" cannot be read.
+			if edge.Digest == "sha256:222" {
+				return &stream.Fake{}
+			}
+			return &stream.Fake{Bytes: []byte(manifest)}
+		},
+	}
+
+	// The failed read is not retried by the second run.
+	expected := "could not read the size of 1 images:\nsha256:222: EOF"
+	for i := 0; i < 2; i++ {
+		got := check.Run()
+		err := checkEqual(fmt.Sprint(got), expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: run %d (ImageSizeCheck)\n", i))
+	}
+
+	err = checkEqual(reads, map[reg.Digest]int{
+		"sha256:000": 1,
+		"sha256:111": 1,
+		"sha256:222": 1,
+	})
+	checkError(t, err, "checkError: test: reads per digest\n")
+}
+
+func TestTotalSizeCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, srcRC}
+	registries2 := []reg.RegistryContext{destRC, destRC2, srcRC}
+
+	// Image "foo" has 2 tags for the same digest, which must only be counted
+	// once.
+	image1 := reg.Image{
+		ImageName: "foo",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9", "1.0"}}}
+	image2 := reg.Image{
+		ImageName: "bar",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9"}}}
+	imageSizes := reg.DigestImageSize{
+		"sha256:000": reg.MBToBytes(5),
+		"sha256:111": reg.MBToBytes(10),
+	}
+
+	var tests = []struct {
+		name      string
+		check     reg.TotalSizeCheck
+		manifests []reg.Manifest
+		expected  error
+	}{
+		{
+			"Total size under the max total size",
+			reg.TotalSizeCheck{
+				MaxTotalSize:    15,
+				DigestImageSize: imageSizes,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			nil,
+		},
+		{
+			"Total size over the max total size",
+			reg.TotalSizeCheck{
+				MaxTotalSize:    14,
+				DigestImageSize: imageSizes,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			reg.TotalSizeError{
+				14,
+				reg.MBToBytes(15),
+			},
+		},
+		{
+			"Images are counted once per destination registry",
+			reg.TotalSizeCheck{
+				MaxTotalSize:    15,
+				DigestImageSize: imageSizes,
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries2,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			reg.TotalSizeError{
+				15,
+				reg.MBToBytes(30),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test.check.PullEdges, _ = reg.ToPromotionEdges(test.manifests)
+		got := test.check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (TotalSizeCheck)\n", test.name))
+	}
+}
+
+func TestVulnerabilityCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, srcRC}
+
+	image1 := reg.Image{
+		ImageName: "foo",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9"}}}
+	image2 := reg.Image{
+		ImageName: "bar",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9"}}}
+
+	var tests = []struct {
+		name      string
+		check     reg.VulnerabilityCheck
+		manifests []reg.Manifest
+		expected  error
+	}{
+		{
+			"No vulnerabilities",
+			reg.VulnerabilityCheck{
+				MaxSeverity:           reg.SeverityCritical,
+				DigestVulnerabilities: reg.DigestVulnerabilities{},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			nil,
+		},
+		{
+			"Vulnerabilities below the max severity",
+			reg.VulnerabilityCheck{
+				MaxSeverity: reg.SeverityCritical,
+				DigestVulnerabilities: reg.DigestVulnerabilities{
+					"sha256:000": {
+						{ID: "CVE-2020-0001", Severity: reg.SeverityHigh},
+						{ID: "CVE-2020-0002", Severity: reg.SeverityLow},
+					},
+				},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+					},
+					SrcRegistry: &srcRC},
+			},
+			nil,
+		},
+		{
+			"Vulnerabilities at or above the max severity",
+			reg.VulnerabilityCheck{
+				MaxSeverity: reg.SeverityHigh,
+				DigestVulnerabilities: reg.DigestVulnerabilities{
+					"sha256:000": {
+						{ID: "CVE-2020-0001", Severity: reg.SeverityHigh},
+						{ID: "CVE-2020-0002", Severity: reg.SeverityLow},
+					},
+					"sha256:111": {
+						{ID: "CVE-2020-0003", Severity: reg.SeverityCritical},
+					},
+				},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			reg.VulnerabilityError{
+				reg.SeverityHigh,
+				map[string][]reg.Vulnerability{
+					"foo@sha256:000": {
+						{ID: "CVE-2020-0001", Severity: reg.SeverityHigh},
+					},
+					"bar@sha256:111": {
+						{ID: "CVE-2020-0003", Severity: reg.SeverityCritical},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test.check.PullEdges, _ = reg.ToPromotionEdges(test.manifests)
+		got := test.check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (VulnerabilityCheck)\n",
+				test.name))
+	}
+}
+
+func TestVulnerabilityErrorString(t *testing.T) {
+	vulnErr := reg.VulnerabilityError{
+		reg.SeverityHigh,
+		map[string][]reg.Vulnerability{
+			"foo@sha256:000": {
+				{ID: "CVE-2020-0002", Severity: reg.SeverityCritical},
+				{ID: "CVE-2020-0001", Severity: reg.SeverityHigh},
+			},
+			"bar@sha256:111": {
+				{ID: "CVE-2020-0003", Severity: reg.SeverityCritical},
+			},
+		},
+	}
+	expected := "The following images have vulnerabilities with a " +
+		"severity of HIGH or higher:\n" +
+		"bar@sha256:111: CVE-2020-0003 (CRITICAL)\n" +
+		"foo@sha256:000: CVE-2020-0001 (HIGH), CVE-2020-0002 (CRITICAL)\n"
+	err := checkEqual(vulnErr.Error(), expected)
+	checkError(t, err, "checkError: test: VulnerabilityError string\n")
+}
+
+func TestReadVulnerabilities(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name: "gcr.io/bar",
+	}
+	destRC2 := reg.RegistryContext{
+		Name: "gcr.io/cat",
+	}
+	edges, _ := reg.ToPromotionEdges([]reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{srcRC, destRC, destRC2},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"},
+						"sha256:111": {"1.0"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	})
+
+	// Canned Container Analysis responses, keyed by digest.
+	responses := map[reg.Digest]string{
+		"sha256:000": `{
+  "occurrences": [
+    {
+      "noteName": "projects/goog-vulnz/notes/CVE-2020-0001",
+      "kind": "VULNERABILITY",
+      "vulnerability": {
+        "severity": "HIGH",
+        "effectiveSeverity": "CRITICAL"
+      }
+    },
+    {
+      "noteName": "projects/goog-vulnz/notes/CVE-2020-0002",
+      "kind": "VULNERABILITY",
+      "vulnerability": {
+        "severity": "LOW"
+      }
+    }
+  ],
+  "nextPageToken": "page2"
+}`,
+		"sha256:000 page2": `{
+  "occurrences": [
+    {
+      "noteName": "projects/goog-vulnz/notes/CVE-2020-0003",
+      "kind": "VULNERABILITY",
+      "vulnerability": {
+        "effectiveSeverity": "MEDIUM"
+      }
+    }
+  ]
+}`,
+		"sha256:111": `{}`,
+	}
+
+	mkFakeStream := func(
+		sc *reg.SyncContext,
+		vc reg.VulnerabilityContext,
+		pageToken string) stream.Producer {
+
+		key := vc.Digest
+		if len(pageToken) > 0 {
+			key += reg.Digest(" " + pageToken)
+		}
+		return &stream.Fake{Bytes: []byte(responses[key])}
+	}
+
+	sc := reg.SyncContext{}
+	got, err := sc.ReadVulnerabilities(edges, mkFakeStream)
+	checkError(t, err, "checkError: test: ReadVulnerabilities (error)\n")
+
+	expected := reg.DigestVulnerabilities{
+		"sha256:000": {
+			{ID: "CVE-2020-0001", Severity: reg.SeverityCritical},
+			{ID: "CVE-2020-0002", Severity: reg.SeverityLow},
+			{ID: "CVE-2020-0003", Severity: reg.SeverityMedium},
+		},
+		"sha256:111": {},
+	}
+	err = checkEqual(got, expected)
+	checkError(t, err, "checkError: test: ReadVulnerabilities\n")
+}
+
+func TestMKRealVulnerabilityCheckUnscannable(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "quay.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name: "gcr.io/bar",
+	}
+	edges, _ := reg.ToPromotionEdges([]reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{srcRC, destRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	})
+
+	sc := reg.SyncContext{}
+	_, err := reg.MKRealVulnerabilityCheck(
+		&sc, reg.SeverityHigh, false, edges)
+	expected := "Cannot scan the following images for vulnerabilities " +
+		"(not in GCR):\nquay.io/foo/a@sha256:000"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Test: MKRealVulnerabilityCheck: expected error %q, got %v",
+			expected, err)
+	}
+
+	// The images are only skipped when asked to.
+	check, err := reg.MKRealVulnerabilityCheck(
+		&sc, reg.SeverityHigh, true, edges)
+	if err != nil {
+		t.Fatalf("Test: MKRealVulnerabilityCheck (skip): %v", err)
+	}
+	if err := check.Run(); err != nil {
+		t.Errorf("Test: VulnerabilityCheck.Run (skip): %v", err)
+	}
+}
+
+func TestTagImmutabilityCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, srcRC}
+
+	imageA := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9", "latest"}}}
+	imageAMoved := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9", "latest"}}}
+	imageALatestMoved := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9"},
+			"sha256:111": {"1.0", "latest"}}}
+	imageB := reg.Image{
+		ImageName: "b",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9"}}}
+
+	var tests = []struct {
+		name            string
+		check           reg.TagImmutabilityCheck
+		masterManifests []reg.Manifest
+		pullManifests   []reg.Manifest
+		expected        error
+	}{
+		{
+			"Empty manifests",
+			reg.TagImmutabilityCheck{},
+			[]reg.Manifest{},
+			[]reg.Manifest{},
+			nil,
+		},
+		{
+			"New tags and images",
+			reg.TagImmutabilityCheck{},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageA,
+					},
+					SrcRegistry: &srcRC},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageALatestMoved,
+						imageB,
+					},
+					SrcRegistry: &srcRC},
+			},
+			reg.TagImmutabilityError{[]string{
+				"gcr.io/bar/a:latest (sha256:000 -> sha256:111)",
+			}},
+		},
+		{
+			"Mutable tag moved",
+			reg.TagImmutabilityCheck{
+				MutableTags: []reg.Tag{"latest"},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageA,
+					},
+					SrcRegistry: &srcRC},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageALatestMoved,
+						imageB,
+					},
+					SrcRegistry: &srcRC},
+			},
+			nil,
+		},
+		{
+			"Immutable tags moved",
+			reg.TagImmutabilityCheck{
+				MutableTags: []reg.Tag{"latest"},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageA,
+					},
+					SrcRegistry: &srcRC},
+			},
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						imageAMoved,
+					},
+					SrcRegistry: &srcRC},
+			},
+			reg.TagImmutabilityError{[]string{
+				"gcr.io/bar/a:0.9 (sha256:000 -> sha256:111)",
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		masterEdges, _ := reg.ToPromotionEdges(test.masterManifests)
+		pullEdges, _ := reg.ToPromotionEdges(test.pullManifests)
+		got := test.check.Compare(masterEdges, pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (TagImmutabilityCheck)\n",
+				test.name))
+	}
+}
+
+func TestMaxTagsPerImageCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, destRC2, srcRC}
+
+	// Image "a" has 3 tags across 2 digests; image "b" has 1 tag.
+	imageA := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9", "1.0"},
+			"sha256:111": {"1.1"}}}
+	imageB := reg.Image{
+		ImageName: "b",
+		Dmap: reg.DigestTags{
+			"sha256:222": {"0.9"}}}
+	// Tagless images are not counted.
+	imageC := reg.Image{
+		ImageName: "c",
+		Dmap: reg.DigestTags{
+			"sha256:333": {}}}
+
+	manifests := []reg.Manifest{
+		{
+			Registries: registries,
+			Images: []reg.Image{
+				imageA,
+				imageB,
+				imageC,
+			},
+			SrcRegistry: &srcRC},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.MaxTagsPerImageCheck
+		expected error
+	}{
+		{
+			"Tags under the max",
+			reg.MaxTagsPerImageCheck{
+				MaxTags: 3,
+			},
+			nil,
+		},
+		{
+			"Tags over the max",
+			reg.MaxTagsPerImageCheck{
+				MaxTags: 2,
+			},
+			reg.MaxTagsPerImageError{
+				2,
+				map[reg.RegistryImagePath]int{
+					"gcr.io/bar/a": 3,
+					"gcr.io/cat/a": 3,
+				},
+			},
+		},
+		{
+			"Allowlisted image",
+			reg.MaxTagsPerImageCheck{
+				MaxTags: 0,
+				Allowlist: map[reg.RegistryImagePath]interface{}{
+					"gcr.io/bar/a": nil,
+					"gcr.io/cat/a": nil,
+					"gcr.io/cat/b": nil,
+				},
+			},
+			reg.MaxTagsPerImageError{
+				0,
+				map[reg.RegistryImagePath]int{
+					"gcr.io/bar/b": 1,
+				},
+			},
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (MaxTagsPerImageCheck)\n",
+				test.name))
+	}
+
+	// Run() checks the pull request's edges.
+	check := reg.MKRealMaxTagsPerImageCheck(
+		1,
+		pullEdges,
+		[]reg.RegistryImagePath{"gcr.io/bar/a", "gcr.io/cat/a"})
+	err := checkEqual(check.Run(), nil)
+	checkError(t, err, "checkError: test: Run (MaxTagsPerImageCheck)\n")
+}
+
+func TestMaxTagsPerImageErrorString(t *testing.T) {
+	err := reg.MaxTagsPerImageError{
+		2,
+		map[reg.RegistryImagePath]int{
+			"gcr.io/cat/a": 4,
+			"gcr.io/bar/a": 3,
+		},
+	}
+	expected := "The following images would have more than the max of 2 " +
+		"tags:\ngcr.io/bar/a (3 tags)\ngcr.io/cat/a (4 tags)\n"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestSourceRegistryAllowlistCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	srcRegName2 := reg.RegistryName("gcr.io/qux")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	srcRC2 := reg.RegistryContext{
+		Name:           srcRegName2,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+
+	imageA := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9"}}}
+	imageB := reg.Image{
+		ImageName: "b",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9"}}}
+
+	manifests := []reg.Manifest{
+		{
+			Registries:  []reg.RegistryContext{destRC, srcRC},
+			Images:      []reg.Image{imageA},
+			SrcRegistry: &srcRC},
+		{
+			Registries:  []reg.RegistryContext{destRC, srcRC2},
+			Images:      []reg.Image{imageB},
+			SrcRegistry: &srcRC2},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.SourceRegistryAllowlistCheck
+		expected error
+	}{
+		{
+			"All sources allowed",
+			reg.SourceRegistryAllowlistCheck{
+				AllowedSources: []reg.RegistryName{srcRegName, srcRegName2},
+			},
+			nil,
+		},
+		{
+			"Source not allowed",
+			reg.SourceRegistryAllowlistCheck{
+				AllowedSources: []reg.RegistryName{srcRegName},
+			},
+			reg.SourceRegistryError{
+				[]reg.RegistryName{srcRegName2},
+			},
+		},
+		{
+			"Empty allowlist",
+			reg.SourceRegistryAllowlistCheck{},
+			reg.SourceRegistryError{
+				[]reg.RegistryName{srcRegName, srcRegName2},
+			},
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v "+
+				"(SourceRegistryAllowlistCheck)\n", test.name))
+	}
+
+	check := reg.MKRealSourceRegistryAllowlistCheck(
+		[]reg.RegistryName{srcRegName},
+		pullEdges)
+	expected := "The following source registries are not in the " +
+		"allowlist: gcr.io/qux"
+	if err := check.Run(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestBlockedSourceCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	srcRegName2 := reg.RegistryName("docker.io/library")
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	srcRC2 := reg.RegistryContext{
+		Name:           srcRegName2,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+
+	imageA := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9"}}}
+	imageB := reg.Image{
+		ImageName: "b",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9", "1.0"}}}
+	imageC := reg.Image{
+		ImageName: "c",
+		Dmap: reg.DigestTags{
+			"sha256:222": {"0.9"}}}
+
+	manifests := []reg.Manifest{
+		{
+			Registries:  []reg.RegistryContext{destRC, srcRC},
+			Images:      []reg.Image{imageA},
+			SrcRegistry: &srcRC},
+		{
+			Registries:  []reg.RegistryContext{destRC, srcRC2},
+			Images:      []reg.Image{imageB, imageC},
+			SrcRegistry: &srcRC2},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.BlockedSourceCheck
+		expected error
+	}{
+		{
+			"No blocked sources",
+			reg.BlockedSourceCheck{},
+			nil,
+		},
+		{
+			"Allowed sources only",
+			reg.BlockedSourceCheck{
+				BlockedSources: []string{"quay.io", "gcr.io/foo/*"},
+			},
+			nil,
+		},
+		{
+			"Blocked source (substring)",
+			reg.BlockedSourceCheck{
+				BlockedSources: []string{"docker.io"},
+			},
+			reg.BlockedSourceError{
+				map[reg.RegistryName][]reg.ImageName{
+					srcRegName2: {"b", "c"},
+				},
+			},
+		},
+		{
+			"Blocked sources (pattern)",
+			reg.BlockedSourceCheck{
+				BlockedSources: []string{"*/library", "gcr.io/f?o"},
+			},
+			reg.BlockedSourceError{
+				map[reg.RegistryName][]reg.ImageName{
+					srcRegName:  {"a"},
+					srcRegName2: {"b", "c"},
+				},
+			},
+		},
+		{
+			"Invalid pattern",
+			reg.BlockedSourceCheck{
+				BlockedSources: []string{"docker.io/[library"},
+			},
+			fmt.Errorf("invalid blocked source pattern: docker.io/[library"),
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v "+
+				"(BlockedSourceCheck)\n", test.name))
+	}
+
+	check := reg.MKRealBlockedSourceCheck(
+		[]string{"docker.io", "gcr.io/f*"},
+		pullEdges)
+	expected := `The following source registries are blocked:
+docker.io/library (images: b, c)
+gcr.io/foo (images: a)
+`
+	err := check.Run()
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if code := reg.CodeOf(err); code != reg.CodePolicyViolation {
+		t.Errorf("expected code %q, got %q", reg.CodePolicyViolation, code)
+	}
+}
+
+func TestDigestAllowlistCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+
+	manifests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, destRC2, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"},
+						"sha256:111": {"1.0", "1.1"}}},
+				{
+					ImageName: "b",
+					Dmap: reg.DigestTags{
+						"sha256:222": {"2.0"},
+						"sha256:333": {}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.DigestAllowlistCheck
+		expected error
+	}{
+		{
+			"No pinned images",
+			reg.DigestAllowlistCheck{},
+			nil,
+		},
+		{
+			"Allowed digests",
+			reg.DigestAllowlistCheck{
+				AllowedDigests: map[reg.ImageName][]reg.Digest{
+					"a": {"sha256:111", "sha256:000"},
+				},
+			},
+			nil,
+		},
+		{
+			// The digest is promoted into two destinations with two tags,
+			// but only reported once.
+			"Disallowed digest",
+			reg.DigestAllowlistCheck{
+				AllowedDigests: map[reg.ImageName][]reg.Digest{
+					"a": {"sha256:000", "sha256:999"},
+				},
+			},
+			reg.DigestAllowlistError{
+				DisallowedDigests: map[reg.ImageName][]reg.Digest{
+					"a": {"sha256:111"},
+				},
+				AllowedDigests: map[reg.ImageName][]reg.Digest{
+					"a": {"sha256:000", "sha256:999"},
+				},
+			},
+		},
+		{
+			"Several pinned images",
+			reg.DigestAllowlistCheck{
+				AllowedDigests: map[reg.ImageName][]reg.Digest{
+					"a": {"sha256:111", "sha256:000"},
+					"b": {"sha256:999"},
+				},
+			},
+			reg.DigestAllowlistError{
+				DisallowedDigests: map[reg.ImageName][]reg.Digest{
+					"b": {"sha256:222", "sha256:333"},
+				},
+				AllowedDigests: map[reg.ImageName][]reg.Digest{
+					"b": {"sha256:999"},
+				},
+			},
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v "+
+				"(DigestAllowlistCheck)\n", test.name))
+	}
+
+	check := reg.MKRealDigestAllowlistCheck(
+		map[reg.ImageName][]reg.Digest{
+			"a": {"sha256:000"},
+			"b": {},
+		},
+		pullEdges)
+	expected := "The following images would be promoted at a digest " +
+		"that is not in the allowlist:\n" +
+		"a@sha256:111 (allowed: sha256:000)\n" +
+		"b@sha256:222 (allowed: none)\n" +
+		"b@sha256:333 (allowed: none)\n"
+	if err := check.Run(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestDigestFormatCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, srcRC}
+
+	validDigest := reg.Digest("sha256:" + strings.Repeat("0", 64))
+	sha512Digest := reg.Digest("sha512:" + strings.Repeat("1", 128))
+	shortDigest := reg.Digest("sha256:000")
+	unprefixedDigest := reg.Digest(strings.Repeat("2", 64))
+
+	imageA := reg.Image{
+		ImageName: "a",
+		Dmap: reg.DigestTags{
+			validDigest:  {"0.9"},
+			shortDigest:  {"1.0", "1.1"},
+			sha512Digest: {"1.2"}}}
+	imageB := reg.Image{
+		ImageName: "b",
+		Dmap: reg.DigestTags{
+			unprefixedDigest: {"0.9"}}}
+
+	var tests = []struct {
+		name     string
+		check    reg.DigestFormatCheck
+		images   []reg.Image
+		expected error
+	}{
+		{
+			"Valid digests",
+			reg.DigestFormatCheck{},
+			[]reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						validDigest: {"0.9"}}},
+			},
+			nil,
+		},
+		{
+			"Malformed digests",
+			reg.DigestFormatCheck{},
+			[]reg.Image{imageA, imageB},
+			reg.DigestFormatError{
+				map[reg.RegistryImagePath][]reg.Digest{
+					"gcr.io/foo/a": {shortDigest, sha512Digest},
+					"gcr.io/foo/b": {unprefixedDigest},
+				},
+			},
+		},
+		{
+			"SHA512 digests allowed",
+			reg.DigestFormatCheck{
+				AllowSHA512: true,
+			},
+			[]reg.Image{imageA, imageB},
+			reg.DigestFormatError{
+				map[reg.RegistryImagePath][]reg.Digest{
+					"gcr.io/foo/a": {shortDigest},
+					"gcr.io/foo/b": {unprefixedDigest},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		// Unlike manifest parsing, ToPromotionEdges does not validate digests.
+		pullEdges, _ := reg.ToPromotionEdges([]reg.Manifest{
+			{
+				Registries:  registries,
+				Images:      test.images,
+				SrcRegistry: &srcRC},
+		})
+		test.check.PullEdges = pullEdges
+		got := test.check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (DigestFormatCheck)\n",
+				test.name))
+	}
+}
+
+func TestDigestFormatErrorString(t *testing.T) {
+	err := reg.DigestFormatError{
+		map[reg.RegistryImagePath][]reg.Digest{
+			"gcr.io/foo/b": {"sha256:111"},
+			"gcr.io/foo/a": {"000", "sha256:000"},
+		},
+	}
+	expected := "The following images have malformed digests:\n" +
+		"gcr.io/foo/a@000\ngcr.io/foo/a@sha256:000\n" +
+		"gcr.io/foo/b@sha256:111\n"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestSourceDigestExistsCheck(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	registries := []reg.RegistryContext{destRC, srcRC}
+
+	presentDigest := reg.Digest("sha256:" + strings.Repeat("0", 64))
+	absentDigest := reg.Digest("sha256:" + strings.Repeat("1", 64))
+
+	// The fake source registry only has presentDigest, in image "a".
+	listings := map[reg.RegistryName]string{
+		"gcr.io/foo/a": fmt.Sprintf(`{
+  "child": [],
+  "manifest": {
+    %q: {
+      "imageSizeBytes": "10",
+      "layerId": "",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["1.0"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/a",
+  "tags": ["1.0"]
+}`, presentDigest),
+		"gcr.io/foo/b": `{"child": [], "manifest": {}, "name": "foo/b", "tags": []}`,
+	}
+
+	var tests = []struct {
+		name     string
+		images   []reg.Image
+		expected error
+	}{
+		{
+			"Present digest",
+			[]reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						presentDigest: {"1.0"}}},
+			},
+			nil,
+		},
+		{
+			"Absent digests",
+			[]reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						presentDigest: {"1.0"},
+						absentDigest:  {"1.1"}}},
+				{
+					ImageName: "b",
+					Dmap: reg.DigestTags{
+						presentDigest: {"1.0"}}},
+			},
+			reg.SourceDigestError{
+				map[reg.RegistryImagePath][]reg.Digest{
+					"gcr.io/foo/a": {absentDigest},
+					"gcr.io/foo/b": {presentDigest},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		pullEdges, err := reg.ToPromotionEdges([]reg.Manifest{
+			{
+				Registries:  registries,
+				Images:      test.images,
+				SrcRegistry: &srcRC},
+		})
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (edges)\n", test.name))
+
+		sc := reg.SyncContext{
+			Threads:          1,
+			RegistryContexts: registries,
+			Inv:              make(reg.MasterInventory),
+			DigestMediaType:  make(reg.DigestMediaType),
+			DigestImageSize:  make(reg.DigestImageSize),
+		}
+		// Only the source repositories must be read.
+		var reads []reg.RegistryName
+		mkFakeStream := func(
+			sc *reg.SyncContext,
+			rc reg.RegistryContext) stream.Producer {
+
+			reads = append(reads, rc.Name)
+			return &stream.Fake{Bytes: []byte(listings[rc.Name])}
+		}
+		err = sc.ReadSourceRepositories(
+			context.Background(),
+			pullEdges,
+			mkFakeStream)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (read)\n", test.name))
+
+		expectedReads := []reg.RegistryName{"gcr.io/foo/a"}
+		if len(test.images) > 1 {
+			expectedReads = append(expectedReads, "gcr.io/foo/b")
+		}
+		eqErr := checkEqual(reads, expectedReads)
+		checkError(t, eqErr,
+			fmt.Sprintf("checkError: test: %v (reads)\n", test.name))
+
+		check := reg.SourceDigestExistsCheck{
+			SrcInv:    sc.Inv,
+			PullEdges: pullEdges,
+		}
+		got := check.Run()
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr,
+			fmt.Sprintf("checkError: test: %v (SourceDigestExistsCheck)\n",
+				test.name))
+	}
+}
+
+func TestSourceDigestErrorString(t *testing.T) {
+	err := reg.SourceDigestError{
+		map[reg.RegistryImagePath][]reg.Digest{
+			"gcr.io/foo/b": {"sha256:111"},
+			"gcr.io/foo/a": {"sha256:000", "sha256:222"},
+		},
+	}
+	expected := "The following digests do not exist in their source " +
+		"registries:\n" +
+		"gcr.io/foo/a@sha256:000\ngcr.io/foo/a@sha256:222\n" +
+		"gcr.io/foo/b@sha256:111\n"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestDuplicateImageCheck(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           "gcr.io/baz",
+		ServiceAccount: "robot",
+	}
+
+	mkManifest := func(
+		dest reg.RegistryContext,
+		images ...reg.Image) reg.Manifest {
+		return reg.Manifest{
+			Registries:  []reg.RegistryContext{dest, srcRC},
+			Images:      images,
+			SrcRegistry: &srcRC,
+		}
+	}
+	mkImage := func(digest reg.Digest, tags ...reg.Tag) reg.Image {
+		return reg.Image{
+			ImageName: "a",
+			Dmap:      reg.DigestTags{digest: tags},
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		mfests   []reg.Manifest
+		expected error
+	}{
+		{
+			"Clean manifest",
+			[]reg.Manifest{
+				mkManifest(destRC,
+					mkImage("sha256:000", "1.0"),
+					reg.Image{
+						ImageName: "b",
+						Dmap:      reg.DigestTags{"sha256:111": {"1.0"}},
+					}),
+			},
+			nil,
+		},
+		{
+			"Benign duplicate within a manifest",
+			[]reg.Manifest{
+				mkManifest(destRC,
+					mkImage("sha256:000", "1.0"),
+					mkImage("sha256:000", "1.0", "1.0.0"),
+					mkImage("sha256:111", "1.1")),
+			},
+			nil,
+		},
+		{
+			"Same image in manifests with different destinations",
+			[]reg.Manifest{
+				mkManifest(destRC, mkImage("sha256:000", "1.0")),
+				mkManifest(destRC2, mkImage("sha256:111", "1.0")),
+			},
+			nil,
+		},
+		{
+			"Conflicting tags within a manifest",
+			[]reg.Manifest{
+				mkManifest(destRC,
+					mkImage("sha256:000", "1.0", "latest"),
+					mkImage("sha256:111", "1.1", "latest")),
+			},
+			reg.DuplicateImageError{
+				map[reg.RegistryImagePath]map[reg.Tag][]reg.Digest{
+					"gcr.io/bar/a": {
+						"latest": {"sha256:000", "sha256:111"},
+					},
+				},
+			},
+		},
+		{
+			"Conflicting tags across manifests",
+			[]reg.Manifest{
+				mkManifest(destRC, mkImage("sha256:000", "1.0")),
+				mkManifest(destRC2, mkImage("sha256:000", "1.0")),
+				mkManifest(destRC2, mkImage("sha256:111", "1.0")),
+			},
+			reg.DuplicateImageError{
+				map[reg.RegistryImagePath]map[reg.Tag][]reg.Digest{
+					"gcr.io/baz/a": {
+						"1.0": {"sha256:000", "sha256:111"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		check := reg.MKRealDuplicateImageCheck(test.mfests)
+		got := check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (DuplicateImageCheck)\n",
+				test.name))
+	}
+}
+
+func TestDuplicateImageErrorString(t *testing.T) {
+	err := reg.DuplicateImageError{
+		map[reg.RegistryImagePath]map[reg.Tag][]reg.Digest{
+			"gcr.io/bar/b": {
+				"1.0": {"sha256:000", "sha256:111"},
+			},
+			"gcr.io/bar/a": {
+				"latest": {"sha256:000", "sha256:111"},
+				"1.0":    {"sha256:222", "sha256:333"},
+			},
+		},
+	}
+	expected := "The following tags of duplicate image definitions point " +
+		"to different digests:\n" +
+		"gcr.io/bar/a:1.0 (sha256:222, sha256:333)\n" +
+		"gcr.io/bar/a:latest (sha256:000, sha256:111)\n" +
+		"gcr.io/bar/b:1.0 (sha256:000, sha256:111)\n"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestSourceRegistryFlagCheck(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	wrongSrcRC := reg.RegistryContext{
+		Name:           "gcr.io/baz",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+
+	var tests = []struct {
+		name     string
+		mfests   []reg.Manifest
+		expected error
+	}{
+		{
+			"One source registry",
+			[]reg.Manifest{
+				{
+					Registries:  []reg.RegistryContext{destRC, srcRC},
+					SrcRegistry: &srcRC,
+				},
+			},
+			nil,
+		},
+		{
+			"No source registry",
+			[]reg.Manifest{
+				{
+					Registries:  []reg.RegistryContext{srcRC, destRC},
+					SrcRegistry: &srcRC,
+				},
+				{
+					Registries: []reg.RegistryContext{destRC},
+					Filepath:   "a/promoter-manifest.yaml",
+				},
+			},
+			reg.SourceRegistryFlagError{
+				[]reg.MisconfiguredManifest{
+					{
+						Filepath: "a/promoter-manifest.yaml",
+					},
+				},
+			},
+		},
+		{
+			"Multiple source registries",
+			[]reg.Manifest{
+				{
+					Registries: []reg.RegistryContext{
+						srcRC, destRC, wrongSrcRC,
+					},
+					SrcRegistry: &srcRC,
+					Filepath:    "a/promoter-manifest.yaml",
+				},
+			},
+			reg.SourceRegistryFlagError{
+				[]reg.MisconfiguredManifest{
+					{
+						Filepath: "a/promoter-manifest.yaml",
+						SrcRegistries: []reg.RegistryName{
+							"gcr.io/foo", "gcr.io/baz",
+						},
+						SrcRegistry: "gcr.io/foo",
+					},
+				},
+			},
+		},
+		{
+			"Source registry does not match",
+			[]reg.Manifest{
+				{
+					Registries:  []reg.RegistryContext{destRC, wrongSrcRC},
+					SrcRegistry: &srcRC,
+					Filepath:    "a/promoter-manifest.yaml",
+				},
+			},
+			reg.SourceRegistryFlagError{
+				[]reg.MisconfiguredManifest{
+					{
+						Filepath:      "a/promoter-manifest.yaml",
+						SrcRegistries: []reg.RegistryName{"gcr.io/baz"},
+						SrcRegistry:   "gcr.io/foo",
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		check := reg.MKRealSourceRegistryFlagCheck(test.mfests)
+		got := check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (SourceRegistryFlagCheck)\n",
+				test.name))
+	}
+}
+
+func TestSourceRegistryFlagErrorString(t *testing.T) {
+	err := reg.SourceRegistryFlagError{
+		[]reg.MisconfiguredManifest{
+			{
+				Filepath: "a/promoter-manifest.yaml",
+			},
+			{
+				Filepath:      "b/promoter-manifest.yaml",
+				SrcRegistries: []reg.RegistryName{"gcr.io/foo", "gcr.io/bar"},
+				SrcRegistry:   "gcr.io/foo",
+			},
+			{
+				SrcRegistries: []reg.RegistryName{"gcr.io/bar"},
+				SrcRegistry:   "gcr.io/foo",
+			},
+			{
+				Filepath:      "c/promoter-manifest.yaml",
+				SrcRegistries: []reg.RegistryName{"gcr.io/bar"},
+			},
+		},
+	}
+	expected := "The following manifests have a misconfigured source " +
+		"registry:\n" +
+		"a/promoter-manifest.yaml: no registry is marked with " +
+		"'src: true'\n" +
+		"b/promoter-manifest.yaml: 2 registries are marked with " +
+		"'src: true' (gcr.io/foo, gcr.io/bar); only the source registry " +
+		"may be\n" +
+		"(manifest): the source registry is gcr.io/foo, but gcr.io/bar is " +
+		"marked with 'src: true'\n" +
+		"c/promoter-manifest.yaml: the source registry is not set " +
+		"(gcr.io/bar is marked with 'src: true')\n"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+// fakeFailedCmd is a stream.Producer for a command that exits with a nonzero
+// status.
+type fakeFailedCmd struct {
+	stream.Fake
+}
+
+func (producer *fakeFailedCmd) Close() error {
+	return fmt.Errorf("exit status 1")
+}
+
+func TestSignatureVerificationCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries := []reg.RegistryContext{destRC, destRC2, srcRC}
+
+	image1 := reg.Image{
+		ImageName: "foo",
+		Dmap: reg.DigestTags{
+			"sha256:000": {"0.9"}}}
+	image2 := reg.Image{
+		ImageName: "bar",
+		Dmap: reg.DigestTags{
+			"sha256:111": {"0.9"},
+			"sha256:222": {"1.0"}}}
+
+	var tests = []struct {
+		name         string
+		manifests    []reg.Manifest
+		signedImages map[string]bool
+		expected     error
+	}{
+		{
+			"All images signed",
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[string]bool{
+				"gcr.io/foo/foo@sha256:000": true,
+				"gcr.io/foo/bar@sha256:111": true,
+				"gcr.io/foo/bar@sha256:222": true,
+			},
+			nil,
+		},
+		{
+			"Some images unsigned",
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						image1,
+						image2,
+					},
+					SrcRegistry: &srcRC},
+			},
+			map[string]bool{
+				"gcr.io/foo/bar@sha256:111": true,
+			},
+			reg.SignatureError{
+				[]string{
+					"gcr.io/foo/bar@sha256:222",
+					"gcr.io/foo/foo@sha256:000",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		// test is used to pin the "test" variable from the outer "range"
+		// scope (see scopelint).
+		test := test
+		verified := make(map[string]int)
+		check := reg.SignatureVerificationCheck{
+			PublicKey: "cosign.pub",
+			MkVerifyCmd: func(
+				check *reg.SignatureVerificationCheck,
+				imageRef string) stream.Producer {
+
+				verified[imageRef]++
+				if test.signedImages[imageRef] {
+					return &stream.Fake{}
+				}
+				return &fakeFailedCmd{}
+			},
+		}
+		check.PullEdges, _ = reg.ToPromotionEdges(test.manifests)
+		got := check.Run()
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (SignatureVerificationCheck)\n",
+				test.name))
+
+		// Each source image is verified exactly once, even though it is
+		// promoted to 2 registries.
+		err = checkEqual(verified, map[string]int{
+			"gcr.io/foo/foo@sha256:000": 1,
+			"gcr.io/foo/bar@sha256:111": 1,
+			"gcr.io/foo/bar@sha256:222": 1,
+		})
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (verified images)\n",
+				test.name))
+	}
+}
+
+func TestSignatureVerificationCmd(t *testing.T) {
+	var tests = []struct {
+		name     string
+		check    reg.SignatureVerificationCheck
+		expected []string
+	}{
+		{
+			"Public key",
+			reg.SignatureVerificationCheck{
+				PublicKey: "gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k",
+			},
+			[]string{
+				"cosign",
+				"verify",
+				"--key",
+				"gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k",
+				"gcr.io/foo/a@sha256:000",
+			},
+		},
+		{
+			"Keyless",
+			reg.SignatureVerificationCheck{
+				CertificateIdentity:   "robot@example.com",
+				CertificateOIDCIssuer: "https://accounts.google.com",
+			},
+			[]string{
+				"cosign",
+				"verify",
+				"--certificate-identity",
+				"robot@example.com",
+				"--certificate-oidc-issuer",
+				"https://accounts.google.com",
+				"gcr.io/foo/a@sha256:000",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := test.check.GetVerifyCmd("gcr.io/foo/a@sha256:000")
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (cosign command)\n", test.name))
+	}
+}
+
+func TestFloatingTagCheck(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+
+	manifests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, destRC2, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9", "latest"}}},
+				{
+					ImageName: "b",
+					Dmap: reg.DigestTags{
+						"sha256:111": {"master"},
+						"sha256:222": {}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.FloatingTagCheck
+		expected error
+	}{
+		{
+			"No floating tags",
+			reg.FloatingTagCheck{
+				ForbiddenTags: []reg.Tag{"nightly"},
+			},
+			nil,
+		},
+		{
+			// The image is promoted into two destinations, but only
+			// reported once.
+			"Latest",
+			reg.FloatingTagCheck{
+				ForbiddenTags: []reg.Tag{"latest"},
+			},
+			reg.FloatingTagError{
+				[]reg.ImageTag{
+					{ImageName: "a", Tag: "latest"},
+				},
+			},
+		},
+		{
+			"Several floating tags",
+			reg.FloatingTagCheck{
+				ForbiddenTags: []reg.Tag{"master", "latest"},
+			},
+			reg.FloatingTagError{
+				[]reg.ImageTag{
+					{ImageName: "a", Tag: "latest"},
+					{ImageName: "b", Tag: "master"},
+				},
+			},
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (FloatingTagCheck)\n",
+				test.name))
+	}
+
+	// Without forbidden tags, the default ones are used.
+	check := reg.MKRealFloatingTagCheck(nil, pullEdges)
+	expected := "The following images would be promoted with a forbidden " +
+		"floating tag:\na:latest\n"
+	if err := check.Run(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestTagPatternCheck(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           "gcr.io/cat",
+		ServiceAccount: "robot",
+	}
+
+	manifests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, destRC2, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"v1.0.0", "latest"},
+						"sha256:111": {"v1.1.0-rc.1"}}},
+				{
+					ImageName: "b",
+					Dmap: reg.DigestTags{
+						"sha256:222": {"v2.10.3"},
+						"sha256:333": {}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+
+	var tests = []struct {
+		name     string
+		check    reg.TagPatternCheck
+		expected error
+	}{
+		{
+			"Conforming tags",
+			reg.TagPatternCheck{
+				Pattern:    `v[0-9]+\.[0-9]+\.[0-9]+(-rc\.[0-9]+)?`,
+				ExemptTags: []reg.Tag{"latest"},
+			},
+			nil,
+		},
+		{
+			"Non-conforming tags",
+			reg.TagPatternCheck{
+				Pattern: reg.DefaultTagPattern,
+			},
+			reg.TagPatternError{
+				reg.DefaultTagPattern,
+				[]reg.ImageTag{
+					{ImageName: "a", Tag: "latest"},
+					{ImageName: "a", Tag: "v1.1.0-rc.1"},
+				},
+			},
+		},
+		{
+			"Exempt tags",
+			reg.TagPatternCheck{
+				Pattern:    reg.DefaultTagPattern,
+				ExemptTags: []reg.Tag{"latest"},
+			},
+			reg.TagPatternError{
+				reg.DefaultTagPattern,
+				[]reg.ImageTag{
+					{ImageName: "a", Tag: "v1.1.0-rc.1"},
+				},
+			},
+		},
+		{
+			"Patterns match whole tags",
+			reg.TagPatternCheck{
+				Pattern:    `v2`,
+				ExemptTags: []reg.Tag{"latest", "v1.0.0", "v1.1.0-rc.1"},
+			},
+			reg.TagPatternError{
+				`v2`,
+				[]reg.ImageTag{
+					{ImageName: "b", Tag: "v2.10.3"},
+				},
+			},
+		},
+	}
+
+	pullEdges, _ := reg.ToPromotionEdges(manifests)
+	for _, test := range tests {
+		got := test.check.Compare(pullEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (TagPatternCheck)\n",
+				test.name))
+	}
+
+	// Without a pattern, the default one is used.
+	check, err := reg.MKRealTagPatternCheck("", []reg.Tag{"latest"}, pullEdges)
+	checkError(t, err, "checkError: test: MKRealTagPatternCheck\n")
+	expected := "The following images would be promoted with a tag which " +
+		"does not match " + reg.DefaultTagPattern + ":\na:v1.1.0-rc.1\n"
+	if err := check.Run(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+
+	_, err = reg.MKRealTagPatternCheck("v[0-9", nil, pullEdges)
+	if err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
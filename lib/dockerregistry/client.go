@@ -0,0 +1,721 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// RegistryClient abstracts away everything that is specific to a particular
+// registry provider (authentication, the API used for reading repositories,
+// and copying images). The promotion algorithm itself only deals with
+// RegistryContexts, digests and tags, and so it does not care which
+// RegistryClient is behind a given registry.
+//
+// To add support for a new kind of registry, implement this interface and
+// teach GetRegistryClient() to recognize the registry's hostname (or
+// provider).
+type RegistryClient interface {
+	// GetToken returns an access token for the registry. The token is stored
+	// in SyncContext.Tokens (keyed by the root repo of the registry). An
+	// empty token means that no token is required.
+	GetToken(rc RegistryContext, useServiceAccount bool) (gcloud.Token, error)
+
+	// ListTags creates a stream.Producer which reads a single
+	// repository. The stream must be in the format used by GCR's "tags/list"
+	// endpoint (see ggcrV1Google.Tags), because that is what
+	// ReadRegistries() consumes.
+	ListTags(sc *SyncContext, rc RegistryContext) stream.Producer
+
+	// GetManifest creates a stream.Producer which reads the raw manifest
+	// list (or OCI image index) referred to by gmlc.
+	GetManifest(
+		sc *SyncContext,
+		gmlc GCRManifestListContext) stream.Producer
+
+	// CopyImage copies the image (or manifest list) src, located in the srcRC
+	// registry, to dst, located in the dstRC registry (which belongs to this
+	// RegistryClient). Both src and dst are full image references.
+	CopyImage(
+		sc *SyncContext,
+		srcRC RegistryContext,
+		src string,
+		dstRC RegistryContext,
+		dst string) error
+
+	// RemoteOptions returns the options used to authenticate against the
+	// registry when copying images. A nil value means that the default
+	// keychain (the Docker config file) is used.
+	RemoteOptions(sc *SyncContext, rc RegistryContext) []ggcrV1Remote.Option
+}
+
+// GetRegistryClient picks the RegistryClient for the given registry, based on
+// its provider (if set) or its hostname. GCR is the default.
+func GetRegistryClient(rc RegistryContext) RegistryClient {
+	if rc.Provider == ProviderHarbor {
+		return &harborClient{}
+	}
+	if rc.Provider == ProviderLocal {
+		return &localClient{}
+	}
+	domain := strings.Split(string(rc.Name), "/")[0]
+	if _, ok := ParseECRDomain(domain); ok {
+		return &ecrClient{}
+	}
+	if IsDockerHubDomain(domain) {
+		return &dockerHubClient{}
+	}
+	if IsQuayDomain(domain) {
+		return &quayClient{}
+	}
+	if IsACRDomain(domain) {
+		return &acrClient{}
+	}
+	return &gcrClient{}
+}
+
+// registryClient is like GetRegistryClient(), but also works for child
+// repositories and for RegistryContexts which were created on the fly from just
+// a name, as these do not carry the provider of the registry.
+func (sc *SyncContext) registryClient(rc RegistryContext) RegistryClient {
+	return GetRegistryClient(sc.toplevelRegistryContext(rc))
+}
+
+// isToplevelRegistry returns true if the given registry is one of the
+// registries in the SyncContext (as opposed to a child repository of one).
+func (sc *SyncContext) isToplevelRegistry(registryName RegistryName) bool {
+	for _, rc := range sc.RegistryContexts {
+		if rc.Name == registryName {
+			return true
+		}
+	}
+	return false
+}
+
+// toplevelRegistryContext returns the RegistryContext (from the SyncContext)
+// of the registry that rc belongs to. This is useful for child repositories
+// and for RegistryContexts which were created on the fly from just a name, as
+// these do not carry any credentials.
+func (sc *SyncContext) toplevelRegistryContext(
+	rc RegistryContext) RegistryContext {
+
+	for _, known := range sc.RegistryContexts {
+		if rc.Name == known.Name ||
+			strings.HasPrefix(string(rc.Name), string(known.Name)+"/") {
+			return known
+		}
+	}
+	return rc
+}
+
+// childRepos filters the given repository paths down to those that are
+// below repoPath, and trims repoPath from them.
+func childRepos(repos []string, repoPath string) []string {
+	children := []string{}
+	for _, repo := range repos {
+		if strings.HasPrefix(repo, repoPath+"/") {
+			children = append(children, strings.TrimPrefix(repo, repoPath+"/"))
+		}
+	}
+	return children
+}
+
+// getToken looks up the token for the given registry, which must have been
+// populated beforehand by PopulateTokens().
+func (sc *SyncContext) getToken(rc RegistryContext) gcloud.Token {
+	tokenKey, _, _ := GetTokenKeyDomainRepoPath(rc.Name)
+	token, ok := sc.Tokens[RootRepo(tokenKey)]
+	if !ok {
+		klog.Exitf("access token for key '%s' not found\n", tokenKey)
+	}
+	return token
+}
+
+// getBasicAuthToken reads the token (password) of the registry from the
+// environment variable named by rc.TokenEnv. An empty token is returned if no
+// credentials are configured for the registry.
+func getBasicAuthToken(rc RegistryContext) (gcloud.Token, error) {
+	if len(rc.Username) == 0 && len(rc.TokenEnv) == 0 {
+		return "", nil
+	}
+	if len(rc.Username) == 0 || len(rc.TokenEnv) == 0 {
+		return "", fmt.Errorf(
+			"registry %s: 'username' and 'token-env' must be set together",
+			rc.Name)
+	}
+
+	token := os.Getenv(rc.TokenEnv)
+	if len(token) == 0 {
+		return "", fmt.Errorf(
+			"registry %s: environment variable %s is not set",
+			rc.Name,
+			rc.TokenEnv)
+	}
+	return gcloud.Token(token), nil
+}
+
+// basicAuthOptions authenticates with the registry's username and token, if
+// configured. Otherwise the default keychain (the Docker config file) is
+// used. Failed reads are retried (see sc.transport()).
+func (sc *SyncContext) basicAuthOptions(
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	rc = sc.toplevelRegistryContext(rc)
+	if len(rc.Username) == 0 {
+		return []ggcrV1Remote.Option{
+			ggcrV1Remote.WithAuthFromKeychain(authn.DefaultKeychain),
+			sc.transportOption(),
+		}
+	}
+
+	return []ggcrV1Remote.Option{
+		ggcrV1Remote.WithAuth(&authn.Basic{
+			Username: rc.Username,
+			Password: string(sc.getToken(rc)),
+		}),
+		sc.transportOption(),
+	}
+}
+
+// doJSONRequest runs the HTTP request with client (which should retry
+// transient failures, e.g. defaultRetryClient) and decodes the JSON response
+// into v.
+func doJSONRequest(
+	client *http.Client,
+	httpReq *http.Request,
+	v interface{}) error {
+
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s",
+			httpReq.Method,
+			httpReq.URL,
+			res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// registryV2Reader is a stream.Producer which reads a repository from a
+// registry that only implements the standard Docker Registry HTTP API V2,
+// without GCR's extensions to the "tags/list" endpoint. Because the standard
+// endpoint only lists tag names, every tag is resolved to its digest
+// separately. The result is then rendered in GCR's format, so that
+// ReadRegistries() can process it like any other repository.
+//
+// The standard API has no notion of child repositories, so they are listed
+// with the provider-specific ListChildren instead. ListChildren is only set
+// for the toplevel registry; it must return the paths of all repositories
+// below it (relative to it), no matter how deeply nested. The toplevel
+// registry itself is not read as a repository.
+//
+// Untagged images cannot be discovered this way, so they are never reported.
+type registryV2Reader struct {
+	RegistryName RegistryName
+	Options      []ggcrV1Remote.Option
+	ListChildren func() ([]string, error)
+}
+
+// gcrManifestInfo mirrors a single "manifest" entry in GCR's "tags/list"
+// response.
+type gcrManifestInfo struct {
+	Size      string   `json:"imageSizeBytes"`
+	LayerID   string   `json:"layerId"`
+	MediaType string   `json:"mediaType"`
+	Tags      []string `json:"tag"`
+	Created   string   `json:"timeCreatedMs"`
+	Uploaded  string   `json:"timeUploadedMs"`
+}
+
+// gcrTags mirrors GCR's "tags/list" response.
+type gcrTags struct {
+	Children  []string                   `json:"child"`
+	Manifests map[string]gcrManifestInfo `json:"manifest"`
+	Name      string                     `json:"name"`
+	Tags      []string                   `json:"tags"`
+}
+
+// Produce reads the repository and returns the result as JSON on stdout.
+func (r *registryV2Reader) Produce() (io.Reader, io.Reader, error) {
+	var tags *gcrTags
+	var err error
+
+	if r.ListChildren != nil {
+		tags, err = readRegistryV2(r.RegistryName, r.ListChildren)
+	} else {
+		tags, err = readRepositoryV2(r.RegistryName, r.Options)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.NewReader(b), strings.NewReader(""), nil
+}
+
+// Close does nothing, as all requests are finished by the time Produce()
+// returns.
+func (r *registryV2Reader) Close() error {
+	return nil
+}
+
+// registryV2ManifestReader is a stream.Producer which reads a raw manifest
+// by digest using the standard Docker Registry HTTP API V2.
+type registryV2ManifestReader struct {
+	Reference string
+	Options   []ggcrV1Remote.Option
+}
+
+// mkRegistryV2ManifestReader creates a registryV2ManifestReader for the
+// manifest list referred to by gmlc.
+func mkRegistryV2ManifestReader(
+	gmlc GCRManifestListContext,
+	opts []ggcrV1Remote.Option) stream.Producer {
+
+	return &registryV2ManifestReader{
+		Reference: fmt.Sprintf(
+			"%s/%s@%s",
+			gmlc.RegistryContext.Name,
+			gmlc.ImageName,
+			gmlc.Digest),
+		Options: opts,
+	}
+}
+
+// Produce fetches the manifest and returns it on stdout.
+func (r *registryV2ManifestReader) Produce() (io.Reader, io.Reader, error) {
+	ref, err := name.ParseReference(r.Reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desc, err := ggcrV1Remote.Get(ref, r.Options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.NewReader(desc.Manifest), strings.NewReader(""), nil
+}
+
+// Close does nothing, as the request is finished by the time Produce()
+// returns.
+func (r *registryV2ManifestReader) Close() error {
+	return nil
+}
+
+func readRegistryV2(
+	registryName RegistryName,
+	listChildren func() ([]string, error)) (*gcrTags, error) {
+	children, err := listChildren()
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, repoPath := GetTokenKeyDomainRepoPath(registryName)
+	return &gcrTags{
+		Children:  children,
+		Manifests: make(map[string]gcrManifestInfo),
+		Name:      repoPath,
+		Tags:      []string{},
+	}, nil
+}
+
+func readRepositoryV2(
+	registryName RegistryName,
+	opts []ggcrV1Remote.Option) (*gcrTags, error) {
+
+	repo, err := name.NewRepository(string(registryName))
+	if err != nil {
+		return nil, err
+	}
+
+	tagNames, err := ggcrV1Remote.List(repo, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := gcrTags{
+		Children:  []string{},
+		Manifests: make(map[string]gcrManifestInfo),
+		Name:      repo.RepositoryStr(),
+		Tags:      tagNames,
+	}
+
+	for _, tagName := range tagNames {
+		desc, err := ggcrV1Remote.Get(repo.Tag(tagName), opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		digest := desc.Digest.String()
+		info, ok := tags.Manifests[digest]
+		if !ok {
+			size, err := imageSize(desc)
+			if err != nil {
+				return nil, err
+			}
+			info = gcrManifestInfo{
+				Size:      strconv.FormatInt(size, 10),
+				MediaType: string(desc.MediaType),
+				Created:   "0",
+				Uploaded:  "0",
+			}
+		}
+		info.Tags = append(info.Tags, tagName)
+		tags.Manifests[digest] = info
+	}
+
+	return &tags, nil
+}
+
+// imageSize computes the size of an image as the sum of its config and layer
+// sizes. For manifest lists, only the size of the manifest list itself is
+// used, because its children are sized separately.
+func imageSize(desc *ggcrV1Remote.Descriptor) (int64, error) {
+	switch desc.MediaType {
+	case ggcrV1Types.DockerManifestList, ggcrV1Types.OCIImageIndex:
+		return desc.Size, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return 0, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+
+	size := m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// CopyImage copies the image (or manifest list) at src to dst, where src and
+// dst are image references located in the srcRC and dstRC registries,
+// respectively. The copy is done by the RegistryClient of the destination.
+func (sc *SyncContext) CopyImage(
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return sc.registryClient(dstRC).CopyImage(sc, srcRC, src, dstRC, dst)
+}
+
+// copyImageTo copies src to dst, authenticating against the destination with
+// dstOpts. This is the CopyImage() implementation shared by all
+// RegistryClients.
+func copyImageTo(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dst string,
+	dstOpts []ggcrV1Remote.Option) error {
+
+	srcOpts := sc.remoteOptions(srcRC)
+	if dstOpts == nil {
+		dstOpts = sc.defaultRemoteOptions()
+	}
+
+	return copyImage(
+		src, dst, srcOpts, dstOpts, sc.Platforms, sc.SkipMissingPlatforms)
+}
+
+// defaultRemoteOptions are the options for registries that need no special
+// treatment: they use the default keychain (this is what crane.Copy() does).
+// Their requests are paced by sc.RateLimiter, if set, and aborted once the
+// context of sc is done, if any (see sc.withContext()).
+func (sc *SyncContext) defaultRemoteOptions() []ggcrV1Remote.Option {
+	opts := []ggcrV1Remote.Option{
+		ggcrV1Remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	}
+	if sc.RateLimiter != nil || sc.ctx != nil {
+		opts = append(opts, ggcrV1Remote.WithTransport(sc.cancellable(
+			sc.RateLimiter.Transport(http.DefaultTransport))))
+	}
+	return opts
+}
+
+// remoteOptions returns the options to access the rc registry with, i.e.
+// those of its RegistryClient, or sc.defaultRemoteOptions() if it has none.
+func (sc *SyncContext) remoteOptions(rc RegistryContext) []ggcrV1Remote.Option {
+	if opts := sc.registryClient(rc).RemoteOptions(sc, rc); opts != nil {
+		return opts
+	}
+	return sc.defaultRemoteOptions()
+}
+
+// verifyDigest reads back the manifest of the image ref, which was just copied
+// into the rc registry, and returns an error unless its digest is the
+// expected one (i.e., that of the source image). This catches registries (or
+// proxies) that re-encode the manifests they store.
+func (sc *SyncContext) verifyDigest(
+	rc RegistryContext,
+	ref string,
+	expected Digest) error {
+
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %v", ref, err)
+	}
+	desc, err := ggcrV1Remote.Get(parsed, sc.remoteOptions(rc)...)
+	if err != nil {
+		return fmt.Errorf("reading back %q: %v", ref, err)
+	}
+	if got := Digest(desc.Digest.String()); got != expected {
+		return fmt.Errorf(
+			"digest mismatch after copy: %q has digest %s, expected %s",
+			ref, got, expected)
+	}
+	return nil
+}
+
+// copyImage is like crane.Copy(), but can use different credentials for the
+// source and destination. Besides images and manifest lists, it also copies
+// OCI artifacts (see IsArtifact()).
+//
+// Manifests and configs are written exactly as they were read, so that the
+// copies keep their digests, along with any annotations and labels.
+//
+// Layers are streamed from the source to the destination with StreamBlob(),
+// so that memory use does not depend on the size of the image.
+//
+// The children of manifest lists must all exist in the source registry (see
+// checkIndexChildren()), unless skipMissing is set, in which case the missing
+// ones are dropped. If platforms are given, manifest lists are filtered to
+// them (see FilterIndexPlatforms()). In both cases, if dst is a digest, the
+// rebuilt manifest list is written under its own (new) digest instead.
+func copyImage(
+	src, dst string,
+	srcOpts, dstOpts []ggcrV1Remote.Option,
+	platforms []ggcrV1.Platform,
+	skipMissing bool) error {
+
+	srcRef, err := name.ParseReference(src)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %v", src, err)
+	}
+	dstRef, err := name.ParseReference(dst)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %v", dst, err)
+	}
+
+	desc, err := ggcrV1Remote.Get(srcRef, srcOpts...)
+	if err != nil {
+		return fmt.Errorf("fetching %q: %v", src, err)
+	}
+
+	switch desc.MediaType {
+	case ggcrV1Types.DockerManifestList, ggcrV1Types.OCIImageIndex:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		idx, dstRef, err = checkIndexChildren(
+			srcRef, dstRef, idx, srcOpts, skipMissing)
+		if err != nil {
+			return err
+		}
+		if len(platforms) > 0 {
+			idx, dstRef, err = filterIndex(srcRef, dstRef, idx, platforms)
+			if err != nil {
+				return err
+			}
+		}
+		if err := streamIndexLayers(
+			srcRef, dstRef, idx, dstOpts); err != nil {
+			return err
+		}
+		return ggcrV1Remote.WriteIndex(dstRef, idx, dstOpts...)
+	case ggcrV1Types.DockerManifestSchema1,
+		ggcrV1Types.DockerManifestSchema1Signed:
+		return fmt.Errorf("copying %q: schema 1 images are not supported", src)
+	default:
+		artifact, err := IsArtifact(desc.Manifest)
+		if err != nil {
+			return fmt.Errorf("parsing manifest of %q: %v", src, err)
+		}
+		if artifact {
+			return copyArtifact(srcRef, dstRef, desc, srcOpts, dstOpts)
+		}
+
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if err := streamLayers(srcRef, dstRef, img, dstOpts); err != nil {
+			return err
+		}
+		return ggcrV1Remote.Write(dstRef, img, dstOpts...)
+	}
+}
+
+// filterIndex filters the manifest list idx of srcRef to the given platforms
+// (see FilterIndexPlatforms()). If dstRef is a digest, it is replaced with the
+// digest of the filtered manifest list.
+func filterIndex(
+	srcRef, dstRef name.Reference,
+	idx ggcrV1.ImageIndex,
+	platforms []ggcrV1.Platform) (ggcrV1.ImageIndex, name.Reference, error) {
+
+	filtered, err := FilterIndexPlatforms(idx, platforms)
+	if err != nil {
+		return nil, nil, fmt.Errorf("filtering %q: %v", srcRef, err)
+	}
+	digest, err := filtered.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	logging.Log().Info("filtered manifest list",
+		"src", srcRef.String(),
+		"platforms", platformsString(platforms),
+		"digest", digest.String())
+
+	if _, ok := dstRef.(name.Digest); ok {
+		dstRef = dstRef.Context().Digest(digest.String())
+	}
+	return filtered, dstRef, nil
+}
+
+// streamIndexLayers streams the layers of the images of the manifest list idx
+// (see streamLayers()). Nested manifest lists are left to WriteIndex().
+func streamIndexLayers(
+	srcRef, dstRef name.Reference,
+	idx ggcrV1.ImageIndex,
+	dstOpts []ggcrV1Remote.Option) error {
+
+	mfest, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range mfest.Manifests {
+		switch child.MediaType {
+		case ggcrV1Types.DockerManifestSchema2, ggcrV1Types.OCIManifestSchema1:
+		default:
+			continue
+		}
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return err
+		}
+		if err := streamLayers(srcRef, dstRef, img, dstOpts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// artifactManifest is the part of an image manifest that tells images and
+// other OCI artifacts apart.
+type artifactManifest struct {
+	MediaType ggcrV1Types.MediaType `json:"mediaType"`
+	Config    struct {
+		MediaType ggcrV1Types.MediaType `json:"mediaType"`
+	} `json:"config"`
+}
+
+// IsArtifact returns true if the raw manifest is that of an OCI artifact which
+// is not a container image, such as a Helm chart (whose config has the media
+// type "application/vnd.cncf.helm.config.v1+json"). Artifacts use the image
+// manifest format, but their config and layers are opaque blobs.
+func IsArtifact(rawManifest []byte) (bool, error) {
+	var mfest artifactManifest
+	if err := json.Unmarshal(rawManifest, &mfest); err != nil {
+		return false, err
+	}
+
+	switch mfest.MediaType {
+	case ggcrV1Types.DockerManifestSchema2, ggcrV1Types.OCIManifestSchema1:
+	default:
+		return false, nil
+	}
+
+	switch mfest.Config.MediaType {
+	case ggcrV1Types.DockerConfigJSON, ggcrV1Types.OCIConfigJSON:
+		return false, nil
+	}
+	return true, nil
+}
+
+// copyArtifact copies an OCI artifact byte for byte: first the blobs
+// referenced by its manifest (the config and the layers), then the manifest
+// itself. Unlike images, the config is not interpreted in any way.
+func copyArtifact(
+	srcRef, dstRef name.Reference,
+	desc *ggcrV1Remote.Descriptor,
+	srcOpts, dstOpts []ggcrV1Remote.Option) error {
+
+	var mfest ggcrV1.Manifest
+	if err := json.Unmarshal(desc.Manifest, &mfest); err != nil {
+		return fmt.Errorf("parsing manifest of %q: %v", srcRef, err)
+	}
+
+	blobs := append([]ggcrV1.Descriptor{mfest.Config}, mfest.Layers...)
+	for _, blob := range blobs {
+		blobRef := srcRef.Context().Digest(blob.Digest.String())
+		layer, err := ggcrV1Remote.Layer(blobRef, srcOpts...)
+		if err != nil {
+			return fmt.Errorf("fetching blob %q: %v", blobRef, err)
+		}
+		if !canMount(srcRef, dstRef) {
+			layer = &streamingLayer{layer}
+		}
+		if err := ggcrV1Remote.WriteLayer(
+			dstRef.Context(), layer, dstOpts...); err != nil {
+			return fmt.Errorf("copying blob %q: %v", blobRef, err)
+		}
+	}
+
+	// All blobs are in place, so writing the image only uploads the (raw)
+	// manifest.
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	return ggcrV1Remote.Write(dstRef, img, dstOpts...)
+}
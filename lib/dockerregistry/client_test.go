@@ -0,0 +1,662 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+func TestParseECRDomain(t *testing.T) {
+	var tests = []struct {
+		name           string
+		input          string
+		expectedRegion string
+		expectedOk     bool
+	}{
+		{
+			"Regular ECR registry",
+			"123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			"us-east-1",
+			true,
+		},
+		{
+			"FIPS ECR registry",
+			"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com",
+			"us-gov-west-1",
+			true,
+		},
+		{
+			"ECR registry in China",
+			"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			"cn-north-1",
+			true,
+		},
+		{
+			"Account ID is too short",
+			"123456789.dkr.ecr.us-east-1.amazonaws.com",
+			"",
+			false,
+		},
+		{
+			"GCR",
+			"gcr.io",
+			"",
+			false,
+		},
+		{
+			"GCR lookalike",
+			"us.gcr.io.dkr.ecr.us-east-1.amazonaws.com",
+			"",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		gotRegion, gotOk := reg.ParseECRDomain(test.input)
+		err := checkEqual(gotRegion, test.expectedRegion)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (region)\n",
+			test.name))
+		err = checkEqual(gotOk, test.expectedOk)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (ok)\n",
+			test.name))
+	}
+}
+
+func TestIsDockerHubDomain(t *testing.T) {
+	var tests = []struct {
+		name     string
+		input    string
+		expected bool
+	}{
+		{
+			"docker.io",
+			"docker.io",
+			true,
+		},
+		{
+			"Docker Hub index",
+			"index.docker.io",
+			true,
+		},
+		{
+			"Docker Hub registry endpoint",
+			"registry-1.docker.io",
+			true,
+		},
+		{
+			"Docker Hub API (not a registry)",
+			"hub.docker.com",
+			false,
+		},
+		{
+			"GCR",
+			"gcr.io",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		got := reg.IsDockerHubDomain(test.input)
+		err := checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+func TestIsArtifact(t *testing.T) {
+	var tests = []struct {
+		name          string
+		input         string
+		expected      bool
+		expectedError bool
+	}{
+		{
+			"Docker image",
+			`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {
+    "mediaType": "application/vnd.docker.container.image.v1+json"
+  }
+}`,
+			false,
+			false,
+		},
+		{
+			"OCI image",
+			`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {
+    "mediaType": "application/vnd.oci.image.config.v1+json"
+  }
+}`,
+			false,
+			false,
+		},
+		{
+			"Helm chart",
+			`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {
+    "mediaType": "application/vnd.cncf.helm.config.v1+json"
+  },
+  "layers": [
+    {
+      "mediaType": "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+    }
+  ]
+}`,
+			true,
+			false,
+		},
+		{
+			"Manifest list",
+			`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": []
+}`,
+			false,
+			false,
+		},
+		{
+			"Invalid manifest",
+			`not JSON`,
+			false,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := reg.IsArtifact([]byte(test.input))
+		eqErr := checkEqual(err != nil, test.expectedError)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (error)\n",
+			test.name))
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+// rawManifestImage is an image with the given raw manifest, which must
+// describe the same config and layers as the wrapped image.
+type rawManifestImage struct {
+	ggcrV1.Image
+	raw []byte
+}
+
+func (i *rawManifestImage) MediaType() (ggcrV1Types.MediaType, error) {
+	return ggcrV1Types.OCIManifestSchema1, nil
+}
+
+func (i *rawManifestImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *rawManifestImage) Manifest() (*ggcrV1.Manifest, error) {
+	return ggcrV1.ParseManifest(bytes.NewReader(i.raw))
+}
+
+func (i *rawManifestImage) Digest() (ggcrV1.Hash, error) {
+	h, _, err := ggcrV1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+func (i *rawManifestImage) Size() (int64, error) {
+	return int64(len(i.raw)), nil
+}
+
+// rawManifestIndex is a manifest list with the given raw manifest, which must
+// list the same images as the wrapped manifest list.
+type rawManifestIndex struct {
+	idx ggcrV1.ImageIndex
+	raw []byte
+}
+
+func (i *rawManifestIndex) MediaType() (ggcrV1Types.MediaType, error) {
+	return ggcrV1Types.OCIImageIndex, nil
+}
+
+func (i *rawManifestIndex) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *rawManifestIndex) IndexManifest() (*ggcrV1.IndexManifest, error) {
+	return ggcrV1.ParseIndexManifest(bytes.NewReader(i.raw))
+}
+
+func (i *rawManifestIndex) Digest() (ggcrV1.Hash, error) {
+	h, _, err := ggcrV1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+func (i *rawManifestIndex) Size() (int64, error) {
+	return int64(len(i.raw)), nil
+}
+
+func (i *rawManifestIndex) Image(h ggcrV1.Hash) (ggcrV1.Image, error) {
+	return i.idx.Image(h)
+}
+
+func (i *rawManifestIndex) ImageIndex(
+	h ggcrV1.Hash) (ggcrV1.ImageIndex, error) {
+	return i.idx.ImageIndex(h)
+}
+
+// TestCopyImagePreservesAnnotations checks that promoted images and manifest
+// lists keep their OCI annotations and config (labels), byte for byte, so
+// that their digests do not change.
+func TestCopyImagePreservesAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		"org.opencontainers.image.revision": "1a2b3c4d",
+		"org.opencontainers.image.created":  "2020-06-01T00:00:00Z",
+	}
+
+	img, err := random.Image(1024, 2)
+	checkError(t, err, "unexpected error creating image\n")
+	cfg, err := img.ConfigFile()
+	checkError(t, err, "unexpected error reading config\n")
+	cfg.Config.Labels = map[string]string{"build-date": "2020-06-01"}
+	img, err = mutate.ConfigFile(img, cfg)
+	checkError(t, err, "unexpected error setting config\n")
+
+	// The manifests are indented unusually, so that any re-encoding would
+	// change their digests.
+	mfest, err := img.Manifest()
+	checkError(t, err, "unexpected error reading manifest\n")
+	mfest.MediaType = ggcrV1Types.OCIManifestSchema1
+	mfest.Config.MediaType = ggcrV1Types.OCIConfigJSON
+	mfest.Annotations = annotations
+	raw, err := json.MarshalIndent(mfest, "", "   ")
+	checkError(t, err, "unexpected error encoding manifest\n")
+	annotatedImg := &rawManifestImage{Image: img, raw: raw}
+
+	idx, _ := mkMultiPlatformIndex(t,
+		ggcrV1.Platform{OS: "linux", Architecture: "amd64"},
+		ggcrV1.Platform{OS: "linux", Architecture: "arm64"})
+	idxMfest, err := idx.IndexManifest()
+	checkError(t, err, "unexpected error reading index\n")
+	idxMfest.MediaType = ggcrV1Types.OCIImageIndex
+	idxMfest.Annotations = annotations
+	rawIdx, err := json.MarshalIndent(idxMfest, "", "   ")
+	checkError(t, err, "unexpected error encoding index\n")
+	annotatedIdx := &rawManifestIndex{idx: idx, raw: rawIdx}
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	write := func(ref string, write func(name.Reference) error) {
+		parsed, err := name.ParseReference(ref)
+		checkError(t, err, "unexpected error parsing reference\n")
+		checkError(t, write(parsed), "unexpected error writing "+ref+"\n")
+	}
+	write(host+"/src/img:v1", func(ref name.Reference) error {
+		return ggcrV1Remote.Write(ref, annotatedImg)
+	})
+	write(host+"/src/idx:v1", func(ref name.Reference) error {
+		return ggcrV1Remote.WriteIndex(ref, annotatedIdx)
+	})
+
+	srcRC := reg.RegistryContext{Name: reg.RegistryName(host + "/src")}
+	dstRC := reg.RegistryContext{Name: reg.RegistryName(host + "/dst")}
+	sc := reg.SyncContext{RegistryContexts: []reg.RegistryContext{srcRC, dstRC}}
+
+	var tests = []struct {
+		name     string
+		image    string
+		expected []byte
+	}{
+		{"Image", "img", raw},
+		{"Manifest list", "idx", rawIdx},
+	}
+
+	for _, test := range tests {
+		src := host + "/src/" + test.image + ":v1"
+		dst := host + "/dst/" + test.image + ":v1"
+		err := sc.CopyImage(srcRC, src, dstRC, dst)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (copy)\n", test.name))
+
+		dstRef, err := name.ParseReference(dst)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (parse)\n", test.name))
+		desc, err := ggcrV1Remote.Get(dstRef)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (get)\n", test.name))
+		err = checkEqual(string(desc.Manifest), string(test.expected))
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (manifest)\n", test.name))
+		expectedDigest, _, _ := ggcrV1.SHA256(bytes.NewReader(test.expected))
+		err = checkEqual(desc.Digest, expectedDigest)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (digest)\n", test.name))
+	}
+
+	// The config (and so the labels) of the image came along too.
+	dstRef, err := name.ParseReference(host + "/dst/img:v1")
+	checkError(t, err, "unexpected error parsing reference\n")
+	dstImg, err := ggcrV1Remote.Image(dstRef)
+	checkError(t, err, "unexpected error reading copied image\n")
+	gotCfg, err := dstImg.RawConfigFile()
+	checkError(t, err, "unexpected error reading copied config\n")
+	expectedCfg, err := img.RawConfigFile()
+	checkError(t, err, "unexpected error reading config\n")
+	err = checkEqual(string(gotCfg), string(expectedCfg))
+	checkError(t, err, "unexpected copied config\n")
+}
+
+// reencodingRegistry is an in-memory registry which re-encodes the image
+// manifests that it serves from the repositories below prefix, like a
+// misbehaving proxy would: their JSON keys are sorted, which changes their
+// digests.
+func reencodingRegistry(prefix string) http.Handler {
+	inner := registry.New()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet ||
+			!strings.HasPrefix(r.URL.Path, "/v2/"+prefix+"/") ||
+			!strings.Contains(r.URL.Path, "/manifests/") {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		inner.ServeHTTP(rec, r)
+		body := rec.Body.Bytes()
+		var mfest map[string]interface{}
+		if rec.Code == http.StatusOK && json.Unmarshal(body, &mfest) == nil {
+			body, _ = json.Marshal(mfest)
+		}
+		for key, values := range rec.Header() {
+			if key == "Content-Length" || key == "Docker-Content-Digest" {
+				continue
+			}
+			w.Header()[key] = values
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(body)
+	})
+}
+
+func TestPromoteVerifyDigests(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	checkError(t, err, "unexpected error creating image\n")
+	h, err := img.Digest()
+	checkError(t, err, "unexpected error reading digest\n")
+	digest := reg.Digest(h.String())
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	var tests = []struct {
+		name           string
+		verifyDigests  bool
+		expectedFailed []string
+	}{
+		{
+			"Re-encoded copies go unnoticed by default",
+			false,
+			nil,
+		},
+		{
+			"Re-encoded copies fail with -verify-digests",
+			true,
+			[]string{"mangled/foo"},
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(reencodingRegistry("mangled"))
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		srcRef, err := name.ParseReference(host + "/src/foo@" + h.String())
+		checkError(t, err, "unexpected error parsing reference\n")
+		err = ggcrV1Remote.Write(srcRef, img)
+		checkError(t, err, "unexpected error writing image\n")
+
+		srcRC := reg.RegistryContext{
+			Name: reg.RegistryName(host + "/src"),
+			Src:  true,
+		}
+		plainRC := reg.RegistryContext{Name: reg.RegistryName(host + "/plain")}
+		mangledRC := reg.RegistryContext{
+			Name: reg.RegistryName(host + "/mangled"),
+		}
+		mfest := reg.Manifest{
+			Registries: []reg.RegistryContext{srcRC, plainRC, mangledRC},
+			Images: []reg.Image{
+				{
+					ImageName: "foo",
+					Dmap:      reg.DigestTags{digest: {"1.0"}},
+				},
+			},
+			SrcRegistry: &srcRC,
+		}
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (edges)\n", test.name))
+
+		sc := reg.SyncContext{
+			RegistryContexts: mfest.Registries,
+			VerifyDigests:    test.verifyDigests,
+		}
+		got, err := sc.Promote(context.Background(), edges, nopStream, nil)
+		eqErr := checkEqual(err != nil, len(test.expectedFailed) > 0)
+		checkError(t, eqErr,
+			fmt.Sprintf("checkError: test: %v (error)\n", test.name))
+
+		var gotFailed []string
+		for _, failed := range got.Failed {
+			gotFailed = append(gotFailed,
+				strings.TrimPrefix(failed.Destination, host+"/"))
+			eqErr = checkEqual(
+				strings.Contains(
+					strings.Join(failed.Errors, "\n"), "digest mismatch"),
+				true)
+			checkError(t, eqErr,
+				fmt.Sprintf("checkError: test: %v (failure)\n", test.name))
+		}
+		eqErr = checkEqual(gotFailed, test.expectedFailed)
+		checkError(t, eqErr,
+			fmt.Sprintf("checkError: test: %v (failed)\n", test.name))
+		eqErr = checkEqual(len(got.Promoted), 2-len(test.expectedFailed))
+		checkError(t, eqErr,
+			fmt.Sprintf("checkError: test: %v (promoted)\n", test.name))
+
+		server.Close()
+	}
+}
+
+// TestGCRClientPromotionEdges reads GCR registries through the GCR
+// RegistryClient (serving canned responses instead of making the HTTP
+// requests), and checks that the promotion edges are the same as for any
+// other source of inventory.
+func TestGCRClientPromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	rcs := []reg.RegistryContext{srcRC, destRC}
+
+	// Canned responses, keyed by URL.
+	responses := map[string]string{
+		"https://gcr.io/v2/foo/tags/list": `{
+  "child": ["a"],
+  "manifest": {},
+  "name": "foo",
+  "tags": []
+}`,
+		"https://gcr.io/v2/foo/a/tags/list": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "imageSizeBytes": "100",
+      "layerId": "",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["0.9"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    },
+    "sha256:111": {
+      "imageSizeBytes": "100",
+      "layerId": "",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["1.0"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/a",
+  "tags": ["0.9", "1.0"]
+}`,
+		"https://gcr.io/v2/bar/tags/list": `{
+  "child": ["a"],
+  "manifest": {},
+  "name": "bar",
+  "tags": []
+}`,
+		"https://gcr.io/v2/bar/a/tags/list": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "imageSizeBytes": "100",
+      "layerId": "",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["0.9"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "bar/a",
+  "tags": ["0.9"]
+}`,
+	}
+
+	sc := reg.SyncContext{
+		UseServiceAccount: true,
+		RegistryContexts:  rcs,
+		Inv: reg.MasterInventory{
+			srcRC.Name:  nil,
+			destRC.Name: nil,
+		},
+		Tokens: map[reg.RootRepo]gcloud.Token{
+			"gcr.io/foo": "token-foo",
+			"gcr.io/bar": "token-bar",
+		},
+		DigestMediaType: make(reg.DigestMediaType),
+		DigestImageSize: make(reg.DigestImageSize),
+	}
+
+	mkFakeGCRStream := func(
+		sc *reg.SyncContext,
+		rc reg.RegistryContext) stream.Producer {
+
+		producer := reg.GetRegistryClient(rc).ListTags(sc, rc)
+		httpProducer, ok := producer.(*stream.HTTP)
+		if !ok {
+			checkError(
+				t,
+				fmt.Errorf("unexpected stream.Producer %T for %s", producer, rc.Name),
+				"Test: TestGCRClientPromotionEdges\n")
+			return &stream.Fake{}
+		}
+
+		// Check that the right token is used.
+		tokenKey, _, _ := reg.GetTokenKeyDomainRepoPath(rc.Name)
+		err := checkEqual(
+			httpProducer.Req.Header.Get("Authorization"),
+			"Bearer "+string(sc.Tokens[reg.RootRepo(tokenKey)]))
+		checkError(t, err, "Test: TestGCRClientPromotionEdges (token)\n")
+
+		body, ok := responses[httpProducer.Req.URL.String()]
+		if !ok {
+			checkError(
+				t,
+				fmt.Errorf("unexpected request %s", httpProducer.Req.URL),
+				"Test: TestGCRClientPromotionEdges\n")
+		}
+		return &stream.Fake{Bytes: []byte(body)}
+	}
+	err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeGCRStream)
+	checkError(t, err, "Test: TestGCRClientPromotionEdges\n")
+
+	mfests := []reg.Manifest{
+		{
+			Registries: rcs,
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"},
+						"sha256:111": {"1.0"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "Test: TestGCRClientPromotionEdges (ToPromotionEdges)\n")
+
+	got, clean := sc.GetPromotionCandidates(edges)
+	expected := map[reg.PromotionEdge]interface{}{
+		{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{
+				ImageName: "a",
+				Tag:       "1.0"},
+			Digest:      "sha256:111",
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{
+				ImageName: "a",
+				Tag:       "1.0"}}: nil,
+	}
+	err = checkEqual(got, expected)
+	checkError(t, err, "Test: TestGCRClientPromotionEdges (edges)\n")
+	err = checkEqual(clean, true)
+	checkError(t, err, "Test: TestGCRClientPromotionEdges (clean)\n")
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// dockerConfig is the part of a Docker config file (as written by "docker
+// login") that holds static credentials, keyed by registry host.
+type dockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+// dockerAuth holds the credentials for a single registry host, either as a
+// username and password, or as "auth" (the base64 encoding of
+// "<username>:<password>").
+type dockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ReadCredentialsFile reads the credentials for the host of the registry from
+// the Docker config file at path (see RegistryContext's CredentialsFile). The
+// entry for the host may also be keyed by its URL (e.g.
+// "https://index.docker.io/v1/", which is what "docker login" uses for
+// Docker Hub).
+func ReadCredentialsFile(
+	path string,
+	registryName RegistryName) (string, string, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf(
+			"registry %s: reading credentials file: %v", registryName, err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", "", fmt.Errorf(
+			"registry %s: parsing credentials file %q: %v",
+			registryName, path, err)
+	}
+
+	_, domain, _ := GetTokenKeyDomainRepoPath(registryName)
+	keys := []string{domain, "https://" + domain, "https://" + domain + "/v1/"}
+	if IsDockerHubDomain(domain) {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		username, password := auth.Username, auth.Password
+		if len(auth.Auth) > 0 {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf(
+					"registry %s: invalid 'auth' for %s in %q: %v",
+					registryName, key, path, err)
+			}
+			kv := strings.SplitN(string(decoded), ":", 2)
+			if len(kv) != 2 {
+				return "", "", fmt.Errorf(
+					"registry %s: invalid 'auth' for %s in %q "+
+						"(expected <username>:<password>)",
+					registryName, key, path)
+			}
+			username, password = kv[0], kv[1]
+		}
+		if len(username) == 0 || len(password) == 0 {
+			return "", "", fmt.Errorf(
+				"registry %s: no username or password for %s in %q",
+				registryName, key, path)
+		}
+		return username, password, nil
+	}
+
+	return "", "", fmt.Errorf(
+		"registry %s: no credentials for %s in %q",
+		registryName, domain, path)
+}
+
+// hasCredentialsFile returns true if the registry that rc belongs to reads its
+// credentials from a credentials file.
+func (sc *SyncContext) hasCredentialsFile(rc RegistryContext) bool {
+	return len(sc.toplevelRegistryContext(rc).CredentialsFile) > 0
+}
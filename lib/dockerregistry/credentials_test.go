@@ -0,0 +1,242 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// writeCredentialsFile writes a Docker config file with the given contents
+// into dir, and returns its path.
+func writeCredentialsFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing credentials file: %v", err)
+	}
+	return path
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "credentials")
+	checkError(t, err, "unexpected error creating temp dir\n")
+	defer os.RemoveAll(tmpDir)
+
+	aliceAuth := base64.StdEncoding.EncodeToString([]byte("alice:s3cr:et"))
+
+	var tests = []struct {
+		name             string
+		registry         reg.RegistryName
+		contents         string
+		expectedUsername string
+		expectedPassword string
+		expectedError    string
+	}{
+		{
+			name:     "Username and password",
+			registry: "quay.io/myorg",
+			contents: `{"auths": {"quay.io": ` +
+				`{"username": "myorg+robot", "password": "token"}}}`,
+			expectedUsername: "myorg+robot",
+			expectedPassword: "token",
+		},
+		{
+			name:     "Encoded auth",
+			registry: "gcr.io/foo",
+			contents: fmt.Sprintf(
+				`{"auths": {"https://gcr.io": {"auth": %q}}}`, aliceAuth),
+			expectedUsername: "alice",
+			expectedPassword: "s3cr:et",
+		},
+		{
+			name:     "Docker Hub",
+			registry: "docker.io/myorg",
+			contents: `{"auths": {"https://index.docker.io/v1/": ` +
+				`{"username": "bob", "password": "token"}}}`,
+			expectedUsername: "bob",
+			expectedPassword: "token",
+		},
+		{
+			name:     "No entry for the registry",
+			registry: "gcr.io/foo",
+			contents: `{"auths": {"quay.io": ` +
+				`{"username": "bob", "password": "token"}}}`,
+			expectedError: "registry gcr.io/foo: no credentials for gcr.io",
+		},
+		{
+			name:     "No password",
+			registry: "gcr.io/foo",
+			contents: `{"auths": {"gcr.io": {"username": "bob"}}}`,
+			expectedError: "registry gcr.io/foo: " +
+				"no username or password for gcr.io",
+		},
+		{
+			name:          "Invalid auth",
+			registry:      "gcr.io/foo",
+			contents:      `{"auths": {"gcr.io": {"auth": "Ym9i"}}}`,
+			expectedError: "registry gcr.io/foo: invalid 'auth' for gcr.io",
+		},
+	}
+
+	for i, test := range tests {
+		path := writeCredentialsFile(
+			t, tmpDir, fmt.Sprintf("config-%d.json", i), test.contents)
+		username, password, err := reg.ReadCredentialsFile(path, test.registry)
+		if test.expectedError != "" {
+			if err == nil ||
+				!strings.HasPrefix(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			continue
+		}
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		err = checkEqual(username, test.expectedUsername)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (username)\n",
+			test.name))
+		err = checkEqual(password, test.expectedPassword)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (password)\n",
+			test.name))
+	}
+}
+
+// basicAuthRegistry is an in-memory registry which only lets the given user
+// in, and records the usernames that it saw.
+type basicAuthRegistry struct {
+	username string
+	password string
+
+	inner http.Handler
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+func newBasicAuthRegistry(username, password string) *basicAuthRegistry {
+	return &basicAuthRegistry{
+		username: username,
+		password: password,
+		inner:    registry.New(),
+		seen:     make(map[string]bool),
+	}
+}
+
+func (r *basicAuthRegistry) ServeHTTP(
+	w http.ResponseWriter,
+	req *http.Request) {
+
+	username, password, ok := req.BasicAuth()
+	if ok {
+		r.mutex.Lock()
+		r.seen[username] = true
+		r.mutex.Unlock()
+	}
+	if !ok || username != r.username || password != r.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.inner.ServeHTTP(w, req)
+}
+
+// TestCredentialsFilePerRegistry copies an image between two registries that
+// only accept their own credentials, which are read from different files.
+func TestCredentialsFilePerRegistry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "credentials")
+	checkError(t, err, "unexpected error creating temp dir\n")
+	defer os.RemoveAll(tmpDir)
+
+	srcRegistry := newBasicAuthRegistry("alice", "alice-token")
+	srcServer := httptest.NewServer(srcRegistry)
+	defer srcServer.Close()
+	srcHost := strings.TrimPrefix(srcServer.URL, "http://")
+
+	dstRegistry := newBasicAuthRegistry("bob", "bob-token")
+	dstServer := httptest.NewServer(dstRegistry)
+	defer dstServer.Close()
+	dstHost := strings.TrimPrefix(dstServer.URL, "http://")
+
+	srcCredentials := writeCredentialsFile(t, tmpDir, "src.json",
+		fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`,
+			srcHost,
+			base64.StdEncoding.EncodeToString([]byte("alice:alice-token"))))
+	dstCredentials := writeCredentialsFile(t, tmpDir, "dst.json",
+		fmt.Sprintf(`{"auths": {%q: {"username": "bob", "password": %q}}}`,
+			"https://"+dstHost,
+			"bob-token"))
+
+	img, err := random.Image(1024, 1)
+	checkError(t, err, "unexpected error creating image\n")
+	digest, err := img.Digest()
+	checkError(t, err, "unexpected error reading digest\n")
+	src := srcHost + "/src/foo@" + digest.String()
+	srcRef, err := name.ParseReference(src)
+	checkError(t, err, "unexpected error parsing reference\n")
+	err = ggcrV1Remote.Write(srcRef, img, ggcrV1Remote.WithAuth(
+		&authn.Basic{Username: "alice", Password: "alice-token"}))
+	checkError(t, err, "unexpected error writing image\n")
+	srcRegistry.seen = make(map[string]bool)
+
+	srcRC := reg.RegistryContext{
+		Name:            reg.RegistryName(srcHost + "/src"),
+		CredentialsFile: srcCredentials,
+		Src:             true,
+	}
+	dstRC := reg.RegistryContext{
+		Name:            reg.RegistryName(dstHost + "/dst"),
+		CredentialsFile: dstCredentials,
+	}
+	sc := reg.SyncContext{
+		RegistryContexts: []reg.RegistryContext{srcRC, dstRC},
+		Tokens:           make(map[reg.RootRepo]gcloud.Token),
+	}
+	err = sc.PopulateTokens()
+	checkError(t, err, "unexpected error populating tokens\n")
+
+	dst := dstHost + "/dst/foo:1.0"
+	err = sc.CopyImage(srcRC, src, dstRC, dst)
+	checkError(t, err, "unexpected error copying image\n")
+
+	// Every registry only ever saw its own user.
+	err = checkEqual(srcRegistry.seen, map[string]bool{"alice": true})
+	checkError(t, err, "unexpected users of the source registry\n")
+	err = checkEqual(dstRegistry.seen, map[string]bool{"bob": true})
+	checkError(t, err, "unexpected users of the destination registry\n")
+
+	dstRef, err := name.ParseReference(dst)
+	checkError(t, err, "unexpected error parsing reference\n")
+	desc, err := ggcrV1Remote.Get(dstRef, ggcrV1Remote.WithAuth(
+		&authn.Basic{Username: "bob", Password: "bob-token"}))
+	checkError(t, err, "unexpected error reading copied image\n")
+	err = checkEqual(desc.Digest, digest)
+	checkError(t, err, "unexpected digest of copied image\n")
+}
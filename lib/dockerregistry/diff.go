@@ -0,0 +1,345 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// PromotionDiff renders the given edges (which should already be filtered by
+// FilterPromotionEdges, so that they only hold what is missing from the
+// destinations) as a human-readable table, grouped by destination registry.
+//
+// The number of bytes to transfer is computed from sc.DigestImageSize. A digest
+// is counted once per destination registry, and not at all if the destination
+// already has it (in which case only a tag is added). If sc.Positions is set,
+// the position of every edge in the manifests is shown too.
+func (sc *SyncContext) PromotionDiff(
+	edges map[PromotionEdge]interface{}) string {
+
+	if len(edges) == 0 {
+		return "Nothing to promote.\n"
+	}
+
+	byDst := make(map[RegistryName][]PromotionEdge)
+	for edge := range edges {
+		name := edge.DstRegistry.Name
+		byDst[name] = append(byDst[name], edge)
+	}
+
+	dsts := make([]RegistryName, 0, len(byDst))
+	for name := range byDst {
+		dsts = append(dsts, name)
+	}
+	sort.Slice(dsts, func(i, j int) bool { return dsts[i] < dsts[j] })
+
+	var sb strings.Builder
+	var totalBytes int64
+	unknown := 0
+
+	for _, dst := range dsts {
+		dstEdges := byDst[dst]
+		sort.Slice(dstEdges, func(i, j int) bool {
+			return diffDestination(dstEdges[i]) < diffDestination(dstEdges[j])
+		})
+
+		var rows strings.Builder
+		tw := tabwriter.NewWriter(&rows, 0, 0, 2, ' ', 0)
+		if sc.Positions != nil {
+			fmt.Fprintln(tw, "  DIGEST\tDESTINATION\tSIZE\tDECLARED AT")
+		} else {
+			fmt.Fprintln(tw, "  DIGEST\tDESTINATION\tSIZE")
+		}
+
+		var dstBytes int64
+		counted := make(map[Digest]bool)
+		for _, edge := range dstEdges {
+			size := "-"
+			_, dp := edge.VertexProps(sc.Inv)
+			if !dp.DigestExists && !counted[edge.Digest] {
+				counted[edge.Digest] = true
+				if bytes, ok := sc.DigestImageSize[edge.Digest]; ok {
+					dstBytes += int64(bytes)
+					size = BytesToHuman(int64(bytes))
+				} else {
+					unknown++
+					size = "unknown"
+				}
+			}
+			if sc.Positions != nil {
+				declaredAt := sc.declaredAt(
+					edge.SrcImageTag.ImageName,
+					edge.Digest)
+				if len(declaredAt) == 0 {
+					declaredAt = "-"
+				}
+				fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n",
+					edge.Digest, diffDestination(edge), size, declaredAt)
+			} else {
+				fmt.Fprintf(tw, "  %s\t%s\t%s\n",
+					edge.Digest, diffDestination(edge), size)
+			}
+		}
+		// nolint[errcheck]
+		tw.Flush()
+
+		totalBytes += dstBytes
+		fmt.Fprintf(&sb, "%s (%d edges, %s):\n",
+			dst, len(dstEdges), BytesToHuman(dstBytes))
+		sb.WriteString(rows.String())
+		sb.WriteString("\n")
+	}
+
+	fmt.Fprintf(&sb,
+		"Total: %d edges to %d registries, %d bytes (%s) to transfer",
+		len(edges), len(dsts), totalBytes, BytesToHuman(totalBytes))
+	if unknown > 0 {
+		fmt.Fprintf(&sb, " (images of unknown size: %d)", unknown)
+	}
+	sb.WriteString("\n")
+
+	return sb.String()
+}
+
+// GarbageCollectionDiff renders the given garbage collection candidates (see
+// GetGarbageCollectionCandidates()) as a human-readable table, with the sizes
+// of the images from sc.DigestImageSize.
+func (sc *SyncContext) GarbageCollectionDiff(
+	candidates []PromotionRequest) string {
+
+	if len(candidates) == 0 {
+		return "Nothing to garbage collect.\n"
+	}
+
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  DIGEST\tIMAGE\tSIZE")
+
+	var totalBytes int64
+	unknown := 0
+	for _, candidate := range candidates {
+		size := "unknown"
+		if bytes, ok := sc.DigestImageSize[candidate.Digest]; ok {
+			totalBytes += int64(bytes)
+			size = BytesToHuman(int64(bytes))
+		} else {
+			unknown++
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n",
+			candidate.Digest,
+			string(candidate.RegistryDest)+"/"+
+				string(candidate.ImageNameDest),
+			size)
+	}
+	// nolint[errcheck]
+	tw.Flush()
+
+	fmt.Fprintf(&sb, "Total: %d untagged images, %d bytes (%s) to delete",
+		len(candidates), totalBytes, BytesToHuman(totalBytes))
+	if unknown > 0 {
+		fmt.Fprintf(&sb, " (images of unknown size: %d)", unknown)
+	}
+	sb.WriteString("\n")
+
+	return sb.String()
+}
+
+// DiffPromotionEdges compares the promotion edges of two revisions of the
+// promoter manifests (see ToPromotionEdges()). An edge of oldEdges is removed
+// if no edge of newEdges promotes its digest to the same destination, as in
+// ImageRemovalCheck; but if the destination is a tag which points to another
+// digest in newEdges, the edge is changed instead.
+func DiffPromotionEdges(
+	oldEdges map[PromotionEdge]interface{},
+	newEdges map[PromotionEdge]interface{}) ManifestDiff {
+
+	oldDsts := edgesByDestination(oldEdges)
+	newDsts := edgesByDestination(newEdges)
+
+	var d ManifestDiff
+	for dst, digests := range oldDsts {
+		for digest, edge := range digests {
+			if _, found := newDsts[dst][digest]; found {
+				continue
+			}
+			// A tag only ever points to one digest.
+			if dst.ImageTag.Tag != "" && len(newDsts[dst]) == 1 {
+				for _, newEdge := range newDsts[dst] {
+					d.Changed = append(d.Changed, ChangedEdge{
+						Old: edge,
+						New: newEdge,
+					})
+				}
+				continue
+			}
+			d.Removed = append(d.Removed, edge)
+		}
+	}
+	for dst, digests := range newDsts {
+		for digest, edge := range digests {
+			if _, found := oldDsts[dst][digest]; found {
+				continue
+			}
+			// Already recorded as changed.
+			if dst.ImageTag.Tag != "" && len(oldDsts[dst]) == 1 {
+				continue
+			}
+			d.Added = append(d.Added, edge)
+		}
+	}
+
+	sortEdges(d.Added)
+	sortEdges(d.Removed)
+	sort.Slice(d.Changed, func(i, j int) bool {
+		return edgeLess(d.Changed[i].New, d.Changed[j].New)
+	})
+	return d
+}
+
+// edgeDestination is where a PromotionEdge promotes its digest to.
+type edgeDestination struct {
+	Registry RegistryName
+	ImageTag ImageTag
+}
+
+// edgesByDestination indexes the edges by their destination and digest.
+// Untagged destinations may have several digests.
+func edgesByDestination(
+	edges map[PromotionEdge]interface{},
+) map[edgeDestination]map[Digest]PromotionEdge {
+
+	dsts := make(map[edgeDestination]map[Digest]PromotionEdge)
+	for edge := range edges {
+		dst := edgeDestination{
+			Registry: edge.DstRegistry.Name,
+			ImageTag: edge.DstImageTag,
+		}
+		if dsts[dst] == nil {
+			dsts[dst] = make(map[Digest]PromotionEdge)
+		}
+		dsts[dst][edge.Digest] = edge
+	}
+	return dsts
+}
+
+// sortEdges sorts the edges by destination image, tag and digest.
+func sortEdges(edges []PromotionEdge) {
+	sort.Slice(edges, func(i, j int) bool {
+		return edgeLess(edges[i], edges[j])
+	})
+}
+
+func edgeLess(a, b PromotionEdge) bool {
+	if diffImage(a) != diffImage(b) {
+		return diffImage(a) < diffImage(b)
+	}
+	if a.DstImageTag.Tag != b.DstImageTag.Tag {
+		return a.DstImageTag.Tag < b.DstImageTag.Tag
+	}
+	return a.Digest < b.Digest
+}
+
+// IsEmpty returns true if the two revisions promote the same images.
+func (d *ManifestDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String renders the ManifestDiff as a human-readable list, grouped by
+// destination image. Added edges are marked with "+", removed edges with "-"
+// and changed edges with "~".
+func (d *ManifestDiff) String() string {
+	if d.IsEmpty() {
+		return "No changes.\n"
+	}
+
+	type row struct {
+		edge PromotionEdge
+		line string
+	}
+	byImage := make(map[string][]row)
+	add := func(edge PromotionEdge, mark, digests string) {
+		tag := string(edge.DstImageTag.Tag)
+		if tag == "" {
+			tag = "(untagged)"
+		}
+		image := diffImage(edge)
+		byImage[image] = append(byImage[image], row{
+			edge: edge,
+			line: fmt.Sprintf("  %s\t%s\t%s\n", mark, tag, digests),
+		})
+	}
+	for _, edge := range d.Added {
+		add(edge, "+", string(edge.Digest))
+	}
+	for _, edge := range d.Removed {
+		add(edge, "-", string(edge.Digest))
+	}
+	for _, change := range d.Changed {
+		add(change.New, "~",
+			string(change.Old.Digest)+" -> "+string(change.New.Digest))
+	}
+
+	images := make([]string, 0, len(byImage))
+	for image := range byImage {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	var sb strings.Builder
+	for _, image := range images {
+		rows := byImage[image]
+		sort.SliceStable(rows, func(i, j int) bool {
+			return edgeLess(rows[i].edge, rows[j].edge)
+		})
+
+		fmt.Fprintf(&sb, "%s:\n", image)
+		tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+		for _, r := range rows {
+			fmt.Fprint(tw, r.line)
+		}
+		// nolint[errcheck]
+		tw.Flush()
+		sb.WriteString("\n")
+	}
+
+	fmt.Fprintf(&sb, "Total: %d added, %d removed, %d changed\n",
+		len(d.Added), len(d.Removed), len(d.Changed))
+
+	return sb.String()
+}
+
+// diffImage returns the destination image of the edge, without any tag.
+func diffImage(edge PromotionEdge) string {
+	return string(edge.DstRegistry.Name) + "/" +
+		string(edge.DstImageTag.ImageName)
+}
+
+// diffDestination returns the destination repo:tag of the edge, or just the
+// repo for tagless promotions.
+func diffDestination(edge PromotionEdge) string {
+	if edge.DstImageTag.Tag == "" {
+		return string(edge.DstRegistry.Name) + "/" +
+			string(edge.DstImageTag.ImageName) + " (untagged)"
+	}
+	return ToPQIN(
+		edge.DstRegistry.Name,
+		edge.DstImageTag.ImageName,
+		edge.DstImageTag.Tag)
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func TestPromotionDiff(t *testing.T) {
+	src := reg.RegistryContext{Name: "gcr.io/src", Src: true}
+	dst1 := reg.RegistryContext{Name: "gcr.io/dst1"}
+	dst2 := reg.RegistryContext{Name: "gcr.io/dst2"}
+
+	mkEdge := func(
+		digest reg.Digest,
+		dst reg.RegistryContext,
+		image reg.ImageName,
+		tag reg.Tag) reg.PromotionEdge {
+		return reg.PromotionEdge{
+			SrcRegistry: src,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: dst,
+			DstImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name      string
+		edges     map[reg.PromotionEdge]interface{}
+		positions map[reg.ImageDigest]reg.SourcePosition
+		expected  string
+	}{
+		{
+			name:     "No edges",
+			edges:    map[reg.PromotionEdge]interface{}{},
+			expected: "Nothing to promote.\n",
+		},
+		{
+			name: "Edges grouped by destination registry",
+			edges: map[reg.PromotionEdge]interface{}{
+				// The same digest is only transferred once per registry.
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"):    nil,
+				mkEdge("sha256:aaa", dst1, "foo", "latest"): nil,
+				// The size of this digest is unknown.
+				mkEdge("sha256:bbb", dst1, "bar", ""): nil,
+				// dst2 already has this digest; only the tag is added.
+				mkEdge("sha256:aaa", dst2, "foo", "1.0"): nil,
+				mkEdge("sha256:ccc", dst2, "baz", "2.0"): nil,
+			},
+			expected: `gcr.io/dst1 (3 edges, 2.0 KiB):
+  DIGEST      DESTINATION                 SIZE
+  sha256:bbb  gcr.io/dst1/bar (untagged)  unknown
+  sha256:aaa  gcr.io/dst1/foo:1.0         2.0 KiB
+  sha256:aaa  gcr.io/dst1/foo:latest      -
+
+gcr.io/dst2 (2 edges, 100 B):
+  DIGEST      DESTINATION          SIZE
+  sha256:ccc  gcr.io/dst2/baz:2.0  100 B
+  sha256:aaa  gcr.io/dst2/foo:1.0  -
+
+Total: 5 edges to 2 registries, 2148 bytes (2.1 KiB) to transfer (images of unknown size: 1)
+`,
+		},
+		{
+			name: "Edges with their declarations",
+			edges: map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"): nil,
+				mkEdge("sha256:ccc", dst1, "baz", "2.0"): nil,
+			},
+			positions: map[reg.ImageDigest]reg.SourcePosition{
+				{ImageName: "foo", Digest: "sha256:aaa"}: {
+					File: "images/foo/images.yaml",
+					Line: 4,
+				},
+			},
+			expected: `gcr.io/dst1 (2 edges, 2.1 KiB):
+  DIGEST      DESTINATION          SIZE     DECLARED AT
+  sha256:ccc  gcr.io/dst1/baz:2.0  100 B    -
+  sha256:aaa  gcr.io/dst1/foo:1.0  2.0 KiB  images/foo/images.yaml:4
+
+Total: 2 edges to 1 registries, 2148 bytes (2.1 KiB) to transfer
+`,
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Inv: reg.MasterInventory{
+				"gcr.io/dst2": reg.RegInvImage{
+					"foo": reg.DigestTags{
+						"sha256:aaa": reg.TagSlice{"old"},
+					},
+				},
+			},
+			DigestImageSize: reg.DigestImageSize{
+				"sha256:aaa": 2048,
+				"sha256:ccc": 100,
+			},
+			Positions: test.positions,
+		}
+
+		got := sc.PromotionDiff(test.edges)
+		if got != test.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestGarbageCollectionDiff(t *testing.T) {
+	sc := reg.SyncContext{
+		DigestImageSize: reg.DigestImageSize{
+			"sha256:aaa": 2048,
+		},
+	}
+
+	var tests = []struct {
+		name       string
+		candidates []reg.PromotionRequest
+		expected   string
+	}{
+		{
+			name:       "No candidates",
+			candidates: []reg.PromotionRequest{},
+			expected:   "Nothing to garbage collect.\n",
+		},
+		{
+			name: "Candidates with known and unknown sizes",
+			candidates: []reg.PromotionRequest{
+				{
+					TagOp:         reg.Delete,
+					RegistryDest:  "gcr.io/dst1",
+					ImageNameDest: "foo",
+					Digest:        "sha256:aaa",
+				},
+				{
+					TagOp:         reg.Delete,
+					RegistryDest:  "gcr.io/dst1",
+					ImageNameDest: "bar",
+					Digest:        "sha256:bbb",
+				},
+			},
+			expected: `  DIGEST      IMAGE            SIZE
+  sha256:aaa  gcr.io/dst1/foo  2.0 KiB
+  sha256:bbb  gcr.io/dst1/bar  unknown
+Total: 2 untagged images, 2048 bytes (2.0 KiB) to delete (images of unknown size: 1)
+`,
+		},
+	}
+
+	for _, test := range tests {
+		got := sc.GarbageCollectionDiff(test.candidates)
+		if got != test.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestDiffPromotionEdges(t *testing.T) {
+	src := reg.RegistryContext{Name: "gcr.io/src", Src: true}
+	dst1 := reg.RegistryContext{Name: "gcr.io/dst1"}
+	dst2 := reg.RegistryContext{Name: "gcr.io/dst2"}
+
+	mkEdges := func(
+		edges ...reg.PromotionEdge) map[reg.PromotionEdge]interface{} {
+
+		m := make(map[reg.PromotionEdge]interface{})
+		for _, edge := range edges {
+			m[edge] = nil
+		}
+		return m
+	}
+	mkEdge := func(
+		digest reg.Digest,
+		dst reg.RegistryContext,
+		image reg.ImageName,
+		tag reg.Tag) reg.PromotionEdge {
+		return reg.PromotionEdge{
+			SrcRegistry: src,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: dst,
+			DstImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		old      map[reg.PromotionEdge]interface{}
+		new      map[reg.PromotionEdge]interface{}
+		expected reg.ManifestDiff
+		rendered string
+	}{
+		{
+			name: "No changes",
+			old:  mkEdges(mkEdge("sha256:aaa", dst1, "foo", "1.0")),
+			// Only the destination matters.
+			new: mkEdges(reg.PromotionEdge{
+				SrcRegistry: reg.RegistryContext{
+					Name:           "gcr.io/src",
+					ServiceAccount: "robot",
+					Src:            true,
+				},
+				SrcImageTag: reg.ImageTag{ImageName: "foo", Tag: "1.0"},
+				Digest:      "sha256:aaa",
+				DstRegistry: dst1,
+				DstImageTag: reg.ImageTag{ImageName: "foo", Tag: "1.0"},
+			}),
+			expected: reg.ManifestDiff{},
+			rendered: "No changes.\n",
+		},
+		{
+			name: "Additions",
+			old:  mkEdges(mkEdge("sha256:aaa", dst1, "foo", "1.0")),
+			new: mkEdges(
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"),
+				mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+				// The same image, promoted to another registry.
+				mkEdge("sha256:aaa", dst2, "foo", "1.0"),
+				mkEdge("sha256:ccc", dst1, "bar", "")),
+			expected: reg.ManifestDiff{
+				Added: []reg.PromotionEdge{
+					mkEdge("sha256:ccc", dst1, "bar", ""),
+					mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+					mkEdge("sha256:aaa", dst2, "foo", "1.0"),
+				},
+			},
+			rendered: `gcr.io/dst1/bar:
+  +  (untagged)  sha256:ccc
+
+gcr.io/dst1/foo:
+  +  1.1  sha256:bbb
+
+gcr.io/dst2/foo:
+  +  1.0  sha256:aaa
+
+Total: 3 added, 0 removed, 0 changed
+`,
+		},
+		{
+			name: "Removals",
+			old: mkEdges(
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"),
+				mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+				mkEdge("sha256:ccc", dst1, "bar", ""),
+				mkEdge("sha256:ddd", dst1, "bar", "")),
+			new: mkEdges(
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"),
+				mkEdge("sha256:ddd", dst1, "bar", "")),
+			expected: reg.ManifestDiff{
+				Removed: []reg.PromotionEdge{
+					mkEdge("sha256:ccc", dst1, "bar", ""),
+					mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+				},
+			},
+			rendered: `gcr.io/dst1/bar:
+  -  (untagged)  sha256:ccc
+
+gcr.io/dst1/foo:
+  -  1.1  sha256:bbb
+
+Total: 0 added, 2 removed, 0 changed
+`,
+		},
+		{
+			name: "Digest changes",
+			old: mkEdges(
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"),
+				mkEdge("sha256:aaa", dst1, "foo", "latest")),
+			new: mkEdges(
+				mkEdge("sha256:aaa", dst1, "foo", "1.0"),
+				mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+				mkEdge("sha256:bbb", dst1, "foo", "latest")),
+			expected: reg.ManifestDiff{
+				Added: []reg.PromotionEdge{
+					mkEdge("sha256:bbb", dst1, "foo", "1.1"),
+				},
+				Changed: []reg.ChangedEdge{
+					{
+						Old: mkEdge("sha256:aaa", dst1, "foo", "latest"),
+						New: mkEdge("sha256:bbb", dst1, "foo", "latest"),
+					},
+				},
+			},
+			rendered: `gcr.io/dst1/foo:
+  +  1.1     sha256:bbb
+  ~  latest  sha256:aaa -> sha256:bbb
+
+Total: 1 added, 0 removed, 1 changed
+`,
+		},
+	}
+
+	for _, test := range tests {
+		got := reg.DiffPromotionEdges(test.old, test.new)
+		err := checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %q\n", test.name))
+
+		if got.String() != test.rendered {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s",
+				test.name, test.rendered, got.String())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// dockerHubAPI is the endpoint of the Docker Hub API, which (unlike the
+// registry API) can list the repositories in a namespace.
+const dockerHubAPI = "https://hub.docker.com/v2"
+
+// IsDockerHubDomain returns true if the given hostname belongs to Docker Hub.
+func IsDockerHubDomain(domain string) bool {
+	switch domain {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+	return false
+}
+
+// dockerHubClient is the RegistryClient for Docker Hub. Docker Hub registries
+// are named after the Docker Hub namespace (organization or user), e.g.
+// "docker.io/myorg". Images are read with the standard Docker Registry HTTP
+// API V2; the exchange of the Docker Hub credentials for a registry token is
+// done transparently by go-containerregistry.
+type dockerHubClient struct{}
+
+// GetToken reads the Docker Hub access token from the environment, if
+// credentials are configured for the registry.
+func (c *dockerHubClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	return getBasicAuthToken(rc)
+}
+
+// ListTags creates a stream.Producer which reads the repository
+// with the standard registry API. The repositories of the namespace are
+// listed with the Docker Hub API.
+func (c *dockerHubClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	r := registryV2Reader{
+		RegistryName: rc.Name,
+		Options:      c.RemoteOptions(sc, rc),
+	}
+
+	if sc.isToplevelRegistry(rc.Name) {
+		_, _, namespace := GetTokenKeyDomainRepoPath(rc.Name)
+		rc = sc.toplevelRegistryContext(rc)
+		username := rc.Username
+		var password gcloud.Token
+		if len(username) > 0 {
+			password = sc.getToken(rc)
+		}
+		r.ListChildren = func() ([]string, error) {
+			return listDockerHubRepositories(
+				&http.Client{Transport: sc.transport()},
+				namespace,
+				username,
+				password)
+		}
+	}
+
+	return &r
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest list (or
+// OCI image index) by digest with the standard registry API.
+func (c *dockerHubClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage copies the image into the registry.
+func (c *dockerHubClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions authenticates with the Docker Hub username and access token,
+// if configured. Otherwise the default keychain is used.
+func (c *dockerHubClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	return sc.basicAuthOptions(rc)
+}
+
+// dockerHubRepositories is a single page of the Docker Hub API's list of
+// repositories.
+type dockerHubRepositories struct {
+	Next    string `json:"next"`
+	Results []struct {
+		Name string `json:"name"`
+	} `json:"results"`
+}
+
+// listDockerHubRepositories lists the names of all repositories in the given
+// Docker Hub namespace. If a username is given, private repositories are
+// listed as well.
+func listDockerHubRepositories(
+	client *http.Client,
+	namespace string,
+	username string,
+	password gcloud.Token) ([]string, error) {
+
+	var authorization string
+	if len(username) > 0 {
+		jwt, err := loginDockerHub(username, password)
+		if err != nil {
+			return nil, err
+		}
+		authorization = "JWT " + jwt
+	}
+
+	names := []string{}
+	endpoint := fmt.Sprintf(
+		"%s/repositories/%s/?page_size=100",
+		dockerHubAPI,
+		namespace)
+
+	for len(endpoint) > 0 {
+		httpReq, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(authorization) > 0 {
+			httpReq.Header.Add("Authorization", authorization)
+		}
+
+		var page dockerHubRepositories
+		if err := doJSONRequest(client, httpReq, &page); err != nil {
+			return nil, err
+		}
+
+		for _, result := range page.Results {
+			names = append(names, result.Name)
+		}
+		endpoint = page.Next
+	}
+
+	return names, nil
+}
+
+// loginDockerHub exchanges the Docker Hub credentials for a JWT, which is
+// required by the Docker Hub API (the registry API uses a different token).
+func loginDockerHub(username string, password gcloud.Token) (string, error) {
+	b, err := json.Marshal(map[string]string{
+		"username": username,
+		"password": string(password),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequest(
+		"POST",
+		dockerHubAPI+"/users/login/",
+		bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Add("Content-Type", "application/json")
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := doJSONRequest(defaultRetryClient, httpReq, &login); err != nil {
+		// Do not wrap the error with the request body, as it contains the
+		// password.
+		return "", fmt.Errorf("could not log in to Docker Hub as %s: %v",
+			username,
+			err)
+	}
+
+	return login.Token, nil
+}
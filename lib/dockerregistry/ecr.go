@@ -0,0 +1,126 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/aws"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// ecrDomain matches the hostname of an ECR registry, e.g.
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com". The region is captured.
+var ecrDomain = regexp.MustCompile(
+	`^[0-9]{12}\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ParseECRDomain returns the AWS region of the given ECR registry hostname.
+// The boolean is false if the hostname does not belong to ECR.
+func ParseECRDomain(domain string) (string, bool) {
+	m := ecrDomain.FindStringSubmatch(strings.ToLower(domain))
+	if m == nil {
+		return "", false
+	}
+	return m[2], true
+}
+
+// ecrClient is the RegistryClient for AWS Elastic Container Registry. ECR
+// implements the standard Docker Registry HTTP API V2, and authenticates
+// with a short-lived token obtained through the AWS SDK credential chain.
+type ecrClient struct{}
+
+// GetToken gets an ECR authorization token with the aws CLI. A token is
+// always required, regardless of useServiceAccount (which only applies to
+// GCP service accounts).
+func (c *ecrClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	domain := strings.Split(string(rc.Name), "/")[0]
+	region, _ := ParseECRDomain(domain)
+	token, err := aws.GetECRToken(region)
+	return gcloud.Token(token), err
+}
+
+// ListTags creates a stream.Producer which reads the repository
+// with the standard registry API.
+func (c *ecrClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	r := registryV2Reader{
+		RegistryName: rc.Name,
+		Options:      c.RemoteOptions(sc, rc),
+	}
+
+	if sc.isToplevelRegistry(rc.Name) {
+		_, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
+		region, _ := ParseECRDomain(domain)
+		// The registry ID is the AWS account ID.
+		registryID := strings.Split(domain, ".")[0]
+		r.ListChildren = func() ([]string, error) {
+			repos, err := aws.ListECRRepositories(region, registryID)
+			if err != nil {
+				return nil, err
+			}
+			return childRepos(repos, repoPath), nil
+		}
+	}
+
+	return &r
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest list (or
+// OCI image index) by digest with the standard registry API.
+func (c *ecrClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage copies the image into the registry.
+func (c *ecrClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions authenticates with the ECR token as a basic auth password.
+// Failed reads are retried (see sc.transport()).
+func (c *ecrClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	return []ggcrV1Remote.Option{
+		ggcrV1Remote.WithAuth(&authn.Basic{
+			Username: aws.ECRUsername,
+			Password: string(sc.getToken(rc)),
+		}),
+		sc.transportOption(),
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// validEnvName matches the names of the environment variables that manifests
+// can reference (see expandEnv()).
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv expands the "${NAME}" references in s to the values of the
+// environment variables NAME, which must be set (possibly to the empty
+// string). "$$" stands for a literal "$", and any other "$" is kept as is.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf(
+					"unterminated variable reference in %q", s)
+			}
+			name := s[i+2 : i+2+end]
+			if !validEnvName.MatchString(name) {
+				return "", fmt.Errorf(
+					"invalid variable name %q in %q", name, s)
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf(
+					"environment variable %s referenced in %q is not set",
+					name, s)
+			}
+			sb.WriteString(value)
+			i += 2 + end
+		default:
+			sb.WriteByte('$')
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// expandRegistryEnv expands the environment variable references (see
+// expandEnv()) in the string fields of the registries, so that one manifest
+// can be used for several environments (e.g. with the registry name
+// "gcr.io/${PROJECT}"). The images are never expanded.
+func expandRegistryEnv(registries []RegistryContext) error {
+	for i := range registries {
+		rc := &registries[i]
+
+		name, err := expandEnv(string(rc.Name))
+		if err != nil {
+			return fmt.Errorf("registries: %v", err)
+		}
+		rc.Name = RegistryName(name)
+
+		for _, field := range []*string{
+			&rc.ServiceAccount,
+			&rc.Username,
+			&rc.TokenEnv,
+			&rc.CredentialsFile,
+			&rc.Path,
+		} {
+			value, err := expandEnv(*field)
+			if err != nil {
+				return fmt.Errorf("registries: %v", err)
+			}
+			*field = value
+		}
+	}
+
+	return nil
+}
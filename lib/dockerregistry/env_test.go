@@ -0,0 +1,140 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func TestParseManifestYAMLEnv(t *testing.T) {
+	os.Setenv("CIP_TEST_ENV", "staging")
+	os.Setenv("CIP_TEST_EMPTY", "")
+	os.Unsetenv("CIP_TEST_UNSET")
+	defer os.Unsetenv("CIP_TEST_ENV")
+	defer os.Unsetenv("CIP_TEST_EMPTY")
+
+	mkInput := func(name, serviceAccount string) string {
+		return fmt.Sprintf(`registries:
+- name: %s
+  service-account: %s
+- name: gcr.io/foo
+  src: true
+images:
+- name: "${CIP_TEST_ENV}"
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+`, name, serviceAccount)
+	}
+	mkManifest := func(
+		name reg.RegistryName,
+		serviceAccount string) reg.Manifest {
+
+		return reg.Manifest{
+			Registries: []reg.RegistryContext{
+				{
+					Name:           name,
+					ServiceAccount: serviceAccount,
+				},
+				{
+					Name: "gcr.io/foo",
+					Src:  true,
+				},
+			},
+			Images: []reg.Image{
+				{
+					// Images are never expanded.
+					ImageName: "${CIP_TEST_ENV}",
+					Dmap: reg.DigestTags{
+						"sha256:0000000000000000000000000000000000000000000000000000000000000000": {"1.0"},
+					},
+				},
+			},
+		}
+	}
+
+	var tests = []struct {
+		name           string
+		input          string
+		expectedOutput reg.Manifest
+		expectedError  error
+	}{
+		{
+			"Set variables",
+			mkInput(
+				"gcr.io/k8s-${CIP_TEST_ENV}",
+				"robot${CIP_TEST_EMPTY}@${CIP_TEST_ENV}.iam.gserviceaccount.com"),
+			mkManifest(
+				"gcr.io/k8s-staging",
+				"robot@staging.iam.gserviceaccount.com"),
+			nil,
+		},
+		{
+			"Unset variable",
+			mkInput("gcr.io/k8s-${CIP_TEST_UNSET}", "robot"),
+			reg.Manifest{},
+			fmt.Errorf("registries: environment variable CIP_TEST_UNSET " +
+				`referenced in "gcr.io/k8s-${CIP_TEST_UNSET}" is not set`),
+		},
+		{
+			"Escaped dollar signs",
+			mkInput("gcr.io/bar", "robot$$${CIP_TEST_ENV}$$1$"),
+			mkManifest("gcr.io/bar", "robot$staging$1$"),
+			nil,
+		},
+		{
+			"Unterminated reference",
+			mkInput("gcr.io/bar", "robot-${CIP_TEST_ENV"),
+			reg.Manifest{},
+			fmt.Errorf("registries: unterminated variable reference in " +
+				`"robot-${CIP_TEST_ENV"`),
+		},
+		{
+			"Invalid variable name",
+			mkInput("gcr.io/bar", "robot-${CIP-TEST}"),
+			reg.Manifest{},
+			fmt.Errorf("registries: invalid variable name \"CIP-TEST\" in " +
+				`"robot-${CIP-TEST}"`),
+		},
+	}
+
+	for _, test := range tests {
+		got, err := reg.ParseManifestYAML([]byte(test.input))
+
+		eqErr := checkEqual(err, test.expectedError)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (error)\n", test.name))
+		if test.expectedError != nil {
+			continue
+		}
+
+		eqErr = checkEqual(got, test.expectedOutput)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (Manifest)\n", test.name))
+	}
+
+	// Thin manifests are expanded as well.
+	thin, err := reg.ParseThinManifestYAML([]byte(`registries:
+- name: gcr.io/k8s-${CIP_TEST_ENV}
+  src: true
+`))
+	checkError(t, err, "unexpected error parsing thin manifest\n")
+	eqErr := checkEqual(thin.Registries[0].Name, reg.RegistryName(
+		"gcr.io/k8s-staging"))
+	checkError(t, eqErr, "unexpected thin manifest registry\n")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorCode is the category of an error returned by the checks or by the
+// promotion, so that callers can handle the failures programmatically (see
+// CodeOf()).
+type ErrorCode string
+
+const (
+	// CodeUnknown is the code of the errors which are not categorized.
+	CodeUnknown ErrorCode = "unknown"
+	// CodeCanceled is the code of the errors caused by a canceled context, or
+	// by a timeout.
+	CodeCanceled ErrorCode = "canceled"
+	// CodeAuth is the code of the errors caused by missing or insufficient
+	// credentials for a registry (e.g. TokenError).
+	CodeAuth ErrorCode = "auth"
+	// CodeNotFound is the code of the errors caused by a missing repository,
+	// image or layer.
+	CodeNotFound ErrorCode = "not-found"
+	// CodeRateLimited is the code of the errors caused by a registry refusing
+	// too many requests.
+	CodeRateLimited ErrorCode = "rate-limited"
+	// CodeInvalidManifest is the code of the errors caused by inconsistent
+	// manifests (DigestFormatError, DuplicateImageError, SourceDigestError,
+	// SourceRegistryFlagError).
+	CodeInvalidManifest ErrorCode = "invalid-manifest"
+	// CodeSizeExceeded is the code of ImageSizeError and TotalSizeError.
+	CodeSizeExceeded ErrorCode = "size-exceeded"
+	// CodeRemovalDetected is the code of ImageRemovalError.
+	CodeRemovalDetected ErrorCode = "removal-detected"
+	// CodeTagMoved is the code of TagImmutabilityError.
+	CodeTagMoved ErrorCode = "tag-moved"
+	// CodeVulnerable is the code of VulnerabilityError.
+	CodeVulnerable ErrorCode = "vulnerable"
+	// CodeUnsigned is the code of SignatureError.
+	CodeUnsigned ErrorCode = "unsigned"
+	// CodePolicyViolation is the code of the errors of the checks which
+	// enforce a policy on the images to promote (BlockedSourceError,
+	// DigestAllowlistError, FloatingTagError, MaxTagsPerImageError,
+	// SourceRegistryError, TagPatternError).
+	CodePolicyViolation ErrorCode = "policy-violation"
+	// CodeChecksFailed is the code of a PreCheckErrors whose errors have
+	// different codes.
+	CodeChecksFailed ErrorCode = "checks-failed"
+	// CodePromotionFailed is the code of the errors of the promotion step
+	// whose failed requests have different (or unknown) codes.
+	CodePromotionFailed ErrorCode = "promotion-failed"
+)
+
+// CodedError is an error with an ErrorCode.
+type CodedError interface {
+	error
+	Code() ErrorCode
+}
+
+// CodeOf returns the code of err, which is:
+//
+//   - the code of the first error of its chain which is a CodedError, if any,
+//   - CodeCanceled for context.Canceled and context.DeadlineExceeded,
+//   - CodeAuth, CodeNotFound or CodeRateLimited for the matching registry
+//     errors (transport.Error),
+//   - CodeUnknown otherwise, or "" if err is nil.
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return CodeCanceled
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return transportErrorCode(terr)
+	}
+
+	return CodeUnknown
+}
+
+// transportErrorCode returns the code of an error response of a registry.
+func transportErrorCode(terr *transport.Error) ErrorCode {
+	switch terr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return CodeAuth
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	}
+
+	for _, diagnostic := range terr.Errors {
+		switch diagnostic.Code {
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return CodeAuth
+		case transport.ManifestUnknownErrorCode,
+			transport.NameUnknownErrorCode,
+			transport.BlobUnknownErrorCode:
+			return CodeNotFound
+		}
+	}
+
+	return CodeUnknown
+}
+
+// commonCode returns the code shared by all the errors, or fallback if their
+// codes differ (or are unknown).
+func commonCode(errs []error, fallback ErrorCode) ErrorCode {
+	var code ErrorCode
+	for _, err := range errs {
+		c := CodeOf(err)
+		if c == CodeUnknown || (code != "" && c != code) {
+			return fallback
+		}
+		code = c
+	}
+	if code == "" {
+		return fallback
+	}
+	return code
+}
+
+// Error implements the error interface.
+func (err PreCheckErrors) Error() string {
+	return fmt.Sprintf("%v error(s) encountered during the prechecks",
+		len(err.Errors))
+}
+
+// Code implements CodedError: it is the code of the errors of the checks if
+// they all have the same one, or CodeChecksFailed.
+func (err PreCheckErrors) Code() ErrorCode {
+	return commonCode(err.Errors, CodeChecksFailed)
+}
+
+// Error implements the error interface.
+func (err RequestErrors) Error() string {
+	return "Encountered an error during the promotion step"
+}
+
+// Code implements CodedError: it is the code of the errors of the requests if
+// they all have the same one (e.g. CodeAuth, if the credentials for the
+// destination registry are wrong), or CodePromotionFailed.
+func (err RequestErrors) Code() ErrorCode {
+	errs := make([]error, 0, len(err.Errors))
+	for _, e := range err.Errors {
+		errs = append(errs, e.Error)
+	}
+	return commonCode(errs, CodePromotionFailed)
+}
+
+// Error implements the error interface.
+func (err TokenError) Error() string {
+	return fmt.Sprintf("could not get access token for %v: %v",
+		err.Registry, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err TokenError) Unwrap() error {
+	return err.Err
+}
+
+// Code implements CodedError.
+func (err TokenError) Code() ErrorCode {
+	return CodeAuth
+}
+
+// Code implements CodedError.
+func (err PromotionFailures) Code() ErrorCode {
+	return CodePromotionFailed
+}
+
+// Code implements CodedError.
+func (err ImageSizeError) Code() ErrorCode {
+	return CodeSizeExceeded
+}
+
+// Code implements CodedError.
+func (err TotalSizeError) Code() ErrorCode {
+	return CodeSizeExceeded
+}
+
+// Code implements CodedError.
+func (err ImageRemovalError) Code() ErrorCode {
+	return CodeRemovalDetected
+}
+
+// Code implements CodedError.
+func (err TagImmutabilityError) Code() ErrorCode {
+	return CodeTagMoved
+}
+
+// Code implements CodedError.
+func (err VulnerabilityError) Code() ErrorCode {
+	return CodeVulnerable
+}
+
+// Code implements CodedError.
+func (err SignatureError) Code() ErrorCode {
+	return CodeUnsigned
+}
+
+// Code implements CodedError.
+func (err DigestFormatError) Code() ErrorCode {
+	return CodeInvalidManifest
+}
+
+// Code implements CodedError.
+func (err SourceDigestError) Code() ErrorCode {
+	return CodeInvalidManifest
+}
+
+// Code implements CodedError.
+func (err DuplicateImageError) Code() ErrorCode {
+	return CodeInvalidManifest
+}
+
+// Code implements CodedError.
+func (err SourceRegistryFlagError) Code() ErrorCode {
+	return CodeInvalidManifest
+}
+
+// Code implements CodedError.
+func (err BlockedSourceError) Code() ErrorCode {
+	return CodePolicyViolation
+}
+
+// Code implements CodedError.
+func (err DigestAllowlistError) Code() ErrorCode {
+	return CodePolicyViolation
+}
+
+// Code implements CodedError.
+func (err FloatingTagError) Code() ErrorCode {
+	return CodePolicyViolation
+}
+
+// Code implements CodedError.
+func (err MaxTagsPerImageError) Code() ErrorCode {
+	return CodePolicyViolation
+}
+
+// Code implements CodedError.
+func (err SourceRegistryError) Code() ErrorCode {
+	return CodePolicyViolation
+}
+
+// Code implements CodedError.
+func (err TagPatternError) Code() ErrorCode {
+	return CodePolicyViolation
+}
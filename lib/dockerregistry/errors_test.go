@@ -0,0 +1,225 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func TestCodeOf(t *testing.T) {
+	sizeErr := reg.ImageSizeError{MaxImageSize: 1}
+	removalErr := reg.ImageRemovalError{[]reg.ImageName{"a"}}
+	authErr := &transport.Error{StatusCode: http.StatusForbidden}
+
+	var tests = []struct {
+		name     string
+		err      error
+		expected reg.ErrorCode
+	}{
+		{
+			"No error",
+			nil,
+			"",
+		},
+		{
+			"Uncategorized error",
+			fmt.Errorf("something went wrong"),
+			reg.CodeUnknown,
+		},
+		{
+			"Image size",
+			sizeErr,
+			reg.CodeSizeExceeded,
+		},
+		{
+			"Total size",
+			reg.TotalSizeError{MaxTotalSize: 1, TotalSize: 2 << 20},
+			reg.CodeSizeExceeded,
+		},
+		{
+			"Wrapped image removal",
+			fmt.Errorf("checking manifests: %w", removalErr),
+			reg.CodeRemovalDetected,
+		},
+		{
+			"Moved tag",
+			reg.TagImmutabilityError{[]string{"gcr.io/bar/a:1.0"}},
+			reg.CodeTagMoved,
+		},
+		{
+			"Floating tag",
+			reg.FloatingTagError{},
+			reg.CodePolicyViolation,
+		},
+		{
+			"Duplicate image",
+			reg.DuplicateImageError{},
+			reg.CodeInvalidManifest,
+		},
+		{
+			"Missing source digest",
+			reg.SourceDigestError{},
+			reg.CodeInvalidManifest,
+		},
+		{
+			"Canceled",
+			fmt.Errorf("reading registries: %w", context.Canceled),
+			reg.CodeCanceled,
+		},
+		{
+			"Timeout",
+			context.DeadlineExceeded,
+			reg.CodeCanceled,
+		},
+		{
+			"Registry denies access",
+			fmt.Errorf("copying image: %w", authErr),
+			reg.CodeAuth,
+		},
+		{
+			"Registry requires credentials",
+			&transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors: []transport.Diagnostic{
+					{Code: transport.UnauthorizedErrorCode},
+				},
+			},
+			reg.CodeAuth,
+		},
+		{
+			"Missing image",
+			&transport.Error{StatusCode: http.StatusNotFound},
+			reg.CodeNotFound,
+		},
+		{
+			"Missing manifest",
+			&transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors: []transport.Diagnostic{
+					{Code: transport.ManifestUnknownErrorCode},
+				},
+			},
+			reg.CodeNotFound,
+		},
+		{
+			"Rate limited",
+			&transport.Error{StatusCode: http.StatusTooManyRequests},
+			reg.CodeRateLimited,
+		},
+		{
+			"Other registry error",
+			&transport.Error{StatusCode: http.StatusInternalServerError},
+			reg.CodeUnknown,
+		},
+		{
+			"Checks with the same code",
+			reg.PreCheckErrors{[]error{sizeErr, reg.TotalSizeError{}}},
+			reg.CodeSizeExceeded,
+		},
+		{
+			"Checks with different codes",
+			reg.PreCheckErrors{[]error{sizeErr, removalErr}},
+			reg.CodeChecksFailed,
+		},
+		{
+			"Check with an uncategorized error",
+			reg.PreCheckErrors{[]error{fmt.Errorf("something went wrong")}},
+			reg.CodeChecksFailed,
+		},
+		{
+			"Requests with the same code",
+			reg.RequestErrors{reg.Errors{
+				{Context: "copy a", Error: authErr},
+				{Context: "copy b", Error: authErr},
+			}},
+			reg.CodeAuth,
+		},
+		{
+			"Requests with different codes",
+			reg.RequestErrors{reg.Errors{
+				{Context: "copy a", Error: authErr},
+				{Context: "copy b", Error: fmt.Errorf("exit status 1")},
+			}},
+			reg.CodePromotionFailed,
+		},
+		{
+			"Promotion failures",
+			reg.PromotionFailures{},
+			reg.CodePromotionFailed,
+		},
+	}
+
+	for _, test := range tests {
+		got := reg.CodeOf(test.err)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (CodeOf)\n", test.name))
+	}
+}
+
+func TestCheckErrorCodes(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mkEdges := func(images ...reg.Image) map[reg.PromotionEdge]interface{} {
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{{
+			Registries:  []reg.RegistryContext{destRC, srcRC},
+			Images:      images,
+			SrcRegistry: &srcRC,
+		}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return edges
+	}
+
+	master := mkEdges(
+		reg.Image{
+			ImageName: "a",
+			Dmap:      reg.DigestTags{"sha256:000": {"1.0"}},
+		},
+		reg.Image{
+			ImageName: "b",
+			Dmap:      reg.DigestTags{"sha256:111": {"1.0"}},
+		})
+	pull := mkEdges(reg.Image{
+		ImageName: "a",
+		Dmap:      reg.DigestTags{"sha256:222": {"1.0"}},
+	})
+
+	removalCheck := reg.ImageRemovalCheck{}
+	got := reg.CodeOf(removalCheck.Compare(master, pull))
+	checkError(t, checkEqual(got, reg.CodeRemovalDetected),
+		"checkError: test: ImageRemovalCheck code\n")
+
+	immutabilityCheck := reg.TagImmutabilityCheck{}
+	got = reg.CodeOf(immutabilityCheck.Compare(master, pull))
+	checkError(t, checkEqual(got, reg.CodeTagMoved),
+		"checkError: test: TagImmutabilityCheck code\n")
+}
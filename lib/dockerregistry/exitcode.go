@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"errors"
+)
+
+// The exit codes of cip, which callers (e.g. CI jobs) can branch on. They are
+// derived from the error that ends the run (see ExitCodeOf()).
+const (
+	// ExitSuccess is the exit code of a successful run.
+	ExitSuccess = 0
+	// ExitFailure is the exit code of a run that failed with an error which
+	// has no more specific exit code, e.g. an invalid flag, or a registry
+	// that could not be read.
+	ExitFailure = 1
+	// ExitChecksFailed is the exit code of a run whose checks failed (e.g.
+	// an image would be removed, or is too large), or whose manifests are
+	// inconsistent.
+	ExitChecksFailed = 2
+	// ExitAuth is the exit code of a run that failed because of missing or
+	// insufficient credentials for a registry.
+	ExitAuth = 3
+	// ExitPartialFailure is the exit code of a run with -keep-going in which
+	// some promotions failed, after every promotion was attempted.
+	ExitPartialFailure = 4
+	// ExitCanceled is the exit code of a run that was interrupted, or that
+	// timed out.
+	ExitCanceled = 5
+)
+
+// ExitCodeOf returns the exit code of a run that ended with err (nil for a
+// successful run), which is derived from its error code (see CodeOf()).
+func ExitCodeOf(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+
+	var failures PromotionFailures
+	if errors.As(err, &failures) {
+		return ExitPartialFailure
+	}
+
+	switch CodeOf(err) {
+	case CodeAuth:
+		return ExitAuth
+	case CodeCanceled:
+		return ExitCanceled
+	case CodeChecksFailed,
+		CodeInvalidManifest,
+		CodePolicyViolation,
+		CodeRemovalDetected,
+		CodeSizeExceeded,
+		CodeTagMoved,
+		CodeUnsigned,
+		CodeVulnerable:
+		return ExitChecksFailed
+	}
+	return ExitFailure
+}
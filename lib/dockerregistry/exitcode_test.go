@@ -0,0 +1,273 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+func TestExitCodeOf(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{
+			"Success",
+			nil,
+			reg.ExitSuccess,
+		},
+		{
+			"Uncategorized error",
+			fmt.Errorf("something went wrong"),
+			reg.ExitFailure,
+		},
+		{
+			"Failed checks",
+			reg.PreCheckErrors{Errors: []error{
+				reg.ImageSizeError{MaxImageSize: 1},
+				reg.ImageRemovalError{[]reg.ImageName{"a"}},
+			}},
+			reg.ExitChecksFailed,
+		},
+		{
+			"Invalid manifest",
+			reg.SourceRegistryFlagError{},
+			reg.ExitChecksFailed,
+		},
+		{
+			"Missing credentials",
+			reg.TokenError{
+				Registry: "gcr.io/foo",
+				Err:      fmt.Errorf("no credentials"),
+			},
+			reg.ExitAuth,
+		},
+		{
+			"Denied promotions",
+			reg.RequestErrors{reg.Errors{
+				{
+					Context: "running writeImage()",
+					Error: &transport.Error{
+						StatusCode: http.StatusForbidden,
+					},
+				},
+			}},
+			reg.ExitAuth,
+		},
+		{
+			"Failed promotions",
+			reg.RequestErrors{reg.Errors{
+				{
+					Context: "running writeImage()",
+					Error:   fmt.Errorf("copy failed"),
+				},
+			}},
+			reg.ExitFailure,
+		},
+		{
+			"Failed promotions with KeepGoing",
+			reg.PromotionFailures{},
+			reg.ExitPartialFailure,
+		},
+		{
+			"Timed out",
+			fmt.Errorf("reading registries: %w", context.DeadlineExceeded),
+			reg.ExitCanceled,
+		},
+	}
+
+	for _, test := range tests {
+		eqErr := checkEqual(reg.ExitCodeOf(test.err), test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+// TestExitCodeOfRuns checks the exit codes of the errors that the steps of a
+// run of cip return.
+func TestExitCodeOfRuns(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mkManifest := func(tag reg.Tag) reg.Manifest {
+		return reg.Manifest{
+			Registries: []reg.RegistryContext{srcRC, destRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"1.0"},
+						"sha256:111": {tag},
+					},
+				},
+			},
+			SrcRegistry: &srcRC,
+		}
+	}
+	mfest := mkManifest("2.0")
+
+	// Checks: "1.0" points to two digests.
+	sc := reg.SyncContext{}
+	err := sc.RunChecks(context.Background(), []reg.PreCheck{
+		reg.MKRealDuplicateImageCheck(
+			[]reg.Manifest{mfest, mkManifest("1.0")}),
+	})
+	eqErr := checkEqual(reg.ExitCodeOf(err), reg.ExitChecksFailed)
+	checkError(t, eqErr, "checkError: test: checks\n")
+
+	// Credentials: the credentials file does not exist.
+	tmpDir, err := ioutil.TempDir("", "exitcode")
+	checkError(t, err, "unexpected error creating temp dir\n")
+	defer os.RemoveAll(tmpDir)
+	sc = reg.SyncContext{
+		RegistryContexts: []reg.RegistryContext{{
+			Name:            "registry.example.com/foo",
+			CredentialsFile: filepath.Join(tmpDir, "missing.json"),
+		}},
+		Tokens: make(map[reg.RootRepo]gcloud.Token),
+	}
+	err = sc.PopulateTokens()
+	eqErr = checkEqual(reg.ExitCodeOf(err), reg.ExitAuth)
+	checkError(t, eqErr, "checkError: test: credentials\n")
+
+	// Promotion: the "2.0" tag fails with copyErr.
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+	mkProcessRequest := func(copyErr error) reg.ProcessRequest {
+		return func(
+			sc *reg.SyncContext,
+			reqs chan stream.ExternalRequest,
+			requestResults chan<- reg.RequestResult,
+			wg *sync.WaitGroup,
+			mutex *sync.Mutex) {
+
+			for req := range reqs {
+				reqRes := reg.RequestResult{Context: req}
+				pr := req.RequestParams.(reg.PromotionRequest)
+				if pr.Tag == "2.0" && copyErr != nil {
+					reqRes.Errors = reg.Errors{
+						{
+							Context: "running writeImage()",
+							Error:   copyErr,
+						},
+					}
+				}
+				requestResults <- reqRes
+			}
+		}
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var tests = []struct {
+		name      string
+		ctx       context.Context
+		copyErr   error
+		keepGoing bool
+		expected  int
+	}{
+		{
+			"Promoted",
+			context.Background(),
+			nil,
+			false,
+			reg.ExitSuccess,
+		},
+		{
+			"Copy failed",
+			context.Background(),
+			fmt.Errorf("copy failed"),
+			false,
+			reg.ExitFailure,
+		},
+		{
+			"Copy denied",
+			context.Background(),
+			&transport.Error{StatusCode: http.StatusUnauthorized},
+			false,
+			reg.ExitAuth,
+		},
+		{
+			"Copy failed with KeepGoing",
+			context.Background(),
+			fmt.Errorf("copy failed"),
+			true,
+			reg.ExitPartialFailure,
+		},
+		{
+			"Canceled",
+			canceled,
+			nil,
+			false,
+			reg.ExitCanceled,
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Inv: reg.MasterInventory{
+				"gcr.io/foo": {
+					"a": {
+						"sha256:000": {"1.0"},
+						"sha256:111": {"2.0"},
+					},
+				},
+				"gcr.io/bar": {},
+			},
+			DigestImageSize: reg.DigestImageSize{},
+			KeepGoing:       test.keepGoing,
+		}
+
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
+		edges, _ = sc.FilterPromotionEdges(test.ctx, edges, false)
+
+		processRequest := mkProcessRequest(test.copyErr)
+		_, err = sc.Promote(test.ctx, edges, nopStream, &processRequest)
+		eqErr := checkEqual(reg.ExitCodeOf(err), test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (%v)\n",
+			test.name, err))
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"net/http"
+
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// gcrClient is the RegistryClient for Google Container Registry.
+type gcrClient struct{}
+
+// GetToken gets a service account token with gcloud, if service accounts are
+// in use.
+func (c *gcrClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	if !useServiceAccount {
+		return "", nil
+	}
+	return gcloud.GetServiceAccountToken(rc.ServiceAccount, useServiceAccount)
+}
+
+// ListTags creates a stream.Producer which reads the repository
+// with GCR's "tags/list" endpoint.
+func (c *gcrClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	var sh stream.HTTP
+
+	tokenKey, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
+
+	httpReq, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("https://%s/v2/%s/tags/list", domain, repoPath),
+		nil)
+
+	if err != nil {
+		klog.Fatalf(
+			"could not create HTTP request for '%s/%s'",
+			domain,
+			repoPath)
+	}
+
+	if sc.UseServiceAccount || sc.hasCredentialsFile(rc) {
+		token, ok := sc.Tokens[RootRepo(tokenKey)]
+		if !ok {
+			klog.Exitf("access token for key '%s' not found\n", tokenKey)
+		}
+
+		rc.Token = token
+		var bearer = "Bearer " + string(rc.Token)
+		httpReq.Header.Add("Authorization", bearer)
+	}
+
+	sh.Req = httpReq
+	sh.Transport = sc.transport()
+	return &sh
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest
+// list by digest.
+func (c *gcrClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	var sh stream.HTTP
+
+	tokenKey, domain, repoPath := GetTokenKeyDomainRepoPath(
+		gmlc.RegistryContext.Name)
+
+	endpoint := fmt.Sprintf(
+		"https://%s/v2/%s/%s/manifests/%s",
+		domain,
+		repoPath,
+		gmlc.ImageName,
+		// Always refer by a digest, because it may be the case that this
+		// manifest list is not actually tagged!
+		gmlc.Digest)
+
+	httpReq, err := http.NewRequest("GET", endpoint, nil)
+
+	// Without this, GCR responds as we had used the "Accept:
+	// application/vnd.docker.distribution.manifest.v1+prettyjws" header.
+	httpReq.Header.Add("Accept", "*/*")
+
+	if err != nil {
+		klog.Fatalf(
+			"could not create HTTP request for manifest list '%s/%s/%s:%s'",
+			domain,
+			repoPath,
+			gmlc.ImageName,
+			gmlc.Digest)
+	}
+
+	if sc.UseServiceAccount || sc.hasCredentialsFile(gmlc.RegistryContext) {
+		token, ok := sc.Tokens[RootRepo(tokenKey)]
+		if !ok {
+			klog.Exitf("access token for key '%s' not found\n", tokenKey)
+		}
+
+		var bearer = "Bearer " + string(token)
+		httpReq.Header.Add("Authorization", bearer)
+	}
+
+	sh.Req = httpReq
+	sh.Transport = sc.transport()
+	return &sh
+}
+
+// CopyImage copies the image into GCR.
+func (c *gcrClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions returns nil, because GCR credentials are picked up from the
+// default keychain, unless the registry has a credentials file.
+func (c *gcrClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	if sc.hasCredentialsFile(rc) {
+		return sc.basicAuthOptions(rc)
+	}
+	return nil
+}
@@ -104,7 +104,7 @@ func GrowManifest(
 
 	// (2) Scan the StagingRepo, and whittle the read results down with some
 	// filters (Filter* fields in GrowManifestOptions).
-	riiUnfiltered, err := ReadStagingRepo(o)
+	riiUnfiltered, err := ReadStagingRepo(ctx, o)
 	if err != nil {
 		return err
 	}
@@ -167,6 +167,7 @@ func FindManifest(o GrowManifestOptions) (Manifest, error) {
 // available to the resulting RegInvImage. This RegInvImage is what we want to
 // inject into the "images.yaml" of a thin manifest.
 func ReadStagingRepo(
+	ctx context.Context,
 	o GrowManifestOptions,
 ) (RegInvImage, error) {
 
@@ -191,12 +192,16 @@ func ReadStagingRepo(
 	if err != nil {
 		return RegInvImage{}, err
 	}
-	sc.ReadRegistries(
+	err = sc.ReadRegistries(
+		ctx,
 		[]RegistryContext{stagingRepoRC},
 		// Read all registries recursively, because we want to produce a
 		// complete snapshot.
 		true,
 		MkReadRepositoryCmdReal)
+	if err != nil {
+		return RegInvImage{}, err
+	}
 
 	return sc.Inv[manifests[0].Registries[0].Name], nil
 }
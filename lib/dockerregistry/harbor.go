@@ -0,0 +1,303 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// ProviderHarbor is the RegistryContext provider of Harbor registries. Harbor
+// is self-hosted, so its registries cannot be recognized by their hostname.
+const ProviderHarbor = "harbor"
+
+// harborPageSize is the number of results requested per page from Harbor's
+// API.
+const harborPageSize = 100
+
+// harborClient is the RegistryClient for Harbor. Harbor registries are named
+// after the Harbor project, e.g. "harbor.example.com/myproject", and must set
+// "provider: harbor". The registry is read through Harbor's v2 API, and
+// authentication uses a user or robot account (see RegistryContext's Username
+// and TokenEnv).
+type harborClient struct{}
+
+// GetToken reads the password (or robot account secret) from the
+// environment, if credentials are configured for the registry.
+func (c *harborClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	return getBasicAuthToken(rc)
+}
+
+// ListTags creates a HarborReader which reads the artifacts of the repository
+// (or, for the toplevel registry, lists the repositories of the project) with
+// Harbor's API.
+func (c *harborClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	_, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
+	toplevel := sc.isToplevelRegistry(rc.Name)
+	project, repo := splitHarborRepoPath(repoPath)
+
+	creds := sc.toplevelRegistryContext(rc)
+	var password gcloud.Token
+	if len(creds.Username) > 0 {
+		password = sc.getToken(creds)
+	}
+
+	mkPageCmd := func(page int) stream.Producer {
+		var endpoint string
+		if toplevel {
+			endpoint = fmt.Sprintf(
+				"https://%s/api/v2.0/projects/%s/repositories"+
+					"?page=%d&page_size=%d",
+				domain,
+				url.PathEscape(project),
+				page,
+				harborPageSize)
+		} else {
+			// Harbor requires slashes in repository names to be escaped
+			// twice.
+			endpoint = fmt.Sprintf(
+				"https://%s/api/v2.0/projects/%s/repositories/%s/artifacts"+
+					"?with_tag=true&page=%d&page_size=%d",
+				domain,
+				url.PathEscape(project),
+				url.PathEscape(url.PathEscape(repo)),
+				page,
+				harborPageSize)
+		}
+
+		httpReq, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			klog.Fatalf(
+				"could not create HTTP request for '%s/%s'",
+				domain,
+				repoPath)
+		}
+		if len(creds.Username) > 0 {
+			httpReq.SetBasicAuth(creds.Username, string(password))
+		}
+
+		return &stream.HTTP{
+			Req:       httpReq,
+			Transport: sc.transport(),
+		}
+	}
+
+	return &HarborReader{
+		RegistryName: rc.Name,
+		Toplevel:     toplevel,
+		MkPageCmd:    mkPageCmd,
+	}
+}
+
+// splitHarborRepoPath splits a repository path (e.g. "myproject/foo/bar")
+// into the Harbor project ("myproject") and the name of the repository within
+// the project ("foo/bar").
+func splitHarborRepoPath(repoPath string) (string, string) {
+	parts := strings.SplitN(repoPath, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest list (or
+// OCI image index) by digest with the standard registry API.
+func (c *harborClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage copies the image into the registry.
+func (c *harborClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions authenticates with the configured account, if any.
+// Otherwise the default keychain is used.
+func (c *harborClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	return sc.basicAuthOptions(rc)
+}
+
+// HarborReader is a stream.Producer which reads a registry through Harbor's
+// v2 API, and translates the result into GCR's "tags/list" format so that
+// ReadRegistries() can process it like any other repository.
+//
+// For the toplevel registry (the Harbor project, or a path within it), only
+// the names of the repositories below it are read, and reported as child
+// repositories. For repositories, all tagged artifacts are read; manifest
+// lists keep their media type, so that their children are read (see
+// ReadGCRManifestLists()) and they are copied as a whole.
+//
+// Harbor's API is paginated; MkPageCmd creates the stream.Producer for a
+// single page of results, starting at page 1.
+type HarborReader struct {
+	RegistryName RegistryName
+	Toplevel     bool
+	MkPageCmd    func(page int) stream.Producer
+}
+
+// harborRepository is a single repository of a project, as returned by
+// Harbor's API. The name includes the project.
+type harborRepository struct {
+	Name string `json:"name"`
+}
+
+// harborArtifact is a single artifact of a repository, as returned by Harbor's
+// API.
+type harborArtifact struct {
+	Digest            string `json:"digest"`
+	Size              int64  `json:"size"`
+	ManifestMediaType string `json:"manifest_media_type"`
+	Tags              []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// Produce reads all pages and returns the result as JSON on stdout.
+func (r *HarborReader) Produce() (io.Reader, io.Reader, error) {
+	_, _, repoPath := GetTokenKeyDomainRepoPath(r.RegistryName)
+	tags := gcrTags{
+		Children:  []string{},
+		Manifests: make(map[string]gcrManifestInfo),
+		Name:      repoPath,
+		Tags:      []string{},
+	}
+
+	var err error
+	if r.Toplevel {
+		err = r.readRepositories(&tags, repoPath)
+	} else {
+		err = r.readArtifacts(&tags)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.NewReader(b), strings.NewReader(""), nil
+}
+
+// Close does nothing, as all pages are closed by the time Produce() returns.
+func (r *HarborReader) Close() error {
+	return nil
+}
+
+func (r *HarborReader) readRepositories(tags *gcrTags, repoPath string) error {
+	var names []string
+	for page := 1; ; page++ {
+		var repos []harborRepository
+		if err := r.readPage(page, &repos); err != nil {
+			return err
+		}
+
+		for _, repo := range repos {
+			names = append(names, repo.Name)
+		}
+
+		if len(repos) < harborPageSize {
+			break
+		}
+	}
+
+	tags.Children = childRepos(names, repoPath)
+	return nil
+}
+
+func (r *HarborReader) readArtifacts(tags *gcrTags) error {
+	for page := 1; ; page++ {
+		var artifacts []harborArtifact
+		if err := r.readPage(page, &artifacts); err != nil {
+			return err
+		}
+
+		for _, artifact := range artifacts {
+			// Untagged artifacts are not reported, like for the other
+			// registries that are read with their own API.
+			if len(artifact.Tags) == 0 {
+				continue
+			}
+
+			mediaType := artifact.ManifestMediaType
+			if len(mediaType) == 0 {
+				mediaType = string(ggcrV1Types.DockerManifestSchema2)
+			}
+			info := gcrManifestInfo{
+				Size:      strconv.FormatInt(artifact.Size, 10),
+				MediaType: mediaType,
+				Created:   "0",
+				Uploaded:  "0",
+			}
+			for _, tag := range artifact.Tags {
+				info.Tags = append(info.Tags, tag.Name)
+				tags.Tags = append(tags.Tags, tag.Name)
+			}
+			tags.Manifests[artifact.Digest] = info
+		}
+
+		if len(artifacts) < harborPageSize {
+			return nil
+		}
+	}
+}
+
+// readPage reads a single page of results into v.
+func (r *HarborReader) readPage(page int, v interface{}) error {
+	producer := r.MkPageCmd(page)
+	stdout, _, err := producer.Produce()
+	if err != nil {
+		return err
+	}
+	// nolint[errcheck]
+	defer producer.Close()
+
+	return json.NewDecoder(stdout).Decode(v)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// TestHarborPromotionEdges reads a Harbor source and destination registry
+// with HarborReader (using canned API responses), and checks the promotion
+// edges computed from a manifest that promotes from the Harbor source
+// registry.
+func TestHarborPromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:     "harbor.example.com/staging",
+		Provider: reg.ProviderHarbor,
+		Src:      true,
+	}
+	destRC := reg.RegistryContext{
+		Name:     "harbor.example.com/prod",
+		Provider: reg.ProviderHarbor,
+	}
+	rcs := []reg.RegistryContext{srcRC, destRC}
+
+	// Canned API responses, keyed by registry name and page.
+	pages := map[reg.RegistryName]map[int]string{
+		"harbor.example.com/staging": {
+			1: `[{"name": "staging/a"}, {"name": "staging/b/c"}]`,
+		},
+		"harbor.example.com/staging/a": {
+			1: `[
+  {
+    "digest": "sha256:000",
+    "size": 100,
+    "manifest_media_type": "application/vnd.docker.distribution.manifest.v2+json",
+    "tags": [{"name": "0.9"}, {"name": "latest"}]
+  },
+  {
+    "digest": "sha256:111",
+    "size": 200,
+    "manifest_media_type": "application/vnd.oci.image.manifest.v1+json",
+    "tags": [{"name": "1.0"}]
+  },
+  {
+    "digest": "sha256:999",
+    "size": 300,
+    "tags": null
+  }
+]`,
+		},
+		"harbor.example.com/staging/b/c": {
+			1: `[
+  {
+    "digest": "sha256:222",
+    "size": 10,
+    "manifest_media_type": "application/vnd.docker.distribution.manifest.list.v2+json",
+    "tags": [{"name": "v1"}]
+  }
+]`,
+		},
+		"harbor.example.com/prod": {
+			1: `[{"name": "prod/a"}]`,
+		},
+		"harbor.example.com/prod/a": {
+			1: `[
+  {
+    "digest": "sha256:000",
+    "size": 100,
+    "tags": [{"name": "0.9"}]
+  }
+]`,
+		},
+	}
+
+	mkFakeHarborReader := func(
+		sc *reg.SyncContext,
+		rc reg.RegistryContext) stream.Producer {
+
+		toplevel := rc.Name == srcRC.Name || rc.Name == destRC.Name
+		return &reg.HarborReader{
+			RegistryName: rc.Name,
+			Toplevel:     toplevel,
+			MkPageCmd: func(page int) stream.Producer {
+				body, ok := pages[rc.Name][page]
+				if !ok {
+					checkError(
+						t,
+						fmt.Errorf("no page %d for %s", page, rc.Name),
+						"Test: TestHarborPromotionEdges\n")
+				}
+				return &stream.Fake{Bytes: []byte(body)}
+			},
+		}
+	}
+
+	sc := reg.SyncContext{
+		RegistryContexts: rcs,
+		Inv: reg.MasterInventory{
+			srcRC.Name:  nil,
+			destRC.Name: nil,
+		},
+		DigestMediaType: make(reg.DigestMediaType),
+		DigestImageSize: make(reg.DigestImageSize),
+	}
+	err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeHarborReader)
+	checkError(t, err, "Test: TestHarborPromotionEdges\n")
+
+	// The untagged artifact is not reported.
+	expectedInv := reg.MasterInventory{
+		"harbor.example.com/staging": {
+			"a": {
+				"sha256:000": {"0.9", "latest"},
+				"sha256:111": {"1.0"}},
+			"b/c": {
+				"sha256:222": {"v1"}}},
+		"harbor.example.com/prod": {
+			"a": {
+				"sha256:000": {"0.9"}}},
+	}
+	err = checkEqual(sc.Inv, expectedInv)
+	checkError(t, err, "Test: TestHarborPromotionEdges (inventory)\n")
+
+	err = checkEqual(
+		sc.DigestMediaType["sha256:222"],
+		ggcrV1Types.DockerManifestList)
+	checkError(t, err, "Test: TestHarborPromotionEdges (media type)\n")
+
+	err = checkEqual(
+		sc.DigestMediaType["sha256:111"],
+		ggcrV1Types.OCIManifestSchema1)
+	checkError(t, err, "Test: TestHarborPromotionEdges (OCI media type)\n")
+
+	err = checkEqual(sc.DigestImageSize["sha256:111"], 200)
+	checkError(t, err, "Test: TestHarborPromotionEdges (image size)\n")
+
+	mfests := []reg.Manifest{
+		{
+			Registries: rcs,
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"},
+						"sha256:111": {"1.0"}}},
+				{
+					ImageName: "b/c",
+					Dmap: reg.DigestTags{
+						"sha256:222": {"v1"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "Test: TestHarborPromotionEdges (ToPromotionEdges)\n")
+
+	got, clean := sc.GetPromotionCandidates(edges)
+	// "a:0.9" is already in the destination, so only "a:1.0" and the
+	// manifest list "b/c:v1" are promoted.
+	expected := map[reg.PromotionEdge]interface{}{
+		{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{
+				ImageName: "a",
+				Tag:       "1.0"},
+			Digest:      "sha256:111",
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{
+				ImageName: "a",
+				Tag:       "1.0"}}: nil,
+		{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{
+				ImageName: "b/c",
+				Tag:       "v1"},
+			Digest:      "sha256:222",
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{
+				ImageName: "b/c",
+				Tag:       "v1"}}: nil,
+	}
+	err = checkEqual(got, expected)
+	checkError(t, err, "Test: TestHarborPromotionEdges (edges)\n")
+	err = checkEqual(clean, true)
+	checkError(t, err, "Test: TestHarborPromotionEdges (clean)\n")
+}
@@ -17,27 +17,30 @@ limitations under the License.
 package inventory
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
 	ggcrV1Google "github.com/google/go-containerregistry/pkg/v1/google"
 	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
 	cipJson "sigs.k8s.io/k8s-container-image-promoter/lib/json"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
 	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
 )
@@ -69,7 +72,13 @@ func MakeSyncContext(
 		RegistryContexts:  make([]RegistryContext, 0),
 		DigestMediaType:   make(DigestMediaType),
 		DigestImageSize:   make(DigestImageSize),
-		ParentDigest:      make(ParentDigest)}
+		ParentDigest:      make(ParentDigest),
+		UploadTimes:       make(UploadTimes),
+		MaxRetries:        DefaultMaxRetries,
+		RetryBaseDelay:    DefaultRetryBaseDelay,
+		MaxParallelImages: DefaultMaxParallelImages,
+		CopyTimeout:       DefaultCopyTimeout,
+		ManifestFiles:     manifestFiles(mfests)}
 
 	registriesSeen := make(map[RegistryContext]interface{})
 	for _, mfest := range mfests {
@@ -97,11 +106,9 @@ func MakeSyncContext(
 	})
 
 	// Populate access tokens for all registries listed in the manifest.
-	if useSvcAcc {
-		err := sc.PopulateTokens()
-		if err != nil {
-			return SyncContext{}, err
-		}
+	err := sc.PopulateTokens()
+	if err != nil {
+		return SyncContext{}, err
 	}
 
 	return sc, nil
@@ -118,12 +125,22 @@ func (sc *SyncContext) LogJSONSummary() {
 	}
 }
 
-// ParseManifestFromFile parses a Manifest from a filepath.
+// ParseManifestFromFile parses a Manifest from a filepath. If the filepath is
+// a directory, all "*.yaml" files within it are merged into a single Manifest
+// (see ParseManifestFromDir).
 func ParseManifestFromFile(filePath string) (Manifest, error) {
 
 	var mfest Manifest
 	var empty Manifest
 
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return empty, err
+	}
+	if info.IsDir() {
+		return ParseManifestFromDir(filePath)
+	}
+
 	b, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return empty, err
@@ -144,6 +161,192 @@ func ParseManifestFromFile(filePath string) (Manifest, error) {
 	return mfest, nil
 }
 
+// ParseManifestFromDir reads all "*.yaml" files within a directory (including
+// its subdirectories) and merges them into a single Manifest. This allows a
+// large manifest to be split up across multiple files. Individual files do not
+// have to be complete manifests; e.g., one file may only define the registries
+// and the others only the images. It is an error for two files to disagree on
+// the settings of the same registry, or to assign the same tag of an image to
+// different digests.
+func ParseManifestFromDir(dir string) (Manifest, error) {
+	var empty Manifest
+
+	// List and sort the paths first, for a consistent ordering.
+	var paths []string
+	var listManifest filepath.WalkFunc = func(p string,
+		info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(p) != ".yaml" {
+			return nil
+		}
+
+		paths = append(paths, p)
+		return nil
+	}
+	if err := filepath.Walk(dir, listManifest); err != nil {
+		return empty, err
+	}
+
+	if len(paths) == 0 {
+		return empty, fmt.Errorf("no manifests found in dir: %s", dir)
+	}
+
+	sort.Strings(paths)
+
+	mfests := make([]Manifest, 0, len(paths))
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return empty, err
+		}
+
+		// The registries may be defined in a different file, so only the
+		// images can be validated on a per-file basis.
+		var mfest Manifest
+		if err := yaml.UnmarshalStrict(b, &mfest); err != nil {
+			return empty, fmt.Errorf("could not parse manifest file %q: %v",
+				p, err)
+		}
+		if err := expandRegistryEnv(mfest.Registries); err != nil {
+			return empty, fmt.Errorf("could not parse manifest file %q: %v",
+				p, err)
+		}
+		if err := validateImages(mfest.Images); err != nil {
+			return empty, fmt.Errorf("could not parse manifest file %q: %v",
+				p, err)
+		}
+		mfest.Filepath = p
+
+		mfests = append(mfests, mfest)
+	}
+
+	merged, err := MergeManifests(mfests)
+	if err != nil {
+		return empty, err
+	}
+
+	merged.Filepath = dir
+
+	err = merged.Validate()
+	if err != nil {
+		return empty, err
+	}
+
+	err = merged.Finalize()
+	if err != nil {
+		return empty, err
+	}
+
+	return merged, nil
+}
+
+// MergeManifests merges the registries, images and allowed removals of the
+// given manifests into a single Manifest. Identical definitions are merged
+// silently, but conflicting ones (a registry defined with different settings,
+// or a tag pointing to different digests of the same image) are rejected.
+//
+// nolint[gocyclo]
+func MergeManifests(mfests []Manifest) (Manifest, error) {
+	var merged Manifest
+
+	// Remember which file defined each registry, for error messages.
+	registryIndexes := make(map[RegistryName]int)
+	registryOrigins := make(map[RegistryName]string)
+	imageIndexes := make(map[ImageName]int)
+	tagOrigins := make(map[ImageName]map[Tag]Digest)
+	removals := make(map[ImageName]bool)
+
+	for _, mfest := range mfests {
+		for _, rc := range mfest.Registries {
+			idx, ok := registryIndexes[rc.Name]
+			if !ok {
+				registryIndexes[rc.Name] = len(merged.Registries)
+				registryOrigins[rc.Name] = mfest.Filepath
+				merged.Registries = append(merged.Registries, rc)
+				continue
+			}
+
+			if merged.Registries[idx] != rc {
+				return Manifest{}, fmt.Errorf(
+					"registry %q is defined differently in %q and %q",
+					rc.Name,
+					registryOrigins[rc.Name],
+					mfest.Filepath)
+			}
+		}
+
+		for _, image := range mfest.Images {
+			idx, ok := imageIndexes[image.ImageName]
+			if !ok {
+				idx = len(merged.Images)
+				imageIndexes[image.ImageName] = idx
+				tagOrigins[image.ImageName] = make(map[Tag]Digest)
+				merged.Images = append(merged.Images, Image{
+					ImageName: image.ImageName,
+					Dmap:      make(DigestTags),
+				})
+			}
+			dst := &merged.Images[idx]
+
+			for digest, tags := range image.Dmap {
+				if _, ok := dst.Dmap[digest]; !ok {
+					dst.Dmap[digest] = TagSlice{}
+				}
+				for _, tag := range tags {
+					other, ok := tagOrigins[image.ImageName][tag]
+					if ok && other != digest {
+						return Manifest{}, fmt.Errorf(
+							"conflicting definitions of %s:%s in %q: "+
+								"the tag points to both %s and %s",
+							image.ImageName,
+							tag,
+							mfest.Filepath,
+							other,
+							digest)
+					}
+					if ok {
+						continue
+					}
+					tagOrigins[image.ImageName][tag] = digest
+					dst.Dmap[digest] = append(dst.Dmap[digest], tag)
+				}
+			}
+
+			for _, pattern := range image.TagPatterns {
+				if !containsString(dst.TagPatterns, pattern) {
+					dst.TagPatterns = append(dst.TagPatterns, pattern)
+				}
+			}
+			dst.PromoteAllTags = dst.PromoteAllTags || image.PromoteAllTags
+		}
+
+		for _, name := range mfest.AllowedRemovals {
+			if removals[name] {
+				continue
+			}
+			removals[name] = true
+			merged.AllowedRemovals = append(merged.AllowedRemovals, name)
+		}
+	}
+
+	return merged, nil
+}
+
+// containsString returns true if the slice contains the given string.
+func containsString(slice []string, s string) bool {
+	for _, elt := range slice {
+		if elt == s {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseThinManifestFromFile parses a ThinManifest from a filepath and generates
 // a Manifest.
 func ParseThinManifestFromFile(filePath string) (Manifest, error) {
@@ -162,13 +365,7 @@ func ParseThinManifestFromFile(filePath string) (Manifest, error) {
 		return empty, err
 	}
 
-	// Get directory name holding this thin manifest.
-	subProject := filepath.Base(filepath.Dir(filePath))
-	imagesPath := filepath.Join(filepath.Dir(filePath),
-		"../../images",
-		subProject,
-		"images.yaml")
-	images, err := ParseImagesFromFile(imagesPath)
+	images, err := ParseImagesFromFile(thinManifestImagesPath(filePath))
 	if err != nil {
 		return empty, err
 	}
@@ -176,6 +373,7 @@ func ParseThinManifestFromFile(filePath string) (Manifest, error) {
 	mfest.Filepath = filePath
 	mfest.Images = images
 	mfest.Registries = thinManifest.Registries
+	mfest.AllowedRemovals = thinManifest.AllowedRemovals
 
 	err = mfest.Finalize()
 	if err != nil {
@@ -185,6 +383,17 @@ func ParseThinManifestFromFile(filePath string) (Manifest, error) {
 	return mfest, nil
 }
 
+// thinManifestImagesPath returns the path of the images file that goes with
+// the thin manifest at filePath (see ThinManifest).
+func thinManifestImagesPath(filePath string) string {
+	// Get directory name holding this thin manifest.
+	subProject := filepath.Base(filepath.Dir(filePath))
+	return filepath.Join(filepath.Dir(filePath),
+		"../../images",
+		subProject,
+		"images.yaml")
+}
+
 // ParseImagesFromFile parses an Images type from a file.
 func ParseImagesFromFile(filePath string) (Images, error) {
 	var images Images
@@ -422,6 +631,298 @@ func ToPromotionEdges(
 	return CheckOverlappingEdges(edges)
 }
 
+// SelectPromotionEdges returns the edges whose image name matches
+// imagePattern, and whose tag matches tagPattern. The patterns are shell
+// patterns (see path.Match()), so that "*" does not match the "/" of a nested
+// image name; an empty pattern matches everything. Tagless edges only match
+// tag patterns that match the empty string (such as "*").
+func SelectPromotionEdges(
+	edges map[PromotionEdge]interface{},
+	imagePattern string,
+	tagPattern string) (map[PromotionEdge]interface{}, error) {
+
+	if _, err := path.Match(imagePattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid image pattern: %v", imagePattern)
+	}
+	if _, err := path.Match(tagPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern: %v", tagPattern)
+	}
+
+	matches := func(pattern, s string) bool {
+		if len(pattern) == 0 {
+			return true
+		}
+		ok, _ := path.Match(pattern, s)
+		return ok
+	}
+
+	selected := make(map[PromotionEdge]interface{})
+	for edge := range edges {
+		if !matches(imagePattern, string(edge.SrcImageTag.ImageName)) ||
+			!matches(tagPattern, string(edge.DstImageTag.Tag)) {
+			continue
+		}
+		selected[edge] = nil
+	}
+
+	logging.Log().Info(
+		"selected promotion edges",
+		"imagePattern", imagePattern,
+		"tagPattern", tagPattern,
+		"selected", len(selected),
+		"total", len(edges))
+
+	return selected, nil
+}
+
+// SelectDestinationEdges returns the edges whose destination registry is
+// destRegistry (a trailing "/" is ignored), so that a run only promotes to
+// one of the destinations of the manifests. The edges to the other
+// destinations are skipped, and logged with their number for every skipped
+// registry. An empty destRegistry selects all edges. It is an error if no
+// edge goes to destRegistry, as its name is then probably misspelled.
+func SelectDestinationEdges(
+	edges map[PromotionEdge]interface{},
+	destRegistry RegistryName) (map[PromotionEdge]interface{}, error) {
+
+	if len(destRegistry) == 0 {
+		return edges, nil
+	}
+	destRegistry = RegistryName(strings.TrimRight(string(destRegistry), "/"))
+
+	selected := make(map[PromotionEdge]interface{})
+	skipped := make(map[RegistryName]int)
+	for edge := range edges {
+		if edge.DstRegistry.Name != destRegistry {
+			skipped[edge.DstRegistry.Name]++
+			continue
+		}
+		selected[edge] = nil
+	}
+
+	skippedRegistries := make([]string, 0, len(skipped))
+	for name := range skipped {
+		skippedRegistries = append(skippedRegistries, string(name))
+	}
+	sort.Strings(skippedRegistries)
+
+	if len(edges) > 0 && len(selected) == 0 {
+		return nil, fmt.Errorf(
+			"no image is promoted to destination registry %v "+
+				"(destination registries: %v)",
+			destRegistry, strings.Join(skippedRegistries, ", "))
+	}
+
+	for _, name := range skippedRegistries {
+		logging.Log().Info(
+			"skipped promotion edges to other destination registry",
+			"destRegistry", name,
+			"skipped", skipped[RegistryName(name)])
+	}
+	logging.Log().Info(
+		"selected promotion edges",
+		"destRegistry", destRegistry,
+		"selected", len(selected),
+		"total", len(edges))
+
+	return selected, nil
+}
+
+// validDestPrefix matches the destination prefixes accepted by
+// PrefixPromotionEdges(): one or more path components of a repository name.
+var validDestPrefix = regexp.MustCompile(
+	`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+
+// PrefixPromotionEdges returns the edges with prefix prepended to the image
+// names of their destinations, so that all images land below a sub-path of
+// the destination registries (e.g., with the prefix "mirror", the image "foo"
+// is promoted to "gcr.io/bar/mirror/foo"). The sources, digests and tags are
+// unchanged. An empty prefix leaves the edges untouched.
+func PrefixPromotionEdges(
+	edges map[PromotionEdge]interface{},
+	prefix string) (map[PromotionEdge]interface{}, error) {
+
+	if len(prefix) == 0 {
+		return edges, nil
+	}
+	if !validDestPrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid destination prefix: %v", prefix)
+	}
+
+	prefixed := make(map[PromotionEdge]interface{})
+	for edge := range edges {
+		edge.DstImageTag.ImageName = ImageName(
+			prefix + "/" + string(edge.DstImageTag.ImageName))
+		prefixed[edge] = nil
+	}
+
+	return prefixed, nil
+}
+
+// ExpandTagPatterns adds the source registry tags that match the TagPatterns
+// of the images in mfests to their Dmap (or all of the tags, for images with
+// PromoteAllTags), so that ToPromotionEdges() promotes them like any other
+// tag. Only the source repositories of such images are read. Tags that are
+// already in the Dmap of an image are left alone, and a pattern that matches
+// no tag (or an empty source repository) is not an error.
+func (sc *SyncContext) ExpandTagPatterns(
+	ctx context.Context,
+	mfests []Manifest,
+	mkProducer func(*SyncContext, RegistryContext) stream.Producer,
+) error {
+	toRead := make(map[RegistryContext]interface{})
+	for _, mfest := range mfests {
+		for _, image := range mfest.Images {
+			if !expandsTags(image) {
+				continue
+			}
+			srcRepo := *mfest.SrcRegistry
+			srcRepo.Name = srcRepo.Name + "/" + RegistryName(image.ImageName)
+			toRead[srcRepo] = nil
+		}
+	}
+	if len(toRead) == 0 {
+		return nil
+	}
+
+	rcs := make([]RegistryContext, 0, len(toRead))
+	for rc := range toRead {
+		rcs = append(rcs, rc)
+	}
+	if err := sc.ReadRegistries(ctx, rcs, false, mkProducer); err != nil {
+		return fmt.Errorf("could not expand tag patterns: %v", err)
+	}
+
+	for i := range mfests {
+		mfest := &mfests[i]
+		for j := range mfest.Images {
+			image := &mfest.Images[j]
+			if !expandsTags(*image) {
+				continue
+			}
+			srcDigestTags := sc.Inv[mfest.SrcRegistry.Name][image.ImageName]
+			expandImageTagPatterns(image, srcDigestTags)
+		}
+	}
+	return nil
+}
+
+// expandsTags returns true if the image has tags to be expanded by
+// ExpandTagPatterns().
+func expandsTags(image Image) bool {
+	return len(image.TagPatterns) > 0 || image.PromoteAllTags
+}
+
+// expandImageTagPatterns adds the tags of srcDigestTags that match the tag
+// patterns of the image to its Dmap (or all of them, if the image has
+// PromoteAllTags).
+func expandImageTagPatterns(image *Image, srcDigestTags DigestTags) {
+	known := make(map[Tag]interface{})
+	for _, tags := range image.Dmap {
+		for _, tag := range tags {
+			known[tag] = nil
+		}
+	}
+	if image.Dmap == nil {
+		image.Dmap = make(DigestTags)
+	}
+
+	if image.PromoteAllTags {
+		matched := 0
+		for digest, tags := range srcDigestTags {
+			for _, tag := range tags {
+				matched++
+				if _, ok := known[tag]; ok {
+					continue
+				}
+				known[tag] = nil
+				image.Dmap[digest] = append(image.Dmap[digest], tag)
+			}
+		}
+		if matched == 0 {
+			logging.Log().Info("source repository has no tags to promote",
+				"image", image.ImageName)
+		}
+	}
+
+	for _, pattern := range image.TagPatterns {
+		matched := 0
+		for digest, tags := range srcDigestTags {
+			for _, tag := range tags {
+				// The patterns were validated when parsing the manifest.
+				if ok, _ := path.Match(pattern, string(tag)); !ok {
+					continue
+				}
+				matched++
+				if _, ok := known[tag]; ok {
+					continue
+				}
+				known[tag] = nil
+				image.Dmap[digest] = append(image.Dmap[digest], tag)
+			}
+		}
+		if matched == 0 {
+			logging.Log().Info("tag pattern matched no tags",
+				"image", image.ImageName, "pattern", pattern)
+		}
+	}
+}
+
+// CollapsePromotionEdges groups the edges which copy the same digest from the
+// same source image into the same destination image, and which therefore only
+// differ in their tags. The groups are keyed by their edge without any tags;
+// the values are the merged (sorted) tags of the group, which are empty if the
+// digest is only promoted without a tag.
+func CollapsePromotionEdges(
+	edges map[PromotionEdge]interface{}) map[PromotionEdge]TagSlice {
+
+	groups := make(map[PromotionEdge]TagSlice)
+	for edge := range edges {
+		tag := edge.DstImageTag.Tag
+		edge.SrcImageTag.Tag = ""
+		edge.DstImageTag.Tag = ""
+
+		tags, ok := groups[edge]
+		if !ok {
+			tags = TagSlice{}
+		}
+		if len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+		groups[edge] = tags
+	}
+
+	for _, tags := range groups {
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	}
+
+	return groups
+}
+
+// ExpandPromotionEdges turns the groups of CollapsePromotionEdges() back into
+// edges: one per tag, or a single tagless edge for groups without tags. This
+// drops the tagless edges of digests that are also promoted with a tag, as
+// they are redundant.
+func ExpandPromotionEdges(
+	groups map[PromotionEdge]TagSlice) map[PromotionEdge]interface{} {
+
+	edges := make(map[PromotionEdge]interface{})
+	for group, tags := range groups {
+		if len(tags) == 0 {
+			edges[group] = nil
+			continue
+		}
+		for _, tag := range tags {
+			edge := group
+			edge.SrcImageTag.Tag = tag
+			edge.DstImageTag.Tag = tag
+			edges[edge] = nil
+		}
+	}
+
+	return edges
+}
+
 func mkPromotionEdge(
 	srcRC, dstRC RegistryContext,
 	srcImageName ImageName,
@@ -446,7 +947,10 @@ func mkPromotionEdge(
 
 // This filters out those edges from ToPromotionEdges (found in []Manifest), to
 // only those PromotionEdges that makes sense to keep around. For example, we
-// want to remove all edges that have already been promoted.
+// want to remove all edges that have already been promoted. With
+// sc.AdditiveOnly, edges that would move an existing tag are rejected too,
+// and with sc.Since, the edges of older (or undated) source images are
+// dropped.
 //
 // nolint[funlen]
 // nolint[gocyclo]
@@ -462,12 +966,15 @@ func (sc *SyncContext) GetPromotionCandidates(
 	}
 
 	toPromote := make(map[PromotionEdge]interface{})
+	sc.AlreadyPromoted = make(map[PromotionEdge]interface{})
 	// nolint[lll]
 	for edge := range edges {
+		log := logging.Log().WithValues(edge.logFields()...)
+
 		// If the edge should be ignored because of a bad read in sc.Inv, drop
-		// it (complain with klog though).
-		if img, ok := ignoreMap[edge.SrcImageTag.ImageName]; ok {
-			klog.Warningf("edge %v: ignoring because src image could not be read: %s\n", edge, img)
+		// it (complain in the logs though).
+		if _, ok := ignoreMap[edge.SrcImageTag.ImageName]; ok {
+			log.Info("ignoring edge because the src image could not be read")
 			continue
 		}
 
@@ -475,7 +982,8 @@ func (sc *SyncContext) GetPromotionCandidates(
 
 		// If dst vertex exists, NOP.
 		if dp.PqinDigestMatch {
-			klog.Infof("edge %v: skipping because it was already promoted (case 1)\n", edge)
+			log.Info("skipping edge because it was already promoted (case 1)")
+			sc.AlreadyPromoted[edge] = nil
 			continue
 		}
 
@@ -484,46 +992,66 @@ func (sc *SyncContext) GetPromotionCandidates(
 		if edge.DstImageTag.Tag == "" && dp.DigestExists {
 			// Still, log a warning if the source is missing the image.
 			if !sp.DigestExists {
-				klog.Errorf("edge %v: skipping %s/%s@%s because it was already promoted, but it is still _LOST_ (can't find it in src registry! please backfill it!)\n", edge, edge.SrcRegistry.Name, edge.SrcImageTag.ImageName, edge.Digest)
+				log.Error(nil, "skipping edge because it was already promoted, but it is still _LOST_ (can't find it in src registry! please backfill it!)")
 			}
+			sc.AlreadyPromoted[edge] = nil
 			continue
 		}
 
 		// If src vertex missing, LOST && NOP. We just need the digest to exist
 		// in src (we don't care if it points to the wrong tag).
 		if !sp.DigestExists {
-			klog.Errorf("edge %v: skipping %s/%s@%s because it is _LOST_ (can't find it in src registry!)\n", edge, edge.SrcRegistry.Name, edge.SrcImageTag.ImageName, edge.Digest)
+			log.Error(nil, "skipping edge because it is _LOST_ (can't find it in src registry!)")
 			continue
 		}
 
+		// If the src image is too old for sc.Since, NOP.
+		if !sc.Since.IsZero() {
+			uploaded, ok := sc.uploadTime(edge)
+			if !ok {
+				log.Info("skipping edge because the upload time of the src image is unknown", "since", sc.Since)
+				continue
+			}
+			if uploaded.Before(sc.Since) {
+				log.Info("skipping edge because the src image was uploaded before the cutoff", "uploaded", uploaded, "since", sc.Since)
+				continue
+			}
+		}
+
 		if dp.PqinExists {
 			if dp.DigestExists {
 				// If the destination already has the digest, but is pointing to
 				// a different tag, then it's an error.
 				if dp.PqinDigestMatch {
 					// NOP (already promoted).
-					klog.Infof("edge %v: skipping because it was already promoted (case 2)\n", edge)
+					log.Info("skipping edge because it was already promoted (case 2)")
+					sc.AlreadyPromoted[edge] = nil
 					continue
 				} else {
-					klog.Errorf("edge %v: tag %s: ERROR: tag move detected from %s to %s", edge, edge.DstImageTag.Tag, edge.Digest, *sc.getDigestForTag(edge.DstImageTag.Tag))
+					log.Error(nil, "tag move detected", "from", edge.Digest, "to", *sc.getDigestForTag(edge.DstImageTag.Tag))
 					clean = false
 					// We continue instead of returning early, because we want
 					// to see and log as many errors as possible as we go
 					// through each promotion edge.
 					continue
 				}
+			} else if sc.AdditiveOnly {
+				// Pqin points to the wrong digest, but tags must not move.
+				log.Error(nil, "refusing to move tag in additive-only mode", "badDigest", dp.BadDigest)
+				clean = false
+				continue
 			} else {
 				// Pqin points to the wrong digest.
-				klog.Warningf("edge %v: tag %s points to the wrong digest; moving\n, dp.BadDigest")
+				log.Info("tag points to the wrong digest; moving", "badDigest", dp.BadDigest)
 			}
 		} else {
 			if dp.DigestExists {
 				// Digest exists in dst, but the pqin we desire does not
 				// exist. Just add the pqin to this existing digest.
-				klog.Infof("edge %v: digest %q already exists, but does not have the pqin we want (%s)\n", edge, edge.Digest, dp.OtherTags)
+				log.Info("digest already exists, but does not have the pqin we want", "otherTags", dp.OtherTags)
 			} else {
 				// Neither the digest nor the pqin exists in dst.
-				klog.Infof("edge %v: regular promotion (neither digest nor pqin exists in dst)\n", edge)
+				log.Info("regular promotion (neither digest nor pqin exists in dst)")
 			}
 		}
 
@@ -638,6 +1166,18 @@ func CheckOverlappingEdges(
 	return checked, nil
 }
 
+// logFields returns the key/value pairs that describe the edge in structured
+// logs.
+func (edge PromotionEdge) logFields() []interface{} {
+	return []interface{}{
+		"image", edge.SrcImageTag.ImageName,
+		"digest", edge.Digest,
+		"tag", edge.DstImageTag.Tag,
+		"src", edge.SrcRegistry.Name,
+		"dst", edge.DstRegistry.Name,
+	}
+}
+
 // VertexProps determines the properties of each vertex (src and dst) in the
 // edge, depending on the state of the world in the MasterInventory.
 func (edge PromotionEdge) VertexProps(
@@ -696,21 +1236,30 @@ func (edge PromotionEdge) VertexPropsFor(
 
 // ParseManifestYAML parses a Manifest from a byteslice. This function is
 // separate from ParseManifestFromFile() so that it can be tested independently.
+// The "${NAME}" references to environment variables in the registries are
+// expanded (see expandRegistryEnv()).
 func ParseManifestYAML(b []byte) (Manifest, error) {
 	var m Manifest
 	if err := yaml.UnmarshalStrict(b, &m); err != nil {
 		return m, err
 	}
+	if err := expandRegistryEnv(m.Registries); err != nil {
+		return m, err
+	}
 
 	return m, m.Validate()
 }
 
-// ParseThinManifestYAML parses a ThinManifest from a byteslice.
+// ParseThinManifestYAML parses a ThinManifest from a byteslice, expanding the
+// environment variable references in its registries like ParseManifestYAML().
 func ParseThinManifestYAML(b []byte) (ThinManifest, error) {
 	var m ThinManifest
 	if err := yaml.UnmarshalStrict(b, &m); err != nil {
 		return m, err
 	}
+	if err := expandRegistryEnv(m.Registries); err != nil {
+		return m, err
+	}
 
 	return m, nil
 }
@@ -726,7 +1275,9 @@ func ParseImagesYAML(b []byte) (Images, error) {
 }
 
 // Validate checks for semantic errors in the yaml fields (the structure of the
-// yaml is checked during unmarshaling).
+// yaml is checked during unmarshaling). Every error points at the offending
+// registry or image, by its position in the manifest (and its name, if any),
+// and at the offending field.
 func (m Manifest) Validate() error {
 	if err := validateRequiredComponents(m); err != nil {
 		return err
@@ -734,21 +1285,64 @@ func (m Manifest) Validate() error {
 	return validateImages(m.Images)
 }
 
+// validateImages checks the digests, tags and tag patterns of the images,
+// and reports all the invalid ones (one per line).
 func validateImages(images []Image) error {
-	for _, image := range images {
-		for digest, tagSlice := range image.Dmap {
+	errs := make([]string, 0)
+	for i, image := range images {
+		field := imageField(i, image)
+
+		// Sort the digests, so that the errors are reported in a consistent
+		// order.
+		digests := make([]Digest, 0, len(image.Dmap))
+		for digest := range image.Dmap {
+			digests = append(digests, digest)
+		}
+		sortDigests(digests)
+
+		for _, digest := range digests {
 			if err := ValidateDigest(digest); err != nil {
-				return err
+				errs = append(errs, fmt.Sprintf("%s: 'dmap': %v", field, err))
+				continue
 			}
 
-			for _, tag := range tagSlice {
+			for _, tag := range image.Dmap[digest] {
 				if err := ValidateTag(tag); err != nil {
-					return err
+					errs = append(errs, fmt.Sprintf(
+						"%s: 'dmap' (digest %s): %v", field, digest, err))
 				}
 			}
 		}
+		for _, pattern := range image.TagPatterns {
+			if err := ValidateTagPattern(pattern); err != nil {
+				errs = append(errs, fmt.Sprintf(
+					"%s: 'tagPatterns': %v", field, err))
+			}
+		}
 	}
-	return nil
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// imageField returns the prefix of the errors about the i-th image of a
+// manifest.
+func imageField(i int, image Image) string {
+	if len(image.ImageName) == 0 {
+		return fmt.Sprintf("images[%d]", i)
+	}
+	return fmt.Sprintf("images[%d] (%q)", i, image.ImageName)
+}
+
+// registryField returns the prefix of the errors about the i-th registry of
+// a manifest.
+func registryField(i int, registry RegistryContext) string {
+	if len(registry.Name) == 0 {
+		return fmt.Sprintf("registries[%d]", i)
+	}
+	return fmt.Sprintf("registries[%d] (%q)", i, registry.Name)
 }
 
 // ValidateDigest validates the digest.
@@ -769,6 +1363,14 @@ func ValidateTag(tag Tag) error {
 	return nil
 }
 
+// ValidateTagPattern validates the tag pattern.
+func ValidateTagPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+		return fmt.Errorf("invalid tag pattern: %v", pattern)
+	}
+	return nil
+}
+
 // ValidateRegistryImagePath validates the RegistryImagePath.
 func ValidateRegistryImagePath(rip RegistryImagePath) error {
 	validRegistryImagePath := regexp.MustCompile(
@@ -817,24 +1419,72 @@ func validateRequiredComponents(m Manifest) error {
 	if len(m.Registries) == 0 {
 		errs = append(errs, fmt.Sprintf("'registries' field cannot be empty"))
 	}
-	for _, registry := range m.Registries {
+	for i, registry := range m.Registries {
+		field := registryField(i, registry)
 		if len(registry.Name) == 0 {
 			errs = append(
 				errs,
-				fmt.Sprintf("registries: 'name' field cannot be empty"))
+				fmt.Sprintf("%s: 'name' field cannot be empty", field))
+		}
+		if (len(registry.Username) == 0) != (len(registry.TokenEnv) == 0) {
+			errs = append(
+				errs,
+				field+": 'username' and 'token-env' fields must be "+
+					"set together")
+		}
+		if len(registry.CredentialsFile) > 0 && len(registry.Username) > 0 {
+			errs = append(
+				errs,
+				field+": 'credentials-file' cannot be used with "+
+					"'username' and 'token-env'")
+		}
+		switch registry.Provider {
+		case "", ProviderHarbor:
+			if len(registry.Path) > 0 {
+				errs = append(
+					errs,
+					fmt.Sprintf(
+						"%s: 'path' requires 'provider: %s'",
+						field,
+						ProviderLocal))
+			}
+		case ProviderLocal:
+			if len(registry.Path) == 0 {
+				errs = append(
+					errs,
+					field+": local registries must set 'path'")
+			}
+			if !registry.Src {
+				errs = append(
+					errs,
+					field+": local registries are read-only, and must "+
+						"set 'src: true'")
+			}
+		default:
+			errs = append(
+				errs,
+				fmt.Sprintf(
+					"%s: unknown 'provider' %q (supported: %q, %q)",
+					field,
+					registry.Provider,
+					ProviderHarbor,
+					ProviderLocal))
 		}
 		knownRegistries = append(knownRegistries, registry.Name)
 	}
-	for _, image := range m.Images {
+	for i, image := range m.Images {
+		field := imageField(i, image)
 		if len(image.ImageName) == 0 {
 			errs = append(
 				errs,
-				fmt.Sprintf("images: 'name' field cannot be empty"))
+				fmt.Sprintf("%s: 'name' field cannot be empty", field))
 		}
-		if len(image.Dmap) == 0 {
+		if len(image.Dmap) == 0 && !expandsTags(image) {
 			errs = append(
 				errs,
-				fmt.Sprintf("images: 'dmap' field cannot be empty"))
+				fmt.Sprintf("%s: 'dmap' field cannot be empty "+
+					"(set 'tagPatterns' or 'promoteAllTags' to promote "+
+					"tags by name)", field))
 		}
 	}
 
@@ -946,8 +1596,14 @@ func getRegistryTagsWrapper(req stream.ExternalRequest,
 
 		googleTags, err = getRegistryTagsFrom(req)
 
-		// We never return an error (err) in the second part of our return
-		// argument, because we don't want to prematurely stop the
+		// Retrying is pointless if the read was cancelled (see
+		// withContext()).
+		if isContextError(err) {
+			return false, err
+		}
+
+		// Otherwise, we never return an error (err) in the second part of our
+		// return argument, because we don't want to prematurely stop the
 		// ExponentialBackoff() loop; we want it to continue looping until
 		// either we get a well-formed tags value, or until it hits
 		// ErrWaitTimeout. This is how ExponentialBackoff() uses the
@@ -993,6 +1649,49 @@ func getRegistryTagsFrom(req stream.ExternalRequest,
 	return tags, nil
 }
 
+// contextProducer is a stream.Producer which only produces its stream if its
+// context is not done yet.
+type contextProducer struct {
+	ctx      context.Context
+	producer stream.Producer
+	started  bool
+}
+
+// Produce produces the stream of the wrapped producer, unless the context is
+// done, in which case the context's error is returned.
+func (p *contextProducer) Produce() (io.Reader, io.Reader, error) {
+	if err := p.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	p.started = true
+	return p.producer.Produce()
+}
+
+// Close closes the wrapped producer, if it was started.
+func (p *contextProducer) Close() error {
+	if !p.started {
+		return nil
+	}
+	return p.producer.Close()
+}
+
+// withContext wraps mkProducer so that the producers do not read anything
+// once ctx is done.
+func withContext(
+	ctx context.Context,
+	mkProducer func(*SyncContext, RegistryContext) stream.Producer,
+) func(*SyncContext, RegistryContext) stream.Producer {
+
+	return func(sc *SyncContext, rc RegistryContext) stream.Producer {
+		return &contextProducer{ctx: ctx, producer: mkProducer(sc, rc)}
+	}
+}
+
+// isContextError returns true if err is the error of a done context.
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
 func getGCRManifestListWrapper(
 	req stream.ExternalRequest) (*ggcrV1.IndexManifest, error) {
 
@@ -1147,16 +1846,31 @@ error:
 }
 
 // PopulateTokens populates the SyncContext's Tokens map with actual usable
-// access tokens.
+// access tokens. Each registry's RegistryClient decides whether a token is
+// needed. Failures are returned as a TokenError.
 func (sc *SyncContext) PopulateTokens() error {
-	for _, rc := range sc.RegistryContexts {
-		token, err := gcloud.GetServiceAccountToken(
-			rc.ServiceAccount,
-			sc.UseServiceAccount)
-		if err != nil {
-			klog.Errorf("could not get service account token for %v",
-				rc.ServiceAccount)
-			return err
+	for i, rc := range sc.RegistryContexts {
+		var token gcloud.Token
+		if len(rc.CredentialsFile) > 0 {
+			username, password, err := ReadCredentialsFile(
+				rc.CredentialsFile, rc.Name)
+			if err != nil {
+				return TokenError{Registry: rc.Name, Err: err}
+			}
+			// The RegistryClients look up the username in the toplevel
+			// RegistryContext.
+			sc.RegistryContexts[i].Username = username
+			token = gcloud.Token(password)
+		} else {
+			var err error
+			token, err = GetRegistryClient(rc).GetToken(
+				rc, sc.UseServiceAccount)
+			if err != nil {
+				return TokenError{Registry: rc.Name, Err: err}
+			}
+		}
+		if len(token) == 0 {
+			continue
 		}
 		tokenKey, _, _ := GetTokenKeyDomainRepoPath(rc.Name)
 		sc.Tokens[RootRepo(tokenKey)] = token
@@ -1213,11 +1927,33 @@ func GetTokenKeyDomainRepoPath(
 // example above that there are images named gcr.io/google-containers/foo:2.0
 // and gcr.io/google-containers/foo/baz:2.0.
 //
+// Repositories are read concurrently, with up to sc.Threads requests in
+// flight (see ExecRequests()). Repositories that cannot be read are ignored
+// from promotion; the errors of all such repositories are returned together.
+//
+// If sc.ListingCache is set, repositories are read from it when possible, and
+// repositories read over the network are added to it.
+//
+// Once ctx is done, the remaining repositories are not read anymore, and
+// ctx.Err() is returned.
+//
 // nolint[gocyclo]
 func (sc *SyncContext) ReadRegistries(
+	ctx context.Context,
 	toRead []RegistryContext,
 	recurse bool,
-	mkProducer func(*SyncContext, RegistryContext) stream.Producer) {
+	mkProducer func(*SyncContext, RegistryContext) stream.Producer) error {
+
+	// Errors of all failed requests, by repository.
+	readErrors := make([]string, 0)
+
+	if sc.Budget != nil {
+		mkProducer = withBudget(mkProducer)
+	}
+	mkProducer = withContext(ctx, mkProducer)
+	if sc.ListingCache != nil {
+		mkProducer = withListingCache(mkProducer)
+	}
 
 	// Collect all images in sc.Inv (the src and dest registry names found in
 	// the manifest).
@@ -1257,18 +1993,26 @@ func (sc *SyncContext) ReadRegistries(
 					Error{
 						Context: "getRegistryTagsWrapper",
 						Error:   err}}
-				requestResults <- reqRes
 
 				// Invalidate promotion conservatively for the subset of images
 				// that touch this network request. If we have trouble reading
 				// "foo" from a destination registry, do not bother trying to
 				// promote it for all registries
+				//
+				// This must happen before we send the result, because that is
+				// what lets ExecRequests() (and so us) return.
 				mutex.Lock()
 				sc.IgnoreFromPromotion(req.RequestParams.(RegistryContext).Name)
+				readErrors = append(readErrors, fmt.Sprintf("%s: %v",
+					req.RequestParams.(RegistryContext).Name,
+					err))
 				mutex.Unlock()
 
+				requestResults <- reqRes
 				continue
 			}
+			sc.cacheListing(req, tagsStruct)
+
 			// Process the current repo.
 			rName := req.RequestParams.(RegistryContext).Name
 			digestTags := make(DigestTags)
@@ -1308,6 +2052,17 @@ func (sc *SyncContext) ReadRegistries(
 				currentRepo[imageName] = digestTags
 
 				mutex.Lock()
+				// The upload times come with the listing, so filtering by
+				// sc.Since does not need any more reads.
+				for digest, mfestInfo := range tagsStruct.Manifests {
+					sc.recordUploadTime(
+						rootReg,
+						ImageDigest{
+							ImageName: imageName,
+							Digest:    Digest(digest),
+						},
+						mfestInfo)
+				}
 				existingRegEntry := sc.Inv[rootReg]
 				if len(existingRegEntry) == 0 {
 					sc.Inv[rootReg] = currentRepo
@@ -1319,6 +2074,7 @@ func (sc *SyncContext) ReadRegistries(
 
 			// Process child repos.
 			if recurse {
+				childReqs := make([]stream.ExternalRequest, 0)
 				for _, childRepoName := range tagsStruct.Children {
 					parentRC, _ := req.RequestParams.(RegistryContext)
 
@@ -1340,12 +2096,20 @@ func (sc *SyncContext) ReadRegistries(
 					var childReq stream.ExternalRequest
 					childReq.RequestParams = childRc
 					childReq.StreamProducer = mkProducer(sc, childRc)
-
-					// Every time we "descend" into child nodes, increment the
-					// semaphore.
-					wg.Add(1)
-					reqs <- childReq
+					childReqs = append(childReqs, childReq)
 				}
+
+				// Every time we "descend" into child nodes, increment the
+				// semaphore.
+				wg.Add(len(childReqs))
+				// Enqueue the child requests from a separate goroutine, because
+				// this worker may be the only one left to drain the reqs
+				// channel (e.g., if sc.Threads is 1).
+				go func() {
+					for _, childReq := range childReqs {
+						reqs <- childReq
+					}
+				}()
 			}
 			// When we're done processing this node (req), decrement the
 			// semaphore.
@@ -1353,19 +2117,36 @@ func (sc *SyncContext) ReadRegistries(
 			requestResults <- reqRes
 		}
 	}
+	// ExecRequests() only tells us that something went wrong; readErrors has
+	// the details.
+	// nolint[errcheck]
 	sc.ExecRequests(populateRequests, processRequest)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(readErrors) > 0 {
+		sort.Strings(readErrors)
+		return fmt.Errorf("could not read %d repositories:\n%s",
+			len(readErrors),
+			strings.Join(readErrors, "\n"))
+	}
+	return nil
 }
 
 // ReadGCRManifestLists reads all manifest lists and populates the ParentDigest
 // field of the SyncContext. ParentDigest is a map of values of the form
 // map[ChildDigest]ParentDigest; and so, if a digest has an entry in this map,
-// it is referenced by a parent DockerManifestList.
+// it is referenced by a parent DockerManifestList. An error is returned if any
+// manifest list could not be read.
 //
 // TODO: Combine this function with ReadRegistries().
 //
 // nolint[gocyclo]
 func (sc *SyncContext) ReadGCRManifestLists(
-	mkProducer func(*SyncContext, GCRManifestListContext) stream.Producer) {
+	mkProducer func(*SyncContext, GCRManifestListContext) stream.Producer,
+) error {
 
 	// Collect all images in sc.Inv (the src and dest registry names found in
 	// the manifest).
@@ -1374,7 +2155,7 @@ func (sc *SyncContext) ReadGCRManifestLists(
 		reqs chan<- stream.ExternalRequest,
 		wg *sync.WaitGroup) {
 
-		// Find all images that are of ggcrV1Types.MediaType == DockerManifestList; these
+		// Find all images that are manifest lists (see isManifestList()); these
 		// images will be queried.
 		for registryName, rii := range sc.Inv {
 			var rc RegistryContext
@@ -1385,7 +2166,7 @@ func (sc *SyncContext) ReadGCRManifestLists(
 			}
 			for imageName, digestTags := range rii {
 				for digest, tagSlice := range digestTags {
-					if sc.DigestMediaType[digest] == ggcrV1Types.DockerManifestList {
+					if isManifestList(sc.DigestMediaType[digest]) {
 						// Create the request.
 						var req stream.ExternalRequest
 						var tag Tag
@@ -1445,7 +2226,7 @@ func (sc *SyncContext) ReadGCRManifestLists(
 			requestResults <- reqRes
 		}
 	}
-	sc.ExecRequests(populateRequests, processRequest)
+	return sc.ExecRequests(populateRequests, processRequest)
 }
 
 // FilterByTag removes all images in RegInvImage that do not match the
@@ -1534,40 +2315,12 @@ func SplitByKnownRegistries(
 }
 
 // MkReadRepositoryCmdReal creates a stream.Producer which makes a real call
-// over the network.
+// over the network, using the RegistryClient of the given registry.
 func MkReadRepositoryCmdReal(
 	sc *SyncContext,
 	rc RegistryContext) stream.Producer {
 
-	var sh stream.HTTP
-
-	tokenKey, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
-
-	httpReq, err := http.NewRequest(
-		"GET",
-		fmt.Sprintf("https://%s/v2/%s/tags/list", domain, repoPath),
-		nil)
-
-	if err != nil {
-		klog.Fatalf(
-			"could not create HTTP request for '%s/%s'",
-			domain,
-			repoPath)
-	}
-
-	if sc.UseServiceAccount {
-		token, ok := sc.Tokens[RootRepo(tokenKey)]
-		if !ok {
-			klog.Exitf("access token for key '%s' not found\n", tokenKey)
-		}
-
-		rc.Token = token
-		var bearer = "Bearer " + string(rc.Token)
-		httpReq.Header.Add("Authorization", bearer)
-	}
-
-	sh.Req = httpReq
-	return &sh
+	return sc.registryClient(rc).ListTags(sc, rc)
 }
 
 // MkReadManifestListCmdReal creates a stream.Producer which makes a real call
@@ -1579,47 +2332,8 @@ func MkReadManifestListCmdReal(
 	sc *SyncContext,
 	gmlc GCRManifestListContext) stream.Producer {
 
-	var sh stream.HTTP
-
-	tokenKey, domain, repoPath := GetTokenKeyDomainRepoPath(
-		gmlc.RegistryContext.Name)
-
-	endpoint := fmt.Sprintf(
-		"https://%s/v2/%s/%s/manifests/%s",
-		domain,
-		repoPath,
-		gmlc.ImageName,
-		// Always refer by a digest, because it may be the case that this
-		// manifest list is not actually tagged!
-		gmlc.Digest)
-
-	httpReq, err := http.NewRequest("GET", endpoint, nil)
-
-	// Without this, GCR responds as we had used the "Accept:
-	// application/vnd.docker.distribution.manifest.v1+prettyjws" header.
-	httpReq.Header.Add("Accept", "*/*")
-
-	if err != nil {
-		klog.Fatalf(
-			"could not create HTTP request for manifest list '%s/%s/%s:%s'",
-			domain,
-			repoPath,
-			gmlc.ImageName,
-			gmlc.Digest)
-	}
-
-	if sc.UseServiceAccount {
-		token, ok := sc.Tokens[RootRepo(tokenKey)]
-		if !ok {
-			klog.Exitf("access token for key '%s' not found\n", tokenKey)
-		}
-
-		var bearer = "Bearer " + string(token)
-		httpReq.Header.Add("Authorization", bearer)
-	}
-
-	sh.Req = httpReq
-	return &sh
+	return sc.registryClient(gmlc.RegistryContext).GetManifest(
+		sc, gmlc)
 }
 
 // ExecRequests uses the Worker Pool pattern, where MaxConcurrentRequests
@@ -1641,14 +2355,13 @@ func (sc *SyncContext) ExecRequests(
 	// number of workers, we don't know the number of jobs.
 	wg := new(sync.WaitGroup)
 
-	var err error
+	var failed Errors
 	// Log any errors encountered.
 	go func() {
 		for reqRes := range requestResults {
 			if len(reqRes.Errors) > 0 {
 				(*mutex).Lock()
-				err = fmt.Errorf("Encountered an error during the" +
-					" promotion step")
+				failed = append(failed, reqRes.Errors...)
 				sc.Logs.Errors = append(sc.Logs.Errors, reqRes.Errors...)
 				(*mutex).Unlock()
 				klog.Errorf(
@@ -1688,7 +2401,10 @@ func (sc *SyncContext) ExecRequests(
 	// single point).
 	close(requestResults)
 
-	return err
+	if len(failed) > 0 {
+		return RequestErrors{failed}
+	}
+	return nil
 }
 
 func extractRegistryTags(reader io.Reader) (*ggcrV1Google.Tags, error) {
@@ -1918,16 +2634,6 @@ func MKPopulateRequestsForPromotionEdges(
 			tp := Add
 			oldDigest := Digest("")
 
-			_, dp := promoteMe.VertexProps(sc.Inv)
-
-			if dp.PqinExists {
-				if !dp.DigestExists {
-					// Pqin points to the wrong digest.
-					klog.Errorf("edge %s: tag '%s' in dest points to %s, not %s (as per the manifest), but tag moves are not supported; skipping\n", promoteMe, promoteMe.DstImageTag.Tag, dp.BadDigest, promoteMe.Digest)
-					continue
-				}
-			}
-
 			// Do not invoke mkProducer for Add or Move operations.
 			if tp == Delete {
 				req.StreamProducer = mkProducer(
@@ -1965,27 +2671,34 @@ func MKPopulateRequestsForPromotionEdges(
 
 // RunChecks runs defined PreChecks in order to check the promotion.
 func (sc *SyncContext) RunChecks(
+	ctx context.Context,
 	preChecks []PreCheck,
 ) error {
 
 	var errors []error
 	for _, preCheck := range preChecks {
+		// Do not start any more checks once ctx is done.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		err := preCheck.Run()
 		if err != nil {
-			klog.Error(err)
+			logging.Log().Error(err, "check failed",
+				"check", fmt.Sprintf("%T", preCheck))
 			errors = append(errors, err)
 		}
 	}
 
 	if errors != nil {
-		return fmt.Errorf("%v error(s) encountered during the prechecks",
-			len(errors))
+		return PreCheckErrors{errors}
 	}
 	return nil
 }
 
 // FilterPromotionEdges generates all "edges" that we want to promote.
 func (sc *SyncContext) FilterPromotionEdges(
+	ctx context.Context,
 	edges map[PromotionEdge]interface{},
 	readRepos bool,
 ) (map[PromotionEdge]interface{}, bool) {
@@ -1993,14 +2706,20 @@ func (sc *SyncContext) FilterPromotionEdges(
 	if readRepos {
 		regs := getRegistriesToRead(edges)
 		for _, reg := range regs {
-			klog.Info("reading this reg:", reg)
+			logging.Log().Info("reading registry", "registry", reg.Name)
 		}
-		sc.ReadRegistries(
+		err := sc.ReadRegistries(
+			ctx,
 			regs,
 			// Do not read these registries recursively, because we already know
 			// exactly which repositories to read (getRegistriesToRead()).
 			false,
 			MkReadRepositoryCmdReal)
+		// The images of the repositories that could not be read are ignored
+		// from promotion, so it is safe to carry on.
+		if err != nil {
+			klog.Error(err)
+		}
 	}
 
 	return sc.GetPromotionCandidates(edges)
@@ -2092,11 +2811,93 @@ func getRegistriesToRead(
 	return rcsFinal
 }
 
+// newCopyLimiter creates a copyLimiter which allows up to maxParallel copies
+// at the same time, within the given budget (which may be nil).
+func newCopyLimiter(maxParallel int, budget *Budget) *copyLimiter {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+	return &copyLimiter{
+		slots:      make(chan struct{}, maxParallel),
+		budget:     budget,
+		keyMutexes: make(map[string]*sync.Mutex),
+		copied:     make(map[string]bool),
+	}
+}
+
+// run runs the copy of the image with the given key (the destination FQIN),
+// once no other copy of the same key is running, and a slot is free. The copy
+// is told whether the same key has already been copied successfully.
+func (cl *copyLimiter) run(
+	key string,
+	copyImage func(copied bool) error) error {
+	cl.mutex.Lock()
+	keyMutex, ok := cl.keyMutexes[key]
+	if !ok {
+		keyMutex = &sync.Mutex{}
+		cl.keyMutexes[key] = keyMutex
+	}
+	cl.mutex.Unlock()
+
+	// Take the slot last, so that waiting for a copy of the same key does
+	// not hold up other copies.
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	cl.slots <- struct{}{}
+	defer func() { <-cl.slots }()
+	cl.budget.Acquire()
+	defer cl.budget.Release()
+
+	err := copyImage(cl.copied[key])
+	if err == nil {
+		cl.mutex.Lock()
+		cl.copied[key] = true
+		cl.mutex.Unlock()
+	}
+	return err
+}
+
+// copyWithTimeout runs the copy with a context which is done once ctx is, or
+// once the copy has run for longer than timeout (if positive). The copy must
+// stop once its context is done (see SyncContext.withContext()), so that it
+// does not outlive its slot of the copyLimiter.
+func copyWithTimeout(
+	ctx context.Context,
+	timeout time.Duration,
+	copyImage func(ctx context.Context) error) error {
+
+	copyCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		copyCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := copyImage(copyCtx)
+	if err != nil && copyCtx.Err() != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("copy timed out after %v", timeout)
+	}
+	return err
+}
+
 // Promote perferms container image promotion by realizing the intent in the
-// Manifest.
+// Manifest. At most sc.MaxParallelImages images are copied at the same time
+// (see copyLimiter). The returned PromotionResult lists the promoted and the
+// failed edges, as well as those that FilterPromotionEdges() skipped because
+// they were already promoted. Copies that take longer than sc.CopyTimeout
+// fail, without holding up the other ones. Once ctx is done, no more images
+// are copied (the remaining edges fail), and ctx.Err() is returned. Every
+// other edge is attempted even if some fail; with sc.KeepGoing, the returned
+// error then lists all the failed edges (see PromotionFailures). With
+// sc.VerifyDigests, every copy is read back, and fails unless it has the
+// digest of its source. The progress is reported to sc.Progress, if set.
 //
 // nolint[gocyclo]
 func (sc *SyncContext) Promote(
+	ctx context.Context,
 	edges map[PromotionEdge]interface{},
 	mkProducer func(
 		RegistryName,
@@ -2106,22 +2907,51 @@ func (sc *SyncContext) Promote(
 		Digest,
 		Tag,
 		TagOp) stream.Producer,
-	customProcessRequest *ProcessRequest) error {
+	customProcessRequest *ProcessRequest) (PromotionResult, error) {
+
+	recorder := newPromotionRecorder()
 
 	if len(edges) == 0 {
 		klog.Info("Nothing to promote.")
-		return nil
+		res := recorder.result(sc, sc.AlreadyPromoted)
+		res.logSummary()
+		return res, nil
+	}
+
+	if sc.CopyReferrers {
+		edges = sc.AddReferrerEdges(edges)
 	}
 
-	klog.Info("Pending promotions:")
+	// Every digest is copied only once into every destination image; the
+	// remaining tags of the digest are added to that copy (see copyLimiter).
+	groups := CollapsePromotionEdges(edges)
+	edges = ExpandPromotionEdges(groups)
+
+	// Tags cannot be moved, so the edges that would move one are skipped, and
+	// counted as such.
+	skipped := sc.skipTagMoves(edges)
+
+	logging.Log().Info(
+		"pending promotions",
+		"count", len(edges),
+		"copies", len(groups))
 	for edge := range edges {
-		klog.Infof("  %v\n", edge)
+		logging.Log().Info("pending promotion", edge.logFields()...)
 	}
 
 	var populateRequests = MKPopulateRequestsForPromotionEdges(
 		edges,
 		mkProducer)
 
+	limiter := newCopyLimiter(sc.MaxParallelImages, sc.Budget)
+	// Every copy is made with its own context (see copyWithTimeout()), from a
+	// snapshot of sc taken before the requests start writing to it (e.g., to
+	// sc.Logs).
+	copySC := *sc
+
+	recorder.progress = sc.newProgressTracker(edges)
+	recorder.progress.run(sc.ProgressInterval)
+
 	var processRequest ProcessRequest
 	var processRequestReal ProcessRequest = func(
 		sc *SyncContext,
@@ -2135,11 +2965,9 @@ func (sc *SyncContext) Promote(
 			errors := make(Errors, 0)
 			// If we're adding or moving (i.e., creating a new image or
 			// overwriting), do not bother shelling out to gcloud. Instead just
-			// use the gcrane.doCopy() method directly.
+			// copy the image directly (see CopyImage()).
 
 			var err error
-			var stdoutReader io.Reader
-			var stderrReader io.Reader
 
 			rpr := req.RequestParams.(PromotionRequest)
 			switch rpr.TagOp {
@@ -2163,44 +2991,64 @@ func (sc *SyncContext) Promote(
 						rpr.Digest)
 				}
 
-				if err := crane.Copy(srcVertex, dstVertex); err != nil {
-					klog.Error(err)
+				srcRC := RegistryContext{Name: rpr.RegistrySrc}
+				dstRC := RegistryContext{
+					Name:           rpr.RegistryDest,
+					ServiceAccount: rpr.ServiceAccount,
+				}
+				copyKey := ToFQIN(
+					rpr.RegistryDest,
+					rpr.ImageNameDest,
+					rpr.Digest)
+				// Only the copy itself is timed, not the wait for the
+				// limiter.
+				var elapsed time.Duration
+				err = limiter.run(copyKey, func(copied bool) error {
+					// Do not start any more copies once ctx is done.
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					start := time.Now()
+					defer func() { elapsed = time.Since(start) }()
+					fromRC, from := srcRC, srcVertex
+					if copied && len(sc.Platforms) == 0 {
+						// The digest is already in the destination image,
+						// so it only needs to be tagged. Filtered manifest
+						// lists have another digest there, so they are
+						// copied again (only their manifests are written).
+						fromRC, from = dstRC, copyKey
+					}
+					return copyWithTimeout(ctx, sc.CopyTimeout,
+						func(copyCtx context.Context) error {
+							return copySC.withContext(copyCtx).CopyImage(
+								fromRC, from, dstRC, dstVertex)
+						})
+				})
+				if err == nil && sc.VerifyDigests {
+					err = sc.verifyDigest(dstRC, dstVertex, rpr.Digest)
+				}
+				sc.Metrics.ObserveCopy(
+					int64(sc.DigestImageSize[rpr.Digest]),
+					elapsed,
+					err)
+				log := logging.Log().WithValues(
+					"image", rpr.ImageNameSrc,
+					"digest", rpr.Digest,
+					"tag", rpr.Tag,
+					"src", rpr.RegistrySrc,
+					"dst", rpr.RegistryDest)
+				if err != nil {
+					log.Error(err, "could not promote image")
 					errors = append(errors, Error{
 						Context: "running writeImage()",
 						Error:   err})
+				} else {
+					log.Info("promoted image")
 				}
 			case Move:
 				klog.Infof("tag moves are no longer supported")
 			case Delete:
-				stdoutReader, stderrReader, err = req.StreamProducer.Produce()
-				if err != nil {
-					errors = append(errors, Error{
-						Context: "running process",
-						Error:   err})
-				}
-				b, err := ioutil.ReadAll(stdoutReader)
-				if err != nil {
-					errors = append(errors, Error{
-						Context: "reading process stdout",
-						Error:   err})
-				}
-				be, err := ioutil.ReadAll(stderrReader)
-				if err != nil {
-					errors = append(errors, Error{
-						Context: "reading process stderr",
-						Error:   err})
-				}
-				// The add-tag has stderr; it uses stderr for debug messages, so
-				// don't count it as an error. Instead just print it out as extra
-				// info.
-				klog.Infof("process stdout:\n%v\n", string(b))
-				klog.Infof("process stderr:\n%v\n", string(be))
-				err = req.StreamProducer.Close()
-				if err != nil {
-					errors = append(errors, Error{
-						Context: "closing process",
-						Error:   err})
-				}
+				errors = append(errors, runTagProcess(req)...)
 			}
 
 			reqRes.Errors = errors
@@ -2221,13 +3069,94 @@ func (sc *SyncContext) Promote(
 		processRequest = *customProcessRequest
 	}
 
-	err := sc.ExecRequests(populateRequests, processRequest)
+	err := sc.ExecRequests(
+		populateRequests,
+		recorder.wrap(sc.auditRequests(processRequest)))
 
 	if sc.DryRun {
 		sc.PrintCapturedRequests(&captured)
+		for req := range captured {
+			recorder.record(req, nil)
+		}
 	}
 
-	return err
+	recorder.progress.finish()
+
+	res := recorder.result(sc, skipped)
+	res.logSummary()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	} else if err != nil && sc.KeepGoing && len(res.Failed) > 0 {
+		err = PromotionFailures{Failed: res.Failed}
+	}
+
+	return res, err
+}
+
+// skipTagMoves removes the edges whose destination tag points to another
+// digest from edges. It returns them along with the edges that were already
+// promoted (sc.AlreadyPromoted), i.e. all the skipped edges.
+func (sc *SyncContext) skipTagMoves(
+	edges map[PromotionEdge]interface{}) map[PromotionEdge]interface{} {
+
+	skipped := make(map[PromotionEdge]interface{})
+	for edge := range sc.AlreadyPromoted {
+		skipped[edge] = nil
+	}
+	for edge := range edges {
+		_, dp := edge.VertexProps(sc.Inv)
+		if !dp.PqinExists || dp.DigestExists {
+			continue
+		}
+
+		klog.Errorf("edge %v: tag '%s' in dest points to %s, not %s (as "+
+			"per the manifest), but tag moves are not supported; skipping\n",
+			edge,
+			edge.DstImageTag.Tag,
+			dp.BadDigest,
+			edge.Digest)
+		skipped[edge] = nil
+		delete(edges, edge)
+	}
+
+	return skipped
+}
+
+// runTagProcess runs the process of a tag-modifying request (e.g., a tag
+// deletion), and returns its errors.
+func runTagProcess(req stream.ExternalRequest) Errors {
+	errors := make(Errors, 0)
+	stdoutReader, stderrReader, err := req.StreamProducer.Produce()
+	if err != nil {
+		errors = append(errors, Error{
+			Context: "running process",
+			Error:   err})
+		return errors
+	}
+	b, err := ioutil.ReadAll(stdoutReader)
+	if err != nil {
+		errors = append(errors, Error{
+			Context: "reading process stdout",
+			Error:   err})
+	}
+	be, err := ioutil.ReadAll(stderrReader)
+	if err != nil {
+		errors = append(errors, Error{
+			Context: "reading process stderr",
+			Error:   err})
+	}
+	// The add-tag has stderr; it uses stderr for debug messages, so don't
+	// count it as an error. Instead just print it out as extra info.
+	klog.Infof("process stdout:\n%v\n", string(b))
+	klog.Infof("process stderr:\n%v\n", string(be))
+	err = req.StreamProducer.Close()
+	if err != nil {
+		errors = append(errors, Error{
+			Context: "closing process",
+			Error:   err})
+	}
+	return errors
 }
 
 // PrintCapturedRequests pretty-prints all given PromotionRequests.
@@ -2307,51 +3236,141 @@ func MkRequestCapturer(captured *CapturedRequests) ProcessRequest {
 	}
 }
 
-// GarbageCollect deletes all images that are not referenced by Docker tags.
-// nolint[gocyclo]
+// ReadGarbageCollectionInventory re-reads the repositories of the given edges
+// (which the promotion may have changed since FilterPromotionEdges() read
+// them), along with their manifest lists, for
+// GetGarbageCollectionCandidates(). An error is returned if any of them could
+// not be read, as garbage collection would then be unsafe.
+func (sc *SyncContext) ReadGarbageCollectionInventory(
+	ctx context.Context,
+	edges map[PromotionEdge]interface{}) error {
+
+	err := sc.ReadRegistries(
+		ctx,
+		getRegistriesToRead(edges),
+		false,
+		MkReadRepositoryCmdReal)
+	if err != nil {
+		return err
+	}
+	if err := sc.ReadGCRManifestLists(MkReadManifestListCmdReal); err != nil {
+		return fmt.Errorf("could not read manifest lists: %v", err)
+	}
+	return nil
+}
+
+// GetGarbageCollectionCandidates returns the deletion requests of the digests
+// in the destination registries of mfest that are not referenced by Docker
+// tags. Digests that are in mfest (tagless promotions), or that are referenced
+// by a manifest list (see ReadGCRManifestLists()), are never deleted. Neither
+// are the referrers of the kept digests, if sc.ReferrersAPI is set (see
+// keepReferrers()). The requests are sorted by registry, image and digest.
+func (sc *SyncContext) GetGarbageCollectionCandidates(
+	mfest Manifest) []PromotionRequest {
+
+	type imageDigest struct {
+		ImageName ImageName
+		Digest    Digest
+	}
+	inManifest := make(map[imageDigest]interface{})
+	for _, image := range mfest.Images {
+		for digest := range image.Dmap {
+			inManifest[imageDigest{image.ImageName, digest}] = nil
+		}
+	}
+
+	srcRegistryName := mfest.srcRegistryName()
+	candidates := make([]PromotionRequest, 0)
+	for _, registry := range mfest.Registries {
+		if registry.Name == srcRegistryName {
+			continue
+		}
+		for imageName, digestTags := range sc.Inv[registry.Name] {
+			imageCandidates := make(map[Digest]interface{})
+			for digest, tagArray := range digestTags {
+				if len(tagArray) > 0 {
+					continue
+				}
+				if _, ok := inManifest[imageDigest{imageName, digest}]; ok {
+					continue
+				}
+				if _, ok := sc.ParentDigest[digest]; ok {
+					continue
+				}
+				imageCandidates[digest] = nil
+			}
+			if sc.ReferrersAPI && len(imageCandidates) > 0 {
+				sc.keepReferrers(
+					registry, imageName, digestTags, imageCandidates)
+			}
+
+			for digest := range imageCandidates {
+				candidates = append(candidates, PromotionRequest{
+					Delete,
+					srcRegistryName,
+					registry.Name,
+					registry.ServiceAccount,
+
+					// No source image name, because tag deletions should only
+					// delete the what's in the destination registry
+					ImageName(""),
+
+					imageName,
+					digest,
+					"",
+					"",
+				})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.RegistryDest != b.RegistryDest {
+			return a.RegistryDest < b.RegistryDest
+		}
+		if a.ImageNameDest != b.ImageNameDest {
+			return a.ImageNameDest < b.ImageNameDest
+		}
+		return a.Digest < b.Digest
+	})
+	return candidates
+}
+
+// GarbageCollect deletes all images that are not referenced by Docker tags
+// (see GetGarbageCollectionCandidates()). In dry runs, the images that would be
+// deleted are only printed, along with their sizes. Once ctx is done, no more
+// images are deleted.
 func (sc *SyncContext) GarbageCollect(
+	ctx context.Context,
 	mfest Manifest,
 	mkProducer func(RegistryContext, ImageName, Digest) stream.Producer,
 	customProcessRequest *ProcessRequest) {
 
+	candidates := sc.GetGarbageCollectionCandidates(mfest)
+	registries := make(map[RegistryName]RegistryContext)
+	for _, registry := range mfest.Registries {
+		registries[registry.Name] = registry
+	}
+
 	var populateRequests PopulateRequests = func(
 		sc *SyncContext,
 		reqs chan<- stream.ExternalRequest,
 		wg *sync.WaitGroup) {
 
-		for _, registry := range mfest.Registries {
-			if registry.Name == sc.SrcRegistry.Name {
-				continue
-			}
-			for imageName, digestTags := range sc.Inv[registry.Name] {
-				for digest, tagArray := range digestTags {
-					if len(tagArray) == 0 {
-						var req stream.ExternalRequest
-						req.StreamProducer = mkProducer(
-							registry,
-							imageName,
-							digest)
-						req.RequestParams = PromotionRequest{
-							Delete,
-							sc.SrcRegistry.Name,
-							registry.Name,
-							registry.ServiceAccount,
-
-							// No source image name, because tag deletions
-							// should only delete the what's in the
-							// destination registry
-							ImageName(""),
-
-							imageName,
-							digest,
-							"",
-							"",
-						}
-						wg.Add(1)
-						reqs <- req
-					}
-				}
+		for _, candidate := range candidates {
+			// Do not queue any more deletions once ctx is done.
+			if ctx.Err() != nil {
+				return
 			}
+			var req stream.ExternalRequest
+			req.StreamProducer = mkProducer(
+				registries[candidate.RegistryDest],
+				candidate.ImageNameDest,
+				candidate.Digest)
+			req.RequestParams = candidate
+			wg.Add(1)
+			reqs <- req
 		}
 	}
 
@@ -2392,13 +3411,14 @@ func (sc *SyncContext) GarbageCollect(
 		processRequest = *customProcessRequest
 	}
 
-	err := sc.ExecRequests(populateRequests, processRequest)
+	err := sc.ExecRequests(populateRequests, sc.auditRequests(processRequest))
 	if err != nil {
 		klog.Info(err)
 	}
 
 	if sc.DryRun {
-		sc.PrintCapturedRequests(&captured)
+		klog.Infof("garbage collection candidates:\n%s",
+			sc.GarbageCollectionDiff(candidates))
 	}
 }
 
@@ -2412,12 +3432,23 @@ func supportedMediaType(v string) (ggcrV1Types.MediaType, error) {
 		return ggcrV1Types.DockerManifestSchema1Signed, nil
 	case ggcrV1Types.DockerManifestSchema2:
 		return ggcrV1Types.DockerManifestSchema2, nil
+	case ggcrV1Types.OCIImageIndex:
+		return ggcrV1Types.OCIImageIndex, nil
+	case ggcrV1Types.OCIManifestSchema1:
+		return ggcrV1Types.OCIManifestSchema1, nil
 	default:
 		return ggcrV1Types.MediaType(""),
 			fmt.Errorf("unsupported MediaType %s", v)
 	}
 }
 
+// isManifestList returns true if the MediaType is that of a manifest list
+// (which is called an image index in OCI parlance).
+func isManifestList(mediaType ggcrV1Types.MediaType) bool {
+	return mediaType == ggcrV1Types.DockerManifestList ||
+		mediaType == ggcrV1Types.OCIImageIndex
+}
+
 // ClearRepository wipes out all Docker images from a registry! Use with caution.
 // nolint[gocyclo]
 //
@@ -2515,6 +3546,7 @@ func (sc *SyncContext) ClearRepository(
 	if customProcessRequest != nil {
 		processRequest = *customProcessRequest
 	}
+	processRequest = sc.auditRequests(processRequest)
 
 	var isEqualTo (func(ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool) = func(want ggcrV1Types.MediaType) func(ggcrV1Types.MediaType) bool {
 		return func(got ggcrV1Types.MediaType) bool {
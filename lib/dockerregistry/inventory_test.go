@@ -17,13 +17,19 @@ limitations under the License.
 package inventory_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	cr "github.com/google/go-containerregistry/pkg/v1/types"
 	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
@@ -238,6 +244,327 @@ images:
 			reg.Manifest{},
 			fmt.Errorf("source registry must be set"),
 		},
+		{
+			"Docker Hub registry with credentials",
+			`registries:
+- name: docker.io/bar
+  username: bar-robot
+  token-env: DOCKER_HUB_TOKEN
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:     "docker.io/bar",
+						Username: "bar-robot",
+						TokenEnv: "DOCKER_HUB_TOKEN",
+					},
+					{
+						Name:           "gcr.io/foo",
+						ServiceAccount: "src@google-containers.iam.gserviceaccount.com",
+						Src:            true,
+					},
+				},
+
+				Images: []reg.Image{},
+			},
+			nil,
+		},
+		{
+			"Username without token-env (invalid)",
+			`registries:
+- name: docker.io/bar
+  username: bar-robot
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{},
+			fmt.Errorf("registries[0] (\"docker.io/bar\"): 'username' and 'token-env' fields must be set together"),
+		},
+		{
+			"Registries with credentials files",
+			`registries:
+- name: docker.io/bar
+  credentials-file: /secrets/bar/config.json
+- name: gcr.io/foo
+  credentials-file: /secrets/foo/config.json
+  src: true
+images: []
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:            "docker.io/bar",
+						CredentialsFile: "/secrets/bar/config.json",
+					},
+					{
+						Name:            "gcr.io/foo",
+						CredentialsFile: "/secrets/foo/config.json",
+						Src:             true,
+					},
+				},
+
+				Images: []reg.Image{},
+			},
+			nil,
+		},
+		{
+			"Credentials file with username (invalid)",
+			`registries:
+- name: docker.io/bar
+  username: bar-robot
+  token-env: DOCKER_HUB_TOKEN
+  credentials-file: /secrets/bar/config.json
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{},
+			fmt.Errorf("registries[0] (\"docker.io/bar\"): 'credentials-file' cannot be used with 'username' and 'token-env'"),
+		},
+		{
+			"Harbor registry",
+			`registries:
+- name: harbor.example.com/bar
+  provider: harbor
+- name: harbor.example.com/foo
+  provider: harbor
+  src: true
+images: []
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:     "harbor.example.com/bar",
+						Provider: "harbor",
+					},
+					{
+						Name:     "harbor.example.com/foo",
+						Provider: "harbor",
+						Src:      true,
+					},
+				},
+
+				Images: []reg.Image{},
+			},
+			nil,
+		},
+		{
+			"Unknown provider (invalid)",
+			`registries:
+- name: registry.example.com/bar
+  provider: nexus
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{},
+			fmt.Errorf("registries[0] (\"registry.example.com/bar\"): unknown 'provider' \"nexus\" (supported: \"harbor\", \"local\")"),
+		},
+		{
+			"Local registry",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: airgap.local/builds
+  provider: local
+  path: /builds/oci
+  src: true
+images: []
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:           "gcr.io/bar",
+						ServiceAccount: "foobar@google-containers.iam.gserviceaccount.com",
+					},
+					{
+						Name:     "airgap.local/builds",
+						Provider: "local",
+						Path:     "/builds/oci",
+						Src:      true,
+					},
+				},
+
+				Images: []reg.Image{},
+			},
+			nil,
+		},
+		{
+			"Local registry as destination (invalid)",
+			`registries:
+- name: airgap.local/builds
+  provider: local
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{},
+			fmt.Errorf("registries[0] (\"airgap.local/builds\"): local registries must set 'path'\nregistries[0] (\"airgap.local/builds\"): local registries are read-only, and must set 'src: true'"),
+		},
+		{
+			"Path without local provider (invalid)",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+  path: /builds/oci
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images: []
+`,
+			reg.Manifest{},
+			fmt.Errorf("registries[0] (\"gcr.io/bar\"): 'path' requires 'provider: local'"),
+		},
+		{
+			"Tag patterns without dmap",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  tagPatterns: ["v1.*"]
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:           "gcr.io/bar",
+						ServiceAccount: "foobar@google-containers.iam.gserviceaccount.com",
+					},
+					{
+						Name:           "gcr.io/foo",
+						ServiceAccount: "src@google-containers.iam.gserviceaccount.com",
+						Src:            true,
+					},
+				},
+
+				Images: []reg.Image{
+					{ImageName: "agave",
+						TagPatterns: []string{"v1.*"},
+					},
+				},
+			},
+			nil,
+		},
+		{
+			"All tags without dmap",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  promoteAllTags: true
+`,
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:           "gcr.io/bar",
+						ServiceAccount: "foobar@google-containers.iam.gserviceaccount.com",
+					},
+					{
+						Name:           "gcr.io/foo",
+						ServiceAccount: "src@google-containers.iam.gserviceaccount.com",
+						Src:            true,
+					},
+				},
+
+				Images: []reg.Image{
+					{ImageName: "agave",
+						PromoteAllTags: true,
+					},
+				},
+			},
+			nil,
+		},
+		{
+			"Registry and image without name (invalid)",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+- dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+`,
+			reg.Manifest{},
+			fmt.Errorf("source registry must be set\n" +
+				"registries[1]: 'name' field cannot be empty\n" +
+				"images[1]: 'name' field cannot be empty"),
+		},
+		{
+			"Image without digests (invalid)",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0"]
+- name: banana
+`,
+			reg.Manifest{},
+			fmt.Errorf("images[1] (\"banana\"): 'dmap' field cannot be empty " +
+				"(set 'tagPatterns' or 'promoteAllTags' to promote tags by name)"),
+		},
+		{
+			"Invalid digests and tags (invalid)",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  dmap:
+    "sha256:0000000000000000000000000000000000000000000000000000000000000000": ["1.0", "-bad"]
+- name: banana
+  dmap:
+    "sha256:000": ["1.0"]
+    "sha256:1111111111111111111111111111111111111111111111111111111111111111": ["1.1"]
+`,
+			reg.Manifest{},
+			fmt.Errorf("images[0] (\"agave\"): 'dmap' (digest " +
+				"sha256:0000000000000000000000000000000000000000000000000000000000000000): " +
+				"invalid tag: -bad\n" +
+				"images[1] (\"banana\"): 'dmap': invalid digest: sha256:000"),
+		},
+		{
+			"Invalid tag pattern",
+			`registries:
+- name: gcr.io/bar
+  service-account: foobar@google-containers.iam.gserviceaccount.com
+- name: gcr.io/foo
+  service-account: src@google-containers.iam.gserviceaccount.com
+  src: true
+images:
+- name: agave
+  tagPatterns: ["v1.[0-"]
+`,
+			reg.Manifest{},
+			fmt.Errorf("images[0] (\"agave\"): 'tagPatterns': invalid tag pattern: v1.[0-"),
+		},
 	}
 
 	// Test only the JSON unmarshalling logic.
@@ -265,32 +592,116 @@ images:
 	}
 }
 
-func TestParseThinManifestsFromDir(t *testing.T) {
-	pwd := bazelTestPath("TestParseThinManifestsFromDir")
-
+func TestParseManifestFromDir(t *testing.T) {
 	var tests = []struct {
 		name string
 		// "input" is folder name, relative to the location of this source file.
 		input              string
-		expectedOutput     []reg.Manifest
+		expectedOutput     reg.Manifest
 		expectedParseError error
 	}{
 		{
-			"No manifests found (invalid)",
-			"empty",
-			[]reg.Manifest{},
-			&os.PathError{
-				Op:   "stat",
-				Path: filepath.Join(pwd, "empty/images"),
-				Err:  fmt.Errorf("no such file or directory"),
-			},
-		},
-		{
-			"Singleton (single manifest)",
-			"singleton",
-			[]reg.Manifest{
-				{
-					Registries: []reg.RegistryContext{
+			"Two files are merged",
+			"merge",
+			reg.Manifest{
+				Registries: []reg.RegistryContext{
+					{
+						Name:           "us.gcr.io/some-prod",
+						ServiceAccount: "sa@robot.com",
+					},
+					{
+						Name:           "gcr.io/foo-staging",
+						ServiceAccount: "sa@robot.com",
+						Src:            true,
+					},
+				},
+				Images: []reg.Image{
+					{
+						ImageName: "foo-controller",
+						Dmap: reg.DigestTags{
+							"sha256:c3d310f4741b3642497da8826e0986db5e02afc9777a2b8e668c8e41034128c1": {"1.0", "latest"},
+							"sha256:0000000000000000000000000000000000000000000000000000000000000000": {"2.0"},
+						},
+					},
+					{
+						ImageName: "bar-controller",
+						Dmap: reg.DigestTags{
+							"sha256:0000000000000000000000000000000000000000000000000000000000000000": {"1.0"},
+						},
+					},
+				},
+				AllowedRemovals: []reg.ImageName{"baz-controller"},
+			},
+			nil,
+		},
+		{
+			"Conflicting tag definitions across files",
+			"conflict",
+			reg.Manifest{},
+			fmt.Errorf(
+				"conflicting definitions of foo-controller:1.0 in %q: the tag points to both sha256:c3d310f4741b3642497da8826e0986db5e02afc9777a2b8e668c8e41034128c1 and sha256:0000000000000000000000000000000000000000000000000000000000000000",
+				bazelTestPath("TestParseManifestFromDir", "conflict", "b.yaml")),
+		},
+	}
+
+	for _, test := range tests {
+		fixtureDir := bazelTestPath("TestParseManifestFromDir", test.input)
+
+		got, errParse := reg.ParseManifestFromFile(fixtureDir)
+
+		var errParseStr string
+		var expectedParseErrorStr string
+		if errParse != nil {
+			errParseStr = errParse.Error()
+		}
+		if test.expectedParseError != nil {
+			expectedParseErrorStr = test.expectedParseError.Error()
+		}
+		eqErr := checkEqual(errParseStr, expectedParseErrorStr)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (error)\n", test.name))
+
+		if test.expectedParseError != nil {
+			continue
+		}
+
+		// Clear the fields calculated on-the-fly.
+		got.SrcRegistry = nil
+		test.expectedOutput.Filepath = fixtureDir
+
+		eqErr = checkEqual(got, test.expectedOutput)
+		checkError(
+			t,
+			eqErr,
+			fmt.Sprintf("Test: %v (Manifest)\n", test.name))
+	}
+}
+
+func TestParseThinManifestsFromDir(t *testing.T) {
+	pwd := bazelTestPath("TestParseThinManifestsFromDir")
+
+	var tests = []struct {
+		name string
+		// "input" is folder name, relative to the location of this source file.
+		input              string
+		expectedOutput     []reg.Manifest
+		expectedParseError error
+	}{
+		{
+			"No manifests found (invalid)",
+			"empty",
+			[]reg.Manifest{},
+			&os.PathError{
+				Op:   "stat",
+				Path: filepath.Join(pwd, "empty/images"),
+				Err:  fmt.Errorf("no such file or directory"),
+			},
+		},
+		{
+			"Singleton (single manifest)",
+			"singleton",
+			[]reg.Manifest{
+				{
+					Registries: []reg.RegistryContext{
 						{
 							Name:           "gcr.io/foo-staging",
 							ServiceAccount: "sa@robot.com",
@@ -1241,14 +1652,324 @@ func TestReadRegistries(t *testing.T) {
 			sr.Bytes = []byte(fakeHTTPBody)
 			return &sr
 		}
-		sc.ReadRegistries(rcs, true, mkFakeStream1)
+		err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeStream1)
+		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
 		got := sc.Inv[fakeRegName]
 		expected := test.expectedOutput
-		err := checkEqual(got, expected)
+		err = checkEqual(got, expected)
 		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
 	}
 }
 
+// TestReadRegistriesErrors tests that errors from reading repositories are
+// aggregated and returned.
+func TestReadRegistriesErrors(t *testing.T) {
+	// Give up on the first failed attempt, instead of retrying for minutes.
+	backoff := stream.BackoffDefault
+	stream.BackoffDefault.Steps = 1
+	defer func() { stream.BackoffDefault = backoff }()
+
+	const fakeRegName reg.RegistryName = "gcr.io/foo"
+	rcs := []reg.RegistryContext{
+		{
+			Name:           fakeRegName,
+			ServiceAccount: "robot",
+		},
+	}
+	// The child repo "broken" cannot be read, but its siblings can.
+	input := map[string]string{
+		"gcr.io/foo": `{
+  "child": [
+    "bar",
+    "broken"
+  ],
+  "manifest": {},
+  "name": "foo",
+  "tags": []
+}`,
+		"gcr.io/foo/bar": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "imageSizeBytes": "1",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": [
+        "1.0"
+      ],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/bar",
+  "tags": [
+    "1.0"
+  ]
+}`,
+		"gcr.io/foo/broken": `not JSON`,
+	}
+	mkFakeStream := func(sc *reg.SyncContext, rc reg.RegistryContext) stream.Producer {
+		_, domain, repoPath := reg.GetTokenKeyDomainRepoPath(rc.Name)
+		return &stream.Fake{Bytes: []byte(input[domain+"/"+repoPath])}
+	}
+
+	sc := reg.SyncContext{
+		// Read one repository at a time, for determinism.
+		Threads:          1,
+		RegistryContexts: rcs,
+		Inv:              map[reg.RegistryName]reg.RegInvImage{fakeRegName: nil},
+		DigestMediaType:  make(reg.DigestMediaType),
+		DigestImageSize:  make(reg.DigestImageSize)}
+
+	err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeStream)
+	if err == nil {
+		t.Fatal("Test: read errors: expected an error, got nil")
+	}
+	eqErr := checkEqual(
+		err.Error(),
+		"could not read 1 repositories:\n"+
+			"gcr.io/foo/broken: timed out waiting for the condition")
+	checkError(t, eqErr, "Test: read errors\n")
+
+	// The readable repositories must still be in the inventory.
+	eqErr = checkEqual(
+		sc.Inv[fakeRegName],
+		reg.RegInvImage{
+			"bar": {"sha256:000": {"1.0"}}})
+	checkError(t, eqErr, "Test: partial inventory\n")
+}
+
+// recordingProducer is a stream.Fake which calls onProduce whenever it is
+// read.
+type recordingProducer struct {
+	stream.Fake
+	onProduce func()
+}
+
+func (p *recordingProducer) Produce() (io.Reader, io.Reader, error) {
+	p.onProduce()
+	return p.Fake.Produce()
+}
+
+// TestReadRegistriesCancel tests that no more repositories are read once the
+// context is cancelled.
+func TestReadRegistriesCancel(t *testing.T) {
+	const fakeRegName reg.RegistryName = "gcr.io/foo"
+	rcs := []reg.RegistryContext{
+		{
+			Name:           fakeRegName,
+			ServiceAccount: "robot",
+		},
+	}
+	input := map[string]string{
+		"gcr.io/foo": `{
+  "child": [
+    "a",
+    "b"
+  ],
+  "manifest": {},
+  "name": "foo",
+  "tags": []
+}`,
+		"gcr.io/foo/a": `{
+  "child": [],
+  "manifest": {},
+  "name": "foo/a",
+  "tags": []
+}`,
+		"gcr.io/foo/b": `{
+  "child": [],
+  "manifest": {},
+  "name": "foo/b",
+  "tags": []
+}`,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel the context while the toplevel repository is being read (e.g.,
+	// because of a CTRL-C); its child repositories must not be read.
+	var mutex sync.Mutex
+	reads := make([]string, 0)
+	mkFakeStream := func(sc *reg.SyncContext, rc reg.RegistryContext) stream.Producer {
+		_, domain, repoPath := reg.GetTokenKeyDomainRepoPath(rc.Name)
+		repo := domain + "/" + repoPath
+		return &recordingProducer{
+			Fake: stream.Fake{Bytes: []byte(input[repo])},
+			onProduce: func() {
+				mutex.Lock()
+				reads = append(reads, repo)
+				mutex.Unlock()
+				cancel()
+			},
+		}
+	}
+
+	sc := reg.SyncContext{
+		Threads:          1,
+		RegistryContexts: rcs,
+		Inv:              map[reg.RegistryName]reg.RegInvImage{fakeRegName: nil},
+		DigestMediaType:  make(reg.DigestMediaType),
+		DigestImageSize:  make(reg.DigestImageSize)}
+
+	err := sc.ReadRegistries(ctx, rcs, true, mkFakeStream)
+	eqErr := checkEqual(err, context.Canceled)
+	checkError(t, eqErr, "Test: cancelled read (error)\n")
+
+	eqErr = checkEqual(reads, []string{"gcr.io/foo"})
+	checkError(t, eqErr, "Test: cancelled read (reads)\n")
+}
+
+func TestExpandTagPatterns(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	rcs := []reg.RegistryContext{srcRC, destRC}
+	input := map[string]string{
+		"gcr.io/foo/a": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "imageSizeBytes": "1",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": [
+        "v1.0",
+        "latest"
+      ],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    },
+    "sha256:111": {
+      "imageSizeBytes": "1",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": [
+        "v1.1"
+      ],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    },
+    "sha256:222": {
+      "imageSizeBytes": "1",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": [
+        "v2.0"
+      ],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/a",
+  "tags": [
+    "latest",
+    "v1.0",
+    "v1.1",
+    "v2.0"
+  ]
+}`,
+		"gcr.io/foo/empty": `{
+  "child": [],
+  "manifest": {},
+  "name": "foo/empty",
+  "tags": []
+}`,
+	}
+	mkFakeStream := func(sc *reg.SyncContext, rc reg.RegistryContext) stream.Producer {
+		_, domain, repoPath := reg.GetTokenKeyDomainRepoPath(rc.Name)
+		return &stream.Fake{Bytes: []byte(input[domain+"/"+repoPath])}
+	}
+
+	var tests = []struct {
+		name     string
+		image    reg.Image
+		expected reg.DigestTags
+	}{
+		{
+			"Pattern matching multiple tags",
+			reg.Image{
+				ImageName:   "a",
+				TagPatterns: []string{"v1.*"},
+			},
+			reg.DigestTags{
+				"sha256:000": {"v1.0"},
+				"sha256:111": {"v1.1"},
+			},
+		},
+		{
+			"Pattern matching no tags",
+			reg.Image{
+				ImageName:   "a",
+				TagPatterns: []string{"v3.*"},
+			},
+			reg.DigestTags{},
+		},
+		{
+			"Explicit tags are kept",
+			reg.Image{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"stable", "v1.0"}},
+				TagPatterns: []string{"v1.*", "v2.?"},
+			},
+			reg.DigestTags{
+				"sha256:000": {"stable", "v1.0"},
+				"sha256:111": {"v1.1"},
+				"sha256:222": {"v2.0"},
+			},
+		},
+		{
+			"All tags",
+			reg.Image{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"stable"}},
+				PromoteAllTags: true,
+			},
+			reg.DigestTags{
+				"sha256:000": {"stable", "v1.0", "latest"},
+				"sha256:111": {"v1.1"},
+				"sha256:222": {"v2.0"},
+			},
+		},
+		{
+			"All tags of an empty repository",
+			reg.Image{
+				ImageName:      "empty",
+				PromoteAllTags: true,
+			},
+			reg.DigestTags{},
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Threads:          1,
+			RegistryContexts: rcs,
+			Inv:              make(reg.MasterInventory),
+			DigestMediaType:  make(reg.DigestMediaType),
+			DigestImageSize:  make(reg.DigestImageSize)}
+		mfests := []reg.Manifest{
+			{
+				Registries:  rcs,
+				Images:      []reg.Image{test.image},
+				SrcRegistry: &srcRC,
+			},
+		}
+
+		err := sc.ExpandTagPatterns(context.Background(), mfests, mkFakeStream)
+		eqErr := checkEqual(err, nil)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (error)\n", test.name))
+
+		eqErr = checkEqual(mfests[0].Images[0].Dmap, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (dmap)\n", test.name))
+	}
+}
+
 // TestReadGManifestLists tests reading ManifestList information from GCR.
 func TestReadGManifestLists(t *testing.T) {
 	const fakeRegName reg.RegistryName = "gcr.io/foo"
@@ -1549,259 +2270,705 @@ func TestSetManipulationsRegInvImageTag(t *testing.T) {
 				reg.ImageTag{"pear", "latest"}: "123"},
 		},
 		{
-			"Set Intersection (both blank)",
-			reg.RegInvImageTag{},
-			reg.RegInvImageTag{},
-			reg.RegInvImageTag.Intersection,
-			reg.RegInvImageTag{},
+			"Set Intersection (both blank)",
+			reg.RegInvImageTag{},
+			reg.RegInvImageTag{},
+			reg.RegInvImageTag.Intersection,
+			reg.RegInvImageTag{},
+		},
+		{
+			"Set Intersection (first blank)",
+			reg.RegInvImageTag{},
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "123"},
+			reg.RegInvImageTag.Intersection,
+			reg.RegInvImageTag{},
+		},
+		{
+			"Set Intersection (second blank)",
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "123"},
+			reg.RegInvImageTag{},
+			reg.RegInvImageTag.Intersection,
+			reg.RegInvImageTag{},
+		},
+		{
+			"Set Intersection (no intersection)",
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "123"},
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "1.0"}: "123"},
+			reg.RegInvImageTag.Intersection,
+			reg.RegInvImageTag{},
+		},
+		{
+			"Set Intersection (some intersection)",
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "this-is-kept",
+				reg.ImageTag{"pear", "1.0"}:    "123"},
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "this-is-lost",
+				reg.ImageTag{"foo", "2.0"}:     "def"},
+			// The intersection code throws out the second value, because it
+			// treats a Map as a Set (and doesn't care about preserving
+			// information for the key's value).
+			reg.RegInvImageTag.Intersection,
+			reg.RegInvImageTag{
+				reg.ImageTag{"pear", "latest"}: "this-is-kept"},
+		},
+	}
+
+	for _, test := range tests {
+		got := test.op(test.input1, test.input2)
+		expected := test.expectedOutput
+		err := checkEqual(got, expected)
+		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
+
+func TestToPromotionEdges(t *testing.T) {
+	srcRegName := reg.RegistryName("gcr.io/foo")
+	destRegName := reg.RegistryName("gcr.io/bar")
+	destRegName2 := reg.RegistryName("gcr.io/cat")
+	destRC := reg.RegistryContext{
+		Name:           destRegName,
+		ServiceAccount: "robot",
+	}
+	destRC2 := reg.RegistryContext{
+		Name:           destRegName2,
+		ServiceAccount: "robot",
+	}
+	srcRC := reg.RegistryContext{
+		Name:           srcRegName,
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	registries1 := []reg.RegistryContext{destRC, srcRC}
+	registries2 := []reg.RegistryContext{destRC, srcRC, destRC2}
+
+	sc := reg.SyncContext{
+		Inv: reg.MasterInventory{
+			"gcr.io/foo": reg.RegInvImage{
+				"a": {
+					"sha256:000": {"0.9"}},
+				"c": {
+					"sha256:222": {"2.0"},
+					"sha256:333": {"3.0"}}},
+			"gcr.io/bar": {
+				"a": {
+					"sha256:000": {"0.9"}},
+				"b": {
+					"sha256:111": {}},
+				"c": {
+					"sha256:222": {"2.0"},
+					"sha256:333": {"3.0"}}},
+			"gcr.io/cat": {
+				"a": {
+					"sha256:000": {"0.9"}},
+				"c": {
+					"sha256:222": {"2.0"},
+					"sha256:333": {"3.0"}}}}}
+
+	var tests = []struct {
+		name                  string
+		input                 []reg.Manifest
+		expectedInitial       map[reg.PromotionEdge]interface{}
+		expectedInitialErr    error
+		expectedFiltered      map[reg.PromotionEdge]interface{}
+		expectedFilteredClean bool
+	}{
+		{
+			"Basic case (1 new edge; already promoted)",
+			[]reg.Manifest{
+				{
+					Registries: registries1,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {"0.9"}}}},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.PromotionEdge]interface{}{
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"},
+					Digest:      "sha256:000",
+					DstRegistry: destRC,
+					DstImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"}}: nil,
+			},
+			nil,
+			make(map[reg.PromotionEdge]interface{}),
+			true,
+		},
+		{
+			"Basic case (2 new edges; already promoted)",
+			[]reg.Manifest{
+				{
+					Registries: registries2,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {"0.9"}}}},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.PromotionEdge]interface{}{
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"},
+					Digest:      "sha256:000",
+					DstRegistry: destRC,
+					DstImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"}}: nil,
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"},
+					Digest:      "sha256:000",
+					DstRegistry: destRC2,
+					DstImageTag: reg.ImageTag{
+						ImageName: "a",
+						Tag:       "0.9"}}: nil,
+			},
+			nil,
+			make(map[reg.PromotionEdge]interface{}),
+			true,
+		},
+		{
+			"Tag move (tag swap image c:2.0 and c:3.0)",
+			[]reg.Manifest{
+				{
+					Registries: registries2,
+					Images: []reg.Image{
+						{
+							ImageName: "c",
+							Dmap: reg.DigestTags{
+								"sha256:222": {"3.0"},
+								"sha256:333": {"2.0"}}}},
+					SrcRegistry: &srcRC},
+			},
+			map[reg.PromotionEdge]interface{}{
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "2.0"},
+					Digest:      "sha256:333",
+					DstRegistry: destRC,
+					DstImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "2.0"}}: nil,
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "3.0"},
+					Digest:      "sha256:222",
+					DstRegistry: destRC,
+					DstImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "3.0"}}: nil,
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "2.0"},
+					Digest:      "sha256:333",
+					DstRegistry: destRC2,
+					DstImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "2.0"}}: nil,
+				{
+					SrcRegistry: srcRC,
+					SrcImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "3.0"},
+					Digest:      "sha256:222",
+					DstRegistry: destRC2,
+					DstImageTag: reg.ImageTag{
+						ImageName: "c",
+						Tag:       "3.0"}}: nil,
+			},
+			nil,
+			make(map[reg.PromotionEdge]interface{}),
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		// Finalize Manifests.
+		for i := range test.input {
+			// Skip errors.
+			_ = test.input[i].Finalize()
+		}
+		got, gotErr := reg.ToPromotionEdges(test.input)
+		err := checkEqual(got, test.expectedInitial)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (ToPromotionEdges)\n", test.name))
+
+		err = checkEqual(gotErr, test.expectedInitialErr)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (ToPromotionEdges (error mismatch)\n", test.name))
+
+		got, gotClean := sc.GetPromotionCandidates(got)
+		err = checkEqual(got, test.expectedFiltered)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (getPromotionCandidates)\n", test.name))
+
+		err = checkEqual(gotClean, test.expectedFilteredClean)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (getPromotionCandidates (cleanliness mismatch)\n", test.name))
+	}
+}
+
+func TestGetPromotionCandidatesAdditiveOnly(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	inv := reg.MasterInventory{
+		"gcr.io/foo": {
+			"a": {
+				"sha256:000": {"1.0"},
+				"sha256:111": {"2.0"},
+				"sha256:222": {"3.0"}}},
+		"gcr.io/bar": {
+			"a": {
+				"sha256:000": {"1.0"},
+				"sha256:999": {"3.0"}}},
+	}
+	// "1.0" is unchanged, "2.0" is new, and "3.0" already points to another
+	// digest in the destination.
+	mfests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"1.0"},
+						"sha256:111": {"2.0"},
+						"sha256:222": {"3.0"}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "checkError: test: ToPromotionEdges\n")
+
+	mkEdge := func(digest reg.Digest, tag reg.Tag) reg.PromotionEdge {
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: "a", Tag: tag},
+			Digest:      digest,
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{ImageName: "a", Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name            string
+		additiveOnly    bool
+		expected        map[reg.PromotionEdge]interface{}
+		expectedClean   bool
+		expectedSkipped map[reg.PromotionEdge]interface{}
+	}{
+		{
+			"Existing tags are moved by default",
+			false,
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:111", "2.0"): nil,
+				mkEdge("sha256:222", "3.0"): nil,
+			},
+			true,
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:000", "1.0"): nil,
+			},
+		},
+		{
+			"Only new tags are promoted in additive-only mode",
+			true,
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:111", "2.0"): nil,
+			},
+			false,
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:000", "1.0"): nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Inv:          inv,
+			AdditiveOnly: test.additiveOnly,
+		}
+		got, gotClean := sc.GetPromotionCandidates(edges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n", test.name))
+		err = checkEqual(gotClean, test.expectedClean)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (clean)\n", test.name))
+		err = checkEqual(sc.AlreadyPromoted, test.expectedSkipped)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (skipped)\n", test.name))
+	}
+}
+
+func TestSelectPromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{destRC, srcRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo-controller",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"v1.0", "v1.1"},
+					"sha256:111": {"v2.0"}}},
+			{
+				ImageName: "foo-webhook",
+				Dmap: reg.DigestTags{
+					"sha256:222": {"v1.0"}}},
+			{
+				ImageName: "bar",
+				Dmap: reg.DigestTags{
+					"sha256:333": {}}},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	mkEdge := func(
+		image reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag) reg.PromotionEdge {
+
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name         string
+		imagePattern string
+		tagPattern   string
+		expected     map[reg.PromotionEdge]interface{}
+		expectedErr  error
+	}{
+		{
+			"Image pattern matching a subset",
+			"foo-*",
+			"",
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "sha256:000", "v1.1"): nil,
+				mkEdge("foo-controller", "sha256:111", "v2.0"): nil,
+				mkEdge("foo-webhook", "sha256:222", "v1.0"):    nil,
+			},
+			nil,
 		},
 		{
-			"Set Intersection (first blank)",
-			reg.RegInvImageTag{},
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "123"},
-			reg.RegInvImageTag.Intersection,
-			reg.RegInvImageTag{},
+			"Image and tag patterns",
+			"foo-controller",
+			"v1.*",
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "sha256:000", "v1.1"): nil,
+			},
+			nil,
 		},
 		{
-			"Set Intersection (second blank)",
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "123"},
-			reg.RegInvImageTag{},
-			reg.RegInvImageTag.Intersection,
-			reg.RegInvImageTag{},
+			"Tag pattern matching tagless edges",
+			"",
+			"*",
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "sha256:000", "v1.1"): nil,
+				mkEdge("foo-controller", "sha256:111", "v2.0"): nil,
+				mkEdge("foo-webhook", "sha256:222", "v1.0"):    nil,
+				mkEdge("bar", "sha256:333", ""):                nil,
+			},
+			nil,
 		},
 		{
-			"Set Intersection (no intersection)",
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "123"},
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "1.0"}: "123"},
-			reg.RegInvImageTag.Intersection,
-			reg.RegInvImageTag{},
+			"Patterns matching nothing",
+			"baz",
+			"",
+			map[reg.PromotionEdge]interface{}{},
+			nil,
 		},
 		{
-			"Set Intersection (some intersection)",
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "this-is-kept",
-				reg.ImageTag{"pear", "1.0"}:    "123"},
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "this-is-lost",
-				reg.ImageTag{"foo", "2.0"}:     "def"},
-			// The intersection code throws out the second value, because it
-			// treats a Map as a Set (and doesn't care about preserving
-			// information for the key's value).
-			reg.RegInvImageTag.Intersection,
-			reg.RegInvImageTag{
-				reg.ImageTag{"pear", "latest"}: "this-is-kept"},
+			"Invalid pattern",
+			"foo-[",
+			"",
+			nil,
+			fmt.Errorf("invalid image pattern: foo-["),
 		},
 	}
 
 	for _, test := range tests {
-		got := test.op(test.input1, test.input2)
-		expected := test.expectedOutput
-		err := checkEqual(got, expected)
-		checkError(t, err, fmt.Sprintf("Test: %v\n", test.name))
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
+
+		got, err := reg.SelectPromotionEdges(
+			edges,
+			test.imagePattern,
+			test.tagPattern)
+
+		eqErr := checkEqual(err, test.expectedErr)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (error)\n",
+			test.name))
+
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
 	}
 }
 
-func TestToPromotionEdges(t *testing.T) {
-	srcRegName := reg.RegistryName("gcr.io/foo")
-	destRegName := reg.RegistryName("gcr.io/bar")
-	destRegName2 := reg.RegistryName("gcr.io/cat")
-	destRC := reg.RegistryContext{
-		Name:           destRegName,
+func TestSelectDestinationEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
 		ServiceAccount: "robot",
+		Src:            true,
 	}
-	destRC2 := reg.RegistryContext{
-		Name:           destRegName2,
+	usRC := reg.RegistryContext{
+		Name:           "us.gcr.io/bar",
 		ServiceAccount: "robot",
 	}
-	srcRC := reg.RegistryContext{
-		Name:           srcRegName,
+	euRC := reg.RegistryContext{
+		Name:           "eu.gcr.io/bar",
 		ServiceAccount: "robot",
-		Src:            true,
 	}
-	registries1 := []reg.RegistryContext{destRC, srcRC}
-	registries2 := []reg.RegistryContext{destRC, srcRC, destRC2}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{usRC, euRC, srcRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo-controller",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"v1.0", "v1.1"}}},
+			{
+				ImageName: "bar",
+				Dmap: reg.DigestTags{
+					"sha256:111": {}}},
+		},
+		SrcRegistry: &srcRC,
+	}
 
-	sc := reg.SyncContext{
-		Inv: reg.MasterInventory{
-			"gcr.io/foo": reg.RegInvImage{
-				"a": {
-					"sha256:000": {"0.9"}},
-				"c": {
-					"sha256:222": {"2.0"},
-					"sha256:333": {"3.0"}}},
-			"gcr.io/bar": {
-				"a": {
-					"sha256:000": {"0.9"}},
-				"b": {
-					"sha256:111": {}},
-				"c": {
-					"sha256:222": {"2.0"},
-					"sha256:333": {"3.0"}}},
-			"gcr.io/cat": {
-				"a": {
-					"sha256:000": {"0.9"}},
-				"c": {
-					"sha256:222": {"2.0"},
-					"sha256:333": {"3.0"}}}}}
+	mkEdge := func(
+		dest reg.RegistryContext,
+		image reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag) reg.PromotionEdge {
+
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: dest,
+			DstImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+		}
+	}
+	euEdges := map[reg.PromotionEdge]interface{}{
+		mkEdge(euRC, "foo-controller", "sha256:000", "v1.0"): nil,
+		mkEdge(euRC, "foo-controller", "sha256:000", "v1.1"): nil,
+		mkEdge(euRC, "bar", "sha256:111", ""):                nil,
+	}
 
 	var tests = []struct {
-		name                  string
-		input                 []reg.Manifest
-		expectedInitial       map[reg.PromotionEdge]interface{}
-		expectedInitialErr    error
-		expectedFiltered      map[reg.PromotionEdge]interface{}
-		expectedFilteredClean bool
+		name         string
+		destRegistry reg.RegistryName
+		expectedLen  int
+		expected     map[reg.PromotionEdge]interface{}
+		expectedErr  error
 	}{
 		{
-			"Basic case (1 new edge; already promoted)",
-			[]reg.Manifest{
-				{
-					Registries: registries1,
-					Images: []reg.Image{
-						{
-							ImageName: "a",
-							Dmap: reg.DigestTags{
-								"sha256:000": {"0.9"}}}},
-					SrcRegistry: &srcRC},
-			},
-			map[reg.PromotionEdge]interface{}{
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"},
-					Digest:      "sha256:000",
-					DstRegistry: destRC,
-					DstImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"}}: nil,
-			},
+			"No destination registry",
+			"",
+			6,
+			nil,
 			nil,
-			make(map[reg.PromotionEdge]interface{}),
-			true,
 		},
 		{
-			"Basic case (2 new edges; already promoted)",
-			[]reg.Manifest{
-				{
-					Registries: registries2,
-					Images: []reg.Image{
-						{
-							ImageName: "a",
-							Dmap: reg.DigestTags{
-								"sha256:000": {"0.9"}}}},
-					SrcRegistry: &srcRC},
-			},
-			map[reg.PromotionEdge]interface{}{
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"},
-					Digest:      "sha256:000",
-					DstRegistry: destRC,
-					DstImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"}}: nil,
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"},
-					Digest:      "sha256:000",
-					DstRegistry: destRC2,
-					DstImageTag: reg.ImageTag{
-						ImageName: "a",
-						Tag:       "0.9"}}: nil,
-			},
+			"One of two destination registries",
+			"eu.gcr.io/bar",
+			3,
+			euEdges,
 			nil,
-			make(map[reg.PromotionEdge]interface{}),
-			true,
 		},
 		{
-			"Tag move (tag swap image c:2.0 and c:3.0)",
-			[]reg.Manifest{
-				{
-					Registries: registries2,
-					Images: []reg.Image{
-						{
-							ImageName: "c",
-							Dmap: reg.DigestTags{
-								"sha256:222": {"3.0"},
-								"sha256:333": {"2.0"}}}},
-					SrcRegistry: &srcRC},
+			"Trailing slash",
+			"eu.gcr.io/bar/",
+			3,
+			euEdges,
+			nil,
+		},
+		{
+			"Unknown destination registry",
+			"asia.gcr.io/bar",
+			0,
+			nil,
+			fmt.Errorf("no image is promoted to destination registry " +
+				"asia.gcr.io/bar " +
+				"(destination registries: eu.gcr.io/bar, us.gcr.io/bar)"),
+		},
+		{
+			// The source registry is not a destination.
+			"Source registry",
+			"gcr.io/foo",
+			0,
+			nil,
+			fmt.Errorf("no image is promoted to destination registry " +
+				"gcr.io/foo " +
+				"(destination registries: eu.gcr.io/bar, us.gcr.io/bar)"),
+		},
+	}
+
+	for _, test := range tests {
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
+
+		got, err := reg.SelectDestinationEdges(edges, test.destRegistry)
+
+		eqErr := checkEqual(err, test.expectedErr)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (error)\n",
+			test.name))
+
+		eqErr = checkEqual(len(got), test.expectedLen)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (count)\n",
+			test.name))
+
+		if test.expected != nil {
+			eqErr = checkEqual(got, test.expected)
+			checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (edges)\n",
+				test.name))
+		}
+	}
+}
+
+func TestPrefixPromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{destRC, srcRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo-controller",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"v1.0", "v1.1"}}},
+			{
+				ImageName: "nested/baz",
+				Dmap: reg.DigestTags{
+					"sha256:111": {}}},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	mkEdge := func(
+		image reg.ImageName,
+		dstImage reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag) reg.PromotionEdge {
+
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{ImageName: dstImage, Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name        string
+		prefix      string
+		expected    map[reg.PromotionEdge]interface{}
+		expectedErr error
+	}{
+		{
+			"No prefix",
+			"",
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("foo-controller", "foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "foo-controller", "sha256:000", "v1.1"): nil,
+				mkEdge("nested/baz", "nested/baz", "sha256:111", ""):             nil,
 			},
+			nil,
+		},
+		{
+			"Prefix",
+			"mirror",
 			map[reg.PromotionEdge]interface{}{
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "2.0"},
-					Digest:      "sha256:333",
-					DstRegistry: destRC,
-					DstImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "2.0"}}: nil,
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "3.0"},
-					Digest:      "sha256:222",
-					DstRegistry: destRC,
-					DstImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "3.0"}}: nil,
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "2.0"},
-					Digest:      "sha256:333",
-					DstRegistry: destRC2,
-					DstImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "2.0"}}: nil,
-				{
-					SrcRegistry: srcRC,
-					SrcImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "3.0"},
-					Digest:      "sha256:222",
-					DstRegistry: destRC2,
-					DstImageTag: reg.ImageTag{
-						ImageName: "c",
-						Tag:       "3.0"}}: nil,
+				mkEdge("foo-controller", "mirror/foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "mirror/foo-controller", "sha256:000", "v1.1"): nil,
+				mkEdge("nested/baz", "mirror/nested/baz", "sha256:111", ""):             nil,
 			},
 			nil,
-			make(map[reg.PromotionEdge]interface{}),
-			false,
+		},
+		{
+			"Nested prefix",
+			"mirror/k8s.io",
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("foo-controller", "mirror/k8s.io/foo-controller", "sha256:000", "v1.0"): nil,
+				mkEdge("foo-controller", "mirror/k8s.io/foo-controller", "sha256:000", "v1.1"): nil,
+				mkEdge("nested/baz", "mirror/k8s.io/nested/baz", "sha256:111", ""):             nil,
+			},
+			nil,
+		},
+		{
+			"Invalid prefix",
+			"mirror/",
+			nil,
+			fmt.Errorf("invalid destination prefix: mirror/"),
+		},
+		{
+			"Invalid prefix (uppercase)",
+			"Mirror",
+			nil,
+			fmt.Errorf("invalid destination prefix: Mirror"),
 		},
 	}
 
 	for _, test := range tests {
-		// Finalize Manifests.
-		for i := range test.input {
-			// Skip errors.
-			_ = test.input[i].Finalize()
-		}
-		got, gotErr := reg.ToPromotionEdges(test.input)
-		err := checkEqual(got, test.expectedInitial)
-		checkError(t, err, fmt.Sprintf("checkError: test: %v (ToPromotionEdges)\n", test.name))
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
 
-		err = checkEqual(gotErr, test.expectedInitialErr)
-		checkError(t, err, fmt.Sprintf("checkError: test: %v (ToPromotionEdges (error mismatch)\n", test.name))
+		got, err := reg.PrefixPromotionEdges(edges, test.prefix)
 
-		got, gotClean := sc.GetPromotionCandidates(got)
-		err = checkEqual(got, test.expectedFiltered)
-		checkError(t, err, fmt.Sprintf("checkError: test: %v (getPromotionCandidates)\n", test.name))
+		eqErr := checkEqual(err, test.expectedErr)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (error)\n",
+			test.name))
 
-		err = checkEqual(gotClean, test.expectedFilteredClean)
-		checkError(t, err, fmt.Sprintf("checkError: test: %v (getPromotionCandidates (cleanliness mismatch)\n", test.name))
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
 	}
 }
 
@@ -2005,6 +3172,125 @@ func (c *FakeCheckAlwaysFail) Run() error {
 	return fmt.Errorf("there was an error in the pull request check")
 }
 
+func TestCollapsePromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "sa@robot.com",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "sa@robot.com",
+	}
+	registries := []reg.RegistryContext{srcRC, destRC}
+
+	mkEdge := func(
+		name reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag) reg.PromotionEdge {
+
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: name, Tag: tag},
+			Digest:      digest,
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{ImageName: name, Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name             string
+		input            []reg.Manifest
+		expectedGroups   map[reg.PromotionEdge]reg.TagSlice
+		expectedExpanded map[reg.PromotionEdge]interface{}
+	}{
+		{
+			"Two manifests promoting the same digest under different tags",
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {"latest"}}},
+					},
+					SrcRegistry: &srcRC,
+				},
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {"1.0"}}},
+					},
+					SrcRegistry: &srcRC,
+				},
+			},
+			map[reg.PromotionEdge]reg.TagSlice{
+				mkEdge("a", "sha256:000", ""): {"1.0", "latest"},
+			},
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("a", "sha256:000", "1.0"):    nil,
+				mkEdge("a", "sha256:000", "latest"): nil,
+			},
+		},
+		{
+			"Redundant tagless promotion",
+			[]reg.Manifest{
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {"1.0"}}},
+						{
+							ImageName: "b",
+							Dmap: reg.DigestTags{
+								"sha256:111": {}}},
+					},
+					SrcRegistry: &srcRC,
+				},
+				{
+					Registries: registries,
+					Images: []reg.Image{
+						{
+							ImageName: "a",
+							Dmap: reg.DigestTags{
+								"sha256:000": {}}},
+					},
+					SrcRegistry: &srcRC,
+				},
+			},
+			map[reg.PromotionEdge]reg.TagSlice{
+				mkEdge("a", "sha256:000", ""): {"1.0"},
+				mkEdge("b", "sha256:111", ""): {},
+			},
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("a", "sha256:000", "1.0"): nil,
+				mkEdge("b", "sha256:111", ""):    nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		edges, err := reg.ToPromotionEdges(test.input)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+
+		groups := reg.CollapsePromotionEdges(edges)
+		err = checkEqual(groups, test.expectedGroups)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (groups)\n",
+			test.name))
+
+		expanded := reg.ExpandPromotionEdges(groups)
+		err = checkEqual(expanded, test.expectedExpanded)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (expanded)\n",
+			test.name))
+	}
+}
+
 func TestRunChecks(t *testing.T) {
 	sc := reg.SyncContext{}
 
@@ -2025,7 +3311,9 @@ func TestRunChecks(t *testing.T) {
 			[]reg.PreCheck{
 				&FakeCheckAlwaysFail{},
 			},
-			fmt.Errorf("1 error(s) encountered during the prechecks"),
+			reg.PreCheckErrors{[]error{
+				fmt.Errorf("there was an error in the pull request check"),
+			}},
 		},
 		{
 			"Checking pull request with successful and unsuccessful checks",
@@ -2034,18 +3322,33 @@ func TestRunChecks(t *testing.T) {
 				&FakeCheckAlwaysFail{},
 				&FakeCheckAlwaysFail{},
 			},
-			fmt.Errorf("2 error(s) encountered during the prechecks"),
+			reg.PreCheckErrors{[]error{
+				fmt.Errorf("there was an error in the pull request check"),
+				fmt.Errorf("there was an error in the pull request check"),
+			}},
 		},
 	}
 
 	for _, test := range tests {
-		got := sc.RunChecks(test.checks)
+		got := sc.RunChecks(context.Background(), test.checks)
 		err := checkEqual(got, test.expected)
 		checkError(t, err,
 			fmt.Sprintf("checkError: test: %v (Error Tracking)\n", test.name))
 	}
 }
 
+func TestRunChecksCancel(t *testing.T) {
+	sc := reg.SyncContext{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The failing check must not even run.
+	got := sc.RunChecks(ctx, []reg.PreCheck{&FakeCheckAlwaysFail{}})
+	err := checkEqual(got, context.Canceled)
+	checkError(t, err, "checkError: test: cancelled checks\n")
+}
+
 // TestPromotion is the most important test as it simulates the main job of the
 // promoter.
 func TestPromotion(t *testing.T) {
@@ -2498,12 +3801,14 @@ func TestPromotion(t *testing.T) {
 		checkError(t, eqErr, fmt.Sprintf("Test: %v: (unexpected error getting promotion edges)\n", test.name))
 
 		filteredEdges, gotClean := test.inputSc.FilterPromotionEdges(
+			context.Background(),
 			edges,
 			false)
 		err = checkEqual(gotClean, test.expectedFilteredClean)
 		checkError(t, err, fmt.Sprintf("checkError: test: %v (edge filtering cleanliness mismatch)\n", test.name))
 
 		test.inputSc.Promote(
+			context.Background(),
 			filteredEdges,
 			nopStream,
 			&processRequestFake)
@@ -2513,6 +3818,163 @@ func TestPromotion(t *testing.T) {
 	}
 }
 
+// TestPromoteCancel tests that no images are copied once the context is
+// cancelled.
+func TestPromoteCancel(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "checkError: test: cancelled promotion (edges)\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The real (non-capturing) request processing is used, as it would try to
+	// copy the image over the network if it did not honor the cancellation.
+	sc := reg.SyncContext{}
+	got, err := sc.Promote(ctx, edges, nopStream, nil)
+	eqErr := checkEqual(err, context.Canceled)
+	checkError(t, eqErr, "checkError: test: cancelled promotion (error)\n")
+
+	eqErr = checkEqual(
+		got.Failed,
+		[]reg.PromotionEdgeResult{
+			{
+				Image:       "a",
+				Digest:      "sha256:000",
+				Source:      "gcr.io/foo/a",
+				Destination: "gcr.io/bar/a",
+				Tags:        reg.TagSlice{"1.0"},
+				Status:      reg.StatusFailed,
+				Errors:      []string{context.Canceled.Error()},
+			},
+		})
+	checkError(t, eqErr, "checkError: test: cancelled promotion (result)\n")
+}
+
+// TestPromoteCopyTimeout tests that copies which take longer than
+// sc.CopyTimeout fail, without holding up the other copies, and that their
+// requests are aborted.
+func TestPromoteCopyTimeout(t *testing.T) {
+	// The source registry never answers, until the request is aborted.
+	aborted := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			aborted <- struct{}{}
+		}))
+	defer server.Close()
+
+	srcRC := reg.RegistryContext{
+		Name: reg.RegistryName(strings.Replace(
+			server.URL, "http://127.0.0.1", "localhost", 1)),
+		Src: true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	digestA := reg.Digest("sha256:" + strings.Repeat("a", 64))
+	digestB := reg.Digest("sha256:" + strings.Repeat("b", 64))
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo",
+				Dmap: reg.DigestTags{
+					digestA: {"1.0"},
+					digestB: {"2.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "checkError: test: copy timeout (edges)\n")
+
+	// Even with a single copy at a time, both copies must time out (instead
+	// of the second one waiting for the first one forever).
+	sc := reg.SyncContext{
+		MaxParallelImages: 1,
+		CopyTimeout:       10 * time.Millisecond,
+	}
+	got, err := sc.Promote(context.Background(), edges, nopStream, nil)
+	eqErr := checkEqual(err != nil, true)
+	checkError(t, eqErr, "checkError: test: copy timeout (error)\n")
+
+	mkResult := func(digest reg.Digest, tag reg.Tag) reg.PromotionEdgeResult {
+		return reg.PromotionEdgeResult{
+			Image:       "foo",
+			Digest:      digest,
+			Source:      string(srcRC.Name) + "/foo",
+			Destination: "gcr.io/bar/foo",
+			Tags:        reg.TagSlice{tag},
+			Status:      reg.StatusFailed,
+			Errors:      []string{"copy timed out after 10ms"},
+		}
+	}
+	eqErr = checkEqual(
+		got.Failed,
+		[]reg.PromotionEdgeResult{
+			mkResult(digestA, "1.0"),
+			mkResult(digestB, "2.0"),
+		})
+	checkError(t, eqErr, "checkError: test: copy timeout (result)\n")
+
+	// The copies must not keep running in the background.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-aborted:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("copy %d was not aborted", i)
+		}
+	}
+}
+
 func TestExecRequests(t *testing.T) {
 	sc := reg.SyncContext{}
 
@@ -2567,6 +4029,9 @@ func TestExecRequests(t *testing.T) {
 		}
 	}
 
+	requestError := reg.Error{
+		Context: "Running TestExecRequests",
+		Error:   fmt.Errorf("This request results in an error")}
 	var processRequestError reg.ProcessRequest = func(
 		sc *reg.SyncContext,
 		reqs chan stream.ExternalRequest,
@@ -2576,9 +4041,7 @@ func TestExecRequests(t *testing.T) {
 		for req := range reqs {
 			reqRes := reg.RequestResult{Context: req}
 			errors := make(reg.Errors, 0)
-			errors = append(errors, reg.Error{
-				Context: "Running TestExecRequests",
-				Error:   fmt.Errorf("This request results in an error")})
+			errors = append(errors, requestError)
 			reqRes.Errors = errors
 			requestResults <- reqRes
 		}
@@ -2597,7 +4060,7 @@ func TestExecRequests(t *testing.T) {
 		{
 			"Error tracking for promotion with errors",
 			processRequestError,
-			fmt.Errorf("Encountered an error during the promotion step"),
+			reg.RequestErrors{reg.Errors{requestError, requestError}},
 		},
 	}
 
@@ -2712,6 +4175,41 @@ func TestGarbageCollection(t *testing.T) {
 					Tag:            ""}: 1,
 			},
 		},
+		{
+			"Tagless promotions and manifest list children are kept",
+			reg.Manifest{
+				Registries: registries,
+				Images: []reg.Image{
+					{
+						ImageName: "a",
+						Dmap: reg.DigestTags{
+							// Tagless promotion.
+							"sha256:000": {},
+							"sha256:333": {"0.8"},
+						}}}},
+			reg.SyncContext{
+				Inv: reg.MasterInventory{
+					"gcr.io/bar": {
+						"a": {
+							"sha256:000": nil,
+							"sha256:333": {"0.8"},
+							// Referenced by the manifest list sha256:333.
+							"sha256:444": nil,
+							"sha256:555": nil}}},
+				ParentDigest: reg.ParentDigest{
+					"sha256:444": "sha256:333"}},
+			reg.CapturedRequests{
+				reg.PromotionRequest{
+					TagOp:          reg.Delete,
+					RegistrySrc:    srcRegName,
+					RegistryDest:   registries[1].Name,
+					ServiceAccount: registries[1].ServiceAccount,
+					ImageNameSrc:   "",
+					ImageNameDest:  "a",
+					Digest:         "sha256:555",
+					Tag:            ""}: 1,
+			},
+		},
 	}
 
 	captured := make(reg.CapturedRequests)
@@ -2745,10 +4243,28 @@ func TestGarbageCollection(t *testing.T) {
 		checkError(t, err,
 			fmt.Sprintf("checkError (srcReg): test: %v\n", test.name))
 		test.inputSc.SrcRegistry = srcReg
-		test.inputSc.GarbageCollect(test.inputM, nopStream, &processRequestFake)
+		test.inputSc.GarbageCollect(
+			context.Background(),
+			test.inputM,
+			nopStream,
+			&processRequestFake)
 
 		err = checkEqual(captured, test.expectedReqs)
 		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+
+		// Nothing is deleted once the context is done.
+		captured = make(reg.CapturedRequests)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		test.inputSc.GarbageCollect(
+			ctx,
+			test.inputM,
+			nopStream,
+			&processRequestFake)
+
+		err = checkEqual(captured, reg.CapturedRequests{})
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (canceled)\n", test.name))
 	}
 }
 
@@ -2881,7 +4397,11 @@ func TestGarbageCollectionMulti(t *testing.T) {
 		checkError(t, err,
 			fmt.Sprintf("checkError (srcReg): test: %v\n", test.name))
 		test.inputSc.SrcRegistry = srcReg
-		test.inputSc.GarbageCollect(test.inputM, nopStream, &processRequestFake)
+		test.inputSc.GarbageCollect(
+			context.Background(),
+			test.inputM,
+			nopStream,
+			&processRequestFake)
 
 		err = checkEqual(captured, test.expectedReqs)
 		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
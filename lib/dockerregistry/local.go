@@ -0,0 +1,658 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	ggcrV1Layout "github.com/google/go-containerregistry/pkg/v1/layout"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// ProviderLocal is the RegistryContext provider of local registries, whose
+// images are read from an OCI image layout directory or a "docker save"
+// tarball (see RegistryContext's Path) instead of from the network.
+const ProviderLocal = "local"
+
+// ociRefNameAnnotation is the annotation that names the images of an OCI
+// image layout.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// localClient is the RegistryClient for local registries. Local registries
+// are read-only, so they can only be the source of a promotion.
+//
+// The name of a local registry (e.g. "airgap.local/builds") is only used to
+// refer to its images. The images themselves are served from the directory or
+// tarball by a localTransport, so that they are read (and copied) with the
+// standard registry API, like the images of any other registry.
+type localClient struct{}
+
+// GetToken returns an empty token, as local registries need no credentials.
+func (c *localClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	return "", nil
+}
+
+// ListTags creates a stream.Producer which reads the repository with the
+// standard registry API. For the toplevel registry, the images of the layout
+// (or tarball) are reported as its child repositories.
+func (c *localClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	r := registryV2Reader{
+		RegistryName: rc.Name,
+		Options:      c.RemoteOptions(sc, rc),
+	}
+
+	if sc.isToplevelRegistry(rc.Name) {
+		path := sc.toplevelRegistryContext(rc).Path
+		r.ListChildren = func() ([]string, error) {
+			store, err := openLocalStore(path)
+			if err != nil {
+				return nil, err
+			}
+			return store.imageNames(), nil
+		}
+	}
+
+	return &r
+}
+
+// GetManifest creates a stream.Producer which reads the manifest list (or OCI
+// image index) by digest with the standard registry API.
+func (c *localClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage always fails, as local registries are read-only.
+func (c *localClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return fmt.Errorf(
+		"cannot copy %q to %q: local registries are read-only", src, dst)
+}
+
+// RemoteOptions serves the registry from its layout or tarball.
+func (c *localClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	rc = sc.toplevelRegistryContext(rc)
+	return []ggcrV1Remote.Option{
+		ggcrV1Remote.WithTransport(&localTransport{
+			RegistryName: rc.Name,
+			Path:         rc.Path,
+		}),
+	}
+}
+
+// localStore holds the images of a local registry.
+type localStore struct {
+	// Images maps the name of every image to the digests of its tags.
+	Images map[ImageName]map[Tag]Digest
+	// ReadBlob opens a blob (or manifest) by digest, and returns its size.
+	ReadBlob func(digest Digest) (io.ReadCloser, int64, error)
+}
+
+var (
+	localStoresMutex sync.Mutex
+	// localStores caches the local registries that were opened, keyed by
+	// path, as reading a "docker save" tarball means compressing all of its
+	// layers.
+	localStores = make(map[string]*localStore)
+)
+
+// openLocalStore reads the OCI image layout (if path is a directory) or
+// "docker save" tarball (otherwise) at path.
+func openLocalStore(path string) (*localStore, error) {
+	localStoresMutex.Lock()
+	defer localStoresMutex.Unlock()
+
+	if store, ok := localStores[path]; ok {
+		return store, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var store *localStore
+	if info.IsDir() {
+		store, err = openOCILayout(path)
+	} else {
+		store, err = openDockerArchive(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	localStores[path] = store
+	return store, nil
+}
+
+// imageNames returns the (sorted) names of all images of the store.
+func (s *localStore) imageNames() []string {
+	names := []string{}
+	for imageName := range s.Images {
+		names = append(names, string(imageName))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addTag records that the tag of the image refers to digest.
+func (s *localStore) addTag(imageName ImageName, tag Tag, digest Digest) {
+	if _, ok := s.Images[imageName]; !ok {
+		s.Images[imageName] = make(map[Tag]Digest)
+	}
+	s.Images[imageName][tag] = digest
+}
+
+// splitImageTag splits a reference of the form "<image>:<tag>" (e.g.
+// "foo/bar:1.0") into the image name and the tag.
+func splitImageTag(ref string) (ImageName, Tag, bool) {
+	i := strings.LastIndex(ref, ":")
+	if i <= 0 || i == len(ref)-1 || strings.Contains(ref[i:], "/") {
+		return "", "", false
+	}
+	return ImageName(ref[:i]), Tag(ref[i+1:]), true
+}
+
+// openOCILayout reads the images of an OCI image layout. The images are the
+// entries of its index.json, which are named after their
+// "org.opencontainers.image.ref.name" annotation, in the form
+// "<image>:<tag>". Other entries are ignored.
+func openOCILayout(dir string) (*localStore, error) {
+	layoutPath, err := ggcrV1Layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := layoutPath.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	mfest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	store := localStore{
+		Images: make(map[ImageName]map[Tag]Digest),
+		ReadBlob: func(digest Digest) (io.ReadCloser, int64, error) {
+			h, err := ggcrV1.NewHash(string(digest))
+			if err != nil {
+				return nil, 0, err
+			}
+			f, err := os.Open(filepath.Join(dir, "blobs", h.Algorithm, h.Hex))
+			if err != nil {
+				return nil, 0, err
+			}
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			return f, info.Size(), nil
+		},
+	}
+
+	for _, desc := range mfest.Manifests {
+		ref := desc.Annotations[ociRefNameAnnotation]
+		imageName, tag, ok := splitImageTag(ref)
+		if !ok {
+			klog.Warningf(
+				"%s: ignoring %s, whose %s annotation (%q) is not of the "+
+					"form <image>:<tag>",
+				dir,
+				desc.Digest,
+				ociRefNameAnnotation,
+				ref)
+			continue
+		}
+		store.addTag(imageName, tag, Digest(desc.Digest.String()))
+	}
+
+	return &store, nil
+}
+
+// openDockerArchive reads the images of a "docker save" tarball. The images
+// are named after their RepoTags (e.g. "foo/bar:1.0").
+//
+// The layers of such tarballs are usually not compressed, so the images are
+// served as ggcr compresses them. Their digests are therefore not those of
+// the images that were saved, but those computed when reading the tarball.
+func openDockerArchive(path string) (*localStore, error) {
+	mfest, err := readDockerArchiveManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+	blobs := make(map[Digest]func() (io.ReadCloser, int64, error))
+	addBytes := func(digest Digest, b []byte) {
+		blobs[digest] = func() (io.ReadCloser, int64, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+		}
+	}
+
+	store := localStore{
+		Images: make(map[ImageName]map[Tag]Digest),
+		ReadBlob: func(digest Digest) (io.ReadCloser, int64, error) {
+			blob, ok := blobs[digest]
+			if !ok {
+				return nil, 0, os.ErrNotExist
+			}
+			return blob()
+		},
+	}
+
+	for _, desc := range mfest {
+		for _, repoTag := range desc.RepoTags {
+			imageName, tag, ok := splitImageTag(repoTag)
+			if !ok {
+				return nil, fmt.Errorf("invalid RepoTag %q", repoTag)
+			}
+			ref, err := name.NewTag(repoTag)
+			if err != nil {
+				return nil, err
+			}
+			img, err := ggcrV1Tarball.Image(opener, &ref)
+			if err != nil {
+				return nil, err
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				return nil, err
+			}
+			store.addTag(imageName, tag, Digest(digest.String()))
+
+			if _, ok := blobs[Digest(digest.String())]; ok {
+				continue
+			}
+			if err := addImageBlobs(img, blobs, addBytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &store, nil
+}
+
+// addImageBlobs adds the manifest, config and layers of img to blobs.
+func addImageBlobs(
+	img ggcrV1.Image,
+	blobs map[Digest]func() (io.ReadCloser, int64, error),
+	addBytes func(digest Digest, b []byte)) error {
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	addBytes(Digest(digest.String()), rawManifest)
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	addBytes(Digest(configName.String()), rawConfig)
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		layer := layer
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+		blobs[Digest(layerDigest.String())] = func() (
+			io.ReadCloser, int64, error) {
+
+			rc, err := layer.Compressed()
+			return rc, size, err
+		}
+	}
+
+	return nil
+}
+
+// readDockerArchiveManifest reads the manifest.json file of a "docker save"
+// tarball.
+func readDockerArchiveManifest(path string) (ggcrV1Tarball.Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("manifest.json not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+
+		var mfest ggcrV1Tarball.Manifest
+		if err := json.NewDecoder(tr).Decode(&mfest); err != nil {
+			return nil, fmt.Errorf("parsing manifest.json: %v", err)
+		}
+		return mfest, nil
+	}
+}
+
+// localTransport is an http.RoundTripper which serves the images of the local
+// registry RegistryName from the OCI image layout or "docker save" tarball at
+// Path. It implements the read-only part of the Docker Registry HTTP API V2
+// that is used by the promoter: listing tags, and reading manifests and blobs.
+// The host of the requests is ignored.
+type localTransport struct {
+	RegistryName RegistryName
+	Path         string
+}
+
+// registryError mirrors the error responses of the Docker Registry HTTP API
+// V2.
+type registryError struct {
+	Errors []registryErrorEntry `json:"errors"`
+}
+
+type registryErrorEntry struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RoundTrip serves a single request.
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.errorResponse(
+			req,
+			http.StatusMethodNotAllowed,
+			"UNSUPPORTED",
+			"local registries are read-only")
+	}
+
+	path := req.URL.Path
+	if path == "/v2" || path == "/v2/" {
+		return t.response(req, http.StatusOK, "application/json",
+			ioutil.NopCloser(strings.NewReader("{}")), 2)
+	}
+
+	store, err := openLocalStore(t.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	path = strings.TrimPrefix(path, "/v2/")
+	if repo := strings.TrimSuffix(path, "/tags/list"); repo != path {
+		return t.serveTags(req, store, repo)
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		return t.serveManifest(
+			req, store, path[:i], path[i+len("/manifests/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		return t.serveBlob(req, store, Digest(path[i+len("/blobs/"):]))
+	}
+
+	return t.errorResponse(
+		req, http.StatusNotFound, "UNSUPPORTED", "unsupported request")
+}
+
+// imageName returns the name of the image that the repository path repo
+// (e.g. "builds/foo" for "airgap.local/builds/foo") refers to.
+func (t *localTransport) imageName(repo string) (ImageName, error) {
+	// Refer to the registry like the image references built from it (see
+	// copyImageTo()), so that its repository path is the same.
+	parsed, err := name.NewRepository(string(t.RegistryName) + "/image")
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.TrimSuffix(parsed.RepositoryStr(), "image")
+	if !strings.HasPrefix(repo, prefix) {
+		return "", fmt.Errorf(
+			"repository %q is not in %s", repo, t.RegistryName)
+	}
+	return ImageName(strings.TrimPrefix(repo, prefix)), nil
+}
+
+func (t *localTransport) serveTags(
+	req *http.Request,
+	store *localStore,
+	repo string) (*http.Response, error) {
+
+	imageName, err := t.imageName(repo)
+	if err != nil {
+		return t.errorResponse(
+			req, http.StatusNotFound, "NAME_UNKNOWN", err.Error())
+	}
+	tagDigests, ok := store.Images[imageName]
+	if !ok {
+		return t.errorResponse(
+			req,
+			http.StatusNotFound,
+			"NAME_UNKNOWN",
+			fmt.Sprintf("image %q not found", imageName))
+	}
+
+	tags := []string{}
+	for tag := range tagDigests {
+		tags = append(tags, string(tag))
+	}
+	sort.Strings(tags)
+
+	b, err := json.Marshal(map[string]interface{}{
+		"name": repo,
+		"tags": tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.response(req, http.StatusOK, "application/json",
+		ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)))
+}
+
+func (t *localTransport) serveManifest(
+	req *http.Request,
+	store *localStore,
+	repo string,
+	ref string) (*http.Response, error) {
+
+	digest := Digest(ref)
+	if !strings.Contains(ref, ":") {
+		imageName, err := t.imageName(repo)
+		if err != nil {
+			return t.errorResponse(
+				req, http.StatusNotFound, "NAME_UNKNOWN", err.Error())
+		}
+		var ok bool
+		digest, ok = store.Images[imageName][Tag(ref)]
+		if !ok {
+			return t.errorResponse(
+				req,
+				http.StatusNotFound,
+				"MANIFEST_UNKNOWN",
+				fmt.Sprintf("%s:%s not found", imageName, ref))
+		}
+	}
+
+	rc, _, err := store.ReadBlob(digest)
+	if err != nil {
+		return t.errorResponse(
+			req,
+			http.StatusNotFound,
+			"MANIFEST_UNKNOWN",
+			fmt.Sprintf("manifest %s not found", digest))
+	}
+	defer rc.Close()
+	rawManifest, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.response(
+		req,
+		http.StatusOK,
+		string(manifestMediaType(rawManifest)),
+		ioutil.NopCloser(bytes.NewReader(rawManifest)),
+		int64(len(rawManifest)))
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Set("Docker-Content-Digest", string(digest))
+	return res, nil
+}
+
+func (t *localTransport) serveBlob(
+	req *http.Request,
+	store *localStore,
+	digest Digest) (*http.Response, error) {
+
+	rc, size, err := store.ReadBlob(digest)
+	if err != nil {
+		return t.errorResponse(
+			req,
+			http.StatusNotFound,
+			"BLOB_UNKNOWN",
+			fmt.Sprintf("blob %s not found", digest))
+	}
+
+	res, err := t.response(
+		req, http.StatusOK, "application/octet-stream", rc, size)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Set("Docker-Content-Digest", string(digest))
+	return res, nil
+}
+
+// manifestMediaType returns the media type of a raw manifest. Manifests
+// without a "mediaType" field are OCI image indexes if they list manifests,
+// and OCI image manifests otherwise.
+func manifestMediaType(rawManifest []byte) ggcrV1Types.MediaType {
+	var mfest struct {
+		MediaType ggcrV1Types.MediaType `json:"mediaType"`
+		Manifests []json.RawMessage     `json:"manifests"`
+	}
+	if err := json.Unmarshal(rawManifest, &mfest); err == nil &&
+		len(mfest.MediaType) > 0 {
+		return mfest.MediaType
+	}
+	if len(mfest.Manifests) > 0 {
+		return ggcrV1Types.OCIImageIndex
+	}
+	return ggcrV1Types.OCIManifestSchema1
+}
+
+// response builds the response to req. The body is dropped for HEAD
+// requests.
+func (t *localTransport) response(
+	req *http.Request,
+	status int,
+	contentType string,
+	body io.ReadCloser,
+	size int64) (*http.Response, error) {
+
+	if req.Method == http.MethodHead {
+		body.Close()
+		body = ioutil.NopCloser(strings.NewReader(""))
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}, nil
+}
+
+// errorResponse builds an error response to req, in the format of the Docker
+// Registry HTTP API V2.
+func (t *localTransport) errorResponse(
+	req *http.Request,
+	status int,
+	code string,
+	message string) (*http.Response, error) {
+
+	b, err := json.Marshal(registryError{
+		Errors: []registryErrorEntry{{Code: code, Message: message}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.response(req, status, "application/json",
+		ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)))
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	ggcrV1Layout "github.com/google/go-containerregistry/pkg/v1/layout"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+const (
+	// The digests of the images in the OCI layout fixture.
+	localFooDigest = "sha256:f2660480070c7801462f9b4e0cfdce5c7b3e4a3b7dad1c2db441c9f2a2ba131e"
+	localBarDigest = "sha256:e42c8e006e86e45199f230dbf6042a96110e25cfc06d46bbc8cd38b811161475"
+)
+
+// TestLocalRegistry reads the OCI layout fixture as a local source registry,
+// and promotes one of its images into an in-memory registry.
+func TestLocalRegistry(t *testing.T) {
+	pwd := bazelTestPath("TestLocalRegistry")
+	srcRC := reg.RegistryContext{
+		Name:     "airgap.local/builds",
+		Provider: reg.ProviderLocal,
+		Path:     filepath.Join(pwd, "oci"),
+		Src:      true,
+	}
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	destRC := reg.RegistryContext{Name: reg.RegistryName(host + "/prod")}
+
+	sc := reg.SyncContext{
+		RegistryContexts: []reg.RegistryContext{srcRC, destRC},
+		Inv:              reg.MasterInventory{srcRC.Name: nil},
+		DigestMediaType:  make(reg.DigestMediaType),
+		DigestImageSize:  make(reg.DigestImageSize),
+	}
+	err := sc.ReadRegistries(
+		context.Background(),
+		[]reg.RegistryContext{srcRC},
+		true,
+		reg.MkReadRepositoryCmdReal)
+	checkError(t, err, "Test: TestLocalRegistry\n")
+
+	// The index.json entry that is only named after its tag is ignored.
+	expectedInv := reg.MasterInventory{
+		"airgap.local/builds": {
+			"foo": {
+				localFooDigest: {"1.0", "latest"}},
+			"bar/baz": {
+				localBarDigest: {"2.0"}}},
+	}
+	err = checkEqual(sc.Inv, expectedInv)
+	checkError(t, err, "Test: TestLocalRegistry (inventory)\n")
+
+	err = checkEqual(
+		sc.DigestMediaType[localFooDigest],
+		ggcrV1Types.DockerManifestSchema2)
+	checkError(t, err, "Test: TestLocalRegistry (media type)\n")
+
+	// The size of the config and the layer.
+	err = checkEqual(sc.DigestImageSize[localFooDigest], 334)
+	checkError(t, err, "Test: TestLocalRegistry (image size)\n")
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{
+		{
+			Registries: sc.RegistryContexts,
+			Images: []reg.Image{
+				{
+					ImageName: "foo",
+					Dmap: reg.DigestTags{
+						localFooDigest: {"1.0"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	})
+	checkError(t, err, "Test: TestLocalRegistry (ToPromotionEdges)\n")
+
+	for edge := range edges {
+		err = sc.CopyImage(
+			edge.SrcRegistry,
+			fmt.Sprintf("%s/%s@%s",
+				edge.SrcRegistry.Name,
+				edge.SrcImageTag.ImageName,
+				edge.Digest),
+			edge.DstRegistry,
+			fmt.Sprintf("%s/%s:%s",
+				edge.DstRegistry.Name,
+				edge.DstImageTag.ImageName,
+				edge.DstImageTag.Tag))
+		checkError(t, err, "Test: TestLocalRegistry (copy)\n")
+	}
+
+	dstRef, err := name.ParseReference(host + "/prod/foo:1.0")
+	checkError(t, err, "Test: TestLocalRegistry (parse)\n")
+	desc, err := ggcrV1Remote.Get(dstRef)
+	checkError(t, err, "Test: TestLocalRegistry (get)\n")
+	err = checkEqual(desc.Digest.String(), localFooDigest)
+	checkError(t, err, "Test: TestLocalRegistry (digest)\n")
+
+	// Local registries are read-only.
+	err = sc.CopyImage(
+		destRC,
+		host+"/prod/foo:1.0",
+		srcRC,
+		"airgap.local/builds/foo:1.1")
+	if err == nil {
+		t.Fatalf("Test: TestLocalRegistry: copied into a local registry")
+	}
+}
+
+// TestLocalRegistryDockerArchive reads a "docker save" tarball (written from
+// the OCI layout fixture) as a local source registry.
+func TestLocalRegistryDockerArchive(t *testing.T) {
+	pwd := bazelTestPath("TestLocalRegistry")
+	layoutPath, err := ggcrV1Layout.FromPath(filepath.Join(pwd, "oci"))
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	idx, err := layoutPath.ImageIndex()
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	idxMfest, err := idx.IndexManifest()
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	img, err := idx.Image(idxMfest.Manifests[0].Digest)
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+
+	dir, err := ioutil.TempDir("", "local-registry")
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "images.tar")
+	tag, err := name.NewTag("foo/bar:1.0")
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	err = ggcrV1Tarball.WriteToFile(archive, tag, img)
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+
+	// The images are served as they are read from the tarball.
+	archived, err := ggcrV1Tarball.ImageFromPath(archive, &tag)
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+	digest, err := archived.Digest()
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive\n")
+
+	srcRC := reg.RegistryContext{
+		Name:     "airgap.local/archive",
+		Provider: reg.ProviderLocal,
+		Path:     archive,
+		Src:      true,
+	}
+	sc := reg.SyncContext{
+		RegistryContexts: []reg.RegistryContext{srcRC},
+		Inv:              reg.MasterInventory{srcRC.Name: nil},
+		DigestMediaType:  make(reg.DigestMediaType),
+		DigestImageSize:  make(reg.DigestImageSize),
+	}
+	err = sc.ReadRegistries(
+		context.Background(),
+		[]reg.RegistryContext{srcRC},
+		true,
+		reg.MkReadRepositoryCmdReal)
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive (read)\n")
+
+	expectedInv := reg.MasterInventory{
+		"airgap.local/archive": {
+			"foo/bar": {
+				reg.Digest(digest.String()): {"1.0"}}},
+	}
+	err = checkEqual(sc.Inv, expectedInv)
+	checkError(t, err, "Test: TestLocalRegistryDockerArchive (inventory)\n")
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+)
+
+const (
+	// dockerReferenceTypeAnnotation and dockerReferenceDigestAnnotation mark
+	// the children of a manifest list that are attestations (such as the
+	// provenance written by BuildKit) of another child, instead of images.
+	dockerReferenceTypeAnnotation   = "vnd.docker.reference.type"
+	dockerReferenceDigestAnnotation = "vnd.docker.reference.digest"
+)
+
+// ParsePlatform parses a platform of the form "<os>/<arch>[/<variant>]", such
+// as "linux/amd64" or "linux/arm/v7".
+func ParsePlatform(s string) (ggcrV1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ggcrV1.Platform{}, fmt.Errorf(
+			"invalid platform %q: must be of the form <os>/<arch>[/<variant>]",
+			s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ggcrV1.Platform{}, fmt.Errorf(
+				"invalid platform %q: empty component", s)
+		}
+	}
+
+	platform := ggcrV1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// ParsePlatforms parses a comma-separated list of platforms (see
+// ParsePlatform()). An empty string yields no platforms.
+func ParsePlatforms(s string) ([]ggcrV1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var platforms []ggcrV1.Platform
+	for _, field := range strings.Split(s, ",") {
+		platform, err := ParsePlatform(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// platformMatches returns true if got is one of the wanted platforms. The
+// variant of a wanted platform only has to match if it is set, so that
+// "linux/arm64" matches "linux/arm64/v8".
+func platformMatches(wanted []ggcrV1.Platform, got ggcrV1.Platform) bool {
+	for _, want := range wanted {
+		if want.OS != got.OS || want.Architecture != got.Architecture {
+			continue
+		}
+		if want.Variant != "" && want.Variant != got.Variant {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// FilterIndexPlatforms returns a manifest list with only the children of idx
+// that are images for one of the given platforms. Children without a platform
+// (such as nested manifest lists) are kept, and so are the attestations of
+// the kept images. The children themselves, and hence their layers, are left
+// untouched; only the manifest list is rebuilt, so it has a new digest.
+//
+// An error is returned if none of the platforms are in idx, rather than
+// promoting an empty manifest list.
+func FilterIndexPlatforms(
+	idx ggcrV1.ImageIndex,
+	platforms []ggcrV1.Platform) (ggcrV1.ImageIndex, error) {
+
+	orig, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[ggcrV1.Hash]bool)
+	images := 0
+	for _, child := range orig.Manifests {
+		if child.Platform == nil || isAttestation(child) {
+			continue
+		}
+		if platformMatches(platforms, *child.Platform) {
+			kept[child.Digest] = true
+			images++
+		}
+	}
+	if images == 0 {
+		return nil, fmt.Errorf(
+			"none of the platforms %s are in the manifest list",
+			platformsString(platforms))
+	}
+
+	filtered := *orig
+	filtered.Manifests = make([]ggcrV1.Descriptor, 0, len(orig.Manifests))
+	for _, child := range orig.Manifests {
+		switch {
+		case isAttestation(child):
+			ref, err := ggcrV1.NewHash(
+				child.Annotations[dockerReferenceDigestAnnotation])
+			if err != nil || !kept[ref] {
+				continue
+			}
+		case child.Platform != nil && !kept[child.Digest]:
+			continue
+		}
+		filtered.Manifests = append(filtered.Manifests, child)
+	}
+
+	return &filteredIndex{idx: idx, manifest: &filtered}, nil
+}
+
+// checkIndexChildren makes sure that all the children of the manifest list
+// idx of srcRef still exist in the source registry, before anything is
+// copied. Otherwise, an error naming the missing children is returned; or, if
+// skipMissing is set, the missing children (and their attestations) are
+// dropped from the manifest list, which then gets a new digest. If dstRef is
+// a digest, it is replaced with that new digest.
+func checkIndexChildren(
+	srcRef, dstRef name.Reference,
+	idx ggcrV1.ImageIndex,
+	srcOpts []ggcrV1Remote.Option,
+	skipMissing bool) (ggcrV1.ImageIndex, name.Reference, error) {
+
+	orig, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missing := make(map[ggcrV1.Hash]bool)
+	missingStrs := make([]string, 0)
+	for _, child := range orig.Manifests {
+		ref := srcRef.Context().Digest(child.Digest.String())
+		_, err := ggcrV1Remote.Get(ref, srcOpts...)
+		if err == nil {
+			continue
+		}
+		if !isManifestUnknown(err) {
+			return nil, nil, fmt.Errorf("fetching %q: %v", ref, err)
+		}
+		missing[child.Digest] = true
+		missingStrs = append(missingStrs, childString(child))
+	}
+
+	if len(missing) == 0 {
+		return idx, dstRef, nil
+	}
+	if !skipMissing {
+		return nil, nil, fmt.Errorf(
+			"manifest list %q references manifests which are missing from "+
+				"the source registry: %s",
+			srcRef, strings.Join(missingStrs, ", "))
+	}
+
+	kept := *orig
+	kept.Manifests = make([]ggcrV1.Descriptor, 0, len(orig.Manifests))
+	for _, child := range orig.Manifests {
+		if missing[child.Digest] {
+			continue
+		}
+		if isAttestation(child) {
+			ref, err := ggcrV1.NewHash(
+				child.Annotations[dockerReferenceDigestAnnotation])
+			if err == nil && missing[ref] {
+				continue
+			}
+		}
+		kept.Manifests = append(kept.Manifests, child)
+	}
+	if len(kept.Manifests) == 0 {
+		return nil, nil, fmt.Errorf(
+			"all the manifests of manifest list %q are missing from the "+
+				"source registry", srcRef)
+	}
+
+	filtered := &filteredIndex{idx: idx, manifest: &kept}
+	digest, err := filtered.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	logging.Log().Info("dropped missing manifests from manifest list",
+		"src", srcRef.String(),
+		"missing", strings.Join(missingStrs, ", "),
+		"digest", digest.String())
+
+	if _, ok := dstRef.(name.Digest); ok {
+		dstRef = dstRef.Context().Digest(digest.String())
+	}
+	return filtered, dstRef, nil
+}
+
+// isManifestUnknown returns true if err is a registry's reply that a manifest
+// does not exist.
+func isManifestUnknown(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.ManifestUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// childString renders the child of a manifest list as its digest, followed by
+// its platform (if any).
+func childString(child ggcrV1.Descriptor) string {
+	if child.Platform == nil {
+		return child.Digest.String()
+	}
+	return fmt.Sprintf("%s (%s)", child.Digest,
+		platformsString([]ggcrV1.Platform{*child.Platform}))
+}
+
+// isAttestation returns true if the child of a manifest list is the
+// attestation of another child (see dockerReferenceTypeAnnotation).
+func isAttestation(child ggcrV1.Descriptor) bool {
+	return child.Annotations[dockerReferenceTypeAnnotation] ==
+		"attestation-manifest"
+}
+
+// platformsString renders platforms as a comma-separated list of
+// "<os>/<arch>[/<variant>]".
+func platformsString(platforms []ggcrV1.Platform) string {
+	strs := make([]string, 0, len(platforms))
+	for _, platform := range platforms {
+		s := platform.OS + "/" + platform.Architecture
+		if platform.Variant != "" {
+			s += "/" + platform.Variant
+		}
+		strs = append(strs, s)
+	}
+	return strings.Join(strs, ",")
+}
+
+// filteredIndex is a manifest list with fewer children than the one it wraps
+// (see FilterIndexPlatforms()). The children, and the media type, are still
+// read from the wrapped manifest list.
+type filteredIndex struct {
+	idx      ggcrV1.ImageIndex
+	manifest *ggcrV1.IndexManifest
+
+	once sync.Once
+	raw  []byte
+	err  error
+}
+
+// MediaType implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) MediaType() (ggcrV1Types.MediaType, error) {
+	return fi.idx.MediaType()
+}
+
+// Image implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) Image(h ggcrV1.Hash) (ggcrV1.Image, error) {
+	return fi.idx.Image(h)
+}
+
+// ImageIndex implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) ImageIndex(h ggcrV1.Hash) (ggcrV1.ImageIndex, error) {
+	return fi.idx.ImageIndex(h)
+}
+
+// IndexManifest implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) IndexManifest() (*ggcrV1.IndexManifest, error) {
+	return fi.manifest, nil
+}
+
+// RawManifest implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) RawManifest() ([]byte, error) {
+	fi.once.Do(func() {
+		fi.raw, fi.err = json.Marshal(fi.manifest)
+	})
+	return fi.raw, fi.err
+}
+
+// Digest implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) Digest() (ggcrV1.Hash, error) {
+	raw, err := fi.RawManifest()
+	if err != nil {
+		return ggcrV1.Hash{}, err
+	}
+	h, _, err := ggcrV1.SHA256(bytes.NewReader(raw))
+	return h, err
+}
+
+// Size implements ggcrV1.ImageIndex.
+func (fi *filteredIndex) Size() (int64, error) {
+	raw, err := fi.RawManifest()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(raw)), nil
+}
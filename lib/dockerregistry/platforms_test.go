@@ -0,0 +1,373 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	var tests = []struct {
+		name          string
+		input         string
+		expected      []ggcrV1.Platform
+		expectedError string
+	}{
+		{
+			"Empty",
+			"",
+			nil,
+			"",
+		},
+		{
+			"With and without variant",
+			"linux/amd64, linux/arm/v7",
+			[]ggcrV1.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm", Variant: "v7"},
+			},
+			"",
+		},
+		{
+			"Missing architecture",
+			"linux",
+			nil,
+			`invalid platform "linux": must be of the form ` +
+				`<os>/<arch>[/<variant>]`,
+		},
+		{
+			"Empty component",
+			"linux//v7",
+			nil,
+			`invalid platform "linux//v7": empty component`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := reg.ParsePlatforms(test.input)
+		var errString string
+		if err != nil {
+			errString = err.Error()
+		}
+		eqErr := checkEqual(errString, test.expectedError)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (error)\n", test.name))
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
+
+// mkMultiPlatformIndex returns a manifest list with a random image for each of
+// the platforms, and the images by platform.
+func mkMultiPlatformIndex(
+	t *testing.T,
+	platforms ...ggcrV1.Platform) (ggcrV1.ImageIndex, []ggcrV1.Image) {
+
+	var addenda []mutate.IndexAddendum
+	var images []ggcrV1.Image
+	for i := range platforms {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatalf("creating random image: %v", err)
+		}
+		images = append(images, img)
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: ggcrV1.Descriptor{
+				Platform: &platforms[i],
+			},
+		})
+	}
+	return mutate.AppendManifests(empty.Index, addenda...), images
+}
+
+func TestFilterIndexPlatforms(t *testing.T) {
+	amd64 := ggcrV1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ggcrV1.Platform{
+		OS:           "linux",
+		Architecture: "arm64",
+		Variant:      "v8",
+	}
+	s390x := ggcrV1.Platform{OS: "linux", Architecture: "s390x"}
+	idx, images := mkMultiPlatformIndex(t, amd64, arm64, s390x)
+
+	// The variant does not have to be given.
+	platforms, err := reg.ParsePlatforms("linux/amd64,linux/arm64")
+	checkError(t, err, "unexpected error parsing platforms\n")
+	filtered, err := reg.FilterIndexPlatforms(idx, platforms)
+	checkError(t, err, "unexpected error filtering index\n")
+
+	mfest, err := filtered.IndexManifest()
+	checkError(t, err, "unexpected error reading filtered index\n")
+	var gotPlatforms []ggcrV1.Platform
+	for _, child := range mfest.Manifests {
+		gotPlatforms = append(gotPlatforms, *child.Platform)
+	}
+	eqErr := checkEqual(gotPlatforms, []ggcrV1.Platform{amd64, arm64})
+	checkError(t, eqErr, "unexpected platforms\n")
+
+	// The kept images, and their layers, are unchanged.
+	for i, child := range mfest.Manifests {
+		expected, err := images[i].Digest()
+		checkError(t, err, "unexpected error reading image digest\n")
+		eqErr = checkEqual(child.Digest, expected)
+		checkError(t, eqErr, "unexpected child digest\n")
+
+		img, err := filtered.Image(child.Digest)
+		checkError(t, err, "unexpected error reading child image\n")
+		gotLayers, err := img.Layers()
+		checkError(t, err, "unexpected error reading layers\n")
+		expectedLayers, err := images[i].Layers()
+		checkError(t, err, "unexpected error reading layers\n")
+		eqErr = checkEqual(len(gotLayers), len(expectedLayers))
+		checkError(t, eqErr, "unexpected number of layers\n")
+		for j := range gotLayers {
+			got, _ := gotLayers[j].Digest()
+			expected, _ := expectedLayers[j].Digest()
+			eqErr = checkEqual(got, expected)
+			checkError(t, eqErr, "unexpected layer digest\n")
+		}
+	}
+
+	// Only the manifest list itself has changed.
+	origDigest, err := idx.Digest()
+	checkError(t, err, "unexpected error reading index digest\n")
+	gotDigest, err := filtered.Digest()
+	checkError(t, err, "unexpected error reading filtered digest\n")
+	if gotDigest == origDigest {
+		t.Errorf("the filtered index has the original digest %v", origDigest)
+	}
+	raw, err := filtered.RawManifest()
+	checkError(t, err, "unexpected error reading raw manifest\n")
+	expectedDigest, _, err := ggcrV1.SHA256(strings.NewReader(string(raw)))
+	checkError(t, err, "unexpected error hashing raw manifest\n")
+	eqErr = checkEqual(gotDigest, expectedDigest)
+	checkError(t, eqErr, "the digest does not match the raw manifest\n")
+
+	origMediaType, _ := idx.MediaType()
+	gotMediaType, _ := filtered.MediaType()
+	eqErr = checkEqual(gotMediaType, origMediaType)
+	checkError(t, eqErr, "unexpected media type\n")
+
+	// None of the platforms are in the manifest list.
+	_, err = reg.FilterIndexPlatforms(idx, []ggcrV1.Platform{
+		{OS: "windows", Architecture: "amd64"},
+	})
+	eqErr = checkEqual(fmt.Sprint(err),
+		"none of the platforms windows/amd64 are in the manifest list")
+	checkError(t, eqErr, "unexpected error for missing platforms\n")
+}
+
+func TestFilterIndexPlatformsWrite(t *testing.T) {
+	amd64 := ggcrV1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ggcrV1.Platform{OS: "linux", Architecture: "arm64"}
+	s390x := ggcrV1.Platform{OS: "linux", Architecture: "s390x"}
+	idx, _ := mkMultiPlatformIndex(t, amd64, arm64, s390x)
+
+	filtered, err := reg.FilterIndexPlatforms(
+		idx, []ggcrV1.Platform{amd64, s390x})
+	checkError(t, err, "unexpected error filtering index\n")
+	digest, err := filtered.Digest()
+	checkError(t, err, "unexpected error reading filtered digest\n")
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, err := name.ParseReference(
+		host + "/foo@" + digest.String())
+	checkError(t, err, "unexpected error parsing reference\n")
+
+	err = ggcrV1Remote.WriteIndex(ref, filtered)
+	checkError(t, err, "unexpected error writing index\n")
+
+	// The written manifest list is the filtered one, and all of its images
+	// (with their layers) were written too.
+	got, err := ggcrV1Remote.Index(ref)
+	checkError(t, err, "unexpected error reading written index\n")
+	gotDigest, err := got.Digest()
+	checkError(t, err, "unexpected error reading written digest\n")
+	eqErr := checkEqual(gotDigest, digest)
+	checkError(t, eqErr, "unexpected written digest\n")
+
+	mfest, err := got.IndexManifest()
+	checkError(t, err, "unexpected error reading written index\n")
+	eqErr = checkEqual(len(mfest.Manifests), 2)
+	checkError(t, eqErr, "unexpected number of written images\n")
+	for _, child := range mfest.Manifests {
+		img, err := got.Image(child.Digest)
+		checkError(t, err, "unexpected error reading written image\n")
+		layers, err := img.Layers()
+		checkError(t, err, "unexpected error reading written layers\n")
+		for _, layer := range layers {
+			_, err := layer.Compressed()
+			checkError(t, err, "unexpected error reading written layer\n")
+		}
+	}
+}
+
+func TestCopyImageMissingPlatforms(t *testing.T) {
+	amd64 := ggcrV1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ggcrV1.Platform{OS: "linux", Architecture: "arm64"}
+	idx, images := mkMultiPlatformIndex(t, amd64, arm64)
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("reading index digest: %v", err)
+	}
+	missingDigest, err := images[1].Digest()
+	if err != nil {
+		t.Fatalf("reading image digest: %v", err)
+	}
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// The arm64 image of the source manifest list was garbage collected: only
+	// the amd64 image is pushed, and then the manifest list itself.
+	srcRef, err := name.ParseReference(host + "/src/foo:1.0")
+	if err != nil {
+		t.Fatalf("parsing reference: %v", err)
+	}
+	keptDigest, err := images[0].Digest()
+	if err != nil {
+		t.Fatalf("reading image digest: %v", err)
+	}
+	if err := ggcrV1Remote.Write(
+		srcRef.Context().Digest(keptDigest.String()),
+		images[0]); err != nil {
+		t.Fatalf("writing image: %v", err)
+	}
+	putRawIndex(t, server.URL+"/v2/src/foo/manifests/1.0", idx)
+
+	// Dropping the arm64 image gives the same manifest list as filtering it
+	// out.
+	kept, err := reg.FilterIndexPlatforms(idx, []ggcrV1.Platform{amd64})
+	if err != nil {
+		t.Fatalf("filtering index: %v", err)
+	}
+	keptIdxDigest, err := kept.Digest()
+	if err != nil {
+		t.Fatalf("reading filtered digest: %v", err)
+	}
+
+	srcRC := reg.RegistryContext{Name: reg.RegistryName(host + "/src")}
+	dstRC := reg.RegistryContext{Name: reg.RegistryName(host + "/dst")}
+
+	var tests = []struct {
+		name          string
+		skipMissing   bool
+		dst           string
+		expectedError string
+		expectedRef   string
+	}{
+		{
+			"Missing images fail the copy",
+			false,
+			"foo:1.0",
+			fmt.Sprintf("manifest list %q references manifests which are "+
+				"missing from the source registry: %s (linux/arm64)",
+				srcRef, missingDigest),
+			"",
+		},
+		{
+			"Missing images are dropped",
+			true,
+			"foo:1.0",
+			"",
+			"foo:1.0",
+		},
+		{
+			"Untagged manifest lists are written under their new digest",
+			true,
+			"bar@" + idxDigest.String(),
+			"",
+			"bar@" + keptIdxDigest.String(),
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			RegistryContexts:     []reg.RegistryContext{srcRC, dstRC},
+			SkipMissingPlatforms: test.skipMissing,
+		}
+		dst := host + "/dst/" + test.dst
+		err := sc.CopyImage(srcRC, srcRef.String(), dstRC, dst)
+		if test.expectedError != "" {
+			if err == nil || err.Error() != test.expectedError {
+				t.Errorf("Test: %v: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			continue
+		}
+		checkError(t, err, fmt.Sprintf("Test: %v: unexpected error\n",
+			test.name))
+
+		// Only the amd64 image is left in the copy.
+		dstRef, err := name.ParseReference(host + "/dst/" + test.expectedRef)
+		checkError(t, err, "unexpected error parsing reference\n")
+		got, err := ggcrV1Remote.Index(dstRef)
+		if err != nil {
+			t.Errorf("Test: %v: unexpected error reading copy: %v",
+				test.name, err)
+			continue
+		}
+		gotDigest, err := got.Digest()
+		checkError(t, err, "unexpected error reading copy digest\n")
+		eqErr := checkEqual(gotDigest, keptIdxDigest)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
+
+// putRawIndex uploads the manifest of idx (but none of its images) to the
+// manifest URL u.
+func putRawIndex(t *testing.T, u string, idx ggcrV1.ImageIndex) {
+	raw, err := idx.RawManifest()
+	if err != nil {
+		t.Fatalf("reading raw index: %v", err)
+	}
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		t.Fatalf("reading index media type: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", string(mediaType))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("writing index: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("writing index: unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var (
+	// imageNameLine matches the "name" key of an image (e.g. "- name: foo").
+	// The names of registries match it too, but they are never followed by
+	// digests.
+	imageNameLine = regexp.MustCompile(`^\s*(?:-\s+)?name:\s*["']?([^"'\s#]+)`)
+
+	// digestLine matches a digest key of a dmap (e.g. `"sha256:...": [...]`).
+	digestLine = regexp.MustCompile(`^\s*["']?(sha256:[^"'\s:]+)["']?\s*:`)
+)
+
+// SourcePosition is the line of a manifest file at which something is
+// declared.
+type SourcePosition struct {
+	File string
+	Line int
+}
+
+// String renders the SourcePosition as "<file>:<line>".
+func (pos SourcePosition) String() string {
+	return fmt.Sprintf("%s:%d", pos.File, pos.Line)
+}
+
+// ManifestPositions finds the lines at which the digests of the images of the
+// given manifests are declared, by reading their files again (see
+// Manifest.Filepath). The YAML parser does not keep track of positions, so
+// the files are scanned line by line instead; this only works for dmaps
+// written in the block style (one digest per line), like in all promoter
+// manifests. If a digest of an image is declared more than once, the first
+// declaration wins.
+func ManifestPositions(
+	mfests []Manifest) (map[ImageDigest]SourcePosition, error) {
+
+	positions := make(map[ImageDigest]SourcePosition)
+	for _, mfest := range mfests {
+		files, err := manifestImageFiles(mfest.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			for key, pos := range scanImagePositions(b, file) {
+				if _, ok := positions[key]; !ok {
+					positions[key] = pos
+				}
+			}
+		}
+	}
+
+	return positions, nil
+}
+
+// manifestImageFiles returns the files which hold the images of the manifest
+// parsed from the given path: the "*.yaml" files of a directory (see
+// ParseManifestFromDir()), the images file of a thin manifest (see
+// ParseThinManifestFromFile()), or else the file itself.
+func manifestImageFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		var files []string
+		var listManifest filepath.WalkFunc = func(p string,
+			info os.FileInfo,
+			err error) error {
+
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && filepath.Ext(p) == ".yaml" {
+				files = append(files, p)
+			}
+			return nil
+		}
+		if err := filepath.Walk(path, listManifest); err != nil {
+			return nil, err
+		}
+
+		sort.Strings(files)
+		return files, nil
+	}
+
+	files := []string{path}
+	if filepath.Base(path) == "promoter-manifest.yaml" {
+		imagesPath := thinManifestImagesPath(path)
+		if _, err := os.Stat(imagesPath); err == nil {
+			files = append(files, imagesPath)
+		}
+	}
+	return files, nil
+}
+
+// scanImagePositions finds the lines at which the digests of the images in
+// the YAML are declared, by attributing every digest line to the most recent
+// image name line.
+func scanImagePositions(
+	b []byte,
+	file string) map[ImageDigest]SourcePosition {
+
+	positions := make(map[ImageDigest]SourcePosition)
+
+	var imageName ImageName
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+
+		if match := imageNameLine.FindStringSubmatch(text); match != nil {
+			imageName = ImageName(match[1])
+			continue
+		}
+
+		match := digestLine.FindStringSubmatch(text)
+		if match == nil || len(imageName) == 0 {
+			continue
+		}
+
+		key := ImageDigest{ImageName: imageName, Digest: Digest(match[1])}
+		if _, ok := positions[key]; !ok {
+			positions[key] = SourcePosition{File: file, Line: line}
+		}
+	}
+
+	return positions
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+func TestManifestPositions(t *testing.T) {
+	const (
+		digestA = "sha256:c3d310f4741b3642497da8826e0986db5e02afc9777a2b8e668c8e41034128c1"
+		digestB = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	)
+
+	testName := "TestManifestPositions"
+	plainPath := bazelTestPath(testName, "plain", "manifest.yaml")
+	thinPath := bazelTestPath(
+		testName, "thin", "manifests", "a", "promoter-manifest.yaml")
+	imagesPath := bazelTestPath(
+		testName, "thin", "images", "a", "images.yaml")
+
+	var tests = []struct {
+		name     string
+		paths    []string
+		expected map[reg.ImageDigest]reg.SourcePosition
+	}{
+		{
+			"Plain manifest",
+			[]string{plainPath},
+			map[reg.ImageDigest]reg.SourcePosition{
+				{ImageName: "foo-controller", Digest: digestA}: {
+					File: plainPath,
+					Line: 11,
+				},
+				{ImageName: "foo-controller", Digest: digestB}: {
+					File: plainPath,
+					Line: 12,
+				},
+				{ImageName: "bar-controller", Digest: digestB}: {
+					File: plainPath,
+					Line: 16,
+				},
+			},
+		},
+		{
+			"Thin manifest",
+			[]string{thinPath},
+			map[reg.ImageDigest]reg.SourcePosition{
+				{ImageName: "baz-controller", Digest: digestA}: {
+					File: imagesPath,
+					Line: 3,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mfests := make([]reg.Manifest, 0)
+		for _, path := range test.paths {
+			mfests = append(mfests, reg.Manifest{Filepath: path})
+		}
+
+		got, err := reg.ManifestPositions(mfests)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+
+		eqErr := checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v\n", test.name))
+	}
+}
+
+func TestSourcePositionString(t *testing.T) {
+	pos := reg.SourcePosition{File: "images/foo/images.yaml", Line: 4}
+
+	eqErr := checkEqual(pos.String(), "images/foo/images.yaml:4")
+	checkError(t, eqErr, "checkError: unexpected SourcePosition string\n")
+}
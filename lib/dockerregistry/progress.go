@@ -0,0 +1,248 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultProgressInterval is how often Promote() reports its progress, if
+// SyncContext.ProgressInterval is not set.
+const DefaultProgressInterval = 10 * time.Second
+
+// Progress is a snapshot of the progress of Promote().
+type Progress struct {
+	// Completed is the number of edges whose promotion is over (including the
+	// failed ones), out of Total.
+	Completed int
+	Failed    int
+	Total     int
+	// Bytes is the size of the images copied so far, out of TotalBytes.
+	Bytes      int64
+	TotalBytes int64
+	Elapsed    time.Duration
+	// Done is true for the last report, once all the edges are completed.
+	Done bool
+}
+
+// ETA estimates the time left until all edges are completed, from the rate
+// of the bytes (or, if the sizes of the images are unknown, of the edges)
+// completed so far. It returns false if there is no estimate yet.
+func (p Progress) ETA() (time.Duration, bool) {
+	done, total := float64(p.Bytes), float64(p.TotalBytes)
+	if p.TotalBytes == 0 {
+		done, total = float64(p.Completed), float64(p.Total)
+	}
+	if done == 0 {
+		return 0, false
+	}
+	eta := time.Duration(float64(p.Elapsed) * (total - done) / done)
+	if eta < 0 {
+		eta = 0
+	}
+	return eta.Round(time.Second), true
+}
+
+// ProgressReporter is told about the progress of Promote(), every
+// SyncContext.ProgressInterval and once more when it is done.
+type ProgressReporter interface {
+	ReportProgress(p Progress)
+}
+
+// TextProgressReporter writes the progress as a line of text, such as
+// "progress: 3 of 10 promotions done (1 failed), 1.5 MiB of 5.0 MiB copied,
+// ETA 1m0s".
+type TextProgressReporter struct {
+	Out io.Writer
+}
+
+// ReportProgress implements ProgressReporter.
+func (r *TextProgressReporter) ReportProgress(p Progress) {
+	eta := "unknown"
+	if d, ok := p.ETA(); ok {
+		eta = d.String()
+	}
+	if p.Done {
+		eta = "done"
+	}
+	fmt.Fprintf(r.Out,
+		"progress: %d of %d promotions done (%d failed), %s of %s copied, "+
+			"ETA %s\n",
+		p.Completed, p.Total, p.Failed,
+		BytesToHuman(p.Bytes), BytesToHuman(p.TotalBytes),
+		eta)
+}
+
+// progressEvent is the JSON form of a Progress (see JSONProgressReporter).
+type progressEvent struct {
+	Event          string  `json:"event"`
+	Completed      int     `json:"completed"`
+	Failed         int     `json:"failed"`
+	Total          int     `json:"total"`
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"totalBytes"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	ETASeconds     float64 `json:"etaSeconds,omitempty"`
+	Done           bool    `json:"done"`
+}
+
+// JSONProgressReporter writes the progress as a JSON object on a single line,
+// with an "event" field of "progress". The "etaSeconds" field is left out if
+// there is no estimate yet.
+type JSONProgressReporter struct {
+	Out io.Writer
+}
+
+// ReportProgress implements ProgressReporter.
+func (r *JSONProgressReporter) ReportProgress(p Progress) {
+	event := progressEvent{
+		Event:          "progress",
+		Completed:      p.Completed,
+		Failed:         p.Failed,
+		Total:          p.Total,
+		Bytes:          p.Bytes,
+		TotalBytes:     p.TotalBytes,
+		ElapsedSeconds: p.Elapsed.Seconds(),
+		Done:           p.Done,
+	}
+	if eta, ok := p.ETA(); ok && !p.Done {
+		event.ETASeconds = eta.Seconds()
+	}
+	// The fields cannot fail to marshal.
+	b, _ := json.Marshal(event)
+	fmt.Fprintf(r.Out, "%s\n", b)
+}
+
+// progressTracker counts the edges completed by Promote(), and reports the
+// progress to a ProgressReporter periodically. A nil progressTracker tracks
+// nothing.
+type progressTracker struct {
+	reporter ProgressReporter
+	start    time.Time
+
+	mutex    sync.Mutex
+	progress Progress
+	// copied records the copies (see resultKey()) that are already counted
+	// in progress.Bytes, as every tag of a copy is completed separately.
+	copied map[PromotionRequest]bool
+	sizes  DigestImageSize
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProgressTracker returns a progressTracker for the given edges, or nil if
+// sc.Progress is not set.
+func (sc *SyncContext) newProgressTracker(
+	edges map[PromotionEdge]interface{}) *progressTracker {
+
+	if sc.Progress == nil {
+		return nil
+	}
+
+	var totalBytes int64
+	for edge := range CollapsePromotionEdges(edges) {
+		totalBytes += int64(sc.DigestImageSize[edge.Digest])
+	}
+
+	return &progressTracker{
+		reporter: sc.Progress,
+		start:    time.Now(),
+		progress: Progress{
+			Total:      len(edges),
+			TotalBytes: totalBytes,
+		},
+		copied: make(map[PromotionRequest]bool),
+		sizes:  sc.DigestImageSize,
+	}
+}
+
+// run reports the progress every interval, until finish() is called.
+func (t *progressTracker) run(interval time.Duration) {
+	if t == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.reporter.ReportProgress(t.snapshot())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// record counts a completed PromotionRequest.
+func (t *progressTracker) record(pr PromotionRequest, errs Errors) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.progress.Completed++
+	if len(errs) > 0 {
+		t.progress.Failed++
+		return
+	}
+	key := resultKey(pr)
+	if !t.copied[key] {
+		t.copied[key] = true
+		t.progress.Bytes += int64(t.sizes[pr.Digest])
+	}
+}
+
+// snapshot returns the current progress.
+func (t *progressTracker) snapshot() Progress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p := t.progress
+	p.Elapsed = time.Since(t.start)
+	return p
+}
+
+// finish stops the periodic reports, and reports the final progress.
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+	}
+
+	p := t.snapshot()
+	p.Done = true
+	t.reporter.ReportProgress(p)
+}
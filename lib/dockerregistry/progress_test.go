@@ -0,0 +1,237 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// fakeProgressReporter records the reported progress, without the elapsed
+// time.
+type fakeProgressReporter struct {
+	mutex   sync.Mutex
+	reports []reg.Progress
+}
+
+func (r *fakeProgressReporter) ReportProgress(p reg.Progress) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p.Elapsed = 0
+	r.reports = append(r.reports, p)
+}
+
+func TestPromoteProgress(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0", "1"},
+					"sha256:111": {"2.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	reporter := &fakeProgressReporter{}
+	sc := reg.SyncContext{
+		DigestImageSize: reg.DigestImageSize{
+			"sha256:000": 10,
+			"sha256:111": 20,
+		},
+		Progress: reporter,
+		// Only the final progress is reported.
+		ProgressInterval: time.Hour,
+	}
+
+	// Fail the promotion of the "2.0" tag.
+	var processRequestFake reg.ProcessRequest = func(
+		sc *reg.SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- reg.RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			reqRes := reg.RequestResult{Context: req}
+			pr := req.RequestParams.(reg.PromotionRequest)
+			if pr.Tag == "2.0" {
+				reqRes.Errors = reg.Errors{
+					{
+						Context: "running writeImage()",
+						Error:   fmt.Errorf("copy failed"),
+					},
+				}
+			}
+			requestResults <- reqRes
+		}
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "unexpected error getting promotion edges\n")
+
+	_, err = sc.Promote(
+		context.Background(),
+		edges,
+		nopStream,
+		&processRequestFake)
+	eqErr := checkEqual(err != nil, true)
+	checkError(t, eqErr, "expected a promotion error\n")
+
+	// Both tags of "sha256:000" count as completed edges, but its bytes are
+	// only counted once; the bytes of the failed copy are not counted.
+	eqErr = checkEqual(reporter.reports, []reg.Progress{
+		{
+			Completed:  3,
+			Failed:     1,
+			Total:      3,
+			Bytes:      10,
+			TotalBytes: 30,
+			Done:       true,
+		},
+	})
+	checkError(t, eqErr, "unexpected progress reports\n")
+}
+
+func TestProgressETA(t *testing.T) {
+	var tests = []struct {
+		name        string
+		progress    reg.Progress
+		expectedETA time.Duration
+		expectedOK  bool
+	}{
+		{
+			"Nothing completed yet",
+			reg.Progress{Total: 4, TotalBytes: 100, Elapsed: time.Minute},
+			0,
+			false,
+		},
+		{
+			"By bytes",
+			reg.Progress{
+				Completed:  3,
+				Total:      4,
+				Bytes:      25,
+				TotalBytes: 100,
+				Elapsed:    time.Minute,
+			},
+			3 * time.Minute,
+			true,
+		},
+		{
+			"By edges, if the sizes are unknown",
+			reg.Progress{Completed: 1, Total: 4, Elapsed: time.Minute},
+			3 * time.Minute,
+			true,
+		},
+		{
+			"Done",
+			reg.Progress{Completed: 4, Total: 4, Elapsed: time.Minute},
+			0,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		eta, ok := test.progress.ETA()
+		eqErr := checkEqual(eta, test.expectedETA)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (eta)\n", test.name))
+		eqErr = checkEqual(ok, test.expectedOK)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (ok)\n", test.name))
+	}
+}
+
+func TestProgressReporters(t *testing.T) {
+	progress := reg.Progress{
+		Completed:  3,
+		Failed:     1,
+		Total:      10,
+		Bytes:      1536 * 1024,
+		TotalBytes: 6 * 1024 * 1024,
+		Elapsed:    20 * time.Second,
+	}
+	done := progress
+	done.Done = true
+
+	var tests = []struct {
+		name     string
+		reporter func(*bytes.Buffer) reg.ProgressReporter
+		expected string
+	}{
+		{
+			"Text",
+			func(b *bytes.Buffer) reg.ProgressReporter {
+				return &reg.TextProgressReporter{Out: b}
+			},
+			"progress: 3 of 10 promotions done (1 failed), " +
+				"1.5 MiB of 6.0 MiB copied, ETA 1m0s\n" +
+				"progress: 3 of 10 promotions done (1 failed), " +
+				"1.5 MiB of 6.0 MiB copied, ETA done\n",
+		},
+		{
+			"JSON",
+			func(b *bytes.Buffer) reg.ProgressReporter {
+				return &reg.JSONProgressReporter{Out: b}
+			},
+			`{"event":"progress","completed":3,"failed":1,"total":10,` +
+				`"bytes":1572864,"totalBytes":6291456,` +
+				`"elapsedSeconds":20,"etaSeconds":60,"done":false}` + "\n" +
+				`{"event":"progress","completed":3,"failed":1,"total":10,` +
+				`"bytes":1572864,"totalBytes":6291456,` +
+				`"elapsedSeconds":20,"done":true}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		reporter := test.reporter(&b)
+		reporter.ReportProgress(progress)
+		reporter.ReportProgress(done)
+		eqErr := checkEqual(b.String(), test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// GetPruneEdges returns the tags to delete from the destination registries so
+// that they mirror the manifests, as edges: every tag of a destination image
+// of the given (unfiltered) edges that is not itself the destination of an
+// edge. Destination images that are not in the manifests at all are left
+// alone, as are untagged digests (see GarbageCollect()), and the referrer tags
+// (see ReferrerTags(), which include the SignatureTag()) of the digests that
+// are still promoted, as they hold their signatures, SBOMs and attestations.
+//
+// The destination registries must have been read into sc.Inv beforehand
+// (e.g., by FilterPromotionEdges()).
+func (sc *SyncContext) GetPruneEdges(
+	edges map[PromotionEdge]interface{}) map[PromotionEdge]interface{} {
+
+	type registryImageTag struct {
+		RegistryName RegistryName
+		ImageTag     ImageTag
+	}
+	wanted := make(map[registryImageTag]interface{})
+	// The destination images of the manifests, with the edge that brought
+	// them in (for its source registry).
+	dstImages := make(map[registryImageTag]PromotionEdge)
+	for edge := range edges {
+		wanted[registryImageTag{edge.DstRegistry.Name, edge.DstImageTag}] = nil
+		dstImages[registryImageTag{
+			edge.DstRegistry.Name,
+			ImageTag{ImageName: edge.DstImageTag.ImageName},
+		}] = edge
+		for _, tag := range ReferrerTags(edge.Digest) {
+			wanted[registryImageTag{
+				edge.DstRegistry.Name,
+				ImageTag{ImageName: edge.DstImageTag.ImageName, Tag: tag},
+			}] = nil
+		}
+	}
+
+	pruneEdges := make(map[PromotionEdge]interface{})
+	for key, edge := range dstImages {
+		imageName := key.ImageTag.ImageName
+		for digest, tags := range sc.Inv[key.RegistryName][imageName] {
+			for _, tag := range tags {
+				dstImageTag := ImageTag{ImageName: imageName, Tag: tag}
+				_, ok := wanted[registryImageTag{key.RegistryName, dstImageTag}]
+				if ok {
+					continue
+				}
+				pruneEdges[PromotionEdge{
+					SrcRegistry: edge.SrcRegistry,
+					SrcImageTag: dstImageTag,
+					Digest:      digest,
+					DstRegistry: edge.DstRegistry,
+					DstImageTag: dstImageTag,
+				}] = nil
+			}
+		}
+	}
+	return pruneEdges
+}
+
+// CheckPruneEdges runs the ImageRemovalCheck against the tags to prune, as if
+// they had been removed from the manifests in a pull request: only the tags of
+// the images in the AllowedRemovals of the manifests may be pruned.
+func CheckPruneEdges(
+	mfests []Manifest,
+	edges map[PromotionEdge]interface{},
+	pruneEdges map[PromotionEdge]interface{},
+) error {
+	check := ImageRemovalCheck{
+		PullEdges:       edges,
+		AllowedRemovals: GetAllowedRemovals(mfests),
+	}
+	if err := check.Compare(pruneEdges, edges); err != nil {
+		return fmt.Errorf("refusing to prune: %v", err)
+	}
+	return nil
+}
+
+// Prune deletes the tags of the given prune edges (see GetPruneEdges()) from
+// the destination registries. In dry runs, the deletions are only printed.
+// Once ctx is done, no more tags are deleted, and ctx.Err() is returned.
+func (sc *SyncContext) Prune(
+	ctx context.Context,
+	pruneEdges map[PromotionEdge]interface{},
+	mkProducer PromotionContext,
+	customProcessRequest *ProcessRequest) error {
+
+	if len(pruneEdges) == 0 {
+		klog.Info("Nothing to prune.")
+		return nil
+	}
+
+	logging.Log().Info("pending prunes", "count", len(pruneEdges))
+	for edge := range pruneEdges {
+		logging.Log().Info("pending prune", edge.logFields()...)
+	}
+
+	var populateRequests PopulateRequests = func(
+		sc *SyncContext,
+		reqs chan<- stream.ExternalRequest,
+		wg *sync.WaitGroup) {
+
+		for edge := range pruneEdges {
+			// Do not queue any more deletions once ctx is done.
+			if ctx.Err() != nil {
+				return
+			}
+			var req stream.ExternalRequest
+			req.StreamProducer = mkProducer(
+				edge.SrcRegistry.Name,
+				edge.SrcImageTag.ImageName,
+				edge.DstRegistry,
+				edge.DstImageTag.ImageName,
+				edge.Digest,
+				edge.DstImageTag.Tag,
+				Delete)
+			req.RequestParams = PromotionRequest{
+				Delete,
+				edge.SrcRegistry.Name,
+				edge.DstRegistry.Name,
+				edge.DstRegistry.ServiceAccount,
+				// No source image name, because tag deletions only affect the
+				// destination registry.
+				ImageName(""),
+				edge.DstImageTag.ImageName,
+				edge.Digest,
+				"",
+				edge.DstImageTag.Tag,
+			}
+			wg.Add(1)
+			reqs <- req
+		}
+	}
+
+	var processRequest ProcessRequest
+	var processRequestReal ProcessRequest = func(
+		sc *SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			reqRes := RequestResult{Context: req}
+			rpr := req.RequestParams.(PromotionRequest)
+			reqRes.Errors = runTagProcess(req)
+			log := logging.Log().WithValues(
+				"image", rpr.ImageNameDest,
+				"digest", rpr.Digest,
+				"tag", rpr.Tag,
+				"dst", rpr.RegistryDest)
+			if len(reqRes.Errors) > 0 {
+				log.Error(reqRes.Errors[0].Error, "could not prune tag")
+			} else {
+				log.Info("pruned tag")
+			}
+			requestResults <- reqRes
+		}
+	}
+
+	captured := make(CapturedRequests)
+
+	if sc.DryRun {
+		processRequestDryRun := MkRequestCapturer(&captured)
+		processRequest = processRequestDryRun
+	} else {
+		processRequest = processRequestReal
+	}
+
+	if customProcessRequest != nil {
+		processRequest = *customProcessRequest
+	}
+
+	err := sc.ExecRequests(populateRequests, sc.auditRequests(processRequest))
+
+	if sc.DryRun {
+		sc.PrintCapturedRequests(&captured)
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
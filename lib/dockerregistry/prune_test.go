@@ -0,0 +1,175 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestPrune(t *testing.T) {
+	src := reg.RegistryContext{Name: "gcr.io/src", Src: true}
+	dst := reg.RegistryContext{Name: "gcr.io/dst", ServiceAccount: "robot"}
+
+	mkEdge := func(
+		digest reg.Digest,
+		image reg.ImageName,
+		tag reg.Tag) reg.PromotionEdge {
+		return reg.PromotionEdge{
+			SrcRegistry: src,
+			SrcImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+			Digest:      digest,
+			DstRegistry: dst,
+			DstImageTag: reg.ImageTag{ImageName: image, Tag: tag},
+		}
+	}
+
+	edges := map[reg.PromotionEdge]interface{}{
+		mkEdge("sha256:aaa", "foo", "1.0"): nil,
+		mkEdge("sha256:bbb", "bar", "2.0"): nil,
+	}
+	sc := reg.SyncContext{
+		Inv: reg.MasterInventory{
+			"gcr.io/dst": {
+				"foo": {
+					// "old" was removed from the manifest.
+					"sha256:aaa": {"1.0", "old"},
+					// The signature and SBOM of a promoted digest are kept.
+					"sha256:a51": {"sha256-aaa.sig"},
+					"sha256:a5b": {"sha256-aaa.sbom"},
+					// The signature of a digest which is no longer promoted
+					// is not.
+					"sha256:e51": {"sha256-eee.sig"},
+					// Untagged digests are left to GarbageCollect().
+					"sha256:ccc": nil},
+				"bar": {
+					"sha256:bbb": {"2.0"}},
+				// Images that are not in the manifests are left alone.
+				"baz": {
+					"sha256:ddd": {"3.0"}}}},
+	}
+
+	pruneEdges := sc.GetPruneEdges(edges)
+	fooOld := mkEdge("sha256:aaa", "foo", "old")
+	fooStaleSig := mkEdge("sha256:e51", "foo", "sha256-eee.sig")
+	err := checkEqual(pruneEdges, map[reg.PromotionEdge]interface{}{
+		fooOld:      nil,
+		fooStaleSig: nil,
+	})
+	checkError(t, err, "checkError: test: GetPruneEdges\n")
+
+	// The prune is only allowed if "foo" may be removed.
+	var tests = []struct {
+		name     string
+		mfests   []reg.Manifest
+		expected error
+	}{
+		{
+			"Prune not allowed",
+			[]reg.Manifest{
+				{Registries: []reg.RegistryContext{src, dst}},
+			},
+			fmt.Errorf("refusing to prune: The following images were " +
+				"removed in this pull request: foo, foo"),
+		},
+		{
+			"Prune allowed",
+			[]reg.Manifest{
+				{
+					Registries:      []reg.RegistryContext{src, dst},
+					AllowedRemovals: []reg.ImageName{"foo"},
+				},
+			},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		got := reg.CheckPruneEdges(test.mfests, edges, pruneEdges)
+		err := checkEqual(got, test.expected)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (CheckPruneEdges)\n",
+				test.name))
+	}
+
+	captured := make(reg.CapturedRequests)
+	var processRequestFake reg.ProcessRequest = func(
+		sc *reg.SyncContext,
+		reqs chan stream.ExternalRequest,
+		errs chan<- reg.RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			pr := req.RequestParams.(reg.PromotionRequest)
+			mutex.Lock()
+			captured[pr]++
+			mutex.Unlock()
+			wg.Add(-1)
+		}
+	}
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		destRC reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+		return nil
+	}
+
+	sc.Threads = 1
+	err = sc.Prune(
+		context.Background(), pruneEdges, nopStream, &processRequestFake)
+	checkError(t, err, "checkError: test: Prune (error)\n")
+	err = checkEqual(captured, reg.CapturedRequests{
+		reg.PromotionRequest{
+			TagOp:          reg.Delete,
+			RegistrySrc:    "gcr.io/src",
+			RegistryDest:   "gcr.io/dst",
+			ServiceAccount: "robot",
+			ImageNameSrc:   "",
+			ImageNameDest:  "foo",
+			Digest:         "sha256:aaa",
+			Tag:            "old"}: 1,
+		reg.PromotionRequest{
+			TagOp:          reg.Delete,
+			RegistrySrc:    "gcr.io/src",
+			RegistryDest:   "gcr.io/dst",
+			ServiceAccount: "robot",
+			ImageNameSrc:   "",
+			ImageNameDest:  "foo",
+			Digest:         "sha256:e51",
+			Tag:            "sha256-eee.sig"}: 1,
+	})
+	checkError(t, err, "checkError: test: Prune\n")
+
+	// Nothing is pruned once the context is done.
+	captured = make(reg.CapturedRequests)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sc.Prune(ctx, pruneEdges, nopStream, &processRequestFake)
+	checkError(t, checkEqual(err, context.Canceled),
+		"checkError: test: Prune (canceled)\n")
+	checkError(t, checkEqual(captured, reg.CapturedRequests{}),
+		"checkError: test: Prune (canceled requests)\n")
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
+)
+
+// IsQuayDomain returns true if the given hostname belongs to Quay.
+func IsQuayDomain(domain string) bool {
+	return domain == "quay.io"
+}
+
+// quayClient is the RegistryClient for Quay. Quay registries are named after
+// the Quay namespace (organization or user), e.g. "quay.io/myorg". The
+// registry is read through Quay's API, and authentication uses a robot
+// account (see RegistryContext's Username and TokenEnv).
+type quayClient struct{}
+
+// GetToken reads the robot account token from the environment, if
+// credentials are configured for the registry.
+func (c *quayClient) GetToken(
+	rc RegistryContext,
+	useServiceAccount bool) (gcloud.Token, error) {
+
+	return getBasicAuthToken(rc)
+}
+
+// ListTags creates a QuayReader which reads the repository (or,
+// for the toplevel registry, lists the repositories of the namespace) with
+// Quay's API.
+func (c *quayClient) ListTags(
+	sc *SyncContext,
+	rc RegistryContext) stream.Producer {
+
+	_, domain, repoPath := GetTokenKeyDomainRepoPath(rc.Name)
+	toplevel := sc.isToplevelRegistry(rc.Name)
+
+	creds := sc.toplevelRegistryContext(rc)
+	var password gcloud.Token
+	if len(creds.Username) > 0 {
+		password = sc.getToken(creds)
+	}
+
+	mkPageCmd := func(page string) stream.Producer {
+		var endpoint string
+		if toplevel {
+			endpoint = fmt.Sprintf(
+				"https://%s/api/v1/repository?namespace=%s&next_page=%s",
+				domain,
+				url.QueryEscape(repoPath),
+				url.QueryEscape(page))
+		} else {
+			if len(page) == 0 {
+				page = "1"
+			}
+			endpoint = fmt.Sprintf(
+				"https://%s/api/v1/repository/%s/tag/"+
+					"?onlyActiveTags=true&limit=100&page=%s",
+				domain,
+				repoPath,
+				page)
+		}
+
+		httpReq, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			klog.Fatalf(
+				"could not create HTTP request for '%s/%s'",
+				domain,
+				repoPath)
+		}
+		if len(creds.Username) > 0 {
+			httpReq.SetBasicAuth(creds.Username, string(password))
+		}
+
+		return &stream.HTTP{
+			Req:       httpReq,
+			Transport: sc.transport(),
+		}
+	}
+
+	return &QuayReader{
+		RegistryName: rc.Name,
+		Toplevel:     toplevel,
+		MkPageCmd:    mkPageCmd,
+	}
+}
+
+// GetManifest creates a stream.Producer which fetches the manifest list (or
+// OCI image index) by digest with the standard registry API.
+func (c *quayClient) GetManifest(
+	sc *SyncContext,
+	gmlc GCRManifestListContext) stream.Producer {
+
+	return mkRegistryV2ManifestReader(
+		gmlc,
+		c.RemoteOptions(sc, gmlc.RegistryContext))
+}
+
+// CopyImage copies the image into the registry.
+func (c *quayClient) CopyImage(
+	sc *SyncContext,
+	srcRC RegistryContext,
+	src string,
+	dstRC RegistryContext,
+	dst string) error {
+
+	return copyImageTo(sc, srcRC, src, dst, c.RemoteOptions(sc, dstRC))
+}
+
+// RemoteOptions authenticates with the robot account, if configured.
+// Otherwise the default keychain is used.
+func (c *quayClient) RemoteOptions(
+	sc *SyncContext,
+	rc RegistryContext) []ggcrV1Remote.Option {
+
+	return sc.basicAuthOptions(rc)
+}
+
+// QuayReader is a stream.Producer which reads a registry through Quay's API,
+// and translates the result into GCR's "tags/list" format so that
+// ReadRegistries() can process it like any other repository.
+//
+// For the toplevel registry (the Quay namespace), only the names of the
+// repositories in it are read, and reported as child repositories. For
+// repositories, all active tags are read, and grouped by digest.
+//
+// Quay's API is paginated; MkPageCmd creates the stream.Producer for a single
+// page of results, where the empty string denotes the first page.
+type QuayReader struct {
+	RegistryName RegistryName
+	Toplevel     bool
+	MkPageCmd    func(page string) stream.Producer
+}
+
+// quayRepositoriesPage is a single page of Quay's list of repositories.
+type quayRepositoriesPage struct {
+	Repositories []struct {
+		Name string `json:"name"`
+	} `json:"repositories"`
+	NextPage string `json:"next_page"`
+}
+
+// quayTagsPage is a single page of Quay's list of tags of a repository.
+type quayTagsPage struct {
+	Tags          []quayTag `json:"tags"`
+	Page          int       `json:"page"`
+	HasAdditional bool      `json:"has_additional"`
+}
+
+// quayTag is a single tag of a repository, as returned by Quay's API.
+type quayTag struct {
+	Name           string `json:"name"`
+	ManifestDigest string `json:"manifest_digest"`
+	Size           int64  `json:"size"`
+	IsManifestList bool   `json:"is_manifest_list"`
+}
+
+// Produce reads all pages and returns the result as JSON on stdout.
+func (r *QuayReader) Produce() (io.Reader, io.Reader, error) {
+	_, _, repoPath := GetTokenKeyDomainRepoPath(r.RegistryName)
+	tags := gcrTags{
+		Children:  []string{},
+		Manifests: make(map[string]gcrManifestInfo),
+		Name:      repoPath,
+		Tags:      []string{},
+	}
+
+	var err error
+	if r.Toplevel {
+		err = r.readRepositories(&tags)
+	} else {
+		err = r.readTags(&tags)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.NewReader(b), strings.NewReader(""), nil
+}
+
+// Close does nothing, as all pages are closed by the time Produce() returns.
+func (r *QuayReader) Close() error {
+	return nil
+}
+
+func (r *QuayReader) readRepositories(tags *gcrTags) error {
+	page := ""
+	for {
+		var repos quayRepositoriesPage
+		if err := r.readPage(page, &repos); err != nil {
+			return err
+		}
+
+		for _, repo := range repos.Repositories {
+			tags.Children = append(tags.Children, repo.Name)
+		}
+
+		if len(repos.NextPage) == 0 {
+			return nil
+		}
+		page = repos.NextPage
+	}
+}
+
+func (r *QuayReader) readTags(tags *gcrTags) error {
+	page := ""
+	for {
+		var quayTags quayTagsPage
+		if err := r.readPage(page, &quayTags); err != nil {
+			return err
+		}
+
+		for _, qt := range quayTags.Tags {
+			info, ok := tags.Manifests[qt.ManifestDigest]
+			if !ok {
+				mediaType := ggcrV1Types.DockerManifestSchema2
+				if qt.IsManifestList {
+					mediaType = ggcrV1Types.DockerManifestList
+				}
+				info = gcrManifestInfo{
+					Size:      strconv.FormatInt(qt.Size, 10),
+					MediaType: string(mediaType),
+					Created:   "0",
+					Uploaded:  "0",
+				}
+			}
+			info.Tags = append(info.Tags, qt.Name)
+			tags.Manifests[qt.ManifestDigest] = info
+			tags.Tags = append(tags.Tags, qt.Name)
+		}
+
+		if !quayTags.HasAdditional {
+			return nil
+		}
+		page = strconv.Itoa(quayTags.Page + 1)
+	}
+}
+
+// readPage reads a single page of results into v.
+func (r *QuayReader) readPage(page string, v interface{}) error {
+	producer := r.MkPageCmd(page)
+	stdout, _, err := producer.Produce()
+	if err != nil {
+		return err
+	}
+	// nolint[errcheck]
+	defer producer.Close()
+
+	return json.NewDecoder(stdout).Decode(v)
+}
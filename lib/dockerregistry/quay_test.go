@@ -0,0 +1,180 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ggcrV1Types "github.com/google/go-containerregistry/pkg/v1/types"
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// TestQuayPromotionEdges reads a Quay source and destination registry with
+// QuayReader (using canned API responses), and checks the promotion edges
+// computed from a manifest that promotes from the Quay source registry.
+func TestQuayPromotionEdges(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "quay.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name: "quay.io/bar",
+	}
+	rcs := []reg.RegistryContext{srcRC, destRC}
+
+	// Canned API responses, keyed by registry name and page.
+	pages := map[reg.RegistryName]map[string]string{
+		"quay.io/foo": {
+			"":    `{"repositories": [{"name": "a"}], "next_page": "abc"}`,
+			"abc": `{"repositories": [{"name": "b"}]}`,
+		},
+		"quay.io/foo/a": {
+			"": `{
+  "tags": [
+    {"name": "0.9", "manifest_digest": "sha256:000", "size": 100},
+    {"name": "latest", "manifest_digest": "sha256:000", "size": 100}
+  ],
+  "page": 1,
+  "has_additional": true
+}`,
+			"2": `{
+  "tags": [
+    {"name": "1.0", "manifest_digest": "sha256:111", "size": 200}
+  ],
+  "page": 2,
+  "has_additional": false
+}`,
+		},
+		"quay.io/foo/b": {
+			"": `{
+  "tags": [
+    {"name": "v1", "manifest_digest": "sha256:222", "is_manifest_list": true}
+  ],
+  "page": 1,
+  "has_additional": false
+}`,
+		},
+		"quay.io/bar": {
+			"": `{"repositories": [{"name": "a"}]}`,
+		},
+		"quay.io/bar/a": {
+			"": `{
+  "tags": [
+    {"name": "0.9", "manifest_digest": "sha256:000", "size": 100}
+  ],
+  "page": 1,
+  "has_additional": false
+}`,
+		},
+	}
+
+	mkFakeQuayReader := func(
+		sc *reg.SyncContext,
+		rc reg.RegistryContext) stream.Producer {
+
+		toplevel := rc.Name == srcRC.Name || rc.Name == destRC.Name
+		return &reg.QuayReader{
+			RegistryName: rc.Name,
+			Toplevel:     toplevel,
+			MkPageCmd: func(page string) stream.Producer {
+				body, ok := pages[rc.Name][page]
+				if !ok {
+					checkError(
+						t,
+						fmt.Errorf("no page %q for %s", page, rc.Name),
+						"Test: TestQuayPromotionEdges\n")
+				}
+				return &stream.Fake{Bytes: []byte(body)}
+			},
+		}
+	}
+
+	sc := reg.SyncContext{
+		RegistryContexts: rcs,
+		Inv: reg.MasterInventory{
+			srcRC.Name:  nil,
+			destRC.Name: nil,
+		},
+		DigestMediaType: make(reg.DigestMediaType),
+		DigestImageSize: make(reg.DigestImageSize),
+	}
+	err := sc.ReadRegistries(context.Background(), rcs, true, mkFakeQuayReader)
+	checkError(t, err, "Test: TestQuayPromotionEdges\n")
+
+	expectedInv := reg.MasterInventory{
+		"quay.io/foo": {
+			"a": {
+				"sha256:000": {"0.9", "latest"},
+				"sha256:111": {"1.0"}},
+			"b": {
+				"sha256:222": {"v1"}}},
+		"quay.io/bar": {
+			"a": {
+				"sha256:000": {"0.9"}}},
+	}
+	err = checkEqual(sc.Inv, expectedInv)
+	checkError(t, err, "Test: TestQuayPromotionEdges (inventory)\n")
+
+	err = checkEqual(
+		sc.DigestMediaType["sha256:222"],
+		ggcrV1Types.DockerManifestList)
+	checkError(t, err, "Test: TestQuayPromotionEdges (media type)\n")
+
+	err = checkEqual(sc.DigestImageSize["sha256:111"], 200)
+	checkError(t, err, "Test: TestQuayPromotionEdges (image size)\n")
+
+	mfests := []reg.Manifest{
+		{
+			Registries: rcs,
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"0.9"}}},
+				{
+					ImageName: "b",
+					Dmap: reg.DigestTags{
+						"sha256:222": {"v1"}}},
+			},
+			SrcRegistry: &srcRC,
+		},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "Test: TestQuayPromotionEdges (ToPromotionEdges)\n")
+
+	got, clean := sc.GetPromotionCandidates(edges)
+	// Image "a" is already in the destination, so only "b" is promoted.
+	expected := map[reg.PromotionEdge]interface{}{
+		{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{
+				ImageName: "b",
+				Tag:       "v1"},
+			Digest:      "sha256:222",
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{
+				ImageName: "b",
+				Tag:       "v1"}}: nil,
+	}
+	err = checkEqual(got, expected)
+	checkError(t, err, "Test: TestQuayPromotionEdges (edges)\n")
+	err = checkEqual(clean, true)
+	checkError(t, err, "Test: TestQuayPromotionEdges (clean)\n")
+}
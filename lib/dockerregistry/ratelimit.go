@@ -0,0 +1,124 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces requests to a steady rate, while allowing short bursts
+// (a token bucket). It is safe for concurrent use, so that a single
+// RateLimiter can be shared by all the workers of a SyncContext. A nil
+// RateLimiter does not limit anything.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows rate requests per second
+// on average, and bursts of up to burst requests (at least 1). A rate of zero
+// (or less) means no limit, for which nil is returned.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Wait blocks until the next request may be sent, or until ctx is done (in
+// which case ctx.Err() is returned).
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token from the bucket, and returns how long to wait until
+// it is actually available. The bucket may go into debt, so that concurrent
+// requests are queued up at the given rate instead of all waking up at once.
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Transport wraps base, so that every request waits for the RateLimiter
+// first. A nil RateLimiter returns base as is.
+func (l *RateLimiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return base
+	}
+	return &rateLimitTransport{Base: base, Limiter: l}
+}
+
+// rateLimitTransport is an http.RoundTripper which paces the requests with a
+// RateLimiter.
+type rateLimitTransport struct {
+	Base    http.RoundTripper
+	Limiter *RateLimiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	if err := t.Limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+// countingTransport is an http.RoundTripper which replies 200 to every
+// request, and counts them. It is safe for concurrent use.
+type countingTransport struct {
+	calls int32
+}
+
+func (ct *countingTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	atomic.AddInt32(&ct.calls, 1)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     http.StatusText(http.StatusOK),
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}, nil
+}
+
+// sendConcurrently sends n requests through transport, from n goroutines at
+// once, and returns how long it took for all of them to complete.
+func sendConcurrently(
+	t *testing.T,
+	transport http.RoundTripper,
+	n int) time.Duration {
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "https://example.com", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestRateLimiterTransport(t *testing.T) {
+	var tests = []struct {
+		name       string
+		rate       float64
+		burst      int
+		requests   int
+		minElapsed time.Duration
+	}{
+		{
+			// The first 2 requests go out at once, and the other 4 are
+			// spaced by 50ms.
+			"Requests beyond the burst are paced",
+			20,
+			2,
+			6,
+			200 * time.Millisecond,
+		},
+		{
+			"Requests within the burst are not delayed",
+			1,
+			5,
+			5,
+			0,
+		},
+		{
+			"No limit",
+			0,
+			0,
+			10,
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		base := &countingTransport{}
+		limiter := reg.NewRateLimiter(test.rate, test.burst)
+		elapsed := sendConcurrently(
+			t,
+			limiter.Transport(base),
+			test.requests)
+
+		if int(base.calls) != test.requests {
+			t.Errorf(
+				"Test: %q: expected %d requests, got %d",
+				test.name,
+				test.requests,
+				base.calls)
+		}
+		// Allow some slack for timer granularity.
+		if elapsed < test.minElapsed-10*time.Millisecond {
+			t.Errorf(
+				"Test: %q: expected the requests to take at least %s, took %s",
+				test.name,
+				test.minElapsed,
+				elapsed)
+		}
+		// Unpaced requests (within the burst) should be (nearly) instant.
+		if test.minElapsed == 0 && elapsed > 500*time.Millisecond {
+			t.Errorf(
+				"Test: %q: expected the requests not to be delayed, took %s",
+				test.name,
+				elapsed)
+		}
+	}
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	limiter := reg.NewRateLimiter(0.001, 1)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("expected the first request to go through, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
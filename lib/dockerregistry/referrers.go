@@ -0,0 +1,346 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+)
+
+// ReferrerTagSuffixes are the suffixes of the tags that point to the
+// referrers (SBOMs, attestations) of a digest, in the same repository. The
+// referrers of "sha256:<hex>" are tagged "sha256-<hex>" followed by one of the
+// suffixes. The empty suffix is the tag schema of OCI referrers (an image
+// index of all referrers), ".sbom" is used by "cosign attach sbom", ".att" by
+// "cosign attest" (e.g., for SBOM attestations), and ".sig" by "cosign sign"
+// (see SignatureTag()).
+var ReferrerTagSuffixes = []string{"", ".att", ".sbom", ".sig"}
+
+// ReferrerTags returns the tags that may point to the referrers of the digest
+// (see ReferrerTagSuffixes).
+func ReferrerTags(digest Digest) []Tag {
+	prefix := strings.Replace(string(digest), ":", "-", 1)
+
+	tags := make([]Tag, 0, len(ReferrerTagSuffixes))
+	for _, suffix := range ReferrerTagSuffixes {
+		tags = append(tags, Tag(prefix+suffix))
+	}
+	return tags
+}
+
+// AddReferrerEdges returns the given edges, along with edges that promote the
+// referrers of their digests (see ReferrerTags()) from the source image to
+// the destination image, under the same tag. Only the referrers found in the
+// source registry inventory are promoted, unless their tag already points to
+// the same digest in the destination.
+//
+// If sc.ReferrersAPI is set, the referrers of every digest are also read with
+// the OCI referrers API (see readReferrers()), which finds the referrers that
+// are not tagged, such as signatures, attestations and provenance pushed by
+// OCI 1.1 clients. These are promoted by digest, unless the destination
+// already has them. Registries that do not support the API only have their
+// tagged referrers promoted.
+func (sc *SyncContext) AddReferrerEdges(
+	edges map[PromotionEdge]interface{}) map[PromotionEdge]interface{} {
+
+	// Many edges share the same source digest (e.g., with different tags),
+	// so its referrers are only read once.
+	type srcImageDigest struct {
+		RegistryName RegistryName
+		ImageName    ImageName
+		Digest       Digest
+	}
+	apiReferrers := make(map[srcImageDigest][]ggcrV1.Descriptor)
+
+	withReferrers := make(map[PromotionEdge]interface{})
+	for edge := range edges {
+		withReferrers[edge] = nil
+
+		tagged := make(map[Digest]interface{})
+		srcTags := sc.Inv[edge.SrcRegistry.Name][edge.SrcImageTag.ImageName]
+		for _, tag := range ReferrerTags(edge.Digest) {
+			digest, ok := srcTags.digestOf(tag)
+			if !ok {
+				continue
+			}
+			tagged[digest] = nil
+
+			referrer := edge
+			referrer.SrcImageTag.Tag = tag
+			referrer.Digest = digest
+			referrer.DstImageTag.Tag = tag
+
+			_, dp := referrer.VertexProps(sc.Inv)
+			if dp.PqinDigestMatch {
+				continue
+			}
+
+			logging.Log().Info(
+				"promoting referrer",
+				referrer.logFields()...)
+			withReferrers[referrer] = nil
+		}
+
+		if !sc.ReferrersAPI {
+			continue
+		}
+		key := srcImageDigest{
+			edge.SrcRegistry.Name,
+			edge.SrcImageTag.ImageName,
+			edge.Digest,
+		}
+		descs, ok := apiReferrers[key]
+		if !ok {
+			descs = sc.readReferrersOrLog(edge)
+			apiReferrers[key] = descs
+		}
+		for _, desc := range descs {
+			digest := Digest(desc.Digest.String())
+			// Tagged referrers are promoted under their tag (above).
+			if _, ok := tagged[digest]; ok {
+				continue
+			}
+
+			referrer := edge
+			referrer.SrcImageTag.Tag = ""
+			referrer.Digest = digest
+			referrer.DstImageTag.Tag = ""
+
+			_, dp := referrer.VertexProps(sc.Inv)
+			if dp.DigestExists {
+				continue
+			}
+
+			logging.Log().Info(
+				"promoting referrer",
+				append(referrer.logFields(),
+					"mediaType", desc.MediaType)...)
+			withReferrers[referrer] = nil
+		}
+	}
+
+	return withReferrers
+}
+
+// keepReferrers removes from candidates (the untagged digests of the image
+// of the rc registry that garbage collection would delete) the referrers of
+// the digests that are kept, and the referrers of those in turn, as read with
+// the OCI referrers API (see readReferrers()). Untagged referrers, such as the
+// ones promoted by AddReferrerEdges(), belong to their subject, and so must
+// not be deleted as long as it is kept.
+//
+// If the referrers of a kept digest cannot be read, all candidates are
+// removed (and so nothing of the image is deleted), as it would be unsafe to
+// delete any of them.
+func (sc *SyncContext) keepReferrers(
+	rc RegistryContext,
+	imageName ImageName,
+	digestTags DigestTags,
+	candidates map[Digest]interface{}) {
+
+	var kept []Digest
+	for digest := range digestTags {
+		if _, ok := candidates[digest]; !ok {
+			kept = append(kept, digest)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+
+	for len(kept) > 0 {
+		digest := kept[0]
+		kept = kept[1:]
+
+		descs, supported, err := sc.readReferrers(rc, imageName, digest)
+		if err != nil {
+			logging.Log().Error(err, "could not read referrers; "+
+				"not garbage collecting the image",
+				"registry", rc.Name,
+				"image", imageName,
+				"digest", digest)
+			for candidate := range candidates {
+				delete(candidates, candidate)
+			}
+			return
+		}
+		if !supported {
+			return
+		}
+		for _, desc := range descs {
+			referrer := Digest(desc.Digest.String())
+			if _, ok := candidates[referrer]; !ok {
+				continue
+			}
+			logging.Log().Info("keeping referrer",
+				"registry", rc.Name,
+				"image", imageName,
+				"digest", referrer,
+				"subject", digest)
+			delete(candidates, referrer)
+			kept = append(kept, referrer)
+		}
+	}
+}
+
+// readReferrersOrLog reads the referrers of the source digest of the edge
+// with readReferrers(). A failure to do so is only logged, as the tagged
+// referrers are still promoted.
+func (sc *SyncContext) readReferrersOrLog(
+	edge PromotionEdge) []ggcrV1.Descriptor {
+
+	log := logging.Log().WithValues(edge.logFields()...)
+	descs, supported, err := sc.readReferrers(
+		edge.SrcRegistry,
+		edge.SrcImageTag.ImageName,
+		edge.Digest)
+	if err != nil {
+		log.Error(err, "could not read referrers; "+
+			"only the tagged referrers are promoted")
+		return nil
+	}
+	if !supported {
+		log.Info("the referrers API is not supported; " +
+			"only the tagged referrers are promoted")
+	}
+	return descs
+}
+
+// readReferrers reads the referrers of the digest in the image of the rc
+// registry with the OCI referrers API ("/v2/<name>/referrers/<digest>"),
+// sorted by digest. The returned bool is false if the registry does not
+// support the API (it responds 404), in which case the referrers can only be
+// found by their tags (see ReferrerTags()).
+func (sc *SyncContext) readReferrers(
+	rc RegistryContext,
+	imageName ImageName,
+	digest Digest) ([]ggcrV1.Descriptor, bool, error) {
+
+	repo, err := name.NewRepository(string(rc.Name) + "/" + string(imageName))
+	if err != nil {
+		return nil, false, err
+	}
+	auth, err := sc.referrersAuth(rc, repo)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sc.Budget.Acquire()
+	defer sc.Budget.Release()
+
+	// The transport takes care of the registry's authentication handshake,
+	// and of its scheme.
+	rt, err := transport.New(
+		repo.Registry,
+		auth,
+		sc.transport(),
+		[]string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, false, err
+	}
+
+	httpReq, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s://%s/v2/%s/referrers/%s",
+			repo.Registry.Scheme(),
+			repo.RegistryStr(),
+			repo.RepositoryStr(),
+			digest),
+		nil)
+	if err != nil {
+		return nil, false, err
+	}
+	httpReq.Header.Set("Accept", referrersMediaType)
+
+	res, err := (&http.Client{Transport: rt}).Do(httpReq)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("%s %s: unexpected status %s",
+			httpReq.Method,
+			httpReq.URL,
+			res.Status)
+	}
+
+	var index ggcrV1.IndexManifest
+	if err := json.NewDecoder(res.Body).Decode(&index); err != nil {
+		return nil, false, fmt.Errorf("decoding the referrers of %s@%s: %v",
+			repo, digest, err)
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		return index.Manifests[i].Digest.String() <
+			index.Manifests[j].Digest.String()
+	})
+	return index.Manifests, true, nil
+}
+
+// referrersMediaType is the media type of the responses of the OCI referrers
+// API (an image index, whose manifests are the referrers).
+const referrersMediaType = "application/vnd.oci.image.index.v1+json"
+
+// referrersAuth returns the credentials with which to read the referrers of
+// the images of the rc registry: its username and token if it has any, its
+// access token if one was populated (see PopulateTokens()), and those of the
+// default keychain (the Docker config file) otherwise.
+func (sc *SyncContext) referrersAuth(
+	rc RegistryContext,
+	repo name.Repository) (authn.Authenticator, error) {
+
+	rc = sc.toplevelRegistryContext(rc)
+	if len(rc.Username) > 0 {
+		return &authn.Basic{
+			Username: rc.Username,
+			Password: string(sc.getToken(rc)),
+		}, nil
+	}
+
+	tokenKey, _, _ := GetTokenKeyDomainRepoPath(RegistryName(repo.Name()))
+	if token := sc.Tokens[RootRepo(tokenKey)]; len(token) > 0 {
+		return &authn.Basic{
+			Username: "oauth2accesstoken",
+			Password: string(token),
+		}, nil
+	}
+
+	return authn.DefaultKeychain.Resolve(repo.Registry)
+}
+
+// digestOf returns the digest that the tag points to, if any.
+func (dt DigestTags) digestOf(tag Tag) (Digest, bool) {
+	for digest, tags := range dt {
+		for _, t := range tags {
+			if t == tag {
+				return digest, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,488 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestReferrerTags(t *testing.T) {
+	got := reg.ReferrerTags("sha256:000")
+	expected := []reg.Tag{
+		"sha256-000",
+		"sha256-000.att",
+		"sha256-000.sbom",
+		"sha256-000.sig",
+	}
+
+	eqErr := checkEqual(got, expected)
+	checkError(t, eqErr, "unexpected referrer tags\n")
+}
+
+func TestPromoteReferrers(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	// The source has an SBOM and an attestation for sha256:000, and the
+	// destination already has the attestation.
+	inv := reg.MasterInventory{
+		"gcr.io/foo": {
+			"a": {
+				"sha256:000": {"1.0"},
+				"sha256:aaa": {"sha256-000.att"},
+				"sha256:bbb": {"sha256-000.sbom"},
+				"sha256:ccc": {"sha256-111.sbom"},
+			},
+		},
+		"gcr.io/bar": {
+			"a": {
+				"sha256:aaa": {"sha256-000.att"},
+			},
+		},
+	}
+
+	mkReq := func(digest reg.Digest, tag reg.Tag) reg.PromotionRequest {
+		return reg.PromotionRequest{
+			TagOp:          reg.Add,
+			RegistrySrc:    srcRC.Name,
+			RegistryDest:   destRC.Name,
+			ServiceAccount: destRC.ServiceAccount,
+			ImageNameSrc:   "a",
+			ImageNameDest:  "a",
+			Digest:         digest,
+			Tag:            tag,
+		}
+	}
+
+	var tests = []struct {
+		name          string
+		copyReferrers bool
+		expectedReqs  reg.CapturedRequests
+	}{
+		{
+			"Referrers are not copied by default",
+			false,
+			reg.CapturedRequests{
+				mkReq("sha256:000", "1.0"): 1,
+			},
+		},
+		{
+			"Missing referrers are copied",
+			true,
+			reg.CapturedRequests{
+				mkReq("sha256:000", "1.0"):             1,
+				mkReq("sha256:bbb", "sha256-000.sbom"): 1,
+			},
+		},
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		captured := make(reg.CapturedRequests)
+		processRequestFake := reg.MkRequestCapturer(&captured)
+
+		sc := reg.SyncContext{
+			Inv:           inv,
+			CopyReferrers: test.copyReferrers,
+		}
+
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("Test: %v (edges)\n", test.name))
+
+		filteredEdges, _ := sc.FilterPromotionEdges(ctx, edges, false)
+		_, err = sc.Promote(ctx, filteredEdges, nopStream, &processRequestFake)
+		checkError(t, err, fmt.Sprintf("Test: %v (promotion)\n", test.name))
+
+		eqErr := checkEqual(captured, test.expectedReqs)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (requests)\n", test.name))
+	}
+}
+
+func TestPromoteReferrersAPI(t *testing.T) {
+	mkDigest := func(c string) reg.Digest {
+		return reg.Digest("sha256:" + strings.Repeat(c, 64))
+	}
+	imageDigest := mkDigest("0")
+	sbomDigest := mkDigest("b")
+	signatureDigest := mkDigest("d")
+	provenanceDigest := mkDigest("e")
+	promotedDigest := mkDigest("f")
+
+	// The referrers API of the source knows about the SBOM (which is also
+	// tagged), a signature and a provenance attestation (which are not), and
+	// another signature which is already in the destination.
+	index := fmt.Sprintf(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json",
+     "digest": %q, "size": 10},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json",
+     "digest": %q, "size": 10},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json",
+     "digest": %q, "size": 10},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json",
+     "digest": %q, "size": 10}
+  ]
+}`, provenanceDigest, signatureDigest, sbomDigest, promotedDigest)
+
+	var mutex sync.Mutex
+	supported := true
+	reads := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case "/v2/foo/referrers/" + string(imageDigest):
+				mutex.Lock()
+				defer mutex.Unlock()
+				reads++
+				if !supported {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type",
+					"application/vnd.oci.image.index.v1+json")
+				fmt.Fprint(w, index)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+
+	srcRC := reg.RegistryContext{
+		Name: reg.RegistryName(strings.Replace(
+			server.URL, "http://127.0.0.1", "localhost", 1)),
+		Src: true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo",
+				Dmap: reg.DigestTags{
+					imageDigest: {"1.0", "latest"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	inv := reg.MasterInventory{
+		srcRC.Name: {
+			"foo": {
+				imageDigest:      {"1.0", "latest"},
+				sbomDigest:       {reg.ReferrerTags(imageDigest)[2]},
+				signatureDigest:  {},
+				provenanceDigest: {},
+				promotedDigest:   {},
+			},
+		},
+		"gcr.io/bar": {
+			"foo": {
+				promotedDigest: {},
+			},
+		},
+	}
+
+	mkReq := func(digest reg.Digest, tag reg.Tag) reg.PromotionRequest {
+		return reg.PromotionRequest{
+			TagOp:          reg.Add,
+			RegistrySrc:    srcRC.Name,
+			RegistryDest:   destRC.Name,
+			ServiceAccount: destRC.ServiceAccount,
+			ImageNameSrc:   "foo",
+			ImageNameDest:  "foo",
+			Digest:         digest,
+			Tag:            tag,
+		}
+	}
+	tagged := reg.CapturedRequests{
+		mkReq(imageDigest, "1.0"):                           1,
+		mkReq(imageDigest, "latest"):                        1,
+		mkReq(sbomDigest, reg.ReferrerTags(imageDigest)[2]): 1,
+	}
+
+	var tests = []struct {
+		name          string
+		referrersAPI  bool
+		supported     bool
+		expectedReads int
+		expectedReqs  reg.CapturedRequests
+	}{
+		{
+			"Referrers API disabled",
+			false,
+			true,
+			0,
+			tagged,
+		},
+		{
+			"Untagged referrers are copied by digest",
+			true,
+			true,
+			1,
+			reg.CapturedRequests{
+				mkReq(imageDigest, "1.0"):                           1,
+				mkReq(imageDigest, "latest"):                        1,
+				mkReq(sbomDigest, reg.ReferrerTags(imageDigest)[2]): 1,
+				mkReq(signatureDigest, ""):                          1,
+				mkReq(provenanceDigest, ""):                         1,
+			},
+		},
+		{
+			"Fallback to the referrer tags",
+			true,
+			false,
+			1,
+			tagged,
+		},
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		mutex.Lock()
+		supported = test.supported
+		reads = 0
+		mutex.Unlock()
+
+		captured := make(reg.CapturedRequests)
+		processRequestFake := reg.MkRequestCapturer(&captured)
+
+		sc := reg.SyncContext{
+			Inv:           inv,
+			CopyReferrers: true,
+			ReferrersAPI:  test.referrersAPI,
+		}
+
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("Test: %v (edges)\n", test.name))
+
+		filteredEdges, _ := sc.FilterPromotionEdges(ctx, edges, false)
+		_, err = sc.Promote(ctx, filteredEdges, nopStream, &processRequestFake)
+		checkError(t, err, fmt.Sprintf("Test: %v (promotion)\n", test.name))
+
+		eqErr := checkEqual(captured, test.expectedReqs)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (requests)\n", test.name))
+
+		// Both tags of the image share its referrers, which are read once.
+		eqErr = checkEqual(reads, test.expectedReads)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (reads)\n", test.name))
+	}
+}
+
+func TestGarbageCollectionKeepsReferrers(t *testing.T) {
+	mkDigest := func(c string) reg.Digest {
+		return reg.Digest("sha256:" + strings.Repeat(c, 64))
+	}
+	imageDigest := mkDigest("0")
+	signatureDigest := mkDigest("d")
+	// A signature of the signature
+	countersignatureDigest := mkDigest("c")
+	garbageDigest := mkDigest("f")
+
+	mkIndex := func(digests ...reg.Digest) string {
+		var manifests []string
+		for _, digest := range digests {
+			manifests = append(manifests, fmt.Sprintf(
+				`{"mediaType": "application/vnd.oci.image.manifest.v1+json", `+
+					`"digest": %q, "size": 10}`, digest))
+		}
+		return fmt.Sprintf(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [%s]
+}`, strings.Join(manifests, ","))
+	}
+
+	var mutex sync.Mutex
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			var index string
+			switch r.URL.Path {
+			case "/v2/":
+				w.WriteHeader(http.StatusOK)
+				return
+			case "/v2/foo/referrers/" + string(imageDigest):
+				index = mkIndex(signatureDigest)
+			case "/v2/foo/referrers/" + string(signatureDigest):
+				index = mkIndex(countersignatureDigest)
+			default:
+				index = mkIndex()
+			}
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.index.v1+json")
+			fmt.Fprint(w, index)
+		}))
+	defer server.Close()
+
+	srcRC := reg.RegistryContext{Name: "gcr.io/foo", Src: true}
+	destRC := reg.RegistryContext{
+		Name: reg.RegistryName(strings.Replace(
+			server.URL, "http://127.0.0.1", "localhost", 1)),
+	}
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "foo",
+				Dmap:      reg.DigestTags{imageDigest: {"1.0"}},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+	inv := reg.MasterInventory{
+		destRC.Name: {
+			"foo": {
+				imageDigest:            {"1.0"},
+				signatureDigest:        {},
+				countersignatureDigest: {},
+				garbageDigest:          {},
+			},
+		},
+	}
+
+	mkReq := func(digest reg.Digest) reg.PromotionRequest {
+		return reg.PromotionRequest{
+			TagOp:         reg.Delete,
+			RegistrySrc:   srcRC.Name,
+			RegistryDest:  destRC.Name,
+			ImageNameDest: "foo",
+			Digest:        digest,
+		}
+	}
+
+	var tests = []struct {
+		name         string
+		referrersAPI bool
+		status       int
+		expected     []reg.PromotionRequest
+	}{
+		{
+			"Referrers API disabled",
+			false,
+			http.StatusOK,
+			[]reg.PromotionRequest{
+				mkReq(countersignatureDigest),
+				mkReq(signatureDigest),
+				mkReq(garbageDigest),
+			},
+		},
+		{
+			"Referrers of kept digests are kept",
+			true,
+			http.StatusOK,
+			[]reg.PromotionRequest{mkReq(garbageDigest)},
+		},
+		{
+			"Referrers API not supported",
+			true,
+			http.StatusNotFound,
+			[]reg.PromotionRequest{
+				mkReq(countersignatureDigest),
+				mkReq(signatureDigest),
+				mkReq(garbageDigest),
+			},
+		},
+		{
+			"Referrers cannot be read",
+			true,
+			http.StatusInternalServerError,
+			[]reg.PromotionRequest{},
+		},
+	}
+
+	for _, test := range tests {
+		mutex.Lock()
+		status = test.status
+		mutex.Unlock()
+
+		sc := reg.SyncContext{
+			Inv:          inv,
+			ReferrersAPI: test.referrersAPI,
+		}
+		got := sc.GetGarbageCollectionCandidates(mfest)
+
+		eqErr := checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v\n", test.name))
+	}
+}
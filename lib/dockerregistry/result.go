@@ -0,0 +1,299 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func newPromotionRecorder() *promotionRecorder {
+	return &promotionRecorder{
+		promoted: make(map[PromotionRequest]TagSlice),
+		failed:   make(map[PromotionRequest]TagSlice),
+		errors:   make(map[PromotionRequest][]string),
+	}
+}
+
+// resultKey returns the PromotionRequest without the fields that differ
+// between the requests of the same copy (see CollapsePromotionEdges()).
+func resultKey(pr PromotionRequest) PromotionRequest {
+	return PromotionRequest{
+		RegistrySrc:   pr.RegistrySrc,
+		RegistryDest:  pr.RegistryDest,
+		ImageNameSrc:  pr.ImageNameSrc,
+		ImageNameDest: pr.ImageNameDest,
+		Digest:        pr.Digest,
+	}
+}
+
+// record records the outcome of a PromotionRequest.
+func (r *promotionRecorder) record(pr PromotionRequest, errs Errors) {
+	r.progress.record(pr, errs)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := resultKey(pr)
+	outcomes := r.promoted
+	if len(errs) > 0 {
+		outcomes = r.failed
+		for _, err := range errs {
+			r.errors[key] = append(r.errors[key], err.Error.Error())
+		}
+	}
+
+	tags, ok := outcomes[key]
+	if !ok {
+		tags = TagSlice{}
+	}
+	if len(pr.Tag) > 0 {
+		tags = append(tags, pr.Tag)
+	}
+	outcomes[key] = tags
+}
+
+// wrap returns a ProcessRequest that records the results of the given one,
+// before passing them on.
+func (r *promotionRecorder) wrap(processRequest ProcessRequest) ProcessRequest {
+	return observeResults(processRequest, func(reqRes RequestResult) {
+		pr, ok := reqRes.Context.RequestParams.(PromotionRequest)
+		if ok {
+			r.record(pr, reqRes.Errors)
+		}
+	})
+}
+
+// observeResults returns a ProcessRequest that passes the results of the given
+// one to observe, before passing them on.
+func observeResults(
+	processRequest ProcessRequest,
+	observe func(RequestResult)) ProcessRequest {
+
+	return func(
+		sc *SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		results := make(chan RequestResult)
+		done := make(chan struct{})
+		go func() {
+			for reqRes := range results {
+				observe(reqRes)
+				requestResults <- reqRes
+			}
+			close(done)
+		}()
+
+		processRequest(sc, reqs, results, wg, mutex)
+		close(results)
+		<-done
+	}
+}
+
+// result returns the PromotionResult of the recorded requests, along with
+// the given edges that were skipped because they were already promoted.
+func (r *promotionRecorder) result(
+	sc *SyncContext,
+	skipped map[PromotionEdge]interface{}) PromotionResult {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := PromotionResult{
+		DryRun:   sc.DryRun,
+		Promoted: make([]PromotionEdgeResult, 0),
+		Skipped:  make([]PromotionEdgeResult, 0),
+		Failed:   make([]PromotionEdgeResult, 0),
+	}
+
+	for key, tags := range r.promoted {
+		res.Promoted = append(
+			res.Promoted,
+			sc.mkEdgeResult(key, tags, StatusPromoted, nil))
+	}
+	for key, tags := range r.failed {
+		res.Failed = append(
+			res.Failed,
+			sc.mkEdgeResult(key, tags, StatusFailed, r.errors[key]))
+	}
+	for edge, tags := range CollapsePromotionEdges(skipped) {
+		key := PromotionRequest{
+			RegistrySrc:   edge.SrcRegistry.Name,
+			RegistryDest:  edge.DstRegistry.Name,
+			ImageNameSrc:  edge.SrcImageTag.ImageName,
+			ImageNameDest: edge.DstImageTag.ImageName,
+			Digest:        edge.Digest,
+		}
+		res.Skipped = append(
+			res.Skipped,
+			sc.mkEdgeResult(key, tags, StatusSkipped, nil))
+	}
+
+	sortEdgeResults(res.Promoted)
+	sortEdgeResults(res.Skipped)
+	sortEdgeResults(res.Failed)
+
+	return res
+}
+
+func (sc *SyncContext) mkEdgeResult(
+	key PromotionRequest,
+	tags TagSlice,
+	status string,
+	errs []string) PromotionEdgeResult {
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	sort.Strings(errs)
+
+	return PromotionEdgeResult{
+		Image:       key.ImageNameDest,
+		Digest:      key.Digest,
+		Source:      ToLQIN(key.RegistrySrc, key.ImageNameSrc),
+		Destination: ToLQIN(key.RegistryDest, key.ImageNameDest),
+		Tags:        tags,
+		Bytes:       int64(sc.DigestImageSize[key.Digest]),
+		Status:      status,
+		Errors:      errs,
+		DeclaredAt:  sc.declaredAt(key.ImageNameSrc, key.Digest),
+	}
+}
+
+// declaredAt returns the position of the digest of the image in the
+// manifests, or "" if it is unknown.
+func (sc *SyncContext) declaredAt(imageName ImageName, digest Digest) string {
+	pos, ok := sc.Positions[ImageDigest{ImageName: imageName, Digest: digest}]
+	if !ok {
+		return ""
+	}
+	return pos.String()
+}
+
+func sortEdgeResults(results []PromotionEdgeResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Destination != results[j].Destination {
+			return results[i].Destination < results[j].Destination
+		}
+		if results[i].Digest != results[j].Digest {
+			return results[i].Digest < results[j].Digest
+		}
+		return results[i].Source < results[j].Source
+	})
+}
+
+// EdgeCount returns the number of PromotionEdges that the results stand for:
+// one per tag, or one for a tagless promotion.
+func EdgeCount(results []PromotionEdgeResult) int {
+	count := 0
+	for _, res := range results {
+		if len(res.Tags) == 0 {
+			count++
+			continue
+		}
+		count += len(res.Tags)
+	}
+	return count
+}
+
+// Counts returns the number of promoted, skipped and failed edges of the
+// PromotionResult (see EdgeCount()).
+func (res PromotionResult) Counts() PromotionCounts {
+	return PromotionCounts{
+		Promoted: EdgeCount(res.Promoted),
+		Skipped:  EdgeCount(res.Skipped),
+		Failed:   EdgeCount(res.Failed),
+	}
+}
+
+// NoOp returns true if nothing was promoted, and nothing failed, i.e. if the
+// destinations already had every image (or there were no images at all).
+func (counts PromotionCounts) NoOp() bool {
+	return counts.Promoted == 0 && counts.Failed == 0
+}
+
+// String renders the counts as a one-line summary.
+func (counts PromotionCounts) String() string {
+	return fmt.Sprintf(
+		"%d promoted, %d skipped, %d failed",
+		counts.Promoted,
+		counts.Skipped,
+		counts.Failed)
+}
+
+// logSummary logs the counts of the PromotionResult, and whether the
+// promotion was a no-op.
+func (res PromotionResult) logSummary() {
+	counts := res.Counts()
+	logging.Log().Info("promotion summary",
+		"promoted", counts.Promoted,
+		"skipped", counts.Skipped,
+		"failed", counts.Failed,
+		"noOp", counts.NoOp())
+	if counts.NoOp() {
+		klog.Infof(
+			"All %d promotion(s) were skipped --- nothing was promoted.",
+			counts.Skipped)
+	}
+}
+
+// ToJSON renders the PromotionResult as an indented JSON object.
+func (res PromotionResult) ToJSON() (string, error) {
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// PromotionFailures is the error returned by Promote() with
+// SyncContext.KeepGoing, once every edge has been attempted. It lists all the
+// failed promotions.
+type PromotionFailures struct {
+	Failed []PromotionEdgeResult
+}
+
+// Error implements the error interface.
+func (err PromotionFailures) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d promotion(s) failed:", EdgeCount(err.Failed))
+	for _, res := range err.Failed {
+		fmt.Fprintf(&sb, "\n  %s", res.Destination)
+		if len(res.Tags) > 0 {
+			fmt.Fprintf(&sb, ":%s", joinTags(res.Tags))
+		}
+		fmt.Fprintf(&sb, "@%s: %s", res.Digest, strings.Join(res.Errors, "; "))
+	}
+	return sb.String()
+}
+
+// joinTags joins the tags with commas.
+func joinTags(tags TagSlice) string {
+	strs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		strs = append(strs, string(tag))
+	}
+	return strings.Join(strs, ",")
+}
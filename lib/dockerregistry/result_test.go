@@ -0,0 +1,400 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestPromotionResult(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0", "1"},
+					"sha256:111": {"2.0"},
+					"sha256:222": {"3.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	sc := reg.SyncContext{
+		Inv: reg.MasterInventory{
+			"gcr.io/foo": {
+				"a": {
+					"sha256:000": {"1.0", "1"},
+					"sha256:111": {"2.0"},
+					"sha256:222": {"3.0"},
+				},
+			},
+			"gcr.io/bar": {
+				"a": {
+					"sha256:222": {"3.0"},
+				},
+			},
+		},
+		DigestImageSize: reg.DigestImageSize{
+			"sha256:000": 10,
+			"sha256:111": 20,
+			"sha256:222": 30,
+		},
+	}
+
+	// Fail the promotion of the "2.0" tag.
+	var processRequestFake reg.ProcessRequest = func(
+		sc *reg.SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- reg.RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			reqRes := reg.RequestResult{Context: req}
+			pr := req.RequestParams.(reg.PromotionRequest)
+			if pr.Tag == "2.0" {
+				reqRes.Errors = reg.Errors{
+					{
+						Context: "running writeImage()",
+						Error:   fmt.Errorf("copy failed"),
+					},
+				}
+			}
+			requestResults <- reqRes
+		}
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	ctx := context.Background()
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "unexpected error getting promotion edges\n")
+
+	filteredEdges, clean := sc.FilterPromotionEdges(ctx, edges, false)
+	eqErr := checkEqual(clean, true)
+	checkError(t, eqErr, "unexpected edge filtering cleanliness\n")
+
+	got, err := sc.Promote(ctx, filteredEdges, nopStream, &processRequestFake)
+	eqErr = checkEqual(err != nil, true)
+	checkError(t, eqErr, "expected a promotion error\n")
+
+	expected := reg.PromotionResult{
+		Promoted: []reg.PromotionEdgeResult{
+			{
+				Image:       "a",
+				Digest:      "sha256:000",
+				Source:      "gcr.io/foo/a",
+				Destination: "gcr.io/bar/a",
+				Tags:        reg.TagSlice{"1", "1.0"},
+				Bytes:       10,
+				Status:      reg.StatusPromoted,
+			},
+		},
+		Skipped: []reg.PromotionEdgeResult{
+			{
+				Image:       "a",
+				Digest:      "sha256:222",
+				Source:      "gcr.io/foo/a",
+				Destination: "gcr.io/bar/a",
+				Tags:        reg.TagSlice{"3.0"},
+				Bytes:       30,
+				Status:      reg.StatusSkipped,
+			},
+		},
+		Failed: []reg.PromotionEdgeResult{
+			{
+				Image:       "a",
+				Digest:      "sha256:111",
+				Source:      "gcr.io/foo/a",
+				Destination: "gcr.io/bar/a",
+				Tags:        reg.TagSlice{"2.0"},
+				Bytes:       20,
+				Status:      reg.StatusFailed,
+				Errors:      []string{"copy failed"},
+			},
+		},
+	}
+
+	eqErr = checkEqual(got, expected)
+	checkError(t, eqErr, "unexpected PromotionResult\n")
+
+	gotJSON, err := got.ToJSON()
+	checkError(t, err, "unexpected error rendering the PromotionResult\n")
+
+	expectedJSON := `{
+  "dryRun": false,
+  "promoted": [
+    {
+      "image": "a",
+      "digest": "sha256:000",
+      "source": "gcr.io/foo/a",
+      "destination": "gcr.io/bar/a",
+      "tags": [
+        "1",
+        "1.0"
+      ],
+      "bytes": 10,
+      "status": "promoted"
+    }
+  ],
+  "skipped": [
+    {
+      "image": "a",
+      "digest": "sha256:222",
+      "source": "gcr.io/foo/a",
+      "destination": "gcr.io/bar/a",
+      "tags": [
+        "3.0"
+      ],
+      "bytes": 30,
+      "status": "skipped"
+    }
+  ],
+  "failed": [
+    {
+      "image": "a",
+      "digest": "sha256:111",
+      "source": "gcr.io/foo/a",
+      "destination": "gcr.io/bar/a",
+      "tags": [
+        "2.0"
+      ],
+      "bytes": 20,
+      "status": "failed",
+      "errors": [
+        "copy failed"
+      ]
+    }
+  ]
+}`
+
+	eqErr = checkEqual(gotJSON, expectedJSON)
+	checkError(t, eqErr, "unexpected PromotionResult JSON\n")
+
+	// With KeepGoing, the error lists every failed promotion.
+	sc.KeepGoing = true
+	_, err = sc.Promote(ctx, filteredEdges, nopStream, &processRequestFake)
+	eqErr = checkEqual(fmt.Sprint(err), `1 promotion(s) failed:
+  gcr.io/bar/a:2.0@sha256:111: copy failed`)
+	checkError(t, eqErr, "unexpected KeepGoing error\n")
+}
+
+func TestPromotionCounts(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0", "1"},
+					"sha256:111": {"2.0"},
+				},
+			},
+			{
+				ImageName: "b",
+				Dmap: reg.DigestTags{
+					"sha256:222": {},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+	srcInv := reg.RegInvImage{
+		"a": {
+			"sha256:000": {"1.0", "1"},
+			"sha256:111": {"2.0"},
+		},
+		"b": {
+			"sha256:222": {},
+		},
+	}
+
+	var processRequestFake reg.ProcessRequest = func(
+		sc *reg.SyncContext,
+		reqs chan stream.ExternalRequest,
+		requestResults chan<- reg.RequestResult,
+		wg *sync.WaitGroup,
+		mutex *sync.Mutex) {
+
+		for req := range reqs {
+			requestResults <- reg.RequestResult{Context: req}
+		}
+	}
+
+	nopStream := func(
+		srcRegistry reg.RegistryName,
+		srcImageName reg.ImageName,
+		rc reg.RegistryContext,
+		destImageName reg.ImageName,
+		digest reg.Digest,
+		tag reg.Tag,
+		tp reg.TagOp) stream.Producer {
+
+		return nil
+	}
+
+	var tests = []struct {
+		name     string
+		destInv  reg.RegInvImage
+		expected reg.PromotionCounts
+		noOp     bool
+		failed   bool
+	}{
+		{
+			"Empty destination",
+			reg.RegInvImage{},
+			reg.PromotionCounts{Promoted: 4},
+			false,
+			false,
+		},
+		{
+			"Fully present",
+			srcInv,
+			reg.PromotionCounts{Skipped: 4},
+			true,
+			false,
+		},
+		{
+			"Partially present",
+			reg.RegInvImage{
+				"a": {
+					"sha256:000": {"1.0"},
+				},
+				"b": {
+					"sha256:222": {},
+				},
+			},
+			reg.PromotionCounts{Promoted: 2, Skipped: 2},
+			false,
+			false,
+		},
+		{
+			// Tags cannot be moved, so the "2.0" tag is skipped.
+			"Tag pointing to another digest",
+			reg.RegInvImage{
+				"a": {
+					"sha256:000": {"1.0", "1"},
+					"sha256:999": {"2.0"},
+				},
+			},
+			reg.PromotionCounts{Promoted: 1, Skipped: 3},
+			false,
+			false,
+		},
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Inv: reg.MasterInventory{
+				"gcr.io/foo": srcInv,
+				"gcr.io/bar": test.destInv,
+			},
+			DigestImageSize: reg.DigestImageSize{},
+		}
+
+		edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n",
+			test.name))
+
+		filteredEdges, clean := sc.FilterPromotionEdges(ctx, edges, false)
+		eqErr := checkEqual(clean, true)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (clean)\n",
+			test.name))
+
+		got, err := sc.Promote(
+			ctx, filteredEdges, nopStream, &processRequestFake)
+		eqErr = checkEqual(err != nil, test.failed)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (promote)\n",
+			test.name))
+
+		eqErr = checkEqual(got.Counts(), test.expected)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (counts)\n",
+			test.name))
+
+		eqErr = checkEqual(got.Counts().NoOp(), test.noOp)
+		checkError(t, eqErr, fmt.Sprintf("checkError: test: %v (no-op)\n",
+			test.name))
+	}
+
+	counts := reg.PromotionCounts{Promoted: 2, Skipped: 5, Failed: 1}
+	eqErr := checkEqual(
+		counts.String(),
+		"2 promoted, 5 skipped, 1 failed")
+	checkError(t, eqErr, "unexpected PromotionCounts string\n")
+}
+
+func TestPromotionFailures(t *testing.T) {
+	err := reg.PromotionFailures{
+		Failed: []reg.PromotionEdgeResult{
+			{
+				Digest:      "sha256:000",
+				Destination: "gcr.io/bar/a",
+				Tags:        reg.TagSlice{"1", "1.0"},
+				Errors:      []string{"copy failed", "copy timed out"},
+			},
+			{
+				Digest:      "sha256:111",
+				Destination: "gcr.io/bar/b",
+				Errors:      []string{"copy failed"},
+			},
+		},
+	}
+
+	expected := `3 promotion(s) failed:
+  gcr.io/bar/a:1,1.0@sha256:000: copy failed; copy timed out
+  gcr.io/bar/b@sha256:111: copy failed`
+	eqErr := checkEqual(err.Error(), expected)
+	checkError(t, eqErr, "unexpected PromotionFailures message\n")
+}
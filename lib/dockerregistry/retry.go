@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	ggcrV1Remote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultMaxRetries is the default number of times a failed registry
+	// request is retried.
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBaseDelay is the default delay before the first retry of a
+	// failed registry request. The delay doubles with every retry.
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+
+	// maxRetryDelay caps the delay between two retries.
+	maxRetryDelay = 30 * time.Second
+
+	// retryJitter is the maximum fraction of the delay that is randomly added
+	// to it, so that concurrent requests do not retry in lockstep.
+	retryJitter = 0.1
+)
+
+// RetryTransport is an http.RoundTripper which retries idempotent requests
+// (GET and HEAD) that fail with a network error or a transient status code
+// (see isTransientStatus()). A request is retried at most MaxRetries times,
+// with an exponential backoff starting at BaseDelay. If all retries fail, the
+// last response (or error) is returned as is.
+type RetryTransport struct {
+	Base       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if !isIdempotent(req) {
+		return base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := base.RoundTrip(req)
+
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case isTransientStatus(res.StatusCode):
+			reason = res.Status
+		default:
+			return res, nil
+		}
+
+		// Give up if we are out of retries, or if the caller is no longer
+		// interested in the response (e.g., because of a timeout).
+		if attempt >= t.MaxRetries || req.Context().Err() != nil {
+			return res, err
+		}
+
+		delay := t.delay(attempt)
+		klog.Warningf("%s %s: %s; retrying in %v (retry %d of %d)",
+			req.Method, req.URL, reason, delay, attempt+1, t.MaxRetries)
+
+		// Discard the failed response, as we are not going to return it.
+		if res != nil {
+			// nolint[errcheck]
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, fmt.Errorf("%s %s: %v (after %d retries)",
+				req.Method, req.URL, req.Context().Err(), attempt)
+		}
+	}
+}
+
+// delay computes how long to wait before the given (zero-based) retry.
+func (t *RetryTransport) delay(attempt int) time.Duration {
+	delay := t.BaseDelay
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return wait.Jitter(delay, retryJitter)
+}
+
+// isIdempotent returns true for requests that are safe to send more than
+// once.
+func isIdempotent(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// isTransientStatus returns true for HTTP status codes that denote a
+// (probably) temporary failure on the server side.
+func isTransientStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// contextTransport is an http.RoundTripper which sends every request with
+// Context, so that all of them are aborted once it is done, even those made
+// by code that does not take a context (such as ggcrV1Remote).
+type contextTransport struct {
+	Base    http.RoundTripper
+	Context context.Context
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *contextTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	if err := t.Context.Err(); err != nil {
+		return nil, err
+	}
+	return t.Base.RoundTrip(req.WithContext(t.Context))
+}
+
+// withContext returns a (shallow) copy of sc whose registry requests are
+// aborted once ctx is done (see sc.cancellable()).
+func (sc *SyncContext) withContext(ctx context.Context) *SyncContext {
+	scCopy := *sc
+	scCopy.ctx = ctx
+	return &scCopy
+}
+
+// cancellable wraps the http.RoundTripper in a contextTransport if sc has a
+// context (see withContext()), and returns it as is otherwise.
+func (sc *SyncContext) cancellable(t http.RoundTripper) http.RoundTripper {
+	if sc.ctx == nil {
+		return t
+	}
+	return &contextTransport{Base: t, Context: sc.ctx}
+}
+
+// transport returns the http.RoundTripper to use for registry requests,
+// which retries failed requests as configured by sc.MaxRetries and
+// sc.RetryBaseDelay. Every attempt is paced by sc.RateLimiter, if set. The
+// requests (and the retries) are aborted once the context of sc is done, if
+// any.
+func (sc *SyncContext) transport() http.RoundTripper {
+	return sc.cancellable(&RetryTransport{
+		Base:       sc.RateLimiter.Transport(http.DefaultTransport),
+		MaxRetries: sc.MaxRetries,
+		BaseDelay:  sc.RetryBaseDelay,
+	})
+}
+
+// transportOption returns the ggcrV1Remote.Option equivalent of
+// sc.transport().
+func (sc *SyncContext) transportOption() ggcrV1Remote.Option {
+	return ggcrV1Remote.WithTransport(sc.transport())
+}
+
+// defaultRetryClient is used for registry requests that are made without a
+// SyncContext at hand (e.g., by the Docker Hub API helpers).
+var defaultRetryClient = &http.Client{
+	Transport: &RetryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: DefaultMaxRetries,
+		BaseDelay:  DefaultRetryBaseDelay,
+	},
+}
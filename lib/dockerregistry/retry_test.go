@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+)
+
+// fakeTransport is an http.RoundTripper which replies with a predefined
+// sequence of status codes, where 0 stands for a network error. The last
+// reply is repeated once the sequence runs out.
+type fakeTransport struct {
+	replies []int
+	calls   int
+}
+
+func (ft *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reply := ft.replies[len(ft.replies)-1]
+	if ft.calls < len(ft.replies) {
+		reply = ft.replies[ft.calls]
+	}
+	ft.calls++
+
+	if reply == 0 {
+		return nil, fmt.Errorf("connection reset by peer")
+	}
+	return &http.Response{
+		StatusCode: reply,
+		Status:     http.StatusText(reply),
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		replies        []int
+		expectedStatus int
+		expectedErr    error
+		expectedCalls  int
+	}{
+		{
+			"Fails twice, then succeeds",
+			"GET",
+			[]int{http.StatusServiceUnavailable, 0, http.StatusOK},
+			http.StatusOK,
+			nil,
+			3,
+		},
+		{
+			"Transient status code until retries run out",
+			"GET",
+			[]int{http.StatusServiceUnavailable},
+			http.StatusServiceUnavailable,
+			nil,
+			4,
+		},
+		{
+			"Network error until retries run out",
+			"HEAD",
+			[]int{0},
+			0,
+			fmt.Errorf("connection reset by peer"),
+			4,
+		},
+		{
+			"Non-transient status code",
+			"GET",
+			[]int{http.StatusNotFound},
+			http.StatusNotFound,
+			nil,
+			1,
+		},
+		{
+			"Non-idempotent request",
+			"POST",
+			[]int{http.StatusServiceUnavailable, http.StatusOK},
+			http.StatusServiceUnavailable,
+			nil,
+			1,
+		},
+	}
+
+	for _, test := range tests {
+		ft := fakeTransport{replies: test.replies}
+		rt := reg.RetryTransport{
+			Base:       &ft,
+			MaxRetries: 3,
+			BaseDelay:  time.Millisecond,
+		}
+
+		req, err := http.NewRequest(test.method, "https://gcr.io/v2/", nil)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (NewRequest)\n", test.name))
+
+		res, gotErr := rt.RoundTrip(req)
+		err = checkEqual(gotErr, test.expectedErr)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (error)\n", test.name))
+
+		gotStatus := 0
+		if res != nil {
+			gotStatus = res.StatusCode
+			// nolint[errcheck]
+			res.Body.Close()
+		}
+		err = checkEqual(gotStatus, test.expectedStatus)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (status)\n", test.name))
+
+		err = checkEqual(ft.calls, test.expectedCalls)
+		checkError(t, err,
+			fmt.Sprintf("checkError: test: %v (calls)\n", test.name))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// GetSignCmd generates the cosign command used to sign an image, given by its
+// FQIN, with the given key. The key is a cosign key reference, such as a KMS
+// key ("gcpkms://projects/<project>/locations/<location>/keyRings/<ring>/
+// cryptoKeys/<key>").
+func GetSignCmd(key, fqin string) []string {
+	return []string{
+		"cosign",
+		"sign",
+		"--key",
+		key,
+		"--yes",
+		fqin}
+}
+
+// SignatureTag returns the tag under which cosign stores the signature of the
+// digest, next to the image ("sha256-<hex>.sig" for "sha256:<hex>").
+func SignatureTag(digest Digest) Tag {
+	return Tag(strings.Replace(string(digest), ":", "-", 1) + ".sig")
+}
+
+// SignPromotedImages signs the destination digest of every promoted image of
+// the PromotionResult, by running the command of mkSignProducer for its FQIN.
+// Signing happens after the promotion, so that the signatures are attached in
+// the destination registries. The outcome is recorded in the Signed and
+// SignErrors fields of every promoted image; an error is returned if any of
+// them could not be signed. Nothing is signed during a dry run.
+func (sc *SyncContext) SignPromotedImages(
+	res *PromotionResult,
+	mkSignProducer func(fqin string) stream.Producer) error {
+
+	failed := 0
+	for i := range res.Promoted {
+		promoted := &res.Promoted[i]
+		fqin := promoted.Destination + "@" + string(promoted.Digest)
+		log := logging.Log().WithValues(
+			"image", promoted.Image,
+			"digest", promoted.Digest,
+			"dst", promoted.Destination)
+
+		if sc.DryRun {
+			log.Info("would sign image (dry run)")
+			continue
+		}
+
+		errs := runTagProcess(stream.ExternalRequest{
+			RequestParams:  fqin,
+			StreamProducer: mkSignProducer(fqin),
+		})
+		if len(errs) > 0 {
+			failed++
+			for _, err := range errs {
+				promoted.SignErrors = append(
+					promoted.SignErrors,
+					err.Error.Error())
+			}
+			log.Error(errs[0].Error, "could not sign image")
+			continue
+		}
+
+		promoted.Signed = true
+		log.Info("signed image")
+	}
+
+	if failed > 0 {
+		klog.Errorf("%d of %d promoted images could not be signed",
+			failed,
+			len(res.Promoted))
+		return fmt.Errorf("could not sign %d image(s)", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// failingProducer is a stream.Producer whose process exits with an error.
+type failingProducer struct {
+	err error
+}
+
+func (producer *failingProducer) Produce() (io.Reader, io.Reader, error) {
+	return strings.NewReader(""), strings.NewReader(""), nil
+}
+
+func (producer *failingProducer) Close() error {
+	return producer.err
+}
+
+func TestGetSignCmd(t *testing.T) {
+	got := reg.GetSignCmd(
+		"gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		"gcr.io/bar/a@sha256:000")
+	expected := []string{
+		"cosign",
+		"sign",
+		"--key",
+		"gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		"--yes",
+		"gcr.io/bar/a@sha256:000",
+	}
+
+	eqErr := checkEqual(got, expected)
+	checkError(t, eqErr, "unexpected sign command\n")
+}
+
+func TestSignPromotedImages(t *testing.T) {
+	mkResult := func() reg.PromotionResult {
+		return reg.PromotionResult{
+			Promoted: []reg.PromotionEdgeResult{
+				{
+					Image:       "a",
+					Digest:      "sha256:000",
+					Destination: "gcr.io/bar/a",
+				},
+				{
+					Image:       "b",
+					Digest:      "sha256:111",
+					Destination: "gcr.io/bar/b",
+				},
+			},
+			Failed: []reg.PromotionEdgeResult{
+				{
+					Image:       "c",
+					Digest:      "sha256:222",
+					Destination: "gcr.io/bar/c",
+				},
+			},
+		}
+	}
+
+	var tests = []struct {
+		name           string
+		dryRun         bool
+		expectedSigned []string
+		expected       reg.PromotionResult
+		expectedErr    error
+	}{
+		{
+			"One image fails to be signed",
+			false,
+			[]string{"gcr.io/bar/a@sha256:000", "gcr.io/bar/b@sha256:111"},
+			reg.PromotionResult{
+				Promoted: []reg.PromotionEdgeResult{
+					{
+						Image:       "a",
+						Digest:      "sha256:000",
+						Destination: "gcr.io/bar/a",
+						Signed:      true,
+					},
+					{
+						Image:       "b",
+						Digest:      "sha256:111",
+						Destination: "gcr.io/bar/b",
+						SignErrors:  []string{"exit status 1"},
+					},
+				},
+				Failed: []reg.PromotionEdgeResult{
+					{
+						Image:       "c",
+						Digest:      "sha256:222",
+						Destination: "gcr.io/bar/c",
+					},
+				},
+			},
+			fmt.Errorf("could not sign 1 image(s)"),
+		},
+		{
+			"Nothing is signed during a dry run",
+			true,
+			nil,
+			mkResult(),
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		var signed []string
+		mkSignProducer := func(fqin string) stream.Producer {
+			signed = append(signed, fqin)
+			if strings.HasPrefix(fqin, "gcr.io/bar/b@") {
+				return &failingProducer{err: fmt.Errorf("exit status 1")}
+			}
+			return &stream.Fake{}
+		}
+
+		sc := reg.SyncContext{DryRun: test.dryRun}
+		got := mkResult()
+		err := sc.SignPromotedImages(&got, mkSignProducer)
+
+		eqErr := checkEqual(err, test.expectedErr)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (error)\n", test.name))
+
+		eqErr = checkEqual(signed, test.expectedSigned)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (signed)\n", test.name))
+
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (result)\n", test.name))
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ggcrV1Google "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// ParseSince parses the cutoff of SyncContext.Since. It is either an RFC 3339
+// timestamp (e.g. "2020-06-01T00:00:00Z") or date (e.g. "2020-06-01"), or an
+// age relative to now, as a duration (e.g. "36h") or a number of days (e.g.
+// "30d"). An empty string yields the zero time, i.e. no cutoff.
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	var age time.Duration
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid number of days %q", s)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		age, err = time.ParseDuration(s)
+		if err != nil || age < 0 {
+			return time.Time{}, fmt.Errorf(
+				"invalid cutoff %q (expected a timestamp, a date, a duration"+
+					" or a number of days)", s)
+		}
+	}
+	return now.Add(-age), nil
+}
+
+// uploadTimeOf returns the time at which a digest was uploaded, according to
+// its "tags/list" entry. Registries that do not record it (e.g., Harbor and
+// Quay) report "0", i.e. the Unix epoch; the creation time is used then, if
+// any.
+func uploadTimeOf(info ggcrV1Google.ManifestInfo) (time.Time, bool) {
+	for _, t := range []time.Time{info.Uploaded, info.Created} {
+		if t.Unix() > 0 {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// recordUploadTime records the upload time of a digest, if it is known. It is
+// called by ReadRegistries(), with its mutex held.
+func (sc *SyncContext) recordUploadTime(
+	rootReg RegistryName,
+	imageDigest ImageDigest,
+	info ggcrV1Google.ManifestInfo) {
+
+	uploaded, ok := uploadTimeOf(info)
+	if !ok {
+		return
+	}
+	if sc.UploadTimes == nil {
+		sc.UploadTimes = make(UploadTimes)
+	}
+	if sc.UploadTimes[rootReg] == nil {
+		sc.UploadTimes[rootReg] = make(map[ImageDigest]time.Time)
+	}
+	sc.UploadTimes[rootReg][imageDigest] = uploaded
+}
+
+// uploadTime returns the upload time of the source image of the edge, if it
+// is known.
+func (sc *SyncContext) uploadTime(edge PromotionEdge) (time.Time, bool) {
+	uploaded, ok := sc.UploadTimes[edge.SrcRegistry.Name][ImageDigest{
+		ImageName: edge.SrcImageTag.ImageName,
+		Digest:    edge.Digest,
+	}]
+	return uploaded, ok
+}
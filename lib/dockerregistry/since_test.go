@@ -0,0 +1,241 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name          string
+		input         string
+		expected      time.Time
+		expectedError string
+	}{
+		{
+			name:     "No cutoff",
+			input:    "",
+			expected: time.Time{},
+		},
+		{
+			name:     "Timestamp",
+			input:    "2020-06-01T08:30:00Z",
+			expected: time.Date(2020, 6, 1, 8, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "Date",
+			input:    "2020-06-01",
+			expected: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Duration",
+			input:    "36h",
+			expected: time.Date(2020, 6, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Days",
+			input:    "30d",
+			expected: time.Date(2020, 5, 31, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:          "Bad number of days",
+			input:         "xd",
+			expectedError: `invalid number of days "xd"`,
+		},
+		{
+			name:  "Garbage",
+			input: "yesterday",
+			expectedError: `invalid cutoff "yesterday" (expected a ` +
+				`timestamp, a date, a duration or a number of days)`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := reg.ParseSince(test.input, now)
+		if test.expectedError != "" {
+			if err == nil || err.Error() != test.expectedError {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			continue
+		}
+		checkError(t, err, fmt.Sprintf("checkError: test: %v\n", test.name))
+		if !got.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestGetPromotionCandidatesSince(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name:           "gcr.io/foo",
+		ServiceAccount: "robot",
+		Src:            true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	// "sha256:000" was uploaded to the source on 2020-01-01 (but recently to
+	// the destination, under another tag), "sha256:111" on 2020-06-15, and
+	// the upload time of "sha256:222" is unknown.
+	listings := map[string]string{
+		"gcr.io/foo/a": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["1.0"],
+      "timeCreatedMs": "1577836800000",
+      "timeUploadedMs": "1577836800000"
+    },
+    "sha256:111": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["2.0"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "1592179200000"
+    },
+    "sha256:222": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["3.0"],
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }
+  },
+  "name": "foo/a",
+  "tags": ["1.0", "2.0", "3.0"]
+}`,
+		"gcr.io/bar/a": `{
+  "child": [],
+  "manifest": {
+    "sha256:000": {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": ["old"],
+      "timeCreatedMs": "1577836800000",
+      "timeUploadedMs": "1593475200000"
+    }
+  },
+  "name": "bar/a",
+  "tags": ["old"]
+}`,
+	}
+	mkFakeStream := func(
+		sc *reg.SyncContext,
+		rc reg.RegistryContext) stream.Producer {
+
+		var sr stream.Fake
+		_, domain, repoPath := reg.GetTokenKeyDomainRepoPath(rc.Name)
+		sr.Bytes = []byte(listings[domain+"/"+repoPath])
+		return &sr
+	}
+
+	mfests := []reg.Manifest{
+		{
+			Registries: []reg.RegistryContext{destRC, srcRC},
+			Images: []reg.Image{
+				{
+					ImageName: "a",
+					Dmap: reg.DigestTags{
+						"sha256:000": {"1.0"},
+						"sha256:111": {"2.0"},
+						"sha256:222": {"3.0"}}},
+			},
+			SrcRegistry: &srcRC},
+	}
+	edges, err := reg.ToPromotionEdges(mfests)
+	checkError(t, err, "checkError: test: ToPromotionEdges\n")
+
+	mkEdge := func(digest reg.Digest, tag reg.Tag) reg.PromotionEdge {
+		return reg.PromotionEdge{
+			SrcRegistry: srcRC,
+			SrcImageTag: reg.ImageTag{ImageName: "a", Tag: tag},
+			Digest:      digest,
+			DstRegistry: destRC,
+			DstImageTag: reg.ImageTag{ImageName: "a", Tag: tag},
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		since    time.Time
+		expected map[reg.PromotionEdge]interface{}
+	}{
+		{
+			"All images are promoted without a cutoff",
+			time.Time{},
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:000", "1.0"): nil,
+				mkEdge("sha256:111", "2.0"): nil,
+				mkEdge("sha256:222", "3.0"): nil,
+			},
+		},
+		{
+			"Only the images uploaded since the cutoff are promoted",
+			time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:111", "2.0"): nil,
+			},
+		},
+		{
+			"The cutoff is inclusive",
+			time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC),
+			map[reg.PromotionEdge]interface{}{
+				mkEdge("sha256:111", "2.0"): nil,
+			},
+		},
+		{
+			"No images are promoted with a later cutoff",
+			time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC),
+			map[reg.PromotionEdge]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			RegistryContexts: []reg.RegistryContext{srcRC, destRC},
+			Inv:              make(reg.MasterInventory),
+			DigestMediaType:  make(reg.DigestMediaType),
+			DigestImageSize:  make(reg.DigestImageSize),
+			Since:            test.since,
+		}
+		err := sc.ReadRegistries(
+			context.Background(),
+			[]reg.RegistryContext{
+				{Name: "gcr.io/foo/a", ServiceAccount: "robot"},
+				{Name: "gcr.io/bar/a", ServiceAccount: "robot"},
+			},
+			false,
+			mkFakeStream)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (read)\n", test.name))
+
+		got, gotClean := sc.GetPromotionCandidates(edges)
+		err = checkEqual(got, test.expected)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (edges)\n", test.name))
+		err = checkEqual(gotClean, true)
+		checkError(t, err, fmt.Sprintf("checkError: test: %v (clean)\n", test.name))
+	}
+}
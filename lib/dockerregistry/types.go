@@ -17,11 +17,16 @@ limitations under the License.
 package inventory
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	ggcrV1 "github.com/google/go-containerregistry/pkg/v1"
 	cr "github.com/google/go-containerregistry/pkg/v1/types"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/metrics"
 	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/gcloud"
 )
@@ -42,12 +47,156 @@ type Error struct {
 	Error   error
 }
 
+// PreCheckErrors is the error of RunChecks(), which holds the errors of the
+// checks which failed.
+type PreCheckErrors struct {
+	Errors []error
+}
+
+// RequestErrors is the error of ExecRequests(), which holds the errors of the
+// requests which failed.
+type RequestErrors struct {
+	Errors Errors
+}
+
+// ImageRemovalError contains ImageRemovalCheck information on the images
+// that were removed from the manifests (in the order they were found).
+type ImageRemovalError struct {
+	RemovedImages []ImageName
+}
+
+// TagImmutabilityError contains TagImmutabilityCheck information on the
+// tags that were moved to a different digest, as sorted
+// "<image>:<tag> (<old digest> -> <new digest>)" descriptions.
+type TagImmutabilityError struct {
+	MovedTags []string
+}
+
 // ImageSizeError contains ImageSizeCheck information on images that are either
 // over the promoter's max image size or have an invalid size of 0 or less.
+// Overrides holds the limits (in MiB) of the oversized images that were not
+// checked against MaxImageSize, but against a per-image override.
+// SuggestedMaxImageSize is the smallest max image size (in MiB) that would
+// allow all of the oversized images without an override, or 0 if there are
+// none.
 type ImageSizeError struct {
-	MaxImageSize    int
-	OversizedImages map[string]int
-	InvalidImages   map[string]int
+	MaxImageSize          int
+	OversizedImages       map[string]int
+	InvalidImages         map[string]int
+	Overrides             map[string]int
+	SuggestedMaxImageSize int
+}
+
+// TotalSizeError contains TotalSizeCheck information on the combined size of
+// the images (in bytes), which is over the max total size (in MiB).
+type TotalSizeError struct {
+	MaxTotalSize int
+	TotalSize    int
+}
+
+// VulnerabilityError contains VulnerabilityCheck information on images that
+// have vulnerabilities with a severity at or above the check's MaxSeverity.
+// VulnerableImages is keyed by the image name and digest.
+type VulnerabilityError struct {
+	MaxSeverity      Severity
+	VulnerableImages map[string][]Vulnerability
+}
+
+// SignatureError contains SignatureVerificationCheck information on images
+// that do not have a valid cosign signature. UnsignedImages holds the full
+// image references (by digest) of the source images.
+type SignatureError struct {
+	UnsignedImages []string
+}
+
+// MaxTagsPerImageError contains MaxTagsPerImageCheck information on images
+// that would have more than MaxTags tags in a destination registry.
+// TagCounts is keyed by the destination image path (registry and image name).
+type MaxTagsPerImageError struct {
+	MaxTags   int
+	TagCounts map[RegistryImagePath]int
+}
+
+// SourceRegistryError contains SourceRegistryAllowlistCheck information on
+// the source registries that are not in the allowlist.
+type SourceRegistryError struct {
+	DisallowedSources []RegistryName
+}
+
+// BlockedSourceError contains BlockedSourceCheck information on the images
+// that would be promoted from a blocked source registry. BlockedImages is
+// keyed by the source registry, and holds the (sorted) names of its images.
+type BlockedSourceError struct {
+	BlockedImages map[RegistryName][]ImageName
+}
+
+// DigestFormatError contains DigestFormatCheck information on the malformed
+// digests of the images to be promoted. InvalidDigests is keyed by the source
+// image path (registry and image name).
+type DigestFormatError struct {
+	InvalidDigests map[RegistryImagePath][]Digest
+}
+
+// SourceDigestError contains SourceDigestExistsCheck information on the
+// digests which are missing from their source registries. MissingDigests is
+// keyed by the source image path (registry and image name).
+type SourceDigestError struct {
+	MissingDigests map[RegistryImagePath][]Digest
+}
+
+// DuplicateImageError contains DuplicateImageCheck information on the images
+// with conflicting definitions. Conflicts is keyed by the destination image
+// path (registry and image name), and holds every tag of the image which
+// points to more than one digest, with those digests (sorted).
+type DuplicateImageError struct {
+	Conflicts map[RegistryImagePath]map[Tag][]Digest
+}
+
+// SourceRegistryFlagError contains SourceRegistryFlagCheck information on
+// the manifests whose source registry is misconfigured.
+type SourceRegistryFlagError struct {
+	Misconfigured []MisconfiguredManifest
+}
+
+// TokenError is returned when the credentials for a registry cannot be read,
+// or when no access token can be obtained for it.
+type TokenError struct {
+	Registry RegistryName
+	Err      error
+}
+
+// MisconfiguredManifest describes the source registry of a manifest, as seen
+// by SourceRegistryFlagCheck.
+type MisconfiguredManifest struct {
+	// Filepath is the path of the manifest, if it was read from a file.
+	Filepath string
+	// SrcRegistries are the registries marked with "src: true".
+	SrcRegistries []RegistryName
+	// SrcRegistry is the source registry the manifest was finalized with
+	// (see Manifest.Finalize()), if any.
+	SrcRegistry RegistryName
+}
+
+// FloatingTagError contains FloatingTagCheck information on the images that
+// would be promoted with a forbidden (floating) tag.
+type FloatingTagError struct {
+	FloatingTags []ImageTag
+}
+
+// TagPatternError contains TagPatternCheck information on the images that
+// would be promoted with a tag which does not match Pattern.
+type TagPatternError struct {
+	Pattern       string
+	NonConforming []ImageTag
+}
+
+// DigestAllowlistError contains DigestAllowlistCheck information on the images
+// that would be promoted at a digest which is not in the allowlist. Both maps
+// are keyed by the image name; AllowedDigests only holds the images with
+// disallowed digests.
+type DigestAllowlistError struct {
+	DisallowedDigests map[ImageName][]Digest
+	AllowedDigests    map[ImageName][]Digest
 }
 
 // CapturedRequests holds a map of all PromotionRequests that were generated. It
@@ -60,19 +209,123 @@ type CollectedLogs struct {
 }
 
 // SyncContext is the main data structure for performing the promotion.
+//
+// ListingCache, if set, is consulted by ReadRegistries() before reading a
+// repository over the network. RefreshListingCache forces all repositories to
+// be read over the network (and re-cached).
+//
+// Failed registry reads are retried up to MaxRetries times, waiting
+// RetryBaseDelay before the first retry (see RetryTransport).
+//
+// Metrics, if set, records every image copied by Promote().
 type SyncContext struct {
-	Threads           int
-	DryRun            bool
-	UseServiceAccount bool
-	Inv               MasterInventory
-	InvIgnore         []ImageName
-	RegistryContexts  []RegistryContext
-	SrcRegistry       *RegistryContext
-	Tokens            map[RootRepo]gcloud.Token
-	DigestMediaType   DigestMediaType
-	DigestImageSize   DigestImageSize
-	ParentDigest      ParentDigest
-	Logs              CollectedLogs
+	Threads             int
+	DryRun              bool
+	UseServiceAccount   bool
+	Inv                 MasterInventory
+	InvIgnore           []ImageName
+	RegistryContexts    []RegistryContext
+	SrcRegistry         *RegistryContext
+	Tokens              map[RootRepo]gcloud.Token
+	DigestMediaType     DigestMediaType
+	DigestImageSize     DigestImageSize
+	ParentDigest        ParentDigest
+	Logs                CollectedLogs
+	ListingCache        ListingCache
+	RefreshListingCache bool
+	MaxRetries          int
+	RetryBaseDelay      time.Duration
+	// RateLimiter, if set, paces all the registry requests of the
+	// SyncContext, across all of its workers (see NewRateLimiter()).
+	RateLimiter *RateLimiter
+	// Budget, if set, limits the number of repository reads, image size
+	// lookups and image copies of the SyncContext that run at the same time,
+	// all together (see NewBudget()).
+	Budget            *Budget
+	Metrics           *metrics.Metrics
+	MaxParallelImages int
+	// CopyTimeout bounds the time taken by every image copy of Promote()
+	// (see copyWithTimeout()). Zero means no limit.
+	CopyTimeout time.Duration
+	// CopyReferrers makes Promote() also promote the referrers (such as SBOMs)
+	// of the promoted digests (see AddReferrerEdges()).
+	CopyReferrers bool
+	// ReferrersAPI makes CopyReferrers also find the referrers which are not
+	// tagged, with the OCI referrers API (see AddReferrerEdges()), and makes
+	// garbage collection keep them (see keepReferrers()).
+	ReferrersAPI bool
+	// AdditiveOnly makes GetPromotionCandidates() reject the edges whose tag
+	// already points to another digest in the destination, instead of moving
+	// the tag, so that only new tags are promoted.
+	AdditiveOnly bool
+	// Since, if set, makes GetPromotionCandidates() skip the edges whose
+	// source image was uploaded before it, as recorded in UploadTimes by
+	// ReadRegistries().
+	Since       time.Time
+	UploadTimes UploadTimes
+	// VerifyDigests makes Promote() read back every image it copies, and
+	// fail the copy unless it has the same digest as the source image (see
+	// verifyDigest()). It must not be combined with Platforms or
+	// SkipMissingPlatforms, which change the digests of manifest lists on
+	// purpose.
+	VerifyDigests bool
+	// KeepGoing makes Promote() return a PromotionFailures error listing
+	// every failed promotion, instead of a generic error.
+	KeepGoing bool
+	// Progress, if set, is told about the progress of Promote() every
+	// ProgressInterval (DefaultProgressInterval if zero).
+	Progress         ProgressReporter
+	ProgressInterval time.Duration
+	// Platforms, if set, makes Promote() filter the manifest lists it copies
+	// to the images of these platforms (see FilterIndexPlatforms()). The
+	// filtered manifest lists get new digests in the destinations.
+	Platforms []ggcrV1.Platform
+	// SkipMissingPlatforms makes Promote() drop the children of the manifest
+	// lists it copies which are missing from the source registry (e.g.
+	// because they were garbage collected), instead of failing the copy (see
+	// checkIndexChildren()). Like Platforms, this gives the manifest lists
+	// new digests in the destinations.
+	SkipMissingPlatforms bool
+	// Positions holds where the digests of the images are declared in the
+	// manifests (see ManifestPositions()). If set, the promotion results and
+	// the dry-run diff point every edge back to its declaration.
+	Positions map[ImageDigest]SourcePosition
+	// AuditLog, if set, records every image copied or deleted by Promote(),
+	// Prune(), GarbageCollect() and ClearRepository() (except in dry runs).
+	// The entries name the manifest files of their images, as found in
+	// ManifestFiles (keyed by ToLQIN() of the destination images), which
+	// MakeSyncContext() fills.
+	AuditLog      *auditlog.Log
+	ManifestFiles map[string]string
+	// AlreadyPromoted holds the edges that GetPromotionCandidates() dropped
+	// because they already exist in the destination registries.
+	AlreadyPromoted map[PromotionEdge]interface{}
+	// ctx, if set, cancels the registry requests made with this SyncContext
+	// (see withContext()).
+	ctx context.Context
+}
+
+// DefaultMaxParallelImages is the default number of images that Promote()
+// copies at the same time (see SyncContext.MaxParallelImages). It is lower
+// than the default number of Threads, because copies move a lot more data
+// than registry reads.
+const DefaultMaxParallelImages = 4
+
+// DefaultCopyTimeout is the default time after which Promote() gives up on a
+// single image copy (see SyncContext.CopyTimeout).
+const DefaultCopyTimeout = 30 * time.Minute
+
+// copyLimiter limits the number of images that are copied at the same time.
+// Copies of the same digest into the same repository (e.g., under different
+// tags) are run one after the other, so that only the first one copies the
+// image, and the others only tag it. Every copy also holds a slot of the
+// budget, if set.
+type copyLimiter struct {
+	slots      chan struct{}
+	budget     *Budget
+	mutex      sync.Mutex
+	keyMutexes map[string]*sync.Mutex
+	copied     map[string]bool
 }
 
 // PreCheck represents a check function to run against a pull request that
@@ -86,22 +339,197 @@ type PreCheck interface {
 
 // ImageSizeCheck implements the PreCheck interface and checks against
 // images that are larger than a size threshold (controlled by the
-// max-image-size flag).
+// max-image-size flag). Overrides, keyed by image name, raises (or lowers)
+// the threshold of individual images. All sizes are in MiB.
+//
+// If MaxImageSize is not set (0), the threshold is derived from the images
+// that are already in the destination repositories of PullEdges, as found in
+// DestInv: it is the size of the largest of them, plus Headroom percent. If
+// none of them has a known size, DefaultMaxImageSize is used.
+//
+// If MkReadManifestCmd is set, the sizes of images missing from
+// DigestImageSize are computed from their manifests, reading up to Threads
+// manifests at once (and no more than Budget allows, if set). Each digest is
+// only read once per ImageSizeCheck, even if it is shared by several edges (or
+// Run() is called again).
 type ImageSizeCheck struct {
-	MaxImageSize    int
+	MaxImageSize      int
+	DigestImageSize   DigestImageSize
+	PullEdges         map[PromotionEdge]interface{}
+	Overrides         map[string]int
+	Threads           int
+	MkReadManifestCmd func(edge PromotionEdge) stream.Producer
+	DestInv           MasterInventory
+	Headroom          int
+	Budget            *Budget
+
+	sizeCache *imageSizeCache
+}
+
+// DefaultMaxImageSize is the max image size (in MiB) used by ImageSizeCheck
+// when it has neither an explicit nor a derived max image size.
+const DefaultMaxImageSize = 2048
+
+// DefaultImageSizeHeadroom is the default percentage by which images may be
+// larger than the largest image already promoted, when ImageSizeCheck derives
+// the max image size from the destination images.
+const DefaultImageSizeHeadroom = 20
+
+// TotalSizeCheck implements the PreCheck interface and checks against pull
+// requests that would add more than MaxTotalSize MiB of images in total.
+type TotalSizeCheck struct {
+	MaxTotalSize    int
 	DigestImageSize DigestImageSize
 	PullEdges       map[PromotionEdge]interface{}
 }
 
+// VulnerabilityCheck implements the PreCheck interface and checks against
+// images that have known vulnerabilities with a severity of MaxSeverity or
+// higher.
+type VulnerabilityCheck struct {
+	MaxSeverity           Severity
+	DigestVulnerabilities DigestVulnerabilities
+	PullEdges             map[PromotionEdge]interface{}
+}
+
+// SignatureVerificationCheck implements the PreCheck interface and checks
+// that all source images are signed with cosign. Signatures are verified
+// either against PublicKey (a key file or KMS URI), or, for keyless signing,
+// against the Fulcio certificate identity CertificateIdentity issued by
+// CertificateOIDCIssuer.
+type SignatureVerificationCheck struct {
+	PublicKey             string
+	CertificateIdentity   string
+	CertificateOIDCIssuer string
+	PullEdges             map[PromotionEdge]interface{}
+	MkVerifyCmd           func(
+		check *SignatureVerificationCheck,
+		imageRef string) stream.Producer
+}
+
 // ImageRemovalCheck implements the PreCheck interface and checks against
 // pull requests that attempt to remove any images from the promoter manifests.
+// Images in AllowedRemovals (see GetAllowedRemovals()) may be removed.
 type ImageRemovalCheck struct {
+	GitRepoPath     string
+	MasterSHA       plumbing.Hash
+	PullRequestSHA  plumbing.Hash
+	PullEdges       map[PromotionEdge]interface{}
+	AllowedRemovals map[RegistryImagePath]interface{}
+}
+
+// TagImmutabilityCheck implements the PreCheck interface and checks against
+// pull requests that point an existing tag to a different digest. Tags in
+// MutableTags (e.g., "latest") are allowed to move.
+type TagImmutabilityCheck struct {
 	GitRepoPath    string
 	MasterSHA      plumbing.Hash
 	PullRequestSHA plumbing.Hash
 	PullEdges      map[PromotionEdge]interface{}
+	MutableTags    []Tag
+}
+
+// MaxTagsPerImageCheck implements the PreCheck interface and checks against
+// pull requests that would give an image more than MaxTags tags in a
+// destination registry. Images in Allowlist are not limited.
+type MaxTagsPerImageCheck struct {
+	MaxTags   int
+	PullEdges map[PromotionEdge]interface{}
+	Allowlist map[RegistryImagePath]interface{}
+}
+
+// SourceRegistryAllowlistCheck implements the PreCheck interface and checks
+// against pull requests that promote images from a source registry that is not
+// in AllowedSources.
+type SourceRegistryAllowlistCheck struct {
+	AllowedSources []RegistryName
+	PullEdges      map[PromotionEdge]interface{}
+}
+
+// BlockedSourceCheck implements the PreCheck interface and checks against
+// pull requests that promote images from a source registry that matches one
+// of BlockedSources (see MKRealBlockedSourceCheck()). It is the inverse of
+// SourceRegistryAllowlistCheck, for when the allowed sources cannot all be
+// listed.
+type BlockedSourceCheck struct {
+	BlockedSources []string
+	PullEdges      map[PromotionEdge]interface{}
+}
+
+// DigestFormatCheck implements the PreCheck interface and checks against
+// pull requests with malformed digests. Digests must be of the form
+// "sha256:<64 hex digits>", or "sha512:<128 hex digits>" if AllowSHA512 is
+// set.
+type DigestFormatCheck struct {
+	AllowSHA512 bool
+	PullEdges   map[PromotionEdge]interface{}
+}
+
+// SourceDigestExistsCheck implements the PreCheck interface and checks
+// against pull requests that promote digests which do not exist in their
+// source registries (e.g. because of a typo), as found in SrcInv. Without it,
+// such images are only skipped, with an error in the logs (see
+// GetPromotionCandidates()).
+type SourceDigestExistsCheck struct {
+	SrcInv    MasterInventory
+	PullEdges map[PromotionEdge]interface{}
+}
+
+// FloatingTagCheck implements the PreCheck interface and checks against pull
+// requests that promote images with a floating tag, such as "latest" or
+// "master". Such tags are mutable by nature, and so must not be promoted.
+type FloatingTagCheck struct {
+	ForbiddenTags []Tag
+	PullEdges     map[PromotionEdge]interface{}
+}
+
+// TagPatternCheck implements the PreCheck interface and checks against pull
+// requests that promote images with tags which do not follow a naming
+// convention: every tag must match the regular expression Pattern as a whole
+// (e.g. semantic version tags, see DefaultTagPattern), except for the tags in
+// ExemptTags. Untagged images are not checked.
+type TagPatternCheck struct {
+	Pattern    string
+	ExemptTags []Tag
+	PullEdges  map[PromotionEdge]interface{}
+}
+
+// DefaultTagPattern is the tag naming convention enforced by TagPatternCheck
+// by default: semantic versions of the form "vX.Y.Z".
+const DefaultTagPattern = `v[0-9]+\.[0-9]+\.[0-9]+`
+
+// DigestAllowlistCheck implements the PreCheck interface and pins images to
+// approved digests: the images in AllowedDigests (keyed by their name in the
+// manifests) may only be promoted at one of their allowed digests. Images that
+// are not in AllowedDigests are not checked. Unlike the ImageRemovalCheck,
+// which only looks at what a pull request changes, this checks every edge.
+type DigestAllowlistCheck struct {
+	AllowedDigests map[ImageName][]Digest
+	PullEdges      map[PromotionEdge]interface{}
+}
+
+// DuplicateImageCheck implements the PreCheck interface and checks against
+// images that are defined more than once for the same destination registry,
+// within or across the given manifests. Such duplicates are allowed as long
+// as they agree, but not if a tag points to different digests. Unlike the
+// other checks, it looks at the manifests themselves, so that it can run
+// before ToPromotionEdges().
+type DuplicateImageCheck struct {
+	Manifests []Manifest
 }
 
+// SourceRegistryFlagCheck implements the PreCheck interface and checks that
+// every manifest has exactly one registry marked as the source ("src: true"),
+// which is the source registry the images are promoted from. Any other
+// registry is a destination, so a wrongly set Src flag would promote the
+// images in the wrong direction.
+type SourceRegistryFlagCheck struct {
+	Manifests []Manifest
+}
+
+// DefaultFloatingTags are the tags that FloatingTagCheck forbids by default.
+var DefaultFloatingTags = []Tag{"latest"}
+
 // PromotionEdge represents a promotion "link" of an image repository between 2
 // registries.
 type PromotionEdge struct {
@@ -114,6 +542,79 @@ type PromotionEdge struct {
 	DstImageTag ImageTag
 }
 
+// ManifestDiff holds the differences between the promotion edges of two
+// revisions of the promoter manifests (see DiffPromotionEdges()). Edges are
+// compared by their destination only, so that e.g. a change of the source
+// registry's service account is not a difference.
+type ManifestDiff struct {
+	Added   []PromotionEdge
+	Removed []PromotionEdge
+	Changed []ChangedEdge
+}
+
+// ChangedEdge is a destination tag which points to a different digest in the
+// new revision of the promoter manifests.
+type ChangedEdge struct {
+	Old PromotionEdge
+	New PromotionEdge
+}
+
+// PromotionResult is the outcome of Promote(). The edges are grouped by the
+// copies of a digest into a destination image, as in CollapsePromotionEdges().
+type PromotionResult struct {
+	DryRun   bool                  `json:"dryRun"`
+	Promoted []PromotionEdgeResult `json:"promoted"`
+	Skipped  []PromotionEdgeResult `json:"skipped"`
+	Failed   []PromotionEdgeResult `json:"failed"`
+}
+
+// PromotionCounts are the numbers of edges (i.e., of tags, or of digests for
+// tagless promotions) that a PromotionResult promoted, skipped because the
+// destination already had them, and failed to promote.
+type PromotionCounts struct {
+	Promoted int
+	Skipped  int
+	Failed   int
+}
+
+// The statuses of a PromotionEdgeResult, which tell which list of the
+// PromotionResult it is in.
+const (
+	StatusPromoted = "promoted"
+	StatusSkipped  = "skipped"
+	StatusFailed   = "failed"
+)
+
+// PromotionEdgeResult describes the promotion of a digest from a source image
+// into a destination image, under the given tags (if any). Status is one of
+// StatusPromoted, StatusSkipped and StatusFailed. Errors is only set for
+// failed promotions. Signed and SignErrors are only set for promoted
+// images, by SignPromotedImages(). DeclaredAt is the position of the digest in
+// the manifests, if SyncContext.Positions is set.
+type PromotionEdgeResult struct {
+	Image       ImageName `json:"image"`
+	Digest      Digest    `json:"digest"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Tags        TagSlice  `json:"tags"`
+	Bytes       int64     `json:"bytes"`
+	Status      string    `json:"status"`
+	Errors      []string  `json:"errors,omitempty"`
+	Signed      bool      `json:"signed,omitempty"`
+	SignErrors  []string  `json:"signErrors,omitempty"`
+	DeclaredAt  string    `json:"declaredAt,omitempty"`
+}
+
+// promotionRecorder collects the outcome of every PromotionRequest processed
+// by Promote(), keyed by the request without its tag.
+type promotionRecorder struct {
+	mutex    sync.Mutex
+	promoted map[PromotionRequest]TagSlice
+	failed   map[PromotionRequest]TagSlice
+	errors   map[PromotionRequest][]string
+	progress *progressTracker
+}
+
 // VertexProperty describes the properties of an Edge, with respect to the state
 // of the world.
 type VertexProperty struct {
@@ -234,6 +735,10 @@ type Manifest struct {
 	// destination registries.
 	Registries []RegistryContext `yaml:"registries,omitempty"`
 	Images     []Image           `yaml:"images,omitempty"`
+	// AllowedRemovals lists the names of images that may be removed from
+	// Images on purpose (e.g., deprecated images). Otherwise,
+	// ImageRemovalCheck rejects the removal of any image.
+	AllowedRemovals []ImageName `yaml:"allowedRemovals,omitempty"`
 
 	// Hidden fields; these are data structure optimizations that are populated
 	// from the fields above. As they are redundant, there is no point in
@@ -250,6 +755,10 @@ type Manifest struct {
 // src/destination repos or the credentials tied to them.
 type ThinManifest struct {
 	Registries []RegistryContext `yaml:"registries,omitempty"`
+	// AllowedRemovals is the same as Manifest's AllowedRemovals. It lives in
+	// the ThinManifest (and not next to the images) so that only the owners
+	// of the manifest can allow removals.
+	AllowedRemovals []ImageName `yaml:"allowedRemovals,omitempty"`
 	// Store actual image data somewhere else.
 	//
 	// NOTE: "ImagesPath" is deprecated. It does nothing and will be
@@ -287,9 +796,17 @@ type ThinManifest struct {
 // Image holds information about an image. It's like an "Object" in the OOP
 // sense, and holds all the information relating to a particular image that we
 // care about.
+//
+// TagPatterns holds shell patterns (e.g. "v1.*", see path.Match()) of source
+// registry tags to promote, in addition to the tags in Dmap. They are expanded
+// into Dmap entries by ExpandTagPatterns(), before the promotion edges are
+// computed. PromoteAllTags does the same for every tag of the source
+// repository (e.g. to set up a mirror).
 type Image struct {
-	ImageName ImageName  `yaml:"name"`
-	Dmap      DigestTags `yaml:"dmap,omitempty"`
+	ImageName      ImageName  `yaml:"name"`
+	Dmap           DigestTags `yaml:"dmap,omitempty"`
+	TagPatterns    []string   `yaml:"tagPatterns,omitempty"`
+	PromoteAllTags bool       `yaml:"promoteAllTags,omitempty"`
 }
 
 // Images is a slice of Image types.
@@ -307,11 +824,35 @@ type DigestTags map[Digest]TagSlice
 
 // RegistryContext holds information about a registry, to be written in a
 // manifest file.
+//
+// Username and TokenEnv are the credentials for registries that use basic
+// authentication (e.g., Docker Hub). To keep secrets out of the manifest,
+// TokenEnv is the name of the environment variable that holds the token (or
+// password), not the token itself.
+//
+// Alternatively, CredentialsFile is the path of a Docker config file (as
+// written by "docker login") whose entry for the host of the registry holds
+// its username and token (see ReadCredentialsFile()). This works for every
+// kind of registry; for GCR, the username is "oauth2accesstoken" and the
+// password is an access token. This way, every registry can use credentials
+// of its own (e.g., of another account).
+//
+// Provider names the kind of registry, for registries that cannot be
+// recognized by their hostname (e.g., self-hosted Harbor instances). See
+// GetRegistryClient().
+//
+// Path is the OCI image layout directory or "docker save" tarball that the
+// images of a local registry (see ProviderLocal) are read from.
 type RegistryContext struct {
-	Name           RegistryName `yaml:"name,omitempty"`
-	ServiceAccount string       `yaml:"service-account,omitempty"`
-	Token          gcloud.Token `yaml:"-"`
-	Src            bool         `yaml:"src,omitempty"`
+	Name            RegistryName `yaml:"name,omitempty"`
+	ServiceAccount  string       `yaml:"service-account,omitempty"`
+	Username        string       `yaml:"username,omitempty"`
+	TokenEnv        string       `yaml:"token-env,omitempty"`
+	CredentialsFile string       `yaml:"credentials-file,omitempty"`
+	Provider        string       `yaml:"provider,omitempty"`
+	Path            string       `yaml:"path,omitempty"`
+	Token           gcloud.Token `yaml:"-"`
+	Src             bool         `yaml:"src,omitempty"`
 }
 
 // GCRManifestListContext is used only for reading GCRManifestList information
@@ -339,6 +880,41 @@ type DigestMediaType map[Digest]cr.MediaType
 // DigestImageSize holds information about the size of an image in bytes.
 type DigestImageSize map[Digest]int
 
+// UploadTimes holds when the digests of every registry were uploaded, keyed
+// like MasterInventory. Digests whose upload time is unknown have no entry.
+type UploadTimes map[RegistryName]map[ImageDigest]time.Time
+
+// DigestVulnerabilities holds the vulnerabilities found in an image.
+type DigestVulnerabilities map[Digest][]Vulnerability
+
+// Vulnerability is a single finding of a vulnerability scanner (e.g., a CVE).
+type Vulnerability struct {
+	ID       string
+	Severity Severity
+}
+
+// Severity is the severity of a Vulnerability. The levels are the same as in
+// GCP Container Analysis.
+type Severity int
+
+// The Severity levels, from least to most severe.
+const (
+	SeverityUnspecified Severity = iota
+	SeverityMinimal
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+// VulnerabilityContext is used only for reading vulnerability information
+// about an image, in the function ReadVulnerabilities.
+type VulnerabilityContext struct {
+	RegistryContext RegistryContext
+	ImageName       ImageName
+	Digest          Digest
+}
+
 // ParentDigest holds a map of the digests of children to parent digests. It is
 // a reverse mapping of ManifestLists, which point to all the child manifests.
 type ParentDigest map[Digest]Digest
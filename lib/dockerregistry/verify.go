@@ -0,0 +1,213 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/logging"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+// VerifyEntry is a digest (and tag, if any) of a destination image that is
+// either missing from the destination registry or not declared in the
+// manifests.
+type VerifyEntry struct {
+	Registry RegistryName `json:"registry"`
+	Image    ImageName    `json:"image"`
+	Digest   Digest       `json:"digest"`
+	Tag      Tag          `json:"tag,omitempty"`
+}
+
+// String renders the VerifyEntry as "<registry>/<image>:<tag>@<digest>", or
+// "<registry>/<image>@<digest>" if it has no tag.
+func (e VerifyEntry) String() string {
+	repo := string(e.Registry) + "/" + string(e.Image)
+	if e.Tag == "" {
+		return repo + "@" + string(e.Digest)
+	}
+	return repo + ":" + string(e.Tag) + "@" + string(e.Digest)
+}
+
+// VerifyResult is the difference between the destination registries and the
+// manifests (see VerifyDestinations()).
+type VerifyResult struct {
+	// Missing are the digests and tags declared in the manifests which are
+	// not in the destination registries.
+	Missing []VerifyEntry `json:"missing"`
+	// Extra are the tags of the destination images which are not declared in
+	// the manifests.
+	Extra []VerifyEntry `json:"extra"`
+}
+
+// HasDrift returns true if the destination registries differ from the
+// manifests.
+func (r VerifyResult) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Extra) > 0
+}
+
+// String renders the VerifyResult as a human-readable table.
+func (r VerifyResult) String() string {
+	if !r.HasDrift() {
+		return "The destination registries match the manifests.\n"
+	}
+
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  DRIFT\tIMAGE")
+	for _, entry := range r.Missing {
+		fmt.Fprintf(tw, "  missing\t%s\n", entry)
+	}
+	for _, entry := range r.Extra {
+		fmt.Fprintf(tw, "  extra\t%s\n", entry)
+	}
+	// nolint[errcheck]
+	tw.Flush()
+
+	fmt.Fprintf(&sb, "Total: %d missing, %d extra\n",
+		len(r.Missing), len(r.Extra))
+
+	return sb.String()
+}
+
+// VerifyDestinations compares the destination images of the given (unfiltered)
+// edges with the destination registries, without modifying anything. A digest
+// or tag of an edge is missing if the destination image does not have it
+// (a tag pointing to another digest counts as both missing and extra). A tag
+// of a destination image is extra if no edge declares it; the referrer tags
+// (see ReferrerTags(), which include the SignatureTag()) of declared digests
+// are not extra, and neither are untagged digests, because the children of
+// manifest lists are untagged too (see GarbageCollect()). Destination images
+// that are not in the manifests at all are not looked at.
+//
+// Only the destination repositories are read, and unlike
+// FilterPromotionEdges(), an error reading one of them is returned, as the
+// result would be incomplete.
+func (sc *SyncContext) VerifyDestinations(
+	ctx context.Context,
+	edges map[PromotionEdge]interface{},
+	mkReadRepositoryCmd func(*SyncContext, RegistryContext) stream.Producer,
+) (VerifyResult, error) {
+
+	type registryImage struct {
+		RegistryName RegistryName
+		ImageName    ImageName
+	}
+	type registryImageDigestTag struct {
+		registryImage
+		Digest Digest
+		Tag    Tag
+	}
+
+	declared := make(map[registryImageDigestTag]interface{})
+	dstImages := make(map[registryImage]RegistryContext)
+	for edge := range edges {
+		image := registryImage{
+			edge.DstRegistry.Name,
+			edge.DstImageTag.ImageName,
+		}
+		declared[registryImageDigestTag{
+			image, edge.Digest, edge.DstImageTag.Tag}] = nil
+		// The referrer tags point to other digests, so they are recorded
+		// without one.
+		for _, tag := range ReferrerTags(edge.Digest) {
+			declared[registryImageDigestTag{image, "", tag}] = nil
+		}
+		dstImages[image] = edge.DstRegistry
+	}
+
+	toRead := make([]RegistryContext, 0, len(dstImages))
+	for image, rc := range dstImages {
+		rc.Name = image.RegistryName + "/" + RegistryName(image.ImageName)
+		toRead = append(toRead, rc)
+	}
+	sort.Slice(toRead, func(i, j int) bool {
+		return toRead[i].Name < toRead[j].Name
+	})
+	for _, rc := range toRead {
+		logging.Log().Info("reading registry", "registry", rc.Name)
+	}
+	err := sc.ReadRegistries(ctx, toRead, false, mkReadRepositoryCmd)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	var result VerifyResult
+	for key := range declared {
+		// The referrer and signature tags are only recorded to be ignored
+		// below.
+		if key.Digest == "" {
+			continue
+		}
+		tags, ok := sc.Inv[key.RegistryName][key.ImageName][key.Digest]
+		if ok && key.Tag != "" {
+			_, ok = tags.ToTagSet()[key.Tag]
+		}
+		if ok {
+			continue
+		}
+		result.Missing = append(result.Missing, VerifyEntry{
+			Registry: key.RegistryName,
+			Image:    key.ImageName,
+			Digest:   key.Digest,
+			Tag:      key.Tag,
+		})
+	}
+
+	for image := range dstImages {
+		rii := sc.Inv[image.RegistryName][image.ImageName]
+		for digest, tags := range rii {
+			for _, tag := range tags {
+				if _, ok := declared[registryImageDigestTag{
+					image, digest, tag}]; ok {
+					continue
+				}
+				if _, ok := declared[registryImageDigestTag{
+					image, "", tag}]; ok {
+					continue
+				}
+				result.Extra = append(result.Extra, VerifyEntry{
+					Registry: image.RegistryName,
+					Image:    image.ImageName,
+					Digest:   digest,
+					Tag:      tag,
+				})
+			}
+		}
+	}
+
+	sortVerifyEntries(result.Missing)
+	sortVerifyEntries(result.Extra)
+
+	logging.Log().Info("verified destination registries",
+		"missing", len(result.Missing),
+		"extra", len(result.Extra))
+
+	return result, nil
+}
+
+// sortVerifyEntries sorts the entries by their string representation, for
+// deterministic output.
+func sortVerifyEntries(entries []VerifyEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].String() < entries[j].String()
+	})
+}
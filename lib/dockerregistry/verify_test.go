@@ -0,0 +1,221 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	reg "sigs.k8s.io/k8s-container-image-promoter/lib/dockerregistry"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/stream"
+)
+
+func TestVerifyDestinations(t *testing.T) {
+	srcRC := reg.RegistryContext{
+		Name: "gcr.io/foo",
+		Src:  true,
+	}
+	destRC := reg.RegistryContext{
+		Name:           "gcr.io/bar",
+		ServiceAccount: "robot",
+	}
+
+	mfest := reg.Manifest{
+		Registries: []reg.RegistryContext{srcRC, destRC},
+		Images: []reg.Image{
+			{
+				ImageName: "a",
+				Dmap: reg.DigestTags{
+					"sha256:000": {"1.0"},
+					"sha256:111": {"2.0"},
+				},
+			},
+		},
+		SrcRegistry: &srcRC,
+	}
+
+	// mkListing renders the listing of the destination repository "a", with
+	// the given tags of each digest.
+	mkListing := func(dmap map[string][]string) string {
+		manifests := ""
+		for digest, tags := range dmap {
+			if len(manifests) > 0 {
+				manifests += ","
+			}
+			tagsJSON := "[]"
+			if len(tags) > 0 {
+				tagsJSON = `["` + tags[0] + `"`
+				for _, tag := range tags[1:] {
+					tagsJSON += `, "` + tag + `"`
+				}
+				tagsJSON += "]"
+			}
+			manifests += fmt.Sprintf(`
+    %q: {
+      "imageSizeBytes": "10",
+      "layerId": "",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "tag": %s,
+      "timeCreatedMs": "0",
+      "timeUploadedMs": "0"
+    }`, digest, tagsJSON)
+		}
+		return fmt.Sprintf(`{
+  "child": [],
+  "manifest": {%s
+  },
+  "name": "bar/a",
+  "tags": []
+}`, manifests)
+	}
+
+	var tests = []struct {
+		name     string
+		listing  map[string][]string
+		expected reg.VerifyResult
+	}{
+		{
+			"No drift",
+			map[string][]string{
+				"sha256:000": {"1.0"},
+				"sha256:111": {"2.0"},
+				// Untagged digests, and referrer and signature tags, are
+				// not extra.
+				"sha256:222": {},
+				"sha256:333": {"sha256-000.sig"},
+				"sha256:444": {"sha256-111.att"},
+			},
+			reg.VerifyResult{},
+		},
+		{
+			"Missing digest",
+			map[string][]string{
+				"sha256:000": {"1.0"},
+			},
+			reg.VerifyResult{
+				Missing: []reg.VerifyEntry{
+					{
+						Registry: "gcr.io/bar",
+						Image:    "a",
+						Digest:   "sha256:111",
+						Tag:      "2.0",
+					},
+				},
+			},
+		},
+		{
+			"Moved and extra tags",
+			map[string][]string{
+				"sha256:000": {"1.0", "2.0"},
+				"sha256:111": {},
+				"sha256:222": {"3.0"},
+			},
+			reg.VerifyResult{
+				Missing: []reg.VerifyEntry{
+					{
+						Registry: "gcr.io/bar",
+						Image:    "a",
+						Digest:   "sha256:111",
+						Tag:      "2.0",
+					},
+				},
+				Extra: []reg.VerifyEntry{
+					{
+						Registry: "gcr.io/bar",
+						Image:    "a",
+						Digest:   "sha256:000",
+						Tag:      "2.0",
+					},
+					{
+						Registry: "gcr.io/bar",
+						Image:    "a",
+						Digest:   "sha256:222",
+						Tag:      "3.0",
+					},
+				},
+			},
+		},
+	}
+
+	edges, err := reg.ToPromotionEdges([]reg.Manifest{mfest})
+	checkError(t, err, "unexpected error getting promotion edges\n")
+
+	for _, test := range tests {
+		sc := reg.SyncContext{
+			Threads:          1,
+			RegistryContexts: []reg.RegistryContext{srcRC, destRC},
+			Inv:              make(reg.MasterInventory),
+			DigestMediaType:  make(reg.DigestMediaType),
+			DigestImageSize:  make(reg.DigestImageSize),
+		}
+
+		// Only the destination repository must be read.
+		listing := mkListing(test.listing)
+		var reads []reg.RegistryName
+		mkFakeStream := func(
+			sc *reg.SyncContext,
+			rc reg.RegistryContext) stream.Producer {
+
+			reads = append(reads, rc.Name)
+			return &stream.Fake{Bytes: []byte(listing)}
+		}
+
+		got, err := sc.VerifyDestinations(
+			context.Background(),
+			edges,
+			mkFakeStream)
+		checkError(t, err, fmt.Sprintf("Test: %v (error)\n", test.name))
+
+		eqErr := checkEqual(reads, []reg.RegistryName{"gcr.io/bar/a"})
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (reads)\n", test.name))
+
+		eqErr = checkEqual(got, test.expected)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (result)\n", test.name))
+
+		eqErr = checkEqual(got.HasDrift(), len(test.expected.Missing) > 0 ||
+			len(test.expected.Extra) > 0)
+		checkError(t, eqErr, fmt.Sprintf("Test: %v (drift)\n", test.name))
+	}
+}
+
+func TestVerifyResultString(t *testing.T) {
+	eqErr := checkEqual(reg.VerifyResult{}.String(),
+		"The destination registries match the manifests.\n")
+	checkError(t, eqErr, "unexpected rendering without drift\n")
+
+	result := reg.VerifyResult{
+		Missing: []reg.VerifyEntry{
+			{
+				Registry: "gcr.io/bar",
+				Image:    "a",
+				Digest:   "sha256:111",
+				Tag:      "2.0",
+			},
+		},
+		Extra: []reg.VerifyEntry{
+			{Registry: "gcr.io/bar", Image: "a", Digest: "sha256:222"},
+		},
+	}
+	expected := `  DRIFT    IMAGE
+  missing  gcr.io/bar/a:2.0@sha256:111
+  extra    gcr.io/bar/a@sha256:222
+Total: 1 missing, 1 extra
+`
+	eqErr = checkEqual(result.String(), expected)
+	checkError(t, eqErr, "unexpected rendering with drift\n")
+}
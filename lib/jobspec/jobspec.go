@@ -0,0 +1,191 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jobspec generates the Kubernetes Job (or CronJob) that runs a
+// promotion in-cluster, so that it can be checked in and deployed like any
+// other manifest. Nothing is sent to a cluster.
+package jobspec
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultName is the default name of the generated Job or CronJob.
+	DefaultName = "cip"
+
+	// DefaultImage is the default image of the container running cip.
+	DefaultImage = "gcr.io/k8s-staging-artifact-promoter/cip:latest"
+)
+
+// Options describes the Job (or CronJob) to generate.
+type Options struct {
+	// Name is the name of the Job or CronJob (and of its container).
+	Name string
+	// Namespace (if set) is the namespace of the Job or CronJob.
+	Namespace string
+	// Image is the image of the container, which must have cip in its PATH.
+	Image string
+	// ServiceAccount (if set) is the Kubernetes service account the pod runs
+	// as (e.g. one bound to a GCP service account with Workload Identity).
+	ServiceAccount string
+	// Schedule (if set) is the cron schedule of a CronJob; a plain Job is
+	// generated if it is empty.
+	Schedule string
+	// Args are the arguments of cip.
+	Args []string
+}
+
+// The types below are the subset of the batch/v1 API needed for the spec.
+
+type objectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type container struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Command []string `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type podSpec struct {
+	ServiceAccountName string      `json:"serviceAccountName,omitempty"`
+	RestartPolicy      string      `json:"restartPolicy"`
+	Containers         []container `json:"containers"`
+}
+
+type podTemplateSpec struct {
+	Spec podSpec `json:"spec"`
+}
+
+type jobSpec struct {
+	BackoffLimit int             `json:"backoffLimit"`
+	Template     podTemplateSpec `json:"template"`
+}
+
+type job struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       jobSpec    `json:"spec"`
+}
+
+type jobTemplateSpec struct {
+	Spec jobSpec `json:"spec"`
+}
+
+type cronJobSpec struct {
+	Schedule          string          `json:"schedule"`
+	ConcurrencyPolicy string          `json:"concurrencyPolicy"`
+	JobTemplate       jobTemplateSpec `json:"jobTemplate"`
+}
+
+type cronJob struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Metadata   objectMeta  `json:"metadata"`
+	Spec       cronJobSpec `json:"spec"`
+}
+
+// Generate returns the YAML of the batch/v1 Job (or CronJob, if
+// o.Schedule is set) that runs cip with o.Args.
+//
+// The pod is not restarted, and the Job not retried, if cip fails: a failed
+// promotion is better investigated than blindly repeated. Runs of a CronJob
+// never overlap.
+func Generate(o Options) ([]byte, error) {
+	if o.Name == "" {
+		return nil, fmt.Errorf("the name of the job is required")
+	}
+	if o.Image == "" {
+		return nil, fmt.Errorf("the image of the job is required")
+	}
+
+	meta := objectMeta{
+		Name:      o.Name,
+		Namespace: o.Namespace,
+	}
+	spec := jobSpec{
+		BackoffLimit: 0,
+		Template: podTemplateSpec{
+			Spec: podSpec{
+				ServiceAccountName: o.ServiceAccount,
+				RestartPolicy:      "Never",
+				Containers: []container{
+					{
+						Name:    o.Name,
+						Image:   o.Image,
+						Command: []string{"cip"},
+						Args:    o.Args,
+					},
+				},
+			},
+		},
+	}
+
+	var obj interface{}
+	if o.Schedule == "" {
+		obj = job{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Metadata:   meta,
+			Spec:       spec,
+		}
+	} else {
+		obj = cronJob{
+			APIVersion: "batch/v1",
+			Kind:       "CronJob",
+			Metadata:   meta,
+			Spec: cronJobSpec{
+				Schedule:          o.Schedule,
+				ConcurrencyPolicy: "Forbid",
+				JobTemplate:       jobTemplateSpec{Spec: spec},
+			},
+		}
+	}
+
+	b, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing job: %v", err)
+	}
+	return b, nil
+}
+
+// FlagArgs returns the flags of fs which were set on the command line, as
+// "-name=value" arguments (sorted by name), except those for which skip
+// returns true.
+func FlagArgs(fs *flag.FlagSet, skip func(name string) bool) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if skip != nil && skip(f.Name) {
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+// IsJobFlag returns true for the flags which configure the generated Job
+// itself (-emit-job and the -job-* flags), rather than the promotion.
+func IsJobFlag(name string) bool {
+	return name == "emit-job" || strings.HasPrefix(name, "job-")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jobspec
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/utils/diff"
+)
+
+// assertMatchesFile compares actual to the golden file p, which is rewritten
+// instead if UPDATE_EXPECTED_OUTPUT is set.
+func assertMatchesFile(t *testing.T, actual string, p string) {
+	if os.Getenv("UPDATE_EXPECTED_OUTPUT") != "" {
+		if err := ioutil.WriteFile(p, []byte(actual), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+		return
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("error reading file %q: %v", p, err)
+	}
+	if expected := string(b); actual != expected {
+		t.Errorf("actual did not match %q; diff=%s",
+			p, diff.StringDiff(actual, expected))
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	args := []string{
+		"-dry-run=false",
+		"-manifest=git::https://github.com/foo/manifests.git//manifest.yaml",
+	}
+
+	grid := []struct {
+		name     string
+		options  Options
+		expected string
+	}{
+		{
+			name: "job",
+			options: Options{
+				Name:           DefaultName,
+				Namespace:      "promoter",
+				Image:          DefaultImage,
+				ServiceAccount: "cip",
+				Args:           args,
+			},
+			expected: "testdata/job.yaml",
+		},
+		{
+			name: "cronjob",
+			options: Options{
+				Name:     "nightly-promotion",
+				Image:    "gcr.io/foo/cip:v1.2.3",
+				Schedule: "0 3 * * *",
+				Args:     args,
+			},
+			expected: "testdata/cronjob.yaml",
+		},
+	}
+
+	for _, g := range grid {
+		g := g // avoid closure go-tcha
+		t.Run(g.name, func(t *testing.T) {
+			b, err := Generate(g.options)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertMatchesFile(t, string(b), g.expected)
+		})
+	}
+
+	if _, err := Generate(Options{Image: DefaultImage}); err == nil {
+		t.Errorf("expected an error for a job without a name")
+	}
+}
+
+func TestFlagArgs(t *testing.T) {
+	fs := flag.NewFlagSet("cip", flag.ContinueOnError)
+	fs.String("manifest", "", "")
+	fs.Bool("dry-run", true, "")
+	fs.Int("threads", 10, "")
+	fs.Bool("emit-job", false, "")
+	fs.String("job-image", DefaultImage, "")
+
+	err := fs.Parse([]string{
+		"-threads", "4",
+		"-manifest=foo.yaml",
+		"-dry-run=false",
+		"-emit-job",
+		"-job-image=gcr.io/foo/cip:v1.2.3",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := FlagArgs(fs, IsJobFlag)
+	expected := []string{"-dry-run=false", "-manifest=foo.yaml", "-threads=4"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging provides the structured logger of the promoter. Log lines
+// carry key/value pairs (such as the image, digest, source registry and
+// destination of a promotion), and are written either as text (through klog)
+// or as JSON objects, one per line.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog"
+)
+
+const (
+	// FormatText logs human-readable text through klog.
+	FormatText = "text"
+	// FormatJSON logs a JSON object per line.
+	FormatJSON = "json"
+)
+
+var (
+	mutex  sync.RWMutex
+	logger logr.Logger = textLogger{}
+)
+
+// Log returns the structured logger. It logs text through klog, unless
+// SetLogger() was called.
+func Log() logr.Logger {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return logger
+}
+
+// SetLogger replaces the structured logger.
+func SetLogger(l logr.Logger) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	logger = l
+}
+
+// NewLogger creates a logger for the given format (FormatText or FormatJSON).
+// JSON logs are written to w; text logs go wherever klog writes them.
+func NewLogger(format string, w io.Writer) (logr.Logger, error) {
+	switch format {
+	case FormatText:
+		return textLogger{}, nil
+	case FormatJSON:
+		return &jsonLogger{out: &lockedWriter{w: w}}, nil
+	default:
+		return nil, fmt.Errorf(
+			"invalid log format %q (allowed values: %q or %q)",
+			format, FormatText, FormatJSON)
+	}
+}
+
+// textLogger logs through klog, appending the key/value pairs to the message
+// as key="value".
+type textLogger struct {
+	name   string
+	level  int
+	values []interface{}
+}
+
+func (l textLogger) Enabled() bool {
+	return bool(klog.V(klog.Level(l.level)))
+}
+
+func (l textLogger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		klog.InfoDepth(1, l.format(msg, nil, keysAndValues))
+	}
+}
+
+func (l textLogger) Error(
+	err error,
+	msg string,
+	keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, l.format(msg, err, keysAndValues))
+}
+
+func (l textLogger) V(level int) logr.Logger {
+	l.level += level
+	return l
+}
+
+func (l textLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	l.values = appendValues(l.values, keysAndValues)
+	return l
+}
+
+func (l textLogger) WithName(name string) logr.Logger {
+	l.name = joinName(l.name, name)
+	return l
+}
+
+func (l textLogger) format(
+	msg string,
+	err error,
+	keysAndValues []interface{}) string {
+
+	var sb strings.Builder
+	if l.name != "" {
+		sb.WriteString(l.name)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(msg)
+	kvs := appendValues(l.values, keysAndValues)
+	if err != nil {
+		kvs = append(kvs, "error", err)
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		fmt.Fprintf(&sb, " %v=%q", kvs[i], fmt.Sprint(kvs[i+1]))
+	}
+	return sb.String()
+}
+
+// jsonLogger writes a JSON object per line, with the fields "ts", "level",
+// "logger" (if named), "msg", "error" (for errors) and the key/value pairs.
+type jsonLogger struct {
+	out    *lockedWriter
+	name   string
+	level  int
+	values []interface{}
+}
+
+func (l *jsonLogger) Enabled() bool {
+	return bool(klog.V(klog.Level(l.level)))
+}
+
+func (l *jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		l.write("info", msg, nil, keysAndValues)
+	}
+}
+
+func (l *jsonLogger) Error(
+	err error,
+	msg string,
+	keysAndValues ...interface{}) {
+	l.write("error", msg, err, keysAndValues)
+}
+
+func (l *jsonLogger) V(level int) logr.Logger {
+	clone := *l
+	clone.level += level
+	return &clone
+}
+
+func (l *jsonLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	clone := *l
+	clone.values = appendValues(l.values, keysAndValues)
+	return &clone
+}
+
+func (l *jsonLogger) WithName(name string) logr.Logger {
+	clone := *l
+	clone.name = joinName(l.name, name)
+	return &clone
+}
+
+func (l *jsonLogger) write(
+	level, msg string,
+	err error,
+	keysAndValues []interface{}) {
+
+	entry := map[string]interface{}{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	if l.name != "" {
+		entry["logger"] = l.name
+	}
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+	kvs := appendValues(l.values, keysAndValues)
+	for i := 0; i < len(kvs); i += 2 {
+		key := fmt.Sprint(kvs[i])
+		value := kvs[i+1]
+		// Values are serialized as JSON (numbers, strings, ...) if possible,
+		// and as text otherwise.
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		default:
+			if _, err := json.Marshal(v); err != nil {
+				value = fmt.Sprint(v)
+			}
+		}
+		entry[key] = value
+	}
+
+	b, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		klog.Errorf("could not log %q as JSON: %v", msg, marshalErr)
+		return
+	}
+	l.out.writeLine(b)
+}
+
+// appendValues returns a new slice with the key/value pairs of both slices. A
+// key without a value gets the value "(MISSING)".
+func appendValues(values, more []interface{}) []interface{} {
+	kvs := make([]interface{}, 0, len(values)+len(more)+1)
+	kvs = append(kvs, values...)
+	kvs = append(kvs, more...)
+	if len(kvs)%2 != 0 {
+		kvs = append(kvs, "(MISSING)")
+	}
+	return kvs
+}
+
+func joinName(name, more string) string {
+	if name == "" {
+		return more
+	}
+	return name + "/" + more
+}
+
+// lockedWriter serializes the lines written by concurrent loggers.
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (lw *lockedWriter) writeLine(b []byte) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	// nolint[errcheck]
+	lw.w.Write(append(b, '\n'))
+}
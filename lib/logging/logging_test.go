@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(FormatJSON, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log = log.WithName("promoter").
+		WithValues("image", "foo", "digest", "sha256:0")
+	log.Info("promoted image", "dst", "gcr.io/bar/foo:1.0", "count", 2)
+	log.WithName("sub").Error(fmt.Errorf("boom"), "could not promote image")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %q", len(lines), buf.String())
+	}
+
+	var tests = []struct {
+		line     string
+		expected map[string]interface{}
+	}{
+		{
+			lines[0],
+			map[string]interface{}{
+				"level":  "info",
+				"logger": "promoter",
+				"msg":    "promoted image",
+				"image":  "foo",
+				"digest": "sha256:0",
+				"dst":    "gcr.io/bar/foo:1.0",
+				"count":  float64(2),
+			},
+		},
+		{
+			lines[1],
+			map[string]interface{}{
+				"level":  "error",
+				"logger": "promoter/sub",
+				"msg":    "could not promote image",
+				"error":  "boom",
+				"image":  "foo",
+				"digest": "sha256:0",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(test.line), &got); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", test.line, err)
+		}
+		if _, ok := got["ts"]; !ok {
+			t.Errorf("missing timestamp in %q", test.line)
+		}
+		delete(got, "ts")
+		if len(got) != len(test.expected) {
+			t.Errorf("expected fields %v, got %v", test.expected, got)
+		}
+		for key, value := range test.expected {
+			if got[key] != value {
+				t.Errorf("field %q: expected %v, got %v", key, value, got[key])
+			}
+		}
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var tests = []struct {
+		name          string
+		logger        textLogger
+		err           error
+		keysAndValues []interface{}
+		expected      string
+	}{
+		{
+			"message only",
+			textLogger{},
+			nil,
+			nil,
+			"msg",
+		},
+		{
+			"values, name and error",
+			textLogger{name: "promoter", values: []interface{}{"image", "foo"}},
+			fmt.Errorf("boom"),
+			[]interface{}{"count", 2},
+			`promoter: msg image="foo" count="2" error="boom"`,
+		},
+		{
+			"key without value",
+			textLogger{},
+			nil,
+			[]interface{}{"image"},
+			`msg image="(MISSING)"`,
+		},
+	}
+
+	for _, test := range tests {
+		got := test.logger.format("msg", test.err, test.keysAndValues)
+		if got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestNewLoggerInvalidFormat(t *testing.T) {
+	if _, err := NewLogger("xml", &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an invalid log format")
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics records metrics about promotion runs, and serves them in the
+// Prometheus text exposition format. It only implements the few metric types
+// that the promoter needs, to avoid depending on the Prometheus client
+// libraries.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Metrics holds the metrics of a promotion run. All methods of a nil *Metrics
+// are no-ops, so that recording metrics costs nothing unless they are served.
+type Metrics struct {
+	ImagesPromoted  *Counter
+	PromotionErrors *Counter
+	BytesCopied     *Histogram
+	CopyDuration    *Histogram
+}
+
+// New creates the metrics of a promotion run.
+func New() *Metrics {
+	return &Metrics{
+		ImagesPromoted: &Counter{
+			Name: "cip_images_promoted_total",
+			Help: "Number of images promoted.",
+		},
+		PromotionErrors: &Counter{
+			Name: "cip_promotion_errors_total",
+			Help: "Number of images that failed to be promoted.",
+		},
+		BytesCopied: NewHistogram(
+			"cip_copied_bytes",
+			"Size of the promoted images, in bytes.",
+			// 1MiB to 16GiB
+			ExponentialBuckets(1<<20, 4, 8)),
+		CopyDuration: NewHistogram(
+			"cip_image_copy_duration_seconds",
+			"Time taken to promote an image, in seconds.",
+			// 0.5s to ~17m
+			ExponentialBuckets(0.5, 2, 12)),
+	}
+}
+
+// ObserveCopy records the promotion of a single image, which took duration d.
+// The size of the image is only recorded if it is known (size > 0).
+func (m *Metrics) ObserveCopy(size int64, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.PromotionErrors.Inc()
+		return
+	}
+
+	m.ImagesPromoted.Inc()
+	m.CopyDuration.Observe(d.Seconds())
+	if size > 0 {
+		m.BytesCopied.Observe(float64(size))
+	}
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	m.ImagesPromoted.write(cw)
+	m.PromotionErrors.write(cw)
+	m.BytesCopied.write(cw)
+	m.CopyDuration.write(cw)
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := m.WriteTo(w); err != nil {
+		klog.Warningf("error writing metrics: %v", err)
+	}
+}
+
+// Serve serves the metrics on "/metrics" at addr (e.g. ":9090") in the
+// background. It only returns an error if addr cannot be listened on.
+func (m *Metrics) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not serve metrics on %q: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	klog.Infof("serving metrics on %s/metrics", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("error serving metrics: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Counter is a metric whose value only goes up.
+type Counter struct {
+	Name string
+	Help string
+
+	mutex sync.Mutex
+	value float64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.value++
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.value
+}
+
+func (c *Counter) write(w *countingWriter) {
+	w.printf("# HELP %s %s\n", c.Name, c.Help)
+	w.printf("# TYPE %s counter\n", c.Name)
+	w.printf("%s %s\n", c.Name, formatFloat(c.Value()))
+}
+
+// Histogram counts observations in buckets of increasing upper bounds.
+type Histogram struct {
+	Name string
+	Help string
+
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates a Histogram with the given (sorted) bucket upper
+// bounds. The "+Inf" bucket is implied.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		Name:    name,
+		Help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// ExponentialBuckets returns count bucket upper bounds, starting at start and
+// multiplied by factor for each following bucket.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *countingWriter) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	w.printf("# HELP %s %s\n", h.Name, h.Help)
+	w.printf("# TYPE %s histogram\n", h.Name)
+	// The bucket counts are cumulative, as Observe() counts each observation
+	// in every bucket that it fits in.
+	for i, bound := range h.buckets {
+		w.printf("%s_bucket{le=\"%s\"} %d\n",
+			h.Name, formatFloat(bound), h.counts[i])
+	}
+	w.printf("%s_bucket{le=\"+Inf\"} %d\n", h.Name, h.count)
+	w.printf("%s_sum %s\n", h.Name, formatFloat(h.sum))
+	w.printf("%s_count %d\n", h.Name, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingWriter remembers the number of bytes written, and the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, a ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, a...)
+	cw.n += int64(n)
+	cw.err = err
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestObserveCopy(t *testing.T) {
+	m := New()
+	m.ObserveCopy(2<<20, 3*time.Second, nil)
+	m.ObserveCopy(0, time.Second, nil)
+	m.ObserveCopy(0, time.Second, fmt.Errorf("copy failed"))
+
+	if got := m.ImagesPromoted.Value(); got != 2 {
+		t.Errorf("expected 2 images promoted, got %v", got)
+	}
+	if got := m.PromotionErrors.Value(); got != 1 {
+		t.Errorf("expected 1 promotion error, got %v", got)
+	}
+	// Unknown sizes are not observed
+	if got := m.BytesCopied.Count(); got != 1 {
+		t.Errorf("expected 1 size observation, got %v", got)
+	}
+	if got := m.CopyDuration.Count(); got != 2 {
+		t.Errorf("expected 2 duration observations, got %v", got)
+	}
+
+	// A nil *Metrics records nothing (and does not panic)
+	var noop *Metrics
+	noop.ObserveCopy(1, time.Second, nil)
+	var b bytes.Buffer
+	if n, err := noop.WriteTo(&b); n != 0 || err != nil {
+		t.Errorf("expected nothing to be written, got %d, %v", n, err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	m := &Metrics{
+		ImagesPromoted:  &Counter{Name: "promoted_total", Help: "Promoted."},
+		PromotionErrors: &Counter{Name: "errors_total", Help: "Errors."},
+		BytesCopied:     NewHistogram("bytes", "Bytes.", []float64{10, 100}),
+		CopyDuration:    NewHistogram("seconds", "Seconds.", []float64{0.5}),
+	}
+	m.ImagesPromoted.Inc()
+	m.BytesCopied.Observe(5)
+	m.BytesCopied.Observe(50)
+	m.BytesCopied.Observe(500)
+	m.CopyDuration.Observe(0.25)
+
+	expected := `# HELP promoted_total Promoted.
+# TYPE promoted_total counter
+promoted_total 1
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP bytes Bytes.
+# TYPE bytes histogram
+bytes_bucket{le="10"} 1
+bytes_bucket{le="100"} 2
+bytes_bucket{le="+Inf"} 3
+bytes_sum 555
+bytes_count 3
+# HELP seconds Seconds.
+# TYPE seconds histogram
+seconds_bucket{le="0.5"} 1
+seconds_bucket{le="+Inf"} 1
+seconds_sum 0.25
+seconds_count 1
+`
+
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if int(n) != b.Len() {
+		t.Errorf("WriteTo returned %d, but wrote %d bytes", n, b.Len())
+	}
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
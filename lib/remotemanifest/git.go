@@ -82,6 +82,8 @@ func (remote *Git) Fetch() ([]reg.Manifest, error) {
 	return manifests, nil
 }
 
+// cloneToTempDir clones the branch of the repository into a new temporary
+// directory. The default branch is cloned if branch is empty.
 func cloneToTempDir(
 	repoURL fmt.Stringer,
 	branch string,
@@ -91,12 +93,18 @@ func cloneToTempDir(
 		return "", err
 	}
 
-	r, err := gogit.PlainClone(tdir, false, &gogit.CloneOptions{
-		URL:           repoURL.String(),
-		ReferenceName: (plumbing.ReferenceName)("refs/heads/" + branch),
-		Depth:         gitCloneDepth,
-	})
+	cloneOptions := &gogit.CloneOptions{
+		URL:   repoURL.String(),
+		Depth: gitCloneDepth,
+	}
+	if len(branch) > 0 {
+		cloneOptions.ReferenceName = (plumbing.ReferenceName)(
+			"refs/heads/" + branch)
+	}
+
+	r, err := gogit.PlainClone(tdir, false, cloneOptions)
 	if err != nil {
+		removeFunc(tdir)()
 		return "", err
 	}
 
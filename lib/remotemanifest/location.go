@@ -0,0 +1,197 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotemanifest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// GitPrefix marks a location as a Git repository (see Download()).
+	GitPrefix = "git::"
+
+	// downloadTimeout bounds the time taken by an HTTP download.
+	downloadTimeout = 5 * time.Minute
+)
+
+// IsRemote returns true if the location is to be downloaded (see Download())
+// rather than read from the local disk.
+func IsRemote(location string) bool {
+	return strings.HasPrefix(location, GitPrefix) ||
+		strings.HasPrefix(location, "http://") ||
+		strings.HasPrefix(location, "https://")
+}
+
+// Download makes the manifest file (or directory) at the given location
+// available on the local disk, and returns its local path. The location is
+// one of:
+//
+//   - "git::<repo URL>[//<path>][?ref=<branch>]": the path within a
+//     (shallow) clone of the branch of the Git repository; the default branch
+//     and the root of the repository are used if they are not given (e.g.
+//     "git::https://github.com/foo/manifests.git//images?ref=main"),
+//   - "http://..." or "https://...": a single file, which is downloaded with
+//     a GET request,
+//   - anything else: a local path, which is returned as is.
+//
+// The returned cleanup function removes the downloaded files, if any.
+func Download(location string) (string, func(), error) {
+	nop := func() {}
+
+	switch {
+	case strings.HasPrefix(location, GitPrefix):
+		repoURL, subPath, branch, err := parseGitLocation(
+			strings.TrimPrefix(location, GitPrefix))
+		if err != nil {
+			return "", nop, err
+		}
+
+		repoPath, err := cloneToTempDir(repoURL, branch)
+		if err != nil {
+			return "", nop, fmt.Errorf("could not clone %q: %v", location, err)
+		}
+		cleanup := removeFunc(repoPath)
+
+		localPath := filepath.Join(repoPath, subPath)
+		if localPath != repoPath &&
+			!strings.HasPrefix(localPath, repoPath+string(filepath.Separator)) {
+			cleanup()
+			return "", nop, fmt.Errorf(
+				"path %q is outside of the repository in %q", subPath, location)
+		}
+
+		return localPath, cleanup, nil
+	case IsRemote(location):
+		localPath, err := downloadToTempDir(location)
+		if err != nil {
+			return "", nop, fmt.Errorf(
+				"could not download %q: %v", location, err)
+		}
+
+		return localPath, removeFunc(filepath.Dir(localPath)), nil
+	}
+
+	return location, nop, nil
+}
+
+// parseGitLocation splits a Git location (without the GitPrefix) into the
+// repository URL, the path within the repository and the branch.
+func parseGitLocation(location string) (*url.URL, string, string, error) {
+	var branch string
+	if i := strings.LastIndex(location, "?"); i >= 0 {
+		query, err := url.ParseQuery(location[i+1:])
+		if err != nil {
+			return nil, "", "", err
+		}
+		branch = query.Get("ref")
+		location = location[:i]
+	}
+
+	// The path is separated by a double slash, which must not be mistaken for
+	// the one of the URL scheme (e.g. "https://").
+	var subPath string
+	schemeEnd := 0
+	if i := strings.Index(location, "://"); i >= 0 {
+		schemeEnd = i + len("://")
+	}
+	if i := strings.Index(location[schemeEnd:], "//"); i >= 0 {
+		subPath = location[schemeEnd+i+len("//"):]
+		location = location[:schemeEnd+i]
+	}
+
+	repoURL, err := url.Parse(location)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return repoURL, subPath, branch, nil
+}
+
+// downloadToTempDir downloads the file at the URL into a new temporary
+// directory, under the same name, and returns its path.
+func downloadToTempDir(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "manifest.yaml"
+	}
+
+	client := &http.Client{Timeout: downloadTimeout}
+	res, err := client.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	tdir, err := ioutil.TempDir("", "k8s.io-")
+	if err != nil {
+		return "", err
+	}
+
+	localPath := filepath.Join(tdir, name)
+	if err := writeFile(localPath, res.Body); err != nil {
+		removeFunc(tdir)()
+		return "", err
+	}
+
+	klog.Infof("downloaded %v to %v", rawURL, localPath)
+	return localPath, nil
+}
+
+func writeFile(localPath string, r io.Reader) error {
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		// nolint[errcheck]
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// removeFunc returns a function that removes the directory. Failures are only
+// logged, because the directory is a temporary one anyway.
+func removeFunc(dir string) func() {
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			klog.Errorf("Could not remove temporary directory %v: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotemanifest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestParseGitLocation(t *testing.T) {
+	var tests = []struct {
+		location        string
+		expectedURL     string
+		expectedSubPath string
+		expectedBranch  string
+	}{
+		{
+			"https://github.com/foo/manifests.git",
+			"https://github.com/foo/manifests.git",
+			"",
+			"",
+		},
+		{
+			"https://github.com/foo/manifests.git//images/bar?ref=release-1.0",
+			"https://github.com/foo/manifests.git",
+			"images/bar",
+			"release-1.0",
+		},
+		{
+			"file:///tmp/manifests?ref=main",
+			"file:///tmp/manifests",
+			"",
+			"main",
+		},
+	}
+
+	for _, test := range tests {
+		repoURL, subPath, branch, err := parseGitLocation(test.location)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.location, err)
+			continue
+		}
+		if repoURL.String() != test.expectedURL {
+			t.Errorf("%s: expected URL %q, got %q",
+				test.location, test.expectedURL, repoURL)
+		}
+		if subPath != test.expectedSubPath {
+			t.Errorf("%s: expected path %q, got %q",
+				test.location, test.expectedSubPath, subPath)
+		}
+		if branch != test.expectedBranch {
+			t.Errorf("%s: expected branch %q, got %q",
+				test.location, test.expectedBranch, branch)
+		}
+	}
+}
+
+func TestDownloadHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/manifests/promoter-manifest.yaml" {
+				http.NotFound(w, r)
+				return
+			}
+			// nolint[errcheck]
+			w.Write([]byte("registries: []\n"))
+		}))
+	defer server.Close()
+
+	localPath, cleanup, err := Download(
+		server.URL + "/manifests/promoter-manifest.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if filepath.Base(localPath) != "promoter-manifest.yaml" {
+		t.Errorf("expected the file name to be kept, got %q", localPath)
+	}
+	b, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("could not read the downloaded file: %v", err)
+	}
+	if string(b) != "registries: []\n" {
+		t.Errorf("unexpected contents %q", b)
+	}
+
+	cleanup()
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed", localPath)
+	}
+
+	if _, _, err := Download(server.URL + "/missing.yaml"); err == nil {
+		t.Errorf("expected an error downloading a missing file")
+	}
+}
+
+func TestDownloadGit(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "remotemanifest-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	// Commit "images/images.yaml" to the "release" branch.
+	repo, err := gogit.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(repoDir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(repoDir, "images", "images.yaml"),
+		[]byte("- name: foo\n"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("images/images.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := worktree.Commit("Add images", &gogit.CommitOptions{
+		Author: &object.Signature{
+			Name:  "test",
+			Email: "test@example.com",
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(
+		plumbing.NewBranchReferenceName("release"),
+		commit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localPath, cleanup, err := Download(
+		GitPrefix + "file://" + repoDir + "//images?ref=release")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cleanup()
+
+	b, err := ioutil.ReadFile(filepath.Join(localPath, "images.yaml"))
+	if err != nil {
+		t.Fatalf("could not read the cloned file: %v", err)
+	}
+	if string(b) != "- name: foo\n" {
+		t.Errorf("unexpected contents %q", b)
+	}
+
+	_, _, err = Download(GitPrefix + "file://" + repoDir + "//../..")
+	if err == nil {
+		t.Errorf("expected an error for a path outside of the repository")
+	}
+}
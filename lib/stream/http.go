@@ -26,10 +26,12 @@ import (
 	"k8s.io/klog"
 )
 
-// HTTP is a wrapper around the net/http's Request type.
+// HTTP is a wrapper around the net/http's Request type. If Transport is set,
+// it is used instead of http.DefaultTransport to make the request.
 type HTTP struct {
-	Req *http.Request
-	Res *http.Response
+	Req       *http.Request
+	Res       *http.Response
+	Transport http.RoundTripper
 }
 
 const (
@@ -40,7 +42,8 @@ const (
 // stderr). In this case we equate the http.Respose "Body" with stdout.
 func (h *HTTP) Produce() (io.Reader, io.Reader, error) {
 	client := http.Client{
-		Timeout: time.Second * requestTimeoutSeconds,
+		Transport: h.Transport,
+		Timeout:   time.Second * requestTimeoutSeconds,
 	}
 
 	var err error
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook notifies an HTTP endpoint about the outcome of a promotion
+// run, by POSTing a JSON summary of it.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// SignatureHeader is the header that holds the signature of the body,
+	// as "sha256=<hex>": the HMAC-SHA256 of the body, keyed with the secret
+	// shared with the receiver.
+	SignatureHeader = "X-Cip-Signature-256"
+
+	// DefaultMaxRetries is the default number of times a failed notification
+	// is retried.
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBaseDelay is the default delay before the first retry of a
+	// failed notification. The delay doubles with every retry.
+	DefaultRetryBaseDelay = time.Second
+
+	// requestTimeout bounds the time taken by a single notification attempt.
+	requestTimeout = 30 * time.Second
+)
+
+// Summary is the JSON payload of a notification. The counts are those of the
+// promotion edges (one per promoted tag, or one for a tagless promotion).
+type Summary struct {
+	Manifest        string  `json:"manifest"`
+	DryRun          bool    `json:"dryRun"`
+	Promoted        int     `json:"promoted"`
+	Skipped         int     `json:"skipped"`
+	Failed          int     `json:"failed"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Notifier POSTs Summaries to URL. If Secret is set, every request is signed
+// with it (see SignatureHeader). Requests that fail with a network error or a
+// non-2xx status are retried at most MaxRetries times, with an exponential
+// backoff starting at RetryBaseDelay.
+type Notifier struct {
+	URL            string
+	Secret         string
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	Client         *http.Client
+}
+
+// New creates a Notifier with the default retry settings.
+func New(url, secret string) *Notifier {
+	return &Notifier{
+		URL:            url,
+		Secret:         secret,
+		MaxRetries:     DefaultMaxRetries,
+		RetryBaseDelay: DefaultRetryBaseDelay,
+		Client:         &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Sign returns the value of the SignatureHeader for the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	// nolint[errcheck]
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify POSTs the summary to the URL, retrying as needed. The error of the
+// last attempt is returned if all of them fail.
+func (n *Notifier) Notify(summary Summary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	delay := n.RetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err = n.post(body)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= n.MaxRetries {
+			return fmt.Errorf("notifying %s: %v (after %d retries)",
+				n.URL, err, attempt)
+		}
+
+		klog.Warningf("notifying %s: %v; retrying in %v (retry %d of %d)",
+			n.URL, err, delay, attempt+1, n.MaxRetries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a single notification.
+func (n *Notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.Secret, body))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain the body, so that the connection can be reused.
+	// nolint[errcheck]
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	// Computed with:
+	// printf '{}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=" +
+		"77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13"
+	got := Sign("secret", []byte("{}"))
+	if got != expected {
+		t.Errorf("expected signature %q, got %q", expected, got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	summary := Summary{
+		Manifest:        "manifests/foo",
+		Promoted:        2,
+		Skipped:         1,
+		Failed:          0,
+		DurationSeconds: 1.5,
+	}
+
+	var tests = []struct {
+		name             string
+		statuses         []int
+		expectedRequests int
+		expectErr        bool
+	}{
+		{
+			"Success",
+			[]int{http.StatusOK},
+			1,
+			false,
+		},
+		{
+			"Success after retries",
+			[]int{http.StatusInternalServerError, http.StatusBadGateway,
+				http.StatusNoContent},
+			3,
+			false,
+		},
+		{
+			"Failure after retries",
+			[]int{http.StatusInternalServerError},
+			3,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				status := test.statuses[len(test.statuses)-1]
+				if requests < len(test.statuses) {
+					status = test.statuses[requests]
+				}
+				requests++
+
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("%s: could not read body: %v", test.name, err)
+				}
+				if r.Header.Get(SignatureHeader) != Sign("secret", body) {
+					t.Errorf("%s: bad signature %q",
+						test.name, r.Header.Get(SignatureHeader))
+				}
+				var got Summary
+				if err := json.Unmarshal(body, &got); err != nil {
+					t.Errorf("%s: invalid payload: %v", test.name, err)
+				}
+				if !reflect.DeepEqual(got, summary) {
+					t.Errorf("%s: expected payload %+v, got %+v",
+						test.name, summary, got)
+				}
+
+				w.WriteHeader(status)
+			}))
+
+		notifier := New(server.URL, "secret")
+		notifier.MaxRetries = 2
+		notifier.RetryBaseDelay = 0
+
+		err := notifier.Notify(summary)
+		server.Close()
+
+		if test.expectErr && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if !test.expectErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if requests != test.expectedRequests {
+			t.Errorf("%s: expected %d requests, got %d",
+				test.name, test.expectedRequests, requests)
+		}
+	}
+}
@@ -18,19 +18,98 @@ package files
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
 	"sigs.k8s.io/yaml"
 )
 
-// Filestore holds information about a filestore (e.g. GCS or S3 bucket),
+// Filestore holds information about a filestore (e.g. GCS or S3 bucket, or
+// Azure Blob Storage container),
 // to be written in a manifest file.
 type Filestore struct {
 	// Base is the leading part of an artifact path, including the scheme.
 	// It is everything that is not the actual file name itself.
-	// e.g. "gs://prod-artifacts/myproject"
+	// e.g. "gs://prod-artifacts/myproject", "s3://prod-artifacts/myproject"
+	// or "azblob://account/prod-artifacts/myproject". Source filestores can
+	// also be HTTP(S) servers, e.g. "https://example.com/releases/v1.0"
 	Base           string `json:"base,omitempty"`
 	ServiceAccount string `json:"service-account,omitempty"`
 	Src            bool   `json:"src,omitempty"`
+	// PathMappings (only for destination filestores) map the names of files
+	// to other paths in this filestore (see DestPath)
+	PathMappings []PathMapping `json:"path-mappings,omitempty"`
+}
+
+// PathMapping maps the names of the files matching Source to the path Dest
+// in a destination filestore, e.g. to promote "bin/linux/amd64/tool" as
+// "releases/v1.0/tool-linux-amd64":
+//
+//	source: bin/([^/]+)/([^/]+)/([^/]+)
+//	dest: releases/v1.0/${3}-${1}-${2}
+type PathMapping struct {
+	// Source is a regular expression, which must match the whole name of
+	// a file (its path relative to the source filestore base)
+	Source string `json:"source"`
+	// Dest is the path of the matching files, relative to the destination
+	// filestore base; it can refer to the submatches of Source as ${1} (or
+	// ${name} for named ones)
+	Dest string `json:"dest"`
+}
+
+// compile compiles the regular expression of m.Source, anchored to match the
+// whole name of a file.
+func (m *PathMapping) compile() (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + m.Source + ")$")
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid source %q of path mapping: %v", m.Source, err)
+	}
+	return re, nil
+}
+
+// DestPath returns the path (relative to the filestore base) that the file
+// with the given name is promoted to: the Dest of the first PathMappings
+// whose Source matches the name (with the submatches expanded), or the name
+// itself if none matches. The sha256 of the file is still checked against
+// the manifest entry of the name.
+func (f *Filestore) DestPath(name string) (string, error) {
+	for i := range f.PathMappings {
+		m := &f.PathMappings[i]
+		re, err := m.compile()
+		if err != nil {
+			return "", err
+		}
+		submatches := re.FindStringSubmatchIndex(name)
+		if submatches == nil {
+			continue
+		}
+
+		p := string(re.ExpandString(nil, m.Dest, name, submatches))
+		if err := validateDestPath(p); err != nil {
+			return "", fmt.Errorf(
+				"path mapping %q -> %q of file %q: %v",
+				m.Source, m.Dest, name, err)
+		}
+		return p, nil
+	}
+	return name, nil
+}
+
+// validateDestPath checks that a mapped path stays within the filestore.
+func validateDestPath(p string) error {
+	if p == "" {
+		return fmt.Errorf("the mapped path is empty")
+	}
+	if strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return fmt.Errorf("invalid mapped path %q", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid mapped path %q", p)
+		}
+	}
+	return nil
 }
 
 // File holds information about a file artifact. File artifacts are copied from
@@ -40,6 +119,13 @@ type File struct {
 	Name string `json:"name"`
 	// SHA256 holds the SHA256 hash of the specified file (hex encoded)
 	SHA256 string `json:"sha256,omitempty"`
+	// SHA512 optionally holds the SHA512 hash of the specified file (hex
+	// encoded), for consumers that require it
+	SHA512 string `json:"sha512,omitempty"`
+	// Size is the size of the file in bytes, if known (informational only;
+	// it is not checked when promoting, but it counts towards the max total
+	// file size if the source filestore does not report a size)
+	Size int64 `json:"size,omitempty"`
 }
 
 // Manifest stores the information in a manifest file (describing the
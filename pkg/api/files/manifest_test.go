@@ -77,8 +77,68 @@ func TestValidateFilestores(t *testing.T) {
 				{Src: true, Base: "gs://src"},
 				{Base: "s3://dest"},
 			},
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "azblob://account/dest"},
+			},
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "ftp://dest"},
+			},
 			expectedError: "unsupported scheme in base",
 		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "https://example.com/releases"},
+				{Base: "gs://dest"},
+			},
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "https://example.com/releases"},
+			},
+			expectedError: "can only be used as a source",
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", PathMappings: []files.PathMapping{
+					{Source: "bin/(.+)", Dest: "releases/${1}"},
+				}},
+			},
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src", PathMappings: []files.PathMapping{
+					{Source: "bin/(.+)", Dest: "releases/${1}"},
+				}},
+				{Base: "gs://dest"},
+			},
+			expectedError: "path-mappings are not supported for source filestore",
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", PathMappings: []files.PathMapping{
+					{Source: "bin/(.+)"},
+				}},
+			},
+			expectedError: "source and dest are required for path mappings",
+		},
+		{
+			filestores: []files.Filestore{
+				{Src: true, Base: "gs://src"},
+				{Base: "gs://dest", PathMappings: []files.PathMapping{
+					{Source: "bin/(.+", Dest: "releases/${1}"},
+				}},
+			},
+			expectedError: "invalid source \"bin/(.+\" of path mapping",
+		},
 	}
 	for _, test := range tests {
 		err := files.ValidateFilestores(test.filestores)
@@ -89,6 +149,7 @@ func TestValidateFilestores(t *testing.T) {
 
 func TestValidateFiles(t *testing.T) {
 	oksha := "4f2f040fa2bfe9bea64911a2a756e8a1727a8bfd757c5e031631a6e699fcf246"
+	oksha512 := oksha + oksha
 
 	var tests = []struct {
 		files         []files.File
@@ -133,6 +194,29 @@ func TestValidateFiles(t *testing.T) {
 			},
 			expectedError: "sha256 was not valid (bad length)",
 		},
+		{
+			files: []files.File{
+				{Name: "foo", SHA256: oksha, SHA512: oksha512},
+			},
+		},
+		{
+			files: []files.File{
+				{Name: "foo", SHA512: oksha512},
+			},
+			expectedError: "sha256 is required",
+		},
+		{
+			files: []files.File{
+				{Name: "foo", SHA256: oksha, SHA512: "bad"},
+			},
+			expectedError: "sha512 was not valid (not hex)",
+		},
+		{
+			files: []files.File{
+				{Name: "foo", SHA256: oksha, SHA512: oksha},
+			},
+			expectedError: "sha512 was not valid (bad length)",
+		},
 	}
 	for _, test := range tests {
 		err := files.ValidateFiles(test.files)
@@ -140,6 +224,67 @@ func TestValidateFiles(t *testing.T) {
 	}
 }
 
+func TestDestPath(t *testing.T) {
+	filestore := files.Filestore{
+		Base: "gs://dest",
+		PathMappings: []files.PathMapping{
+			{
+				// A straightforward rename
+				Source: "README.md",
+				Dest:   "docs/README-v1.0.md",
+			},
+			{
+				Source: "bin/(?P<os>[^/]+)/(?P<arch>[^/]+)/([^/]+)",
+				Dest:   "releases/v1.0/${3}-${os}-${arch}",
+			},
+			{
+				Source: "escape/(.+)",
+				Dest:   "../${1}",
+			},
+		},
+	}
+
+	var tests = []struct {
+		name          string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "README.md",
+			expected: "docs/README-v1.0.md",
+		},
+		{
+			name:     "bin/linux/amd64/tool",
+			expected: "releases/v1.0/tool-linux-amd64",
+		},
+		{
+			name:     "bin/darwin/arm64/tool",
+			expected: "releases/v1.0/tool-darwin-arm64",
+		},
+		{
+			// Not matched as a whole
+			name:     "bin/linux/amd64/tools/tool",
+			expected: "bin/linux/amd64/tools/tool",
+		},
+		{
+			name:     "docs/README.md",
+			expected: "docs/README.md",
+		},
+		{
+			name:          "escape/foo",
+			expectedError: `invalid mapped path "../foo"`,
+		},
+	}
+	for _, test := range tests {
+		actual, err := filestore.DestPath(test.name)
+		checkErrorMatchesExpected(t, err, test.expectedError)
+		if actual != test.expected {
+			t.Errorf("expected %q to map to %q, got %q",
+				test.name, test.expected, actual)
+		}
+	}
+}
+
 func checkErrorMatchesExpected(t *testing.T, err error, expected string) {
 	if err != nil && expected == "" {
 		t.Errorf("unexpected error: %v", err)
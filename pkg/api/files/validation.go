@@ -50,12 +50,27 @@ func ValidateFilestores(filestores []Filestore) error {
 			return fmt.Errorf("filestore did not have base set")
 		}
 
-		// Currently the only backend supported is GCS
-		if !strings.HasPrefix(filestore.Base, "gs://") {
+		// Currently the supported backends are GCS, S3 and Azure Blob
+		// Storage; files can also be promoted from HTTP(S) servers
+		isHTTP := strings.HasPrefix(filestore.Base, "http://") ||
+			strings.HasPrefix(filestore.Base, "https://")
+		if !strings.HasPrefix(filestore.Base, "gs://") &&
+			!strings.HasPrefix(filestore.Base, "s3://") &&
+			!strings.HasPrefix(filestore.Base, "azblob://") &&
+			!isHTTP {
 			return fmt.Errorf(
 				"filestore has unsupported scheme in base %q",
 				filestore.Base)
 		}
+		if isHTTP && !filestore.Src {
+			return fmt.Errorf(
+				"HTTP(S) filestore %q can only be used as a source",
+				filestore.Base)
+		}
+
+		if err := validatePathMappings(filestore); err != nil {
+			return err
+		}
 
 		if filestore.Src {
 			if source != nil {
@@ -77,6 +92,33 @@ func ValidateFilestores(filestores []Filestore) error {
 	return nil
 }
 
+// validatePathMappings checks the PathMappings of a filestore.
+func validatePathMappings(filestore *Filestore) error {
+	if len(filestore.PathMappings) == 0 {
+		return nil
+	}
+	if filestore.Src {
+		return fmt.Errorf(
+			"path-mappings are not supported for source filestore %q",
+			filestore.Base)
+	}
+
+	for i := range filestore.PathMappings {
+		m := &filestore.PathMappings[i]
+		if m.Source == "" || m.Dest == "" {
+			return fmt.Errorf(
+				"source and dest are required for path mappings "+
+					"of filestore %q",
+				filestore.Base)
+		}
+		if _, err := m.compile(); err != nil {
+			return fmt.Errorf("filestore %q: %v", filestore.Base, err)
+		}
+	}
+
+	return nil
+}
+
 // ValidateFiles validates the Files field of the manifest.
 func ValidateFiles(files []File) error {
 	if len(files) == 0 {
@@ -103,6 +145,21 @@ func ValidateFiles(files []File) error {
 		if len(sha256) != 32 {
 			return fmt.Errorf("sha256 was not valid (bad length): %q", f.SHA256)
 		}
+
+		// The sha512 is optional
+		if f.SHA512 != "" {
+			sha512, err := hex.DecodeString(f.SHA512)
+			if err != nil {
+				return fmt.Errorf(
+					"sha512 was not valid (not hex): %q", f.SHA512)
+			}
+
+			// nolint[gomnd]
+			if len(sha512) != 64 {
+				return fmt.Errorf(
+					"sha512 was not valid (bad length): %q", f.SHA512)
+			}
+		}
 	}
 
 	return nil
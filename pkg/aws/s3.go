@@ -0,0 +1,233 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// S3Object describes an object in an S3 bucket.
+type S3Object struct {
+	Key  string `json:"Key"`
+	Size int64  `json:"Size"`
+	// ETag is the MD5 of the object (hex encoded, without quotes), unless the
+	// object was uploaded in multiple parts.
+	ETag string `json:"ETag"`
+}
+
+// S3CLI reads and writes S3 objects with the aws CLI. Like GetECRToken, it
+// relies on the aws CLI to resolve credentials with the standard AWS SDK
+// credential chain.
+type S3CLI struct{}
+
+// ListObjects lists all objects in the bucket whose key starts with prefix.
+// The aws CLI takes care of pagination.
+func (S3CLI) ListObjects(
+	ctx context.Context,
+	bucket, prefix string) ([]S3Object, error) {
+
+	cmd := exec.CommandContext(ctx, "aws",
+		"s3api",
+		"list-objects-v2",
+		"--bucket",
+		bucket,
+		"--prefix",
+		prefix,
+		"--output",
+		"json")
+
+	stdout, err := runS3Cmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// The output is empty if there are no objects.
+	if len(bytes.TrimSpace(stdout)) == 0 {
+		return nil, nil
+	}
+
+	var listing struct {
+		Contents []S3Object `json:"Contents"`
+	}
+	if err := json.Unmarshal(stdout, &listing); err != nil {
+		return nil, fmt.Errorf("error parsing objects in s3://%s/%s: %v",
+			bucket, prefix, err)
+	}
+
+	for i := range listing.Contents {
+		listing.Contents[i].ETag = strings.Trim(listing.Contents[i].ETag, `"`)
+	}
+	return listing.Contents, nil
+}
+
+// OpenObject streams the contents of an object. The returned io.ReadCloser
+// must be closed, which also reports any error of the download.
+func (S3CLI) OpenObject(
+	ctx context.Context,
+	bucket, key string) (io.ReadCloser, error) {
+
+	cmd := exec.CommandContext(ctx, "aws",
+		"s3",
+		"cp",
+		"s3://"+bucket+"/"+key,
+		"-")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		klog.Errorf("could not execute cmd %v", cmd)
+		return nil, err
+	}
+
+	return &cmdReadCloser{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// PutObject uploads localFile as an object. S3 itself checks the upload
+// against sha256 (the hex-encoded SHA256 of localFile), and records it as the
+// object's checksum (see ObjectSHA256). The object gets the given content
+// type, unless it is empty.
+func (S3CLI) PutObject(
+	ctx context.Context,
+	bucket, key, localFile, sha256, contentType string) error {
+
+	checksum, err := hex.DecodeString(sha256)
+	if err != nil {
+		return fmt.Errorf("invalid sha256 %q: %v", sha256, err)
+	}
+
+	args := []string{
+		"s3api",
+		"put-object",
+		"--bucket",
+		bucket,
+		"--key",
+		key,
+		"--body",
+		localFile,
+		"--checksum-algorithm",
+		"SHA256",
+		"--checksum-sha256",
+		base64.StdEncoding.EncodeToString(checksum),
+	}
+	if contentType != "" {
+		args = append(args, "--content-type", contentType)
+	}
+	cmd := exec.CommandContext(ctx, "aws", args...)
+
+	_, err = runS3Cmd(cmd)
+	return err
+}
+
+// DeleteObject deletes an object.
+func (S3CLI) DeleteObject(
+	ctx context.Context,
+	bucket, key string) error {
+
+	cmd := exec.CommandContext(ctx, "aws",
+		"s3api",
+		"delete-object",
+		"--bucket",
+		bucket,
+		"--key",
+		key)
+
+	_, err := runS3Cmd(cmd)
+	return err
+}
+
+// ObjectSHA256 returns the SHA256 checksum (hex encoded) that S3 recorded for
+// an object when it was uploaded.
+func (S3CLI) ObjectSHA256(
+	ctx context.Context,
+	bucket, key string) (string, error) {
+
+	cmd := exec.CommandContext(ctx, "aws",
+		"s3api",
+		"head-object",
+		"--bucket",
+		bucket,
+		"--key",
+		key,
+		"--checksum-mode",
+		"ENABLED",
+		"--query",
+		"ChecksumSHA256",
+		"--output",
+		"text")
+
+	stdout, err := runS3Cmd(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := strings.TrimSpace(string(stdout))
+	if encoded == "" || encoded == "None" {
+		return "", fmt.Errorf("no sha256 checksum recorded for s3://%s/%s",
+			bucket, key)
+	}
+
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid sha256 checksum %q for s3://%s/%s: %v",
+			encoded, bucket, key, err)
+	}
+	return hex.EncodeToString(checksum), nil
+}
+
+// runS3Cmd runs the command, and returns its stdout. Stderr is included in
+// the error, because the aws CLI explains failures there.
+func runS3Cmd(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		klog.Errorf("could not execute cmd %v", cmd)
+		return nil, fmt.Errorf("%v: %s",
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// cmdReadCloser reads the stdout of a running command, and waits for the
+// command to exit when closed.
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close waits for the command to exit.
+func (rc *cmdReadCloser) Close() error {
+	// Closing stdout first makes the command exit (with SIGPIPE) if we stopped
+	// reading early.
+	// nolint[errcheck]
+	rc.ReadCloser.Close()
+	return rc.cmd.Wait()
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// ECRUsername is the username that must be paired with the token returned by
+// GetECRToken when authenticating against an ECR registry.
+const ECRUsername = "AWS"
+
+// GetECRToken calls the aws CLI to get an authorization token for the ECR
+// registries in the given region. The aws CLI resolves credentials with the
+// standard AWS SDK credential chain (environment variables, shared
+// credentials file, instance/task roles, etc).
+func GetECRToken(region string) (string, error) {
+	cmd := exec.Command("aws",
+		"ecr",
+		"get-login-password",
+		"--region",
+		region)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	// Do not log the token (stdout) on error. NEVER print the token as part
+	// of an error message!
+
+	err := cmd.Run()
+	if err != nil {
+		klog.Errorf("could not execute cmd %v", cmd)
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// ListECRRepositories calls the aws CLI to list the names of all
+// repositories in the given ECR registry (identified by its AWS account ID).
+func ListECRRepositories(region, registryID string) ([]string, error) {
+	cmd := exec.Command("aws",
+		"ecr",
+		"describe-repositories",
+		"--region",
+		region,
+		"--registry-id",
+		registryID,
+		"--query",
+		"repositories[].repositoryName",
+		"--output",
+		"text")
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if err != nil {
+		klog.Errorf("could not execute cmd %v", cmd)
+		return nil, err
+	}
+
+	return strings.Fields(stdout.String()), nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Blob describes a blob in an Azure Blob Storage container.
+type Blob struct {
+	Name string
+	Size int64
+	// MD5 is the hex-encoded MD5 of the blob, if Azure has one on record.
+	MD5 string
+}
+
+// BlobCLI reads and writes blobs with the az CLI. Requests are authenticated
+// with the identity that the az CLI is logged in as ("--auth-mode login"); for
+// example, "az login --identity" uses the managed identity of the machine, and
+// "az login --service-principal" can be fed from the usual AZURE_*
+// environment variables.
+type BlobCLI struct{}
+
+// ListBlobs lists all blobs in the container whose name starts with prefix.
+func (BlobCLI) ListBlobs(
+	ctx context.Context,
+	account, container, prefix string) ([]Blob, error) {
+
+	cmd := exec.CommandContext(ctx, "az",
+		"storage",
+		"blob",
+		"list",
+		"--auth-mode",
+		"login",
+		"--account-name",
+		account,
+		"--container-name",
+		container,
+		"--prefix",
+		prefix,
+		"--num-results",
+		"*",
+		"--output",
+		"json")
+
+	stdout, err := runCmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var listing []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			ContentLength   int64 `json:"contentLength"`
+			ContentSettings struct {
+				ContentMD5 string `json:"contentMd5"`
+			} `json:"contentSettings"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(stdout, &listing); err != nil {
+		return nil, fmt.Errorf("error parsing blobs in %s/%s: %v",
+			account, container, err)
+	}
+
+	blobs := make([]Blob, 0, len(listing))
+	for _, b := range listing {
+		blob := Blob{
+			Name: b.Name,
+			Size: b.Properties.ContentLength,
+		}
+		// The MD5 is base64 encoded (and missing for some large blobs).
+		md5 := b.Properties.ContentSettings.ContentMD5
+		if md5 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(md5)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MD5 %q for blob %q: %v",
+					md5, b.Name, err)
+			}
+			blob.MD5 = hex.EncodeToString(decoded)
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+// OpenBlob downloads a blob, and returns an io.ReadCloser for its contents.
+// The az CLI can only download to a file, so the blob is downloaded to a
+// temporary file, which is removed when the io.ReadCloser is closed.
+func (BlobCLI) OpenBlob(
+	ctx context.Context,
+	account, container, name string) (io.ReadCloser, error) {
+
+	f, err := ioutil.TempFile("", "azblob")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %v", err)
+	}
+	rc := &tempFileReadCloser{File: f}
+
+	cmd := exec.CommandContext(ctx, "az",
+		"storage",
+		"blob",
+		"download",
+		"--auth-mode",
+		"login",
+		"--account-name",
+		account,
+		"--container-name",
+		container,
+		"--name",
+		name,
+		"--file",
+		f.Name(),
+		"--no-progress",
+		"--output",
+		"none")
+
+	if _, err := runCmd(cmd); err != nil {
+		// nolint[errcheck]
+		rc.Close()
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// UploadBlob uploads localFile as a blob, overwriting any existing blob. The
+// blob gets the given content type, unless it is empty.
+func (BlobCLI) UploadBlob(
+	ctx context.Context,
+	account, container, name, localFile, contentType string) error {
+
+	args := []string{
+		"storage",
+		"blob",
+		"upload",
+		"--auth-mode",
+		"login",
+		"--account-name",
+		account,
+		"--container-name",
+		container,
+		"--name",
+		name,
+		"--file",
+		localFile,
+		"--overwrite",
+		"--no-progress",
+		"--output",
+		"none",
+	}
+	if contentType != "" {
+		args = append(args, "--content-type", contentType)
+	}
+	cmd := exec.CommandContext(ctx, "az", args...)
+
+	_, err := runCmd(cmd)
+	return err
+}
+
+// DeleteBlob deletes a blob.
+func (BlobCLI) DeleteBlob(
+	ctx context.Context,
+	account, container, name string) error {
+
+	cmd := exec.CommandContext(ctx, "az",
+		"storage",
+		"blob",
+		"delete",
+		"--auth-mode",
+		"login",
+		"--account-name",
+		account,
+		"--container-name",
+		container,
+		"--name",
+		name,
+		"--output",
+		"none")
+
+	_, err := runCmd(cmd)
+	return err
+}
+
+// runCmd runs the command, and returns its stdout. Stderr is included in the
+// error, because the az CLI explains failures there.
+func runCmd(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		klog.Errorf("could not execute cmd %v", cmd)
+		return nil, fmt.Errorf("%v: %s",
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// tempFileReadCloser reads a temporary file, and removes it when closed.
+type tempFileReadCloser struct {
+	*os.File
+}
+
+// Close closes and removes the file.
+func (rc *tempFileReadCloser) Close() error {
+	err := rc.File.Close()
+	if rmErr := os.Remove(rc.File.Name()); rmErr != nil {
+		klog.Warningf("unable to remove temp file %q: %v",
+			rc.File.Name(), rmErr)
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// GetAADAccessToken calls the az CLI to get an Azure Active Directory access
+// token for the identity that the az CLI is logged in as (see BlobCLI). The
+// token can be exchanged for a registry refresh token by Azure Container
+// Registry.
+func GetAADAccessToken() (string, error) {
+	cmd := exec.Command("az",
+		"account",
+		"get-access-token",
+		"--query",
+		"accessToken",
+		"--output",
+		"tsv")
+
+	// Do not log the token (stdout) on error. NEVER print the token as part
+	// of an error message!
+
+	stdout, err := runCmd(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(stdout)), nil
+}
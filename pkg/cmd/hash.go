@@ -17,29 +17,75 @@ limitations under the License.
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/filepromoter"
 )
 
+// IgnoreFileName is the name of the files that list (in gitignore syntax) the
+// paths for GenerateManifest to skip. Like .gitignore files, there can be one
+// in any directory, and its patterns are relative to that directory.
+const IgnoreFileName = ".promoterignore"
+
 // GenerateManifestOptions holds the parameters for a hash-files operation.
 type GenerateManifestOptions struct {
 	// BaseDir is the directory containing the files to hash
 	BaseDir string
+
+	// SHA512 also records the SHA512 hash of each file. The SHA256 hash is
+	// always recorded, as it is required to promote the files.
+	SHA512 bool
+
+	// Threads is the number of files to hash concurrently
+	Threads int
+
+	// Exclude holds glob patterns (as in filepath.Match) of files and
+	// directories to skip; excluded directories are not walked at all. The
+	// paths matched by the ignore files (see IgnoreFileName) are skipped
+	// too.
+	// Patterns containing a "/" are matched against the path relative to
+	// BaseDir, other patterns against the base name at any depth (e.g. ".git"
+	// or "*.tmp").
+	Exclude []string
+
+	// Include holds glob patterns (matched like Exclude) of the files to
+	// hash; if non-empty, files matching none of them are skipped. Include
+	// patterns only apply to files, not directories, and Exclude takes
+	// precedence: a file matching both is skipped.
+	Include []string
+
+	// FollowSymlinks hashes the target of symlinks to files (it is an error
+	// if the target does not exist); otherwise symlinks are skipped.
+	// Symlinks to directories are always skipped.
+	FollowSymlinks bool
+
+	// ExcludeHidden skips the files and directories whose name starts with a
+	// "." (the directories are not walked at all); otherwise they are hashed
+	// like any other file.
+	ExcludeHidden bool
 }
 
 // PopulateDefaults sets the default values for GenerateManifestOptions.
 func (o *GenerateManifestOptions) PopulateDefaults() {
-	// There are no fields with non-empty default values
-	// (but we still want to follow the PopulateDefaults pattern)
+	o.Threads = runtime.NumCPU()
 }
 
 // GenerateManifest generates a manifest containing the files in options.BaseDir
+// The files are hashed concurrently (see options.Threads), and the manifest
+// lists them sorted by name. The ignore files (see IgnoreFileName) are read as
+// the directories are walked, and are not listed themselves.
 // nolint[lll]
 func GenerateManifest(ctx context.Context, options GenerateManifestOptions) (*api.Manifest, error) {
 	manifest := &api.Manifest{}
@@ -53,7 +99,58 @@ func GenerateManifest(ctx context.Context, options GenerateManifestOptions) (*ap
 		basedir += "/"
 	}
 
-	if err := filepath.Walk(basedir, func(p string, info os.FileInfo, err error) error {
+	for _, patterns := range [][]string{options.Exclude, options.Include} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, xerrors.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	threads := options.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	var ignore ignoreMatcher
+
+	// The first hashing error cancels the walk
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mutex   sync.Mutex
+		wg      sync.WaitGroup
+		hashErr error
+	)
+
+	requests := make(chan hashRequest)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				file, err := hashFile(req, options.SHA512)
+
+				mutex.Lock()
+				if err != nil {
+					if hashErr == nil {
+						hashErr = err
+					}
+					cancel()
+				} else {
+					manifest.Files = append(manifest.Files, file)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	walkErr := filepath.Walk(basedir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -61,21 +158,176 @@ func GenerateManifest(ctx context.Context, options GenerateManifestOptions) (*ap
 			return xerrors.Errorf("expected path %q to have prefix %q", p, basedir)
 		}
 
-		if !info.IsDir() {
-			relativePath := strings.TrimPrefix(p, basedir)
-			sha256, err := filepromoter.ComputeSHA256ForFile(p)
+		relativePath := strings.TrimPrefix(p, basedir)
+		if relativePath == "" {
+			// The base directory itself
+			return ignore.load(p, relativePath)
+		}
+
+		hidden := strings.HasPrefix(info.Name(), ".")
+		if (hidden && options.ExcludeHidden) ||
+			matchesAny(options.Exclude, relativePath) ||
+			ignore.match(relativePath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if err := ignore.load(p, relativePath); err != nil {
+				return err
+			}
+		} else if info.Name() == IgnoreFileName {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !options.FollowSymlinks {
+				klog.V(2).Infof("skipping symlink %q", p)
+				return nil
+			}
+
+			target, err := os.Stat(p)
 			if err != nil {
-				return xerrors.Errorf("error hashing file %q: %w", p, err)
+				if os.IsNotExist(err) {
+					return xerrors.Errorf("symlink %q is dangling", p)
+				}
+				return xerrors.Errorf("error resolving symlink %q: %w", p, err)
+			}
+			if target.IsDir() {
+				klog.Warningf("skipping symlink %q to a directory", p)
+				return nil
 			}
-			manifest.Files = append(manifest.Files, api.File{
-				Name:   relativePath,
-				SHA256: sha256,
-			})
+			info = target
+		}
+
+		if info.IsDir() {
+			return nil
 		}
-		return nil
-	}); err != nil {
-		return nil, xerrors.Errorf("error walking path %q: %w", options.BaseDir, err)
+
+		if len(options.Include) != 0 && !matchesAny(options.Include, relativePath) {
+			return nil
+		}
+
+		req := hashRequest{
+			path: p,
+			file: api.File{
+				Name: relativePath,
+				Size: info.Size(),
+			},
+		}
+		select {
+		case requests <- req:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(requests)
+	wg.Wait()
+
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	if walkErr != nil {
+		return nil, xerrors.Errorf("error walking path %q: %w", options.BaseDir, walkErr)
 	}
 
+	// The files are hashed in no particular order
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
 	return manifest, nil
 }
+
+// matchesAny returns true if relativePath matches any of the patterns. See
+// GenerateManifestOptions.Exclude for how the patterns are matched.
+func matchesAny(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		name := relativePath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relativePath)
+		}
+		// The patterns were validated, so Match cannot fail
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreMatcher matches paths against the patterns of the ignore files (see
+// IgnoreFileName) read so far. Directories are walked depth-first, so the
+// patterns of a directory are loaded before its contents are matched, and the
+// patterns of nested directories take precedence, as in git.
+type ignoreMatcher struct {
+	patterns []gitignore.Pattern
+}
+
+// load reads the ignore file in the directory dir (at relativePath from the
+// base directory), if there is one.
+func (m *ignoreMatcher) load(dir, relativePath string) error {
+	p := filepath.Join(dir, IgnoreFileName)
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return xerrors.Errorf("error reading %q: %w", p, err)
+	}
+	defer f.Close()
+
+	var domain []string
+	if relativePath != "" {
+		domain = strings.Split(relativePath, "/")
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		m.patterns = append(m.patterns, gitignore.ParsePattern(line, domain))
+	}
+	if err := scanner.Err(); err != nil {
+		return xerrors.Errorf("error reading %q: %w", p, err)
+	}
+	return nil
+}
+
+// match returns true if relativePath (from the base directory) is ignored.
+func (m *ignoreMatcher) match(relativePath string, isDir bool) bool {
+	if len(m.patterns) == 0 {
+		return false
+	}
+	return gitignore.NewMatcher(m.patterns).Match(
+		strings.Split(relativePath, "/"), isDir)
+}
+
+// hashRequest is a file to be hashed by GenerateManifest.
+type hashRequest struct {
+	// path is the path of the file on disk
+	path string
+	// file is the manifest entry for the file, without the hashes
+	file api.File
+}
+
+// hashFile completes the manifest entry of req with the hashes of the file.
+func hashFile(req hashRequest, withSHA512 bool) (api.File, error) {
+	var err error
+	file := req.file
+	if withSHA512 {
+		file.SHA256, file.SHA512, err =
+			filepromoter.ComputeHashesForFile(req.path)
+	} else {
+		file.SHA256, err = filepromoter.ComputeSHA256ForFile(req.path)
+	}
+	if err != nil {
+		return api.File{}, xerrors.Errorf(
+			"error hashing file %q: %w", req.path, err)
+	}
+	return file, nil
+}
@@ -2,13 +2,19 @@ package cmd_test
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"k8s.io/utils/diff"
 	"sigs.k8s.io/yaml"
 
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/cmd"
 )
 
@@ -33,6 +39,560 @@ func TestHash(t *testing.T) {
 	AssertMatchesFile(t, string(manifestYAML), "testdata/files-manifest.yaml")
 }
 
+func TestHashSHA512(t *testing.T) {
+	ctx := context.Background()
+
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+
+	opt.BaseDir = "testdata/files"
+	opt.SHA512 = true
+
+	manifest, err := cmd.GenerateManifest(ctx, opt)
+	if err != nil {
+		t.Fatalf("failed to generate manifest: %v", err)
+	}
+
+	manifestYAML, err := yaml.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("error serializing manifest: %v", err)
+	}
+
+	AssertMatchesFile(
+		t, string(manifestYAML), "testdata/files-manifest-sha512.yaml")
+}
+
+func TestHashConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 50; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("d%d", i%4), fmt.Sprintf("f%d", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+	}
+
+	var expected *api.Manifest
+	for _, threads := range []int{1, 2, 8, 50} {
+		var opt cmd.GenerateManifestOptions
+		opt.PopulateDefaults()
+
+		opt.BaseDir = dir
+		opt.Threads = threads
+
+		manifest, err := cmd.GenerateManifest(ctx, opt)
+		if err != nil {
+			t.Fatalf("failed to generate manifest: %v", err)
+		}
+
+		if len(manifest.Files) != 50 {
+			t.Errorf("threads=%d: expected 50 files, got %d",
+				threads, len(manifest.Files))
+		}
+		if !sort.SliceIsSorted(manifest.Files, func(i, j int) bool {
+			return manifest.Files[i].Name < manifest.Files[j].Name
+		}) {
+			t.Errorf("threads=%d: files are not sorted", threads)
+		}
+
+		if expected == nil {
+			expected = manifest
+		} else if !reflect.DeepEqual(manifest, expected) {
+			t.Errorf("threads=%d: manifest differs from threads=1", threads)
+		}
+	}
+}
+
+func TestHashError(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+	}
+	// A dangling symlink cannot be followed for hashing
+	broken := filepath.Join(dir, "broken")
+	if err := os.Symlink(filepath.Join(dir, "missing"), broken); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+
+	opt.BaseDir = dir
+	opt.Threads = 4
+	opt.FollowSymlinks = true
+
+	_, err = cmd.GenerateManifest(ctx, opt)
+	if err == nil || !strings.Contains(err.Error(), "is dangling") {
+		t.Errorf("expected a dangling symlink error, got %v", err)
+	}
+}
+
+func TestHashSymlinks(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	content := []byte("hello")
+	p := filepath.Join(dir, "d", "file")
+	if err := ioutil.WriteFile(p, content, 0644); err != nil {
+		t.Fatalf("error writing file %q: %v", p, err)
+	}
+
+	mustSymlink := func(target, name string) {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("error creating symlink %q: %v", name, err)
+		}
+	}
+	mustSymlink("d/file", "link")
+	mustSymlink("d", "dirlink")
+
+	var tests = []struct {
+		name           string
+		followSymlinks bool
+		dangling       bool
+		expected       []string
+		expectedError  string
+	}{
+		{
+			name:     "Symlinks are skipped",
+			expected: []string{"d/file"},
+		},
+		{
+			name:     "Dangling symlinks are skipped",
+			dangling: true,
+			expected: []string{"d/file"},
+		},
+		{
+			name:           "Symlinks are followed",
+			followSymlinks: true,
+			expected:       []string{"d/file", "link"},
+		},
+		{
+			name:           "Dangling symlinks are an error",
+			followSymlinks: true,
+			dangling:       true,
+			expectedError:  "is dangling",
+		},
+	}
+
+	for _, test := range tests {
+		broken := filepath.Join(dir, "broken")
+		if test.dangling {
+			mustSymlink("missing", "broken")
+		}
+
+		var opt cmd.GenerateManifestOptions
+		opt.PopulateDefaults()
+
+		opt.BaseDir = dir
+		opt.FollowSymlinks = test.followSymlinks
+
+		manifest, err := cmd.GenerateManifest(ctx, opt)
+
+		if test.dangling {
+			if err := os.Remove(broken); err != nil {
+				t.Fatalf("error removing symlink: %v", err)
+			}
+		}
+
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to generate manifest: %v", test.name, err)
+			continue
+		}
+
+		var names []string
+		for _, f := range manifest.Files {
+			names = append(names, f.Name)
+			if f.Size != int64(len(content)) {
+				t.Errorf("%s: unexpected size %d for %q",
+					test.name, f.Size, f.Name)
+			}
+			if f.SHA256 != manifest.Files[0].SHA256 {
+				t.Errorf("%s: unexpected sha256 for %q", test.name, f.Name)
+			}
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: expected files %v, got %v",
+				test.name, test.expected, names)
+		}
+	}
+}
+
+func TestHashExcludeInclude(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		".git/HEAD",
+		"a/.git/HEAD",
+		"a/b.txt",
+		"a/c.tmp",
+		"a/keep/d.txt",
+		"a/keep/d.txt~",
+		"build/out.bin",
+		"e.txt",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+	}
+	// Following these dangling symlinks would fail, so pruned directories
+	// must not be walked
+	for _, name := range []string{".git/broken", "a/.git/broken"} {
+		p := filepath.Join(dir, name)
+		if err := os.Symlink(filepath.Join(dir, "missing"), p); err != nil {
+			t.Fatalf("error creating symlink: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		exclude  []string
+		include  []string
+		expected []string
+	}{
+		{
+			name:    "Exclude prunes nested directories",
+			exclude: []string{".git", "*.tmp", "*~", "build"},
+			expected: []string{
+				"a/b.txt",
+				"a/keep/d.txt",
+				"e.txt",
+			},
+		},
+		{
+			name:    "Exclude by relative path",
+			exclude: []string{".git", "a/.git", "a/keep/*", "build/out.bin"},
+			expected: []string{
+				"a/b.txt",
+				"a/c.tmp",
+				"e.txt",
+			},
+		},
+		{
+			name:    "Include is an allowlist of files",
+			exclude: []string{".git"},
+			include: []string{"*.txt"},
+			expected: []string{
+				"a/b.txt",
+				"a/keep/d.txt",
+				"e.txt",
+			},
+		},
+		{
+			name:    "Exclude takes precedence over include",
+			exclude: []string{".git", "b.txt"},
+			include: []string{"*.txt"},
+			expected: []string{
+				"a/keep/d.txt",
+				"e.txt",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var opt cmd.GenerateManifestOptions
+		opt.PopulateDefaults()
+
+		opt.BaseDir = dir
+		opt.Exclude = test.exclude
+		opt.Include = test.include
+		// Pruned directories contain dangling symlinks, which would fail
+		opt.FollowSymlinks = true
+
+		manifest, err := cmd.GenerateManifest(ctx, opt)
+		if err != nil {
+			t.Errorf("%s: failed to generate manifest: %v", test.name, err)
+			continue
+		}
+
+		var names []string
+		for _, f := range manifest.Files {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: expected files %v, got %v",
+				test.name, test.expected, names)
+		}
+	}
+}
+
+func TestHashIgnoreFiles(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".promoterignore": strings.Join([]string{
+			"# Comments and blank lines are skipped",
+			"",
+			"*.tmp",
+			"!keep.tmp",
+			"build/",
+			"/root-only.txt",
+		}, "\n"),
+		"a.txt":         "",
+		"a.tmp":         "",
+		"keep.tmp":      "",
+		"root-only.txt": "",
+		"x.log":         "",
+		"build/out.bin": "",
+		"sub/.promoterignore": strings.Join([]string{
+			"*.log",
+			"!b.tmp",
+		}, "\n"),
+		"sub/b.tmp":         "",
+		"sub/c.tmp":         "",
+		"sub/root-only.txt": "",
+		"sub/x.log":         "",
+		// Only directories match "build/"
+		"sub/build":          "",
+		"sub/deep/build/out": "",
+		"sub/deep/y.log":     "",
+		"other/x.log":        "",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+	}
+	// Following this dangling symlink would fail, so the ignored directory
+	// must not be walked
+	broken := filepath.Join(dir, "build", "broken")
+	if err := os.Symlink(filepath.Join(dir, "missing"), broken); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	var tests = []struct {
+		name     string
+		exclude  []string
+		expected []string
+	}{
+		{
+			name: "Nested ignore files",
+			expected: []string{
+				"a.txt",
+				"keep.tmp",
+				"other/x.log",
+				"sub/b.tmp",
+				"sub/build",
+				"sub/root-only.txt",
+				"x.log",
+			},
+		},
+		{
+			name:    "Ignore files compose with exclude",
+			exclude: []string{"a.txt", "other"},
+			expected: []string{
+				"keep.tmp",
+				"sub/b.tmp",
+				"sub/build",
+				"sub/root-only.txt",
+				"x.log",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var opt cmd.GenerateManifestOptions
+		opt.PopulateDefaults()
+
+		opt.BaseDir = dir
+		opt.Exclude = test.exclude
+		opt.FollowSymlinks = true
+
+		manifest, err := cmd.GenerateManifest(ctx, opt)
+		if err != nil {
+			t.Errorf("%s: failed to generate manifest: %v", test.name, err)
+			continue
+		}
+
+		var names []string
+		for _, f := range manifest.Files {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: expected files %v, got %v",
+				test.name, test.expected, names)
+		}
+	}
+}
+
+func TestHashHidden(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "hash")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		".env",
+		"a.txt",
+		".git/config",
+		"sub/.rc",
+		"sub/b.txt",
+		"sub/.cache/c.txt",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("error writing file %q: %v", p, err)
+		}
+	}
+	// Following this dangling symlink would fail, so a pruned hidden directory
+	// must not be walked
+	broken := filepath.Join(dir, ".git", "broken")
+	if err := os.Symlink(filepath.Join(dir, "missing"), broken); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	var tests = []struct {
+		name          string
+		excludeHidden bool
+		expected      []string
+		expectedError string
+	}{
+		{
+			name:          "Hidden files are included",
+			expectedError: "is dangling",
+		},
+		{
+			name:          "Hidden files and directories are skipped",
+			excludeHidden: true,
+			expected:      []string{"a.txt", "sub/b.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		var opt cmd.GenerateManifestOptions
+		opt.PopulateDefaults()
+
+		opt.BaseDir = dir
+		opt.FollowSymlinks = true
+		opt.ExcludeHidden = test.excludeHidden
+
+		manifest, err := cmd.GenerateManifest(ctx, opt)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to generate manifest: %v", test.name, err)
+			continue
+		}
+
+		var names []string
+		for _, f := range manifest.Files {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: expected files %v, got %v",
+				test.name, test.expected, names)
+		}
+	}
+
+	// Without the dangling symlink, all the hidden files are hashed by
+	// default.
+	if err := os.Remove(broken); err != nil {
+		t.Fatalf("error removing symlink: %v", err)
+	}
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+	opt.BaseDir = dir
+
+	manifest, err := cmd.GenerateManifest(ctx, opt)
+	if err != nil {
+		t.Fatalf("failed to generate manifest: %v", err)
+	}
+	var names []string
+	for _, f := range manifest.Files {
+		names = append(names, f.Name)
+	}
+	expected := []string{
+		".env",
+		".git/config",
+		"a.txt",
+		"sub/.cache/c.txt",
+		"sub/.rc",
+		"sub/b.txt",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected files %v, got %v", expected, names)
+	}
+}
+
+func TestHashInvalidPattern(t *testing.T) {
+	ctx := context.Background()
+
+	var opt cmd.GenerateManifestOptions
+	opt.PopulateDefaults()
+
+	opt.BaseDir = "testdata/files"
+	opt.Exclude = []string{"[bad"}
+
+	_, err := cmd.GenerateManifest(ctx, opt)
+	if err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("expected an invalid pattern error, got %v", err)
+	}
+}
+
 // AssertMatchesFile verifies that the contents of p match actual.
 //
 //  We break this out into a file because we also support the
@@ -25,9 +25,13 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 	"k8s.io/klog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+	"sigs.k8s.io/k8s-container-image-promoter/lib/remotemanifest"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 	"sigs.k8s.io/k8s-container-image-promoter/pkg/filepromoter"
 )
@@ -35,18 +39,77 @@ import (
 // PromoteFilesOptions holds the flag-values for a file promotion
 type PromoteFilesOptions struct {
 	// FilestoresPath is the path to the manifest file containing the filestores section
+	// It can also be a remote location (see remotemanifest.Download).
 	FilestoresPath string
 
 	// FilesPath specifies a path to manifest files containing the files section.
+	// It can also be a remote location (see remotemanifest.Download).
 	FilesPath string
 
-	// DryRun (if set) will not perform operations, but print them instead
+	// DryRun (if set) will not perform operations, but print the plan
+	// instead: what would happen (upload, skip or delete) to every file, in
+	// every destination
 	DryRun bool
 
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
 
+	// Workers is the number of files to upload concurrently
+	Workers int
+
+	// Force (if set) copies all files, even if they already exist in the destination
+	Force bool
+
+	// Prune (if set) deletes the files of the destinations that are not in
+	// the manifest, so that they mirror it exactly
+	Prune bool
+
+	// ContentTypes maps file extensions (e.g. ".html") to the content type
+	// that uploaded files with them get, instead of the detected one
+	ContentTypes map[string]string
+
+	// GzipExtensions lists the extensions (e.g. ".txt") of the files that are
+	// uploaded gzip-compressed, with a "gzip" content encoding
+	GzipExtensions []string
+
+	// SniffContentType (if set) detects the content type of files with unknown
+	// extensions from their contents
+	SniffContentType bool
+
+	// MaxTotalFileSize (if greater than 0) is the max total size, in MiB, of
+	// the files to upload; the promotion fails before uploading anything if
+	// they are larger
+	MaxTotalFileSize int64
+
+	// UploadRetries is the number of times an upload that fails with a
+	// transient error is retried, before the file is reported as failed
+	UploadRetries int
+
+	// UploadRetryBaseDelay is the delay before the first retry of an upload;
+	// it doubles with every retry
+	UploadRetryBaseDelay time.Duration
+
+	// VerifyReadBack (if set) downloads every uploaded file again, and fails
+	// its promotion if its sha256 does not match the manifest. It costs as
+	// much egress as the uploads
+	VerifyReadBack bool
+
+	// ManifestVerifyKey (if set) is the public key (a PEM file, or a cosign
+	// key reference such as a KMS key) with which the signature of the files
+	// manifest is verified; nothing is promoted if it is not valid
+	ManifestVerifyKey string
+
+	// ManifestSignaturePath is the path to the detached signature of the
+	// files manifest (see CosignSignBlob). It defaults to FilesPath with a
+	// ".sig" suffix, and can also be a remote location
+	ManifestSignaturePath string
+
+	// AuditLogPath (if set) is the file to which every upload (and deletion)
+	// is appended, as a line of JSON (see auditlog.Entry), as soon as it is
+	// done. Nothing is recorded in dry runs
+	AuditLogPath string
+
 	// Out is the destination for "normal" output (such as dry-run)
 	Out io.Writer
 }
@@ -55,6 +118,9 @@ type PromoteFilesOptions struct {
 func (o *PromoteFilesOptions) PopulateDefaults() {
 	o.DryRun = true
 	o.UseServiceAccount = false
+	o.Workers = 4
+	o.UploadRetries = filepromoter.DefaultUploadRetries
+	o.UploadRetryBaseDelay = filepromoter.DefaultUploadRetryBaseDelay
 	o.Out = os.Stdout
 }
 
@@ -79,6 +145,20 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 	promoter := &filepromoter.ManifestPromoter{
 		Manifest:          manifest,
 		UseServiceAccount: options.UseServiceAccount,
+		Force:             options.Force,
+		ContentTypes: filepromoter.ContentTypeRules{
+			Overrides: options.ContentTypes,
+			Sniff:     options.SniffContentType,
+		},
+		Compression: filepromoter.CompressionRules{
+			Gzip: options.GzipExtensions,
+		},
+		Retry: filepromoter.RetryPolicy{
+			MaxRetries: options.UploadRetries,
+			BaseDelay:  options.UploadRetryBaseDelay,
+		},
+		VerifyReadBack: options.VerifyReadBack,
+		Prune:          options.Prune,
 	}
 
 	ops, err := promoter.BuildOperations(ctx)
@@ -88,22 +168,46 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 			err)
 	}
 
-	// So that we can support future parallel execution, an error
-	// in one operation does not prevent us attempting the
+	if err := filepromoter.CheckTotalFileSize(
+		ops, options.MaxTotalFileSize); err != nil {
+		return err
+	}
+
+	// An error in one operation does not prevent us attempting the
 	// remaining operations
 	var errors []error
-	for _, op := range ops {
-		if _, err := fmt.Fprintf(options.Out, "%v\n", op); err != nil {
-			errors = append(errors, fmt.Errorf(
-				"error writing to output: %v", err))
+	if options.DryRun {
+		if err := filepromoter.WritePlan(
+			options.Out, promoter.Plan); err != nil {
+			errors = append(errors, err)
 		}
+	} else {
+		var audit *auditlog.Log
+		if options.AuditLogPath != "" {
+			audit, err = auditlog.Open(options.AuditLogPath)
+			if err != nil {
+				return err
+			}
+		}
+		ops = filepromoter.AuditOperations(ops, audit, options.FilesPath)
+
+		results := filepromoter.RunOperations(ctx, ops, options.Workers)
+		for _, result := range results {
+			if _, err := fmt.Fprintf(options.Out, "%v\n", result.Op); err != nil {
+				errors = append(errors, fmt.Errorf(
+					"error writing to output: %v", err))
+			}
 
-		if !options.DryRun {
-			if err := op.Run(ctx); err != nil {
-				klog.Warningf("error copying file: %v", err)
-				errors = append(errors, err)
+			if result.Err != nil {
+				klog.Warningf("error copying file: %v", result.Err)
+				errors = append(errors, result.Err)
 			}
 		}
+
+		if err := audit.Close(); err != nil {
+			errors = append(errors, fmt.Errorf(
+				"error writing audit log: %v", err))
+		}
 	}
 
 	if len(errors) != 0 {
@@ -117,6 +221,25 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 		return errors[0]
 	}
 
+	uploaded := len(ops) - promoter.Pruned
+	if options.DryRun {
+		fmt.Fprintf(
+			options.Out,
+			"%d files to upload, %d skipped (already present)\n",
+			uploaded, promoter.Skipped)
+		if options.Prune {
+			fmt.Fprintf(options.Out, "%d files to delete\n", promoter.Pruned)
+		}
+	} else {
+		fmt.Fprintf(
+			options.Out,
+			"%d files uploaded, %d skipped (already present)\n",
+			uploaded, promoter.Skipped)
+		if options.Prune {
+			fmt.Fprintf(options.Out, "%d files deleted\n", promoter.Pruned)
+		}
+	}
+
 	if options.DryRun {
 		fmt.Fprintf(
 			options.Out,
@@ -130,17 +253,71 @@ func RunPromoteFiles(ctx context.Context, options PromoteFilesOptions) error {
 	return nil
 }
 
-// ReadManifest reads a manifest.
+// ParseContentTypes parses a comma-separated list of "<extension>=<content
+// type>" overrides (e.g. ".html=text/html,.sig=text/plain") for
+// PromoteFilesOptions.ContentTypes.
+func ParseContentTypes(s string) (map[string]string, error) {
+	contentTypes := make(map[string]string)
+	if s == "" {
+		return contentTypes, nil
+	}
+
+	for _, override := range strings.Split(s, ",") {
+		kv := strings.SplitN(override, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf(
+				"invalid content type override %q "+
+					"(expected <extension>=<content type>)",
+				override)
+		}
+		contentTypes[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return contentTypes, nil
+}
+
+// ParseExtensions parses a comma-separated list of file extensions (e.g.
+// ".txt,.html"), for PromoteFilesOptions.GzipExtensions.
+func ParseExtensions(s string) []string {
+	var extensions []string
+	for _, ext := range strings.Split(s, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// ReadManifest reads a manifest. Remote manifests are downloaded to a
+// temporary directory first.
 func ReadManifest(options PromoteFilesOptions) (*api.Manifest, error) {
 	merged := &api.Manifest{}
 
-	filestores, err := readFilestores(options.FilestoresPath)
+	filestoresPath, cleanup, err := remotemanifest.Download(options.FilestoresPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	filestores, err := readFilestores(filestoresPath)
 	if err != nil {
 		return nil, err
 	}
 	merged.Filestores = filestores
 
-	files, err := readFiles(options.FilesPath)
+	filesPath, cleanup, err := remotemanifest.Download(options.FilesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if options.ManifestVerifyKey != "" {
+		if err := verifyFilesSignature(options, filesPath); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := readFiles(filesPath)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +331,55 @@ func ReadManifest(options PromoteFilesOptions) (*api.Manifest, error) {
 	return merged, nil
 }
 
+// verifyFilesSignature verifies the signature of the files manifest
+// (downloaded to filesPath) with options.ManifestVerifyKey.
+func verifyFilesSignature(options PromoteFilesOptions, filesPath string) error {
+	info, err := os.Stat(filesPath)
+	if err != nil {
+		return xerrors.Errorf("error reading manifest %q: %w", filesPath, err)
+	}
+	if info.IsDir() {
+		return xerrors.Errorf(
+			"cannot verify the signature of manifest directory %q; "+
+				"signed manifests must be a single file",
+			options.FilesPath)
+	}
+
+	sigPath := options.ManifestSignaturePath
+	if sigPath == "" {
+		sigPath = signaturePath(options.FilesPath)
+	}
+	localSigPath, cleanup, err := remotemanifest.Download(sigPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := VerifyManifestSignature(
+		context.Background(),
+		filesPath,
+		localSigPath,
+		options.ManifestVerifyKey); err != nil {
+		return err
+	}
+
+	klog.Infof("verified the signature %q of manifest %q",
+		sigPath, options.FilesPath)
+	return nil
+}
+
+// signaturePath returns the default location of the signature of the
+// manifest at the given location: the same path, with a ".sig" suffix (before
+// the "?ref=" of Git locations).
+func signaturePath(location string) string {
+	if strings.HasPrefix(location, remotemanifest.GitPrefix) {
+		if i := strings.Index(location, "?"); i >= 0 {
+			return location[:i] + SignatureSuffix + location[i:]
+		}
+	}
+	return location + SignatureSuffix
+}
+
 // readFilestores reads a filestores manifest
 func readFilestores(p string) ([]api.Filestore, error) {
 	if p == "" {
@@ -17,6 +17,8 @@ limitations under the License.
 package cmd_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"sigs.k8s.io/yaml"
@@ -62,3 +64,33 @@ func TestReadManifests(t *testing.T) {
 		})
 	}
 }
+
+func TestReadRemoteManifests(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	options := cmd.PromoteFilesOptions{
+		FilestoresPath: server.URL + "/manifests/onefiles/filestores.yaml",
+		FilesPath:      server.URL + "/manifests/onefiles/files.yaml",
+	}
+
+	manifest, err := cmd.ReadManifest(options)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+
+	manifestYAML, err := yaml.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("error serializing manifest: %v", err)
+	}
+
+	AssertMatchesFile(
+		t,
+		string(manifestYAML),
+		"testdata/manifests/onefiles/expected.yaml")
+
+	options.FilesPath = server.URL + "/manifests/onefiles/missing.yaml"
+	if _, err := cmd.ReadManifest(options); err == nil {
+		t.Errorf("expected an error reading a missing remote manifest")
+	}
+}
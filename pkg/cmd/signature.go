@@ -0,0 +1,175 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// SignatureSuffix is appended to the path of a files manifest to find its
+// detached signature, unless another path is given.
+const SignatureSuffix = ".sig"
+
+// CosignSignBlob signs the serialized manifest with cosign ("cosign
+// sign-blob"), and returns the detached signature (base64-encoded, as cosign
+// writes it). The key is a cosign key reference: the path of a private key,
+// or a KMS key such as "gcpkms://projects/<project>/locations/<location>/
+// keyRings/<ring>/cryptoKeys/<key>".
+func CosignSignBlob(
+	ctx context.Context,
+	manifest []byte,
+	key string) ([]byte, error) {
+
+	dir, err := ioutil.TempDir("", "promobot-sign")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	if err := ioutil.WriteFile(manifestPath, manifest, 0600); err != nil {
+		return nil, err
+	}
+	sigPath := manifestPath + SignatureSuffix
+
+	if err := runCosign(ctx,
+		"sign-blob",
+		"--key", key,
+		"--output-signature", sigPath,
+		"--yes",
+		manifestPath); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(sigPath)
+}
+
+// VerifyManifestSignature checks that sig is a valid detached signature of
+// the manifest file at manifestPath (as made by CosignSignBlob) for the
+// given public key. Keys in PEM files (like those of "cosign
+// generate-key-pair") are verified directly; other key references (such as
+// KMS keys) are verified with "cosign verify-blob".
+func VerifyManifestSignature(
+	ctx context.Context,
+	manifestPath string,
+	sigPath string,
+	key string) error {
+
+	if strings.Contains(key, "://") {
+		return runCosign(ctx,
+			"verify-blob",
+			"--key", key,
+			"--signature", sigPath,
+			manifestPath)
+	}
+
+	manifest, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return xerrors.Errorf(
+			"error reading manifest %q: %w", manifestPath, err)
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return xerrors.Errorf("error reading signature %q: %w", sigPath, err)
+	}
+	pub, err := readPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyBlob(manifest, sig, pub); err != nil {
+		return xerrors.Errorf(
+			"invalid signature %q of manifest %q: %w",
+			sigPath, manifestPath, err)
+	}
+	return nil
+}
+
+// readPublicKey reads an ECDSA public key from a PEM file.
+func readPublicKey(path string) (*ecdsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("error reading public key %q: %w", path, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, xerrors.Errorf("no PEM data in public key %q", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing public key %q: %w", path, err)
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, xerrors.Errorf(
+			"unsupported public key %q: %T (only ECDSA keys are supported)",
+			path, key)
+	}
+	return pub, nil
+}
+
+// ecdsaSignature is the ASN.1 encoding of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifyBlob verifies the base64-encoded ECDSA signature (over the SHA256
+// hash) of blob.
+func verifyBlob(blob, sig []byte, pub *ecdsa.PublicKey) error {
+	der, err := base64.StdEncoding.DecodeString(
+		string(bytes.TrimSpace(sig)))
+	if err != nil {
+		return xerrors.Errorf("error decoding signature: %w", err)
+	}
+	var rs ecdsaSignature
+	if _, err := asn1.Unmarshal(der, &rs); err != nil {
+		return xerrors.Errorf("error parsing signature: %w", err)
+	}
+
+	digest := sha256.Sum256(blob)
+	if !ecdsa.Verify(pub, digest[:], rs.R, rs.S) {
+		return xerrors.New("signature does not match")
+	}
+	return nil
+}
+
+// runCosign runs cosign with the given arguments. Its output is included in
+// the error if it fails.
+func runCosign(ctx context.Context, args ...string) error {
+	// nolint[gosec]
+	out, err := exec.CommandContext(ctx, "cosign", args...).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf(
+			"cosign %s failed: %w: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
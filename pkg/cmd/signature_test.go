@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/cmd"
+)
+
+// signBlob signs blob like "cosign sign-blob" does.
+func signBlob(t *testing.T, key *ecdsa.PrivateKey, blob []byte) []byte {
+	digest := sha256.Sum256(blob)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatalf("error encoding signature: %v", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(der))
+}
+
+// writePublicKey writes the public key of key as a PEM file in dir.
+func writePublicKey(t *testing.T, dir string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error encoding public key: %v", err)
+	}
+	p := filepath.Join(dir, "cosign.pub")
+	b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatalf("error writing public key: %v", err)
+	}
+	return p
+}
+
+func TestReadSignedManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	pubPath := writePublicKey(t, dir, key)
+
+	files, err := ioutil.ReadFile("testdata/manifests/onefiles/files.yaml")
+	if err != nil {
+		t.Fatalf("error reading manifest: %v", err)
+	}
+	filesPath := filepath.Join(dir, "files.yaml")
+	if err := ioutil.WriteFile(filesPath, files, 0644); err != nil {
+		t.Fatalf("error writing manifest: %v", err)
+	}
+
+	writeSignature := func(p string, sig []byte) {
+		if err := ioutil.WriteFile(p, sig, 0644); err != nil {
+			t.Fatalf("error writing signature: %v", err)
+		}
+	}
+	writeSignature(filesPath+cmd.SignatureSuffix, signBlob(t, key, files))
+	otherSigPath := filepath.Join(dir, "other.sig")
+	writeSignature(otherSigPath, signBlob(t, otherKey, files))
+
+	tamperedPath := filepath.Join(dir, "tampered.yaml")
+	tampered := bytes.Replace(files, []byte("905fef"), []byte("805fef"), 1)
+	if err := ioutil.WriteFile(tamperedPath, tampered, 0644); err != nil {
+		t.Fatalf("error writing manifest: %v", err)
+	}
+
+	grid := []struct {
+		name                  string
+		filesPath             string
+		manifestSignaturePath string
+		expectError           bool
+	}{
+		{
+			name:      "valid signature",
+			filesPath: filesPath,
+		},
+		{
+			name:                  "tampered manifest",
+			filesPath:             tamperedPath,
+			manifestSignaturePath: filesPath + cmd.SignatureSuffix,
+			expectError:           true,
+		},
+		{
+			name:                  "signed with another key",
+			filesPath:             filesPath,
+			manifestSignaturePath: otherSigPath,
+			expectError:           true,
+		},
+		{
+			name:        "missing signature",
+			filesPath:   tamperedPath,
+			expectError: true,
+		},
+		{
+			name:        "manifest directory",
+			filesPath:   "testdata/manifests/manyfiles/files/",
+			expectError: true,
+		},
+	}
+
+	for _, g := range grid {
+		g := g // avoid closure go-tcha
+		t.Run(g.name, func(t *testing.T) {
+			options := cmd.PromoteFilesOptions{
+				FilestoresPath:        "testdata/manifests/onefiles/filestores.yaml",
+				FilesPath:             g.filesPath,
+				ManifestVerifyKey:     pubPath,
+				ManifestSignaturePath: g.manifestSignaturePath,
+			}
+
+			_, err := cmd.ReadManifest(options)
+			if g.expectError && err == nil {
+				t.Fatalf("expected an error verifying the manifest signature")
+			}
+			if !g.expectError && err != nil {
+				t.Fatalf("failed to read signed manifest: %v", err)
+			}
+		})
+	}
+
+	// A manifest that fails verification is never promoted.
+	var out bytes.Buffer
+	options := cmd.PromoteFilesOptions{
+		FilestoresPath:        "testdata/manifests/onefiles/filestores.yaml",
+		FilesPath:             tamperedPath,
+		ManifestVerifyKey:     pubPath,
+		ManifestSignaturePath: filesPath + cmd.SignatureSuffix,
+		DryRun:                true,
+		Out:                   &out,
+	}
+	if err := cmd.RunPromoteFiles(context.Background(), options); err == nil {
+		t.Errorf("expected promotion of a tampered manifest to fail")
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be promoted, got output %q", out.String())
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+)
+
+// auditable is implemented by the SyncFileOps that change a filestore, which
+// describe their change as an audit log entry (without a result).
+type auditable interface {
+	auditEntry() auditlog.Entry
+}
+
+// auditEntry implements auditable.
+func (o *copyFileOp) auditEntry() auditlog.Entry {
+	return auditlog.Entry{
+		Kind:        auditlog.KindFile,
+		Operation:   auditlog.OperationCopy,
+		Source:      o.Source.AbsolutePath,
+		Destination: o.Dest.AbsolutePath,
+		Digest:      "sha256:" + o.ManifestFile.SHA256,
+	}
+}
+
+// auditEntry implements auditable.
+func (o *deleteFileOp) auditEntry() auditlog.Entry {
+	return auditlog.Entry{
+		Kind:        auditlog.KindFile,
+		Operation:   auditlog.OperationDelete,
+		Destination: o.Dest.AbsolutePath,
+	}
+}
+
+// auditedOp is a SyncFileOp that records its outcome in an audit log.
+type auditedOp struct {
+	op       SyncFileOp
+	log      *auditlog.Log
+	manifest string
+}
+
+// AuditOperations returns the ops, where the ones that change a filestore
+// record their outcome in log as soon as they are run. manifest is the
+// manifest that declared the ops. If log is nil, the ops are returned as is.
+func AuditOperations(
+	ops []SyncFileOp,
+	log *auditlog.Log,
+	manifest string) []SyncFileOp {
+
+	if log == nil {
+		return ops
+	}
+	audited := make([]SyncFileOp, 0, len(ops))
+	for _, op := range ops {
+		if _, ok := op.(auditable); ok {
+			op = &auditedOp{op: op, log: log, manifest: manifest}
+		}
+		audited = append(audited, op)
+	}
+	return audited
+}
+
+// Run implements SyncFileOp.Run
+func (o *auditedOp) Run(ctx context.Context) error {
+	err := o.op.Run(ctx)
+
+	e := o.op.(auditable).auditEntry()
+	e.Manifest = o.manifest
+	e.Result = auditlog.ResultSuccess
+	if err != nil {
+		e.Result = auditlog.ResultFailure
+		e.Error = err.Error()
+	}
+	o.log.Record(e)
+
+	return err
+}
+
+// String is the pretty-printer of the wrapped operation.
+func (o *auditedOp) String() string {
+	return fmt.Sprint(o.op)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestAuditOperations(t *testing.T) {
+	client := newFakeS3Client()
+	client.objects["src/files/good.txt"] = []byte("good")
+	client.objects["src/files/stale.txt"] = []byte("changed")
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	goodSHA256, _ := ComputeSHA256(strings.NewReader("good"))
+	staleSHA256, _ := ComputeSHA256(strings.NewReader("stale"))
+
+	var ops []SyncFileOp
+	for _, f := range []api.File{
+		{Name: "good.txt", SHA256: goodSHA256},
+		{Name: "stale.txt", SHA256: staleSHA256},
+	} {
+		f := f
+		ops = append(ops, &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: f.Name,
+				AbsolutePath: "s3://src/files/" + f.Name,
+				filestore:    src,
+			},
+			Dest: &syncFileInfo{
+				RelativePath: f.Name,
+				AbsolutePath: "s3://dest/release/" + f.Name,
+				filestore:    dest,
+			},
+			ManifestFile: &f,
+		})
+	}
+
+	// Without a log, the ops are left alone.
+	if got := AuditOperations(ops, nil, "files.yaml"); &got[0] != &ops[0] {
+		t.Errorf("expected the ops to be returned as is")
+	}
+
+	var out bytes.Buffer
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	log := &auditlog.Log{
+		Out: &out,
+		Now: func() time.Time { return now },
+	}
+	audited := AuditOperations(ops, log, "files.yaml")
+	// Run one op at a time, for determinism.
+	results := RunOperations(context.Background(), audited, 1)
+
+	// The audited ops print like the ops they wrap.
+	for i, result := range results {
+		if got := fmt.Sprint(result.Op); !strings.HasPrefix(got, "COPY ") {
+			t.Errorf("result %d: unexpected op %q", i, got)
+		}
+	}
+
+	changedSHA256, _ := ComputeSHA256(strings.NewReader("changed"))
+	expected := []auditlog.Entry{
+		{
+			Time:        now,
+			Kind:        "file",
+			Operation:   "copy",
+			Source:      "s3://src/files/good.txt",
+			Destination: "s3://dest/release/good.txt",
+			Digest:      "sha256:" + goodSHA256,
+			Result:      "success",
+			Manifest:    "files.yaml",
+		},
+		{
+			Time:        now,
+			Kind:        "file",
+			Operation:   "copy",
+			Source:      "s3://src/files/stale.txt",
+			Destination: "s3://dest/release/stale.txt",
+			Digest:      "sha256:" + staleSHA256,
+			Result:      "failure",
+			Error: fmt.Sprintf(
+				"sha256 did not match for file %q: actual=%q expected=%q "+
+					"(is the manifest entry for %q stale?)",
+				"s3://src/files/stale.txt",
+				changedSHA256,
+				staleSHA256,
+				"stale.txt"),
+			Manifest: "files.yaml",
+		},
+	}
+
+	var got []auditlog.Entry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e auditlog.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid audit log line %q: %v", line, err)
+		}
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected audit log entries %+v, got %+v", expected, got)
+	}
+}
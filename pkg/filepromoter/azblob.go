@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/azure"
+)
+
+// azureBlobClient is the set of Azure Blob Storage operations used by
+// azblobSyncFilestore. It is implemented by azure.BlobCLI, and faked in tests.
+type azureBlobClient interface {
+	ListBlobs(
+		ctx context.Context,
+		account, container, prefix string) ([]azure.Blob, error)
+	OpenBlob(
+		ctx context.Context,
+		account, container, name string) (io.ReadCloser, error)
+	UploadBlob(
+		ctx context.Context,
+		account, container, name, localFile, contentType string) error
+	DeleteBlob(
+		ctx context.Context,
+		account, container, name string) error
+}
+
+type azblobSyncFilestore struct {
+	filestore *api.Filestore
+	client    azureBlobClient
+	account   string
+	container string
+	prefix    string
+}
+
+// openAzblobFilestore opens a filestore for the
+// azblob://account/container/prefix URL u. Credentials are resolved by the
+// client (for azure.BlobCLI, by the az CLI), so the service-account of the
+// filestore is not used.
+func openAzblobFilestore(
+	filestore *api.Filestore,
+	u *url.URL,
+	client azureBlobClient) (syncFilestore, error) {
+
+	if filestore.ServiceAccount != "" {
+		klog.Warningf(
+			"ignoring service-account %q for Azure Blob filestore %q",
+			filestore.ServiceAccount, filestore.Base)
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	container := path
+	prefix := ""
+	if i := strings.Index(path, "/"); i != -1 {
+		container = path[:i]
+		prefix = path[i+1:]
+	}
+	if u.Host == "" || container == "" {
+		return nil, fmt.Errorf(
+			"filestore base %q must be of the form "+
+				"azblob://account/container[/prefix]",
+			filestore.Base)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	s := &azblobSyncFilestore{
+		filestore: filestore,
+		client:    client,
+		account:   u.Host,
+		container: container,
+		prefix:    prefix,
+	}
+	return s, nil
+}
+
+// url returns the azblob:// URL of the blob with the given absolute path.
+func (s *azblobSyncFilestore) url(absolutePath string) string {
+	return "azblob://" + s.account + "/" + s.container + "/" + absolutePath
+}
+
+// OpenReader opens an io.ReadCloser for the specified file.
+func (s *azblobSyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	absolutePath := s.prefix + name
+	return s.client.OpenBlob(ctx, s.account, s.container, absolutePath)
+}
+
+// UploadFile uploads a local file to the specified destination.
+func (s *azblobSyncFilestore) UploadFile(
+	ctx context.Context,
+	dest string,
+	localFile string,
+	contentType string) error {
+	absolutePath := s.prefix + dest
+
+	blobURL := s.url(absolutePath)
+
+	klog.Infof("uploading to %s", blobURL)
+	if err := s.client.UploadBlob(
+		ctx, s.account, s.container, absolutePath, localFile,
+		contentType); err != nil {
+		return fmt.Errorf("error uploading to %q: %v", blobURL, err)
+	}
+
+	return nil
+}
+
+// DeleteFile implements syncFileDeleter.
+func (s *azblobSyncFilestore) DeleteFile(
+	ctx context.Context,
+	name string) error {
+	absolutePath := s.prefix + name
+
+	blobURL := s.url(absolutePath)
+
+	klog.Infof("deleting %s", blobURL)
+	if err := s.client.DeleteBlob(
+		ctx, s.account, s.container, absolutePath); err != nil {
+		return fmt.Errorf("error deleting %q: %v", blobURL, err)
+	}
+
+	return nil
+}
+
+// VerifyFile reads back the uploaded file and checks its sha256, as Azure
+// Blob Storage does not record SHA256 checksums itself.
+func (s *azblobSyncFilestore) VerifyFile(
+	ctx context.Context,
+	dest string,
+	sha256sum string) error {
+	absolutePath := s.prefix + dest
+
+	blobURL := s.url(absolutePath)
+
+	in, err := s.OpenReader(ctx, dest)
+	if err != nil {
+		return fmt.Errorf("error verifying %q: %v", blobURL, err)
+	}
+	defer in.Close()
+
+	actual, err := ComputeSHA256(in)
+	if err != nil {
+		return fmt.Errorf("error hashing %q: %v", blobURL, err)
+	}
+
+	if actual != sha256sum {
+		return fmt.Errorf(
+			"sha256 did not match for uploaded file %q: actual=%q expected=%q",
+			blobURL, actual, sha256sum)
+	}
+
+	return nil
+}
+
+// ListFiles returns all the file artifacts in the filestore, recursively.
+func (s *azblobSyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	files := make(map[string]*syncFileInfo)
+
+	klog.Infof("listing files in container %s/%s with prefix %q",
+		s.account, s.container, s.prefix)
+	blobs, err := s.client.ListBlobs(ctx, s.account, s.container, s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing blobs in %q: %v",
+			s.filestore.Base, err)
+	}
+
+	for _, blob := range blobs {
+		name := blob.Name
+		if !strings.HasPrefix(name, s.prefix) {
+			return nil, fmt.Errorf(
+				"found blob %q without prefix %q",
+				name, s.prefix)
+		}
+
+		file := &syncFileInfo{}
+		file.AbsolutePath = s.url(name)
+		file.RelativePath = strings.TrimPrefix(name, s.prefix)
+		// Blobs without an MD5 never match, and so are re-copied.
+		file.MD5 = blob.MD5
+		file.Size = blob.Size
+		file.filestore = s
+		files[file.RelativePath] = file
+	}
+
+	return files, nil
+}
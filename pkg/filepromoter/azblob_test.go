@@ -0,0 +1,298 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/azure"
+)
+
+// fakeAzureBlobClient is an in-memory azureBlobClient, keyed by
+// "account/container/name".
+type fakeAzureBlobClient struct {
+	blobs map[string][]byte
+
+	// contentTypes maps the uploaded blobs to their content type.
+	contentTypes map[string]string
+
+	// corruptUploads makes uploads store different content.
+	corruptUploads bool
+}
+
+func newFakeAzureBlobClient() *fakeAzureBlobClient {
+	return &fakeAzureBlobClient{
+		blobs:        make(map[string][]byte),
+		contentTypes: make(map[string]string),
+	}
+}
+
+func (c *fakeAzureBlobClient) ListBlobs(
+	ctx context.Context,
+	account, container, prefix string) ([]azure.Blob, error) {
+	var blobs []azure.Blob
+	root := account + "/" + container + "/"
+	for k, data := range c.blobs {
+		if !strings.HasPrefix(k, root+prefix) {
+			continue
+		}
+		md5sum := md5.Sum(data)
+		blobs = append(blobs, azure.Blob{
+			Name: strings.TrimPrefix(k, root),
+			Size: int64(len(data)),
+			MD5:  hex.EncodeToString(md5sum[:]),
+		})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, nil
+}
+
+func (c *fakeAzureBlobClient) OpenBlob(
+	ctx context.Context,
+	account, container, name string) (io.ReadCloser, error) {
+	data, ok := c.blobs[account+"/"+container+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("BlobNotFound: %s/%s/%s",
+			account, container, name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *fakeAzureBlobClient) UploadBlob(
+	ctx context.Context,
+	account, container, name, localFile, contentType string) error {
+	data, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	if c.corruptUploads {
+		data = append(data, '!')
+	}
+	c.blobs[account+"/"+container+"/"+name] = data
+	c.contentTypes[account+"/"+container+"/"+name] = contentType
+	return nil
+}
+
+func (c *fakeAzureBlobClient) DeleteBlob(
+	ctx context.Context,
+	account, container, name string) error {
+	if _, ok := c.blobs[account+"/"+container+"/"+name]; !ok {
+		return fmt.Errorf("BlobNotFound: %s/%s/%s", account, container, name)
+	}
+	delete(c.blobs, account+"/"+container+"/"+name)
+	return nil
+}
+
+func mustOpenAzblobFilestore(
+	t *testing.T,
+	base string,
+	client azureBlobClient) *azblobSyncFilestore {
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("error parsing %q: %v", base, err)
+	}
+	s, err := openAzblobFilestore(&api.Filestore{Base: base}, u, client)
+	if err != nil {
+		t.Fatalf("error opening %q: %v", base, err)
+	}
+	return s.(*azblobSyncFilestore)
+}
+
+func TestOpenAzblobFilestore(t *testing.T) {
+	var tests = []struct {
+		base      string
+		account   string
+		container string
+		prefix    string
+		expectErr bool
+	}{
+		{
+			base:      "azblob://account/container",
+			account:   "account",
+			container: "container",
+		},
+		{
+			base:      "azblob://account/container/some/prefix",
+			account:   "account",
+			container: "container",
+			prefix:    "some/prefix/",
+		},
+		{
+			base:      "azblob://account",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.base)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", test.base, err)
+		}
+		s, err := openAzblobFilestore(
+			&api.Filestore{Base: test.base}, u, newFakeAzureBlobClient())
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.base)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.base, err)
+			continue
+		}
+		got := s.(*azblobSyncFilestore)
+		if got.account != test.account ||
+			got.container != test.container ||
+			got.prefix != test.prefix {
+			t.Errorf("%s: unexpected account %q, container %q and prefix %q",
+				test.base, got.account, got.container, got.prefix)
+		}
+	}
+}
+
+func TestAzblobListFiles(t *testing.T) {
+	client := newFakeAzureBlobClient()
+	client.blobs["account/container/prefix/a.txt"] = []byte("a")
+	client.blobs["account/container/prefix/dir/b.txt"] = []byte("bb")
+	client.blobs["account/container/other/c.txt"] = []byte("ccc")
+	client.blobs["account/other/prefix/d.txt"] = []byte("dddd")
+
+	s := mustOpenAzblobFilestore(t, "azblob://account/container/prefix", client)
+
+	files, err := s.ListFiles(context.Background())
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+
+	var tests = []struct {
+		relativePath string
+		absolutePath string
+		size         int64
+	}{
+		{"a.txt", "azblob://account/container/prefix/a.txt", 1},
+		{"dir/b.txt", "azblob://account/container/prefix/dir/b.txt", 2},
+	}
+	if len(files) != len(tests) {
+		t.Errorf("expected %d files, got %d", len(tests), len(files))
+	}
+	for _, test := range tests {
+		file := files[test.relativePath]
+		if file == nil {
+			t.Errorf("file %q not listed", test.relativePath)
+			continue
+		}
+		if file.AbsolutePath != test.absolutePath {
+			t.Errorf("unexpected absolute path %q for %q",
+				file.AbsolutePath, test.relativePath)
+		}
+		if file.Size != test.size {
+			t.Errorf("unexpected size %d for %q", file.Size, test.relativePath)
+		}
+		if file.MD5 == "" {
+			t.Errorf("MD5 not set for %q", test.relativePath)
+		}
+	}
+}
+
+func TestAzblobCopyFileOp(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	oksha := hex.EncodeToString(sum[:])
+
+	var tests = []struct {
+		name           string
+		sha256         string
+		corruptUploads bool
+		expectedError  string
+	}{
+		{
+			name:   "Copy and verify",
+			sha256: oksha,
+		},
+		{
+			name:          "Source does not match the manifest",
+			sha256:        strings.Repeat("0", 64),
+			expectedError: "sha256 did not match for file",
+		},
+		{
+			name:           "Upload does not match the manifest",
+			sha256:         oksha,
+			corruptUploads: true,
+			expectedError:  "sha256 did not match for uploaded file",
+		},
+	}
+
+	for _, test := range tests {
+		client := newFakeAzureBlobClient()
+		client.blobs["account/src/files/hello.txt"] = content
+		client.corruptUploads = test.corruptUploads
+
+		src := mustOpenAzblobFilestore(t, "azblob://account/src/files", client)
+		dest := mustOpenAzblobFilestore(
+			t, "azblob://account/dest/release", client)
+
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: "hello.txt",
+				AbsolutePath: "azblob://account/src/files/hello.txt",
+				filestore:    src,
+			},
+			Dest: &syncFileInfo{
+				RelativePath: "hello.txt",
+				AbsolutePath: "azblob://account/dest/release/hello.txt",
+				filestore:    dest,
+			},
+			ManifestFile: &api.File{Name: "hello.txt", SHA256: test.sha256},
+		}
+
+		err := op.Run(context.Background())
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			uploaded := client.blobs["account/dest/release/hello.txt"]
+			if !bytes.Equal(uploaded, content) {
+				t.Errorf("%s: file was not copied", test.name)
+			}
+			contentType := client.contentTypes["account/dest/release/hello.txt"]
+			if contentType != "text/plain; charset=utf-8" {
+				t.Errorf("%s: unexpected content type %q",
+					test.name, contentType)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+}
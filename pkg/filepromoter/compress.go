@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ContentEncodingGzip is the content encoding of gzip-compressed files.
+const ContentEncodingGzip = "gzip"
+
+// CompressionRules controls which uploaded files are compressed. They are
+// stored compressed, with a content encoding that makes clients decompress
+// them transparently.
+type CompressionRules struct {
+	// Gzip lists the file extensions (e.g. ".txt" or "html") of the files
+	// to gzip.
+	Gzip []string
+}
+
+// ContentEncoding returns the content encoding that the file name is
+// uploaded with, or "" if it is uploaded as is.
+func (r *CompressionRules) ContentEncoding(name string) string {
+	for _, ext := range extensions(name) {
+		for _, gzipExt := range r.Gzip {
+			if normalizeExtension(gzipExt) == ext {
+				return ContentEncodingGzip
+			}
+		}
+	}
+	return ""
+}
+
+// syncEncodedFileUploader is implemented by filestores that can store files
+// with a content encoding.
+type syncEncodedFileUploader interface {
+	// UploadEncodedFile uploads localFile, which holds the contents of the
+	// file encoded with contentEncoding, to dest. sha256 is the
+	// (hex-encoded) sha256 of the decoded contents, which is what
+	// VerifyFile checks.
+	UploadEncodedFile(
+		ctx context.Context,
+		dest, localFile, contentType, contentEncoding, sha256 string) error
+}
+
+// gzipFile compresses localFile into a new temp file, and returns its name.
+func gzipFile(localFile string) (string, error) {
+	in, err := os.Open(localFile)
+	if err != nil {
+		return "", fmt.Errorf("error opening %q: %v", localFile, err)
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile("", "promoter-gzip")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %v", err)
+	}
+	name := out.Name()
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("error compressing %q: %v", localFile, err)
+	}
+	return name, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestCompressionRulesContentEncoding(t *testing.T) {
+	rules := CompressionRules{Gzip: []string{".txt", "html", ".TAR"}}
+
+	var tests = []struct {
+		name     string
+		expected string
+	}{
+		{name: "notes.txt", expected: ContentEncodingGzip},
+		{name: "docs/index.html", expected: ContentEncodingGzip},
+		{name: "NOTES.TXT", expected: ContentEncodingGzip},
+		{name: "release.tar", expected: ContentEncodingGzip},
+		{name: "kubectl", expected: ""},
+		{name: "kubectl.sha256", expected: ""},
+		{name: "txt", expected: ""},
+	}
+
+	for _, test := range tests {
+		if got := rules.ContentEncoding(test.name); got != test.expected {
+			t.Errorf("%s: expected content encoding %q, got %q",
+				test.name, test.expected, got)
+		}
+	}
+
+	var none CompressionRules
+	if got := none.ContentEncoding("notes.txt"); got != "" {
+		t.Errorf("expected no content encoding by default, got %q", got)
+	}
+}
+
+// encodedUpload records an upload to an encodingFilestore.
+type encodedUpload struct {
+	contents        []byte
+	contentEncoding string
+	sha256          string
+}
+
+// encodingFilestore is a syncFilestore that supports content encodings, and
+// records the encoded uploads.
+type encodingFilestore struct {
+	syncFilestore
+
+	uploads map[string]encodedUpload
+}
+
+func (s *encodingFilestore) UploadEncodedFile(
+	ctx context.Context,
+	dest, localFile, contentType, contentEncoding, sha256 string) error {
+	contents, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	s.uploads[dest] = encodedUpload{
+		contents:        contents,
+		contentEncoding: contentEncoding,
+		sha256:          sha256,
+	}
+	return nil
+}
+
+func TestCopyFileOpCompression(t *testing.T) {
+	ctx := context.Background()
+
+	contents := strings.Repeat("hello world\n", 100)
+	sha256, _ := ComputeSHA256(strings.NewReader(contents))
+
+	client := newFakeS3Client()
+	client.objects["src/files/notes.txt"] = []byte(contents)
+	client.objects["src/files/kubectl"] = []byte(contents)
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := &encodingFilestore{
+		syncFilestore: mustOpenS3Filestore(t, "s3://dest/release", client),
+		uploads:       make(map[string]encodedUpload),
+	}
+
+	newOp := func(name string, dest syncFilestore) *copyFileOp {
+		return &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: name,
+				AbsolutePath: "s3://src/files/" + name,
+				filestore:    src,
+			},
+			Dest: &syncFileInfo{
+				RelativePath: name,
+				AbsolutePath: "s3://dest/release/" + name,
+				filestore:    dest,
+			},
+			ManifestFile: &api.File{Name: name, SHA256: sha256},
+			Compression:  CompressionRules{Gzip: []string{".txt"}},
+		}
+	}
+
+	// A matching file is uploaded gzipped, with the original sha256
+	if err := newOp("notes.txt", dest).Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	upload, ok := dest.uploads["notes.txt"]
+	if !ok {
+		t.Fatalf("notes.txt was not uploaded with a content encoding")
+	}
+	if upload.contentEncoding != ContentEncodingGzip {
+		t.Errorf("expected content encoding %q, got %q",
+			ContentEncodingGzip, upload.contentEncoding)
+	}
+	if upload.sha256 != sha256 {
+		t.Errorf("expected the sha256 of the original file %q, got %q",
+			sha256, upload.sha256)
+	}
+	if len(upload.contents) >= len(contents) {
+		t.Errorf("expected the upload to be compressed, got %d bytes",
+			len(upload.contents))
+	}
+	r, err := gzip.NewReader(bytes.NewReader(upload.contents))
+	if err != nil {
+		t.Fatalf("upload is not gzipped: %v", err)
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error decompressing the upload: %v", err)
+	}
+	if string(decoded) != contents {
+		t.Errorf("decompressed upload does not match the original file")
+	}
+
+	// Other files are uploaded as is
+	if err := newOp("kubectl", dest).Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := dest.uploads["kubectl"]; ok {
+		t.Errorf("kubectl was uploaded with a content encoding")
+	}
+	if got := string(client.objects["dest/release/kubectl"]); got != contents {
+		t.Errorf("expected kubectl to be uploaded as is, got %q", got)
+	}
+
+	// Destinations without content encodings are refused
+	plain := mustOpenS3Filestore(t, "s3://plain/release", client)
+	err = newOp("notes.txt", plain).Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "content encoding") {
+		t.Errorf("expected a content encoding error, got %v", err)
+	}
+	if _, ok := client.objects["plain/release/notes.txt"]; ok {
+		t.Errorf("notes.txt was uploaded to a destination " +
+			"without content encodings")
+	}
+}
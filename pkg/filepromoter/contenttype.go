@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultContentType is the content type of files whose type is unknown.
+const DefaultContentType = "application/octet-stream"
+
+// sniffLen is the number of bytes that http.DetectContentType considers.
+const sniffLen = 512
+
+// knownContentTypes maps the extensions of the files we usually publish to
+// their content types. It is consulted before the mime package, because the
+// latter depends on the mime.types files of the system we run on.
+var knownContentTypes = map[string]string{
+	".css":    "text/css; charset=utf-8",
+	".gz":     "application/gzip",
+	".htm":    "text/html; charset=utf-8",
+	".html":   "text/html; charset=utf-8",
+	".js":     "application/javascript",
+	".json":   "application/json",
+	".md":     "text/markdown; charset=utf-8",
+	".md5":    "text/plain; charset=utf-8",
+	".png":    "image/png",
+	".sha1":   "text/plain; charset=utf-8",
+	".sha256": "text/plain; charset=utf-8",
+	".sha512": "text/plain; charset=utf-8",
+	".svg":    "image/svg+xml",
+	".tar":    "application/x-tar",
+	".tar.gz": "application/gzip",
+	".tgz":    "application/gzip",
+	".txt":    "text/plain; charset=utf-8",
+	".xml":    "application/xml",
+	".yaml":   "application/yaml",
+	".yml":    "application/yaml",
+	".zip":    "application/zip",
+}
+
+// ContentTypeRules controls the content type that uploaded files get.
+type ContentTypeRules struct {
+	// Overrides maps file extensions (e.g. ".html") to the content type to
+	// use for them, instead of the detected one.
+	Overrides map[string]string
+
+	// Sniff detects the content type of files with unknown extensions from
+	// their first bytes (see http.DetectContentType).
+	Sniff bool
+}
+
+// Detect returns the content type of the file name, whose contents are in
+// localFile. The extensions of the name are matched (longest first, so that
+// ".tar.gz" wins over ".gz") against the overrides, the extensions we know
+// about and then the mime package; if none of them match, the contents are
+// sniffed (if enabled), or else DefaultContentType is returned.
+func (r *ContentTypeRules) Detect(name, localFile string) (string, error) {
+	exts := extensions(name)
+
+	for _, ext := range exts {
+		for k, contentType := range r.Overrides {
+			if normalizeExtension(k) == ext {
+				return contentType, nil
+			}
+		}
+	}
+
+	for _, ext := range exts {
+		if contentType, ok := knownContentTypes[ext]; ok {
+			return contentType, nil
+		}
+	}
+
+	for _, ext := range exts {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType, nil
+		}
+	}
+
+	if r.Sniff {
+		return sniffContentType(localFile)
+	}
+
+	return DefaultContentType, nil
+}
+
+// extensions returns the (lowercase) extensions of the file name, longest
+// first (e.g. ".tar.gz" and ".gz" for "kubernetes.tar.gz").
+func extensions(name string) []string {
+	base := strings.ToLower(path.Base(name))
+
+	var exts []string
+	for i := 1; i < len(base); i++ {
+		if base[i] == '.' && i < len(base)-1 {
+			exts = append(exts, base[i:])
+		}
+	}
+	return exts
+}
+
+// normalizeExtension lowercases ext, and adds the leading dot if it is
+// missing, so that overrides can be given as either "html" or ".HTML".
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// sniffContentType detects the content type of localFile from its contents.
+func sniffContentType(localFile string) (string, error) {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return "", fmt.Errorf("error opening %q: %v", localFile, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("error reading %q: %v", localFile, err)
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
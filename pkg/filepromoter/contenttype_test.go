@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "contenttype")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	htmlFile := filepath.Join(tmpdir, "html")
+	if err := ioutil.WriteFile(
+		htmlFile, []byte("<!DOCTYPE html><html></html>"), 0644); err != nil {
+		t.Fatalf("error writing %q: %v", htmlFile, err)
+	}
+
+	var tests = []struct {
+		name        string
+		file        string
+		rules       ContentTypeRules
+		contentType string
+	}{
+		{
+			name:        "release-notes.html",
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:        "v1.19.0/changelog.json",
+			contentType: "application/json",
+		},
+		{
+			name:        "README.MD",
+			contentType: "text/markdown; charset=utf-8",
+		},
+		{
+			name:        "kubernetes.tar.gz.sha256",
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "kubernetes-server-linux-amd64.tar.gz",
+			contentType: "application/gzip",
+		},
+		{
+			name: "kubernetes-server-linux-amd64.tar.gz",
+			rules: ContentTypeRules{
+				Overrides: map[string]string{
+					".gz":     "application/x-gzip",
+					"TAR.GZ":  "application/x-tar+gzip",
+					".tar.xz": "application/x-xz",
+				},
+			},
+			contentType: "application/x-tar+gzip",
+		},
+		{
+			name: "release-notes.html",
+			rules: ContentTypeRules{
+				Overrides: map[string]string{"html": "text/plain"},
+			},
+			contentType: "text/plain",
+		},
+		{
+			name:        "kubectl",
+			file:        htmlFile,
+			contentType: DefaultContentType,
+		},
+		{
+			name:        "kubectl",
+			file:        htmlFile,
+			rules:       ContentTypeRules{Sniff: true},
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:        ".hidden",
+			file:        htmlFile,
+			contentType: DefaultContentType,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.rules.Detect(test.name, test.file)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.contentType {
+			t.Errorf("%s: expected content type %q, got %q",
+				test.name, test.contentType, got)
+		}
+	}
+}
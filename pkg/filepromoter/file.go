@@ -19,12 +19,15 @@ package filepromoter
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 
+	"golang.org/x/xerrors"
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 )
@@ -39,6 +42,11 @@ type syncFileInfo struct {
 	// Note: with multipart uploads or compression, the value is unobvious.
 	MD5 string
 
+	// CRC32C is the (hex-encoded) crc32c checksum of the content, for the
+	// backends that record one (GCS, including for composite objects, which
+	// have no MD5).
+	CRC32C string
+
 	Size int64
 
 	filestore syncFilestore
@@ -50,6 +58,18 @@ type copyFileOp struct {
 	Dest   *syncFileInfo
 
 	ManifestFile *api.File
+
+	// ContentTypes determines the content type of the uploaded file.
+	ContentTypes ContentTypeRules
+
+	// Compression determines whether the file is uploaded compressed.
+	Compression CompressionRules
+
+	// Retry controls how a failed download or upload is retried.
+	Retry RetryPolicy
+
+	// VerifyReadBack downloads the uploaded file again, to check its sha256.
+	VerifyReadBack bool
 }
 
 // Run implements SyncFileOp.Run
@@ -78,38 +98,178 @@ func (o *copyFileOp) Run(ctx context.Context) error {
 		}
 	}()
 
+	// The source file is hashed as it is downloaded, retrying transient
+	// failures (a retry starts over with an empty file and fresh hashers)
+	var sha256Hasher, sha512Hasher hash.Hash
+	if err := o.Retry.do(ctx, o.Source.AbsolutePath, func() error {
+		sha256Hasher = sha256.New()
+		sha512Hasher = sha512.New()
+		return o.download(
+			ctx, f, io.MultiWriter(sha256Hasher, sha512Hasher))
+	}); err != nil {
+		return err
+	}
+	// We close the file to be sure it is fully written
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing temp file %q: %v", tempFilename, err)
+	}
+	f = nil
+
+	if err := verifySourceHashes(
+		hex.EncodeToString(sha256Hasher.Sum(nil)),
+		hex.EncodeToString(sha512Hasher.Sum(nil)),
+		o.Source.AbsolutePath, o.ManifestFile); err != nil {
+		return err
+	}
+
+	contentType, err := o.ContentTypes.Detect(
+		o.Dest.RelativePath, tempFilename)
+	if err != nil {
+		return err
+	}
+
+	// Compress the file, if it is to be stored with a content encoding; the
+	// manifest (and so VerifyFile) still has the sha256 of the original
+	uploadFilename := tempFilename
+	contentEncoding := o.Compression.ContentEncoding(o.Dest.RelativePath)
+	var encoder syncEncodedFileUploader
+	if contentEncoding != "" {
+		var ok bool
+		encoder, ok = o.Dest.filestore.(syncEncodedFileUploader)
+		if !ok {
+			return fmt.Errorf(
+				"cannot upload %q with content encoding %q: "+
+					"the destination does not support content encodings",
+				o.Dest.AbsolutePath, contentEncoding)
+		}
+
+		uploadFilename, err = gzipFile(tempFilename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(uploadFilename); err != nil {
+				klog.Warningf(
+					"unable to remove temp file %q: %v",
+					uploadFilename, err)
+			}
+		}()
+	}
+
+	// Upload to the destination, retrying transient failures
+	if err := o.Retry.do(ctx, o.Dest.AbsolutePath, func() error {
+		if encoder != nil {
+			return encoder.UploadEncodedFile(
+				ctx, o.Dest.RelativePath, uploadFilename, contentType,
+				contentEncoding, o.ManifestFile.SHA256)
+		}
+		return o.Dest.filestore.UploadFile(
+			ctx, o.Dest.RelativePath, uploadFilename, contentType)
+	}); err != nil {
+		return err
+	}
+
+	// Verify the uploaded file, if the destination supports it
+	if verifier, ok := o.Dest.filestore.(syncFileVerifier); ok {
+		if err := verifier.VerifyFile(
+			ctx, o.Dest.RelativePath, o.ManifestFile.SHA256); err != nil {
+			return err
+		}
+	}
+
+	// The checksums the destination reports are computed by the destination
+	// itself; reading the file back also catches what it mangles on the way
+	// out
+	if o.VerifyReadBack {
+		if err := verifyReadBack(
+			ctx, o.Dest, o.ManifestFile.SHA256); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// download copies the source file to the (truncated) file f, and to hasher.
+func (o *copyFileOp) download(
+	ctx context.Context,
+	f *os.File,
+	hasher io.Writer) error {
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error writing temp file %q: %v", f.Name(), err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("error writing temp file %q: %v", f.Name(), err)
+	}
+
 	in, err := o.Source.filestore.OpenReader(ctx, o.Source.RelativePath)
 	if err != nil {
-		return fmt.Errorf("error reading %q: %v", o.Source.AbsolutePath, err)
+		return xerrors.Errorf(
+			"error reading %q: %w",
+			o.Source.AbsolutePath, err)
 	}
 	defer in.Close()
 
-	if _, err := io.Copy(f, in); err != nil {
-		return fmt.Errorf(
-			"error downloading %s: %v",
+	if _, err := io.Copy(io.MultiWriter(f, hasher), in); err != nil {
+		return xerrors.Errorf(
+			"error downloading %s: %w",
 			o.Source.AbsolutePath, err)
 	}
-	// We close the file to be sure it is fully written
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("error writing temp file %q: %v", tempFilename, err)
+	return nil
+}
+
+// verifyReadBack downloads the uploaded file dest, and checks its contents
+// against the (hex-encoded) sha256 of the manifest. Files stored with a
+// content encoding are served decoded by GCS, so they are checked against
+// the sha256 of the original file as well.
+func verifyReadBack(
+	ctx context.Context,
+	dest *syncFileInfo,
+	expected string) error {
+
+	in, err := dest.filestore.OpenReader(ctx, dest.RelativePath)
+	if err != nil {
+		return fmt.Errorf("error reading back %q: %v", dest.AbsolutePath, err)
 	}
-	f = nil
+	defer in.Close()
 
-	// Verify the source hash
-	sha256, err := ComputeSHA256ForFile(tempFilename)
+	actual, err := ComputeSHA256(in)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading back %q: %v", dest.AbsolutePath, err)
 	}
-	if sha256 != o.ManifestFile.SHA256 {
+	if actual != expected {
 		return fmt.Errorf(
-			"sha256 did not match for file %q: actual=%q expected=%q",
-			o.Source.AbsolutePath, sha256, o.ManifestFile.SHA256)
+			"sha256 did not match for uploaded file %q when read back: "+
+				"actual=%q expected=%q",
+			dest.AbsolutePath, actual, expected)
 	}
 
-	// Upload to the destination
-	if err := o.Dest.filestore.UploadFile(
-		ctx, o.Dest.RelativePath, tempFilename); err != nil {
-		return err
+	klog.V(2).Infof("read back %q; sha256 matches", dest.AbsolutePath)
+	return nil
+}
+
+// verifySourceHashes checks the (hex-encoded) hashes of the downloaded source
+// file against the ones recorded in the manifest (the sha512 is optional in
+// the manifest). A mismatch usually means that the manifest is
+// stale, i.e. the source file was changed after the manifest was generated;
+// nothing must be uploaded then, or we would promote content that nobody
+// reviewed.
+func verifySourceHashes(
+	sha256, sha512, source string,
+	manifestFile *api.File) error {
+
+	if sha256 != manifestFile.SHA256 {
+		return fmt.Errorf(
+			"sha256 did not match for file %q: actual=%q expected=%q "+
+				"(is the manifest entry for %q stale?)",
+			source, sha256, manifestFile.SHA256, manifestFile.Name)
+	}
+	if manifestFile.SHA512 != "" && sha512 != manifestFile.SHA512 {
+		return fmt.Errorf(
+			"sha512 did not match for file %q: actual=%q expected=%q "+
+				"(is the manifest entry for %q stale?)",
+			source, sha512, manifestFile.SHA512, manifestFile.Name)
 	}
 
 	return nil
@@ -122,12 +282,84 @@ func (o *copyFileOp) String() string {
 		o.Source.AbsolutePath, o.Dest.AbsolutePath)
 }
 
+// ComputeSHA256 returns the hex-encoded sha256 hash of the contents of r,
+// which is read until EOF.
+func ComputeSHA256(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ComputeSHA512 returns the hex-encoded sha512 hash of the contents of r,
+// which is read until EOF.
+func ComputeSHA512(r io.Reader) (string, error) {
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // nolint[lll]
 // ComputeSHA256ForFile returns the hex-encoded sha256 hash of the file named filename
 func ComputeSHA256ForFile(filename string) (string, error) {
+	return computeForFile(filename, ComputeSHA256)
+}
+
+// nolint[lll]
+// ComputeSHA512ForFile returns the hex-encoded sha512 hash of the file named filename
+func ComputeSHA512ForFile(filename string) (string, error) {
+	return computeForFile(filename, ComputeSHA512)
+}
+
+// computeForFile opens the file named filename, and returns the hash of its
+// contents computed by compute (e.g. ComputeSHA256).
+func computeForFile(
+	filename string,
+	compute func(io.Reader) (string, error)) (string, error) {
+
+	var sum string
+	err := withFile(filename, func(f io.Reader) error {
+		var err error
+		sum, err = compute(f)
+		return err
+	})
+	return sum, err
+}
+
+// ComputeHashesForFile returns the hex-encoded sha256 and sha512 hashes of the
+// file named filename, reading the file only once.
+func ComputeHashesForFile(filename string) (string, string, error) {
+	sha256Hasher := sha256.New()
+	sha512Hasher := sha512.New()
+	if err := hashFile(
+		filename, io.MultiWriter(sha256Hasher, sha512Hasher)); err != nil {
+		return "", "", err
+	}
+
+	sha256 := hex.EncodeToString(sha256Hasher.Sum(nil))
+	sha512 := hex.EncodeToString(sha512Hasher.Sum(nil))
+	return sha256, sha512, nil
+}
+
+// hashFile writes the contents of the file named filename to hasher.
+func hashFile(filename string, hasher io.Writer) error {
+	return withFile(filename, func(f io.Reader) error {
+		_, err := io.Copy(hasher, f)
+		return err
+	})
+}
+
+// withFile opens the file named filename, and passes it to read. An error
+// returned by read is reported as a hashing error.
+func withFile(filename string, read func(io.Reader) error) error {
 	f, err := os.Open(filename)
 	if err != nil {
-		return "", fmt.Errorf(
+		return fmt.Errorf(
 			"error re-opening temp file %q: %v",
 			filename, err)
 	}
@@ -139,11 +371,9 @@ func ComputeSHA256ForFile(filename string) (string, error) {
 		}
 	}()
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, f); err != nil {
-		return "", fmt.Errorf("error hashing file %q: %v", filename, err)
+	if err := read(f); err != nil {
+		return fmt.Errorf("error hashing file %q: %v", filename, err)
 	}
 
-	sha256 := hex.EncodeToString(hasher.Sum(nil))
-	return sha256, nil
+	return nil
 }
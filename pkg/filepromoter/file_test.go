@@ -0,0 +1,223 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestVerifySourceHashes(t *testing.T) {
+	content := []byte("hello world")
+	sum256 := sha256.Sum256(content)
+	oksha256 := hex.EncodeToString(sum256[:])
+	sum512 := sha512.Sum512(content)
+	oksha512 := hex.EncodeToString(sum512[:])
+
+	// The manifest was generated for a previous version of the file.
+	stale := []byte("hello world, v0")
+	staleSum256 := sha256.Sum256(stale)
+	stalesha256 := hex.EncodeToString(staleSum256[:])
+	staleSum512 := sha512.Sum512(stale)
+	stalesha512 := hex.EncodeToString(staleSum512[:])
+
+	var tests = []struct {
+		name          string
+		sha256        string
+		sha512        string
+		expectedError string
+	}{
+		{
+			name:   "Matching sha256",
+			sha256: oksha256,
+		},
+		{
+			name:   "Matching sha256 and sha512",
+			sha256: oksha256,
+			sha512: oksha512,
+		},
+		{
+			name:   "Stale sha256",
+			sha256: stalesha256,
+			expectedError: `sha256 did not match for file "gs://src/hello.txt": ` +
+				`actual="` + oksha256 + `" expected="` + stalesha256 + `" ` +
+				`(is the manifest entry for "hello.txt" stale?)`,
+		},
+		{
+			name:   "Stale sha512",
+			sha256: oksha256,
+			sha512: stalesha512,
+			expectedError: `sha512 did not match for file "gs://src/hello.txt": ` +
+				`actual="` + oksha512 + `" expected="` + stalesha512 + `" ` +
+				`(is the manifest entry for "hello.txt" stale?)`,
+		},
+	}
+
+	for _, test := range tests {
+		manifestFile := &api.File{
+			Name:   "hello.txt",
+			SHA256: test.sha256,
+			SHA512: test.sha512,
+		}
+		err := verifySourceHashes(
+			oksha256, oksha512, "gs://src/hello.txt", manifestFile)
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expectedError {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+}
+
+func TestCopyFileOpStaleManifest(t *testing.T) {
+	client := newFakeS3Client()
+	client.objects["src/files/hello.txt"] = []byte("hello world")
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	op := &copyFileOp{
+		Source: &syncFileInfo{
+			RelativePath: "hello.txt",
+			AbsolutePath: "s3://src/files/hello.txt",
+			filestore:    src,
+		},
+		Dest: &syncFileInfo{
+			RelativePath: "hello.txt",
+			AbsolutePath: "s3://dest/release/hello.txt",
+			filestore:    dest,
+		},
+		ManifestFile: &api.File{
+			Name:   "hello.txt",
+			SHA256: strings.Repeat("0", 64),
+		},
+	}
+
+	err := op.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("expected a stale manifest error, got %v", err)
+	}
+	if _, ok := client.objects["dest/release/hello.txt"]; ok {
+		t.Errorf("file was uploaded despite the stale manifest")
+	}
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestComputeSHA256(t *testing.T) {
+	var tests = []struct {
+		name     string
+		r        io.Reader
+		expected string
+	}{
+		{
+			name: "Empty input",
+			r:    bytes.NewReader(nil),
+			expected: "e3b0c44298fc1c149afbf4c8996fb924" +
+				"27ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name: "Small input",
+			r:    strings.NewReader("hello world"),
+			expected: "b94d27b9934d3e08a52e52d7da7dabfa" +
+				"c484efe37a5380ee9088f7ace2efcde9",
+		},
+		{
+			// Computed with: head -c 67108864 /dev/zero | sha256sum
+			name: "Large stream (64MiB)",
+			r:    io.LimitReader(zeroReader{}, 64*1024*1024),
+			expected: "3b6a07d0d404fab4e23b6d34bc6696a6" +
+				"a312dd92821332385e5af7c01c421351",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ComputeSHA256(test.r)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected sha256 %q, got %q",
+				test.name, test.expected, got)
+		}
+	}
+}
+
+func TestComputeSHA512(t *testing.T) {
+	got, err := ComputeSHA512(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "cf83e1357eefb8bdf1542850d66d8007" +
+		"d620e4050b5715dc83f4a921d36ce9ce" +
+		"47d0d13c5d85f2b0ff8318d2877eec2f" +
+		"63b931bd47417a81a538327af927da3e"
+	if got != expected {
+		t.Errorf("expected sha512 %q, got %q", expected, got)
+	}
+}
+
+func TestComputeSHA256ForFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "sha256")
+	if err != nil {
+		t.Fatalf("error creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatalf("error writing temp file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("error closing temp file: %v", err)
+	}
+
+	got, err := ComputeSHA256ForFile(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := ComputeSHA256(strings.NewReader("hello world"))
+	if got != expected {
+		t.Errorf("expected sha256 %q, got %q", expected, got)
+	}
+
+	if _, err := ComputeSHA256ForFile(f.Name() + ".missing"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
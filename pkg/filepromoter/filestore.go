@@ -27,6 +27,8 @@ import (
 	"google.golang.org/api/option"
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/aws"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/azure"
 )
 
 // FilestorePromoter manages the promotion of files.
@@ -39,19 +41,81 @@ type FilestorePromoter struct {
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
+
+	// Force copies every file, even if it already exists in the destination
+	// with the expected contents.
+	Force bool
+
+	// ContentTypes controls the content type of the uploaded files.
+	ContentTypes ContentTypeRules
+
+	// Compression controls which uploaded files are compressed.
+	Compression CompressionRules
+
+	// Retry controls how failed downloads and uploads are retried.
+	Retry RetryPolicy
+
+	// VerifyReadBack downloads every uploaded file again, to check its
+	// sha256 against the manifest.
+	VerifyReadBack bool
+
+	// Skipped is set by BuildOperations to the number of files that were not
+	// copied, because they already exist in the destination.
+	Skipped int
+
+	// Prune deletes the files of the destination that are not in the
+	// manifest, so that it mirrors the manifest exactly.
+	Prune bool
+
+	// Pruned is set by BuildOperations to the number of files that are
+	// deleted, if Prune is set.
+	Pruned int
+
+	// Plan is set by BuildOperations to what happens to every file of the
+	// manifest (and, if Prune is set, to every file that is deleted).
+	Plan []PlannedFile
 }
 
 type syncFilestore interface {
 	// OpenReader opens an io.ReadCloser for the specified file
 	OpenReader(ctx context.Context, name string) (io.ReadCloser, error)
 
-	// UploadFile uploads a local file to the specified destination
-	UploadFile(ctx context.Context, dest string, localFile string) error
+	// UploadFile uploads a local file to the specified destination, with
+	// the given content type (the default one of the backend if empty)
+	UploadFile(
+		ctx context.Context,
+		dest, localFile, contentType string) error
 
 	// ListFiles returns all the file artifacts in the filestore, recursively.
 	ListFiles(ctx context.Context) (map[string]*syncFileInfo, error)
 }
 
+// syncFileVerifier is implemented by filestores that can check the contents
+// of a file after it has been uploaded.
+type syncFileVerifier interface {
+	// VerifyFile checks that the uploaded file dest has the given
+	// (hex-encoded) sha256
+	VerifyFile(ctx context.Context, dest string, sha256 string) error
+}
+
+// syncFileDeleter is implemented by filestores from which files can be
+// deleted, for pruning.
+type syncFileDeleter interface {
+	// DeleteFile deletes the specified file
+	DeleteFile(ctx context.Context, name string) error
+}
+
+// syncFileStatter is implemented by filestores that cannot list their files,
+// but can look up given files (e.g. HTTP servers).
+type syncFileStatter interface {
+	// StatFiles returns the files with the given names that exist in the
+	// filestore, retrying transient failures with retry
+	StatFiles(
+		ctx context.Context,
+		names []string,
+		retry RetryPolicy) (map[string]*syncFileInfo, error)
+}
+
 func openFilestore(
 	ctx context.Context,
 	filestore *api.Filestore,
@@ -63,11 +127,30 @@ func openFilestore(
 			filestore.Base, err)
 	}
 
-	if u.Scheme != "gs" {
+	switch u.Scheme {
+	case "gs":
+		return openGCSFilestore(ctx, filestore, u, useServiceAccount)
+	case "s3":
+		return openS3Filestore(filestore, u, aws.S3CLI{})
+	case "azblob":
+		return openAzblobFilestore(filestore, u, azure.BlobCLI{})
+	case "http", "https":
+		return openHTTPFilestore(filestore, u)
+	default:
 		return nil, fmt.Errorf(
-			"unrecognized scheme %q (supported schemes: gs://)",
+			"unrecognized scheme %q "+
+				"(supported schemes: gs://, s3://, azblob://, "+
+				"http:// and https:// for sources)",
 			filestore.Base)
 	}
+}
+
+// openGCSFilestore opens a filestore for the gs://bucket/prefix URL u.
+func openGCSFilestore(
+	ctx context.Context,
+	filestore *api.Filestore,
+	u *url.URL,
+	useServiceAccount bool) (syncFilestore, error) {
 
 	var opts []option.ClientOption
 	if useServiceAccount && filestore.ServiceAccount != "" {
@@ -98,13 +181,31 @@ func openFilestore(
 	return s, nil
 }
 
-// computeNeededOperations determines the list of files that need to be copied
+// computeNeededOperations determines the list of files that need to be
+// copied, and counts the ones that are skipped in p.Skipped.
+//
+// If p.Prune is set, the files of the destination that are not in the
+// manifest are deleted (see computePruneOperations).
+//
+// Unless p.Force is set, a file is skipped if the destination already has it
+// with the same metadata (see matchMetadata), or, if the metadata is
+// inconclusive, with the sha256 of the manifest (if the destination can verify
+// files, see syncFileVerifier). This makes re-running an interrupted promotion
+// cheap.
 // nolint[funlen]
 func (p *FilestorePromoter) computeNeededOperations(
+	ctx context.Context,
 	source, dest map[string]*syncFileInfo,
 	destFilestore syncFilestore) ([]SyncFileOp, error) {
 	// nolint[prealloc]
 	var ops []SyncFileOp
+	p.Skipped = 0
+	p.Pruned = 0
+	p.Plan = nil
+
+	// The names of the files promoted to each destination path, to catch
+	// path mappings which map several files to the same path
+	destNames := make(map[string]string)
 
 	for i := range p.Files {
 		f := &p.Files[i]
@@ -118,55 +219,158 @@ func (p *FilestorePromoter) computeNeededOperations(
 				relativePath, absolutePath)
 		}
 
-		destFile := dest[relativePath]
+		destPath, err := p.Dest.DestPath(relativePath)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := destNames[destPath]; ok && other != relativePath {
+			return nil, fmt.Errorf(
+				"files %q and %q are both promoted to %q",
+				other, relativePath, joinFilepath(p.Dest, destPath))
+		}
+		destNames[destPath] = relativePath
+
+		destFile := dest[destPath]
 		if destFile == nil {
 			destFile = &syncFileInfo{}
-			destFile.RelativePath = sourceFile.RelativePath
-			destFile.AbsolutePath = joinFilepath(
-				p.Dest,
-				sourceFile.RelativePath)
+			destFile.RelativePath = destPath
+			destFile.AbsolutePath = joinFilepath(p.Dest, destPath)
 			destFile.filestore = destFilestore
+			p.addToPlan(ActionUpload, sourceFile, destFile, f)
 			ops = append(ops, &copyFileOp{
 				Source:       sourceFile,
 				Dest:         destFile,
 				ManifestFile: f,
+				ContentTypes: p.ContentTypes,
+				Compression:  p.Compression,
+				Retry:        p.Retry,
+
+				VerifyReadBack: p.VerifyReadBack,
 			})
 			continue
 		}
 
-		changed := false
-		if destFile.MD5 != sourceFile.MD5 {
-			klog.Warningf("MD5 mismatch on source %q vs dest %q: %q vs %q",
-				sourceFile.AbsolutePath,
-				destFile.AbsolutePath,
-				sourceFile.MD5,
-				destFile.MD5)
-			changed = true
-		}
+		if p.Force {
+			p.addToPlan(ActionUpload, sourceFile, destFile, f)
+			ops = append(ops, &copyFileOp{
+				Source:       sourceFile,
+				Dest:         destFile,
+				ManifestFile: f,
+				ContentTypes: p.ContentTypes,
+				Compression:  p.Compression,
+				Retry:        p.Retry,
 
-		if destFile.Size != sourceFile.Size {
-			klog.Warningf("Size mismatch on source %q vs dest %q: %d vs %d",
-				sourceFile.AbsolutePath,
-				destFile.AbsolutePath,
-				sourceFile.Size,
-				destFile.Size)
-			changed = true
+				VerifyReadBack: p.VerifyReadBack,
+			})
+			continue
 		}
 
-		if !changed {
+		compressed := p.Compression.ContentEncoding(destPath) != ""
+		match, conclusive := matchMetadata(sourceFile, destFile, compressed)
+		if match {
 			klog.V(2).Infof("metadata match for %q", destFile.AbsolutePath)
+			p.addToPlan(ActionSkip, sourceFile, destFile, f)
+			p.Skipped++
 			continue
 		}
+
+		// The checksums can differ for identical contents (e.g., for
+		// multipart uploads), so check the contents themselves if possible.
+		verifier, ok := destFilestore.(syncFileVerifier)
+		if ok && !conclusive {
+			err := verifier.VerifyFile(ctx, destFile.RelativePath, f.SHA256)
+			if err == nil {
+				klog.Infof("sha256 match for %q; skipping",
+					destFile.AbsolutePath)
+				p.addToPlan(ActionSkip, sourceFile, destFile, f)
+				p.Skipped++
+				continue
+			}
+			klog.V(2).Infof("not skipping %q: %v", destFile.AbsolutePath, err)
+		}
+
+		p.addToPlan(ActionUpload, sourceFile, destFile, f)
 		ops = append(ops, &copyFileOp{
 			Source:       sourceFile,
 			Dest:         destFile,
 			ManifestFile: f,
+			ContentTypes: p.ContentTypes,
+			Compression:  p.Compression,
+			Retry:        p.Retry,
+
+			VerifyReadBack: p.VerifyReadBack,
 		})
 	}
 
+	if p.Prune {
+		pruneOps, err := p.computePruneOperations(
+			dest, destNames, destFilestore)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, pruneOps...)
+	}
+
 	return ops, nil
 }
 
+// matchMetadata compares the metadata that the filestores report for the
+// source and destination files, without reading either of them. It returns
+// whether the files match, and whether that answer is conclusive; if not, the
+// destination file needs to be checked against the manifest.
+//
+// The files match if they have the same size and crc32c or (non-multipart)
+// MD5. A size mismatch is conclusive, unless the destination file is
+// compressed (in which case neither its size nor its checksums are those of
+// the source file).
+func matchMetadata(
+	source, dest *syncFileInfo,
+	compressed bool) (match, conclusive bool) {
+	if compressed {
+		return false, false
+	}
+
+	// Some sources (e.g., HTTP servers) do not always report a size
+	if source.Size < 0 {
+		return false, false
+	}
+	if source.Size != dest.Size {
+		klog.Warningf("Size mismatch on source %q vs dest %q: %d vs %d",
+			source.AbsolutePath,
+			dest.AbsolutePath,
+			source.Size,
+			dest.Size)
+		return false, true
+	}
+
+	if source.CRC32C != "" && dest.CRC32C != "" {
+		if source.CRC32C == dest.CRC32C {
+			return true, true
+		}
+		klog.Warningf("CRC32C mismatch on source %q vs dest %q: %q vs %q",
+			source.AbsolutePath,
+			dest.AbsolutePath,
+			source.CRC32C,
+			dest.CRC32C)
+		return false, false
+	}
+
+	// The ETag of multipart S3 uploads (with a "-<parts>" suffix) is not
+	// the MD5 of the content
+	if source.MD5 != "" && !strings.Contains(source.MD5, "-") &&
+		source.MD5 == dest.MD5 {
+		return true, true
+	}
+	if source.MD5 != dest.MD5 {
+		klog.Warningf("MD5 mismatch on source %q vs dest %q: %q vs %q",
+			source.AbsolutePath,
+			dest.AbsolutePath,
+			source.MD5,
+			dest.MD5)
+	}
+	return false, false
+}
+
 func joinFilepath(filestore *api.Filestore, relativePath string) string {
 	s := strings.TrimSuffix(filestore.Base, "/")
 	s += "/"
@@ -174,6 +378,23 @@ func joinFilepath(filestore *api.Filestore, relativePath string) string {
 	return s
 }
 
+// listSourceFiles returns the files of the source filestore; filestores that
+// cannot be listed are only asked for the files of the manifest.
+func (p *FilestorePromoter) listSourceFiles(
+	ctx context.Context,
+	sourceFilestore syncFilestore) (map[string]*syncFileInfo, error) {
+	statter, ok := sourceFilestore.(syncFileStatter)
+	if !ok {
+		return sourceFilestore.ListFiles(ctx)
+	}
+
+	names := make([]string, 0, len(p.Files))
+	for i := range p.Files {
+		names = append(names, p.Files[i].Name)
+	}
+	return statter.StatFiles(ctx, names, p.Retry)
+}
+
 // BuildOperations builds the required operations to sync from the
 // Source Filestore to the Dest Filestore.
 func (p *FilestorePromoter) BuildOperations(
@@ -187,7 +408,7 @@ func (p *FilestorePromoter) BuildOperations(
 		return nil, err
 	}
 
-	sourceFiles, err := sourceFilestore.ListFiles(ctx)
+	sourceFiles, err := p.listSourceFiles(ctx, sourceFilestore)
 	if err != nil {
 		return nil, err
 	}
@@ -197,5 +418,6 @@ func (p *FilestorePromoter) BuildOperations(
 		return nil, err
 	}
 
-	return p.computeNeededOperations(sourceFiles, destFiles, destFilestore)
+	return p.computeNeededOperations(
+		ctx, sourceFiles, destFiles, destFilestore)
 }
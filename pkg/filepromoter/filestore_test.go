@@ -0,0 +1,312 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestComputeNeededOperations(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	oksha := hex.EncodeToString(sum[:])
+
+	var tests = []struct {
+		name string
+		// destContent is nil if the file does not exist in the destination.
+		destContent []byte
+		// destSHA256 is the sha256 recorded for the destination file.
+		destSHA256 string
+		// metadataMismatch makes the destination MD5 differ from the source.
+		metadataMismatch bool
+		force            bool
+		expectedOps      int
+		expectedSkipped  int
+		// expectedLookups is the number of times the sha256 of the
+		// destination file is looked up.
+		expectedLookups int
+	}{
+		{
+			name:        "Missing in destination",
+			expectedOps: 1,
+		},
+		{
+			name:            "Metadata match",
+			destContent:     content,
+			destSHA256:      oksha,
+			expectedSkipped: 1,
+		},
+		{
+			name:             "Metadata mismatch but sha256 match",
+			destContent:      content,
+			destSHA256:       oksha,
+			metadataMismatch: true,
+			expectedSkipped:  1,
+			expectedLookups:  1,
+		},
+		{
+			name:             "Metadata mismatch and sha256 mismatch",
+			destContent:      []byte("hello World"),
+			destSHA256:       "bogus",
+			metadataMismatch: true,
+			expectedOps:      1,
+			expectedLookups:  1,
+		},
+		{
+			name:        "Different sizes",
+			destContent: []byte("goodbye world"),
+			destSHA256:  "bogus",
+			expectedOps: 1,
+		},
+		{
+			name:        "Force",
+			destContent: content,
+			destSHA256:  oksha,
+			force:       true,
+			expectedOps: 1,
+		},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+
+		client := newFakeS3Client()
+		client.objects["src/files/hello.txt"] = content
+		if test.destContent != nil {
+			client.objects["dest/release/hello.txt"] = test.destContent
+			client.checksums["dest/release/hello.txt"] = test.destSHA256
+		}
+
+		src := mustOpenS3Filestore(t, "s3://src/files", client)
+		dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+		sourceFiles, err := src.ListFiles(ctx)
+		if err != nil {
+			t.Fatalf("%s: error listing source files: %v", test.name, err)
+		}
+		destFiles, err := dest.ListFiles(ctx)
+		if err != nil {
+			t.Fatalf("%s: error listing dest files: %v", test.name, err)
+		}
+		if test.metadataMismatch {
+			destFiles["hello.txt"].MD5 = "different"
+		}
+
+		p := &FilestorePromoter{
+			Source: &api.Filestore{Base: "s3://src/files"},
+			Dest:   &api.Filestore{Base: "s3://dest/release"},
+			Files:  []api.File{{Name: "hello.txt", SHA256: oksha}},
+			Force:  test.force,
+		}
+		ops, err := p.computeNeededOperations(
+			ctx, sourceFiles, destFiles, dest)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(ops) != test.expectedOps {
+			t.Errorf("%s: expected %d operations, got %d",
+				test.name, test.expectedOps, len(ops))
+		}
+		if p.Skipped != test.expectedSkipped {
+			t.Errorf("%s: expected %d skipped, got %d",
+				test.name, test.expectedSkipped, p.Skipped)
+		}
+		if client.sha256Lookups != test.expectedLookups {
+			t.Errorf("%s: expected %d sha256 lookups, got %d",
+				test.name, test.expectedLookups, client.sha256Lookups)
+		}
+	}
+}
+
+func TestMatchMetadata(t *testing.T) {
+	var tests = []struct {
+		name               string
+		source             syncFileInfo
+		dest               syncFileInfo
+		compressed         bool
+		expectedMatch      bool
+		expectedConclusive bool
+	}{
+		{
+			name:               "MD5 match",
+			source:             syncFileInfo{MD5: "abcd", Size: 10},
+			dest:               syncFileInfo{MD5: "abcd", Size: 10},
+			expectedMatch:      true,
+			expectedConclusive: true,
+		},
+		{
+			name:   "MD5 mismatch",
+			source: syncFileInfo{MD5: "abcd", Size: 10},
+			dest:   syncFileInfo{MD5: "1234", Size: 10},
+		},
+		{
+			name:   "Multipart ETags",
+			source: syncFileInfo{MD5: "abcd-2", Size: 10},
+			dest:   syncFileInfo{MD5: "abcd-2", Size: 10},
+		},
+		{
+			name:   "No checksums",
+			source: syncFileInfo{Size: 10},
+			dest:   syncFileInfo{Size: 10},
+		},
+		{
+			name:               "CRC32C match",
+			source:             syncFileInfo{CRC32C: "0000abcd", Size: 10},
+			dest:               syncFileInfo{CRC32C: "0000abcd", Size: 10},
+			expectedMatch:      true,
+			expectedConclusive: true,
+		},
+		{
+			name:               "CRC32C match without MD5 in the destination",
+			source:             syncFileInfo{MD5: "abcd", CRC32C: "0000abcd", Size: 10},
+			dest:               syncFileInfo{CRC32C: "0000abcd", Size: 10},
+			expectedMatch:      true,
+			expectedConclusive: true,
+		},
+		{
+			name:   "CRC32C mismatch",
+			source: syncFileInfo{CRC32C: "0000abcd", Size: 10},
+			dest:   syncFileInfo{CRC32C: "00001234", Size: 10},
+		},
+		{
+			name:               "Size mismatch",
+			source:             syncFileInfo{MD5: "abcd", Size: 10},
+			dest:               syncFileInfo{MD5: "abcd", Size: 11},
+			expectedConclusive: true,
+		},
+		{
+			name:   "Unknown source size",
+			source: syncFileInfo{Size: -1},
+			dest:   syncFileInfo{MD5: "abcd", Size: 10},
+		},
+		{
+			name:       "Compressed",
+			source:     syncFileInfo{MD5: "abcd", Size: 10},
+			dest:       syncFileInfo{MD5: "abcd", Size: 10},
+			compressed: true,
+		},
+	}
+
+	for _, test := range tests {
+		match, conclusive := matchMetadata(
+			&test.source, &test.dest, test.compressed)
+		if match != test.expectedMatch {
+			t.Errorf("%s: expected match=%v, got %v",
+				test.name, test.expectedMatch, match)
+		}
+		if conclusive != test.expectedConclusive {
+			t.Errorf("%s: expected conclusive=%v, got %v",
+				test.name, test.expectedConclusive, conclusive)
+		}
+	}
+}
+
+func TestComputeNeededOperationsPathMappings(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	oksha := hex.EncodeToString(sum[:])
+
+	client := newFakeS3Client()
+	client.objects["src/files/bin/linux/amd64/tool"] = content
+	client.objects["src/files/bin/darwin/arm64/tool"] = content
+	client.objects["src/files/README.md"] = content
+	// Already promoted under its new name
+	client.objects["dest/release/releases/v1.0/tool-darwin-arm64"] = content
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	sourceFiles, err := src.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing source files: %v", err)
+	}
+	destFiles, err := dest.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing dest files: %v", err)
+	}
+
+	destFilestore := &api.Filestore{
+		Base: "s3://dest/release",
+		PathMappings: []api.PathMapping{
+			{Source: "README.md", Dest: "releases/v1.0/README.md"},
+			{
+				Source: "bin/([^/]+)/([^/]+)/([^/]+)",
+				Dest:   "releases/v1.0/${3}-${1}-${2}",
+			},
+		},
+	}
+	p := &FilestorePromoter{
+		Source: &api.Filestore{Base: "s3://src/files"},
+		Dest:   destFilestore,
+		Files: []api.File{
+			{Name: "README.md", SHA256: oksha},
+			{Name: "bin/darwin/arm64/tool", SHA256: oksha},
+			{Name: "bin/linux/amd64/tool", SHA256: oksha},
+		},
+	}
+	ops, err := p.computeNeededOperations(ctx, sourceFiles, destFiles, dest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		`COPY "s3://src/files/README.md" to ` +
+			`"s3://dest/release/releases/v1.0/README.md"`,
+		`COPY "s3://src/files/bin/linux/amd64/tool" to ` +
+			`"s3://dest/release/releases/v1.0/tool-linux-amd64"`,
+	}
+	if len(ops) != len(expected) {
+		t.Fatalf("expected %d operations, got %v", len(expected), ops)
+	}
+	for i, op := range ops {
+		if fmt.Sprint(op) != expected[i] {
+			t.Errorf("expected operation %q, got %q", expected[i], op)
+		}
+	}
+	if p.Skipped != 1 {
+		t.Errorf("expected 1 skipped, got %d", p.Skipped)
+	}
+
+	// The uploaded file is the source file, under its new name
+	if err := ops[1].Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uploaded := client.objects["dest/release/releases/v1.0/tool-linux-amd64"]
+	if string(uploaded) != string(content) {
+		t.Errorf("file was not copied to its mapped path")
+	}
+
+	// Two files cannot be promoted to the same path
+	destFilestore.PathMappings = []api.PathMapping{
+		{Source: "bin/[^/]+/[^/]+/([^/]+)", Dest: "releases/v1.0/${1}"},
+	}
+	p.Files = p.Files[1:]
+	_, err = p.computeNeededOperations(ctx, sourceFiles, destFiles, dest)
+	if err == nil || !strings.Contains(err.Error(), "are both promoted to") {
+		t.Errorf("expected an error for conflicting paths, got %v", err)
+	}
+}
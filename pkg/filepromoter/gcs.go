@@ -18,6 +18,7 @@ package filepromoter
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
@@ -26,11 +27,16 @@ import (
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/xerrors"
 	"google.golang.org/api/iterator"
 	"k8s.io/klog"
 	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
 )
 
+// gcsSHA256MetadataKey is the object metadata key under which UploadFile
+// records the (hex-encoded) sha256 of the uploaded file.
+const gcsSHA256MetadataKey = "sha256"
+
 type gcsSyncFilestore struct {
 	filestore *api.Filestore
 	client    *storage.Client
@@ -50,7 +56,25 @@ func (s *gcsSyncFilestore) OpenReader(
 func (s *gcsSyncFilestore) UploadFile(
 	ctx context.Context,
 	dest string,
-	localFile string) error {
+	localFile string,
+	contentType string) error {
+	return s.upload(ctx, dest, localFile, contentType, "", "")
+}
+
+// UploadEncodedFile implements syncEncodedFileUploader. GCS serves the file
+// decoded to the clients that do not accept its content encoding.
+func (s *gcsSyncFilestore) UploadEncodedFile(
+	ctx context.Context,
+	dest, localFile, contentType, contentEncoding, sha256 string) error {
+	return s.upload(ctx, dest, localFile, contentType, contentEncoding, sha256)
+}
+
+// upload uploads a local file to the specified destination, with the given
+// content encoding (if any). The sha256 recorded for VerifyFile is that of
+// the local file, unless fileSHA256 is given.
+func (s *gcsSyncFilestore) upload(
+	ctx context.Context,
+	dest, localFile, contentType, contentEncoding, fileSHA256 string) error {
 	absolutePath := s.prefix + dest
 
 	gcsURL := "gs://" + s.bucket + "/" + absolutePath
@@ -65,14 +89,20 @@ func (s *gcsSyncFilestore) UploadFile(
 		}
 	}()
 
-	// Compute crc32 checksum for upload integrity
+	// Compute crc32 checksum for upload integrity, and the sha256 to record
+	// for VerifyFile
 	var fileCRC32C uint32
 	{
 		hasher := crc32.New(crc32.MakeTable(crc32.Castagnoli))
-		if _, err := io.Copy(hasher, in); err != nil {
-			return fmt.Errorf("error computing crc32 checksum: %v", err)
+		sha256Hasher := sha256.New()
+		if _, err := io.Copy(
+			io.MultiWriter(hasher, sha256Hasher), in); err != nil {
+			return fmt.Errorf("error computing checksums: %v", err)
 		}
 		fileCRC32C = hasher.Sum32()
+		if fileSHA256 == "" {
+			fileSHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
+		}
 
 		if _, err := in.Seek(0, 0); err != nil {
 			return fmt.Errorf("error rewinding in file: %v", err)
@@ -85,21 +115,90 @@ func (s *gcsSyncFilestore) UploadFile(
 
 	w.CRC32C = fileCRC32C
 	w.SendCRC32C = true
+	w.Metadata = map[string]string{gcsSHA256MetadataKey: fileSHA256}
+	w.ContentType = contentType
+	w.ContentEncoding = contentEncoding
 
 	// Much bigger chunk size for faster uploading
 	// nolint[gomnd]
 	w.ChunkSize = 128 * 1024 * 1024
 
+	// The upload errors are wrapped, so that transient ones can be retried
+	// (see isTransient())
 	if _, err := io.Copy(w, in); err != nil {
 		if err2 := w.Close(); err2 != nil {
 			klog.Warningf("error closing upload stream: %v", err)
 			// TODO: Try to delete the possibly partially written file?
 		}
-		return fmt.Errorf("error uploading to %q: %v", gcsURL, err)
+		return xerrors.Errorf("error uploading to %q: %w", gcsURL, err)
 	}
 
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("error uploading to %q: %v", gcsURL, err)
+		return xerrors.Errorf("error uploading to %q: %w", gcsURL, err)
+	}
+
+	// GCS does not record a sha256, so check the crc32 it reports for the
+	// uploaded object against the one we computed locally
+	if err := verifyCRC32C(gcsURL, fileCRC32C, w.Attrs()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// verifyCRC32C checks that the crc32 checksum GCS reports for the uploaded
+// object gcsURL (in attrs) is the expected one.
+func verifyCRC32C(
+	gcsURL string,
+	expected uint32,
+	attrs *storage.ObjectAttrs) error {
+	if attrs == nil {
+		return fmt.Errorf(
+			"error verifying %q: no attributes returned for upload", gcsURL)
+	}
+	if attrs.CRC32C != expected {
+		return fmt.Errorf(
+			"crc32c did not match for uploaded file %q: actual=%08x expected=%08x",
+			gcsURL, attrs.CRC32C, expected)
+	}
+
+	return nil
+}
+
+// DeleteFile implements syncFileDeleter.
+func (s *gcsSyncFilestore) DeleteFile(ctx context.Context, name string) error {
+	absolutePath := s.prefix + name
+
+	gcsURL := "gs://" + s.bucket + "/" + absolutePath
+
+	klog.Infof("deleting %s", gcsURL)
+	if err := s.client.Bucket(s.bucket).Object(absolutePath).Delete(
+		ctx); err != nil {
+		return fmt.Errorf("error deleting %q: %v", gcsURL, err)
+	}
+
+	return nil
+}
+
+// VerifyFile checks the sha256 that UploadFile recorded in the metadata of the
+// uploaded file.
+func (s *gcsSyncFilestore) VerifyFile(
+	ctx context.Context,
+	dest string,
+	sha256 string) error {
+	absolutePath := s.prefix + dest
+
+	gcsURL := "gs://" + s.bucket + "/" + absolutePath
+
+	attrs, err := s.client.Bucket(s.bucket).Object(absolutePath).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("error verifying %q: %v", gcsURL, err)
+	}
+	actual := attrs.Metadata[gcsSHA256MetadataKey]
+	if actual != sha256 {
+		return fmt.Errorf(
+			"sha256 did not match for uploaded file %q: actual=%q expected=%q",
+			gcsURL, actual, sha256)
 	}
 
 	return nil
@@ -133,11 +232,11 @@ func (s *gcsSyncFilestore) ListFiles(
 		file := &syncFileInfo{}
 		file.AbsolutePath = "gs://" + s.bucket + "/" + obj.Name
 		file.RelativePath = strings.TrimPrefix(name, s.prefix)
-		if obj.MD5 == nil {
-			return nil, fmt.Errorf("MD5 not set on file %q", file.AbsolutePath)
+		// Composite objects have no MD5, but always have a crc32c.
+		if obj.MD5 != nil {
+			file.MD5 = hex.EncodeToString(obj.MD5)
 		}
-
-		file.MD5 = hex.EncodeToString(obj.MD5)
+		file.CRC32C = fmt.Sprintf("%08x", obj.CRC32C)
 		file.Size = obj.Size
 		file.filestore = s
 
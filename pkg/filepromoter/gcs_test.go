@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestVerifyCRC32C(t *testing.T) {
+	crc := crc32.Checksum(
+		[]byte("hello world"), crc32.MakeTable(crc32.Castagnoli))
+
+	var tests = []struct {
+		name          string
+		attrs         *storage.ObjectAttrs
+		expectedError string
+	}{
+		{
+			name:  "Match",
+			attrs: &storage.ObjectAttrs{CRC32C: crc},
+		},
+		{
+			name:          "Mismatch",
+			attrs:         &storage.ObjectAttrs{CRC32C: crc + 1},
+			expectedError: "crc32c did not match for uploaded file",
+		},
+		{
+			name:          "No attributes",
+			expectedError: "no attributes returned",
+		},
+	}
+
+	for _, test := range tests {
+		err := verifyCRC32C("gs://bucket/hello.txt", crc, test.attrs)
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+}
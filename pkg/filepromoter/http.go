@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// httpResponseHeaderTimeout bounds how long we wait for an HTTP server to
+// start answering a request; the download itself is bounded by the context.
+const httpResponseHeaderTimeout = time.Minute
+
+// httpSyncFilestore is a read-only filestore for files served over HTTP(S),
+// e.g. release artifacts published by another project. It can only be used
+// as a source filestore.
+type httpSyncFilestore struct {
+	filestore *api.Filestore
+	client    *http.Client
+	base      string
+}
+
+// httpStatusError is returned for HTTP responses with an unexpected status.
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status for %q: %s", e.URL, e.Status)
+}
+
+// openHTTPFilestore opens a filestore for the http(s)://host/prefix URL u.
+func openHTTPFilestore(
+	filestore *api.Filestore,
+	u *url.URL) (syncFilestore, error) {
+
+	if !filestore.Src {
+		return nil, fmt.Errorf(
+			"%s filestore %q can only be used as a source",
+			u.Scheme, filestore.Base)
+	}
+	if filestore.ServiceAccount != "" {
+		klog.Warningf(
+			"ignoring service-account %q for HTTP filestore %q",
+			filestore.ServiceAccount, filestore.Base)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = httpResponseHeaderTimeout
+
+	s := &httpSyncFilestore{
+		filestore: filestore,
+		client:    &http.Client{Transport: transport},
+		base:      strings.TrimSuffix(u.String(), "/") + "/",
+	}
+	return s, nil
+}
+
+// fileURL returns the URL of the file name.
+func (s *httpSyncFilestore) fileURL(name string) string {
+	return s.base + strings.TrimPrefix(name, "/")
+}
+
+// do sends a request for the file name, and returns the response if its
+// status is 200.
+func (s *httpSyncFilestore) do(
+	ctx context.Context,
+	method, name string) (*http.Response, error) {
+
+	fileURL := s.fileURL(name)
+	req, err := http.NewRequest(method, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpStatusError{
+			URL:        fileURL,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	return resp, nil
+}
+
+// OpenReader opens an io.ReadCloser for the specified file.
+func (s *httpSyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, name)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// UploadFile is not supported: HTTP filestores are read-only.
+func (s *httpSyncFilestore) UploadFile(
+	ctx context.Context,
+	dest, localFile, contentType string) error {
+	return fmt.Errorf(
+		"cannot upload to %q: HTTP filestores are read-only",
+		s.fileURL(dest))
+}
+
+// ListFiles is not supported: HTTP servers cannot list their files (see
+// StatFiles instead).
+func (s *httpSyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	return nil, fmt.Errorf(
+		"cannot list the files of %q: HTTP filestores cannot be listed",
+		s.filestore.Base)
+}
+
+// StatFiles implements syncFileStatter, with a HEAD request for every file.
+// Files that the server does not have (404) are left out.
+func (s *httpSyncFilestore) StatFiles(
+	ctx context.Context,
+	names []string,
+	retry RetryPolicy) (map[string]*syncFileInfo, error) {
+
+	files := make(map[string]*syncFileInfo)
+	for _, name := range names {
+		fileURL := s.fileURL(name)
+
+		var resp *http.Response
+		err := retry.do(ctx, fileURL, func() error {
+			var err error
+			resp, err = s.do(ctx, http.MethodHead, name)
+			return err
+		})
+		var statusErr *httpStatusError
+		if xerrors.As(err, &statusErr) &&
+			statusErr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error checking %q: %v", fileURL, err)
+		}
+		resp.Body.Close()
+
+		file := &syncFileInfo{}
+		file.RelativePath = name
+		file.AbsolutePath = fileURL
+		file.Size = resp.ContentLength
+		file.filestore = s
+		files[name] = file
+	}
+
+	return files, nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// fakeHTTPServer serves files over HTTP, failing the first GETs of some of
+// them with a 503.
+type fakeHTTPServer struct {
+	mutex sync.Mutex
+	// files maps paths (without the leading slash) to their contents.
+	files map[string][]byte
+	// failures maps paths to the number of GETs that fail.
+	failures map[string]int
+	// gets counts the GETs of every path.
+	gets map[string]int
+}
+
+func (s *fakeHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method == http.MethodGet {
+		s.gets[name]++
+		if s.failures[name] > 0 {
+			s.failures[name]--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	content, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content) // nolint[errcheck]
+}
+
+func newFakeHTTPServer(files map[string][]byte) *fakeHTTPServer {
+	return &fakeHTTPServer{
+		files:    files,
+		failures: make(map[string]int),
+		gets:     make(map[string]int),
+	}
+}
+
+func mustOpenHTTPFilestore(t *testing.T, base string) *httpSyncFilestore {
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("error parsing %q: %v", base, err)
+	}
+	s, err := openHTTPFilestore(&api.Filestore{Base: base, Src: true}, u)
+	if err != nil {
+		t.Fatalf("error opening %q: %v", base, err)
+	}
+	return s.(*httpSyncFilestore)
+}
+
+func TestOpenHTTPFilestore(t *testing.T) {
+	base := "https://example.com/releases"
+	u, _ := url.Parse(base)
+	_, err := openHTTPFilestore(&api.Filestore{Base: base}, u)
+	expected := `https filestore "https://example.com/releases" ` +
+		`can only be used as a source`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestHTTPStatFiles(t *testing.T) {
+	handler := newFakeHTTPServer(map[string][]byte{
+		"releases/a.txt":     []byte("a"),
+		"releases/dir/b.txt": []byte("bb"),
+		"other/c.txt":        []byte("ccc"),
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	s := mustOpenHTTPFilestore(t, server.URL+"/releases/")
+	files, err := s.StatFiles(
+		context.Background(),
+		[]string{"a.txt", "dir/b.txt", "c.txt"},
+		RetryPolicy{})
+	if err != nil {
+		t.Fatalf("error checking files: %v", err)
+	}
+
+	var tests = []struct {
+		relativePath string
+		absolutePath string
+		size         int64
+	}{
+		{"a.txt", server.URL + "/releases/a.txt", 1},
+		{"dir/b.txt", server.URL + "/releases/dir/b.txt", 2},
+	}
+	if len(files) != len(tests) {
+		t.Errorf("expected %d files, got %d", len(tests), len(files))
+	}
+	for _, test := range tests {
+		file := files[test.relativePath]
+		if file == nil {
+			t.Errorf("file %q not found", test.relativePath)
+			continue
+		}
+		if file.AbsolutePath != test.absolutePath {
+			t.Errorf("unexpected absolute path %q for %q",
+				file.AbsolutePath, test.relativePath)
+		}
+		if file.Size != test.size {
+			t.Errorf("unexpected size %d for %q", file.Size, test.relativePath)
+		}
+	}
+
+	if _, err := s.ListFiles(context.Background()); err == nil {
+		t.Errorf("expected an error listing the files")
+	}
+}
+
+func TestHTTPCopyFileOp(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	oksha := hex.EncodeToString(sum[:])
+
+	var tests = []struct {
+		name          string
+		path          string
+		sha256        string
+		failures      int
+		maxRetries    int
+		expectedGets  int
+		expectedError string
+	}{
+		{
+			name:         "Download and verify",
+			path:         "hello.txt",
+			sha256:       oksha,
+			expectedGets: 1,
+		},
+		{
+			name:          "Source does not match the manifest",
+			path:          "hello.txt",
+			sha256:        strings.Repeat("0", 64),
+			expectedGets:  1,
+			expectedError: "sha256 did not match for file",
+		},
+		{
+			name:         "Fails twice, then succeeds",
+			path:         "hello.txt",
+			sha256:       oksha,
+			failures:     2,
+			maxRetries:   3,
+			expectedGets: 3,
+		},
+		{
+			name:          "Retries exhausted",
+			path:          "hello.txt",
+			sha256:        oksha,
+			failures:      2,
+			maxRetries:    1,
+			expectedGets:  2,
+			expectedError: "503 Service Unavailable (after 1 retries)",
+		},
+		{
+			name:          "Not found",
+			path:          "missing.txt",
+			sha256:        oksha,
+			maxRetries:    3,
+			expectedGets:  1,
+			expectedError: "404 Not Found",
+		},
+	}
+
+	for _, test := range tests {
+		handler := newFakeHTTPServer(map[string][]byte{
+			"releases/hello.txt": content,
+		})
+		handler.failures["releases/"+test.path] = test.failures
+		server := httptest.NewServer(handler)
+
+		client := newFakeS3Client()
+		src := mustOpenHTTPFilestore(t, server.URL+"/releases")
+		dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: test.path,
+				AbsolutePath: src.fileURL(test.path),
+				filestore:    src,
+			},
+			Dest: &syncFileInfo{
+				RelativePath: "hello.txt",
+				AbsolutePath: "s3://dest/release/hello.txt",
+				filestore:    dest,
+			},
+			ManifestFile: &api.File{Name: "hello.txt", SHA256: test.sha256},
+			Retry: RetryPolicy{
+				MaxRetries: test.maxRetries,
+				BaseDelay:  time.Millisecond,
+			},
+		}
+
+		err := op.Run(context.Background())
+		server.Close()
+
+		got := handler.gets["releases/"+test.path]
+		if got != test.expectedGets {
+			t.Errorf("%s: expected %d downloads, got %d",
+				test.name, test.expectedGets, got)
+		}
+		uploaded, ok := client.objects["dest/release/hello.txt"]
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			if string(uploaded) != string(content) {
+				t.Errorf("%s: unexpected uploaded contents %q",
+					test.name, uploaded)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %v",
+				test.name, test.expectedError, err)
+		}
+		if ok {
+			t.Errorf("%s: file was uploaded despite the error", test.name)
+		}
+	}
+}
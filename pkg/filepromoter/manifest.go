@@ -31,6 +31,39 @@ type ManifestPromoter struct {
 	// UseServiceAccount must be true, for service accounts to be used
 	// This gives some protection against a hostile manifest.
 	UseServiceAccount bool
+
+	// Force copies every file, even if it already exists in a destination
+	// with the expected contents.
+	Force bool
+
+	// ContentTypes controls the content type of the uploaded files.
+	ContentTypes ContentTypeRules
+
+	// Compression controls which uploaded files are compressed.
+	Compression CompressionRules
+
+	// Retry controls how failed uploads are retried.
+	Retry RetryPolicy
+
+	// VerifyReadBack downloads every uploaded file again, to check its
+	// sha256 against the manifest. This costs as much egress as the uploads.
+	VerifyReadBack bool
+
+	// Skipped is set by BuildOperations to the number of files (across all
+	// destinations) that were not copied, because they already exist.
+	Skipped int
+
+	// Prune deletes the files of the destinations that are not in the
+	// manifest.
+	Prune bool
+
+	// Pruned is set by BuildOperations to the number of files (across all
+	// destinations) that are deleted, if Prune is set.
+	Pruned int
+
+	// Plan is set by BuildOperations to what happens to every file, in every
+	// destination.
+	Plan []PlannedFile
 }
 
 // BuildOperations builds the required operations to sync from the
@@ -44,6 +77,9 @@ func (p *ManifestPromoter) BuildOperations(
 
 	// nolint[prealloc]
 	var operations []SyncFileOp
+	p.Skipped = 0
+	p.Pruned = 0
+	p.Plan = nil
 
 	for i := range p.Manifest.Filestores {
 		filestore := &p.Manifest.Filestores[i]
@@ -56,6 +92,12 @@ func (p *ManifestPromoter) BuildOperations(
 			Dest:              filestore,
 			Files:             p.Manifest.Files,
 			UseServiceAccount: p.UseServiceAccount,
+			Force:             p.Force,
+			ContentTypes:      p.ContentTypes,
+			Compression:       p.Compression,
+			Retry:             p.Retry,
+			VerifyReadBack:    p.VerifyReadBack,
+			Prune:             p.Prune,
 		}
 		ops, err := fp.BuildOperations(ctx)
 		if err != nil {
@@ -64,6 +106,9 @@ func (p *ManifestPromoter) BuildOperations(
 				filestore.Base, err)
 		}
 		operations = append(operations, ops...)
+		p.Skipped += fp.Skipped
+		p.Pruned += fp.Pruned
+		p.Plan = append(p.Plan, fp.Plan...)
 	}
 
 	return operations, nil
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// PlanAction is what a promotion does with a file.
+type PlanAction string
+
+const (
+	// ActionUpload is for files that are copied to the destination.
+	ActionUpload PlanAction = "upload"
+	// ActionSkip is for files that already exist in the destination.
+	ActionSkip PlanAction = "skip"
+	// ActionDelete is for files that are pruned from the destination.
+	ActionDelete PlanAction = "delete"
+)
+
+// PlannedFile is an entry of the plan of a promotion, which describes what
+// happens to a file, so that it can be previewed in dry runs.
+type PlannedFile struct {
+	// Source is the absolute path of the source file (empty for deletes).
+	Source string
+
+	// Destination is the absolute path of the file in the destination.
+	Destination string
+
+	// Size is the size of the file, in bytes.
+	Size int64
+
+	Action PlanAction
+}
+
+// String is the pretty-printer for a PlannedFile.
+func (f PlannedFile) String() string {
+	size := fmt.Sprintf("%d bytes", f.Size)
+	if f.Size < 0 {
+		size = "unknown size"
+	}
+	if f.Source == "" {
+		return fmt.Sprintf(
+			"%s %q (%s)",
+			strings.ToUpper(string(f.Action)), f.Destination, size)
+	}
+	return fmt.Sprintf(
+		"%s %q to %q (%s)",
+		strings.ToUpper(string(f.Action)), f.Source, f.Destination, size)
+}
+
+// WritePlan writes the plan to w, one file per line.
+func WritePlan(w io.Writer, plan []PlannedFile) error {
+	for _, f := range plan {
+		if _, err := fmt.Fprintln(w, f); err != nil {
+			return fmt.Errorf("error writing to output: %v", err)
+		}
+	}
+	return nil
+}
+
+// addToPlan records in p.Plan that the manifest file f is promoted from
+// source to dest with the given action.
+func (p *FilestorePromoter) addToPlan(
+	action PlanAction,
+	source, dest *syncFileInfo,
+	f *api.File) {
+
+	// Like CheckTotalFileSize, fall back to the size in the manifest if the
+	// source filestore does not report one (a negative size is unknown)
+	size := source.Size
+	if size <= 0 && f.Size > 0 {
+		size = f.Size
+	}
+
+	p.Plan = append(p.Plan, PlannedFile{
+		Source:      source.AbsolutePath,
+		Destination: dest.AbsolutePath,
+		Size:        size,
+		Action:      action,
+	})
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestPlan(t *testing.T) {
+	ctx := context.Background()
+
+	hello := []byte("hello world")
+	helloSum := sha256.Sum256(hello)
+	goodbye := []byte("goodbye")
+	goodbyeSum := sha256.Sum256(goodbye)
+
+	client := newFakeS3Client()
+	client.objects["src/files/hello.txt"] = hello
+	client.objects["src/files/goodbye.txt"] = goodbye
+	client.objects["dest/release/hello.txt"] = hello
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	sourceFiles, err := src.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing source files: %v", err)
+	}
+	destFiles, err := dest.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing dest files: %v", err)
+	}
+
+	p := &FilestorePromoter{
+		Source: &api.Filestore{Base: "s3://src/files"},
+		Dest:   &api.Filestore{Base: "s3://dest/release"},
+		Files: []api.File{
+			{Name: "goodbye.txt", SHA256: hex.EncodeToString(goodbyeSum[:])},
+			{Name: "hello.txt", SHA256: hex.EncodeToString(helloSum[:])},
+		},
+	}
+	if _, err := p.computeNeededOperations(
+		ctx, sourceFiles, destFiles, dest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := WritePlan(&out, p.Plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `UPLOAD "s3://src/files/goodbye.txt" to ` +
+		`"s3://dest/release/goodbye.txt" (7 bytes)
+SKIP "s3://src/files/hello.txt" to "s3://dest/release/hello.txt" (11 bytes)
+`
+	if out.String() != expected {
+		t.Errorf("expected plan:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// Planning does not write to any filestore
+	if len(client.objects) != 3 || len(client.contentTypes) != 0 ||
+		len(client.deleted) != 0 {
+		t.Errorf("unexpected writes: %v", client.objects)
+	}
+}
+
+func TestPlanSizeFromManifest(t *testing.T) {
+	p := &FilestorePromoter{}
+	p.addToPlan(
+		ActionUpload,
+		&syncFileInfo{AbsolutePath: "https://example.com/a", Size: -1},
+		&syncFileInfo{AbsolutePath: "s3://dest/a"},
+		&api.File{Name: "a", Size: 42})
+
+	expected := PlannedFile{
+		Source:      "https://example.com/a",
+		Destination: "s3://dest/a",
+		Size:        42,
+		Action:      ActionUpload,
+	}
+	if len(p.Plan) != 1 || p.Plan[0] != expected {
+		t.Errorf("expected plan %v, got %v", expected, p.Plan)
+	}
+
+	// Without a size in the manifest either, the size stays unknown
+	p.Plan = nil
+	p.addToPlan(
+		ActionUpload,
+		&syncFileInfo{AbsolutePath: "https://example.com/b", Size: -1},
+		&syncFileInfo{AbsolutePath: "s3://dest/b"},
+		&api.File{Name: "b"})
+
+	expectedLine := `UPLOAD "https://example.com/b" to "s3://dest/b" ` +
+		`(unknown size)`
+	if len(p.Plan) != 1 || p.Plan[0].String() != expectedLine {
+		t.Errorf("expected plan %q, got %v", expectedLine, p.Plan)
+	}
+}
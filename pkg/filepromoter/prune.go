@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog"
+)
+
+// deleteFileOp manages deleting a single file, when pruning a destination.
+type deleteFileOp struct {
+	Dest *syncFileInfo
+
+	// Retry controls how a failed deletion is retried.
+	Retry RetryPolicy
+}
+
+// Run implements SyncFileOp.Run
+func (o *deleteFileOp) Run(ctx context.Context) error {
+	deleter, ok := o.Dest.filestore.(syncFileDeleter)
+	if !ok {
+		return fmt.Errorf(
+			"cannot delete %q: the filestore does not support deletions",
+			o.Dest.AbsolutePath)
+	}
+
+	err := o.Retry.do(ctx, o.Dest.AbsolutePath, func() error {
+		return deleter.DeleteFile(ctx, o.Dest.RelativePath)
+	})
+	if err != nil {
+		klog.Errorf("error pruning %q: %v", o.Dest.AbsolutePath, err)
+		return err
+	}
+	klog.Infof("pruned %q", o.Dest.AbsolutePath)
+	return nil
+}
+
+// String is the pretty-printer for an operation, as used by dry-run.
+func (o *deleteFileOp) String() string {
+	return fmt.Sprintf("DELETE %q", o.Dest.AbsolutePath)
+}
+
+// computePruneOperations returns the operations that delete the files of the
+// destination (dest, listed under its prefix) that are not promoted to it,
+// i.e. not in destNames. It refuses to prune if no file at all is promoted,
+// as that would empty the destination.
+func (p *FilestorePromoter) computePruneOperations(
+	dest map[string]*syncFileInfo,
+	destNames map[string]string,
+	destFilestore syncFilestore) ([]SyncFileOp, error) {
+	if _, ok := destFilestore.(syncFileDeleter); !ok {
+		return nil, fmt.Errorf(
+			"cannot prune %q: the filestore does not support deletions",
+			p.Dest.Base)
+	}
+	if len(destNames) == 0 {
+		return nil, fmt.Errorf(
+			"refusing to prune %q: the manifest has no files",
+			p.Dest.Base)
+	}
+
+	// Sort the files, for a consistent plan
+	names := make([]string, 0, len(dest))
+	for name := range dest {
+		if _, ok := destNames[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	ops := make([]SyncFileOp, 0, len(names))
+	for _, name := range names {
+		destFile := dest[name]
+		klog.Infof("would prune %q: not in the manifest", destFile.AbsolutePath)
+		p.Plan = append(p.Plan, PlannedFile{
+			Destination: destFile.AbsolutePath,
+			Size:        destFile.Size,
+			Action:      ActionDelete,
+		})
+		ops = append(ops, &deleteFileOp{Dest: destFile, Retry: p.Retry})
+	}
+	p.Pruned = len(ops)
+
+	return ops, nil
+}
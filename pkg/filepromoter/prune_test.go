@@ -0,0 +1,226 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/k8s-container-image-promoter/lib/auditlog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// pruneTestPromoter returns a promoter of hello.txt from s3://src/files to
+// s3://dest/release, where hello.txt is already present, along with files
+// that are not in the manifest.
+func pruneTestPromoter(
+	t *testing.T,
+	client *fakeS3Client,
+	prune bool) (*FilestorePromoter, []SyncFileOp) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+
+	client.objects["src/files/hello.txt"] = content
+	client.objects["dest/release/hello.txt"] = content
+	client.objects["dest/release/old.txt"] = []byte("old")
+	client.objects["dest/release/v1/old.txt"] = []byte("older")
+	// Not under the prefix of the destination
+	client.objects["dest/other/old.txt"] = []byte("other")
+
+	src := mustOpenS3Filestore(t, "s3://src/files", client)
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	sourceFiles, err := src.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing source files: %v", err)
+	}
+	destFiles, err := dest.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("error listing dest files: %v", err)
+	}
+
+	p := &FilestorePromoter{
+		Source: &api.Filestore{Base: "s3://src/files"},
+		Dest:   &api.Filestore{Base: "s3://dest/release"},
+		Files: []api.File{
+			{Name: "hello.txt", SHA256: hex.EncodeToString(sum[:])},
+		},
+		Prune: prune,
+	}
+	ops, err := p.computeNeededOperations(ctx, sourceFiles, destFiles, dest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return p, ops
+}
+
+func TestPrune(t *testing.T) {
+	client := newFakeS3Client()
+	p, ops := pruneTestPromoter(t, client, true)
+
+	if p.Skipped != 1 || p.Pruned != 2 {
+		t.Errorf("expected 1 skipped and 2 pruned, got %d and %d",
+			p.Skipped, p.Pruned)
+	}
+
+	var out bytes.Buffer
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	log := &auditlog.Log{
+		Out: &out,
+		Now: func() time.Time { return now },
+	}
+	ops = AuditOperations(ops, log, "files.yaml")
+	for _, result := range RunOperations(context.Background(), ops, 1) {
+		if result.Err != nil {
+			t.Errorf("unexpected error: %v", result.Err)
+		}
+	}
+
+	expectedDeleted := []string{
+		"dest/release/old.txt",
+		"dest/release/v1/old.txt",
+	}
+	if !reflect.DeepEqual(client.deleted, expectedDeleted) {
+		t.Errorf("expected %v to be deleted, got %v",
+			expectedDeleted, client.deleted)
+	}
+	for _, key := range []string{
+		"dest/release/hello.txt",
+		"dest/other/old.txt",
+	} {
+		if _, ok := client.objects[key]; !ok {
+			t.Errorf("expected %q not to be deleted", key)
+		}
+	}
+
+	// The deletions are audited
+	var got []auditlog.Entry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e auditlog.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid audit log line %q: %v", line, err)
+		}
+		got = append(got, e)
+	}
+	var expected []auditlog.Entry
+	for _, key := range expectedDeleted {
+		expected = append(expected, auditlog.Entry{
+			Time:        now,
+			Kind:        "file",
+			Operation:   "delete",
+			Destination: "s3://" + key,
+			Result:      "success",
+			Manifest:    "files.yaml",
+		})
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected audit log %v, got %v", expected, got)
+	}
+}
+
+func TestPruneDisabled(t *testing.T) {
+	client := newFakeS3Client()
+	p, ops := pruneTestPromoter(t, client, false)
+
+	if len(ops) != 0 || p.Pruned != 0 {
+		t.Errorf("expected no operations, got %v", ops)
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	client := newFakeS3Client()
+	p, _ := pruneTestPromoter(t, client, true)
+
+	var out bytes.Buffer
+	if err := WritePlan(&out, p.Plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `SKIP "s3://src/files/hello.txt" to ` +
+		`"s3://dest/release/hello.txt" (11 bytes)
+DELETE "s3://dest/release/old.txt" (3 bytes)
+DELETE "s3://dest/release/v1/old.txt" (5 bytes)
+`
+	if out.String() != expected {
+		t.Errorf("expected plan:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if len(client.deleted) != 0 {
+		t.Errorf("unexpected deletions: %v", client.deleted)
+	}
+}
+
+func TestPruneErrors(t *testing.T) {
+	client := newFakeS3Client()
+	dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+	u, err := url.Parse("https://example.com/release")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	httpFilestore := &api.Filestore{
+		Base: "https://example.com/release",
+		Src:  true,
+	}
+	httpDest, err := openHTTPFilestore(httpFilestore, u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tests = []struct {
+		name          string
+		destFilestore syncFilestore
+		destNames     map[string]string
+		expectedError string
+	}{
+		{
+			name:          "No files in the manifest",
+			destFilestore: dest,
+			expectedError: `refusing to prune "s3://dest/release": ` +
+				"the manifest has no files",
+		},
+		{
+			name:          "Filestore without deletions",
+			destFilestore: httpDest,
+			destNames:     map[string]string{"hello.txt": "hello.txt"},
+			expectedError: `cannot prune "s3://dest/release": ` +
+				"the filestore does not support deletions",
+		},
+	}
+
+	for _, test := range tests {
+		p := &FilestorePromoter{
+			Dest:  &api.Filestore{Base: "s3://dest/release"},
+			Prune: true,
+		}
+		_, err := p.computePruneOperations(
+			map[string]*syncFileInfo{}, test.destNames, test.destFilestore)
+		if err == nil || err.Error() != test.expectedError {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/api/googleapi"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultUploadRetries is the default number of times a failed upload is
+	// retried.
+	DefaultUploadRetries = 3
+
+	// DefaultUploadRetryBaseDelay is the default delay before the first retry
+	// of a failed upload. The delay doubles with every retry.
+	DefaultUploadRetryBaseDelay = time.Second
+
+	// maxUploadRetryDelay caps the delay between two retries.
+	maxUploadRetryDelay = 30 * time.Second
+)
+
+// RetryPolicy controls how downloads and uploads that fail with a transient
+// error (see isTransient()) are retried. Uploads are idempotent, as they
+// always write the same contents to the same destination. The zero value does
+// not retry.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a failed operation is retried.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry; it doubles with every
+	// retry, up to maxUploadRetryDelay.
+	BaseDelay time.Duration
+}
+
+// do calls fn until it succeeds, fails with an error that is not transient,
+// or the retries are exhausted, and returns its last error. what describes
+// the operation in the logs.
+func (p RetryPolicy) do(
+	ctx context.Context,
+	what string,
+	fn func() error) error {
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			if attempt > 0 {
+				return fmt.Errorf("%v (after %d retries)", err, attempt)
+			}
+			return err
+		}
+
+		delay := p.delay(attempt)
+		klog.Warningf("%s: %v; retrying in %v (retry %d of %d)",
+			what, err, delay, attempt+1, p.MaxRetries)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%v (gave up retrying: %v)", err, ctx.Err())
+		}
+	}
+}
+
+// delay computes how long to wait before the given (zero-based) retry.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && delay < maxUploadRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxUploadRetryDelay {
+		delay = maxUploadRetryDelay
+	}
+	return delay
+}
+
+// isTransient returns true for errors that denote a (probably) temporary
+// failure: GCS and HTTP errors with a transient status code, network timeouts
+// and connections dropped mid-transfer. Cancellations are never transient.
+func isTransient(err error) bool {
+	if xerrors.Is(err, context.Canceled) ||
+		xerrors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if xerrors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.Code)
+	}
+
+	var statusErr *httpStatusError
+	if xerrors.As(err, &statusErr) {
+		return isTransientStatus(statusErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if xerrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return xerrors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTransientStatus returns true for the HTTP status codes of requests that
+// are worth retrying.
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
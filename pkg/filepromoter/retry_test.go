@@ -0,0 +1,251 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/api/googleapi"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+// flakyFilestore is a syncFilestore whose uploads of some files fail a number
+// of times before being passed on to the wrapped filestore.
+type flakyFilestore struct {
+	syncFilestore
+
+	mutex sync.Mutex
+	// failures maps a destination to the errors its uploads fail with, in
+	// order.
+	failures map[string][]error
+	// attempts counts the uploads of every destination.
+	attempts map[string]int
+}
+
+func (s *flakyFilestore) UploadFile(
+	ctx context.Context,
+	dest, localFile, contentType string) error {
+	s.mutex.Lock()
+	s.attempts[dest]++
+	var err error
+	if len(s.failures[dest]) > 0 {
+		err = s.failures[dest][0]
+		s.failures[dest] = s.failures[dest][1:]
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return s.syncFilestore.UploadFile(ctx, dest, localFile, contentType)
+}
+
+func TestCopyFileOpRetries(t *testing.T) {
+	unavailable := &googleapi.Error{
+		Code:    http.StatusServiceUnavailable,
+		Message: "backend unavailable",
+	}
+	forbidden := &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "access denied",
+	}
+
+	var tests = []struct {
+		name             string
+		failures         []error
+		maxRetries       int
+		expectedAttempts int
+		expectedError    string
+	}{
+		{
+			name:             "Fails twice, then succeeds",
+			failures:         []error{unavailable, unavailable},
+			maxRetries:       3,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "Retries exhausted",
+			failures:         []error{unavailable, unavailable},
+			maxRetries:       1,
+			expectedAttempts: 2,
+			expectedError: "googleapi: Error 503: backend unavailable " +
+				"(after 1 retries)",
+		},
+		{
+			name:             "Permanent error",
+			failures:         []error{forbidden},
+			maxRetries:       3,
+			expectedAttempts: 1,
+			expectedError:    "googleapi: Error 403: access denied",
+		},
+	}
+
+	for _, test := range tests {
+		client := newFakeS3Client()
+		client.objects["src/files/flaky.txt"] = []byte("flaky")
+		client.objects["src/files/steady.txt"] = []byte("steady")
+
+		src := mustOpenS3Filestore(t, "s3://src/files", client)
+		dest := &flakyFilestore{
+			syncFilestore: mustOpenS3Filestore(t, "s3://dest/release", client),
+			failures:      map[string][]error{"flaky.txt": test.failures},
+			attempts:      make(map[string]int),
+		}
+
+		var ops []SyncFileOp
+		for _, name := range []string{"flaky.txt", "steady.txt"} {
+			content := client.objects["src/files/"+name]
+			sha256, _ := ComputeSHA256(strings.NewReader(string(content)))
+			ops = append(ops, &copyFileOp{
+				Source: &syncFileInfo{
+					RelativePath: name,
+					AbsolutePath: "s3://src/files/" + name,
+					filestore:    src,
+				},
+				Dest: &syncFileInfo{
+					RelativePath: name,
+					AbsolutePath: "s3://dest/release/" + name,
+					filestore:    dest,
+				},
+				ManifestFile: &api.File{Name: name, SHA256: sha256},
+				Retry: RetryPolicy{
+					MaxRetries: test.maxRetries,
+					BaseDelay:  time.Millisecond,
+				},
+			})
+		}
+
+		results := RunOperations(context.Background(), ops, 2)
+
+		if got := dest.attempts["flaky.txt"]; got != test.expectedAttempts {
+			t.Errorf("%s: expected %d attempts, got %d",
+				test.name, test.expectedAttempts, got)
+		}
+
+		// results are sorted by op, so the flaky file comes first.
+		err := results[0].Err
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			if _, ok := client.objects["dest/release/flaky.txt"]; !ok {
+				t.Errorf("%s: flaky file was not uploaded", test.name)
+			}
+		} else {
+			if err == nil || err.Error() != test.expectedError {
+				t.Errorf("%s: expected error %q, got %v",
+					test.name, test.expectedError, err)
+			}
+			if _, ok := client.objects["dest/release/flaky.txt"]; ok {
+				t.Errorf("%s: flaky file was uploaded", test.name)
+			}
+		}
+
+		// The other file is always uploaded.
+		if err := results[1].Err; err != nil {
+			t.Errorf("%s: unexpected error for the other file: %v",
+				test.name, err)
+		}
+		if _, ok := client.objects["dest/release/steady.txt"]; !ok {
+			t.Errorf("%s: other file was not uploaded", test.name)
+		}
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			"Service unavailable",
+			&googleapi.Error{Code: http.StatusServiceUnavailable},
+			true,
+		},
+		{
+			"Too many requests (wrapped)",
+			xerrors.Errorf("error uploading to %q: %w", "gs://bucket/file",
+				&googleapi.Error{Code: http.StatusTooManyRequests}),
+			true,
+		},
+		{
+			"Forbidden",
+			&googleapi.Error{Code: http.StatusForbidden},
+			false,
+		},
+		{
+			"HTTP bad gateway",
+			xerrors.Errorf("error reading %q: %w", "https://example.com/file",
+				&httpStatusError{StatusCode: http.StatusBadGateway}),
+			true,
+		},
+		{
+			"HTTP not found",
+			&httpStatusError{StatusCode: http.StatusNotFound},
+			false,
+		},
+		{
+			"Network timeout",
+			timeoutError{},
+			true,
+		},
+		{
+			"Connection dropped",
+			xerrors.Errorf("error uploading: %w", io.ErrUnexpectedEOF),
+			true,
+		},
+		{
+			"Cancelled",
+			xerrors.Errorf("error uploading: %w", context.Canceled),
+			false,
+		},
+		{
+			"Unknown error",
+			errors.New("checksum mismatch"),
+			false,
+		},
+		{
+			"Unwrapped error",
+			fmt.Errorf("error uploading: %v",
+				&googleapi.Error{Code: http.StatusServiceUnavailable}),
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SyncFileOpResult is the outcome of running a SyncFileOp.
+type SyncFileOpResult struct {
+	Op  SyncFileOp
+	Err error
+}
+
+// RunOperations runs ops, with at most workers operations running
+// concurrently. An error in one operation does not prevent the remaining
+// operations from running.
+//
+// The results of all the operations are returned, sorted by their
+// pretty-printed form, so that the output does not depend on scheduling.
+func RunOperations(
+	ctx context.Context,
+	ops []SyncFileOp,
+	workers int) []SyncFileOpResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]SyncFileOpResult, len(ops))
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = SyncFileOpResult{
+					Op:  ops[i],
+					Err: ops[i].Run(ctx),
+				}
+			}
+		}()
+	}
+
+	for i := range ops {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return fmt.Sprint(results[i].Op) < fmt.Sprint(results[j].Op)
+	})
+
+	return results
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyTracker records the maximum number of concurrent operations.
+type concurrencyTracker struct {
+	mutex   sync.Mutex
+	running int
+	max     int
+}
+
+func (c *concurrencyTracker) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+}
+
+func (c *concurrencyTracker) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running--
+}
+
+// fakeOp is a SyncFileOp that takes a little while to upload.
+type fakeOp struct {
+	name    string
+	err     error
+	tracker *concurrencyTracker
+}
+
+func (o *fakeOp) Run(ctx context.Context) error {
+	o.tracker.start()
+	defer o.tracker.stop()
+	time.Sleep(10 * time.Millisecond)
+	return o.err
+}
+
+func (o *fakeOp) String() string {
+	return "UPLOAD " + o.name
+}
+
+func TestRunOperations(t *testing.T) {
+	var tests = []struct {
+		name           string
+		workers        int
+		expectedMaxRun int
+	}{
+		{"Serial", 1, 1},
+		{"Default to serial", 0, 1},
+		{"Bounded", 3, 3},
+		{"More workers than operations", 20, 8},
+	}
+
+	for _, test := range tests {
+		tracker := &concurrencyTracker{}
+		var ops []SyncFileOp
+		for i := 7; i >= 0; i-- {
+			op := &fakeOp{name: fmt.Sprintf("file-%d", i), tracker: tracker}
+			if i%4 == 1 {
+				op.err = fmt.Errorf("error uploading %s", op.name)
+			}
+			ops = append(ops, op)
+		}
+
+		results := RunOperations(context.Background(), ops, test.workers)
+
+		if tracker.max != test.expectedMaxRun {
+			t.Errorf("%s: expected max concurrency %d, got %d",
+				test.name, test.expectedMaxRun, tracker.max)
+		}
+		if len(results) != len(ops) {
+			t.Fatalf("%s: expected %d results, got %d",
+				test.name, len(ops), len(results))
+		}
+
+		var errors []error
+		for i, result := range results {
+			expected := fmt.Sprintf("UPLOAD file-%d", i)
+			if got := fmt.Sprint(result.Op); got != expected {
+				t.Errorf("%s: expected result %d to be %q, got %q",
+					test.name, i, expected, got)
+			}
+			if result.Err != nil {
+				errors = append(errors, result.Err)
+			}
+		}
+		if len(errors) != 2 ||
+			errors[0].Error() != "error uploading file-1" ||
+			errors[1].Error() != "error uploading file-5" {
+			t.Errorf("%s: unexpected errors %v", test.name, errors)
+		}
+	}
+}
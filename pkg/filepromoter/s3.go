@@ -0,0 +1,190 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog"
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/aws"
+)
+
+// s3Client is the set of S3 operations used by s3SyncFilestore. It is
+// implemented by aws.S3CLI, and faked in tests.
+type s3Client interface {
+	ListObjects(
+		ctx context.Context,
+		bucket, prefix string) ([]aws.S3Object, error)
+	OpenObject(
+		ctx context.Context,
+		bucket, key string) (io.ReadCloser, error)
+	PutObject(
+		ctx context.Context,
+		bucket, key, localFile, sha256, contentType string) error
+	ObjectSHA256(
+		ctx context.Context,
+		bucket, key string) (string, error)
+	DeleteObject(
+		ctx context.Context,
+		bucket, key string) error
+}
+
+type s3SyncFilestore struct {
+	filestore *api.Filestore
+	client    s3Client
+	bucket    string
+	prefix    string
+}
+
+// openS3Filestore opens a filestore for the s3://bucket/prefix URL u.
+// Credentials are resolved by the client (for aws.S3CLI, with the standard AWS
+// credential chain), so the service-account of the filestore is not used.
+func openS3Filestore(
+	filestore *api.Filestore,
+	u *url.URL,
+	client s3Client) (syncFilestore, error) {
+
+	if filestore.ServiceAccount != "" {
+		klog.Warningf(
+			"ignoring service-account %q for S3 filestore %q",
+			filestore.ServiceAccount, filestore.Base)
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	s := &s3SyncFilestore{
+		filestore: filestore,
+		client:    client,
+		bucket:    u.Host,
+		prefix:    prefix,
+	}
+	return s, nil
+}
+
+// OpenReader opens an io.ReadCloser for the specified file.
+func (s *s3SyncFilestore) OpenReader(
+	ctx context.Context,
+	name string) (io.ReadCloser, error) {
+	absolutePath := s.prefix + name
+	return s.client.OpenObject(ctx, s.bucket, absolutePath)
+}
+
+// UploadFile uploads a local file to the specified destination.
+func (s *s3SyncFilestore) UploadFile(
+	ctx context.Context,
+	dest string,
+	localFile string,
+	contentType string) error {
+	absolutePath := s.prefix + dest
+
+	s3URL := "s3://" + s.bucket + "/" + absolutePath
+
+	// The sha256 is sent along with the upload, so that S3 can check the
+	// upload integrity (and record the sha256 for VerifyFile)
+	sha256, err := ComputeSHA256ForFile(localFile)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("uploading to %s", s3URL)
+	if err := s.client.PutObject(
+		ctx, s.bucket, absolutePath, localFile, sha256,
+		contentType); err != nil {
+		return fmt.Errorf("error uploading to %q: %v", s3URL, err)
+	}
+
+	return nil
+}
+
+// DeleteFile implements syncFileDeleter.
+func (s *s3SyncFilestore) DeleteFile(ctx context.Context, name string) error {
+	absolutePath := s.prefix + name
+
+	s3URL := "s3://" + s.bucket + "/" + absolutePath
+
+	klog.Infof("deleting %s", s3URL)
+	if err := s.client.DeleteObject(ctx, s.bucket, absolutePath); err != nil {
+		return fmt.Errorf("error deleting %q: %v", s3URL, err)
+	}
+
+	return nil
+}
+
+// VerifyFile checks the sha256 that S3 recorded for the uploaded file.
+func (s *s3SyncFilestore) VerifyFile(
+	ctx context.Context,
+	dest string,
+	sha256 string) error {
+	absolutePath := s.prefix + dest
+
+	s3URL := "s3://" + s.bucket + "/" + absolutePath
+
+	actual, err := s.client.ObjectSHA256(ctx, s.bucket, absolutePath)
+	if err != nil {
+		return fmt.Errorf("error verifying %q: %v", s3URL, err)
+	}
+	if actual != sha256 {
+		return fmt.Errorf(
+			"sha256 did not match for uploaded file %q: actual=%q expected=%q",
+			s3URL, actual, sha256)
+	}
+
+	return nil
+}
+
+// ListFiles returns all the file artifacts in the filestore, recursively.
+func (s *s3SyncFilestore) ListFiles(
+	ctx context.Context) (map[string]*syncFileInfo, error) {
+	files := make(map[string]*syncFileInfo)
+
+	klog.Infof("listing files in bucket %s with prefix %q", s.bucket, s.prefix)
+	objects, err := s.client.ListObjects(ctx, s.bucket, s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing objects in %q: %v",
+			s.filestore.Base, err)
+	}
+
+	for _, obj := range objects {
+		name := obj.Key
+		if !strings.HasPrefix(name, s.prefix) {
+			return nil, fmt.Errorf(
+				"found object %q without prefix %q",
+				name, s.prefix)
+		}
+
+		file := &syncFileInfo{}
+		file.AbsolutePath = "s3://" + s.bucket + "/" + obj.Key
+		file.RelativePath = strings.TrimPrefix(name, s.prefix)
+		// The ETag is the MD5, except for multipart uploads (whose ETag has
+		// a "-<parts>" suffix); those are checked with VerifyFile instead.
+		file.MD5 = obj.ETag
+		file.Size = obj.Size
+		file.filestore = s
+		files[file.RelativePath] = file
+	}
+
+	return files, nil
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+	"sigs.k8s.io/k8s-container-image-promoter/pkg/aws"
+)
+
+// fakeS3Client is an in-memory s3Client, keyed by "bucket/key". It is safe for
+// concurrent use, as the operations run in parallel (see RunOperations()).
+type fakeS3Client struct {
+	mutex sync.Mutex
+
+	objects   map[string][]byte
+	checksums map[string]string
+
+	// contentTypes maps the key of uploaded objects to their content type.
+	contentTypes map[string]string
+
+	// corruptUploads makes uploads record a bogus checksum.
+	corruptUploads bool
+
+	// corruptReadsOf makes reads of the objects in this bucket return
+	// corrupted contents (while their checksums are still correct).
+	corruptReadsOf string
+
+	// sha256Lookups counts the calls to ObjectSHA256.
+	sha256Lookups int
+
+	// deleted lists the keys of the deleted objects.
+	deleted []string
+}
+
+func newFakeS3Client() *fakeS3Client {
+	return &fakeS3Client{
+		objects:      make(map[string][]byte),
+		checksums:    make(map[string]string),
+		contentTypes: make(map[string]string),
+	}
+}
+
+func (c *fakeS3Client) ListObjects(
+	ctx context.Context,
+	bucket, prefix string) ([]aws.S3Object, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var objects []aws.S3Object
+	for k, data := range c.objects {
+		if !strings.HasPrefix(k, bucket+"/"+prefix) {
+			continue
+		}
+		md5sum := md5.Sum(data)
+		objects = append(objects, aws.S3Object{
+			Key:  strings.TrimPrefix(k, bucket+"/"),
+			Size: int64(len(data)),
+			ETag: hex.EncodeToString(md5sum[:]),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (c *fakeS3Client) OpenObject(
+	ctx context.Context,
+	bucket, key string) (io.ReadCloser, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	data, ok := c.objects[bucket+"/"+key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s/%s", bucket, key)
+	}
+	if bucket == c.corruptReadsOf {
+		data = append([]byte("corrupted "), data...)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *fakeS3Client) PutObject(
+	ctx context.Context,
+	bucket, key, localFile, sha256, contentType string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	data, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	c.objects[bucket+"/"+key] = data
+	c.contentTypes[bucket+"/"+key] = contentType
+	c.checksums[bucket+"/"+key] = sha256
+	if c.corruptUploads {
+		c.checksums[bucket+"/"+key] = "bogus"
+	}
+	return nil
+}
+
+func (c *fakeS3Client) ObjectSHA256(
+	ctx context.Context,
+	bucket, key string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sha256Lookups++
+	checksum, ok := c.checksums[bucket+"/"+key]
+	if !ok {
+		return "", fmt.Errorf("no sha256 checksum recorded")
+	}
+	return checksum, nil
+}
+
+func (c *fakeS3Client) DeleteObject(
+	ctx context.Context,
+	bucket, key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.objects, bucket+"/"+key)
+	delete(c.checksums, bucket+"/"+key)
+	c.deleted = append(c.deleted, bucket+"/"+key)
+	return nil
+}
+
+func mustOpenS3Filestore(
+	t *testing.T,
+	base string,
+	client s3Client) *s3SyncFilestore {
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("error parsing %q: %v", base, err)
+	}
+	s, err := openS3Filestore(&api.Filestore{Base: base}, u, client)
+	if err != nil {
+		t.Fatalf("error opening %q: %v", base, err)
+	}
+	return s.(*s3SyncFilestore)
+}
+
+func TestS3ListFiles(t *testing.T) {
+	client := newFakeS3Client()
+	client.objects["bucket/prefix/a.txt"] = []byte("a")
+	client.objects["bucket/prefix/dir/b.txt"] = []byte("bb")
+	client.objects["bucket/other/c.txt"] = []byte("ccc")
+
+	s := mustOpenS3Filestore(t, "s3://bucket/prefix", client)
+	if s.bucket != "bucket" || s.prefix != "prefix/" {
+		t.Errorf("unexpected bucket %q and prefix %q", s.bucket, s.prefix)
+	}
+
+	files, err := s.ListFiles(context.Background())
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+
+	var tests = []struct {
+		relativePath string
+		absolutePath string
+		size         int64
+	}{
+		{"a.txt", "s3://bucket/prefix/a.txt", 1},
+		{"dir/b.txt", "s3://bucket/prefix/dir/b.txt", 2},
+	}
+	if len(files) != len(tests) {
+		t.Errorf("expected %d files, got %d", len(tests), len(files))
+	}
+	for _, test := range tests {
+		file := files[test.relativePath]
+		if file == nil {
+			t.Errorf("file %q not listed", test.relativePath)
+			continue
+		}
+		if file.AbsolutePath != test.absolutePath {
+			t.Errorf("unexpected absolute path %q for %q",
+				file.AbsolutePath, test.relativePath)
+		}
+		if file.Size != test.size {
+			t.Errorf("unexpected size %d for %q", file.Size, test.relativePath)
+		}
+		if file.MD5 == "" {
+			t.Errorf("MD5 not set for %q", test.relativePath)
+		}
+	}
+}
+
+func TestS3CopyFileOp(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	oksha := hex.EncodeToString(sum[:])
+
+	var tests = []struct {
+		name           string
+		sha256         string
+		sha512         string
+		corruptUploads bool
+		corruptReads   bool
+		verifyReadBack bool
+		expectedError  string
+	}{
+		{
+			name:   "Copy and verify",
+			sha256: oksha,
+		},
+		{
+			name:          "Source does not match the manifest",
+			sha256:        strings.Repeat("0", 64),
+			expectedError: "sha256 did not match for file",
+		},
+		{
+			name:          "Source does not match the manifest sha512",
+			sha256:        oksha,
+			sha512:        strings.Repeat("0", 128),
+			expectedError: "sha512 did not match for file",
+		},
+		{
+			name:           "Upload does not match the manifest",
+			sha256:         oksha,
+			corruptUploads: true,
+			expectedError:  "sha256 did not match for uploaded file",
+		},
+		{
+			name:           "Copy and read back",
+			sha256:         oksha,
+			verifyReadBack: true,
+		},
+		{
+			// The checksums recorded by the store are fine, so this is only
+			// caught by reading the file back
+			name:         "Corrupted read back, not verified",
+			sha256:       oksha,
+			corruptReads: true,
+		},
+		{
+			name:           "Corrupted read back",
+			sha256:         oksha,
+			corruptReads:   true,
+			verifyReadBack: true,
+			expectedError: "sha256 did not match for uploaded file " +
+				`"s3://dest/release/hello.txt" when read back`,
+		},
+	}
+
+	for _, test := range tests {
+		client := newFakeS3Client()
+		client.objects["src/files/hello.txt"] = content
+		client.corruptUploads = test.corruptUploads
+		if test.corruptReads {
+			client.corruptReadsOf = "dest"
+		}
+
+		src := mustOpenS3Filestore(t, "s3://src/files", client)
+		dest := mustOpenS3Filestore(t, "s3://dest/release", client)
+
+		op := &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: "hello.txt",
+				AbsolutePath: "s3://src/files/hello.txt",
+				filestore:    src,
+			},
+			Dest: &syncFileInfo{
+				RelativePath: "hello.txt",
+				AbsolutePath: "s3://dest/release/hello.txt",
+				filestore:    dest,
+			},
+			ManifestFile: &api.File{
+				Name:   "hello.txt",
+				SHA256: test.sha256,
+				SHA512: test.sha512,
+			},
+			VerifyReadBack: test.verifyReadBack,
+		}
+
+		err := op.Run(context.Background())
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			if !bytes.Equal(client.objects["dest/release/hello.txt"], content) {
+				t.Errorf("%s: file was not copied", test.name)
+			}
+			contentType := client.contentTypes["dest/release/hello.txt"]
+			if contentType != "text/plain; charset=utf-8" {
+				t.Errorf("%s: unexpected content type %q",
+					test.name, contentType)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error %q, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxLargestFiles is the number of files that TotalFileSizeError lists.
+const maxLargestFiles = 5
+
+// bytesPerMiB is the number of bytes in a MiB.
+const bytesPerMiB = 1024 * 1024
+
+// FileSize is the size of a file to be uploaded.
+type FileSize struct {
+	// Path is the absolute path of the file in the source filestore.
+	Path string
+	Size int64
+}
+
+// TotalFileSizeError is returned by CheckTotalFileSize when the files to be
+// uploaded are too large.
+type TotalFileSizeError struct {
+	// MaxTotalSize and TotalSize are in MiB.
+	MaxTotalSize int64
+	TotalSize    int64
+
+	// LargestFiles are the largest files to be uploaded, largest first.
+	LargestFiles []FileSize
+}
+
+// Error implements the error interface.
+func (err TotalFileSizeError) Error() string {
+	lines := make([]string, 0, len(err.LargestFiles))
+	for _, file := range err.LargestFiles {
+		lines = append(lines, fmt.Sprintf(
+			"%s (%d MiB)", file.Path, bytesToMiB(file.Size)))
+	}
+
+	return fmt.Sprintf("the files to upload total %dMiB, which is over the "+
+		"max total file size of %dMiB; the largest files are:\n%s",
+		err.TotalSize, err.MaxTotalSize, strings.Join(lines, "\n"))
+}
+
+// CheckTotalFileSize returns a TotalFileSizeError if the files copied by the
+// operations add up to more than maxTotalSize (in MiB). A maxTotalSize of 0
+// (or less) disables the check.
+//
+// The sizes of the files are the ones reported by the source filestore; the
+// size recorded in the manifest (if any) is only used if the filestore does
+// not report one (a negative size, e.g. from an HTTP server that sends no
+// Content-Length, is unknown). Files of unknown size count as empty.
+func CheckTotalFileSize(ops []SyncFileOp, maxTotalSize int64) error {
+	if maxTotalSize <= 0 {
+		return nil
+	}
+
+	var totalSize int64
+	var files []FileSize
+	for _, op := range ops {
+		copyOp, ok := op.(*copyFileOp)
+		if !ok {
+			continue
+		}
+
+		size := copyOp.Source.Size
+		if size <= 0 && copyOp.ManifestFile != nil {
+			size = copyOp.ManifestFile.Size
+		}
+		if size < 0 {
+			size = 0
+		}
+
+		totalSize += size
+		files = append(files, FileSize{
+			Path: copyOp.Source.AbsolutePath,
+			Size: size,
+		})
+	}
+
+	if totalSize <= maxTotalSize*bytesPerMiB {
+		return nil
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(files) > maxLargestFiles {
+		files = files[:maxLargestFiles]
+	}
+
+	return TotalFileSizeError{
+		MaxTotalSize: maxTotalSize,
+		TotalSize:    bytesToMiB(totalSize),
+		LargestFiles: files,
+	}
+}
+
+// bytesToMiB converts bytes to MiB, rounding up (so that a total just over the
+// limit is not reported as being at the limit).
+func bytesToMiB(size int64) int64 {
+	return (size + bytesPerMiB - 1) / bytesPerMiB
+}
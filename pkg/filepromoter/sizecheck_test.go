@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filepromoter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	api "sigs.k8s.io/k8s-container-image-promoter/pkg/api/files"
+)
+
+func TestCheckTotalFileSize(t *testing.T) {
+	mkOp := func(name string, size, manifestSize int64) SyncFileOp {
+		return &copyFileOp{
+			Source: &syncFileInfo{
+				RelativePath: name,
+				AbsolutePath: "gs://src/" + name,
+				Size:         size,
+			},
+			ManifestFile: &api.File{Name: name, Size: manifestSize},
+		}
+	}
+
+	var ops []SyncFileOp
+	for i := 1; i <= 6; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		ops = append(ops, mkOp(name, int64(i)*bytesPerMiB, 0))
+	}
+	// The size of the manifest is only used if the filestore reports none.
+	ops = append(ops, mkOp("manifest-size", 0, 10*bytesPerMiB))
+	ops = append(ops, mkOp("both-sizes", bytesPerMiB/2, 100*bytesPerMiB))
+	// A negative size is unknown too; without a size in the manifest, the file
+	// counts as empty.
+	ops = append(ops, mkOp("unknown-size", -1, 2*bytesPerMiB))
+	ops = append(ops, mkOp("no-size", -1, 0))
+	// Other operations are ignored.
+	ops = append(ops, &fakeOp{name: "other"})
+
+	var tests = []struct {
+		name          string
+		maxTotalSize  int64
+		expectedError error
+	}{
+		{
+			name:         "No limit",
+			maxTotalSize: 0,
+		},
+		{
+			name:         "At the limit",
+			maxTotalSize: 34,
+		},
+		{
+			name:         "Over the limit",
+			maxTotalSize: 33,
+			expectedError: TotalFileSizeError{
+				MaxTotalSize: 33,
+				TotalSize:    34,
+				LargestFiles: []FileSize{
+					{Path: "gs://src/manifest-size", Size: 10 * bytesPerMiB},
+					{Path: "gs://src/file-6", Size: 6 * bytesPerMiB},
+					{Path: "gs://src/file-5", Size: 5 * bytesPerMiB},
+					{Path: "gs://src/file-4", Size: 4 * bytesPerMiB},
+					{Path: "gs://src/file-3", Size: 3 * bytesPerMiB},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		err := CheckTotalFileSize(ops, test.maxTotalSize)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Errorf("%s: expected error %v, got %v",
+				test.name, test.expectedError, err)
+		}
+	}
+
+	expectedMessage := `the files to upload total 34MiB, which is over the ` +
+		`max total file size of 33MiB; the largest files are:
+gs://src/manifest-size (10 MiB)
+gs://src/file-6 (6 MiB)
+gs://src/file-5 (5 MiB)
+gs://src/file-4 (4 MiB)
+gs://src/file-3 (3 MiB)`
+	if err := CheckTotalFileSize(ops, 33); err.Error() != expectedMessage {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -348,13 +349,17 @@ func (t *E2ETest) clearRepositories() error {
 		return err
 	}
 
-	sc.ReadRegistries(
+	err = sc.ReadRegistries(
+		context.Background(),
 		sc.RegistryContexts,
 		// Read all registries recursively, because we want to delete every
 		// image found in it (clearRepository works by deleting each image found
 		// in sc.Inv).
 		true,
 		reg.MkReadRepositoryCmdReal)
+	if err != nil {
+		return err
+	}
 
 	// Clear ALL registries in the test manifest. Blank slate!
 	for _, rc := range t.Registries {